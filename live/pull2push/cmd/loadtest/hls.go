@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ====================== HLS 观众 ======================
+
+// hlsLiveEdge 起播时从倒数第几个分片开始，和常见播放器一致
+const hlsLiveEdge = 3
+
+// hlsState 一个 HLS 观众的播放列表状态
+type hlsState struct {
+	lastSeq uint64            // 上一次播放列表的 MEDIA-SEQUENCE
+	uris    map[uint64]string // 分片序号 -> 地址，用来校验同一个序号的分片不会变
+	next    uint64            // 下一个要下载的分片序号
+	started bool
+}
+
+// runHLS 像播放器一样轮询播放列表、按顺序下载分片
+func (v *viewer) runHLS(ctx context.Context) error {
+	playlistURL, err := url.Parse(v.url)
+	if err != nil {
+		return err
+	}
+	st := &hlsState{uris: make(map[uint64]string)}
+
+	for {
+		pl, err := v.fetchPlaylist(ctx, playlistURL)
+		if err != nil {
+			return err
+		}
+		if master, ok := pl.(*m3u8.MasterPlaylist); ok {
+			// 多码率时取第一个码率
+			if len(master.Variants) == 0 {
+				return fmt.Errorf("master playlist 没有码率")
+			}
+			ref, err := url.Parse(master.Variants[0].URI)
+			if err != nil {
+				return err
+			}
+			playlistURL = playlistURL.ResolveReference(ref)
+			continue
+		}
+		media := pl.(*m3u8.MediaPlaylist)
+
+		downloaded, err := v.checkPlaylist(ctx, st, playlistURL, media)
+		if err != nil {
+			return err
+		}
+		if media.Closed {
+			return fmt.Errorf("播放列表已结束（EXT-X-ENDLIST）")
+		}
+		// 没有新分片时按规范等半个 target duration 再刷新
+		wait := time.Duration(media.TargetDuration * float64(time.Second) / 2)
+		if downloaded > 0 || wait <= 0 {
+			wait = 100 * time.Millisecond
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// checkPlaylist 校验序号单调，并下载还没有下载过的分片，返回下载的分片数
+func (v *viewer) checkPlaylist(ctx context.Context, st *hlsState, base *url.URL, media *m3u8.MediaPlaylist) (int, error) {
+	r := v.result
+	if st.started && media.SeqNo < st.lastSeq {
+		r.violation("MEDIA-SEQUENCE 回退 %d -> %d", st.lastSeq, media.SeqNo)
+	}
+	st.lastSeq = media.SeqNo
+
+	var segs []*m3u8.MediaSegment
+	for _, s := range media.Segments {
+		if s != nil {
+			segs = append(segs, s)
+		}
+	}
+	for i, s := range segs {
+		seq := media.SeqNo + uint64(i)
+		if old, ok := st.uris[seq]; ok && old != s.URI {
+			r.violation("分片 %d 的地址变了 %s -> %s", seq, old, s.URI)
+		}
+		st.uris[seq] = s.URI
+	}
+	for seq := range st.uris {
+		if seq < media.SeqNo {
+			delete(st.uris, seq)
+		}
+	}
+	if len(segs) == 0 {
+		return 0, nil
+	}
+
+	if !st.started {
+		st.started = true
+		st.next = media.SeqNo + uint64(max(0, len(segs)-hlsLiveEdge))
+	}
+	if st.next < media.SeqNo {
+		// 下载太慢，分片已经滑出了列表
+		r.Dropped += int(media.SeqNo - st.next)
+		st.next = media.SeqNo
+	}
+
+	downloaded := 0
+	for ; st.next < media.SeqNo+uint64(len(segs)); st.next++ {
+		s := segs[st.next-media.SeqNo]
+		ref, err := url.Parse(s.URI)
+		if err != nil {
+			return downloaded, err
+		}
+		if err := v.fetchSegment(ctx, base.ResolveReference(ref).String()); err != nil {
+			return downloaded, err
+		}
+		now := time.Now()
+		v.start(now)
+		v.player.advance(now, time.Duration(s.Duration*float64(time.Second)))
+		r.Frames++
+		downloaded++
+	}
+	return downloaded, nil
+}
+
+func (v *viewer) fetchPlaylist(ctx context.Context, u *url.URL) (m3u8.Playlist, error) {
+	body, err := v.get(ctx, u.String())
+	if err != nil {
+		return nil, err
+	}
+	pl, _, err := m3u8.Decode(*bytes.NewBuffer(body), true)
+	if err != nil {
+		return nil, fmt.Errorf("解析播放列表失败: %w", err)
+	}
+	return pl, nil
+}
+
+// fetchSegment 下载分片，TS 分片校验同步字节
+func (v *viewer) fetchSegment(ctx context.Context, u string) error {
+	body, err := v.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(strings.SplitN(u, "?", 2)[0], ".ts") {
+		if len(body) == 0 || len(body)%188 != 0 {
+			v.result.violation("TS 分片长度 %d 不是 188 的整数倍", len(body))
+		}
+		for i := 0; i+188 <= len(body); i += 188 {
+			if body[i] != 0x47 {
+				v.result.violation("TS 分片第 %d 个包同步字节错误", i/188)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (v *viewer) get(ctx context.Context, u string) ([]byte, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, v.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("GET %s: HTTP %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	v.addBytes(len(body))
+	return body, err
+}
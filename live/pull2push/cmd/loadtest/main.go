@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"pull2push/core/synthetic"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+loadtest 观众压测工具：同时打开 N 个 FLV / HLS / WS 观众，校验收到的流并统计起播时间、卡顿、吞吐和丢帧
+
+	go run ./cmd/loadtest -url "http://127.0.0.1:8080/live/flv/test-synthetic/{id}" -n 500 -ramp 10s -d 1m
+	go run ./cmd/loadtest -url "http://127.0.0.1:8080/live/hls/test-synthetic/{id}/index.m3u8" -n 200
+	go run ./cmd/loadtest -url "ws://127.0.0.1:8080/live/ws/test-synthetic/{id}" -n 500
+
+	{id} 会替换成每个观众自己的编号（lt-1、lt-2 ...），pull2push 按 clientId 区分观众。
+	不想依赖真实上游时有两种办法：
+		1. 配置文件里用 type: synthetic 的流（进程内生成）
+		2. -upstream-listen :9000 在压测进程里起一个合成流上游，pull2push 按普通 flv / hls 流去拉
+		   http://127.0.0.1:9000/live.flv、http://127.0.0.1:9000/live.m3u8，只给 -upstream-listen 不给 -url 时只提供上游
+*/
+
+// Options 压测参数
+type Options struct {
+	URL      string
+	Mode     string        // flv / hls / ws，为空时按 url 判断
+	Viewers  int           // 观众数
+	Ramp     time.Duration // 在这段时间内均匀地建立连接，避免瞬间把服务端打满
+	Duration time.Duration // 每个观众连接后观看多久
+	Timeout  time.Duration // 连接 / 响应头 / 单次请求超时
+	Stall    time.Duration // 播放位置追上缓冲区超过多久算一次卡顿
+}
+
+const (
+	ModeFLV = "flv"
+	ModeHLS = "hls"
+	ModeWS  = "ws"
+)
+
+func main() {
+	var opts Options
+	var upstreamListen, upstreamQuery string
+	var jsonOut bool
+	flag.StringVar(&opts.URL, "url", "", "拉流地址，{id} 替换为观众编号")
+	flag.StringVar(&opts.Mode, "mode", "", "flv / hls / ws，默认按 url 判断")
+	flag.IntVar(&opts.Viewers, "n", 100, "并发观众数")
+	flag.DurationVar(&opts.Ramp, "ramp", 10*time.Second, "建立全部连接用的时间")
+	flag.DurationVar(&opts.Duration, "d", time.Minute, "每个观众的观看时长")
+	flag.DurationVar(&opts.Timeout, "timeout", 10*time.Second, "连接和请求超时")
+	flag.DurationVar(&opts.Stall, "stall", 500*time.Millisecond, "缓冲区耗尽超过多久算一次卡顿")
+	flag.StringVar(&upstreamListen, "upstream-listen", "", "在本进程里启动合成流上游的监听地址，例如 :9000")
+	flag.StringVar(&upstreamQuery, "upstream", "", "合成流参数，例如 width=640&height=360&fps=25&gop=50")
+	flag.BoolVar(&jsonOut, "json", false, "以 JSON 输出报告")
+	flag.Parse()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if upstreamListen != "" {
+		if err := serveUpstream(upstreamListen, upstreamQuery); err != nil {
+			log.Fatal(err)
+		}
+		if opts.URL == "" {
+			<-ctx.Done()
+			return
+		}
+	}
+
+	if err := opts.normalize(); err != nil {
+		log.Fatal(err)
+	}
+	report := run(ctx, opts)
+	if jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+	report.Print(os.Stdout)
+}
+
+func (o *Options) normalize() error {
+	if o.URL == "" {
+		return fmt.Errorf("缺少 -url")
+	}
+	if o.Viewers <= 0 {
+		return fmt.Errorf("观众数 %d 无效", o.Viewers)
+	}
+	if o.Mode == "" {
+		switch {
+		case strings.HasPrefix(o.URL, "ws://") || strings.HasPrefix(o.URL, "wss://"):
+			o.Mode = ModeWS
+		case strings.Contains(o.URL, ".m3u8"):
+			o.Mode = ModeHLS
+		default:
+			o.Mode = ModeFLV
+		}
+	}
+	switch o.Mode {
+	case ModeFLV, ModeHLS, ModeWS:
+	default:
+		return fmt.Errorf("不支持的 mode %s", o.Mode)
+	}
+	return nil
+}
+
+// serveUpstream 在后台启动合成流上游
+func serveUpstream(addr, query string) error {
+	synOpts, err := synthetic.ParseOptions("synthetic://?" + query)
+	if err != nil {
+		return err
+	}
+	server, err := synthetic.NewServer(synOpts)
+	if err != nil {
+		return err
+	}
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, server))
+	}()
+	log.Printf("synthetic upstream on %s: /live.flv /live.m3u8 (%dx%d %dfps gop %d)", addr, synOpts.Width, synOpts.Height, synOpts.FPS, synOpts.GOP)
+	return nil
+}
+
+// progress 压测过程中的实时计数
+type progress struct {
+	active  atomic.Int64
+	started atomic.Int64
+	failed  atomic.Int64
+	bytes   atomic.Int64
+}
+
+// run 按 ramp 节奏启动所有观众，等全部结束后汇总
+func run(ctx context.Context, opts Options) *Report {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConnsPerHost:   opts.Viewers,
+		ResponseHeaderTimeout: opts.Timeout,
+		DisableCompression:    true,
+	}
+	client := &http.Client{Transport: transport}
+	defer transport.CloseIdleConnections()
+
+	var p progress
+	results := make([]*Result, opts.Viewers)
+	var wg sync.WaitGroup
+
+	stopProgress := make(chan struct{})
+	go printProgress(&p, opts, stopProgress)
+
+	interval := opts.Ramp / time.Duration(opts.Viewers)
+	begin := time.Now()
+launch:
+	for i := 0; i < opts.Viewers; i++ {
+		if wait := time.Until(begin.Add(interval * time.Duration(i))); wait > 0 {
+			select {
+			case <-ctx.Done():
+				break launch
+			case <-time.After(wait):
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v := &viewer{
+				id:     fmt.Sprintf("lt-%d", i+1),
+				opts:   opts,
+				client: client,
+				p:      &p,
+			}
+			v.url = strings.ReplaceAll(opts.URL, "{id}", v.id)
+			results[i] = v.run(ctx)
+		}()
+	}
+	wg.Wait()
+	close(stopProgress)
+
+	return buildReport(opts, results, time.Since(begin))
+}
+
+// printProgress 每 5 秒输出一次当前状态
+func printProgress(p *progress, opts Options, stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var lastBytes int64
+	last := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			total := p.bytes.Load()
+			mbps := float64(total-lastBytes) * 8 / now.Sub(last).Seconds() / 1e6
+			lastBytes, last = total, now
+			log.Printf("[%s] active %d/%d started %d failed %d, %.1f Mbps", opts.Mode, p.active.Load(), opts.Viewers, p.started.Load(), p.failed.Load(), mbps)
+		}
+	}
+}
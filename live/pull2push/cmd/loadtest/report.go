@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// ====================== Report ======================
+
+// Percentiles 一组数值的分位数
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// Report 压测汇总
+type Report struct {
+	Mode       string         `json:"mode"`
+	URL        string         `json:"url"`
+	Viewers    int            `json:"viewers"`
+	Started    int            `json:"started"`    // 成功起播的观众
+	Failed     int            `json:"failed"`     // 连接失败、未起播或中途断开的观众
+	Elapsed    time.Duration  `json:"elapsed"`    // 整个压测用时
+	TotalMbps  float64        `json:"totalMbps"`  // 所有观众的吞吐之和（按各自观看时长计算）
+	Violations int            `json:"violations"` // 校验问题总数
+	Errors     map[string]int `json:"errors,omitempty"`
+	Samples    []string       `json:"samples,omitempty"` // 校验问题示例
+
+	StartupMs   Percentiles `json:"startupMs"`
+	Stalls      Percentiles `json:"stalls"`
+	StallMs     Percentiles `json:"stallMs"`
+	Kbps        Percentiles `json:"kbps"`
+	DropPercent Percentiles `json:"dropPercent"`
+
+	Results []*Result `json:"results"`
+}
+
+// percentiles 最近秩法计算分位数，values 会被排序
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sort.Float64s(values)
+	at := func(q float64) float64 {
+		i := int(math.Ceil(q*float64(len(values)))) - 1
+		return values[max(0, min(i, len(values)-1))]
+	}
+	return Percentiles{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: values[len(values)-1]}
+}
+
+func buildReport(opts Options, results []*Result, elapsed time.Duration) *Report {
+	report := &Report{
+		Mode:    opts.Mode,
+		URL:     opts.URL,
+		Viewers: opts.Viewers,
+		Elapsed: elapsed,
+		Errors:  make(map[string]int),
+	}
+	var startup, stalls, stallMs, kbps, drop []float64
+	for _, r := range results {
+		if r == nil {
+			// ctx 取消时还没启动的观众
+			continue
+		}
+		report.Results = append(report.Results, r)
+		if r.Err != "" {
+			report.Failed++
+			report.Errors[r.Err]++
+		}
+		report.Violations += r.Violations
+		for _, s := range r.Samples {
+			if len(report.Samples) < 20 {
+				report.Samples = append(report.Samples, r.Id+": "+s)
+			}
+		}
+		if !r.Started {
+			continue
+		}
+		report.Started++
+		report.TotalMbps += r.KbpsValue() / 1000
+		startup = append(startup, float64(r.Startup.Milliseconds()))
+		stalls = append(stalls, float64(r.Stalls))
+		stallMs = append(stallMs, float64(r.StallTime.Milliseconds()))
+		kbps = append(kbps, r.KbpsValue())
+		drop = append(drop, r.DropRate()*100)
+	}
+	report.StartupMs = percentiles(startup)
+	report.Stalls = percentiles(stalls)
+	report.StallMs = percentiles(stallMs)
+	report.Kbps = percentiles(kbps)
+	report.DropPercent = percentiles(drop)
+	return report
+}
+
+// Print 文本报告
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "\n%s %s\n", r.Mode, r.URL)
+	fmt.Fprintf(w, "viewers %d, started %d, failed %d, elapsed %s, total %.1f Mbps\n\n",
+		r.Viewers, r.Started, r.Failed, r.Elapsed.Round(time.Millisecond), r.TotalMbps)
+
+	fmt.Fprintf(w, "%-16s %10s %10s %10s %10s\n", "", "p50", "p90", "p99", "max")
+	rows := []struct {
+		name string
+		p    Percentiles
+	}{
+		{"startup (ms)", r.StartupMs},
+		{"stalls", r.Stalls},
+		{"stall time (ms)", r.StallMs},
+		{"throughput kbps", r.Kbps},
+		{"drop rate (%)", r.DropPercent},
+	}
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-16s %10.1f %10.1f %10.1f %10.1f\n", row.name, row.p.P50, row.p.P90, row.p.P99, row.p.Max)
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintln(w, "\nerrors:")
+		for msg, n := range r.Errors {
+			fmt.Fprintf(w, "  %5d  %s\n", n, msg)
+		}
+	}
+	if r.Violations > 0 {
+		fmt.Fprintf(w, "\nstream validation: %d problems\n", r.Violations)
+		for _, s := range r.Samples {
+			fmt.Fprintf(w, "  %s\n", s)
+		}
+	} else {
+		fmt.Fprintln(w, "\nstream validation: ok")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	flvBroker "pull2push/core/broker/flv"
+	"time"
+)
+
+// ====================== viewer ======================
+
+// maxViolations 每个观众最多记录多少条校验问题的原文，计数不受限制
+const maxViolations = 5
+
+// Result 一个观众的统计结果
+type Result struct {
+	Id         string        `json:"id"`
+	Err        string        `json:"error,omitempty"` // 连接失败或中途断开的原因，正常看完为空
+	Started    bool          `json:"started"`         // 是否起播
+	Startup    time.Duration `json:"startup"`         // 发起请求到可以播放（首个关键帧 / 首个分片）
+	Stalls     int           `json:"stalls"`          // 卡顿次数
+	StallTime  time.Duration `json:"stallTime"`       // 卡顿总时长
+	Bytes      int64         `json:"bytes"`
+	Watched    time.Duration `json:"watched"`    // 起播后观看的时长
+	Frames     int           `json:"frames"`     // flv / ws：视频帧数；hls：分片数
+	Dropped    int           `json:"dropped"`    // flv / ws：按时间戳间隔估计的丢帧数；hls：来不及下载就滑出列表的分片数
+	Violations int           `json:"violations"` // 校验不通过的次数
+	Samples    []string      `json:"samples,omitempty"`
+}
+
+// KbpsValue 起播后的平均吞吐
+func (r *Result) KbpsValue() float64 {
+	if r.Watched <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) * 8 / r.Watched.Seconds() / 1000
+}
+
+// DropRate 丢帧（丢分片）比例
+func (r *Result) DropRate() float64 {
+	if r.Frames+r.Dropped == 0 {
+		return 0
+	}
+	return float64(r.Dropped) / float64(r.Frames+r.Dropped)
+}
+
+func (r *Result) violation(format string, args ...any) {
+	r.Violations++
+	if len(r.Samples) < maxViolations {
+		r.Samples = append(r.Samples, fmt.Sprintf(format, args...))
+	}
+}
+
+type viewer struct {
+	id     string
+	url    string
+	opts   Options
+	client *http.Client
+	p      *progress
+
+	result *Result
+	player player
+	begin  time.Time
+}
+
+// run 观看 opts.Duration 后返回，ctx 取消时提前结束
+func (v *viewer) run(ctx context.Context) *Result {
+	v.result = &Result{Id: v.id}
+	v.player.threshold = v.opts.Stall
+	v.begin = time.Now()
+
+	v.p.active.Add(1)
+	defer v.p.active.Add(-1)
+
+	ctx, cancel := context.WithTimeout(ctx, v.opts.Duration)
+	defer cancel()
+
+	var err error
+	switch v.opts.Mode {
+	case ModeFLV:
+		err = v.runFLV(ctx)
+	case ModeWS:
+		err = v.runWS(ctx)
+	case ModeHLS:
+		err = v.runHLS(ctx)
+	}
+	now := time.Now()
+	v.player.finish(now)
+	v.result.Stalls = v.player.stalls
+	v.result.StallTime = v.player.stallTotal
+	if v.result.Started {
+		v.result.Watched = now.Sub(v.player.startWall)
+	}
+	// 观看时长到了属于正常结束
+	if err != nil && ctx.Err() == nil {
+		v.result.Err = err.Error()
+	} else if !v.result.Started {
+		v.result.Err = "未起播"
+	}
+	if v.result.Err != "" {
+		v.p.failed.Add(1)
+	}
+	return v.result
+}
+
+// start 第一次可以播放
+func (v *viewer) start(now time.Time) {
+	if v.result.Started {
+		return
+	}
+	v.result.Started = true
+	v.result.Startup = now.Sub(v.begin)
+	v.player.startWall = now
+	v.p.started.Add(1)
+}
+
+func (v *viewer) addBytes(n int) {
+	v.result.Bytes += int64(n)
+	v.p.bytes.Add(int64(n))
+}
+
+// ====================== player ======================
+
+/*
+player 简化的播放器模型，用来判断卡顿
+
+	起播后播放位置按墙上时间前进，收到的媒体时长是缓冲区；播放位置追上缓冲区就开始卡顿，
+	直到再收到数据为止。卡顿期间播放位置不动，卡顿时间超过 threshold 才计一次，
+	避免直播边缘正常的帧间抖动被算成卡顿。
+*/
+type player struct {
+	threshold  time.Duration
+	startWall  time.Time
+	buffered   time.Duration // 起播后收到的媒体时长
+	stallTotal time.Duration
+	stalls     int
+}
+
+// advance 收到了 d 时长的媒体数据
+func (p *player) advance(now time.Time, d time.Duration) {
+	p.catchUp(now)
+	p.buffered += d
+}
+
+// catchUp 到 now 为止，如果缓冲区已经用完，把等待的时间记为卡顿
+func (p *player) catchUp(now time.Time) {
+	if p.startWall.IsZero() {
+		return
+	}
+	// 缓冲区耗尽的时刻
+	drained := p.startWall.Add(p.buffered + p.stallTotal)
+	if stall := now.Sub(drained); stall > 0 {
+		p.stallTotal += stall
+		if stall >= p.threshold {
+			p.stalls++
+		}
+	}
+}
+
+func (p *player) finish(now time.Time) {
+	p.catchUp(now)
+}
+
+// ====================== FLV 校验 ======================
+
+// flvChecker 逐个 tag 校验 FLV 流，并推动播放器模型
+type flvChecker struct {
+	v *viewer
+
+	lastTs      [32]int64 // 每种 tag 上一次的时间戳，-1 表示还没有
+	seenVideoSH bool
+	started     bool
+	mediaTs     int64 // 起播后最大的媒体时间戳
+	frameGap    int64 // 观察到的最小视频帧间隔，用来估计丢帧
+	lastVideo   int64
+}
+
+// maxTimestampJump 相邻 tag 时间戳跳变超过这个值视为不连续
+const maxTimestampJump = 5000
+
+func newFLVChecker(v *viewer) *flvChecker {
+	c := &flvChecker{v: v, lastVideo: -1}
+	for i := range c.lastTs {
+		c.lastTs[i] = -1
+	}
+	return c
+}
+
+// check 读 FLV 头后逐个 tag 校验，直到读出错
+func (c *flvChecker) check(r *bufio.Reader) error {
+	header, err := flvBroker.ReadFLVHeader(r)
+	if err != nil {
+		return err
+	}
+	c.v.addBytes(len(header))
+	if header[4]&0x01 == 0 {
+		c.v.result.violation("FLV 头没有视频标记")
+	}
+
+	var hdr [flvBroker.FLVTagHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			return err
+		}
+		tagType := hdr[0] & 0x1F
+		size := int(hdr[1])<<16 | int(hdr[2])<<8 | int(hdr[3])
+		ts := int64(uint32(hdr[4])<<16 | uint32(hdr[5])<<8 | uint32(hdr[6]) | uint32(hdr[7])<<24)
+		if tagType != flvBroker.TagTypeAudio && tagType != flvBroker.TagTypeVideo && tagType != flvBroker.TagTypeScript {
+			// 类型错了说明数据已经错位，后面没法继续解析
+			return fmt.Errorf("tag 类型 %d 无效，数据错位", tagType)
+		}
+		// 只保留判断关键帧 / 序列头需要的前几个字节，其余直接丢弃
+		head, err := r.Peek(min(size, 8))
+		if err != nil {
+			return err
+		}
+		tag := &flvBroker.FlvTag{TagType: tagType, DataSize: uint32(size), Timestamp: uint32(ts), Data: append([]byte(nil), head...)}
+		if _, err := r.Discard(size); err != nil {
+			return err
+		}
+		var pts [flvBroker.PrevTagSizeLength]byte
+		if _, err := io.ReadFull(r, pts[:]); err != nil {
+			return err
+		}
+		if prev := binary.BigEndian.Uint32(pts[:]); prev != uint32(size+flvBroker.FLVTagHeaderSize) {
+			c.v.result.violation("PreviousTagSize %d 和 tag 大小 %d 不一致", prev, size+flvBroker.FLVTagHeaderSize)
+		}
+		c.v.addBytes(flvBroker.FLVTagHeaderSize + size + flvBroker.PrevTagSizeLength)
+		c.onTag(tag, time.Now())
+	}
+}
+
+func (c *flvChecker) onTag(tag *flvBroker.FlvTag, now time.Time) {
+	r := c.v.result
+	ts := int64(tag.Timestamp)
+
+	if tag.TagType == flvBroker.TagTypeScript {
+		return
+	}
+	if tag.IsSequenceHeader() {
+		if tag.TagType == flvBroker.TagTypeVideo {
+			c.seenVideoSH = true
+		}
+		return
+	}
+
+	// 视频元数据、序列结束等不携带画面的包不参与统计
+	if tag.TagType == flvBroker.TagTypeVideo {
+		if h := tag.VideoHeader(); h == nil || !h.IsCodedFrame() {
+			return
+		}
+	}
+
+	// 每条轨道的时间戳不能回退，也不能突然大跳
+	if last := c.lastTs[tag.TagType]; last >= 0 {
+		if ts < last {
+			r.violation("%s 时间戳回退 %d -> %d", trackName(tag.TagType), last, ts)
+		} else if ts-last > maxTimestampJump {
+			r.violation("%s 时间戳跳变 %d -> %d", trackName(tag.TagType), last, ts)
+		}
+	}
+	c.lastTs[tag.TagType] = ts
+
+	if tag.TagType == flvBroker.TagTypeVideo {
+		if !c.started {
+			if !tag.IsKeyFrame() {
+				r.violation("第一个视频帧不是关键帧")
+			}
+			// H.264 / H.265 / AV1 / VP9 都要先有解码配置
+			if !c.seenVideoSH && tag.VideoHeader().CodecID != 0 {
+				r.violation("关键帧之前没有视频序列头")
+			}
+			c.started = true
+			c.mediaTs = ts
+			c.v.start(now)
+		}
+		c.countFrame(ts)
+	}
+	if !c.started {
+		return
+	}
+	// 缓冲区按最大的媒体时间戳计算，时间戳异常时不推进，避免把跳变算成缓冲
+	if ts > c.mediaTs && ts-c.mediaTs <= maxTimestampJump {
+		c.v.player.advance(now, time.Duration(ts-c.mediaTs)*time.Millisecond)
+		c.mediaTs = ts
+	} else {
+		c.v.player.catchUp(now)
+		if ts-c.mediaTs > maxTimestampJump {
+			c.mediaTs = ts
+		}
+	}
+}
+
+// countFrame 统计视频帧，相邻帧间隔明显大于正常帧间隔时按缺了几帧估计丢帧
+func (c *flvChecker) countFrame(ts int64) {
+	r := c.v.result
+	r.Frames++
+	defer func() { c.lastVideo = ts }()
+	if c.lastVideo < 0 {
+		return
+	}
+	gap := ts - c.lastVideo
+	if gap <= 0 || gap > maxTimestampJump {
+		return
+	}
+	if c.frameGap == 0 || gap < c.frameGap {
+		c.frameGap = gap
+	}
+	// 前几帧还没有可靠的帧间隔
+	if r.Frames > 10 && gap*2 > c.frameGap*3 {
+		r.Dropped += int((gap+c.frameGap/2)/c.frameGap) - 1
+	}
+}
+
+func trackName(tagType uint8) string {
+	if tagType == flvBroker.TagTypeVideo {
+		return "视频"
+	}
+	return "音频"
+}
+
+// runFLV HTTP-FLV 观众
+func (v *viewer) runFLV(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %s", resp.Status)
+	}
+	err = newFLVChecker(v).check(bufio.NewReaderSize(resp.Body, 64*1024))
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("服务端关闭了连接")
+	}
+	return err
+}
+
+// runWS WebSocket-FLV 观众
+func (v *viewer) runWS(ctx context.Context) error {
+	conn, err := dialWS(ctx, v.url, v.opts.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// ctx 结束时关闭连接，让阻塞的读返回
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err = newFLVChecker(v).check(bufio.NewReaderSize(conn, 64*1024))
+	if errors.Is(err, io.EOF) {
+		return fmt.Errorf("服务端关闭了连接")
+	}
+	return err
+}
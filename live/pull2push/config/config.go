@@ -0,0 +1,505 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// 流类型
+const (
+	StreamTypeFLV       = "flv"       // 按 url 的 scheme 选择数据源：http(s) HTTP-FLV、rtmp、rtsp、udp(TS)
+	StreamTypeTS        = "ts"        // MPEG-TS 上游，http(s):// 按 HTTP-TS 拉取
+	StreamTypeHLS       = "hls"       // m3u8 拉流
+	StreamTypeCamera    = "camera"    // 摄像头 / ffmpeg 通过 HTTP POST 推流，没有上游地址
+	StreamTypeSynthetic = "synthetic" // 进程内生成的测试流，url 为 synthetic://?fps=25&gop=50...，可以不填
+	StreamTypeFile      = "file"      // 按真实时间循环播放本地文件，url 为 file:///path/a.flv，或者配置 playlist
+)
+
+// HTTPConfig HTTP 服务配置，修改后需要重启
+type HTTPConfig struct {
+	Listen []string   `yaml:"listen"` // 监听地址，可以同时监听多个
+	CORS   CORSConfig `yaml:"cors"`
+}
+
+type CORSConfig struct {
+	AllowOrigins     []string      `yaml:"allow_origins"`
+	AllowMethods     []string      `yaml:"allow_methods"`
+	AllowHeaders     []string      `yaml:"allow_headers"`
+	ExposeHeaders    []string      `yaml:"expose_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+// CacheConfig 各类 broker 的缓存大小，单个流没有单独配置时使用
+type CacheConfig struct {
+	HLSSegments int `yaml:"hls_segments"` // HLS 环形缓冲保留的分片数
+	CameraGOP   int `yaml:"camera_gop"`   // camera 缓存的最大包数
+
+	StartCacheConfig `yaml:",inline"` // 起播缓存策略的默认值
+}
+
+// 起播方式，对应拉流地址的 ?start= 参数
+const (
+	StartLive   = "live"   // 不要缓存，从下一个关键帧开始，延迟最低，适合互动直播
+	StartGOP    = "gop"    // 从最近一个关键帧开始，秒开
+	StartBuffer = "buffer" // 按起播缓存策略给更多历史数据，播放器缓冲更足，适合被动观看
+)
+
+// StartCacheConfig flv / ts / synthetic / file / camera 的起播缓存策略：新观众先收到多少历史数据，
+// 单个流没有单独配置的项使用 cache 里的值，观众可以用 ?start= 覆盖起播方式
+type StartCacheConfig struct {
+	GOPs     int           `yaml:"gops"`      // 保留最近几个 GOP，默认 1
+	Duration time.Duration `yaml:"duration"`  // 保留最近多长时间，配置了就不看 gops
+	MaxBytes ByteSize      `yaml:"max_bytes"` // 起播数据的字节上限，最近一个 GOP 总是保留；0 不限制
+	Start    string        `yaml:"start"`     // 观众没有带 ?start= 时的起播方式：live / gop / buffer，默认 buffer
+
+	ClipWindow time.Duration `yaml:"clip_window"` // 缓存至少保留多长时间，供导出片段（POST /live/clips），不影响起播；0 只能导出起播缓存里的数据
+}
+
+// MemoryConfig 进程内缓存（环形缓冲、HLS 分片、GOP、客户端通道）的内存预算，支持热更新
+type MemoryConfig struct {
+	Limit         ByteSize `yaml:"limit"`          // 所有流缓存的总预算，超出后缓存只保留最近一个 GOP，0 不限制
+	StreamReserve ByteSize `yaml:"stream_reserve"` // 新增一路流时至少要剩余的预算，不够时拒绝添加
+}
+
+// ClipsConfig 从直播缓存导出片段（POST /live/clips），能往前剪多久由 cache.clip_window 决定
+type ClipsConfig struct {
+	Dir         string        `yaml:"dir"`          // 片段文件的保存目录，默认 clips
+	Retention   time.Duration `yaml:"retention"`    // 导出的片段保留多久，之后删除文件和任务，默认 24h
+	MaxDuration time.Duration `yaml:"max_duration"` // 单个片段的最大时长，end 也最多在这么久之后，默认 10m
+}
+
+// camera 同一路已经有推流时，新推流的处理方式
+const (
+	PublishReject = "reject" // 拒绝新推流，返回 409
+	PublishKick   = "kick"   // 断开旧推流，由新推流接管
+	PublishBackup = "backup" // 新推流排队做备份，当前推流断开时马上接管
+)
+
+// PublishConfig camera 推流断开后的宽限期和重复推流策略，单个流没有单独配置的项使用全局的值，支持热更新
+type PublishConfig struct {
+	Grace       time.Duration `yaml:"grace"`        // 推流断开后保留观众等待重连的时间，超时后断开观众
+	HoldFrame   bool          `yaml:"hold_frame"`   // 宽限期内重复发送最后一个关键帧，播放器停在最后一帧
+	OnDuplicate string        `yaml:"on_duplicate"` // reject / kick / backup
+}
+
+// LimitsConfig 观众准入限制，0 表示不限制，支持热更新；已经在看的观众不受影响
+type LimitsConfig struct {
+	MaxViewers          int     `yaml:"max_viewers"`            // 本节点同时在看的观众数
+	MaxViewersPerStream int     `yaml:"max_viewers_per_stream"` // 单路直播同时在看的观众数
+	MaxBandwidth        BitRate `yaml:"max_bandwidth"`          // 本节点的出口带宽，如 800Mbps
+	MaxSessionsPerToken int     `yaml:"max_sessions_per_token"` // 同一个 token 同时观看的会话数
+	Redirect            bool    `yaml:"redirect"`               // 超出本节点的限制时 302 到集群里的其他节点，没有集群时直接拒绝
+}
+
+// AuthConfig 拉流/推流鉴权，token 通过 ?token= 或者 Authorization: Bearer 传递，支持热更新
+type AuthConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Tokens  []string `yaml:"tokens"`
+}
+
+// AdminConfig 管理接口（/live/admin、/live/sessions、运行时增删转推目标）的鉴权和切换上游、转推的限制，支持热更新
+// tokens 和拉流的 auth.tokens 分开，拉流 token 不能调用管理接口；
+// 没有配置 tokens 时 auth 关闭则不鉴权（本机调试），auth 开启则管理接口全部拒绝
+type AdminConfig struct {
+	Tokens        []string `yaml:"tokens"`
+	SwitchSchemes []string `yaml:"switch_schemes"` // 切换上游允许的协议，默认 http / https / rtmp / rtsp
+	SwitchHosts   []string `yaml:"switch_hosts"`   // 切换上游允许的主机，为空时只允许 streams 里已经配置过的上游主机
+	PushHosts     []string `yaml:"push_hosts"`     // 运行时添加转推目标允许的主机，为空时只允许 streams[].push 里已经配置过的主机
+}
+
+// HooksConfig 事件回调，POST JSON 到对应地址，留空表示不回调；on_play / on_publish 返回非 2xx 时拒绝请求
+type HooksConfig struct {
+	OnPlay      string        `yaml:"on_play"`
+	OnStop      string        `yaml:"on_stop"`
+	OnPublish   string        `yaml:"on_publish"`
+	OnUnpublish string        `yaml:"on_unpublish"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// ClusterConfig origin-edge 集群，nodes 和 registry 都为空时单机运行，修改后需要重启
+type ClusterConfig struct {
+	Self     string        `yaml:"self"`     // 当前节点对外的 HTTP 地址
+	Nodes    []string      `yaml:"nodes"`    // 静态节点列表
+	Registry string        `yaml:"registry"` // 注册中心地址，返回 JSON 字符串数组
+	Refresh  time.Duration `yaml:"refresh"`  // 从注册中心刷新节点的间隔
+	Token    string        `yaml:"token"`    // 节点之间拉流用的 token，开启 auth 时必须配置，这些拉流不受 limits 限制
+}
+
+// StreamConfig 一路直播
+type StreamConfig struct {
+	Key     string   `yaml:"key"`
+	Type    string   `yaml:"type"`
+	URL     string   `yaml:"url"`
+	Variant string   `yaml:"variant"` // hls：固定选择的码率
+	Buffer  int      `yaml:"buffer"`  // hls 分片数 / camera 缓存包数，0 使用 cache 里的默认值
+	Push    []string `yaml:"push"`    // 转推目标
+
+	Publish       PublishConfig `yaml:"publish"`        // camera：宽限期和重复推流策略
+	Fallback      string        `yaml:"fallback"`       // flv / ts / synthetic / file：上游断流时循环插播的本地 FLV / MP4 文件
+	FallbackAfter time.Duration `yaml:"fallback_after"` // 上游多久没有数据开始插播，默认 3s
+
+	Playlist []PlaylistItem `yaml:"playlist"` // file：节目单，配置了就不看 url
+
+	Cache StartCacheConfig `yaml:"cache"` // flv / ts / synthetic / file / camera：起播缓存策略
+}
+
+// PlaylistItem file 类型节目单里的一个文件
+type PlaylistItem struct {
+	File string `yaml:"file"` // 本地文件路径
+	Loop int    `yaml:"loop"` // 连续播放几遍，默认 1
+	At   string `yaml:"at"`   // 每天定时插播的时刻 HH:MM[:SS]，到点打断当前节目；不填则参与轮播
+}
+
+// Config 总配置结构
+type Config struct {
+	HTTP    HTTPConfig     `yaml:"http"`
+	Cache   CacheConfig    `yaml:"cache"`
+	Memory  MemoryConfig   `yaml:"memory"`
+	Clips   ClipsConfig    `yaml:"clips"`
+	Publish PublishConfig  `yaml:"publish"`
+	Limits  LimitsConfig   `yaml:"limits"`
+	Auth    AuthConfig     `yaml:"auth"`
+	Admin   AdminConfig    `yaml:"admin"`
+	Hooks   HooksConfig    `yaml:"hooks"`
+	Cluster ClusterConfig  `yaml:"cluster"`
+	Streams []StreamConfig `yaml:"streams"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+
+	cfg := &Config{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config: %w", err)
+	}
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+// setDefaults 没有配置的项使用原来 main.go 里写死的值
+func (cfg *Config) setDefaults() {
+	if len(cfg.HTTP.Listen) == 0 {
+		cfg.HTTP.Listen = []string{":8080"}
+	}
+	cors := &cfg.HTTP.CORS
+	if len(cors.AllowOrigins) == 0 {
+		cors.AllowOrigins = []string{"*"}
+	}
+	if len(cors.AllowMethods) == 0 {
+		cors.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	}
+	if len(cors.AllowHeaders) == 0 {
+		cors.AllowHeaders = []string{"Origin", "android-device-id", "Content-Type", "Accept", "Authorization", "X-Token", "request-time", "X-Requested-With"}
+	}
+	if len(cors.ExposeHeaders) == 0 {
+		cors.ExposeHeaders = []string{"Content-Length"}
+	}
+	if cors.MaxAge == 0 {
+		cors.MaxAge = 12 * time.Hour
+	}
+	if cfg.Cache.HLSSegments == 0 {
+		cfg.Cache.HLSSegments = 3
+	}
+	if cfg.Cache.CameraGOP == 0 {
+		cfg.Cache.CameraGOP = 150
+	}
+	if len(cfg.Admin.SwitchSchemes) == 0 {
+		cfg.Admin.SwitchSchemes = []string{"http", "https", "rtmp", "rtsp"}
+	}
+	if cfg.Clips.Dir == "" {
+		cfg.Clips.Dir = "clips"
+	}
+	if cfg.Clips.Retention == 0 {
+		cfg.Clips.Retention = 24 * time.Hour
+	}
+	if cfg.Clips.MaxDuration == 0 {
+		cfg.Clips.MaxDuration = 10 * time.Minute
+	}
+	if cfg.Memory.StreamReserve == 0 {
+		cfg.Memory.StreamReserve = 16 << 20
+	}
+	if cfg.Publish.OnDuplicate == "" {
+		cfg.Publish.OnDuplicate = PublishReject
+	}
+	if cfg.Hooks.Timeout == 0 {
+		cfg.Hooks.Timeout = 3 * time.Second
+	}
+	for i := range cfg.Streams {
+		if cfg.Streams[i].Type == "" {
+			cfg.Streams[i].Type = StreamTypeFLV
+		}
+		if cfg.Streams[i].Type == StreamTypeSynthetic && cfg.Streams[i].URL == "" {
+			cfg.Streams[i].URL = "synthetic://"
+		}
+	}
+}
+
+// Validate 检查流定义：key 唯一，类型合法，拉流类型必须有 url
+func (cfg *Config) Validate() error {
+	seen := make(map[string]bool, len(cfg.Streams))
+	for _, s := range cfg.Streams {
+		if s.Key == "" {
+			return errors.New("stream key 不能为空")
+		}
+		if seen[s.Key] {
+			return fmt.Errorf("stream key %s 重复", s.Key)
+		}
+		seen[s.Key] = true
+		switch s.Type {
+		case StreamTypeFLV, StreamTypeTS, StreamTypeHLS:
+			if s.URL == "" {
+				return fmt.Errorf("stream %s 缺少 url", s.Key)
+			}
+		case StreamTypeCamera, StreamTypeSynthetic:
+		case StreamTypeFile:
+			if s.URL == "" && len(s.Playlist) == 0 {
+				return fmt.Errorf("stream %s 缺少 url 或 playlist", s.Key)
+			}
+			for _, item := range s.Playlist {
+				if err := item.validate(); err != nil {
+					return fmt.Errorf("stream %s: %w", s.Key, err)
+				}
+			}
+		default:
+			return fmt.Errorf("stream %s 的类型 %s 不支持", s.Key, s.Type)
+		}
+		if s.Fallback != "" && !s.PullsFLV() {
+			return fmt.Errorf("stream %s: 只有 flv / ts / synthetic / file 支持 fallback", s.Key)
+		}
+		if s.FallbackAfter < 0 {
+			return fmt.Errorf("stream %s: fallback_after 不能为负数", s.Key)
+		}
+		if err := s.Publish.validate(); err != nil {
+			return fmt.Errorf("stream %s: %w", s.Key, err)
+		}
+		if err := s.Cache.validate(); err != nil {
+			return fmt.Errorf("stream %s: %w", s.Key, err)
+		}
+	}
+	if err := cfg.Publish.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Cache.StartCacheConfig.validate(); err != nil {
+		return err
+	}
+	if cfg.Memory.Limit > 0 && cfg.Memory.StreamReserve > cfg.Memory.Limit {
+		return errors.New("memory.stream_reserve 不能大于 memory.limit")
+	}
+	if l := cfg.Limits; l.MaxViewers < 0 || l.MaxViewersPerStream < 0 || l.MaxSessionsPerToken < 0 {
+		return errors.New("limits 不能为负数")
+	}
+	if cfg.Auth.Enabled && len(cfg.Auth.Tokens) == 0 {
+		return errors.New("auth 已开启但没有配置 tokens")
+	}
+	clustered := len(cfg.Cluster.Nodes) > 0 || cfg.Cluster.Registry != ""
+	if clustered && cfg.Cluster.Self == "" {
+		return errors.New("开启集群时必须配置 cluster.self")
+	}
+	if clustered && cfg.Auth.Enabled && cfg.Cluster.Token == "" {
+		return errors.New("开启集群和 auth 时必须配置 cluster.token，否则 edge 从 origin 拉流会被拒绝")
+	}
+	return nil
+}
+
+// CheckSwitchURL 管理后台切换上游时检查新地址，协议和主机都要在 admin 的白名单里，
+// 防止通过管理接口让服务器去请求内网地址或者读取本地文件
+func (cfg *Config) CheckSwitchURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("上游地址 %q 格式不对", raw)
+	}
+	if !slices.Contains(cfg.Admin.SwitchSchemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("不允许切换到 %s 协议的上游", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("上游地址 %q 没有主机", raw)
+	}
+	hosts := cfg.Admin.SwitchHosts
+	if len(hosts) == 0 {
+		for _, s := range cfg.Streams {
+			hosts = appendHost(hosts, s.URL)
+		}
+	}
+	if !containsHost(hosts, u.Hostname()) {
+		return fmt.Errorf("不允许切换到主机 %s", u.Hostname())
+	}
+	return nil
+}
+
+// CheckPushURL 运行时添加转推目标时检查地址，只能推到 admin.push_hosts 里的主机，
+// 防止通过转推接口把直播转发到任意服务器，或者让服务器去请求内网地址
+func (cfg *Config) CheckPushURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("推流地址 %q 格式不对", raw)
+	}
+	if scheme := strings.ToLower(u.Scheme); scheme != "rtmp" && scheme != "http" && scheme != "https" {
+		return fmt.Errorf("不支持 %s 协议的推流地址", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("推流地址 %q 没有主机", raw)
+	}
+	hosts := cfg.Admin.PushHosts
+	if len(hosts) == 0 {
+		for _, s := range cfg.Streams {
+			for _, p := range s.Push {
+				hosts = appendHost(hosts, p)
+			}
+		}
+	}
+	if !containsHost(hosts, u.Hostname()) {
+		return fmt.Errorf("不允许推流到主机 %s", u.Hostname())
+	}
+	return nil
+}
+
+// appendHost 追加地址里的主机，解析失败或者没有主机时忽略
+func appendHost(hosts []string, raw string) []string {
+	if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+// containsHost 主机不区分大小写
+func containsHost(hosts []string, host string) bool {
+	return slices.ContainsFunc(hosts, func(h string) bool { return strings.EqualFold(h, host) })
+}
+
+// PullsFLV 上游转换成 FLV tag 由 FLVStreamBroker 分发的流类型，支持原地切换上游和断流垫片
+func (s StreamConfig) PullsFLV() bool {
+	switch s.Type {
+	case StreamTypeFLV, StreamTypeTS, StreamTypeSynthetic, StreamTypeFile:
+		return true
+	}
+	return false
+}
+
+func (item PlaylistItem) validate() error {
+	if item.File == "" {
+		return errors.New("playlist 条目缺少 file")
+	}
+	if item.Loop < 0 {
+		return fmt.Errorf("playlist %s: loop 不能为负数", item.File)
+	}
+	if item.At != "" {
+		for _, layout := range []string{"15:04:05", "15:04"} {
+			if _, err := time.Parse(layout, item.At); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("playlist %s: at %q 格式不对，应为 HH:MM 或 HH:MM:SS", item.File, item.At)
+	}
+	return nil
+}
+
+// StreamBuffer 流的缓存大小，没有单独配置时使用 cache 里的默认值
+func (cfg *Config) StreamBuffer(s StreamConfig) int {
+	if s.Buffer > 0 {
+		return s.Buffer
+	}
+	switch s.Type {
+	case StreamTypeHLS:
+		return cfg.Cache.HLSSegments
+	case StreamTypeCamera:
+		return cfg.Cache.CameraGOP
+	}
+	return 0
+}
+
+// StreamCache 流的起播缓存策略，没有单独配置的项使用 cache 里的值；hls 不使用，返回零值
+func (cfg *Config) StreamCache(s StreamConfig) StartCacheConfig {
+	if !s.PullsFLV() && s.Type != StreamTypeCamera {
+		return StartCacheConfig{}
+	}
+	c := cfg.Cache.StartCacheConfig
+	if s.Cache.GOPs > 0 || s.Cache.Duration > 0 {
+		// gops 和 duration 是二选一的，流里配置了任意一个就整体覆盖
+		c.GOPs, c.Duration = s.Cache.GOPs, s.Cache.Duration
+	}
+	if s.Cache.MaxBytes > 0 {
+		c.MaxBytes = s.Cache.MaxBytes
+	}
+	if s.Cache.Start != "" {
+		c.Start = s.Cache.Start
+	}
+	if s.Cache.ClipWindow > 0 {
+		c.ClipWindow = s.Cache.ClipWindow
+	}
+	return c
+}
+
+func (c StartCacheConfig) validate() error {
+	if c.GOPs < 0 || c.Duration < 0 || c.MaxBytes < 0 || c.ClipWindow < 0 {
+		return errors.New("cache 的 gops / duration / max_bytes / clip_window 不能为负数")
+	}
+	switch c.Start {
+	case "", StartLive, StartGOP, StartBuffer:
+		return nil
+	}
+	return fmt.Errorf("cache.start %q 不支持，应为 live / gop / buffer", c.Start)
+}
+
+// StreamPublish 流的推流策略，没有单独配置的项使用 publish 里的值
+func (cfg *Config) StreamPublish(s StreamConfig) PublishConfig {
+	p := cfg.Publish
+	if s.Publish.Grace > 0 {
+		p.Grace = s.Publish.Grace
+	}
+	if s.Publish.HoldFrame {
+		p.HoldFrame = true
+	}
+	if s.Publish.OnDuplicate != "" {
+		p.OnDuplicate = s.Publish.OnDuplicate
+	}
+	return p
+}
+
+func (p PublishConfig) validate() error {
+	if p.Grace < 0 {
+		return errors.New("publish.grace 不能为负数")
+	}
+	switch p.OnDuplicate {
+	case "", PublishReject, PublishKick, PublishBackup:
+	default:
+		return fmt.Errorf("publish.on_duplicate %s 不支持，只能是 reject / kick / backup", p.OnDuplicate)
+	}
+	return nil
+}
+
+// ====================== Store ======================
+
+// Store 保存当前生效的配置，热更新时整体替换，鉴权、回调等每次请求都从这里读取
+type Store struct {
+	current atomic.Pointer[Config]
+}
+
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Load 当前生效的配置，调用方不要修改返回值
+func (s *Store) Load() *Config {
+	return s.current.Load()
+}
+
+// Swap 替换配置，返回旧配置
+func (s *Store) Swap(cfg *Config) *Config {
+	return s.current.Swap(cfg)
+}
@@ -0,0 +1,102 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	flv := StreamConfig{Key: "a", Type: StreamTypeFLV, URL: "http://h/a.flv"}
+	tests := []struct {
+		name string
+		cfg  Config
+		ok   bool
+	}{
+		{"正常", Config{Streams: []StreamConfig{flv, {Key: "b", Type: StreamTypeCamera}}}, true},
+		{"key 重复", Config{Streams: []StreamConfig{flv, flv}}, false},
+		{"key 为空", Config{Streams: []StreamConfig{{Type: StreamTypeCamera}}}, false},
+		{"flv 缺少 url", Config{Streams: []StreamConfig{{Key: "a", Type: StreamTypeFLV}}}, false},
+		{"hls 缺少 url", Config{Streams: []StreamConfig{{Key: "a", Type: StreamTypeHLS}}}, false},
+		{"file 缺少 url 和 playlist", Config{Streams: []StreamConfig{{Key: "a", Type: StreamTypeFile}}}, false},
+		{"synthetic 可以不填 url", Config{Streams: []StreamConfig{{Key: "a", Type: StreamTypeSynthetic}}}, true},
+		{"不支持的类型", Config{Streams: []StreamConfig{{Key: "a", Type: "rtp", URL: "rtp://h"}}}, false},
+		{"camera 不支持 fallback", Config{Streams: []StreamConfig{{Key: "a", Type: StreamTypeCamera, Fallback: "a.flv"}}}, false},
+		{"开启 auth 没有 tokens", Config{Auth: AuthConfig{Enabled: true}}, false},
+		{"开启 auth 有 tokens", Config{Auth: AuthConfig{Enabled: true, Tokens: []string{"t"}}}, true},
+		{"集群没有 self", Config{Cluster: ClusterConfig{Nodes: []string{"http://n1"}}}, false},
+		{"集群开启 auth 没有 token", Config{Auth: AuthConfig{Enabled: true, Tokens: []string{"t"}}, Cluster: ClusterConfig{Self: "http://n1", Nodes: []string{"http://n1"}}}, false},
+		{"集群开启 auth 有 token", Config{Auth: AuthConfig{Enabled: true, Tokens: []string{"t"}}, Cluster: ClusterConfig{Self: "http://n1", Nodes: []string{"http://n1"}, Token: "c"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.Validate(); (err == nil) != tt.ok {
+				t.Fatalf("Validate() = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckPushURL(t *testing.T) {
+	cfg := &Config{
+		Streams: []StreamConfig{
+			{Key: "a", Type: StreamTypeFLV, URL: "rtmp://live.example.com/app/a", Push: []string{"rtmp://cdn.example.com/app/a"}},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		hosts []string
+		url   string
+		ok    bool
+	}{
+		{"已经配置过的转推主机", nil, "rtmp://CDN.example.com/app/b", true},
+		{"上游主机不能当转推目标", nil, "rtmp://live.example.com/app/b", false},
+		{"内网地址", nil, "http://127.0.0.1:6379/", false},
+		{"不支持的协议", nil, "file:///tmp/a.flv", false},
+		{"没有主机", nil, "rtmp:///app", false},
+		{"白名单里的主机", []string{"backup.example.com"}, "https://backup.example.com/ingest/a", true},
+		{"配置了白名单后只认白名单", []string{"backup.example.com"}, "rtmp://cdn.example.com/app/a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Admin.PushHosts = tt.hosts
+			if err := cfg.CheckPushURL(tt.url); (err == nil) != tt.ok {
+				t.Fatalf("CheckPushURL(%q) = %v", tt.url, err)
+			}
+		})
+	}
+}
+
+func TestCheckSwitchURL(t *testing.T) {
+	cfg := &Config{
+		Streams: []StreamConfig{
+			{Key: "a", Type: StreamTypeFLV, URL: "rtmp://live.example.com/app/a"},
+			{Key: "b", Type: StreamTypeCamera},
+		},
+	}
+	cfg.setDefaults()
+
+	tests := []struct {
+		name  string
+		hosts []string
+		url   string
+		ok    bool
+	}{
+		{"已经配置过的上游主机", nil, "http://live.example.com:8080/app/b.flv", true},
+		{"主机不区分大小写", nil, "RTMP://Live.Example.com/app/b", true},
+		{"没配置过的主机", nil, "http://127.0.0.1:6379/", false},
+		{"本地文件", nil, "file:///etc/passwd", false},
+		{"不在白名单的协议", nil, "udp://live.example.com:1234", false},
+		{"没有主机", nil, "rtmp:///app", false},
+		{"格式不对", nil, "://", false},
+		{"白名单里的主机", []string{"backup.example.com"}, "rtsp://backup.example.com/cam", true},
+		{"配置了白名单后只认白名单", []string{"backup.example.com"}, "rtmp://live.example.com/app/a", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Admin.SwitchHosts = tt.hosts
+			if err := cfg.CheckSwitchURL(tt.url); (err == nil) != tt.ok {
+				t.Fatalf("CheckSwitchURL(%q) = %v", tt.url, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"strconv"
+	"strings"
+)
+
+// ByteSize 配置里的字节数，可以写成数字或者带单位的字符串：1073741824、1GB、512MB、64KB
+type ByteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"GB", 1 << 30}, {"G", 1 << 30},
+	{"MB", 1 << 20}, {"M", 1 << 20},
+	{"KB", 1 << 10}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseByteSize 解析带单位的字节数，单位按 1024 换算，不区分大小写
+func ParseByteSize(s string) (ByteSize, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	factor := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(text, u.suffix) {
+			text, factor = strings.TrimSpace(strings.TrimSuffix(text, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的大小 %q", s)
+	}
+	return ByteSize(n * factor), nil
+}
+
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	size, err := ParseByteSize(node.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// BitRate 配置里的码率（bit/s），可以写成数字或者带单位的字符串：1Gbps、800Mbps、500Kbps，单位按 1000 换算
+type BitRate int64
+
+var rateUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"GBPS", 1e9}, {"MBPS", 1e6}, {"KBPS", 1e3}, {"BPS", 1},
+	{"G", 1e9}, {"M", 1e6}, {"K", 1e3},
+}
+
+// ParseBitRate 解析带单位的码率，不区分大小写
+func ParseBitRate(s string) (BitRate, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	factor := 1.0
+	for _, u := range rateUnits {
+		if strings.HasSuffix(text, u.suffix) {
+			text, factor = strings.TrimSpace(strings.TrimSuffix(text, u.suffix)), u.factor
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(text, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("无效的码率 %q", s)
+	}
+	return BitRate(n * factor), nil
+}
+
+func (b *BitRate) UnmarshalYAML(node *yaml.Node) error {
+	rate, err := ParseBitRate(node.Value)
+	if err != nil {
+		return err
+	}
+	*b = rate
+	return nil
+}
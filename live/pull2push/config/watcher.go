@@ -0,0 +1,59 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Watch 收到 SIGHUP 或者配置文件发生变化（按修改时间和大小轮询）时重新加载，加载成功后调用 onReload，
+// 加载失败时保留原配置并打印错误
+func Watch(ctx context.Context, path string, interval time.Duration, onReload func(*Config)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := fileVersion(path)
+	reload := func(reason string) {
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			log.Printf("[config] reload (%s) failed, keep current config: %v", reason, err)
+			return
+		}
+		log.Printf("[config] reload (%s) %s", reason, path)
+		onReload(cfg)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			last, _ = fileVersion(path)
+			reload("SIGHUP")
+		case <-ticker.C:
+			version, err := fileVersion(path)
+			if err != nil || version == last {
+				continue
+			}
+			last = version
+			reload("file changed")
+		}
+	}
+}
+
+// fileVersion 文件的修改时间和大小，编辑器保存时至少有一个会变化
+func fileVersion(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", info.ModTime().UnixNano(), info.Size()), nil
+}
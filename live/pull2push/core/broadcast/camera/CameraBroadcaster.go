@@ -11,7 +11,7 @@ import (
 
 // CameraBroadcaster.go 广播器
 type CameraBroadcaster struct {
-	mutex sync.Mutex
+	mutex sync.RWMutex // 配置热更新、管理后台会在请求处理过程中增删 Broker
 
 	//  负责协调所有的拉流链接 FLVStreamBroker 直接的工作
 	brokerMap map[string]broker.Broker // key为直播房间号
@@ -45,6 +45,9 @@ func (cb *CameraBroadcaster) RemoveBroker(brokerKey string) {
 
 // FindBroker 查询 Broker
 func (cb *CameraBroadcaster) FindBroker(brokerKey string) (broker.Broker, error) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
 	if val, ok := cb.brokerMap[brokerKey]; ok {
 		return val, nil
 	}
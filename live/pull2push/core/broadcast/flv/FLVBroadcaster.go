@@ -11,7 +11,7 @@ import (
 
 // FLVBroadcaster 广播器
 type FLVBroadcaster struct {
-	mutex sync.Mutex
+	mutex sync.RWMutex // 配置热更新、管理后台会在请求处理过程中增删 Broker
 
 	//  负责协调所有的拉流链接 FLVStreamBroker 直接的工作
 	brokerMap map[string]broker.Broker // key为直播房间号
@@ -44,6 +44,9 @@ func (fb *FLVBroadcaster) RemoveBroker(brokerKey string) {
 
 // FindBroker 查询 Broker
 func (fb *FLVBroadcaster) FindBroker(brokerKey string) (broker.Broker, error) {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+
 	if val, ok := fb.brokerMap[brokerKey]; ok {
 		return val, nil
 	}
@@ -11,7 +11,7 @@ import (
 
 // HLSBroadcaster 广播器
 type HLSBroadcaster struct {
-	mutex sync.Mutex
+	mutex sync.RWMutex // 配置热更新、管理后台会在请求处理过程中增删 Broker
 
 	//  负责协调所有的 HLSM3U8Broker 直接的工作
 	brokerMap map[string]broker.Broker // key为直播房间号
@@ -44,6 +44,9 @@ func (hb *HLSBroadcaster) RemoveBroker(brokerKey string) {
 
 // FindBroker 查询 Broker
 func (fb *HLSBroadcaster) FindBroker(brokerKey string) (broker.Broker, error) {
+	fb.mutex.RLock()
+	defer fb.mutex.RUnlock()
+
 	if val, ok := fb.brokerMap[brokerKey]; ok {
 		return val, nil
 	}
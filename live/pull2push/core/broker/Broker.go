@@ -1,11 +1,14 @@
 package broker
 
 import (
-	"github.com/gin-gonic/gin"
+	"context"
 	"pull2push/core/client"
 )
 
 // Broker 每一个直播地址都持有一个 Broker 对象，用于保存当前这个直播的信息
+//
+// 新的协议请实现 stream.Broker（按 Packet 分帧、带 context、不依赖 gin），
+// 再用 adapter.NewLegacyBroker 包装成 Broker 放进广播器；FLVStreamBroker 和 CameraBroker 两套接口都实现了
 type Broker interface {
 
 	// AddLiveClient 新增客户端
@@ -20,8 +23,8 @@ type Broker interface {
 	// ListenStatus 监听当前直播的必要状态
 	ListenStatus()
 
-	// PullLoop 持续去直播原地址拉流/数据
-	PullLoop(BrokerOptional)
+	// PullLoop 持续去直播原地址拉流/数据，阻塞到 ctx 结束或者 broker 被关闭
+	PullLoop(ctx context.Context) error
 
 	// Broadcast 原地址拉取到数据之后广播给客户端
 	Broadcast2LiveClient(data []byte)
@@ -30,9 +33,9 @@ type Broker interface {
 	UpdateSourceURL(newSourceURL string)
 }
 
-// BrokerOptional broker配置选项
-type BrokerOptional struct {
-	GinContext *gin.Context
+// LiveClientLister 可以列出当前客户端的 Broker，管理后台用来展示观众
+type LiveClientLister interface {
+	ListLiveClients() []string
 }
 
 type BROKER_CLOSE_TYPE int
@@ -50,3 +53,9 @@ const (
 	// 客户端被踢出直播间
 	KickedOutClient BROKER_CLOSE_TYPE = 4
 )
+
+// CloseSignal 服务端主动断开一个客户端时给它的信号：断开类型和原因，原因会尽量带给播放端（ws 的 close 帧、hls 的 403）
+type CloseSignal struct {
+	Type   BROKER_CLOSE_TYPE `json:"type"`
+	Reason string            `json:"reason"`
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+// START_MODE 新观众的起播方式，对应拉流地址的 ?start= 参数
+type START_MODE string
+
+const (
+	// StartDefault 按流配置的默认方式
+	StartDefault START_MODE = ""
+
+	// StartLive 不要缓存的历史数据，从下一个关键帧开始：延迟最低，等到关键帧之前没有画面，适合连麦、互动直播
+	StartLive START_MODE = "live"
+
+	// StartGOP 从最近一个关键帧开始，秒开
+	StartGOP START_MODE = "gop"
+
+	// StartBuffer 按流的缓存策略尽量多给历史数据：播放器缓冲更足、不容易卡，延迟也更高，适合被动观看
+	StartBuffer START_MODE = "buffer"
+)
+
+// ErrInvalidStartMode ?start= 的值不认识
+var ErrInvalidStartMode = errors.New("start 只能是 live / gop / buffer")
+
+// ParseStartMode 解析 ?start= 参数，空串返回 StartDefault
+func ParseStartMode(s string) (START_MODE, error) {
+	switch mode := START_MODE(s); mode {
+	case StartDefault, StartLive, StartGOP, StartBuffer:
+		return mode, nil
+	}
+	return StartDefault, ErrInvalidStartMode
+}
+
+// StartModer 带起播方式的客户端；不读环形缓冲的客户端在 AddLiveClient 时由 broker 按它选择起播数据
+type StartModer interface {
+	StartMode() START_MODE
+}
+
+// CachePolicy 一路直播的起播缓存策略，FLVStreamBroker 的环形缓冲和 CameraBroker 的 GOP 缓存共用
+//
+//	GOPs、Duration 都为 0 时只保留最近一个 GOP；Duration 不为 0 时按时间，从不早于最新数据 Duration 的最早关键帧开始，不看 GOPs
+//	MaxBytes 限制起播数据的总字节数，超过时放弃更早的 GOP，最近一个 GOP 总是保留
+//	Retain 缓存至少保留的时长，供导出片段（见 Clipper），不影响起播
+type CachePolicy struct {
+	GOPs     int
+	Duration time.Duration
+	MaxBytes int
+	Start    START_MODE // 观众没有指定时的起播方式，为空时按 StartBuffer
+	Retain   time.Duration
+}
+
+// CacheEntry 缓存里一个包和起播有关的信息
+type CacheEntry struct {
+	Size      int
+	KeyFrame  bool
+	Timestamp uint32 // 毫秒
+}
+
+// Resolve 观众实际的起播方式，mode 为空时用策略的默认值
+func (p CachePolicy) Resolve(mode START_MODE) START_MODE {
+	if mode == StartDefault {
+		mode = p.Start
+	}
+	if mode == StartDefault {
+		mode = StartBuffer
+	}
+	return mode
+}
+
+// StartIndex 在按时间顺序排列的 n 个缓存包里按 mode 选起播位置（一定是关键帧），
+// 返回 -1 表示从下一个关键帧开始：StartLive，或者缓存里还没有关键帧
+func (p CachePolicy) StartIndex(mode START_MODE, n int, at func(i int) CacheEntry) int {
+	mode = p.Resolve(mode)
+	if mode == StartLive || n == 0 {
+		return -1
+	}
+	newest := at(n - 1).Timestamp
+	start, gops, size := -1, 0, 0
+	for i := n - 1; i >= 0; i-- {
+		e := at(i)
+		size += e.Size
+		if !e.KeyFrame {
+			continue
+		}
+		if start >= 0 {
+			// 已经有一个可以起播的关键帧，再往前要满足策略的限制
+			if mode == StartGOP || (p.MaxBytes > 0 && size > p.MaxBytes) {
+				break
+			}
+			if p.Duration > 0 {
+				age := int64(newest) - int64(e.Timestamp)
+				if age < 0 || time.Duration(age)*time.Millisecond > p.Duration {
+					break
+				}
+			} else if gops >= max(p.GOPs, 1) {
+				break
+			}
+		}
+		start = i
+		gops++
+	}
+	return start
+}
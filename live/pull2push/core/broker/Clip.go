@@ -0,0 +1,52 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrClipRange 要导出的时间段不在 broker 的缓存里（太早已经被覆盖，或者还没有到）
+var ErrClipRange = errors.New("这段时间不在直播缓存里")
+
+// Clip 从 broker 缓存里取出的一段直播，数据是 FLV 字节，交给导出任务封装成文件
+type Clip struct {
+	Header []byte    // 起播头：FLV 头 + 元数据 + 序列头，时间戳为 0
+	Tags   [][]byte  // 从关键帧开始的 tag，时间戳是直播里的原值
+	Start  time.Time // 第一个 tag 到达的时间，一般比请求的开始时间早（对齐到关键帧）
+	End    time.Time // 最后一个 tag 到达的时间
+}
+
+// Clipper 能从缓存里导出片段的 broker，缓存能保留多长时间由 CachePolicy.Retain 决定
+type Clipper interface {
+	Clip(from, to time.Time) (*Clip, error)
+}
+
+// ClipEntry 缓存里一个包和导出片段有关的信息
+type ClipEntry struct {
+	KeyFrame bool
+	At       time.Time // 到达时间
+}
+
+// ClipRange 在按时间顺序排列的 n 个缓存包里选 [from, to] 对应的区间 [start, end)：
+// start 是不晚于 from 的最近一个关键帧，from 早于缓存时从缓存里最早的关键帧开始；end 之前的包都不晚于 to。
+// 区间里没有关键帧、或者 to 早于缓存里最早的包时返回 ErrClipRange
+func ClipRange(from, to time.Time, n int, at func(i int) ClipEntry) (start, end int, err error) {
+	start, end = -1, n
+	for end > 0 && at(end-1).At.After(to) {
+		end--
+	}
+	for i := 0; i < end; i++ {
+		e := at(i)
+		if !e.KeyFrame {
+			continue
+		}
+		if start >= 0 && e.At.After(from) {
+			break
+		}
+		start = i
+	}
+	if start < 0 {
+		return 0, 0, ErrClipRange
+	}
+	return start, end, nil
+}
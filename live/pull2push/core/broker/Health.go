@@ -0,0 +1,80 @@
+package broker
+
+import "time"
+
+// HEALTH_EVENT_TYPE 流健康检查发现的异常类型
+type HEALTH_EVENT_TYPE int
+
+const (
+	// HealthStalled 超过一定时间没有收到任何数据（摄像头卡死 / 上游断开）
+	HealthStalled HEALTH_EVENT_TYPE = 1
+
+	// HealthRecovered 断流之后重新收到数据
+	HealthRecovered HEALTH_EVENT_TYPE = 2
+
+	// HealthTimestampJump 时间戳向前跳变
+	HealthTimestampJump HEALTH_EVENT_TYPE = 3
+
+	// HealthTimestampRegression 时间戳回退
+	HealthTimestampRegression HEALTH_EVENT_TYPE = 4
+
+	// HealthKeyframeInterval 关键帧间隔异常
+	HealthKeyframeInterval HEALTH_EVENT_TYPE = 5
+
+	// HealthAVDrift 音视频时间戳偏差过大
+	HealthAVDrift HEALTH_EVENT_TYPE = 6
+
+	// HealthMissingSequenceHeader 收到帧数据但还没有序列头，客户端无法解码
+	HealthMissingSequenceHeader HEALTH_EVENT_TYPE = 7
+)
+
+func (t HEALTH_EVENT_TYPE) String() string {
+	switch t {
+	case HealthStalled:
+		return "stalled"
+	case HealthRecovered:
+		return "recovered"
+	case HealthTimestampJump:
+		return "timestamp_jump"
+	case HealthTimestampRegression:
+		return "timestamp_regression"
+	case HealthKeyframeInterval:
+		return "keyframe_interval"
+	case HealthAVDrift:
+		return "av_drift"
+	case HealthMissingSequenceHeader:
+		return "missing_sequence_header"
+	}
+	return "unknown"
+}
+
+// MarshalText 在 JSON 里输出可读的名称
+func (t HEALTH_EVENT_TYPE) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// HealthEvent 一次异常事件
+type HealthEvent struct {
+	BrokerKey string            `json:"brokerKey"`
+	Type      HEALTH_EVENT_TYPE `json:"type"`
+	Track     string            `json:"track,omitempty"` // video / audio，和轨道无关时为空
+	Message   string            `json:"message"`
+	Value     int64             `json:"value"` // 触发事件的数值（毫秒），比如断流时长、跳变大小
+	Time      time.Time         `json:"time"`
+}
+
+// HealthReport 一路直播当前的健康状态
+type HealthReport struct {
+	Healthy     bool           `json:"healthy"`
+	Stalled     bool           `json:"stalled"`
+	LastDataAt  time.Time      `json:"lastDataAt"`
+	EventCounts map[string]int `json:"eventCounts"` // 按类型累计的事件数
+	Events      []HealthEvent  `json:"events"`      // 最近的事件，按时间先后排列
+}
+
+// HealthReporter 能够报告健康状态的 broker
+type HealthReporter interface {
+
+	// HealthReport 返回当前健康状态和最近的异常事件
+	HealthReport() *HealthReport
+}
@@ -0,0 +1,43 @@
+package broker
+
+import "time"
+
+// MediaInfoProvider 能够报告当前流媒体信息的 broker
+type MediaInfoProvider interface {
+
+	// MediaInfo 返回当前流的编码信息和实时统计，还没有收到数据时返回 nil
+	MediaInfo() *MediaInfo
+}
+
+// MediaInfo 一路直播的音视频信息
+type MediaInfo struct {
+	Video       *VideoInfo `json:"video,omitempty"`
+	Audio       *AudioInfo `json:"audio,omitempty"`
+	BitrateKbps float64    `json:"bitrateKbps"` // 音视频总码率
+	UpdatedAt   time.Time  `json:"updatedAt"`   // 最近一次收到数据的时间
+}
+
+// VideoInfo 视频编码参数（来自 SPS / 解码配置）和实时统计
+type VideoInfo struct {
+	Codec         string  `json:"codec"`
+	Profile       string  `json:"profile,omitempty"`
+	Level         string  `json:"level,omitempty"`
+	Width         int     `json:"width,omitempty"`
+	Height        int     `json:"height,omitempty"`
+	ChromaFormat  string  `json:"chromaFormat,omitempty"`
+	BitDepth      int     `json:"bitDepth,omitempty"`
+	FPS           float64 `json:"fps,omitempty"` // SPS VUI 中声明的帧率
+	MeasuredFPS   float64 `json:"measuredFps"`   // 按时间戳统计的实际帧率
+	BitrateKbps   float64 `json:"bitrateKbps"`   // 实际码率
+	GOPFrames     int     `json:"gopFrames"`     // 最近一个完整 GOP 的帧数
+	GOPDurationMs uint32  `json:"gopDurationMs"` // 最近一个完整 GOP 的时长
+}
+
+// AudioInfo 音频编码参数（来自 AudioSpecificConfig）和实时统计
+type AudioInfo struct {
+	Codec       string  `json:"codec"`
+	Profile     string  `json:"profile,omitempty"`
+	SampleRate  int     `json:"sampleRate,omitempty"`
+	Channels    int     `json:"channels,omitempty"`
+	BitrateKbps float64 `json:"bitrateKbps"`
+}
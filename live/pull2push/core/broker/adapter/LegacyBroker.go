@@ -0,0 +1,157 @@
+package adapter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/client"
+	"pull2push/core/stream"
+	"sort"
+	"sync"
+)
+
+/*
+adapter stream.Broker / stream.Client 和旧的 broker.Broker / client.LiveClient 之间的转换
+
+	LegacyBroker    把新 broker 包装成 broker.Broker，放进现有的广播器，flv / ts / ws 观众通过 Broadcast 接收数据
+	LiveClientOf    把旧观众包装成 stream.Client，包按 FLV tag 写给它的 Broadcast
+	PacketClientOf  把新观众包装成 client.LiveClient，挂到旧 broker 上，Broadcast 的 FLV 字节解析成包
+	PublishRequest  把推流的 HTTP 请求交给 Publisher，gin 只在这一层和 handler 里出现
+*/
+
+// LegacyBroker 把 stream.Broker 包装成 broker.Broker
+type LegacyBroker struct {
+	BrokerKey string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	sb     stream.Broker
+	once   sync.Once
+
+	mu        sync.Mutex
+	clientMap map[string]client.LiveClient // map[clientId]LiveClient，FindLiveClient 用
+	tags      *flvBroker.TagReader         // Broadcast2LiveClient 收到的 FLV 字节
+}
+
+// NewLegacyBroker 启动 sb 并包装成 broker.Broker，ctx 结束或者 Close 时 sb 一起关闭
+func NewLegacyBroker(ctx context.Context, brokerKey string, sb stream.Broker) (*LegacyBroker, error) {
+	lb := &LegacyBroker{
+		BrokerKey: brokerKey,
+		sb:        sb,
+		clientMap: make(map[string]client.LiveClient),
+		tags:      flvBroker.NewTagReader(),
+	}
+	lb.ctx, lb.cancel = context.WithCancel(ctx)
+	if err := sb.Start(lb.ctx); err != nil {
+		lb.cancel()
+		return nil, err
+	}
+	return lb, nil
+}
+
+// Unwrap 被包装的 stream.Broker
+func (lb *LegacyBroker) Unwrap() stream.Broker {
+	return lb.sb
+}
+
+// AddLiveClient 添加客户端，先收到 FLV 头和 broker 缓存的起播数据
+func (lb *LegacyBroker) AddLiveClient(clientId string, liveClient client.LiveClient) {
+	if err := lb.sb.AddClient(clientId, LiveClientOf(liveClient)); err != nil {
+		log.Printf("[adapter:%s] 添加客户端 %s 失败: %v", lb.BrokerKey, clientId, err)
+		return
+	}
+	lb.mu.Lock()
+	lb.clientMap[clientId] = liveClient
+	lb.mu.Unlock()
+}
+
+// RemoveLiveClient 移除客户端
+func (lb *LegacyBroker) RemoveLiveClient(clientId string) {
+	lb.sb.RemoveClient(clientId)
+	lb.mu.Lock()
+	delete(lb.clientMap, clientId)
+	lb.mu.Unlock()
+}
+
+// FindLiveClient 查询 LiveClient
+func (lb *LegacyBroker) FindLiveClient(clientId string) (client.LiveClient, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if val, ok := lb.clientMap[clientId]; ok {
+		return val, nil
+	}
+	return nil, fmt.Errorf("未找到 %s 对应的 LiveClient", clientId)
+}
+
+// ListLiveClients 当前所有客户端编号
+func (lb *LegacyBroker) ListLiveClients() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	ids := make([]string, 0, len(lb.clientMap))
+	for clientId := range lb.clientMap {
+		ids = append(ids, clientId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// ListenStatus 新 broker 的状态监听在 Start 里启动，这里不需要做任何事
+func (lb *LegacyBroker) ListenStatus() {}
+
+// PullLoop 被包装的 broker 已经在 Start 里开始拉流，这里阻塞到 ctx 结束或者 Close
+func (lb *LegacyBroker) PullLoop(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-lb.ctx.Done():
+		return nil
+	}
+}
+
+// Publish 被包装的 broker 实现了 Publisher 时接收一次推流，Close 时推流一起结束
+func (lb *LegacyBroker) Publish(ctx context.Context, r io.Reader) error {
+	pub, ok := lb.sb.(Publisher)
+	if !ok {
+		return fmt.Errorf("%s 不接收推流", lb.BrokerKey)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(lb.ctx, cancel)
+	defer stop()
+	return pub.Publish(ctx, r)
+}
+
+// Broadcast2LiveClient 把 FLV 字节解析成包交给 broker 分发，数据可以按任意字节边界传进来
+func (lb *LegacyBroker) Broadcast2LiveClient(data []byte) {
+	lb.mu.Lock()
+	packets, err := lb.tags.Packets(data)
+	lb.mu.Unlock()
+	if err != nil {
+		log.Printf("[adapter:%s] 解析 FLV 数据失败: %v", lb.BrokerKey, err)
+		return
+	}
+	for _, p := range packets {
+		if err := lb.sb.WritePacket(p); err != nil {
+			return
+		}
+	}
+}
+
+// UpdateSourceURL 被包装的 broker 实现了 stream.SourceUpdater 时切换上游地址
+func (lb *LegacyBroker) UpdateSourceURL(newSourceURL string) {
+	if u, ok := lb.sb.(stream.SourceUpdater); ok {
+		u.UpdateSourceURL(newSourceURL)
+	}
+}
+
+// Close broker 从广播器移除后调用，关闭被包装的 broker
+func (lb *LegacyBroker) Close() error {
+	var err error
+	lb.once.Do(func() {
+		lb.cancel()
+		err = lb.sb.Close()
+	})
+	return err
+}
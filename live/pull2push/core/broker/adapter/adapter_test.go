@@ -0,0 +1,213 @@
+package adapter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	cameraBroker "pull2push/core/broker/camera"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/stream"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ms(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+
+func TestPacketTagRoundTrip(t *testing.T) {
+	packets := []stream.Packet{
+		{Kind: stream.PacketMetadata, Payload: []byte{2, 0, 10}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, Config: true, Payload: []byte{1, 0x64, 0, 0x1F}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(40), PTS: ms(120), KeyFrame: true, Payload: []byte{0, 0, 0, 1, 0x65}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecHEVC, Config: true, Payload: []byte{1, 2, 3}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecHEVC, DTS: ms(80), PTS: ms(160), Payload: []byte{0, 0, 0, 1, 0x02}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecHEVC, DTS: ms(120), PTS: ms(120), Payload: []byte{0, 0, 0, 1, 0x02}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAV1, DTS: ms(40), PTS: ms(40), KeyFrame: true, Payload: []byte{0x12, 0}},
+		{Kind: stream.PacketAudio, Codec: stream.CodecAAC, Config: true, Payload: []byte{0x12, 0x10}},
+		{Kind: stream.PacketAudio, Codec: stream.CodecAAC, DTS: ms(23), PTS: ms(23), Payload: []byte{0x21, 0x00}},
+		{Kind: stream.PacketAudio, Codec: stream.CodecMP3, DTS: ms(26), PTS: ms(26), Payload: []byte{0xFF, 0xFB}},
+	}
+	for _, want := range packets {
+		tag, err := flvBroker.TagFromPacket(want)
+		if err != nil {
+			t.Fatalf("%v: %v", want, err)
+		}
+		got, ok := flvBroker.PacketFromTag(tag)
+		if !ok {
+			t.Fatalf("%v: 转换回来失败", want)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("转换前 %v\n转换后 %v", want, got)
+		}
+	}
+
+	if _, err := flvBroker.TagFromPacket(stream.Packet{Kind: stream.PacketAudio, Codec: "Opus"}); err == nil {
+		t.Error("FLV 装不下的编码应该返回错误")
+	}
+}
+
+// hubBroker 测试用的 stream.Broker，数据由测试通过 WritePacket 写入
+type hubBroker struct {
+	*stream.Hub
+	started bool
+}
+
+func (b *hubBroker) Start(ctx context.Context) error {
+	b.started = true
+	return nil
+}
+
+func (b *hubBroker) PullLoop(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// fakeLiveClient 记录 Broadcast 收到的字节
+type fakeLiveClient struct {
+	buf bytes.Buffer
+}
+
+func (c *fakeLiveClient) Broadcast(data []byte)    { c.buf.Write(data) }
+func (c *fakeLiveClient) Listen()                  {}
+func (c *fakeLiveClient) GetDataChan() chan []byte { return nil }
+
+func tagBytes(t *testing.T, packets ...stream.Packet) []byte {
+	var out []byte
+	for _, p := range packets {
+		tag, err := flvBroker.TagFromPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, tag.ToBytes()...)
+	}
+	return out
+}
+
+func TestLegacyBroker(t *testing.T) {
+	sb := &hubBroker{Hub: stream.NewHub()}
+	lb, err := NewLegacyBroker(context.Background(), "test", sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	if !sb.started {
+		t.Fatal("NewLegacyBroker 没有调用 Start")
+	}
+
+	data := tagBytes(t,
+		stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, Config: true, Payload: []byte{1}},
+		stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, KeyFrame: true, Payload: []byte{0, 0, 0, 1, 0x65}},
+		stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(40), PTS: ms(40), Payload: []byte{0, 0, 0, 1, 0x41}},
+	)
+	// 旧接口的数据可以在任意位置断开
+	lb.Broadcast2LiveClient(data[:7])
+	lb.Broadcast2LiveClient(data[7:])
+
+	lc := &fakeLiveClient{}
+	lb.AddLiveClient("a", lc)
+	if found, err := lb.FindLiveClient("a"); err != nil || found != lc {
+		t.Fatalf("FindLiveClient: %v %v", found, err)
+	}
+	lb.Broadcast2LiveClient(tagBytes(t, stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(80), PTS: ms(80), Payload: []byte{0, 0, 0, 1, 0x41}}))
+
+	// 旧观众先收到 FLV 头，再收到序列头 + GOP + 实时数据
+	d := flvBroker.NewFLVDemuxer()
+	tags, err := d.Feed(lc.buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 4 || !tags[0].IsSequenceHeader() || !tags[1].IsKeyFrame() || tags[3].Timestamp != 80 {
+		t.Fatalf("旧观众收到的 tag 不对: %d 个", len(tags))
+	}
+
+	lb.RemoveLiveClient("a")
+	if ids := lb.ListLiveClients(); len(ids) != 0 {
+		t.Errorf("RemoveLiveClient 之后还有客户端: %v", ids)
+	}
+}
+
+type packetRecorder struct {
+	packets []stream.Packet
+}
+
+func (r *packetRecorder) Write(p stream.Packet) error {
+	r.packets = append(r.packets, p)
+	return nil
+}
+
+func TestPacketClientOf(t *testing.T) {
+	r := &packetRecorder{}
+	lc := PacketClientOf(r)
+	data := append(flvBroker.BuildFLVHeader(true, true), tagBytes(t,
+		stream.Packet{Kind: stream.PacketAudio, Codec: stream.CodecAAC, Config: true, Payload: []byte{0x12, 0x10}},
+		stream.Packet{Kind: stream.PacketAudio, Codec: stream.CodecAAC, DTS: ms(23), PTS: ms(23), Payload: []byte{0x21}},
+	)...)
+	lc.Broadcast(data[:20])
+	lc.Broadcast(data[20:])
+	if len(r.packets) != 2 || !r.packets[0].Config || r.packets[1].DTS != ms(23) {
+		t.Fatalf("新观众收到的包不对: %v", r.packets)
+	}
+}
+
+// FLVStreamBroker 和 CameraBroker 都可以只通过 stream.Broker 使用：Start、WritePacket、AddClient、Close
+func TestStreamBrokers(t *testing.T) {
+	config := stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, Config: true, Payload: []byte{1, 0x64, 0, 0x1F}}
+	key := stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(40), PTS: ms(40), KeyFrame: true, Payload: []byte{0, 0, 0, 1, 0x65}}
+	inter := stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(80), PTS: ms(80), Payload: []byte{0, 0, 0, 1, 0x41}}
+	blocked := func(ctx context.Context, _ string) (flvBroker.TagSource, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	brokers := map[string]stream.Broker{
+		"flv":    flvBroker.NewFLVStreamBrokerWithDialer("stream-flv", "test://", blocked),
+		"camera": cameraBroker.NewCameraBroker("stream-camera", 0),
+	}
+	for name, sb := range brokers {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			if err := sb.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			live := &packetRecorder{}
+			if err := sb.AddClient("live", live); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []stream.Packet{config, key, inter} {
+				if err := sb.WritePacket(p); err != nil {
+					t.Fatalf("WritePacket: %v", err)
+				}
+			}
+			if len(live.packets) != 3 || !live.packets[0].Config || !live.packets[1].KeyFrame {
+				t.Fatalf("观众收到的包不对: %v", live.packets)
+			}
+			// 后加入的观众先收到解码配置和最近的 GOP
+			late := &packetRecorder{}
+			if err := sb.AddClient("late", late); err != nil {
+				t.Fatal(err)
+			}
+			if len(late.packets) != 3 || !late.packets[0].Config || !late.packets[1].KeyFrame {
+				t.Fatalf("后加入的观众收到的包不对: %v", late.packets)
+			}
+			sb.RemoveClient("late")
+			if err := sb.WritePacket(inter); err != nil || len(late.packets) != 3 {
+				t.Fatalf("RemoveClient 之后还收到数据: %v %d", err, len(late.packets))
+			}
+
+			// ctx 结束等同于 Close
+			cancel()
+			deadline := time.Now().Add(time.Second)
+			for !errors.Is(sb.WritePacket(inter), stream.ErrClosed) {
+				if time.Now().After(deadline) {
+					t.Fatal("ctx 结束之后 broker 没有关闭")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := sb.AddClient("after", &packetRecorder{}); !errors.Is(err, stream.ErrClosed) {
+				t.Fatalf("关闭之后 AddClient 返回 %v", err)
+			}
+			if err := sb.PullLoop(context.Background()); err != nil {
+				t.Fatalf("关闭之后 PullLoop 返回 %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package adapter
+
+import (
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/client"
+	"pull2push/core/stream"
+)
+
+// ====================== client.LiveClient -> stream.Client ======================
+
+// liveClientWriter 旧观众按 FLV tag 接收数据，第一个包之前先收到 FLV 头
+type liveClientWriter struct {
+	lc         client.LiveClient
+	headerSent bool
+}
+
+// LiveClientOf 把旧观众包装成 stream.Client；FLV 装不下的编码丢弃，Broadcast 本身不会失败，观众由旧的流程移除
+func LiveClientOf(lc client.LiveClient) stream.Client {
+	return &liveClientWriter{lc: lc}
+}
+
+func (w *liveClientWriter) Write(p stream.Packet) error {
+	tag, err := flvBroker.TagFromPacket(p)
+	if err != nil {
+		return nil
+	}
+	data := tag.ToBytes()
+	if !w.headerSent {
+		w.headerSent = true
+		data = append(flvBroker.BuildFLVHeader(true, true), data...)
+	}
+	w.lc.Broadcast(data)
+	return nil
+}
+
+// ====================== stream.Client -> client.LiveClient ======================
+
+// PacketClientOf 把新观众包装成 client.LiveClient，挂到旧 broker 上，实现见 flvBroker.PacketClientOf
+func PacketClientOf(c stream.Client) client.LiveClient {
+	return flvBroker.PacketClientOf(c)
+}
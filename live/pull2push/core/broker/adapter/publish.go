@@ -0,0 +1,39 @@
+package adapter
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Publisher 接收推流的 broker（摄像头推流这类），上游数据来自 HTTP 请求体而不是自己拉取
+type Publisher interface {
+
+	// Publish 读取一次推流直到 r 结束或者 ctx 结束
+	Publish(ctx context.Context, r io.Reader) error
+}
+
+// requestBody 推流的请求体，带上推流端地址，broker 打断推流时设置读超时
+type requestBody struct {
+	io.Reader
+	remote string
+	rc     *http.ResponseController
+}
+
+// RemoteAddr 推流端地址
+func (b *requestBody) RemoteAddr() string {
+	return b.remote
+}
+
+// SetReadDeadline 推流的读可能一直阻塞在一个已经死掉的连接上，设置读超时让它返回
+func (b *requestBody) SetReadDeadline(t time.Time) error {
+	return b.rc.SetReadDeadline(t)
+}
+
+// PublishRequest 把一个推流的 HTTP 请求交给 pub，阻塞到推流结束；broker 不需要知道 gin
+func PublishRequest(c *gin.Context, pub Publisher) error {
+	body := &requestBody{Reader: c.Request.Body, remote: c.ClientIP(), rc: http.NewResponseController(c.Writer)}
+	return pub.Publish(c.Request.Context(), body)
+}
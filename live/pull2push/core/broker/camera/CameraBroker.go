@@ -1,12 +1,18 @@
 package camera
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
 	"pull2push/core/client"
+	"pull2push/core/memory"
+	"pull2push/core/stream"
+	"sort"
 	"sync"
+	"time"
 )
 
 /*
@@ -26,86 +32,207 @@ import (
 */
 
 // CameraBroker 每个 直播地址 用一个 Broker 管理，里面管理了多个当前直播链接的客户端
+//
+// 推流的 body 是完整的 FLV 流，按 tag 解析：FLV 头、元数据和音视频序列头单独保存，
+// 从最近一个视频关键帧开始缓存 GOP，新观众先收到 起播头 + GOP 再接着收实时数据。
+// 所有状态都在 mu 下修改，数据只通过 LiveClient.Broadcast 发给客户端，Broadcast 不能阻塞。
+//
+// 推流断开后 broker 保留，观众留在直播里等待宽限期内的重连；新推流的时间戳接着上一个推流换算，
+// 观众看到的是一条连续的流。同一路同时只有一个推流生效，第二个推流按 PublishPolicy 拒绝、踢掉旧的或者排队做备份。
 type CameraBroker struct {
 	// 直播数据相关
 	BrokerKey string // 直播房间的唯一编号
-	//cache        [][]byte // 内存缓存最近的若干个 FLV 包，方便新客户端秒开  缓存最近一个 GOP（关键帧 + 后续帧）
-	gop [][]byte // 内存缓存最近的若干个 FLV 包，方便新客户端秒开缓存最近一个 GOP（关键帧 + 后续帧）
+
+	mu           sync.Mutex
+	flvHeader    []byte             // FLV 头（含 PreviousTagSize0），只保存第一次推流的，重连时不再发给已连接的观众
+	metaTag      *flvBroker.FlvTag  // onMetaData
+	videoSeqTag  *flvBroker.FlvTag  // 视频序列头
+	videoMetaTag *flvBroker.FlvTag  // Enhanced FLV 的视频元数据
+	audioSeqTag  *flvBroker.FlvTag  // 音频序列头
+	keyTag       *flvBroker.FlvTag  // 最后一个视频关键帧，宽限期内重复发送
+	gop          []gopPacket        // 按起播缓存策略保留的最近若干个 GOP（关键帧 + 后续帧），方便新客户端秒开
+	gopBytes     int                // gop 里数据的总字节数
+	maxCache     int                // gop 最多缓存的包数，超过后丢掉最早的 GOP，只剩一个 GOP 也放不下时不再缓存，等下一个关键帧
+	cachePolicy  broker.CachePolicy // 起播缓存策略，决定 gop 保留多少个 GOP
+	account      *memory.Account    // gop 缓存的内存记账
+	stats        *flvBroker.MediaStats
+	health       *flvBroker.HealthAnalyzer
+
+	// 推流相关，在 mu 下修改
+	policy     PublishPolicy
+	active     *publisher   // 当前生效的推流，宽限期内为 nil
+	backups    []*publisher // 排队的备份推流
+	generation uint64       // 每次切换推流加一，宽限期据此判断期间有没有重连
+	published  bool         // 观众已经收到过数据，新推流要接着 lastTs 换算时间戳
+	lastTs     uint32       // 最后发给观众的时间戳
+	closed     bool
+
+	writeMu sync.Mutex // WritePacket 的调用互相串行
+	writer  *publisher // WritePacket 登记的推流，在 writeMu 下修改
 
 	// 状态控制相关
 	BrokerCloseSig chan broker.BROKER_CLOSE_TYPE // 控制当前这个直播是否被关闭
 	once           sync.Once
+	startOnce      sync.Once
+	stopSig        chan struct{}
 
 	// 客户端相关
-	clientMutex    sync.Mutex                   // 客户端的异步操作控制器
-	clientMap      map[string]client.LiveClient // map[clientId]LiveClient 存储这个broker里面所有的客户端
+	clientMap      map[string]client.LiveClient // map[clientId]LiveClient 存储这个broker里面所有的客户端，在 mu 下修改
+	waitKey        map[string]bool              // 按 ?start=live 起播、还在等关键帧的客户端，在 mu 下修改
 	ClientCloseSig chan string                  // 客户端关闭信号，当客户端主动关闭通知时，该信道被触发，输出的字符串为关闭的客户端编号clientId
 
 }
 
+// NewCameraBroker 调用 Start 之后开始监听状态，推流见 Publish
 func NewCameraBroker(brokerKey string, maxCache int) *CameraBroker {
 	if maxCache == 0 {
 		maxCache = 150
 	}
 	cb := CameraBroker{
-		BrokerKey: brokerKey,
-		//cache:          make([][]byte, 0),
+		BrokerKey:      brokerKey,
 		clientMap:      make(map[string]client.LiveClient),
+		waitKey:        make(map[string]bool),
 		BrokerCloseSig: make(chan broker.BROKER_CLOSE_TYPE),
 		ClientCloseSig: make(chan string),
-		gop:            make([][]byte, 0),
+		stopSig:        make(chan struct{}),
+		maxCache:       maxCache,
+		account:        memory.Default.Open(brokerKey),
+		stats:          flvBroker.NewMediaStats(),
+		health:         flvBroker.NewHealthAnalyzer(brokerKey, flvBroker.DefaultHealthConfig()),
 	}
 
-	// 开启必要的状态监听
-	go cb.ListenStatus()
-
 	log.Println("开始推流:", brokerKey)
 
 	return &cb
 }
 
-// AddLiveClient 添加客户端
-func (cb *CameraBroker) AddLiveClient(clientId string, client client.LiveClient) {
-	cb.clientMutex.Lock()
-	cb.clientMap[clientId] = client
-	cb.clientMutex.Unlock()
+// Start 开启必要的状态监听，不阻塞；ctx 结束等同于 Close，重复调用只启动一次
+func (cb *CameraBroker) Start(ctx context.Context) error {
+	cb.mu.Lock()
+	closed := cb.closed
+	cb.mu.Unlock()
+	if closed {
+		return stream.ErrClosed
+	}
+	cb.startOnce.Do(func() {
+		context.AfterFunc(ctx, func() { cb.Close() })
+		go cb.ListenStatus()
+	})
+	return nil
+}
 
-	// 先把缓存的 GOP 发送给新客户端
-	for _, pkt := range cb.gop {
-		client.GetDataChan() <- pkt
+// AddLiveClient 添加客户端，先按起播方式（见 broker.StartModer）发送起播头和缓存的 GOP；
+// 和 handleTag 在同一把锁里，起播数据和之后的实时数据正好衔接
+func (cb *CameraBroker) AddLiveClient(clientId string, liveClient client.LiveClient) {
+	mode := broker.StartDefault
+	if m, ok := liveClient.(broker.StartModer); ok {
+		mode = m.StartMode()
 	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.closed {
+		// 查到 broker 之后它被配置热更新移除了，不会再有数据
+		if kickable, ok := liveClient.(client.Kickable); ok {
+			kickable.Kick("直播已停止")
+		}
+		return
+	}
+	cb.clientMap[clientId] = liveClient
+	if cb.cachePolicy.Resolve(mode) == broker.StartLive {
+		cb.waitKey[clientId] = true
+	}
+	if init := cb.initialBytes(mode); len(init) > 0 {
+		liveClient.Broadcast(init)
+	}
+}
 
+// SetCachePolicy 修改起播缓存策略，配置热更新时调用；已经缓存的 GOP 在下一个关键帧时按新策略淘汰
+func (cb *CameraBroker) SetCachePolicy(policy broker.CachePolicy) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.cachePolicy = policy
+}
+
+// AddClient 新增 stream.Client 观众，和旧客户端一样先收到起播头和缓存的 GOP
+func (cb *CameraBroker) AddClient(id string, c stream.Client) error {
+	cb.mu.Lock()
+	closed := cb.closed
+	cb.mu.Unlock()
+	if closed {
+		return stream.ErrClosed
+	}
+	cb.AddLiveClient(id, flvBroker.PacketClientOf(c))
+	return nil
+}
+
+// RemoveClient 移除 stream.Client 观众
+func (cb *CameraBroker) RemoveClient(id string) {
+	cb.RemoveLiveClient(id)
 }
 
 // RemoveLiveClient 移除客户端
 func (cb *CameraBroker) RemoveLiveClient(clientId string) {
-	cb.clientMutex.Lock()
-	defer cb.clientMutex.Unlock()
-	liveClient := cb.clientMap[clientId]
-	if liveClient == nil {
-		return
-	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
 	delete(cb.clientMap, clientId)
-
-	//// 如果没有客户端并且想释放 broker，可关闭 stopCh 让 PullLoop 停止（本示例保留 broker，防止频繁断开上游）
-	//if remaining == 0 {
-	//	// optionally stop pulling after idle timeout. For simplicity we keep running.
-	//}
+	delete(cb.waitKey, clientId)
 }
 
 // FindLiveClient 查询 LiveClient
 func (cb *CameraBroker) FindLiveClient(clientId string) (client.LiveClient, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
 	if val, ok := cb.clientMap[clientId]; ok {
 		return val, nil
 	}
 	return nil, errors.New(fmt.Sprintf("未找到 %s 对应的 LiveClient", clientId))
 }
 
+// ListLiveClients 当前所有客户端编号
+func (cb *CameraBroker) ListLiveClients() []string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	ids := make([]string, 0, len(cb.clientMap))
+	for clientId := range cb.clientMap {
+		ids = append(ids, clientId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
 // UpdateSourceURL 支持切换直播原地址
 func (cb *CameraBroker) UpdateSourceURL(newSourceURL string) {}
 
-// ListenStatus 监听当前直播的必要状态
+// Close broker 从广播器移除后调用，断开所有推流和观众，归还内存记账
+func (cb *CameraBroker) Close() error {
+	cb.once.Do(func() {
+		close(cb.stopSig)
+		cb.mu.Lock()
+		cb.closed = true
+		if cb.active != nil {
+			cb.active.interrupt()
+		}
+		for _, p := range cb.backups {
+			p.interrupt()
+		}
+		cb.resetGOP()
+		for _, c := range cb.clientMap {
+			if kickable, ok := c.(client.Kickable); ok {
+				kickable.Kick("直播已停止")
+			}
+		}
+		cb.mu.Unlock()
+		cb.account.Close()
+	})
+	return nil
+}
+
+// ListenStatus 监听当前直播的必要状态：客户端离开、定时检查是否断流
 func (cb *CameraBroker) ListenStatus() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
 		case clientId := <-cb.ClientCloseSig:
@@ -115,47 +242,275 @@ func (cb *CameraBroker) ListenStatus() {
 		case <-cb.BrokerCloseSig:
 			// 直播被关闭
 			close(cb.BrokerCloseSig)
+		case <-cb.stopSig:
+			return
+		case now := <-ticker.C:
+			cb.health.Check(now)
 		}
 
 	}
 }
 
-// PullLoop 持续去直播原地址拉流/数据
-func (cb *CameraBroker) PullLoop(bo broker.BrokerOptional) {
+// HealthReport 当前的健康状态和最近的异常事件
+func (cb *CameraBroker) HealthReport() *broker.HealthReport {
+	return cb.health.Report()
+}
+
+// MediaInfo 推流的编码参数和码率/帧率/GOP 统计
+func (cb *CameraBroker) MediaInfo() *broker.MediaInfo {
+	return cb.stats.Snapshot()
+}
 
-	data := make([]byte, 4096)
-	for {
-		n, err := bo.GinContext.Request.Body.Read(data)
-		if err != nil {
-			fmt.Println("推流断开:", err)
-			break
+// PullLoop camera 的数据来自推流（见 Publish），没有上游可拉，阻塞到 ctx 结束或者 Close
+func (cb *CameraBroker) PullLoop(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-cb.stopSig:
+		return nil
+	}
+}
+
+// handleTag 处理推流 p 的一个 tag：换算时间戳，序列头/元数据单独保存，其余进入 GOP 缓存，然后广播；
+// 备份推流只保存起播头，返回 false 表示 p 已经被踢掉
+func (cb *CameraBroker) handleTag(p *publisher, tag *flvBroker.FlvTag) bool {
+	cb.mu.Lock()
+	if p != cb.active {
+		backup := false
+		for _, b := range cb.backups {
+			if b == p {
+				backup = true
+				p.keepHeader(tag)
+			}
 		}
-		packet := make([]byte, n)
-		copy(packet, data[:n])
-		cb.Broadcast2LiveClient(packet)
+		cb.mu.Unlock()
+		return backup
 	}
+	if p.waitKey && !isHeaderTag(tag) {
+		if !tag.IsKeyFrame() {
+			cb.mu.Unlock()
+			return true
+		}
+		p.waitKey = false
+	}
+	cb.rebase(p, tag)
+	data := tag.ToBytes()
+
+	switch {
+	case tag.TagType == flvBroker.TagTypeScript:
+		cb.metaTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == flvBroker.TagTypeVideo:
+		cb.videoSeqTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == flvBroker.TagTypeAudio:
+		cb.audioSeqTag = tag
+	case isVideoMetadata(tag):
+		cb.videoMetaTag = tag
+	default:
+		if tag.IsKeyFrame() {
+			cb.keyTag = tag
+		}
+		cb.cacheGOP(data, tag.IsKeyFrame(), tag.Timestamp)
+	}
+	clients := make([]client.LiveClient, 0, len(cb.clientMap))
+	for id, c := range cb.clientMap {
+		if cb.waitKey[id] {
+			// 按 live 起播的客户端从下一个关键帧开始，中途更新的序列头照常发送
+			if !tag.IsKeyFrame() && !isHeaderTag(tag) {
+				continue
+			}
+			if tag.IsKeyFrame() {
+				delete(cb.waitKey, id)
+			}
+		}
+		clients = append(clients, c)
+	}
+	cb.mu.Unlock()
+	cb.stats.Observe(tag)
+	cb.health.Observe(tag)
+
+	// 广播给所有客户端
+	for _, c := range clients {
+		c.Broadcast(data)
+	}
+	return true
+}
 
+// gopPacket GOP 缓存里的一个 tag
+type gopPacket struct {
+	data     []byte
+	keyFrame bool
+	ts       uint32
+	at       time.Time // 到达时间，导出片段时按它选时间段
 }
 
-// Broadcast2LiveClient 原地址拉取到数据之后广播给客户端
-func (cb *CameraBroker) Broadcast2LiveClient(data []byte) {
-	cb.clientMutex.Lock()
-	clientMap := cb.clientMap
-	cb.clientMutex.Unlock()
+// cacheGOP 关键帧开始新的 GOP 并按起播缓存策略淘汰更早的 GOP；超过包数上限时丢掉最早的 GOP，
+// 只剩当前 GOP 也放不下或者进程内存预算超出时丢掉全部缓存，新观众等下一个关键帧；调用方需持有 mu
+func (cb *CameraBroker) cacheGOP(data []byte, keyFrame bool, ts uint32) {
+	if !keyFrame && len(cb.gop) == 0 {
+		// 还没有收到关键帧，缓存了也没法解码
+		return
+	}
+	if cb.account.Over() {
+		cb.resetGOP()
+		return
+	}
+	for len(cb.gop) >= cb.maxCache {
+		if !cb.dropGOP(cb.nextGOP()) {
+			cb.resetGOP()
+			if !keyFrame {
+				return
+			}
+		}
+	}
+	cb.gop = append(cb.gop, gopPacket{data: data, keyFrame: keyFrame, ts: ts, at: time.Now()})
+	cb.gopBytes += len(data)
+	cb.account.Charge(len(data))
+	if keyFrame {
+		cb.dropGOP(cb.retainIndex())
+	}
+}
 
-	// 简化：这里假设每个 packet 都是关键帧或帧数据
-	// 实际项目中需要解析 FLV tag 判断关键帧
-	isKeyFrame := data[0]&0x10 != 0
-	// 如果是关键帧，重置 GOP 缓存
-	if isKeyFrame {
-		cb.gop = cb.gop[:0]
+// retainIndex 缓存需要保留的最早位置：起播需要的 GOP，以及 Retain 时长内的全部 GOP；调用方需持有 mu
+func (cb *CameraBroker) retainIndex() int {
+	start := cb.startIndex(broker.StartBuffer)
+	if cb.cachePolicy.Retain <= 0 {
+		return start
+	}
+	// 保留 Retain 开始之前的最后一个关键帧，导出的片段才能从 Retain 的起点开始
+	since := cb.gop[len(cb.gop)-1].at.Add(-cb.cachePolicy.Retain)
+	keep := 0
+	for i := 0; i < start; i++ {
+		if cb.gop[i].keyFrame && !cb.gop[i].at.After(since) {
+			keep = i
+		}
 	}
-	// 缓存
-	cb.gop = append(cb.gop, data)
+	return keep
+}
 
-	// 广播给所有客户端
-	for _, c := range clientMap {
-		c.GetDataChan() <- data
+// nextGOP 第二个 GOP 的起点，只有一个 GOP 时返回 0；调用方需持有 mu
+func (cb *CameraBroker) nextGOP() int {
+	for i := 1; i < len(cb.gop); i++ {
+		if cb.gop[i].keyFrame {
+			return i
+		}
 	}
+	return 0
+}
+
+// dropGOP 丢掉 gop[:n] 并归还记账，n <= 0 时什么都不做；调用方需持有 mu
+func (cb *CameraBroker) dropGOP(n int) bool {
+	if n <= 0 {
+		return false
+	}
+	for _, p := range cb.gop[:n] {
+		cb.gopBytes -= len(p.data)
+		cb.account.Free(len(p.data))
+	}
+	cb.gop = append(cb.gop[:0], cb.gop[n:]...)
+	return true
+}
+
+// startIndex 按起播方式在 gop 里选起点，-1 表示没有可以起播的数据；调用方需持有 mu
+func (cb *CameraBroker) startIndex(mode broker.START_MODE) int {
+	return cb.cachePolicy.StartIndex(mode, len(cb.gop), func(i int) broker.CacheEntry {
+		return broker.CacheEntry{Size: len(cb.gop[i].data), KeyFrame: cb.gop[i].keyFrame, Timestamp: cb.gop[i].ts}
+	})
+}
+
+// resetGOP 清空 GOP 缓存并归还记账，调用方需持有 mu
+func (cb *CameraBroker) resetGOP() {
+	cb.account.Free(cb.gopBytes)
+	cb.gop = nil
+	cb.gopBytes = 0
+}
 
+// initialBytes 新客户端起播需要的数据：FLV 头 + 元数据 + 序列头 + 按起播方式选的 GOP，还没有收到推流时为 nil；调用方需持有 mu
+func (cb *CameraBroker) initialBytes(mode broker.START_MODE) []byte {
+	if cb.flvHeader == nil {
+		return nil
+	}
+	var gop []gopPacket
+	if i := cb.startIndex(mode); i >= 0 {
+		gop = cb.gop[i:]
+	}
+	size := cb.headerSize()
+	for _, p := range gop {
+		size += len(p.data)
+	}
+	buf := cb.appendHeader(make([]byte, 0, size))
+	for _, p := range gop {
+		buf = append(buf, p.data...)
+	}
+	return buf
+}
+
+// headerSize appendHeader 写入的字节数，调用方需持有 mu
+func (cb *CameraBroker) headerSize() int {
+	size := len(cb.flvHeader)
+	for _, t := range []*flvBroker.FlvTag{cb.metaTag, cb.videoSeqTag, cb.videoMetaTag, cb.audioSeqTag} {
+		if t != nil {
+			size += flvBroker.FLVTagHeaderSize + len(t.Data) + flvBroker.PrevTagSizeLength
+		}
+	}
+	return size
+}
+
+// appendHeader 追加起播头：FLV 头 + 元数据 + 序列头，时间戳为 0；调用方需持有 mu
+func (cb *CameraBroker) appendHeader(buf []byte) []byte {
+	buf = append(buf, cb.flvHeader...)
+	for _, t := range []*flvBroker.FlvTag{cb.metaTag, cb.videoSeqTag, cb.videoMetaTag, cb.audioSeqTag} {
+		if t == nil {
+			continue
+		}
+		st := *t
+		st.Timestamp = 0
+		buf = append(buf, st.ToBytes()...)
+	}
+	return buf
+}
+
+// Clip 从 GOP 缓存里导出一段直播（见 broker.Clipper），能导出多久由缓存策略的 Retain 和 camera_gop 的包数上限决定
+func (cb *CameraBroker) Clip(from, to time.Time) (*broker.Clip, error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.flvHeader == nil {
+		return nil, broker.ErrClipRange
+	}
+	start, end, err := broker.ClipRange(from, to, len(cb.gop), func(i int) broker.ClipEntry {
+		return broker.ClipEntry{KeyFrame: cb.gop[i].keyFrame, At: cb.gop[i].at}
+	})
+	if err != nil {
+		return nil, err
+	}
+	tags := make([][]byte, 0, end-start)
+	for _, p := range cb.gop[start:end] {
+		tags = append(tags, p.data)
+	}
+	header := cb.appendHeader(make([]byte, 0, cb.headerSize()))
+	return &broker.Clip{Header: header, Tags: tags, Start: cb.gop[start].at, End: cb.gop[end-1].at}, nil
+}
+
+// isHeaderTag 元数据、序列头这类不属于任何 GOP 的 tag
+func isHeaderTag(tag *flvBroker.FlvTag) bool {
+	return tag.TagType == flvBroker.TagTypeScript || tag.IsSequenceHeader() || isVideoMetadata(tag)
+}
+
+// isVideoMetadata Enhanced FLV 的视频元数据包，和序列头一样放进起播头
+func isVideoMetadata(tag *flvBroker.FlvTag) bool {
+	h := tag.VideoHeader()
+	return h != nil && h.Enhanced && h.PacketType == flvBroker.VideoPacketMetadata
+}
+
+// Broadcast2LiveClient 广播一段已经封装好的 FLV tag 数据，不进入缓存
+func (cb *CameraBroker) Broadcast2LiveClient(data []byte) {
+	cb.mu.Lock()
+	clients := make([]client.LiveClient, 0, len(cb.clientMap))
+	for _, c := range cb.clientMap {
+		clients = append(clients, c)
+	}
+	cb.mu.Unlock()
+
+	for _, c := range clients {
+		c.Broadcast(data)
+	}
 }
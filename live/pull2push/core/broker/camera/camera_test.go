@@ -0,0 +1,341 @@
+package camera
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var flvHeader = []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+
+func newTag(tagType uint8, ts uint32, data ...byte) *flvBroker.FlvTag {
+	return &flvBroker.FlvTag{TagType: tagType, DataSize: uint32(len(data)), Timestamp: ts, Data: data}
+}
+
+// 测试用的 avc tag：第一个字节是帧类型 + 编码，第二个字节是 AVCPacketType；
+// handleTag 会改写时间戳，每次都要新建
+func metaTag() *flvBroker.FlvTag { return newTag(flvBroker.TagTypeScript, 0, 2, 0, 10) }
+func videoSeqTag(ts uint32) *flvBroker.FlvTag {
+	return newTag(flvBroker.TagTypeVideo, ts, 0x17, 0, 0, 0, 0)
+}
+func audioSeqTag(ts uint32) *flvBroker.FlvTag {
+	return newTag(flvBroker.TagTypeAudio, ts, 0xAF, 0, 0x12, 0x10)
+}
+
+func keyFrame(ts uint32) *flvBroker.FlvTag {
+	return newTag(flvBroker.TagTypeVideo, ts, 0x17, 1, 0, 0, 0, byte(ts))
+}
+func interFrame(ts uint32) *flvBroker.FlvTag {
+	return newTag(flvBroker.TagTypeVideo, ts, 0x27, 1, 0, 0, 0, byte(ts))
+}
+func audioFrame(ts uint32) *flvBroker.FlvTag {
+	return newTag(flvBroker.TagTypeAudio, ts, 0xAF, 1, byte(ts))
+}
+
+// recordClient 记录 Broadcast 收到的数据
+type recordClient struct {
+	mu   sync.Mutex
+	data [][]byte
+}
+
+func (c *recordClient) Broadcast(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = append(c.data, data)
+}
+func (c *recordClient) Listen()                  {}
+func (c *recordClient) GetDataChan() chan []byte { return nil }
+
+func (c *recordClient) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Join(c.data, nil)
+}
+
+// kickClient 记录被踢出的原因
+type kickClient struct {
+	recordClient
+	kicked string
+}
+
+func (c *kickClient) Kick(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.kicked = reason
+}
+
+func (c *kickClient) kickReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.kicked
+}
+
+// acquire 登记一个测试用的推流
+func acquire(t *testing.T, cb *CameraBroker) *publisher {
+	t.Helper()
+	p := &publisher{remote: t.Name(), interrupt: func() {}}
+	if err := cb.acquire(p); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+	return p
+}
+
+func concat(tags ...*flvBroker.FlvTag) []byte {
+	var buf []byte
+	for _, tag := range tags {
+		buf = append(buf, tag.ToBytes()...)
+	}
+	return buf
+}
+
+func publish(t *testing.T, cb *CameraBroker, tags ...*flvBroker.FlvTag) {
+	t.Helper()
+	body := append(append([]byte(nil), flvHeader...), concat(tags...)...)
+	if err := cb.Publish(context.Background(), bytes.NewReader(body)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+}
+
+func TestCameraBrokerInitialGOP(t *testing.T) {
+	cb := NewCameraBroker("cam", 0)
+	defer cb.Close()
+
+	live := &recordClient{}
+	cb.AddLiveClient("live", live)
+	if len(live.data) != 0 {
+		t.Fatalf("client got %d packets before any push", len(live.data))
+	}
+
+	// 推流过程中加入的观众：先收到起播头 + 最近一个 GOP，再收到实时数据
+	late := &recordClient{}
+	tags := []*flvBroker.FlvTag{metaTag(), videoSeqTag(40), audioSeqTag(40), keyFrame(40), audioFrame(60), interFrame(80), keyFrame(120), interFrame(160)}
+	p := acquire(t, cb)
+	cb.mu.Lock()
+	cb.flvHeader = flvHeader
+	cb.mu.Unlock()
+	for _, tag := range tags {
+		st := *tag
+		cb.handleTag(p, &st)
+	}
+	cb.AddLiveClient("late", late)
+	cb.handleTag(p, audioFrame(170))
+
+	want := append(append([]byte(nil), flvHeader...), concat(metaTag(), videoSeqTag(0), audioSeqTag(0), keyFrame(120), interFrame(160), audioFrame(170))...)
+	if got := late.bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("late viewer got\n% x\nwant\n% x", got, want)
+	}
+	if got, want := live.bytes(), concat(append(tags, audioFrame(170))...); !bytes.Equal(got, want) {
+		t.Fatalf("live viewer got\n% x\nwant\n% x", got, want)
+	}
+	if cb.MediaInfo() == nil {
+		t.Fatal("no media info")
+	}
+}
+
+func TestCameraBrokerPullLoop(t *testing.T) {
+	cb := NewCameraBroker("cam-push", 3)
+	defer cb.Close()
+
+	viewer := &recordClient{}
+	cb.AddLiveClient("viewer", viewer)
+	tags := []*flvBroker.FlvTag{videoSeqTag(0), interFrame(0), keyFrame(40), interFrame(80), interFrame(120), interFrame(160)}
+	publish(t, cb, tags...)
+
+	if got, want := viewer.bytes(), concat(tags...); !bytes.Equal(got, want) {
+		t.Fatalf("viewer got\n% x\nwant\n% x", got, want)
+	}
+	// 没有宽限期，推流结束后直播马上结束，起播头和 GOP 都清空
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if len(cb.gop) != 0 || cb.gopBytes != 0 || cb.account.Used() != 0 {
+		t.Fatalf("gop not reset: %d packets, %d bytes, account %d", len(cb.gop), cb.gopBytes, cb.account.Used())
+	}
+	if cb.flvHeader != nil || cb.videoSeqTag != nil || cb.active != nil {
+		t.Fatal("header kept after push ended")
+	}
+}
+
+func TestCameraBrokerGOPLimit(t *testing.T) {
+	cb := NewCameraBroker("cam-limit", 3)
+	defer cb.Close()
+	cb.flvHeader = flvHeader
+	p := acquire(t, cb)
+
+	// 开头的非关键帧不缓存；超过 maxCache 时丢掉整个 GOP，等下一个关键帧
+	for _, tag := range []*flvBroker.FlvTag{interFrame(0), keyFrame(40), interFrame(80), interFrame(120)} {
+		cb.handleTag(p, tag)
+	}
+	if len(cb.gop) != 3 {
+		t.Fatalf("gop = %d packets, want 3", len(cb.gop))
+	}
+	cb.handleTag(p, interFrame(160))
+	cb.handleTag(p, interFrame(200))
+	if len(cb.gop) != 0 {
+		t.Fatalf("gop = %d packets after overflow, want 0", len(cb.gop))
+	}
+	cb.handleTag(p, keyFrame(240))
+	if len(cb.gop) != 1 || int64(cb.gopBytes) != cb.account.Used() {
+		t.Fatalf("gop = %d packets, %d bytes, account %d", len(cb.gop), cb.gopBytes, cb.account.Used())
+	}
+}
+
+// modeClient 带起播方式的客户端
+type modeClient struct {
+	recordClient
+	mode broker.START_MODE
+}
+
+func (c *modeClient) StartMode() broker.START_MODE { return c.mode }
+
+// tagCount 客户端收到的数据里有几个 tag
+func tagCount(t *testing.T, c *recordClient) int {
+	t.Helper()
+	tags, err := flvBroker.NewFLVDemuxer().Feed(c.bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(tags)
+}
+
+func TestCameraBrokerCachePolicy(t *testing.T) {
+	cb := NewCameraBroker("cam-cache", 0)
+	defer cb.Close()
+	cb.SetCachePolicy(broker.CachePolicy{GOPs: 2})
+	cb.flvHeader = flvHeader
+	p := acquire(t, cb)
+
+	for _, tag := range []*flvBroker.FlvTag{keyFrame(0), interFrame(40), keyFrame(80), interFrame(120), keyFrame(160), interFrame(200)} {
+		cb.handleTag(p, tag)
+	}
+	// 只保留最近两个 GOP
+	if len(cb.gop) != 4 || !cb.gop[0].keyFrame || int64(cb.gopBytes) != cb.account.Used() {
+		t.Fatalf("gop = %d packets, %d bytes, account %d", len(cb.gop), cb.gopBytes, cb.account.Used())
+	}
+
+	buffered := &recordClient{}
+	cb.AddLiveClient("buffer", buffered)
+	latest := &modeClient{mode: broker.StartGOP}
+	cb.AddLiveClient("gop", latest)
+	live := &modeClient{mode: broker.StartLive}
+	cb.AddLiveClient("live", live)
+	if n := tagCount(t, buffered); n != 4 {
+		t.Fatalf("buffer 起播收到 %d 个 tag，期望 4", n)
+	}
+	if n := tagCount(t, &latest.recordClient); n != 2 {
+		t.Fatalf("gop 起播收到 %d 个 tag，期望 2", n)
+	}
+
+	// live 起播只有 FLV 头，从下一个关键帧开始收实时数据
+	cb.handleTag(p, interFrame(240))
+	if n := tagCount(t, &live.recordClient); n != 0 {
+		t.Fatalf("live 在关键帧之前收到 %d 个 tag", n)
+	}
+	cb.handleTag(p, keyFrame(280))
+	cb.handleTag(p, interFrame(320))
+	if n := tagCount(t, &live.recordClient); n != 2 {
+		t.Fatalf("live 收到 %d 个 tag，期望 2", n)
+	}
+}
+
+func TestCameraBrokerDuplicatePolicy(t *testing.T) {
+	cb := NewCameraBroker("cam-dup", 0)
+	defer cb.Close()
+	first := acquire(t, cb)
+
+	if err := cb.acquire(&publisher{interrupt: func() {}}); !errors.Is(err, ErrPublishing) {
+		t.Fatalf("reject: err = %v", err)
+	}
+
+	// kick：新推流接管，旧推流的读被打断，之后的 tag 不再转发
+	cb.SetPublishPolicy(PublishPolicy{OnDuplicate: DuplicateKick})
+	interrupted := false
+	first.interrupt = func() { interrupted = true }
+	second := acquire(t, cb)
+	if !interrupted || cb.active != second {
+		t.Fatalf("kick: interrupted=%v active=%v", interrupted, cb.active == second)
+	}
+	if cb.handleTag(first, keyFrame(0)) {
+		t.Fatal("kicked publisher still accepted")
+	}
+	cb.unpublish(first)
+	if cb.active != second {
+		t.Fatal("kicked publisher ended the live")
+	}
+
+	// backup：排队的推流只保存起播头，当前推流断开时马上接管，观众先收到它的序列头
+	cb.SetPublishPolicy(PublishPolicy{OnDuplicate: DuplicateBackup})
+	viewer := &recordClient{}
+	cb.AddLiveClient("viewer", viewer)
+	cb.handleTag(second, videoSeqTag(40))
+	cb.handleTag(second, keyFrame(40))
+	backup := acquire(t, cb)
+	backupSeq := newTag(flvBroker.TagTypeVideo, 0, 0x17, 0, 0, 0, 1)
+	if !cb.handleTag(backup, backupSeq) || !cb.handleTag(backup, keyFrame(0)) {
+		t.Fatal("backup publisher rejected")
+	}
+	cb.unpublish(second)
+	if cb.active != backup {
+		t.Fatal("backup did not take over")
+	}
+	// 接管后先丢掉非关键帧，时间戳接在上一个推流之后
+	cb.handleTag(backup, interFrame(40))
+	cb.handleTag(backup, keyFrame(80))
+
+	seq := *backupSeq
+	seq.Timestamp = 40
+	want := concat(videoSeqTag(40), keyFrame(40), &seq, keyFrame(80))
+	if got := viewer.bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("viewer got\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestCameraBrokerGraceReconnect(t *testing.T) {
+	cb := NewCameraBroker("cam-grace", 0)
+	defer cb.Close()
+	cb.SetPublishPolicy(PublishPolicy{Grace: 1500 * time.Millisecond, HoldFrame: true})
+	viewer := &kickClient{}
+	cb.AddLiveClient("viewer", viewer)
+
+	first := acquire(t, cb)
+	for _, tag := range []*flvBroker.FlvTag{videoSeqTag(0), keyFrame(0), interFrame(40)} {
+		cb.handleTag(first, tag)
+	}
+	cb.unpublish(first)
+
+	// 宽限期内观众留着，每秒收到一次最后的关键帧
+	time.Sleep(holdInterval + 200*time.Millisecond)
+	if reason := viewer.kickReason(); reason != "" {
+		t.Fatalf("viewer kicked during grace: %s", reason)
+	}
+	held := keyFrame(0)
+	held.Timestamp = 40 + uint32(holdInterval.Milliseconds())
+
+	// 重连的推流时间戳从 0 开始，换算成接着上一个推流
+	second := acquire(t, cb)
+	cb.handleTag(second, videoSeqTag(0))
+	cb.handleTag(second, keyFrame(0))
+	key := keyFrame(0)
+	key.Timestamp = held.Timestamp + reconnectGap
+	want := concat(videoSeqTag(0), keyFrame(0), interFrame(40), held, videoSeqTag(key.Timestamp), key)
+	if got := viewer.bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("viewer got\n% x\nwant\n% x", got, want)
+	}
+
+	// 第二次断开后没有重连，宽限期结束时断开观众，清空起播头
+	cb.SetPublishPolicy(PublishPolicy{Grace: 50 * time.Millisecond})
+	cb.unpublish(second)
+	time.Sleep(200 * time.Millisecond)
+	if viewer.kickReason() == "" {
+		t.Fatal("viewer not kicked after grace")
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.videoSeqTag != nil || cb.published {
+		t.Fatal("state not reset after grace")
+	}
+}
@@ -0,0 +1,339 @@
+package camera
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/client"
+	"pull2push/core/stream"
+	"time"
+)
+
+// ErrPublishing 这路直播已经有推流，并且重复推流策略是拒绝
+var ErrPublishing = errors.New("这路直播已经在推流")
+
+// DUPLICATE_POLICY 同一路直播已经有推流时，新推流的处理方式
+type DUPLICATE_POLICY string
+
+const (
+	// DuplicateReject 拒绝新推流
+	DuplicateReject DUPLICATE_POLICY = "reject"
+
+	// DuplicateKick 断开旧推流，由新推流接管
+	DuplicateKick DUPLICATE_POLICY = "kick"
+
+	// DuplicateBackup 新推流排队做备份，当前推流断开时马上接管
+	DuplicateBackup DUPLICATE_POLICY = "backup"
+)
+
+// PublishPolicy 推流断开后的宽限期和重复推流策略
+type PublishPolicy struct {
+	Grace       time.Duration    // 推流断开后保留观众等待重连的时间，0 表示马上结束直播
+	HoldFrame   bool             // 宽限期内重复发送最后一个关键帧，播放器停在最后一帧，不会因为没有数据超时断开
+	OnDuplicate DUPLICATE_POLICY // 已经有推流时新推流的处理方式，为空时拒绝
+}
+
+const (
+	// holdInterval 宽限期内重复发送最后一个关键帧的间隔
+	holdInterval = time.Second
+
+	// reconnectGap 新推流接管时，第一个 tag 的时间戳接在上一个推流最后一个 tag 之后多少毫秒
+	reconnectGap = 40
+)
+
+// publisher 一次推流（一个 POST 请求，或者 WritePacket 写入的包）
+type publisher struct {
+	remote    string
+	startedAt time.Time
+	interrupt func() // 打断阻塞中的读，被踢掉或者 broker 关闭时调用
+
+	waitKey bool  // 接管一路正在播放的直播，要等到视频关键帧才开始转发
+	based   bool  // 已经算好时间戳偏移
+	offset  int64 // 时间戳偏移（毫秒），让观众看到的时间戳接着上一个推流连续增长
+
+	// 排队做备份时收到的起播头，接管时发给观众
+	metaTag      *flvBroker.FlvTag
+	videoSeqTag  *flvBroker.FlvTag
+	videoMetaTag *flvBroker.FlvTag
+	audioSeqTag  *flvBroker.FlvTag
+}
+
+// newPublisher 推流的数据从 r 读取；r 带推流端地址时记下来，能设置读超时或者关闭时用来打断阻塞中的读
+func newPublisher(r io.Reader) *publisher {
+	p := &publisher{remote: "unknown", startedAt: time.Now(), interrupt: func() {}}
+	if a, ok := r.(interface{ RemoteAddr() string }); ok {
+		p.remote = a.RemoteAddr()
+	}
+	switch d := r.(type) {
+	case interface{ SetReadDeadline(time.Time) error }:
+		// 推流的读可能一直阻塞在一个已经死掉的连接上，读超时设为现在马上返回
+		p.interrupt = func() { _ = d.SetReadDeadline(time.Now()) }
+	case io.Closer:
+		p.interrupt = func() { d.Close() }
+	}
+	return p
+}
+
+// SetPublishPolicy 修改宽限期和重复推流策略，配置热更新时调用，正在进行中的宽限期不受影响
+func (cb *CameraBroker) SetPublishPolicy(policy PublishPolicy) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.policy = policy
+}
+
+// Publish 从 r 读取一次 FLV 推流，直到推流断开、ctx 结束或者被新推流踢掉；按重复推流策略拒绝时返回 ErrPublishing。
+// HTTP 推流见 adapter.PublishRequest
+func (cb *CameraBroker) Publish(ctx context.Context, r io.Reader) error {
+	p := newPublisher(r)
+	if err := cb.acquire(p); err != nil {
+		return err
+	}
+	defer cb.unpublish(p)
+	stop := context.AfterFunc(ctx, p.interrupt)
+	defer stop()
+	log.Printf("[camera:%s] 开始推流 %s", cb.BrokerKey, p.remote)
+
+	body := bufio.NewReaderSize(r, 64<<10)
+	header, err := flvBroker.ReadFLVHeader(body)
+	if err != nil {
+		log.Printf("[camera:%s] 推流不是 FLV: %v", cb.BrokerKey, err)
+		return nil
+	}
+	cb.mu.Lock()
+	if cb.flvHeader == nil {
+		cb.flvHeader = header
+	}
+	cb.mu.Unlock()
+	cb.health.Reset()
+
+	for {
+		tag, err := flvBroker.ReadFlvTag(body)
+		if err != nil {
+			log.Printf("[camera:%s] 推流断开 %s: %v", cb.BrokerKey, p.remote, err)
+			return nil
+		}
+		if !cb.handleTag(p, tag) {
+			log.Printf("[camera:%s] 推流 %s 被新推流踢掉", cb.BrokerKey, p.remote)
+			return nil
+		}
+	}
+}
+
+// WritePacket 进程内的数据源按包推流：第一次写入时和 HTTP 推流一样按重复推流策略登记，
+// 之后一直生效，直到被新推流踢掉（返回 ErrPublishing）或者 Close
+func (cb *CameraBroker) WritePacket(pkt stream.Packet) error {
+	tag, err := flvBroker.TagFromPacket(pkt)
+	if err != nil {
+		return err
+	}
+	cb.writeMu.Lock()
+	defer cb.writeMu.Unlock()
+	cb.mu.Lock()
+	closed := cb.closed
+	cb.mu.Unlock()
+	if closed {
+		return stream.ErrClosed
+	}
+	if cb.writer == nil {
+		p := &publisher{remote: "WritePacket", startedAt: time.Now(), interrupt: func() {}}
+		if err := cb.acquire(p); err != nil {
+			return err
+		}
+		cb.mu.Lock()
+		if cb.flvHeader == nil {
+			cb.flvHeader = flvBroker.BuildFLVHeader(true, true)
+		}
+		cb.mu.Unlock()
+		cb.writer = p
+	}
+	if !cb.handleTag(cb.writer, tag) {
+		cb.writer = nil
+		return ErrPublishing
+	}
+	return nil
+}
+
+// acquire 按重复推流策略登记一个新推流
+func (cb *CameraBroker) acquire(p *publisher) error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.closed {
+		return fmt.Errorf("直播 %s 已经停止: %w", cb.BrokerKey, stream.ErrClosed)
+	}
+	if cb.active == nil {
+		cb.activate(p)
+		return nil
+	}
+	switch cb.policy.OnDuplicate {
+	case DuplicateKick:
+		old := cb.active
+		cb.activate(p)
+		old.interrupt()
+	case DuplicateBackup:
+		cb.backups = append(cb.backups, p)
+		log.Printf("[camera:%s] 推流 %s 排队做备份", cb.BrokerKey, p.remote)
+	default:
+		return ErrPublishing
+	}
+	return nil
+}
+
+// activate 让 p 成为当前推流，结束宽限期；备份推流接管时先把它的起播头发给观众。调用方需持有 mu
+func (cb *CameraBroker) activate(p *publisher) {
+	cb.active = p
+	cb.generation++
+	// 观众已经在看了，中途接管要等关键帧，否则解码器拿到的是半个 GOP
+	p.waitKey = cb.published && cb.videoSeqTag != nil
+
+	var headers []byte
+	for _, h := range []struct {
+		dst **flvBroker.FlvTag
+		src *flvBroker.FlvTag
+	}{{&cb.metaTag, p.metaTag}, {&cb.videoSeqTag, p.videoSeqTag}, {&cb.videoMetaTag, p.videoMetaTag}, {&cb.audioSeqTag, p.audioSeqTag}} {
+		if h.src == nil {
+			continue
+		}
+		h.src.Timestamp = cb.lastTs
+		*h.dst = h.src
+		headers = append(headers, h.src.ToBytes()...)
+	}
+	if len(headers) > 0 {
+		for _, c := range cb.clientMap {
+			c.Broadcast(headers)
+		}
+	}
+}
+
+// unpublish 推流结束：有备份时马上接管，否则进入宽限期
+func (cb *CameraBroker) unpublish(p *publisher) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	for i, b := range cb.backups {
+		if b == p {
+			cb.backups = append(cb.backups[:i], cb.backups[i+1:]...)
+			return
+		}
+	}
+	if cb.active != p {
+		// 已经被新推流踢掉
+		return
+	}
+	cb.active = nil
+	if cb.closed {
+		return
+	}
+	if len(cb.backups) > 0 {
+		next := cb.backups[0]
+		cb.backups = cb.backups[1:]
+		cb.activate(next)
+		log.Printf("[camera:%s] 备份推流 %s 接管", cb.BrokerKey, next.remote)
+		return
+	}
+	if cb.policy.Grace <= 0 {
+		cb.endPublish()
+		return
+	}
+	log.Printf("[camera:%s] 推流断开，等待 %v 重连", cb.BrokerKey, cb.policy.Grace)
+	go cb.waitReconnect(cb.generation, cb.policy)
+}
+
+// waitReconnect 宽限期：期间有新推流接管就退出，超时后结束直播
+func (cb *CameraBroker) waitReconnect(generation uint64, policy PublishPolicy) {
+	deadline := time.NewTimer(policy.Grace)
+	defer deadline.Stop()
+	var hold <-chan time.Time
+	if policy.HoldFrame {
+		ticker := time.NewTicker(holdInterval)
+		defer ticker.Stop()
+		hold = ticker.C
+	}
+	for {
+		select {
+		case <-cb.stopSig:
+			return
+		case <-deadline.C:
+			cb.mu.Lock()
+			if cb.active == nil && cb.generation == generation {
+				log.Printf("[camera:%s] %v 内没有重新推流，直播结束", cb.BrokerKey, policy.Grace)
+				cb.endPublish()
+			}
+			cb.mu.Unlock()
+			return
+		case <-hold:
+			if !cb.holdFrame(generation) {
+				return
+			}
+		}
+	}
+}
+
+// holdFrame 重新发送最后一个关键帧，时间戳往后推，返回 false 表示已经有新推流接管
+func (cb *CameraBroker) holdFrame(generation uint64) bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.active != nil || cb.generation != generation {
+		return false
+	}
+	if cb.keyTag == nil {
+		return true
+	}
+	cb.lastTs += uint32(holdInterval.Milliseconds())
+	key := *cb.keyTag
+	key.Timestamp = cb.lastTs
+	data := key.ToBytes()
+	for _, c := range cb.clientMap {
+		c.Broadcast(data)
+	}
+	return true
+}
+
+// endPublish 直播结束：清空起播头和 GOP，断开所有观众，下一次推流从头开始。调用方需持有 mu
+func (cb *CameraBroker) endPublish() {
+	cb.resetGOP()
+	cb.flvHeader, cb.keyTag = nil, nil
+	cb.metaTag, cb.videoSeqTag, cb.videoMetaTag, cb.audioSeqTag = nil, nil, nil, nil
+	cb.published = false
+	cb.lastTs = 0
+	for _, c := range cb.clientMap {
+		if kickable, ok := c.(client.Kickable); ok {
+			kickable.Kick("推流已断开，直播结束")
+		}
+	}
+}
+
+// rebase 把推流的时间戳换算成观众看到的时间戳，第一个 tag 接在上一个推流之后。调用方需持有 mu
+func (cb *CameraBroker) rebase(p *publisher, tag *flvBroker.FlvTag) {
+	if !p.based {
+		p.based = true
+		if cb.published {
+			p.offset = int64(cb.lastTs) + reconnectGap - int64(tag.Timestamp)
+		}
+	}
+	ts := int64(tag.Timestamp) + p.offset
+	if ts < 0 {
+		ts = 0
+	}
+	tag.Timestamp = uint32(ts)
+	if tag.Timestamp > cb.lastTs || !cb.published {
+		cb.lastTs = tag.Timestamp
+	}
+	cb.published = true
+}
+
+// keepHeader 备份推流只保存起播头，数据丢掉
+func (p *publisher) keepHeader(tag *flvBroker.FlvTag) {
+	switch {
+	case tag.TagType == flvBroker.TagTypeScript:
+		p.metaTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == flvBroker.TagTypeVideo:
+		p.videoSeqTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == flvBroker.TagTypeAudio:
+		p.audioSeqTag = tag
+	case isVideoMetadata(tag):
+		p.videoMetaTag = tag
+	}
+}
@@ -1,7 +1,6 @@
 package flv
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -9,11 +8,13 @@ import (
 	"io"
 	"log"
 	"log/slog"
-	"net"
-	"net/http"
 	"pull2push/core/broker"
 	"pull2push/core/client"
+	"pull2push/core/memory"
+	"pull2push/core/stream"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,49 +22,155 @@ import (
 
 // FLVStreamBroker 每个 直播地址 用一个 Broker 管理，里面管理了多个当前直播链接的客户端
 type FLVStreamBroker struct {
-	BrokerKey   string      // 直播房间的唯一编号
-	UpstreamURL string      // 直播房间的上游拉流地址
-	DataCh      chan []byte // 上游拉流缓存的数据
-	GOPCache    *GOPCache   // 保留关键帧数据
-	flvParser   *FLVParser  // 创建FLV解析器 (启用调试模式)
+	BrokerKey   string          // 直播房间的唯一编号
+	UpstreamURL string          // 直播房间的上游拉流地址
+	ring        *PacketRing     // 所有观众共享的环形缓冲，同时承担 GOP 缓存
+	flvParser   *FLVParser      // 创建FLV解析器 (启用调试模式)
+	dialer      SourceDialer    // 上游数据源
+	account     *memory.Account // 环形缓冲的内存记账
 
 	HeaderMutex  sync.RWMutex
-	HeaderBytes  []byte
+	HeaderBytes  []byte // 起播头：FLV 头 + 元数据 + 序列头
 	HeaderParsed bool
+	flvHeader    []byte  // 上游的 FLV 头（含 PreviousTagSize0）
+	metaTag      *FlvTag // 最近一次的 onMetaData
+	videoSeqTag  *FlvTag // 最近一次的视频序列头
+	videoMetaTag *FlvTag // 最近一次的 Enhanced FLV 视频元数据（HDR colorInfo 等）
+	audioSeqTag  *FlvTag // 最近一次的音频序列头
+	stats        *MediaStats
+	health       *HealthAnalyzer
 
 	clientMutex sync.Mutex                   // 客户端的异步操作控制器
 	clientMap   map[string]client.LiveClient // map[clientId]LiveFLVClient 存储这个broker里面所有的客户端
-
-	stopSig chan struct{} // 控制当前这个直播是否被关闭
-	once    sync.Once
+	pushMap     map[string]client.LiveClient // 不读环形缓冲、需要逐个 Broadcast 的客户端（转推等），是 clientMap 的子集
+	waitKey     map[string]bool              // pushMap 里按 live 起播、还在等关键帧的客户端，在 HeaderMutex 下修改
+
+	sourceMutex sync.Mutex         // 保护 UpstreamURL / source / cancelPull
+	source      TagSource          // 当前正在读取的数据源
+	cancelPull  context.CancelFunc // 取消当前这一次拉流
+
+	// 断流插播垫片（见 flv_fallback.go），先锁 fallbackMutex 再锁 HeaderMutex
+	fallbackMutex sync.Mutex
+	slate         *Slate        // 为 nil 时不插播
+	fallbackAfter time.Duration // 上游多久没有数据开始插播
+	slateStop     chan struct{} // 正在插播时不为 nil，关闭后停止插播
+	spliced       bool          // 插播过垫片，之后上游的时间戳都要换算
+	lastTs        uint32        // 最后发给观众的时间戳
+	lastUpstream  atomic.Int64  // 最后一次收到上游 tag 的时间（UnixNano）
+
+	stopSig   chan struct{} // 控制当前这个直播是否被关闭
+	once      sync.Once
+	startOnce sync.Once
 }
 
+// NewFLVStreamBroker 按上游地址的 scheme 选择数据源（见 RegisterSourceDialer），调用 Start 之后开始拉流
 func NewFLVStreamBroker(brokerKey, upstreamURL string) *FLVStreamBroker {
+	return NewFLVStreamBrokerWithDialer(brokerKey, upstreamURL, DialSource)
+}
 
+// NewFLVStreamBrokerWithDialer 使用指定的数据源，TS/RTSP 等非 FLV 上游通过它复用 FLV 的分发逻辑
+func NewFLVStreamBrokerWithDialer(brokerKey, upstreamURL string, dialer SourceDialer) *FLVStreamBroker {
+	return NewFLVStreamBrokerWithPolicy(brokerKey, upstreamURL, dialer, broker.CachePolicy{})
+}
+
+// NewFLVStreamBrokerWithPolicy 使用指定的起播缓存策略，环形缓冲的容量按策略确定，修改策略需要重建 broker
+func NewFLVStreamBrokerWithPolicy(brokerKey, upstreamURL string, dialer SourceDialer, policy broker.CachePolicy) *FLVStreamBroker {
+	account := memory.Default.Open(brokerKey)
+	ring := NewPacketRing(RingSizeFor(policy), account)
+	ring.SetPolicy(policy)
 	b := FLVStreamBroker{
 		BrokerKey:   brokerKey,
 		UpstreamURL: upstreamURL,
-		GOPCache:    &GOPCache{tags: make([]*FlvTag, 0)},
-		DataCh:      make(chan []byte, 4096), // 带缓冲，缓存 4096 个数据包
+		dialer:      dialer,
+		account:     account,
+		ring:        ring,
+		stats:       NewMediaStats(),
+		health:      NewHealthAnalyzer(brokerKey, DefaultHealthConfig()),
 		clientMap:   make(map[string]client.LiveClient),
+		pushMap:     make(map[string]client.LiveClient),
+		waitKey:     make(map[string]bool),
 		stopSig:     make(chan struct{}),
 	}
-
-	// start pulling loop
-	go b.PullLoop(broker.BrokerOptional{})
-	fmt.Printf("\n newBroker = %#v \n", &b)
+	b.lastUpstream.Store(time.Now().UnixNano())
 
 	return &b
 }
 
-func (sb *FLVStreamBroker) AddLiveClient(clientId string, client client.LiveClient) {
+// Start 在后台拉流和监听状态，不阻塞；ctx 结束等同于 Close，重复调用只启动一次
+func (b *FLVStreamBroker) Start(ctx context.Context) error {
+	if b.stopped() {
+		return stream.ErrClosed
+	}
+	b.startOnce.Do(func() {
+		context.AfterFunc(ctx, func() { b.Close() })
+		go func() {
+			if err := b.PullLoop(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("[flv:%s] 拉流结束: %v", b.BrokerKey, err)
+			}
+		}()
+		go b.ListenStatus()
+	})
+	return nil
+}
+
+// AddLiveClient 新增客户端。读环形缓冲的客户端（见 client.RingReader）只登记，数据由它自己通过 Subscribe 的游标读取；
+// 其他客户端先按起播方式（见 broker.StartModer）发送起播头和缓存的数据，再加入广播列表
+func (sb *FLVStreamBroker) AddLiveClient(clientId string, liveClient client.LiveClient) {
 	sb.clientMutex.Lock()
 	defer sb.clientMutex.Unlock()
 
-	sb.clientMap[clientId] = client
+	sb.clientMap[clientId] = liveClient
+	if _, ok := liveClient.(client.RingReader); ok {
+		return
+	}
+	// pushMap 和环形缓冲都在 HeaderMutex 下更新，起播数据和之后的广播正好衔接
+	mode := broker.StartDefault
+	if m, ok := liveClient.(broker.StartModer); ok {
+		mode = m.StartMode()
+	}
+	sb.HeaderMutex.Lock()
+	init := sb.initialBytes(mode)
+	sb.pushMap[clientId] = liveClient
+	if sb.ring.Policy().Resolve(mode) == broker.StartLive {
+		sb.waitKey[clientId] = true
+	}
+	sb.HeaderMutex.Unlock()
+	if len(init) > 0 {
+		liveClient.Broadcast(init)
+	}
+}
+
+// Subscribe 新观众的读取游标，先返回起播头，再按流默认的起播方式开始
+func (sb *FLVStreamBroker) Subscribe() *RingCursor {
+	return sb.SubscribeAt(broker.StartDefault)
+}
+
+// SubscribeAt 按观众指定的起播方式（?start=）创建读取游标
+func (sb *FLVStreamBroker) SubscribeAt(mode broker.START_MODE) *RingCursor {
+	sb.HeaderMutex.RLock()
+	defer sb.HeaderMutex.RUnlock()
+	var header []byte
+	if sb.HeaderBytes != nil {
+		header = append([]byte(nil), sb.HeaderBytes...)
+	}
+	return sb.ring.NewCursorAt(header, mode)
+}
+
+// AddClient 新增 stream.Client 观众，和不读环形缓冲的旧客户端一样先收到起播数据，FLV 字节解析成包写给它
+func (sb *FLVStreamBroker) AddClient(id string, c stream.Client) error {
+	if sb.stopped() {
+		return stream.ErrClosed
+	}
+	sb.AddLiveClient(id, PacketClientOf(c))
+	return nil
 }
 
-// RemoveClient 移除客户端
+// RemoveClient 移除 stream.Client 观众
+func (sb *FLVStreamBroker) RemoveClient(id string) {
+	sb.RemoveLiveClient(id)
+}
+
+// RemoveLiveClient 移除客户端
 func (sb *FLVStreamBroker) RemoveLiveClient(clientId string) {
 	sb.clientMutex.Lock()
 	defer sb.clientMutex.Unlock()
@@ -72,6 +179,10 @@ func (sb *FLVStreamBroker) RemoveLiveClient(clientId string) {
 		return
 	}
 	delete(sb.clientMap, clientId)
+	sb.HeaderMutex.Lock()
+	delete(sb.pushMap, clientId)
+	delete(sb.waitKey, clientId)
+	sb.HeaderMutex.Unlock()
 
 	//// 如果没有客户端并且想释放 broker，可关闭 stopCh 让 PullLoop 停止（本示例保留 broker，防止频繁断开上游）
 	//if remaining == 0 {
@@ -81,117 +192,315 @@ func (sb *FLVStreamBroker) RemoveLiveClient(clientId string) {
 
 // FindLiveClient 查询 LiveClient
 func (fsb *FLVStreamBroker) FindLiveClient(clientId string) (client.LiveClient, error) {
+	fsb.clientMutex.Lock()
+	defer fsb.clientMutex.Unlock()
+
 	if val, ok := fsb.clientMap[clientId]; ok {
 		return val, nil
 	}
 	return nil, errors.New(fmt.Sprintf("未找到 %s 对应的 LiveClient", clientId))
 }
 
-// UpdateSourceURL 支持切换直播原地址
+// ListLiveClients 当前所有客户端编号
+func (fsb *FLVStreamBroker) ListLiveClients() []string {
+	fsb.clientMutex.Lock()
+	defer fsb.clientMutex.Unlock()
+
+	ids := make([]string, 0, len(fsb.clientMap))
+	for clientId := range fsb.clientMap {
+		ids = append(ids, clientId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// UpdateSourceURL 切换直播原地址：断开当前上游，PullLoop 会用新地址重连，已连接的客户端不受影响
 func (b *FLVStreamBroker) UpdateSourceURL(newSourceURL string) {
+	b.sourceMutex.Lock()
+	b.UpstreamURL = newSourceURL
+	b.sourceMutex.Unlock()
+	log.Printf("[flv:%s] switch upstream to %s", b.BrokerKey, newSourceURL)
+	b.interruptPull()
+}
 
+// Close 停止拉流，broker 从广播器移除后调用
+func (b *FLVStreamBroker) Close() error {
+	b.once.Do(func() {
+		close(b.stopSig)
+		b.SetFallback(nil, 0)
+		// 观众读完缓冲里剩下的数据后结束，缓冲的记账要在账户关闭之前归还
+		b.ring.Close()
+		b.account.Close()
+	})
+	b.interruptPull()
+	return nil
 }
 
-// ListenStatus 监听当前直播的必要状态
+// interruptPull 打断正在进行的拉取（拨号中或者读取中）
+func (b *FLVStreamBroker) interruptPull() {
+	b.sourceMutex.Lock()
+	cancel, src := b.cancelPull, b.source
+	b.sourceMutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	if src != nil {
+		src.Close()
+	}
+}
+
+// stopped 是否已经被 Close
+func (b *FLVStreamBroker) stopped() bool {
+	select {
+	case <-b.stopSig:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait 等待 d，期间被 Close 或者 ctx 结束时返回 false
+func (b *FLVStreamBroker) wait(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-b.stopSig:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// ListenStatus 监听当前直播的必要状态：定时检查是否断流
 func (b *FLVStreamBroker) ListenStatus() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopSig:
+			return
+		case now := <-ticker.C:
+			b.health.Check(now)
+			b.checkFallback(now)
+		}
+	}
+}
 
+// HealthReport 当前的健康状态和最近的异常事件
+func (b *FLVStreamBroker) HealthReport() *broker.HealthReport {
+	return b.health.Report()
 }
 
-// PullLoop 持续去服务端拉流
-func (b *FLVStreamBroker) PullLoop(bo broker.BrokerOptional) {
+// PullLoop 持续去服务端拉流，断开后自动重连，直到 Close（返回 nil）或者 ctx 结束（返回 ctx 的错误）
+func (b *FLVStreamBroker) PullLoop(parent context.Context) error {
 	backoff := time.Second
 	for {
-		log.Println("dial upstream", b.UpstreamURL)
-		req, _ := http.NewRequest("GET", b.UpstreamURL, nil)
-		// add headers typical for FLV
-		req.Header.Set("User-Agent", "Go-Relay-Flv/1.0")
-		req.Header.Set("Accept", "*/*")
-		client := &http.Client{
-			Timeout: 0, // streaming
-			Transport: &http.Transport{
-				// keep-alive
-				DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
-			},
+		ctx, cancel := context.WithCancel(parent)
+		b.sourceMutex.Lock()
+		upstreamURL := b.UpstreamURL
+		b.cancelPull = cancel
+		b.sourceMutex.Unlock()
+		// cancelPull 登记之后再检查，Close 不会漏掉这一次拉流
+		if b.stopped() || parent.Err() != nil {
+			cancel()
+			return b.pullErr(parent)
 		}
-		// 拉流
-		resp, err := client.Do(req)
+
+		log.Println("dial upstream", upstreamURL)
+		// 拉流，按上游协议选择数据源
+		src, err := b.dialer(ctx, upstreamURL)
 		// 失败重试
 		if err != nil {
-			time.Sleep(backoff)
+			cancel()
+			log.Println("upstream dial error:", err)
+			if !b.wait(parent, backoff) {
+				return b.pullErr(parent)
+			}
 			backoff *= 2
 			if backoff > 30*time.Second {
 				backoff = 30 * time.Second
 			}
 			continue
 		}
-		if resp.StatusCode != http.StatusOK {
-			log.Println("upstream bad status:", resp.Status)
-			resp.Body.Close()
-			time.Sleep(backoff)
-			continue
-		}
-
-		//b.doFlvParse(resp.Body)
 
 		// 成功连接，重置 backoff
 		backoff = time.Second
 
-		first := true
-		// 读取本次拉到的流数据，并且进行数据分发
-		buf := make([]byte, 4096)
-		//headerTemp := make([]byte, 0)
-		//totalSize := 0
-		for {
-			n, err := resp.Body.Read(buf)
-			if n > 0 {
-				if first {
-					//if totalSize == 0 {
-					//	dataSize := uint32(buf[1])<<16 | uint32(buf[2])<<8 | uint32(buf[3])
-					//	totalSize = 11 + int(dataSize) + 4 // tag header + data + prevTagSize
-					//}
-					//
-					//headerTemp = append(headerTemp, buf[:n]...)
-					//fmt.Println("构造headerTemp， ", len(headerTemp), "totalSize = ", totalSize)
-					//if len(headerTemp) >= totalSize {
-					//	err = b.readOneFlvTag(headerTemp[:totalSize])
-					//	if err != nil {
-					//		log.Println("关键帧读取失败 readOneFlvTag error:", err)
-					//	}
-					//
-					//	first = false
-					//}
-
-				}
-				// copy bytes to avoid race
-				cp := make([]byte, n)
-				copy(cp, buf[:n])
-				b.Broadcast2LiveClient(cp)
+		b.sourceMutex.Lock()
+		b.source = src
+		b.sourceMutex.Unlock()
+		if ctx.Err() != nil {
+			// 拨号期间被切换地址或者关闭
+			src.Close()
+		}
+
+		// 逐个 tag 读取本次拉到的流数据，并且进行数据分发
+		err = b.relayTags(src)
+		src.Close()
+		cancel()
+		b.sourceMutex.Lock()
+		b.source = nil
+		b.sourceMutex.Unlock()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Println("upstream read error:", "上游直播关闭", "退出拉流过程")
+		} else {
+			log.Println("upstream read error:", err)
+		}
+
+		// small backoff before reconnect
+		if !b.wait(parent, 500*time.Millisecond) {
+			return b.pullErr(parent)
+		}
+	}
+}
+
+// pullErr PullLoop 退出时的返回值：被 Close 时为 nil，否则是 ctx 的错误
+func (b *FLVStreamBroker) pullErr(ctx context.Context) error {
+	if b.stopped() {
+		return nil
+	}
+	return ctx.Err()
+}
+
+// relayTags 读取数据源的 FLV 头和 tag，缓存起播数据后按 tag 广播给客户端
+func (b *FLVStreamBroker) relayTags(src TagSource) error {
+	b.setFLVHeader(src.Header())
+	b.health.Reset()
+
+	seg := &segment{}
+	for {
+		tag, err := src.ReadTag()
+		if err != nil {
+			return err
+		}
+		b.relayTag(seg, tag)
+	}
+}
+
+// setFLVHeader 保存 FLV 头，上游重连时只在第一次连接保存，避免给已连接的客户端重复发送头
+func (b *FLVStreamBroker) setFLVHeader(header []byte) {
+	b.HeaderMutex.Lock()
+	defer b.HeaderMutex.Unlock()
+	if b.flvHeader == nil {
+		b.flvHeader = header
+	}
+}
+
+// handleTag 处理一个上游 tag：写给观众，并计入媒体统计和健康检查
+func (b *FLVStreamBroker) handleTag(tag *FlvTag) {
+	b.writeTag(tag)
+	b.stats.Observe(tag)
+	b.health.Observe(tag)
+}
+
+// writeTag 序列头/元数据单独保存，其余进入 GOP 缓存，然后广播；插播的垫片不计入统计，直接走这里
+func (b *FLVStreamBroker) writeTag(tag *FlvTag) {
+	b.HeaderMutex.Lock()
+	switch {
+	case tag.TagType == TagTypeScript:
+		b.metaTag = tag
+		b.HeaderParsed = true
+	case tag.IsSequenceHeader() && tag.TagType == TagTypeVideo:
+		b.videoSeqTag = tag
+		b.HeaderParsed = true
+	case isVideoMetadata(tag):
+		b.videoMetaTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == TagTypeAudio:
+		b.audioSeqTag = tag
+		b.HeaderParsed = true
+	}
+	b.HeaderBytes = b.buildHeaderBytes()
+
+	// 起播头更新和写入环形缓冲放在同一把锁里，Subscribe 拿到的起播头和游标起点总是一致的
+	data := tag.ToBytes()
+	keyFrame := b.ring.Write(data, tag.IsKeyFrame())
+	clients := make([]client.LiveClient, 0, len(b.pushMap))
+	for id, c := range b.pushMap {
+		if b.waitKey[id] {
+			// 按 live 起播的客户端从下一个关键帧开始，中途更新的元数据和序列头照常发送
+			if !keyFrame && tag.TagType != TagTypeScript && !tag.IsSequenceHeader() {
+				continue
 			}
-			if err != nil {
-				if err == io.EOF {
-					log.Println("upstream EOF, reconnecting", "退出拉流过程")
-					break
-				} else if "unexpected EOF" == err.Error() {
-					log.Println("upstream read error:", "上游直播关闭", "退出拉流过程")
-					break
-				} else {
-					log.Println("upstream read error:", err)
-				}
-				resp.Body.Close()
-				break
+			if keyFrame {
+				delete(b.waitKey, id)
 			}
 		}
+		clients = append(clients, c)
+	}
+	b.HeaderMutex.Unlock()
 
-		// 如果 stop 信号被触发，可以退出（此实现未触发 stop）
-		select {
-		case <-b.stopSig:
-			return
-		default:
+	for _, c := range clients {
+		c.Broadcast(data)
+	}
+}
+
+// WritePacket 把一个 stream.Packet 按 FLV tag 分发给观众，和上游拉到的 tag 一样进入起播缓存；FLV 装不下的编码返回错误
+func (b *FLVStreamBroker) WritePacket(p stream.Packet) error {
+	if b.stopped() {
+		return stream.ErrClosed
+	}
+	tag, err := TagFromPacket(p)
+	if err != nil {
+		return err
+	}
+	// 没有上游时观众的起播头用默认的 FLV 头
+	b.setFLVHeader(BuildFLVHeader(true, true))
+	b.handleTag(tag)
+	return nil
+}
+
+// MediaInfo 当前流的编码参数和码率/帧率/GOP 统计
+func (b *FLVStreamBroker) MediaInfo() *broker.MediaInfo {
+	return b.stats.Snapshot()
+}
+
+// buildHeaderBytes 起播头：FLV 头 + 元数据 + 视频/音频序列头，调用方需持有 HeaderMutex
+func (b *FLVStreamBroker) buildHeaderBytes() []byte {
+	if b.flvHeader == nil {
+		return nil
+	}
+	buf := append([]byte(nil), b.flvHeader...)
+	for _, t := range []*FlvTag{b.metaTag, b.videoSeqTag, b.videoMetaTag, b.audioSeqTag} {
+		if t == nil {
+			continue
 		}
+		st := *t
+		st.Timestamp = 0
+		buf = append(buf, st.ToBytes()...)
+	}
+	return buf
+}
 
-		// small backoff before reconnect
-		time.Sleep(500 * time.Millisecond)
+// isVideoMetadata Enhanced FLV 的视频元数据包，和序列头一样放进起播头
+func isVideoMetadata(tag *FlvTag) bool {
+	h := tag.VideoHeader()
+	return h != nil && h.Enhanced && h.PacketType == VideoPacketMetadata
+}
+
+// Clip 从环形缓冲里导出一段直播（见 broker.Clipper），能导出多久由缓存策略的 Retain 决定
+func (b *FLVStreamBroker) Clip(from, to time.Time) (*broker.Clip, error) {
+	b.HeaderMutex.RLock()
+	defer b.HeaderMutex.RUnlock()
+	if b.HeaderBytes == nil {
+		return nil, broker.ErrClipRange
+	}
+	tags, start, end, err := b.ring.Range(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return &broker.Clip{Header: append([]byte(nil), b.HeaderBytes...), Tags: tags, Start: start, End: end}, nil
+}
+
+// initialBytes 新客户端起播需要的数据：起播头 + 按起播方式从缓冲里取的数据，调用方需持有 HeaderMutex
+func (b *FLVStreamBroker) initialBytes(mode broker.START_MODE) []byte {
+	if b.HeaderBytes == nil {
+		return nil
 	}
+	buf := append([]byte(nil), b.HeaderBytes...)
+	for _, data := range b.ring.Snapshot(mode) {
+		buf = append(buf, data...)
+	}
+	return buf
 }
 
 func (sb *FLVStreamBroker) doFlvParse(body io.ReadCloser) {
@@ -217,7 +526,7 @@ func (sb *FLVStreamBroker) doFlvParse(body io.ReadCloser) {
 	headerBytes, err := sb.flvParser.GetRequiredTagsBytes()
 	if err != nil {
 		body.Close()
-		fmt.Println("获取FLV头部字节失败: %v", err)
+		fmt.Printf("获取FLV头部字节失败: %v\n", err)
 	}
 
 	// 保存头部字节供后续使用
@@ -263,74 +572,28 @@ func (sb *FLVStreamBroker) readOneFlvTag(src []byte) error {
 		PrevTagSize: prevTagSize,
 	}
 
-	sb.GOPCache.AddTag(tag)
+	sb.ring.Write(tag.ToBytes(), tag.IsKeyFrame())
 
 	fmt.Println("一个tag构造完成！！！")
 
 	return nil
 }
 
+// Broadcast2LiveClient 广播一段已经封装好的 FLV 数据：写入环形缓冲，再发给不读环形缓冲的客户端
 func (b *FLVStreamBroker) Broadcast2LiveClient(data []byte) {
-	//log.Println("FLVStreamBroker.Broadcast.BrokerKey:", b.BrokerKey)
-	if len(b.clientMap) == 0 {
-		return
-	}
-	b.clientMutex.Lock()
-	// 复制 client list to avoid holding lock during send
-	clients := make([]client.LiveClient, 0, len(b.clientMap))
-	for _, c := range b.clientMap {
+	b.HeaderMutex.Lock()
+	b.ring.Write(data, false)
+	clients := make([]client.LiveClient, 0, len(b.pushMap))
+	for _, c := range b.pushMap {
 		clients = append(clients, c)
 	}
-	b.clientMutex.Unlock()
+	b.HeaderMutex.Unlock()
 
-	// 广播数据 send non-blocking (drop if client's channel full)
 	for _, c := range clients {
 		c.Broadcast(data)
-		////fmt.Printf("send non-blocking %#v \n\n", c.dataCh)
-		//select {
-		//case c.dataCh <- data:
-		//	//fmt.Println("发送数据成功")
-		//default:
-		//	// 客户端慢，丢包并继续
-		//}
 	}
 }
 
-//1. 原因
-//视频解码必须要从**关键帧（I-frame）**开始，否则画面会花屏或无法显示。
-//如果新客户端连接时，没等到关键帧，就会卡在黑屏，直到下一个关键帧到来。
-//所以，我们要在内存里保存最近的一组 GOP（关键帧 + 关键帧之后的所有非关键帧），新客户端连接时，先把这一组发过去。
-
-// GOPCache 要让晚加入的前端也能播放，你的 Go 服务端必须缓存起始包（FLV header + metadata + 第一个关键帧），每次新客户端连上来都先推送它们。
-// type GOPCache struct
-// FLV 里 Video Tag 的 FrameType = 1 表示关键帧（I-frame）。
-// 步骤 1：解析上游流数据
-type GOPCache struct {
-	mu   sync.Mutex
-	tags []*FlvTag // 存储一组 GOP（关键帧 + 之后的帧）
-}
-
-// 步骤 2：建立 GOP 缓存
-// AddTag：每来一帧都存起来，如果是关键帧，就清空之前的，重新开始存。
-func (c *GOPCache) AddTag(tag *FlvTag) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	// 如果是关键帧，清空之前的缓存
-	if tag.IsKeyFrame() {
-		c.tags = nil
-	}
-	c.tags = append(c.tags, tag)
-}
-
-// 步骤 3：新客户端连接时发 GOP 缓存
-// GetTags：新客户端连接时，先把缓存的 GOP 发过去。
-func (c *GOPCache) GetTags() []*FlvTag {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return append([]*FlvTag(nil), c.tags...)
-}
-
 type FlvTag struct {
 	TagType     uint8  // 1 byte: Tag Type (8 = audio, 9 = video, 18 = script data)
 	DataSize    uint32 // 3 bytes, 实际是24bit，表示数据大小（不含11字节头和4字节PreviousTagSize）
@@ -340,46 +603,44 @@ type FlvTag struct {
 	PrevTagSize uint32 // 4 bytes, 上一个tag的总大小（含头和数据）
 }
 
-// ToBytes 序列化 FlvTag 成字节切片
+// ToBytes 序列化 FlvTag 成字节切片，按最终大小一次分配，结果会进入环形缓冲被所有观众共享
 func (tag *FlvTag) ToBytes() []byte {
-	buf := bytes.NewBuffer(nil)
+	buf := make([]byte, 11+len(tag.Data)+4)
 
-	// 写TagType 1字节
-	buf.WriteByte(tag.TagType)
+	// TagType 1字节
+	buf[0] = tag.TagType
 
-	// 写DataSize 3字节（24bit）
-	dataSizeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(dataSizeBytes, tag.DataSize)
-	buf.Write(dataSizeBytes[1:4]) // 取后三字节
+	// DataSize 3字节（24bit）
+	buf[1], buf[2], buf[3] = byte(tag.DataSize>>16), byte(tag.DataSize>>8), byte(tag.DataSize)
 
-	// 写Timestamp 3字节 + 1字节扩展
-	timestampBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(timestampBytes, tag.Timestamp)
-	buf.Write(timestampBytes[1:4])   // 3字节时间戳低位
-	buf.WriteByte(timestampBytes[0]) // 1字节扩展时间戳
+	// Timestamp 3字节低位 + 1字节扩展时间戳
+	buf[4], buf[5], buf[6], buf[7] = byte(tag.Timestamp>>16), byte(tag.Timestamp>>8), byte(tag.Timestamp), byte(tag.Timestamp>>24)
 
-	// 写StreamID 3字节 总是0
-	buf.Write([]byte{0x00, 0x00, 0x00})
+	// StreamID 3字节 总是0
 
-	// 写Data有效载荷
-	buf.Write(tag.Data)
+	// Data有效载荷
+	copy(buf[11:], tag.Data)
 
-	// 写PreviousTagSize 4字节，等于 tag头(11) + 数据大小
-	prevTagSize := uint32(11 + tag.DataSize)
-	prevTagSizeBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(prevTagSizeBytes, prevTagSize)
-	buf.Write(prevTagSizeBytes)
+	// PreviousTagSize 4字节，等于 tag头(11) + 数据大小
+	binary.BigEndian.PutUint32(buf[11+len(tag.Data):], uint32(11+tag.DataSize))
 
-	return buf.Bytes()
+	return buf
 }
 
-func (tag *FlvTag) IsKeyFrame() bool {
-	if tag.TagType != 9 { // 9 是视频Tag
-		return false
-	}
-	if len(tag.Data) == 0 {
-		return false
+// IsSequenceHeader 是否是序列头（解码配置），视频同时支持 legacy 和 Enhanced FLV（hvc1/av01/vp09）
+func (tag *FlvTag) IsSequenceHeader() bool {
+	switch tag.TagType {
+	case TagTypeVideo:
+		h := tag.VideoHeader()
+		return h != nil && h.IsSequenceStart()
+	case TagTypeAudio:
+		return len(tag.Data) >= 2 && (tag.Data[0]>>4)&0x0F == FormatAAC && tag.Data[1] == 0
 	}
-	frameType := (tag.Data[0] & 0xF0) >> 4
-	return frameType == 1
+	return false
+}
+
+// IsKeyFrame 是否是视频关键帧，Enhanced FLV 的元数据/序列结束包不算
+func (tag *FlvTag) IsKeyFrame() bool {
+	h := tag.VideoHeader()
+	return h != nil && h.IsKeyFrame()
 }
@@ -0,0 +1,412 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+/*
+裸码流 <-> FLV tag 的转换工具
+
+	TS、RTSP 等上游拿到的是 Annex-B 格式的 H.264/H.265 NALU 和 AAC 裸帧，
+	这里把它们打包成和 HTTP-FLV 上游完全一样的 FlvTag，后面的 GOP 缓存、分发、转推都不需要关心上游协议。
+	反过来，TS 输出时也用这里的函数把 FLV 里的 AVCC/HVCC 数据还原成 Annex-B。
+*/
+
+// H.264 NALU 类型
+const (
+	H264NALSlice = 1
+	H264NALIDR   = 5
+	H264NALSEI   = 6
+	H264NALSPS   = 7
+	H264NALPPS   = 8
+	H264NALAUD   = 9
+)
+
+// H.265 NALU 类型
+const (
+	H265NALIRAPMin = 16
+	H265NALIRAPMax = 23
+	H265NALVPS     = 32
+	H265NALSPS     = 33
+	H265NALPPS     = 34
+	H265NALAUD     = 35
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// SplitAnnexB 按起始码（00 00 01 / 00 00 00 01）切分 NALU
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	i := 0
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				// 去掉 4 字节起始码多出来的 0 以及 NALU 尾部的 0
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				if end > start {
+					nalus = append(nalus, data[start:end])
+				}
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		// 没有起始码，当作单个 NALU
+		nalus = append(nalus, data)
+	}
+	return nalus
+}
+
+// SplitAVCC 按长度前缀切分 NALU（FLV/MP4 里的格式）
+func SplitAVCC(data []byte, lengthSize int) ([][]byte, error) {
+	var nalus [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nalus, errors.New("AVCC 数据长度不足")
+		}
+		var n int
+		for i := 0; i < lengthSize; i++ {
+			n = n<<8 | int(data[i])
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return nalus, errors.New("AVCC NALU 长度越界")
+		}
+		nalus = append(nalus, data[:n])
+		data = data[n:]
+	}
+	return nalus, nil
+}
+
+// JoinAnnexB 把 NALU 用 4 字节起始码拼接起来
+func JoinAnnexB(nalus ...[]byte) []byte {
+	size := 0
+	for _, n := range nalus {
+		size += 4 + len(n)
+	}
+	buf := make([]byte, 0, size)
+	for _, n := range nalus {
+		buf = append(buf, annexBStartCode...)
+		buf = append(buf, n...)
+	}
+	return buf
+}
+
+// RemoveEmulationPrevention 去掉 NALU 里的防竞争字节 00 00 03
+func RemoveEmulationPrevention(data []byte) []byte {
+	if !bytes.Contains(data, []byte{0, 0, 3}) {
+		return data
+	}
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// H265NALType H.265 NALU 类型
+func H265NALType(nalu []byte) uint8 {
+	if len(nalu) == 0 {
+		return 0
+	}
+	return (nalu[0] >> 1) & 0x3F
+}
+
+// ====================== 解码配置记录 ======================
+
+// AVCDecoderConfig 根据 SPS/PPS 构造 AVCDecoderConfigurationRecord
+func AVCDecoderConfig(sps, pps []byte) []byte {
+	if len(sps) < 4 {
+		return nil
+	}
+	buf := []byte{0x01, sps[1], sps[2], sps[3], 0xFF, 0xE1}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(sps)))
+	buf = append(buf, sps...)
+	buf = append(buf, 0x01)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(pps)))
+	return append(buf, pps...)
+}
+
+// ParseAVCDecoderConfig 解析 AVCDecoderConfigurationRecord，返回 SPS/PPS 和 NALU 长度字段大小
+func ParseAVCDecoderConfig(record []byte) (spsList, ppsList [][]byte, lengthSize int, err error) {
+	if len(record) < 7 {
+		return nil, nil, 0, errors.New("AVC 配置记录太短")
+	}
+	lengthSize = int(record[4]&0x03) + 1
+	pos := 5
+	numSPS := int(record[pos] & 0x1F)
+	pos++
+	for i := 0; i < numSPS; i++ {
+		if pos+2 > len(record) {
+			return nil, nil, 0, errors.New("AVC 配置记录 SPS 越界")
+		}
+		l := int(binary.BigEndian.Uint16(record[pos:]))
+		pos += 2
+		if pos+l > len(record) {
+			return nil, nil, 0, errors.New("AVC 配置记录 SPS 越界")
+		}
+		spsList = append(spsList, record[pos:pos+l])
+		pos += l
+	}
+	if pos >= len(record) {
+		return spsList, nil, lengthSize, nil
+	}
+	numPPS := int(record[pos])
+	pos++
+	for i := 0; i < numPPS; i++ {
+		if pos+2 > len(record) {
+			break
+		}
+		l := int(binary.BigEndian.Uint16(record[pos:]))
+		pos += 2
+		if pos+l > len(record) {
+			break
+		}
+		ppsList = append(ppsList, record[pos:pos+l])
+		pos += l
+	}
+	return spsList, ppsList, lengthSize, nil
+}
+
+// HEVCDecoderConfig 根据 VPS/SPS/PPS 构造 HEVCDecoderConfigurationRecord
+// profile/tier/level 取自 SPS 里的 profile_tier_level，色度格式和位深使用 4:2:0 8bit
+func HEVCDecoderConfig(vps, sps, pps []byte) []byte {
+	rbsp := RemoveEmulationPrevention(sps)
+	// 2 字节 NALU 头 + 1 字节 (vps_id, max_sub_layers_minus1, temporal_id_nesting) + 12 字节 profile_tier_level
+	if len(rbsp) < 15 {
+		return nil
+	}
+	maxSubLayers := (rbsp[2]>>1)&0x07 + 1
+	temporalIdNested := rbsp[2] & 0x01
+	ptl := rbsp[3:15]
+
+	buf := make([]byte, 0, 23+3*5+len(vps)+len(sps)+len(pps))
+	buf = append(buf, 0x01)
+	buf = append(buf, ptl...) // profile_space/tier/profile_idc + 兼容性标志 + 约束标志 + level_idc
+	buf = append(buf,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,       // parallelismType
+		0xFD,       // chroma_format_idc = 1 (4:2:0)
+		0xF8,       // bit_depth_luma_minus8 = 0
+		0xF8,       // bit_depth_chroma_minus8 = 0
+		0x00, 0x00, // avgFrameRate
+		maxSubLayers<<3|temporalIdNested<<2|0x03, // lengthSizeMinusOne = 3
+		0x03, // numOfArrays
+	)
+	for _, item := range []struct {
+		nalType uint8
+		nalu    []byte
+	}{{H265NALVPS, vps}, {H265NALSPS, sps}, {H265NALPPS, pps}} {
+		buf = append(buf, 0x80|item.nalType) // array_completeness = 1
+		buf = binary.BigEndian.AppendUint16(buf, 1)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(item.nalu)))
+		buf = append(buf, item.nalu...)
+	}
+	return buf
+}
+
+// ParseHEVCDecoderConfig 解析 HEVCDecoderConfigurationRecord，返回全部参数集（VPS/SPS/PPS 顺序）和 NALU 长度字段大小
+func ParseHEVCDecoderConfig(record []byte) (paramSets [][]byte, lengthSize int, err error) {
+	if len(record) < 23 {
+		return nil, 0, errors.New("HEVC 配置记录太短")
+	}
+	lengthSize = int(record[21]&0x03) + 1
+	numArrays := int(record[22])
+	pos := 23
+	for i := 0; i < numArrays; i++ {
+		if pos+3 > len(record) {
+			return paramSets, lengthSize, errors.New("HEVC 配置记录越界")
+		}
+		numNalus := int(binary.BigEndian.Uint16(record[pos+1:]))
+		pos += 3
+		for j := 0; j < numNalus; j++ {
+			if pos+2 > len(record) {
+				return paramSets, lengthSize, errors.New("HEVC 配置记录越界")
+			}
+			l := int(binary.BigEndian.Uint16(record[pos:]))
+			pos += 2
+			if pos+l > len(record) {
+				return paramSets, lengthSize, errors.New("HEVC 配置记录越界")
+			}
+			paramSets = append(paramSets, record[pos:pos+l])
+			pos += l
+		}
+	}
+	return paramSets, lengthSize, nil
+}
+
+// ====================== AAC ======================
+
+// AACSampleRates AAC 采样率索引表
+var AACSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// AACAudioSpecificConfig 构造 2 字节 AudioSpecificConfig
+func AACAudioSpecificConfig(objectType, sampleRateIndex, channels uint8) []byte {
+	return []byte{
+		objectType<<3 | sampleRateIndex>>1,
+		(sampleRateIndex&0x01)<<7 | channels<<3,
+	}
+}
+
+// ADTSHeader 根据 AudioSpecificConfig 构造 7 字节 ADTS 头，frameLen 为 AAC 裸帧长度
+func ADTSHeader(asc []byte, frameLen int) []byte {
+	objectType := asc[0] >> 3
+	sampleRateIndex := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0F
+	profile := objectType - 1
+	if objectType == 0 || objectType > 4 {
+		profile = 1 // ADTS 只能表达 Main/LC/SSR/LTP，其余按 LC 处理
+	}
+	total := frameLen + 7
+	return []byte{
+		0xFF,
+		0xF1, // MPEG-4, no CRC
+		profile<<6 | sampleRateIndex<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(total>>11),
+		byte(total >> 3),
+		byte(total&0x07)<<5 | 0x1F,
+		0xFC,
+	}
+}
+
+// ====================== FLV tag 打包 ======================
+
+// NewFlvTag 构造一个 tag，DataSize 和 PrevTagSize 按数据长度计算
+func NewFlvTag(tagType uint8, timestamp uint32, data []byte) *FlvTag {
+	return &FlvTag{
+		TagType:     tagType,
+		DataSize:    uint32(len(data)),
+		Timestamp:   timestamp,
+		Data:        data,
+		PrevTagSize: uint32(FLVTagHeaderSize + len(data)),
+	}
+}
+
+// NewAACSequenceTag AAC 序列头 tag
+func NewAACSequenceTag(asc []byte, timestamp uint32) *FlvTag {
+	data := append([]byte{0xAF, 0x00}, asc...)
+	return NewFlvTag(TagTypeAudio, timestamp, data)
+}
+
+// NewAACFrameTag AAC 裸帧 tag
+func NewAACFrameTag(raw []byte, timestamp uint32) *FlvTag {
+	data := make([]byte, 2+len(raw))
+	data[0], data[1] = 0xAF, 0x01
+	copy(data[2:], raw)
+	return NewFlvTag(TagTypeAudio, timestamp, data)
+}
+
+// NewVideoSequenceTag 视频序列头 tag（legacy CodecID：7=AVC，12=HEVC）
+func NewVideoSequenceTag(codecID uint8, config []byte, timestamp uint32) *FlvTag {
+	data := append([]byte{0x10 | codecID, 0x00, 0x00, 0x00, 0x00}, config...)
+	return NewFlvTag(TagTypeVideo, timestamp, data)
+}
+
+// NewVideoFrameTag 视频帧 tag，NALU 以 4 字节长度前缀写入
+func NewVideoFrameTag(codecID uint8, nalus [][]byte, keyFrame bool, dts uint32, cts int32) *FlvTag {
+	size := 5
+	for _, n := range nalus {
+		size += 4 + len(n)
+	}
+	data := make([]byte, 5, size)
+	frameType := byte(0x20)
+	if keyFrame {
+		frameType = 0x10
+	}
+	data[0] = frameType | codecID
+	data[1] = 0x01
+	data[2], data[3], data[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+	for _, n := range nalus {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(n)))
+		data = append(data, n...)
+	}
+	return NewFlvTag(TagTypeVideo, dts, data)
+}
+
+// VideoPacker 把 Annex-B 访问单元打包成 FLV tag，参数集出现或变化时先输出序列头
+type VideoPacker struct {
+	codecID       uint8 // CodecH264 / CodecH265
+	vps, sps, pps []byte
+	config        []byte // 最近一次输出的解码配置
+}
+
+func NewVideoPacker(codecID uint8) *VideoPacker {
+	return &VideoPacker{codecID: codecID}
+}
+
+// Pack 打包一个访问单元（同一时间戳的全部 NALU），还没有拿到参数集之前的帧会被丢弃
+func (vp *VideoPacker) Pack(nalus [][]byte, dts uint32, cts int32) []*FlvTag {
+	frame := make([][]byte, 0, len(nalus))
+	keyFrame := false
+	for _, n := range nalus {
+		if len(n) == 0 {
+			continue
+		}
+		if vp.codecID == CodecH265 {
+			switch t := H265NALType(n); {
+			case t == H265NALVPS:
+				vp.vps = n
+			case t == H265NALSPS:
+				vp.sps = n
+			case t == H265NALPPS:
+				vp.pps = n
+			case t == H265NALAUD:
+			default:
+				if t >= H265NALIRAPMin && t <= H265NALIRAPMax {
+					keyFrame = true
+				}
+				frame = append(frame, n)
+			}
+			continue
+		}
+		switch n[0] & 0x1F {
+		case H264NALSPS:
+			vp.sps = n
+		case H264NALPPS:
+			vp.pps = n
+		case H264NALAUD:
+		case H264NALIDR:
+			keyFrame = true
+			frame = append(frame, n)
+		default:
+			frame = append(frame, n)
+		}
+	}
+
+	var tags []*FlvTag
+	var config []byte
+	if vp.codecID == CodecH265 && vp.vps != nil && vp.sps != nil && vp.pps != nil {
+		config = HEVCDecoderConfig(vp.vps, vp.sps, vp.pps)
+	} else if vp.codecID == CodecH264 && vp.sps != nil && vp.pps != nil {
+		config = AVCDecoderConfig(vp.sps, vp.pps)
+	}
+	if config != nil && !bytes.Equal(config, vp.config) {
+		vp.config = config
+		tags = append(tags, NewVideoSequenceTag(vp.codecID, config, dts))
+	}
+	if vp.config == nil || len(frame) == 0 {
+		return tags
+	}
+	return append(tags, NewVideoFrameTag(vp.codecID, frame, keyFrame, dts, cts))
+}
@@ -0,0 +1,124 @@
+package flv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// maxTagDataSize FLV tag 数据区最大 24bit，超过说明数据错位
+const maxTagDataSize = 1<<24 - 1
+
+// ErrInvalidFLVHeader 数据不是以 FLV 头开始
+var ErrInvalidFLVHeader = errors.New("无效的FLV签名")
+
+// BuildFLVHeader 构造 9 字节 FLV 头 + 4 字节 PreviousTagSize0
+func BuildFLVHeader(hasAudio, hasVideo bool) []byte {
+	var flags byte
+	if hasAudio {
+		flags |= 0x04
+	}
+	if hasVideo {
+		flags |= 0x01
+	}
+	return []byte{'F', 'L', 'V', 0x01, flags, 0x00, 0x00, 0x00, 0x09, 0x00, 0x00, 0x00, 0x00}
+}
+
+// ReadFLVHeader 从流中读取 FLV 头和 PreviousTagSize0，返回这 13 个字节
+func ReadFLVHeader(r io.Reader) ([]byte, error) {
+	header := make([]byte, FLVHeaderSize+PrevTagSizeLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("读取FLV头失败: %w", err)
+	}
+	if !bytes.Equal(header[0:3], []byte{'F', 'L', 'V'}) {
+		return nil, ErrInvalidFLVHeader
+	}
+	// 头部长度大于 9 时跳过扩展字节
+	if size := binary.BigEndian.Uint32(header[5:9]); size > FLVHeaderSize {
+		if _, err := io.CopyN(io.Discard, r, int64(size-FLVHeaderSize)); err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint32(header[5:9], FLVHeaderSize)
+	}
+	return header, nil
+}
+
+// ReadFlvTag 从流中读取一个完整的 tag（含 PreviousTagSize）
+func ReadFlvTag(r io.Reader) (*FlvTag, error) {
+	var hdr [FLVTagHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	tag := parseTagHeader(hdr[:])
+	tag.Data = make([]byte, tag.DataSize)
+	if _, err := io.ReadFull(r, tag.Data); err != nil {
+		return nil, err
+	}
+	var pts [PrevTagSizeLength]byte
+	if _, err := io.ReadFull(r, pts[:]); err != nil {
+		return nil, err
+	}
+	tag.PrevTagSize = binary.BigEndian.Uint32(pts[:])
+	return tag, nil
+}
+
+func parseTagHeader(hdr []byte) *FlvTag {
+	return &FlvTag{
+		TagType:   hdr[0] & 0x1F, // 高 3 位是保留位/加密标记
+		DataSize:  uint32(hdr[1])<<16 | uint32(hdr[2])<<8 | uint32(hdr[3]),
+		Timestamp: uint32(hdr[4])<<16 | uint32(hdr[5])<<8 | uint32(hdr[6]) | uint32(hdr[7])<<24,
+		StreamID:  uint32(hdr[8])<<16 | uint32(hdr[9])<<8 | uint32(hdr[10]),
+	}
+}
+
+// FLVDemuxer 增量 FLV 解析器，数据可以按任意字节边界喂进来，每次返回已经完整的 tag
+// 适用于 LiveClient.Broadcast 这种拿到的是字节块而不是 tag 的场景
+type FLVDemuxer struct {
+	buf        []byte
+	headerDone bool
+	Header     []byte // 解析到的 FLV 头（13 字节）
+}
+
+func NewFLVDemuxer() *FLVDemuxer {
+	return &FLVDemuxer{}
+}
+
+// Feed 追加数据，返回本次可以解析出的完整 tag
+func (d *FLVDemuxer) Feed(data []byte) ([]*FlvTag, error) {
+	d.buf = append(d.buf, data...)
+
+	if !d.headerDone {
+		if len(d.buf) < FLVHeaderSize+PrevTagSizeLength {
+			return nil, nil
+		}
+		if !bytes.Equal(d.buf[0:3], []byte{'F', 'L', 'V'}) {
+			return nil, ErrInvalidFLVHeader
+		}
+		d.Header = append([]byte(nil), d.buf[:FLVHeaderSize+PrevTagSizeLength]...)
+		d.buf = d.buf[FLVHeaderSize+PrevTagSizeLength:]
+		d.headerDone = true
+	}
+
+	var tags []*FlvTag
+	for len(d.buf) >= FLVTagHeaderSize {
+		tag := parseTagHeader(d.buf[:FLVTagHeaderSize])
+		total := FLVTagHeaderSize + int(tag.DataSize) + PrevTagSizeLength
+		if len(d.buf) < total {
+			break
+		}
+		tag.Data = append([]byte(nil), d.buf[FLVTagHeaderSize:FLVTagHeaderSize+int(tag.DataSize)]...)
+		tag.PrevTagSize = binary.BigEndian.Uint32(d.buf[total-PrevTagSizeLength : total])
+		tags = append(tags, tag)
+		d.buf = d.buf[total:]
+	}
+
+	// 剩余数据搬到新切片，避免底层数组无限增长
+	if len(d.buf) == 0 {
+		d.buf = nil
+	} else if cap(d.buf) > 4*len(d.buf)+64*1024 {
+		d.buf = append([]byte(nil), d.buf...)
+	}
+	return tags, nil
+}
@@ -0,0 +1,266 @@
+package flv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+/*
+Enhanced FLV / Enhanced RTMP（veovera enhanced-rtmp v1）
+
+	视频 tag 第一个字节最高位 IsExHeader=1 时：
+		[1 bit IsExHeader][3 bit FrameType][4 bit PacketType][4 byte FourCC]
+	PacketType：
+		0 SequenceStart        解码配置（hvcC / av1C / vpcC）
+		1 CodedFrames          帧数据，hvc1 在 FourCC 后多 3 字节 CompositionTime
+		2 SequenceEnd
+		3 CodedFramesX         帧数据，CompositionTime 隐含为 0
+		4 Metadata             AMF 编码的 HDR/colorInfo 等
+		5 MPEG2TSSequenceStart
+
+	legacy tag（CodecID 7/12）统一映射到同样的 PacketType，上层不需要区分两种格式。
+*/
+
+// Enhanced FLV 视频 PacketType
+const (
+	VideoPacketSequenceStart        = 0
+	VideoPacketCodedFrames          = 1
+	VideoPacketSequenceEnd          = 2
+	VideoPacketCodedFramesX         = 3
+	VideoPacketMetadata             = 4
+	VideoPacketMPEG2TSSequenceStart = 5
+)
+
+// 视频 FrameType
+const (
+	VideoFrameKey          = 1
+	VideoFrameInter        = 2
+	VideoFrameDisposable   = 3
+	VideoFrameGenerated    = 4
+	VideoFrameCommandFrame = 5 // 视频信息/命令帧，不携带图像
+)
+
+// Enhanced FLV FourCC
+const (
+	FourCCAVC  = "avc1"
+	FourCCHEVC = "hvc1"
+	FourCCAV1  = "av01"
+	FourCCVP9  = "vp09"
+)
+
+var errShortVideoTag = errors.New("视频tag数据不足")
+
+// VideoTagHeader 解析后的视频 tag 头，legacy 和 enhanced 两种格式统一成同一结构
+type VideoTagHeader struct {
+	Enhanced        bool   // 是否是 ExVideoTagHeader
+	FrameType       uint8  // VideoFrameKey 等
+	CodecID         uint8  // 对应的 legacy CodecID（CodecH264/CodecH265/CodecAV1/CodecVP9），未知 FourCC 为 0
+	FourCC          string // enhanced 格式的 FourCC，legacy 格式按 CodecID 填充
+	PacketType      uint8  // VideoPacketSequenceStart 等
+	CompositionTime int32  // 毫秒，有符号 24 位
+	HeaderSize      int    // 头部长度，Data[HeaderSize:] 是负载
+}
+
+// ParseVideoTagHeader 解析视频 tag 头
+func ParseVideoTagHeader(data []byte) (*VideoTagHeader, error) {
+	if len(data) < 1 {
+		return nil, errShortVideoTag
+	}
+	h := &VideoTagHeader{}
+	if data[0]&0x80 != 0 {
+		if len(data) < 5 {
+			return nil, errShortVideoTag
+		}
+		h.Enhanced = true
+		h.FrameType = (data[0] >> 4) & 0x07
+		h.PacketType = data[0] & 0x0F
+		h.FourCC = string(data[1:5])
+		h.CodecID = fourCCToCodecID(h.FourCC)
+		h.HeaderSize = 5
+		if h.PacketType == VideoPacketCodedFrames && h.FourCC == FourCCHEVC {
+			if len(data) < 8 {
+				return nil, errShortVideoTag
+			}
+			h.CompositionTime = readSI24(data[5:8])
+			h.HeaderSize = 8
+		}
+		return h, nil
+	}
+
+	h.FrameType = (data[0] >> 4) & 0x0F
+	h.CodecID = data[0] & 0x0F
+	h.FourCC = codecIDToFourCC(h.CodecID)
+	h.HeaderSize = 1
+	h.PacketType = VideoPacketCodedFrames
+	switch h.CodecID {
+	case CodecH264, CodecH265:
+		// AVCPacketType + CompositionTime
+		if len(data) < 5 {
+			return nil, errShortVideoTag
+		}
+		switch data[1] {
+		case 0:
+			h.PacketType = VideoPacketSequenceStart
+		case 2:
+			h.PacketType = VideoPacketSequenceEnd
+		}
+		h.CompositionTime = readSI24(data[2:5])
+		h.HeaderSize = 5
+	}
+	return h, nil
+}
+
+// IsSequenceStart 是否是解码配置
+func (h *VideoTagHeader) IsSequenceStart() bool {
+	return h.PacketType == VideoPacketSequenceStart
+}
+
+// IsCodedFrame 是否携带编码帧
+func (h *VideoTagHeader) IsCodedFrame() bool {
+	return (h.PacketType == VideoPacketCodedFrames || h.PacketType == VideoPacketCodedFramesX) && h.FrameType != VideoFrameCommandFrame
+}
+
+// IsKeyFrame 是否是关键帧（只对编码帧成立，序列头和元数据不算）
+func (h *VideoTagHeader) IsKeyFrame() bool {
+	return h.FrameType == VideoFrameKey && h.IsCodedFrame()
+}
+
+// BuildVideoTagData 封装视频 tag 数据，fourCC 为 avc1 时输出 legacy 格式（老播放器只认这种），其余输出 enhanced 格式
+// hvc1 的编码帧 CompositionTime 为 0 时使用 CodedFramesX，省掉 3 字节
+func BuildVideoTagData(fourCC string, frameType, packetType uint8, cts int32, payload []byte) []byte {
+	if fourCC == FourCCAVC {
+		avcPacketType := byte(1)
+		switch packetType {
+		case VideoPacketSequenceStart:
+			avcPacketType = 0
+		case VideoPacketSequenceEnd:
+			avcPacketType = 2
+		}
+		data := make([]byte, 0, 5+len(payload))
+		data = append(data, frameType<<4|CodecH264, avcPacketType, byte(cts>>16), byte(cts>>8), byte(cts))
+		return append(data, payload...)
+	}
+
+	if fourCC == FourCCHEVC && packetType == VideoPacketCodedFrames && cts == 0 {
+		packetType = VideoPacketCodedFramesX
+	}
+	if fourCC != FourCCHEVC && packetType == VideoPacketCodedFrames {
+		// 只有 hvc1 的 CodedFrames 带 CompositionTime
+		cts = 0
+	}
+	data := make([]byte, 0, 8+len(payload))
+	data = append(data, 0x80|(frameType&0x07)<<4|packetType&0x0F)
+	data = append(data, fourCC[:4]...)
+	if fourCC == FourCCHEVC && packetType == VideoPacketCodedFrames {
+		data = append(data, byte(cts>>16), byte(cts>>8), byte(cts))
+	}
+	return append(data, payload...)
+}
+
+// VideoHeader 解析视频 tag 头，非视频 tag 返回 nil
+func (tag *FlvTag) VideoHeader() *VideoTagHeader {
+	if tag.TagType != TagTypeVideo {
+		return nil
+	}
+	h, err := ParseVideoTagHeader(tag.Data)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+func fourCCToCodecID(fourCC string) uint8 {
+	switch fourCC {
+	case FourCCAVC:
+		return CodecH264
+	case FourCCHEVC:
+		return CodecH265
+	case FourCCAV1:
+		return CodecAV1
+	case FourCCVP9:
+		return CodecVP9
+	}
+	return 0
+}
+
+func codecIDToFourCC(codecID uint8) string {
+	switch codecID {
+	case CodecH264:
+		return FourCCAVC
+	case CodecH265:
+		return FourCCHEVC
+	case CodecAV1:
+		return FourCCAV1
+	case CodecVP9:
+		return FourCCVP9
+	}
+	return ""
+}
+
+// readSI24 有符号 24 位大端整数
+func readSI24(b []byte) int32 {
+	return int32(uint32(b[0])<<16|uint32(b[1])<<8|uint32(b[2])) << 8 >> 8
+}
+
+// ====================== AV1 / VP9 解码配置 ======================
+
+// AV1CodecConfigurationRecord av1C（AV1-ISOBMFF 2.3）
+type AV1CodecConfigurationRecord struct {
+	SeqProfile         uint8
+	SeqLevelIdx0       uint8
+	SeqTier0           uint8
+	HighBitdepth       bool
+	TwelveBit          bool
+	Monochrome         bool
+	ChromaSubsamplingX uint8
+	ChromaSubsamplingY uint8
+	ConfigOBUs         []byte // 一般是 Sequence Header OBU
+}
+
+// ParseAV1CodecConfigurationRecord 解析 av1C
+func ParseAV1CodecConfigurationRecord(data []byte) (*AV1CodecConfigurationRecord, error) {
+	if len(data) < 4 {
+		return nil, errors.New("av1C 数据不足")
+	}
+	if data[0] != 0x81 { // marker(1) + version(7) = 1
+		return nil, fmt.Errorf("av1C marker/version 错误: 0x%02X", data[0])
+	}
+	return &AV1CodecConfigurationRecord{
+		SeqProfile:         data[1] >> 5,
+		SeqLevelIdx0:       data[1] & 0x1F,
+		SeqTier0:           data[2] >> 7,
+		HighBitdepth:       data[2]&0x40 != 0,
+		TwelveBit:          data[2]&0x20 != 0,
+		Monochrome:         data[2]&0x10 != 0,
+		ChromaSubsamplingX: (data[2] >> 3) & 0x01,
+		ChromaSubsamplingY: (data[2] >> 2) & 0x01,
+		ConfigOBUs:         data[4:],
+	}, nil
+}
+
+// VPCodecConfigurationRecord vpcC（VP Codec ISO Media File Format Binding，version 1）
+type VPCodecConfigurationRecord struct {
+	Profile           uint8
+	Level             uint8
+	BitDepth          uint8
+	ChromaSubsampling uint8
+	FullRange         bool
+}
+
+// ParseVPCodecConfigurationRecord 解析 vpcC，兼容带 FullBox 头（version + flags）和不带的两种写法
+func ParseVPCodecConfigurationRecord(data []byte) (*VPCodecConfigurationRecord, error) {
+	if len(data) >= 12 && data[0] == 1 && binary.BigEndian.Uint32(data[:4])&0x00FFFFFF == 0 {
+		data = data[4:]
+	}
+	if len(data) < 3 {
+		return nil, errors.New("vpcC 数据不足")
+	}
+	return &VPCodecConfigurationRecord{
+		Profile:           data[0],
+		Level:             data[1],
+		BitDepth:          data[2] >> 4,
+		ChromaSubsampling: (data[2] >> 1) & 0x07,
+		FullRange:         data[2]&0x01 != 0,
+	}, nil
+}
@@ -0,0 +1,222 @@
+package flv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"pull2push/core/broker"
+	"reflect"
+	"testing"
+)
+
+// exTag Enhanced FLV 视频 tag 数据：[IsExHeader|FrameType|PacketType][FourCC] + rest
+func exTag(frameType, packetType uint8, fourCC string, rest ...byte) []byte {
+	return append(append([]byte{0x80 | frameType<<4 | packetType}, fourCC...), rest...)
+}
+
+func TestParseVideoTagHeader(t *testing.T) {
+	payload := []byte{0xAA, 0xBB}
+	tests := []struct {
+		name     string
+		data     []byte
+		want     VideoTagHeader
+		keyFrame bool
+	}{
+		{"hvc1 SequenceStart", exTag(VideoFrameKey, VideoPacketSequenceStart, FourCCHEVC, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecH265, FourCCHEVC, VideoPacketSequenceStart, 0, 5}, false},
+		{"hvc1 CodedFrames 带 CTS", exTag(VideoFrameKey, VideoPacketCodedFrames, FourCCHEVC, append([]byte{0, 0, 0x50}, payload...)...),
+			VideoTagHeader{true, VideoFrameKey, CodecH265, FourCCHEVC, VideoPacketCodedFrames, 80, 8}, true},
+		{"hvc1 CodedFrames 负 CTS", exTag(VideoFrameInter, VideoPacketCodedFrames, FourCCHEVC, 0xFF, 0xFF, 0xD8),
+			VideoTagHeader{true, VideoFrameInter, CodecH265, FourCCHEVC, VideoPacketCodedFrames, -40, 8}, false},
+		{"hvc1 CodedFramesX", exTag(VideoFrameKey, VideoPacketCodedFramesX, FourCCHEVC, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecH265, FourCCHEVC, VideoPacketCodedFramesX, 0, 5}, true},
+		{"hvc1 SequenceEnd", exTag(VideoFrameKey, VideoPacketSequenceEnd, FourCCHEVC),
+			VideoTagHeader{true, VideoFrameKey, CodecH265, FourCCHEVC, VideoPacketSequenceEnd, 0, 5}, false},
+		{"hvc1 Metadata", exTag(VideoFrameCommandFrame, VideoPacketMetadata, FourCCHEVC, payload...),
+			VideoTagHeader{true, VideoFrameCommandFrame, CodecH265, FourCCHEVC, VideoPacketMetadata, 0, 5}, false},
+		{"av01 SequenceStart", exTag(VideoFrameKey, VideoPacketSequenceStart, FourCCAV1, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecAV1, FourCCAV1, VideoPacketSequenceStart, 0, 5}, false},
+		{"av01 CodedFrames 没有 CTS", exTag(VideoFrameKey, VideoPacketCodedFrames, FourCCAV1, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecAV1, FourCCAV1, VideoPacketCodedFrames, 0, 5}, true},
+		{"av01 MPEG2TSSequenceStart", exTag(VideoFrameKey, VideoPacketMPEG2TSSequenceStart, FourCCAV1, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecAV1, FourCCAV1, VideoPacketMPEG2TSSequenceStart, 0, 5}, false},
+		{"vp09 SequenceStart", exTag(VideoFrameKey, VideoPacketSequenceStart, FourCCVP9, payload...),
+			VideoTagHeader{true, VideoFrameKey, CodecVP9, FourCCVP9, VideoPacketSequenceStart, 0, 5}, false},
+		{"vp09 CodedFramesX", exTag(VideoFrameInter, VideoPacketCodedFramesX, FourCCVP9, payload...),
+			VideoTagHeader{true, VideoFrameInter, CodecVP9, FourCCVP9, VideoPacketCodedFramesX, 0, 5}, false},
+		{"vp09 SequenceEnd", exTag(VideoFrameKey, VideoPacketSequenceEnd, FourCCVP9),
+			VideoTagHeader{true, VideoFrameKey, CodecVP9, FourCCVP9, VideoPacketSequenceEnd, 0, 5}, false},
+		{"未知 FourCC", exTag(VideoFrameKey, VideoPacketCodedFrames, "xxxx"),
+			VideoTagHeader{true, VideoFrameKey, 0, "xxxx", VideoPacketCodedFrames, 0, 5}, true},
+		{"legacy avc 序列头", []byte{0x17, 0, 0, 0, 0, 1},
+			VideoTagHeader{false, VideoFrameKey, CodecH264, FourCCAVC, VideoPacketSequenceStart, 0, 5}, false},
+		{"legacy avc 帧", []byte{0x27, 1, 0, 0, 0x28, 0xAA},
+			VideoTagHeader{false, VideoFrameInter, CodecH264, FourCCAVC, VideoPacketCodedFrames, 40, 5}, false},
+		{"legacy hevc 序列结束", []byte{0x1C, 2, 0, 0, 0},
+			VideoTagHeader{false, VideoFrameKey, CodecH265, FourCCHEVC, VideoPacketSequenceEnd, 0, 5}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseVideoTagHeader(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *h != tt.want {
+				t.Fatalf("得到 %+v\n期望 %+v", *h, tt.want)
+			}
+			if h.IsKeyFrame() != tt.keyFrame {
+				t.Fatalf("IsKeyFrame() = %v", h.IsKeyFrame())
+			}
+		})
+	}
+}
+
+func TestParseVideoTagHeaderShort(t *testing.T) {
+	for _, data := range [][]byte{
+		nil,
+		{0x90, 'h', 'v', 'c'},
+		exTag(VideoFrameKey, VideoPacketCodedFrames, FourCCHEVC, 0, 0), // 缺 CTS
+		{0x17, 1, 0},
+	} {
+		if _, err := ParseVideoTagHeader(data); err == nil {
+			t.Errorf("% x 应该返回错误", data)
+		}
+	}
+}
+
+func TestBuildVideoTagData(t *testing.T) {
+	payload := []byte{0xAA, 0xBB}
+	tests := []struct {
+		name       string
+		fourCC     string
+		frameType  uint8
+		packetType uint8
+		cts        int32
+		want       []byte
+	}{
+		{"hvc1 SequenceStart", FourCCHEVC, VideoFrameKey, VideoPacketSequenceStart, 0,
+			exTag(VideoFrameKey, VideoPacketSequenceStart, FourCCHEVC, payload...)},
+		{"hvc1 CodedFrames 带 CTS", FourCCHEVC, VideoFrameKey, VideoPacketCodedFrames, 80,
+			exTag(VideoFrameKey, VideoPacketCodedFrames, FourCCHEVC, 0, 0, 0x50, 0xAA, 0xBB)},
+		{"hvc1 CodedFrames 负 CTS", FourCCHEVC, VideoFrameInter, VideoPacketCodedFrames, -40,
+			exTag(VideoFrameInter, VideoPacketCodedFrames, FourCCHEVC, 0xFF, 0xFF, 0xD8, 0xAA, 0xBB)},
+		{"hvc1 CTS 为 0 用 CodedFramesX", FourCCHEVC, VideoFrameKey, VideoPacketCodedFrames, 0,
+			exTag(VideoFrameKey, VideoPacketCodedFramesX, FourCCHEVC, payload...)},
+		{"hvc1 SequenceEnd", FourCCHEVC, VideoFrameKey, VideoPacketSequenceEnd, 0,
+			exTag(VideoFrameKey, VideoPacketSequenceEnd, FourCCHEVC, payload...)},
+		{"av01 CodedFrames 丢掉 CTS", FourCCAV1, VideoFrameInter, VideoPacketCodedFrames, 40,
+			exTag(VideoFrameInter, VideoPacketCodedFrames, FourCCAV1, payload...)},
+		{"av01 MPEG2TSSequenceStart", FourCCAV1, VideoFrameKey, VideoPacketMPEG2TSSequenceStart, 0,
+			exTag(VideoFrameKey, VideoPacketMPEG2TSSequenceStart, FourCCAV1, payload...)},
+		{"vp09 SequenceStart", FourCCVP9, VideoFrameKey, VideoPacketSequenceStart, 0,
+			exTag(VideoFrameKey, VideoPacketSequenceStart, FourCCVP9, payload...)},
+		{"vp09 CodedFramesX", FourCCVP9, VideoFrameKey, VideoPacketCodedFramesX, 0,
+			exTag(VideoFrameKey, VideoPacketCodedFramesX, FourCCVP9, payload...)},
+		{"avc1 输出 legacy 格式", FourCCAVC, VideoFrameKey, VideoPacketCodedFrames, 40,
+			[]byte{0x17, 1, 0, 0, 0x28, 0xAA, 0xBB}},
+		{"avc1 序列头", FourCCAVC, VideoFrameKey, VideoPacketSequenceStart, 0,
+			[]byte{0x17, 0, 0, 0, 0, 0xAA, 0xBB}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildVideoTagData(tt.fourCC, tt.frameType, tt.packetType, tt.cts, payload)
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("得到 % x\n期望 % x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVideoTagDataRoundTrip(t *testing.T) {
+	payload := []byte{0x01, 0x02, 0x03}
+	all := []uint8{VideoPacketSequenceStart, VideoPacketCodedFrames, VideoPacketCodedFramesX,
+		VideoPacketSequenceEnd, VideoPacketMetadata, VideoPacketMPEG2TSSequenceStart}
+	codecs := map[string][]uint8{
+		FourCCAVC:  {VideoPacketSequenceStart, VideoPacketCodedFrames, VideoPacketSequenceEnd}, // legacy 格式只有这三种
+		FourCCHEVC: all,
+		FourCCAV1:  all,
+		FourCCVP9:  all,
+	}
+	for fourCC, packetTypes := range codecs {
+		for _, packetType := range packetTypes {
+			for _, frameType := range []uint8{VideoFrameKey, VideoFrameInter} {
+				for _, cts := range []int32{0, 40, -40, 1<<23 - 1, -1 << 23} {
+					name := fmt.Sprintf("%s/%d/%d/%d", fourCC, packetType, frameType, cts)
+					data := BuildVideoTagData(fourCC, frameType, packetType, cts, payload)
+					h, err := ParseVideoTagHeader(data)
+					if err != nil {
+						t.Fatalf("%s: %v", name, err)
+					}
+
+					// 只有 avc1 / hvc1 的编码帧带 CTS，hvc1 的 CTS 为 0 时换成 CodedFramesX
+					wantCTS, wantPacket := int32(0), packetType
+					if packetType == VideoPacketCodedFrames && (fourCC == FourCCAVC || fourCC == FourCCHEVC) {
+						wantCTS = cts
+					}
+					if fourCC == FourCCAVC && packetType != VideoPacketCodedFrames {
+						wantCTS = cts // legacy 格式所有包都带 CompositionTime
+					}
+					if fourCC == FourCCHEVC && packetType == VideoPacketCodedFrames && cts == 0 {
+						wantPacket = VideoPacketCodedFramesX
+					}
+					if h.FourCC != fourCC || h.CodecID != fourCCToCodecID(fourCC) || h.FrameType != frameType ||
+						h.PacketType != wantPacket || h.CompositionTime != wantCTS || h.Enhanced != (fourCC != FourCCAVC) {
+						t.Errorf("%s: 解析得到 %+v", name, *h)
+					}
+					if !bytes.Equal(data[h.HeaderSize:], payload) {
+						t.Errorf("%s: 负载 % x", name, data[h.HeaderSize:])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestEnhancedKeyFrameGOPCache(t *testing.T) {
+	for _, fourCC := range []string{FourCCHEVC, FourCCAV1, FourCCVP9} {
+		t.Run(fourCC, func(t *testing.T) {
+			// 上游一直连不上，数据由测试直接交给 writeTag
+			b := NewFLVStreamBrokerWithDialer("enhanced-"+fourCC, "test://", func(ctx context.Context, _ string) (TagSource, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			})
+			defer b.Close()
+			b.setFLVHeader(BuildFLVHeader(false, true))
+
+			frame := func(frameType, packetType uint8, ts uint32, mark byte) *FlvTag {
+				return NewFlvTag(TagTypeVideo, ts, BuildVideoTagData(fourCC, frameType, packetType, 40, []byte{mark}))
+			}
+			tags := []*FlvTag{
+				frame(VideoFrameKey, VideoPacketSequenceStart, 0, 's'),
+				frame(VideoFrameKey, VideoPacketCodedFrames, 0, 1),
+				frame(VideoFrameInter, VideoPacketCodedFrames, 40, 2),
+				frame(VideoFrameKey, VideoPacketCodedFrames, 80, 3),
+				frame(VideoFrameInter, VideoPacketCodedFramesX, 120, 4),
+				// 带关键帧标记的序列结束和元数据不是关键帧，不能作为起播点
+				frame(VideoFrameKey, VideoPacketSequenceEnd, 160, 5),
+				frame(VideoFrameCommandFrame, VideoPacketMetadata, 160, 6),
+			}
+			for _, tag := range tags {
+				b.writeTag(tag)
+			}
+
+			b.HeaderMutex.RLock()
+			defer b.HeaderMutex.RUnlock()
+			if b.videoSeqTag == nil || !bytes.Equal(b.videoSeqTag.Data, tags[0].Data) {
+				t.Fatal("序列头没有放进起播头")
+			}
+			var marks []byte
+			for _, data := range b.ring.Snapshot(broker.StartDefault) {
+				tag, err := ReadFlvTag(bytes.NewReader(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				marks = append(marks, tag.Data[len(tag.Data)-1])
+			}
+			// 从最近的关键帧 3 开始
+			if want := []byte{3, 4, 5, 6}; !reflect.DeepEqual(marks, want) {
+				t.Fatalf("起播数据 %v，期望 %v", marks, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package flv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+断流插播垫片
+
+	上游超过 fallbackAfter 没有数据时，把本地的垫片文件（“马上回来”）按真实时间循环插进直播，
+	上游恢复后等到它的视频关键帧再切回去。观众的连接始终不断：
+		切到垫片：先发垫片的序列头，再从垫片的关键帧开始
+		切回上游：先发上游的序列头，再从上游的关键帧开始，关键帧之前的数据丢掉
+	插播过一次之后，上游的时间戳都按 segment 换算，观众看到的时间戳一直连续增长。
+*/
+
+// DefaultFallbackAfter 上游多久没有数据开始插播垫片
+const DefaultFallbackAfter = 3 * time.Second
+
+// spliceGap 切换数据源时，新数据源第一个 tag 接在上一个 tag 之后多少毫秒
+const spliceGap = 40
+
+// Slate 断流时插播的垫片，本地文件解出来的 tag 整个放在内存里循环播放
+type Slate struct {
+	Path     string
+	header   []byte    // FLV 头（含 PreviousTagSize0）
+	headers  []*FlvTag // 元数据和序列头
+	tags     []*FlvTag // 从第一个视频关键帧开始的音视频 tag，时间戳从 0 开始
+	duration uint32    // 循环一次的时长（毫秒）
+	size     int
+}
+
+// LoadSlate 读取 FLV 垫片文件，其它格式用 NewSlate
+func LoadSlate(path string) (*Slate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	header, err := ReadFLVHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("垫片 %s: %w", path, err)
+	}
+	return NewSlate(path, &httpFLVSource{body: io.NopCloser(r), header: header})
+}
+
+// NewSlate 把 src 里的 tag 全部读出来做成垫片，有视频时从第一个关键帧开始循环，src 由调用方关闭
+func NewSlate(path string, src TagSource) (*Slate, error) {
+	s := &Slate{Path: path, header: src.Header(), size: len(src.Header())}
+	var first uint32
+	hasVideo := false
+	for {
+		tag, err := src.ReadTag()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// 录下来的文件最后一个 tag 经常不完整，丢掉就好
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("垫片 %s: %w", path, err)
+		}
+		s.size += FLVTagHeaderSize + len(tag.Data) + PrevTagSizeLength
+		switch {
+		case isHeaderTag(tag):
+			s.headers = append(s.headers, tag)
+			hasVideo = hasVideo || tag.TagType == TagTypeVideo
+		case len(s.tags) == 0 && hasVideo && !tag.IsKeyFrame():
+			// 关键帧之前的帧没法解码
+		case tag.TagType == TagTypeVideo || tag.TagType == TagTypeAudio:
+			if len(s.tags) == 0 {
+				first = tag.Timestamp
+			}
+			tag.Timestamp -= first
+			s.tags = append(s.tags, tag)
+		}
+	}
+	if len(s.tags) == 0 {
+		return nil, fmt.Errorf("垫片 %s 没有可以播放的音视频数据", path)
+	}
+	// 最后一帧也要占一帧的时长，否则循环的接缝处两帧时间戳重叠
+	last := s.tags[len(s.tags)-1].Timestamp
+	frame := uint32(spliceGap)
+	if n := len(s.tags); n > 1 && last > 0 {
+		frame = max(last/uint32(n-1), 1)
+	}
+	s.duration = last + frame
+	return s, nil
+}
+
+// Size 垫片占用的内存
+func (s *Slate) Size() int {
+	return s.size
+}
+
+// segment 一次上游连接：时间戳偏移，以及插播期间收到的上游起播头
+type segment struct {
+	based  bool
+	offset int64
+
+	metaTag      *FlvTag
+	videoSeqTag  *FlvTag
+	videoMetaTag *FlvTag
+	audioSeqTag  *FlvTag
+}
+
+// keep 记录上游的起播头，切回上游时重新发给观众
+func (seg *segment) keep(tag *FlvTag) {
+	switch {
+	case tag.TagType == TagTypeScript:
+		seg.metaTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == TagTypeVideo:
+		seg.videoSeqTag = tag
+	case isVideoMetadata(tag):
+		seg.videoMetaTag = tag
+	case tag.IsSequenceHeader() && tag.TagType == TagTypeAudio:
+		seg.audioSeqTag = tag
+	}
+}
+
+// SetFallback 设置断流插播的垫片，slate 为 nil 时不插播；正在插播时停止，下一次检查时按新配置重新开始
+func (b *FLVStreamBroker) SetFallback(slate *Slate, after time.Duration) {
+	if after <= 0 {
+		after = DefaultFallbackAfter
+	}
+	b.fallbackMutex.Lock()
+	defer b.fallbackMutex.Unlock()
+	if b.slate != nil {
+		b.account.Free(b.slate.Size())
+	}
+	if slate != nil {
+		b.account.Charge(slate.Size())
+	}
+	b.slate, b.fallbackAfter = slate, after
+	b.stopSlate()
+}
+
+// relayTag 处理一个上游 tag：插播中等到上游的关键帧再切回来，然后换算时间戳交给 handleTag
+func (b *FLVStreamBroker) relayTag(seg *segment, tag *FlvTag) {
+	b.lastUpstream.Store(time.Now().UnixNano())
+	b.fallbackMutex.Lock()
+	defer b.fallbackMutex.Unlock()
+	seg.keep(tag)
+
+	if b.slateStop != nil {
+		// 插播中：上游的起播头先存着，纯音频的流任意一帧都可以切，有视频的要等关键帧
+		if isHeaderTag(tag) || (seg.videoSeqTag != nil && !tag.IsKeyFrame()) {
+			return
+		}
+		b.stopSlate()
+		log.Printf("[flv:%s] 上游恢复，结束插播垫片", b.BrokerKey)
+		seg.based = false
+		b.rebase(seg, tag)
+		for _, h := range []*FlvTag{seg.metaTag, seg.videoSeqTag, seg.videoMetaTag, seg.audioSeqTag} {
+			if h != nil {
+				st := *h
+				st.Timestamp = tag.Timestamp
+				b.handleTag(&st)
+			}
+		}
+		b.handleTag(tag)
+		return
+	}
+	b.rebase(seg, tag)
+	b.handleTag(tag)
+}
+
+// rebase 换算上游的时间戳：插播过垫片之后，每个 segment 的第一个音视频 tag 接在观众收到的最后一个 tag 之后。
+// 调用方需持有 fallbackMutex
+func (b *FLVStreamBroker) rebase(seg *segment, tag *FlvTag) {
+	if !seg.based {
+		if isHeaderTag(tag) {
+			// 起播头不参与计算偏移，放在当前位置
+			if b.spliced {
+				tag.Timestamp = b.lastTs
+			}
+			return
+		}
+		seg.based = true
+		seg.offset = 0
+		if b.spliced {
+			seg.offset = int64(b.lastTs) + spliceGap - int64(tag.Timestamp)
+		}
+	}
+	ts := int64(tag.Timestamp) + seg.offset
+	if ts < 0 {
+		ts = 0
+	}
+	tag.Timestamp = uint32(ts)
+	if tag.Timestamp > b.lastTs {
+		b.lastTs = tag.Timestamp
+	}
+}
+
+// checkFallback 上游断流超过 fallbackAfter 时开始插播，由 ListenStatus 定时调用
+func (b *FLVStreamBroker) checkFallback(now time.Time) {
+	b.fallbackMutex.Lock()
+	defer b.fallbackMutex.Unlock()
+	if b.slate == nil || b.slateStop != nil || b.stopped() {
+		return
+	}
+	if now.Sub(time.Unix(0, b.lastUpstream.Load())) < b.fallbackAfter {
+		return
+	}
+	log.Printf("[flv:%s] 上游 %v 没有数据，开始插播垫片 %s", b.BrokerKey, b.fallbackAfter, b.slate.Path)
+	// 上游一直没有连上时观众还没有 FLV 头，用垫片的
+	b.setFLVHeader(b.slate.header)
+	stop := make(chan struct{})
+	b.slateStop = stop
+	b.spliced = true
+	go b.playSlate(stop, b.slate)
+}
+
+// stopSlate 停止插播，调用方需持有 fallbackMutex
+func (b *FLVStreamBroker) stopSlate() {
+	if b.slateStop != nil {
+		close(b.slateStop)
+		b.slateStop = nil
+	}
+}
+
+// playSlate 按真实时间循环发送垫片，直到 stop 被关闭或者 broker 被 Close
+func (b *FLVStreamBroker) playSlate(stop chan struct{}, slate *Slate) {
+	b.fallbackMutex.Lock()
+	if b.slateStop != stop {
+		b.fallbackMutex.Unlock()
+		return
+	}
+	base := b.lastTs + spliceGap
+	for _, h := range slate.headers {
+		st := *h
+		st.Timestamp = base
+		b.writeTag(&st)
+	}
+	b.fallbackMutex.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+	for loop := uint32(0); ; loop++ {
+		for _, t := range slate.tags {
+			due := loop*slate.duration + t.Timestamp
+			timer.Reset(time.Until(start.Add(time.Duration(due) * time.Millisecond)))
+			select {
+			case <-stop:
+				return
+			case <-b.stopSig:
+				return
+			case <-timer.C:
+			}
+
+			b.fallbackMutex.Lock()
+			if b.slateStop != stop {
+				b.fallbackMutex.Unlock()
+				return
+			}
+			st := *t
+			st.Timestamp = base + due
+			if st.Timestamp > b.lastTs {
+				b.lastTs = st.Timestamp
+			}
+			b.writeTag(&st)
+			b.fallbackMutex.Unlock()
+		}
+	}
+}
+
+// isHeaderTag 元数据、序列头这类不属于任何 GOP 的 tag
+func isHeaderTag(tag *FlvTag) bool {
+	return tag.TagType == TagTypeScript || tag.IsSequenceHeader() || isVideoMetadata(tag)
+}
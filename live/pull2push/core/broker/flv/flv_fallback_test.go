@@ -0,0 +1,154 @@
+package flv
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testTag(tagType uint8, ts uint32, data ...byte) *FlvTag {
+	return &FlvTag{TagType: tagType, DataSize: uint32(len(data)), Timestamp: ts, Data: data}
+}
+
+// avc 的第一个字节是帧类型 + 编码，第二个字节是 AVCPacketType；最后一个字节区分上游和垫片
+func seqTag(ts uint32, mark byte) *FlvTag { return testTag(TagTypeVideo, ts, 0x17, 0, 0, 0, 0, mark) }
+func keyTag(ts uint32, mark byte) *FlvTag { return testTag(TagTypeVideo, ts, 0x17, 1, 0, 0, 0, mark) }
+func interTag(ts uint32, mark byte) *FlvTag {
+	return testTag(TagTypeVideo, ts, 0x27, 1, 0, 0, 0, mark)
+}
+
+func writeSlate(t *testing.T, tags ...*FlvTag) string {
+	t.Helper()
+	buf := []byte{'F', 'L', 'V', 1, 1, 0, 0, 0, 9, 0, 0, 0, 0}
+	for _, tag := range tags {
+		buf = append(buf, tag.ToBytes()...)
+	}
+	path := filepath.Join(t.TempDir(), "slate.flv")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// pushClient 不读环形缓冲的客户端，记录 Broadcast 收到的 tag
+type pushClient struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (c *pushClient) Broadcast(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data = append(c.data, data...)
+}
+func (c *pushClient) Listen()                  {}
+func (c *pushClient) GetDataChan() chan []byte { return nil }
+
+func (c *pushClient) tags(t *testing.T) []*FlvTag {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := bytes.NewReader(c.data)
+	var tags []*FlvTag
+	for r.Len() > 0 {
+		tag, err := ReadFlvTag(r)
+		if err != nil {
+			t.Fatalf("read tag: %v", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+func playing(b *FLVStreamBroker) bool {
+	b.fallbackMutex.Lock()
+	defer b.fallbackMutex.Unlock()
+	return b.slateStop != nil
+}
+
+func TestLoadSlate(t *testing.T) {
+	path := writeSlate(t, testTag(TagTypeScript, 0, 2, 0, 10), seqTag(0, 's'),
+		interTag(960, 's'), keyTag(1000, 's'), interTag(1040, 's'), interTag(1080, 's'))
+	slate, err := LoadSlate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slate.headers) != 2 || len(slate.tags) != 3 {
+		t.Fatalf("headers=%d tags=%d", len(slate.headers), len(slate.tags))
+	}
+	if !slate.tags[0].IsKeyFrame() || slate.tags[0].Timestamp != 0 || slate.tags[2].Timestamp != 80 {
+		t.Fatalf("slate does not start at key frame 0: %+v", slate.tags[0])
+	}
+	if slate.duration != 120 {
+		t.Fatalf("duration = %d, want 120", slate.duration)
+	}
+
+	if _, err := LoadSlate(writeSlate(t, seqTag(0, 's'))); err == nil {
+		t.Fatal("slate without frames accepted")
+	}
+}
+
+func TestFallbackSplice(t *testing.T) {
+	// 上游一直连不上，数据由测试直接交给 relayTag
+	b := NewFLVStreamBrokerWithDialer("fallback", "test://", func(ctx context.Context, _ string) (TagSource, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer b.Close()
+	slate, err := LoadSlate(writeSlate(t, seqTag(0, 's'), keyTag(0, 's'), interTag(40, 's')))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetFallback(slate, time.Second)
+	viewer := &pushClient{}
+	b.AddLiveClient("viewer", viewer)
+
+	seg := &segment{}
+	b.setFLVHeader([]byte{'F', 'L', 'V', 1, 1, 0, 0, 0, 9, 0, 0, 0, 0})
+	for _, tag := range []*FlvTag{seqTag(0, 'u'), keyTag(0, 'u'), interTag(40, 'u')} {
+		b.relayTag(seg, tag)
+	}
+
+	// 上游断流超过阈值，开始插播
+	b.checkFallback(time.Now())
+	if playing(b) {
+		t.Fatal("slate started before threshold")
+	}
+	b.checkFallback(time.Now().Add(2 * time.Second))
+	time.Sleep(150 * time.Millisecond)
+
+	// 上游恢复，时间戳还接着断流前；关键帧之前的帧丢掉，从关键帧切回来
+	b.relayTag(seg, seqTag(80, 'u'))
+	b.relayTag(seg, interTag(80, 'u'))
+	b.relayTag(seg, keyTag(120, 'u'))
+	b.relayTag(seg, interTag(160, 'u'))
+	if playing(b) {
+		t.Fatal("slate still playing after upstream key frame")
+	}
+
+	tags := viewer.tags(t)
+	var marks []byte
+	var last uint32
+	for i, tag := range tags {
+		if tag.Timestamp < last {
+			t.Fatalf("tag %d timestamp %d goes back from %d", i, tag.Timestamp, last)
+		}
+		last = tag.Timestamp
+		marks = append(marks, tag.Data[len(tag.Data)-1])
+	}
+	// 上游 3 个 tag；垫片的序列头 + 至少一个关键帧；上游的序列头 + 关键帧 + 后续帧
+	if len(tags) < 8 || string(marks[:5]) != "uuuss" || string(marks[len(marks)-3:]) != "uuu" {
+		t.Fatalf("unexpected splice: %q", marks)
+	}
+	if seq := tags[len(tags)-3]; !seq.IsSequenceHeader() || !tags[len(tags)-2].IsKeyFrame() {
+		t.Fatal("switch back does not start with sequence header + key frame")
+	}
+	b.HeaderMutex.RLock()
+	defer b.HeaderMutex.RUnlock()
+	if b.videoSeqTag.Data[len(b.videoSeqTag.Data)-1] != 'u' {
+		t.Fatal("new viewers would get the slate sequence header")
+	}
+}
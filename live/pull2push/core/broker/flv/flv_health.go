@@ -0,0 +1,246 @@
+package flv
+
+import (
+	"fmt"
+	"log"
+	"pull2push/core/broker"
+	"sync"
+	"time"
+)
+
+/*
+流健康检查
+
+	在 tag 流上检查：断流、时间戳跳变/回退、关键帧间隔、音视频偏差、缺少序列头。
+	每个异常都是一个 broker.HealthEvent，保留最近 maxHealthEvents 条，同一类事件在 healthEventCooldown 内只记录一次（计数照常累加），
+	避免摄像头持续异常时刷屏。
+*/
+
+const (
+	maxHealthEvents     = 100
+	healthEventCooldown = 10 * time.Second
+	healthyAfter        = 30 * time.Second // 最近一次异常超过该时间后才认为恢复健康
+)
+
+// HealthConfig 健康检查阈值
+type HealthConfig struct {
+	StallTimeout        time.Duration // 超过该时间没有数据认为断流
+	MaxTimestampJump    uint32        // 同一轨道相邻 tag 时间戳允许的最大间隔（毫秒）
+	MaxKeyframeInterval uint32        // 关键帧最大间隔（毫秒）
+	MaxAVDrift          uint32        // 音视频时间戳最大偏差（毫秒）
+}
+
+// DefaultHealthConfig 适用于 HTTP-FLV / RTMP / RTSP 等连续的流
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		StallTimeout:        5 * time.Second,
+		MaxTimestampJump:    3000,
+		MaxKeyframeInterval: 10000,
+		MaxAVDrift:          1000,
+	}
+}
+
+// trackState 单个轨道的状态
+type trackState struct {
+	lastTs          uint32
+	seen            bool
+	seqHeader       bool
+	missingReported bool
+}
+
+// HealthAnalyzer 一路直播的健康检查，Observe 和 Check 可以在不同的 goroutine 调用
+type HealthAnalyzer struct {
+	mu        sync.Mutex
+	brokerKey string
+	cfg       HealthConfig
+
+	lastDataAt time.Time
+	stalled    bool
+
+	video       trackState
+	audio       trackState
+	lastKeyTs   uint32
+	keySeen     bool
+	gopReported bool // 当前 GOP 已经报告过关键帧间隔过长
+	drifting    bool
+
+	events    []broker.HealthEvent
+	counts    map[string]int
+	lastEvent map[string]time.Time // 类型+轨道 -> 最近一次记录的时间
+	lastBadAt time.Time            // 最近一次异常的时间
+}
+
+func NewHealthAnalyzer(brokerKey string, cfg HealthConfig) *HealthAnalyzer {
+	return &HealthAnalyzer{
+		brokerKey:  brokerKey,
+		cfg:        cfg,
+		lastDataAt: time.Now(),
+		counts:     make(map[string]int),
+		lastEvent:  make(map[string]time.Time),
+	}
+}
+
+// Reset 上游重新连接后时间戳和序列头都会重新开始，清掉轨道状态，保留事件记录
+func (a *HealthAnalyzer) Reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.video, a.audio = trackState{}, trackState{}
+	a.keySeen, a.gopReported, a.drifting = false, false, false
+}
+
+// Observe 检查一个 tag
+func (a *HealthAnalyzer) Observe(tag *FlvTag) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	if a.stalled {
+		a.stalled = false
+		gap := now.Sub(a.lastDataAt).Milliseconds()
+		a.emit(now, broker.HealthRecovered, "", gap, fmt.Sprintf("断流 %dms 后恢复", gap))
+	}
+	a.lastDataAt = now
+
+	switch tag.TagType {
+	case TagTypeVideo:
+		a.observeVideo(now, tag)
+	case TagTypeAudio:
+		a.observeAudio(now, tag)
+	default:
+		return
+	}
+
+	if a.video.seen && a.audio.seen {
+		drift := int64(a.video.lastTs) - int64(a.audio.lastTs)
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift > int64(a.cfg.MaxAVDrift) && !a.drifting {
+			a.drifting = true
+			a.emit(now, broker.HealthAVDrift, "", drift, fmt.Sprintf("音视频时间戳相差 %dms", drift))
+		} else if drift < int64(a.cfg.MaxAVDrift/2) {
+			a.drifting = false
+		}
+	}
+}
+
+func (a *HealthAnalyzer) observeVideo(now time.Time, tag *FlvTag) {
+	h := tag.VideoHeader()
+	if h == nil {
+		return
+	}
+	if h.IsSequenceStart() {
+		a.video.seqHeader = true
+		return
+	}
+	if !h.IsCodedFrame() {
+		return
+	}
+	if !a.video.seqHeader && !a.video.missingReported {
+		a.video.missingReported = true
+		a.emit(now, broker.HealthMissingSequenceHeader, "video", 0, "收到视频帧但还没有视频序列头")
+	}
+	a.checkTimestamp(now, &a.video, "video", tag.Timestamp)
+
+	switch {
+	case h.IsKeyFrame():
+		if a.keySeen && !a.gopReported && tag.Timestamp > a.lastKeyTs && tag.Timestamp-a.lastKeyTs > a.cfg.MaxKeyframeInterval {
+			interval := int64(tag.Timestamp - a.lastKeyTs)
+			a.emit(now, broker.HealthKeyframeInterval, "video", interval, fmt.Sprintf("关键帧间隔 %dms", interval))
+		}
+		a.lastKeyTs, a.keySeen, a.gopReported = tag.Timestamp, true, false
+	case a.keySeen && !a.gopReported && tag.Timestamp > a.lastKeyTs && tag.Timestamp-a.lastKeyTs > a.cfg.MaxKeyframeInterval:
+		// 迟迟等不到下一个关键帧，不等它到了再报
+		a.gopReported = true
+		interval := int64(tag.Timestamp - a.lastKeyTs)
+		a.emit(now, broker.HealthKeyframeInterval, "video", interval, fmt.Sprintf("已经 %dms 没有关键帧", interval))
+	}
+}
+
+func (a *HealthAnalyzer) observeAudio(now time.Time, tag *FlvTag) {
+	if len(tag.Data) < 2 {
+		return
+	}
+	if (tag.Data[0]>>4)&0x0F == FormatAAC {
+		if tag.Data[1] == 0 {
+			a.audio.seqHeader = true
+			return
+		}
+		if !a.audio.seqHeader && !a.audio.missingReported {
+			a.audio.missingReported = true
+			a.emit(now, broker.HealthMissingSequenceHeader, "audio", 0, "收到 AAC 帧但还没有音频序列头")
+		}
+	}
+	a.checkTimestamp(now, &a.audio, "audio", tag.Timestamp)
+}
+
+func (a *HealthAnalyzer) checkTimestamp(now time.Time, track *trackState, name string, ts uint32) {
+	if track.seen {
+		switch {
+		case ts < track.lastTs:
+			back := int64(track.lastTs - ts)
+			a.emit(now, broker.HealthTimestampRegression, name, back, fmt.Sprintf("时间戳回退 %dms（%d -> %d）", back, track.lastTs, ts))
+		case ts-track.lastTs > a.cfg.MaxTimestampJump:
+			jump := int64(ts - track.lastTs)
+			a.emit(now, broker.HealthTimestampJump, name, jump, fmt.Sprintf("时间戳跳变 %dms（%d -> %d）", jump, track.lastTs, ts))
+		}
+	}
+	track.lastTs, track.seen = ts, true
+}
+
+// Check 检查是否断流，需要定时调用
+func (a *HealthAnalyzer) Check(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.stalled {
+		return
+	}
+	if idle := now.Sub(a.lastDataAt); idle > a.cfg.StallTimeout {
+		a.stalled = true
+		a.emit(now, broker.HealthStalled, "", idle.Milliseconds(), fmt.Sprintf("%dms 没有收到数据", idle.Milliseconds()))
+	}
+}
+
+// emit 记录一个事件，调用方需持有 mu
+func (a *HealthAnalyzer) emit(now time.Time, typ broker.HEALTH_EVENT_TYPE, track string, value int64, msg string) {
+	a.counts[typ.String()]++
+	if typ != broker.HealthRecovered {
+		a.lastBadAt = now
+	}
+
+	key := typ.String() + "/" + track
+	if last, ok := a.lastEvent[key]; ok && now.Sub(last) < healthEventCooldown && typ != broker.HealthStalled && typ != broker.HealthRecovered {
+		return
+	}
+	a.lastEvent[key] = now
+
+	ev := broker.HealthEvent{BrokerKey: a.brokerKey, Type: typ, Track: track, Message: msg, Value: value, Time: now}
+	a.events = append(a.events, ev)
+	if len(a.events) > maxHealthEvents {
+		a.events = append(a.events[:0], a.events[len(a.events)-maxHealthEvents:]...)
+	}
+	if track != "" {
+		log.Printf("[health:%s] %s(%s) %s", a.brokerKey, typ, track, msg)
+	} else {
+		log.Printf("[health:%s] %s %s", a.brokerKey, typ, msg)
+	}
+}
+
+// Report 当前的健康状态
+func (a *HealthAnalyzer) Report() *broker.HealthReport {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	report := &broker.HealthReport{
+		Healthy:     !a.stalled && (a.lastBadAt.IsZero() || time.Since(a.lastBadAt) > healthyAfter),
+		Stalled:     a.stalled,
+		LastDataAt:  a.lastDataAt,
+		EventCounts: make(map[string]int, len(a.counts)),
+		Events:      append([]broker.HealthEvent(nil), a.events...),
+	}
+	for k, v := range a.counts {
+		report.EventCounts[k] = v
+	}
+	return report
+}
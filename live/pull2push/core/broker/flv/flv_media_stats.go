@@ -0,0 +1,198 @@
+package flv
+
+import (
+	"fmt"
+	"pull2push/core/broker"
+	"sync"
+	"time"
+)
+
+// statsWindowMs 码率/帧率按 tag 时间戳统计的窗口长度
+const statsWindowMs = 2000
+
+// rateWindow 按时间戳窗口统计字节数和帧数
+type rateWindow struct {
+	start   uint32
+	started bool
+	bytes   int
+	frames  int
+
+	kbps float64 // 上一个完整窗口的码率
+	fps  float64 // 上一个完整窗口的帧率
+}
+
+func (w *rateWindow) add(ts uint32, n int, frame bool) {
+	// 第一次统计或时间戳回退（上游重连）时重新开始
+	if !w.started || ts < w.start {
+		w.start, w.started, w.bytes, w.frames = ts, true, 0, 0
+	}
+	if elapsed := ts - w.start; elapsed >= statsWindowMs {
+		w.kbps = float64(w.bytes*8) / float64(elapsed)
+		w.fps = float64(w.frames) * 1000 / float64(elapsed)
+		w.start, w.bytes, w.frames = ts, 0, 0
+	}
+	w.bytes += n
+	if frame {
+		w.frames++
+	}
+}
+
+// MediaStats 从 tag 流中提取编码参数并统计码率、帧率、GOP 长度，可以并发读取
+type MediaStats struct {
+	mu        sync.Mutex
+	video     *broker.VideoInfo
+	audio     *broker.AudioInfo
+	videoRate rateWindow
+	audioRate rateWindow
+	updatedAt time.Time
+
+	gopStart  uint32 // 当前 GOP 起始关键帧的时间戳
+	gopFrames int    // 当前 GOP 已经收到的帧数
+	inGOP     bool
+	lastGOP   int
+	lastGOPMs uint32
+}
+
+func NewMediaStats() *MediaStats {
+	return &MediaStats{}
+}
+
+// Observe 统计一个 tag
+func (s *MediaStats) Observe(tag *FlvTag) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch tag.TagType {
+	case TagTypeVideo:
+		s.observeVideo(tag)
+	case TagTypeAudio:
+		s.observeAudio(tag)
+	default:
+		return
+	}
+	s.updatedAt = time.Now()
+}
+
+func (s *MediaStats) observeVideo(tag *FlvTag) {
+	h := tag.VideoHeader()
+	if h == nil {
+		return
+	}
+	if h.IsSequenceStart() {
+		s.video = parseVideoInfo(h, tag.Data[h.HeaderSize:])
+		return
+	}
+	if !h.IsCodedFrame() {
+		return
+	}
+	s.videoRate.add(tag.Timestamp, len(tag.Data), true)
+
+	if s.inGOP && tag.Timestamp < s.gopStart {
+		s.inGOP = false
+	}
+	if h.IsKeyFrame() {
+		if s.inGOP {
+			s.lastGOP, s.lastGOPMs = s.gopFrames, tag.Timestamp-s.gopStart
+		}
+		s.gopStart, s.gopFrames, s.inGOP = tag.Timestamp, 0, true
+	}
+	if s.inGOP {
+		s.gopFrames++
+	}
+}
+
+func (s *MediaStats) observeAudio(tag *FlvTag) {
+	if len(tag.Data) < 2 {
+		return
+	}
+	format := (tag.Data[0] >> 4) & 0x0F
+	if format == FormatAAC && tag.Data[1] == 0 {
+		info := &broker.AudioInfo{Codec: "AAC"}
+		if asc, err := ParseAudioSpecificConfig(tag.Data[2:]); err == nil {
+			info.Profile, info.SampleRate, info.Channels = asc.Profile, asc.SampleRate, asc.Channels
+		}
+		s.audio = info
+		return
+	}
+	if s.audio == nil {
+		// 非 AAC 没有序列头，只能从 tag 头的标志位拿到大概的参数
+		s.audio = &broker.AudioInfo{
+			Codec:      (&FLVParser{}).audioFormatToString(format),
+			SampleRate: []int{5500, 11025, 22050, 44100}[(tag.Data[0]>>2)&0x03],
+			Channels:   int(tag.Data[0]&0x01) + 1,
+		}
+	}
+	s.audioRate.add(tag.Timestamp, len(tag.Data), false)
+}
+
+// parseVideoInfo 从解码配置里取出编码参数，H.264/H.265 会继续解析 SPS
+func parseVideoInfo(h *VideoTagHeader, config []byte) *broker.VideoInfo {
+	info := &broker.VideoInfo{Codec: (&FLVParser{}).fourCCToString(h.FourCC)}
+	var sps *SPSInfo
+	switch h.FourCC {
+	case FourCCAVC:
+		if spsList, _, _, err := ParseAVCDecoderConfig(config); err == nil && len(spsList) > 0 {
+			sps, _ = ParseH264SPS(spsList[0])
+		}
+	case FourCCHEVC:
+		if paramSets, _, err := ParseHEVCDecoderConfig(config); err == nil {
+			for _, nalu := range paramSets {
+				if H265NALType(nalu) == H265NALSPS {
+					sps, _ = ParseH265SPS(nalu)
+					break
+				}
+			}
+		}
+	case FourCCAV1:
+		if rec, err := ParseAV1CodecConfigurationRecord(config); err == nil {
+			info.Profile = []string{"Main", "High", "Professional"}[min(int(rec.SeqProfile), 2)]
+			info.Level = fmt.Sprintf("%d.%d", 2+rec.SeqLevelIdx0>>2, rec.SeqLevelIdx0&0x03)
+			info.BitDepth = 8
+			if rec.HighBitdepth {
+				info.BitDepth = 10
+				if rec.TwelveBit {
+					info.BitDepth = 12
+				}
+			}
+		}
+	case FourCCVP9:
+		if rec, err := ParseVPCodecConfigurationRecord(config); err == nil {
+			info.Profile = fmt.Sprintf("Profile %d", rec.Profile)
+			info.Level = fmt.Sprintf("%g", float64(rec.Level)/10)
+			info.BitDepth = int(rec.BitDepth)
+		}
+	}
+	if sps != nil {
+		info.Profile, info.Level = sps.Profile, sps.Level
+		info.Width, info.Height = sps.Width, sps.Height
+		info.ChromaFormat, info.BitDepth = sps.ChromaFormat, sps.BitDepth
+		info.FPS = sps.FrameRate
+	}
+	return info
+}
+
+// Snapshot 返回当前的统计结果，还没有收到音视频时返回 nil
+func (s *MediaStats) Snapshot() *broker.MediaInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.video == nil && s.audio == nil {
+		return nil
+	}
+	info := &broker.MediaInfo{UpdatedAt: s.updatedAt}
+	if s.video != nil {
+		v := *s.video
+		v.MeasuredFPS = s.videoRate.fps
+		v.BitrateKbps = s.videoRate.kbps
+		v.GOPFrames, v.GOPDurationMs = s.lastGOP, s.lastGOPMs
+		info.Video = &v
+		info.BitrateKbps += v.BitrateKbps
+	}
+	if s.audio != nil {
+		a := *s.audio
+		a.BitrateKbps = s.audioRate.kbps
+		info.Audio = &a
+		info.BitrateKbps += a.BitrateKbps
+	}
+	return info
+}
@@ -0,0 +1,186 @@
+package flv
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"pull2push/core/client"
+	"pull2push/core/stream"
+	"sync"
+	"time"
+)
+
+// ====================== FlvTag <-> stream.Packet ======================
+
+// PacketFromTag 去掉 FLV tag 头，转换成 stream.Packet；序列结束、视频元数据、命令帧和不认识的编码返回 false
+func PacketFromTag(tag *FlvTag) (stream.Packet, bool) {
+	ts := time.Duration(tag.Timestamp) * time.Millisecond
+	p := stream.Packet{DTS: ts, PTS: ts}
+	switch tag.TagType {
+	case TagTypeScript:
+		p.Kind = stream.PacketMetadata
+		p.Payload = tag.Data
+		return p, true
+
+	case TagTypeVideo:
+		h, err := ParseVideoTagHeader(tag.Data)
+		if err != nil || h.FourCC == "" {
+			return p, false
+		}
+		p.Kind = stream.PacketVideo
+		p.Codec = h.FourCC
+		p.Payload = tag.Data[h.HeaderSize:]
+		switch {
+		case h.IsSequenceStart():
+			p.Config = true
+		case h.IsCodedFrame():
+			p.KeyFrame = h.FrameType == VideoFrameKey
+			p.PTS += time.Duration(h.CompositionTime) * time.Millisecond
+		default:
+			return p, false
+		}
+		return p, true
+
+	case TagTypeAudio:
+		if len(tag.Data) < 1 {
+			return p, false
+		}
+		p.Kind = stream.PacketAudio
+		switch (tag.Data[0] >> 4) & 0x0F {
+		case FormatAAC:
+			if len(tag.Data) < 2 {
+				return p, false
+			}
+			p.Codec = stream.CodecAAC
+			p.Config = tag.Data[1] == 0
+			p.Payload = tag.Data[2:]
+		case FormatMP3:
+			p.Codec = stream.CodecMP3
+			p.Payload = tag.Data[1:]
+		default:
+			return p, false
+		}
+		return p, true
+	}
+	return p, false
+}
+
+// TagFromPacket 把 stream.Packet 封装回 FLV tag：avc1 输出 legacy 格式，hvc1/av01/vp09 输出 Enhanced FLV
+func TagFromPacket(p stream.Packet) (*FlvTag, error) {
+	ts := uint32(p.DTS / time.Millisecond)
+	switch p.Kind {
+	case stream.PacketMetadata:
+		return NewFlvTag(TagTypeScript, ts, p.Payload), nil
+
+	case stream.PacketVideo:
+		if fourCCToCodecID(p.Codec) == 0 {
+			return nil, fmt.Errorf("FLV 不支持视频编码 %q", p.Codec)
+		}
+		frameType, packetType := uint8(VideoFrameInter), uint8(VideoPacketCodedFrames)
+		if p.KeyFrame || p.Config {
+			frameType = VideoFrameKey
+		}
+		if p.Config {
+			packetType = VideoPacketSequenceStart
+		}
+		cts := int32(p.CompositionTime() / time.Millisecond)
+		return NewFlvTag(TagTypeVideo, ts, BuildVideoTagData(p.Codec, frameType, packetType, cts, p.Payload)), nil
+
+	case stream.PacketAudio:
+		switch p.Codec {
+		case stream.CodecAAC:
+			if p.Config {
+				return NewAACSequenceTag(p.Payload, ts), nil
+			}
+			return NewAACFrameTag(p.Payload, ts), nil
+		case stream.CodecMP3:
+			// 44kHz 16bit 立体声，播放器按 MP3 帧头里的参数解码
+			data := make([]byte, 1+len(p.Payload))
+			data[0] = FormatMP3<<4 | 0x0F
+			copy(data[1:], p.Payload)
+			return NewFlvTag(TagTypeAudio, ts, data), nil
+		}
+		return nil, fmt.Errorf("FLV 不支持音频编码 %q", p.Codec)
+	}
+	return nil, fmt.Errorf("未知的包类型 %s", p.Kind)
+}
+
+// ====================== stream.Client -> client.LiveClient ======================
+
+// packetClient 挂在 LiveClient 接口上的新观众，Broadcast 收到的 FLV 字节解析成包写给它
+type packetClient struct {
+	c    stream.Client
+	mu   sync.Mutex
+	tags *TagReader
+	err  error // 第一次 Write 失败的原因，之后的数据全部丢弃
+}
+
+// PacketClientOf 把新观众包装成 client.LiveClient，FLV broker 的 AddClient 和 adapter 都用它
+func PacketClientOf(c stream.Client) client.LiveClient {
+	return &packetClient{c: c, tags: NewTagReader()}
+}
+
+func (pc *packetClient) Broadcast(data []byte) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.err != nil {
+		return
+	}
+	packets, err := pc.tags.Packets(data)
+	if err != nil {
+		pc.err = err
+		log.Printf("[flv] 解析 FLV 数据失败: %v", err)
+		return
+	}
+	for _, p := range packets {
+		if err := pc.c.Write(p); err != nil {
+			pc.err = err
+			return
+		}
+	}
+}
+
+// Listen 数据在 Broadcast 里直接写给观众
+func (pc *packetClient) Listen() {}
+
+// GetDataChan 没有写通道
+func (pc *packetClient) GetDataChan() chan []byte {
+	return nil
+}
+
+// ====================== FLV 字节 -> stream.Packet ======================
+
+// TagReader 旧接口传的是没有分帧的 FLV 字节，可能带 FLV 头（起播数据）也可能不带（实时数据）
+type TagReader struct {
+	demuxer *FLVDemuxer
+	started bool
+}
+
+// NewTagReader 每一路 FLV 字节用一个，解析器会保留跨调用的半个 tag
+func NewTagReader() *TagReader {
+	return &TagReader{demuxer: NewFLVDemuxer()}
+}
+
+// Packets 解析一段 FLV 字节，返回其中完整的包，数据可以按任意字节边界传进来
+func (r *TagReader) Packets(data []byte) ([]stream.Packet, error) {
+	if !r.started {
+		r.started = true
+		if !bytes.HasPrefix(data, []byte("FLV")) {
+			// 没有 FLV 头，先补一个让解析器进入读 tag 的状态
+			if _, err := r.demuxer.Feed(BuildFLVHeader(true, true)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	tags, err := r.demuxer.Feed(data)
+	if err != nil {
+		return nil, err
+	}
+	packets := make([]stream.Packet, 0, len(tags))
+	for _, tag := range tags {
+		if p, ok := PacketFromTag(tag); ok {
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
@@ -376,7 +376,7 @@ func (p *FLVParser) PrintRequiredTags() {
 					fmt.Print("\n    ")
 				}
 			}
-			fmt.Println("\n")
+			fmt.Print("\n\n")
 
 			// 打印解析后的元数据
 			if tag.Metadata != nil {
@@ -644,29 +644,39 @@ func (p *FLVParser) parseTag(reader io.Reader) (FLVTag, error) {
 			tag.IsConfig = (packetType == 0) // AAC序列头
 
 			if tag.IsConfig && len(dataBuf) > 3 {
-				// 解析AAC特定配置（可提取更精确的采样率等）
-				// 这里只实现基础解析，完整解析需要更复杂的处理
-				aacObjectType := (dataBuf[2] >> 3) & 0x1F
-				samplingFreqIndex := ((dataBuf[2] & 0x07) << 1) | ((dataBuf[3] >> 7) & 0x01)
-				channelConfig := (dataBuf[3] >> 3) & 0x0F
+				// 完整解析AudioSpecificConfig（支持扩展采样率和HE-AAC），失败时退回到按固定位置读取
+				if info, err := ParseAudioSpecificConfig(dataBuf[2:]); err == nil {
+					tag.SampleRate = info.SampleRate
+					tag.Channels = info.Channels
+					if tag.Channels == 0 {
+						tag.Channels = 2
+					}
+					if p.debug {
+						log.Printf("[DEBUG] AAC配置: %s, %d Hz, %d声道", info.Profile, info.SampleRate, info.Channels)
+					}
+				} else {
+					aacObjectType := (dataBuf[2] >> 3) & 0x1F
+					samplingFreqIndex := ((dataBuf[2] & 0x07) << 1) | ((dataBuf[3] >> 7) & 0x01)
+					channelConfig := (dataBuf[3] >> 3) & 0x0F
 
-				if p.debug {
-					log.Printf("[DEBUG] AAC配置: ObjectType=%d, SamplingFreqIndex=%d, ChannelConfig=%d",
-						aacObjectType, samplingFreqIndex, channelConfig)
-				}
+					if p.debug {
+						log.Printf("[DEBUG] AAC配置: ObjectType=%d, SamplingFreqIndex=%d, ChannelConfig=%d",
+							aacObjectType, samplingFreqIndex, channelConfig)
+					}
 
-				// 根据采样率索引设置具体采样率
-				aacSampleRates := []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
-				if int(samplingFreqIndex) < len(aacSampleRates) {
-					tag.SampleRate = aacSampleRates[samplingFreqIndex]
-				}
+					// 根据采样率索引设置具体采样率
+					aacSampleRates := []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+					if int(samplingFreqIndex) < len(aacSampleRates) {
+						tag.SampleRate = aacSampleRates[samplingFreqIndex]
+					}
 
-				// 设置声道数
-				if channelConfig > 0 {
-					tag.Channels = int(channelConfig)
-				} else {
-					// 默认为ffprobe检测到的双声道
-					tag.Channels = 2
+					// 设置声道数
+					if channelConfig > 0 {
+						tag.Channels = int(channelConfig)
+					} else {
+						// 默认为ffprobe检测到的双声道
+						tag.Channels = 2
+					}
 				}
 			} else if !tag.IsConfig {
 				// 非配置帧但是AAC格式，默认设置为ffprobe检测到的值
@@ -675,21 +685,23 @@ func (p *FLVParser) parseTag(reader io.Reader) (FLVTag, error) {
 			}
 		}
 	} else if tagType == TagTypeVideo && len(dataBuf) > 0 {
-		// 视频Tag
-		frameType := (dataBuf[0] >> 4) & 0x0F
-		codecID := dataBuf[0] & 0x0F
-
-		tag.IsKeyFrame = (frameType == 1) // 1=关键帧
-		tag.Codec = p.videoCodecToString(codecID)
-
-		// 判断是否是配置帧
-		if (codecID == CodecH264 || codecID == CodecH265) && len(dataBuf) > 1 {
-			avcPacketType := dataBuf[1]
-			tag.IsConfig = (avcPacketType == 0) // 0=AVC/HEVC序列头
+		// 视频Tag，legacy 和 Enhanced FLV（ExVideoTagHeader + FourCC）统一解析
+		videoHeader, err := ParseVideoTagHeader(dataBuf)
+		if err == nil {
+			tag.IsKeyFrame = videoHeader.IsKeyFrame()
+			tag.IsConfig = videoHeader.IsSequenceStart()
+			if videoHeader.Enhanced {
+				tag.Codec = p.fourCCToString(videoHeader.FourCC)
+			} else {
+				tag.Codec = p.videoCodecToString(videoHeader.CodecID)
+			}
 
 			// 如果是配置帧，调用parseVideoConfig进行解析
 			if tag.IsConfig {
-				p.parseVideoConfig(dataBuf, &tag, codecID)
+				p.parseVideoConfig(dataBuf, &tag, videoHeader)
+			} else if videoHeader.Enhanced && videoHeader.PacketType == VideoPacketMetadata {
+				// Enhanced FLV 视频元数据（colorInfo 等），AMF 编码
+				p.parseScriptData(dataBuf[videoHeader.HeaderSize:], &tag)
 			}
 		}
 	} else if tagType == TagTypeScript && len(dataBuf) > 0 {
@@ -717,23 +729,76 @@ func (p *FLVParser) parseTag(reader io.Reader) (FLVTag, error) {
 }
 
 // parseVideoConfig 根据不同的编解码器选择对应的解析函数
-func (p *FLVParser) parseVideoConfig(data []byte, tag *FLVTag, codecID uint8) {
-	if len(data) < 5 {
+func (p *FLVParser) parseVideoConfig(data []byte, tag *FLVTag, videoHeader *VideoTagHeader) {
+	if len(data) < videoHeader.HeaderSize {
 		return // 数据不足
 	}
+	config := data[videoHeader.HeaderSize:] // 跳过FLV视频tag头部
 
-	switch codecID {
+	switch videoHeader.CodecID {
 	case CodecH264:
-		p.parseAVCConfig(data[5:], tag) // 跳过前5个字节的FLV视频tag头部
+		p.parseAVCConfig(config, tag)
 	case CodecH265:
-		p.parseHEVCConfig(data[5:], tag) // 跳过前5个字节的FLV视频tag头部
+		p.parseHEVCConfig(config, tag)
+	case CodecAV1:
+		p.parseAV1Config(config, tag)
+	case CodecVP9:
+		p.parseVP9Config(config, tag)
 	default:
 		if p.debug {
-			log.Printf("[DEBUG] 不支持的视频编解码器: %d", codecID)
+			log.Printf("[DEBUG] 不支持的视频编解码器: %d %s", videoHeader.CodecID, videoHeader.FourCC)
 		}
 	}
 }
 
+// parseAV1Config 解析AV1配置数据（av1C）
+func (p *FLVParser) parseAV1Config(data []byte, tag *FLVTag) {
+	config, err := ParseAV1CodecConfigurationRecord(data)
+	if err != nil {
+		if p.debug {
+			log.Printf("[DEBUG] AV1配置解析失败: %v", err)
+		}
+		return
+	}
+	if p.debug {
+		log.Printf("[DEBUG] AV1配置: Profile=%d, Level=%d, Tier=%d, HighBitdepth=%v",
+			config.SeqProfile, config.SeqLevelIdx0, config.SeqTier0, config.HighBitdepth)
+	}
+	// seq_level_idx：8=4.0(1080p) 12=5.0(4K)
+	switch {
+	case config.SeqLevelIdx0 >= 12:
+		tag.Width, tag.Height = 3840, 2160
+	case config.SeqLevelIdx0 >= 8:
+		tag.Width, tag.Height = 1920, 1080
+	default:
+		tag.Width, tag.Height = 1280, 720
+	}
+}
+
+// parseVP9Config 解析VP9配置数据（vpcC）
+func (p *FLVParser) parseVP9Config(data []byte, tag *FLVTag) {
+	config, err := ParseVPCodecConfigurationRecord(data)
+	if err != nil {
+		if p.debug {
+			log.Printf("[DEBUG] VP9配置解析失败: %v", err)
+		}
+		return
+	}
+	if p.debug {
+		log.Printf("[DEBUG] VP9配置: Profile=%d, Level=%d, BitDepth=%d",
+			config.Profile, config.Level, config.BitDepth)
+	}
+	// level 40=4.0(1080p) 50=5.0(4K)
+	switch {
+	case config.Level >= 50:
+		tag.Width, tag.Height = 3840, 2160
+	case config.Level >= 40:
+		tag.Width, tag.Height = 1920, 1080
+	default:
+		tag.Width, tag.Height = 1280, 720
+	}
+}
+
 // parseAVCConfig 解析AVC(H.264)配置数据
 func (p *FLVParser) parseAVCConfig(data []byte, tag *FLVTag) {
 	if len(data) < 7 {
@@ -754,6 +819,16 @@ func (p *FLVParser) parseAVCConfig(data []byte, tag *FLVTag) {
 			avcConfig.ProfileCompatibility, avcConfig.AVCLevelIndication)
 	}
 
+	// 优先按位解析SPS，解析失败时才退回到按Profile估算
+	if spsList, _, _, err := ParseAVCDecoderConfig(data); err == nil && len(spsList) > 0 {
+		if info, err := ParseH264SPS(spsList[0]); err == nil {
+			p.applySPSInfo(tag, info)
+			return
+		} else if p.debug {
+			log.Printf("[DEBUG] H.264 SPS解析失败: %v", err)
+		}
+	}
+
 	// 查找SPS（序列参数集）
 	if len(data) > 10 {
 		spsLength := (int(data[6]) << 8) | int(data[7])
@@ -764,6 +839,19 @@ func (p *FLVParser) parseAVCConfig(data []byte, tag *FLVTag) {
 	}
 }
 
+// applySPSInfo 用SPS解析结果覆盖视频参数，SPS里没有帧率时保留原值
+func (p *FLVParser) applySPSInfo(tag *FLVTag, info *SPSInfo) {
+	if p.debug {
+		log.Printf("[DEBUG] SPS: %s@L%s %dx%d %s %dbit fps=%.3f",
+			info.Profile, info.Level, info.Width, info.Height, info.ChromaFormat, info.BitDepth, info.FrameRate)
+	}
+	tag.Width = info.Width
+	tag.Height = info.Height
+	if info.FrameRate > 0 {
+		tag.FrameRate = info.FrameRate
+	}
+}
+
 // setAVCVideoParams 根据AVC Profile设置视频参数
 func (p *FLVParser) setAVCVideoParams(tag *FLVTag, profile uint8, spsLength int) {
 	// 根据Profile和SPS长度估算视频参数
@@ -892,7 +980,8 @@ func (p *FLVParser) parseHEVCNALUnits(data []byte, tag *FLVTag) {
 			break
 		}
 
-		nalUnitType := (data[currentPos] >> 1) & 0x3F
+		// array_completeness(1) + reserved(1) + NAL_unit_type(6)
+		nalUnitType := data[currentPos] & 0x3F
 		numNalus := binary.BigEndian.Uint16(data[currentPos+1 : currentPos+3])
 		currentPos += 3
 
@@ -935,6 +1024,15 @@ func (p *FLVParser) parseHEVCNALUnits(data []byte, tag *FLVTag) {
 		}
 	}
 
+	// 用SPS的真实参数覆盖按Level估算的结果
+	if sps != nil {
+		if info, err := ParseH265SPS(sps); err == nil {
+			p.applySPSInfo(tag, info)
+		} else if p.debug {
+			log.Printf("[DEBUG] H.265 SPS解析失败: %v", err)
+		}
+	}
+
 	// 重构配置数据
 	if vps != nil && sps != nil && pps != nil {
 		p.reconstructHEVCConfigData(tag, vps, sps, pps)
@@ -947,7 +1045,7 @@ func (p *FLVParser) parseHEVCNALUnits(data []byte, tag *FLVTag) {
 // reconstructHEVCConfigData 重构HEVC配置数据
 func (p *FLVParser) reconstructHEVCConfigData(tag *FLVTag, vps, sps, pps []byte) {
 	// 计算新的配置数据大小
-	totalSize := 5  // HEVC标记(1) + 包类型(1) + 合成时间(3)
+	totalSize := 5  // 视频tag头部：legacy 为 HEVC标记(1) + 包类型(1) + 合成时间(3)，Enhanced 为 ExHeader(1) + FourCC(4)
 	totalSize += 22 // 保留原始的HEVC配置头部
 	totalSize += 1  // NAL数组数量
 	// 为每个NAL数组添加空间
@@ -959,13 +1057,9 @@ func (p *FLVParser) reconstructHEVCConfigData(tag *FLVTag, vps, sps, pps []byte)
 	newConfig := make([]byte, totalSize)
 	pos := 0
 
-	// 写入HEVC标记和包类型
-	newConfig[pos] = 0x1C // HEVC标记
-	pos++
-	newConfig[pos] = 0x00 // 配置包类型
-	pos++
-	// 合成时间 (3字节，设为0)
-	pos += 3
+	// 保留原始的视频tag头部（legacy: 0x1C 00 000000，Enhanced: 0x90 + "hvc1"，都是5字节）
+	copy(newConfig[pos:], tag.RawData[:5])
+	pos += 5
 
 	// 复制原始的HEVC配置头部
 	copy(newConfig[pos:], tag.RawData[5:27])
@@ -994,7 +1088,7 @@ func (p *FLVParser) reconstructHEVCConfigData(tag *FLVTag, vps, sps, pps []byte)
 
 // writeNALUnit 写入NAL单元数据
 func (p *FLVParser) writeNALUnit(config []byte, pos int, nalType uint8, nalData []byte) int {
-	config[pos] = nalType << 1 // NAL类型
+	config[pos] = 0x80 | nalType // array_completeness=1 + NAL类型
 	pos++
 	binary.BigEndian.PutUint16(config[pos:], 1) // NAL数量
 	pos += 2
@@ -1115,8 +1209,7 @@ func (p *FLVParser) parseScriptData(data []byte, tag *FLVTag) {
 	// 解析元数据属性
 	for currentPos+2 < len(data) {
 		// 检查是否到达对象结束标记
-		if currentPos+2 < len(data) && data[currentPos] == 0x00 && data[currentPos+1] == 0x00 &&
-			currentPos+2 < len(data) && data[currentPos+2] == AMF0_OBJECT_END {
+		if data[currentPos] == 0x00 && data[currentPos+1] == 0x00 && data[currentPos+2] == AMF0_OBJECT_END {
 			break
 		}
 
@@ -1327,6 +1420,22 @@ func (p *FLVParser) videoCodecToString(codecID uint8) string {
 	}
 }
 
+// fourCCToString Enhanced FLV 的 FourCC 转成可读名称
+func (p *FLVParser) fourCCToString(fourCC string) string {
+	switch fourCC {
+	case FourCCAVC:
+		return "H.264"
+	case FourCCHEVC:
+		return "H.265"
+	case FourCCAV1:
+		return "AV1"
+	case FourCCVP9:
+		return "VP9"
+	default:
+		return fmt.Sprintf("Unknown(%s)", fourCC)
+	}
+}
+
 func (p *FLVParser) audioFormatToString(format uint8) string {
 	switch format {
 	case FormatAAC:
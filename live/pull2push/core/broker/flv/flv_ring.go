@@ -0,0 +1,372 @@
+package flv
+
+import (
+	"context"
+	"io"
+	"pull2push/core/broker"
+	"pull2push/core/memory"
+	"sync"
+	"time"
+)
+
+/*
+PacketRing 一个 broker 所有观众共享的环形缓冲
+
+	broker 每收到一个 tag 只序列化一次、写一次，观众各自持有一个 RingCursor 按自己的进度读，
+	内存只和缓冲容量有关，不随观众数增长（以前每个观众一个 4096 深的 chan []byte）。
+
+	起播：新游标按 broker.CachePolicy 和观众的起播方式选起点（最近的关键帧 / 更早的若干 GOP / 下一个关键帧），替代原来的 GOP 缓存，
+	     纯音频流没有关键帧，每个音频 tag 都可以作为起点（见 startPoint）
+	慢客户端：游标落后超过一圈（被覆盖）时判定为溢出，跳到最近的关键帧重新开始，
+	         最近的关键帧也已经被覆盖时从最新位置开始并丢弃数据直到下一个关键帧
+	内存：缓冲里的数据记在流的 memory.Account 上，进程预算超出时淘汰最近关键帧之前的数据，
+	     只保留起播需要的一个 GOP，落在淘汰区间里的游标和被覆盖一样处理
+	唤醒：每次写入关闭当前的 notify channel 并换一个新的，等待中的游标全部被唤醒，写入的开销和观众数无关
+*/
+type PacketRing struct {
+	mu      sync.RWMutex
+	slots   []ringSlot
+	next    uint64 // 下一个写入的序号，也是已经写入的包数
+	lastKey uint64 // 最近一个关键帧的序号
+	hasKey  bool
+	video   bool   // 写入过视频 tag，见 startPoint
+	floor   uint64 // 序号小于 floor 的数据已经因为内存预算被淘汰
+	notify  chan struct{}
+	closed  bool
+	policy  broker.CachePolicy
+
+	account *memory.Account
+}
+
+type ringSlot struct {
+	data     []byte
+	keyFrame bool
+	ts       uint32 // tag 的时间戳，按时长起播时使用
+	at       int64  // 写入时间（UnixNano），导出片段时按它选时间段
+}
+
+// ringSlotSize 一个 ringSlot 本身占用的字节数（切片头 + bool + 时间戳对齐 + 写入时间）
+const ringSlotSize = 40
+
+// DefaultRingSize 默认缓冲包数，25fps 视频 + 44.1kHz 音频大约 15 秒，足够放下常见的 GOP
+const DefaultRingSize = 2048
+
+// ringPacketsPerSecond 按 DefaultRingSize 能放 15 秒估算的每秒包数
+const ringPacketsPerSecond = DefaultRingSize / 15
+
+// ringSecondsPerGOP 按 GOP 数缓存时，每个 GOP 按这么多秒预留缓冲
+const ringSecondsPerGOP = 4
+
+// RingSizeFor 按起播缓存策略估算缓冲需要的包数，不小于 DefaultRingSize
+func RingSizeFor(policy broker.CachePolicy) int {
+	seconds := time.Duration(policy.GOPs*ringSecondsPerGOP) * time.Second
+	if policy.Duration > 0 {
+		// 最早的关键帧可能比 Duration 再早一个 GOP
+		seconds = policy.Duration + ringSecondsPerGOP*time.Second
+	}
+	if policy.Retain > 0 {
+		seconds = max(seconds, policy.Retain+ringSecondsPerGOP*time.Second)
+	}
+	return max(DefaultRingSize, int(seconds.Seconds()*ringPacketsPerSecond))
+}
+
+// maxBatch 游标一次最多读出的包数，读得太多会让慢客户端一次写很久
+const maxBatch = 256
+
+// NewPacketRing account 为 nil 时不记账、不受内存预算限制
+func NewPacketRing(size int, account *memory.Account) *PacketRing {
+	if size <= 0 {
+		size = DefaultRingSize
+	}
+	account.Charge(size * ringSlotSize)
+	return &PacketRing{
+		slots:   make([]ringSlot, size),
+		notify:  make(chan struct{}),
+		account: account,
+	}
+}
+
+// Write 写入一个包，data 写入后不能再修改，所有观众共享同一份字节；返回这个包能不能作为起播点（见 startPoint）
+func (r *PacketRing) Write(data []byte, keyFrame bool) bool {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return false
+	}
+	keyFrame = r.startPoint(data, keyFrame)
+	seq := r.next
+	slot := &r.slots[seq%uint64(len(r.slots))]
+	r.account.Free(len(slot.data))
+	*slot = ringSlot{data: data, keyFrame: keyFrame, ts: tagTimestamp(data), at: time.Now().UnixNano()}
+	r.account.Charge(len(data))
+	r.next++
+	if keyFrame {
+		r.lastKey, r.hasKey = seq, true
+	}
+	if r.account.Over() {
+		r.trim()
+	}
+	notify := r.notify
+	r.notify = make(chan struct{})
+	r.mu.Unlock()
+	close(notify)
+	return keyFrame
+}
+
+// startPoint 包能不能作为起播点：视频流只有关键帧可以；还没有出现过视频的流（纯音频）没有关键帧，
+// 每个音频 tag 都可以起播，否则观众会一直等下去。调用方需持有写锁
+func (r *PacketRing) startPoint(data []byte, keyFrame bool) bool {
+	if len(data) < FLVTagHeaderSize {
+		return keyFrame
+	}
+	switch data[0] & 0x1F {
+	case TagTypeVideo:
+		r.video = true
+	case TagTypeAudio:
+		return keyFrame || !r.video
+	}
+	return keyFrame
+}
+
+// SetPolicy 修改起播缓存策略，只影响之后创建的游标；缓冲容量在创建时已经确定（见 RingSizeFor）
+func (r *PacketRing) SetPolicy(policy broker.CachePolicy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.policy = policy
+}
+
+// Policy 当前的起播缓存策略
+func (r *PacketRing) Policy() broker.CachePolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.policy
+}
+
+// tagTimestamp 序列化后的 FLV tag 里的时间戳，不是完整 tag 时返回 0
+func tagTimestamp(data []byte) uint32 {
+	if len(data) < FLVTagHeaderSize {
+		return 0
+	}
+	return uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24
+}
+
+// Close 关闭缓冲，游标读完剩余数据后返回 io.EOF；缓冲的记账在这里全部归还，
+// 账户按 brokerKey 共用，重建的 broker 和还没走的观众还在用同一个账户
+func (r *PacketRing) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	freed := len(r.slots) * ringSlotSize
+	for seq := r.oldest(); seq < r.next; seq++ {
+		freed += len(r.slots[seq%uint64(len(r.slots))].data)
+	}
+	r.account.Free(freed)
+	close(r.notify)
+}
+
+// trim 进程内存预算超出时淘汰最近关键帧之前的数据，调用方需持有写锁
+func (r *PacketRing) trim() {
+	if !r.hasKey {
+		return
+	}
+	size := uint64(len(r.slots))
+	for seq := r.oldest(); seq < r.lastKey; seq++ {
+		slot := &r.slots[seq%size]
+		r.account.Free(len(slot.data))
+		*slot = ringSlot{}
+	}
+	r.floor = max(r.floor, r.lastKey)
+}
+
+// oldest 缓冲里还没被覆盖、淘汰的最旧序号，调用方需持有锁
+func (r *PacketRing) oldest() uint64 {
+	if r.next <= uint64(len(r.slots)) {
+		return r.floor
+	}
+	return max(r.next-uint64(len(r.slots)), r.floor)
+}
+
+// startPosition 新游标 / 溢出游标的起点，调用方需持有锁
+func (r *PacketRing) startPosition() (seq uint64, needKey bool) {
+	if r.hasKey && r.lastKey >= r.oldest() {
+		return r.lastKey, false
+	}
+	return r.next, true
+}
+
+// startFor 按起播方式选新游标的起点，调用方需持有锁
+func (r *PacketRing) startFor(mode broker.START_MODE) (seq uint64, needKey bool) {
+	oldest, size := r.oldest(), uint64(len(r.slots))
+	i := r.policy.StartIndex(mode, int(r.next-oldest), func(i int) broker.CacheEntry {
+		slot := &r.slots[(oldest+uint64(i))%size]
+		return broker.CacheEntry{Size: len(slot.data), KeyFrame: slot.keyFrame, Timestamp: slot.ts}
+	})
+	if i < 0 {
+		return r.next, true
+	}
+	return oldest + uint64(i), false
+}
+
+// Snapshot 按起播方式取出缓冲里的起播数据，没有可以起播的关键帧时返回 nil
+func (r *PacketRing) Snapshot(mode broker.START_MODE) [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seq, needKey := r.startFor(mode)
+	if needKey {
+		return nil
+	}
+	out := make([][]byte, 0, r.next-seq)
+	for ; seq < r.next; seq++ {
+		out = append(out, r.slots[seq%uint64(len(r.slots))].data)
+	}
+	return out
+}
+
+// Range 取出写入时间在 [from, to] 之间的数据，从关键帧开始（见 broker.ClipRange），同时返回第一个和最后一个包的写入时间
+func (r *PacketRing) Range(from, to time.Time) ([][]byte, time.Time, time.Time, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	oldest, size := r.oldest(), uint64(len(r.slots))
+	slot := func(i int) *ringSlot { return &r.slots[(oldest+uint64(i))%size] }
+	start, end, err := broker.ClipRange(from, to, int(r.next-oldest), func(i int) broker.ClipEntry {
+		return broker.ClipEntry{KeyFrame: slot(i).keyFrame, At: time.Unix(0, slot(i).at)}
+	})
+	if err != nil {
+		return nil, time.Time{}, time.Time{}, err
+	}
+	out := make([][]byte, 0, end-start)
+	for i := start; i < end; i++ {
+		out = append(out, slot(i).data)
+	}
+	return out, time.Unix(0, slot(start).at), time.Unix(0, slot(end-1).at), nil
+}
+
+// NewCursor 新游标，header 会在第一次 Next 时最先返回（起播头），之后按策略默认的起播方式开始
+func (r *PacketRing) NewCursor(header []byte) *RingCursor {
+	return r.NewCursorAt(header, broker.StartDefault)
+}
+
+// NewCursorAt 按指定的起播方式创建游标
+func (r *PacketRing) NewCursorAt(header []byte, mode broker.START_MODE) *RingCursor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	seq, needKey := r.startFor(mode)
+	return &RingCursor{ring: r, seq: seq, needKey: needKey, header: header}
+}
+
+// ====================== RingCursor ======================
+
+// RingCursor 一个观众在 PacketRing 里的读取位置，只能在一个 goroutine 里使用
+type RingCursor struct {
+	ring    *PacketRing
+	seq     uint64 // 下一个要读的序号
+	needKey bool   // 丢弃数据直到下一个关键帧
+	header  []byte // 还没发出的起播头
+
+	Resyncs int // 因为太慢被覆盖、跳到关键帧的次数
+}
+
+// PacketReader 按批读取 FLV 数据，FLVStreamBroker 的观众用 RingCursor，其他 broker 用 ChanReader
+type PacketReader interface {
+	// Next 阻塞到至少有一个包可读，把可读的包追加到 dst 后返回；ctx 结束返回 ctx.Err()，数据源关闭返回 io.EOF
+	Next(ctx context.Context, dst [][]byte) ([][]byte, error)
+}
+
+// Next 见 PacketReader
+func (c *RingCursor) Next(ctx context.Context, dst [][]byte) ([][]byte, error) {
+	if c.header != nil {
+		dst = append(dst, c.header)
+		c.header = nil
+	}
+	for {
+		var wait <-chan struct{}
+		dst, wait = c.read(dst)
+		if len(dst) > 0 {
+			return dst, nil
+		}
+		if wait == nil {
+			return dst, io.EOF
+		}
+		select {
+		case <-ctx.Done():
+			return dst, ctx.Err()
+		case <-wait:
+		}
+	}
+}
+
+// read 读出当前可读的包，没有可读的包时返回等待用的 channel，缓冲已关闭时 channel 为 nil
+func (c *RingCursor) read(dst [][]byte) ([][]byte, <-chan struct{}) {
+	r := c.ring
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if c.seq < r.oldest() {
+		// 被覆盖了，中间的数据已经没有了
+		c.seq, c.needKey = r.startPosition()
+		c.Resyncs++
+	}
+	size := uint64(len(r.slots))
+	for n := 0; c.seq < r.next && n < maxBatch; c.seq++ {
+		slot := r.slots[c.seq%size]
+		if c.needKey {
+			if !slot.keyFrame {
+				continue
+			}
+			c.needKey = false
+		}
+		dst = append(dst, slot.data)
+		n++
+	}
+	if len(dst) > 0 {
+		return dst, nil
+	}
+	if r.closed {
+		return dst, nil
+	}
+	return dst, r.notify
+}
+
+// Lag 落后最新数据的包数
+func (c *RingCursor) Lag() uint64 {
+	c.ring.mu.RLock()
+	defer c.ring.mu.RUnlock()
+	if c.seq >= c.ring.next {
+		return 0
+	}
+	return c.ring.next - c.seq
+}
+
+// ====================== ChanReader ======================
+
+// ChanReader 把 Broadcast 通道包装成 PacketReader，给不提供 PacketRing 的 broker（camera 等）使用
+type ChanReader chan []byte
+
+// Next 见 PacketReader，通道关闭时返回 io.EOF
+func (ch ChanReader) Next(ctx context.Context, dst [][]byte) ([][]byte, error) {
+	select {
+	case <-ctx.Done():
+		return dst, ctx.Err()
+	case data, ok := <-ch:
+		if !ok {
+			return dst, io.EOF
+		}
+		dst = append(dst, data)
+	}
+	// 把已经到达的数据一起读出来，合并成一次写
+	for len(dst) < maxBatch {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				return dst, nil
+			}
+			dst = append(dst, data)
+		default:
+			return dst, nil
+		}
+	}
+	return dst, nil
+}
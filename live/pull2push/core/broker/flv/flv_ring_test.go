@@ -0,0 +1,395 @@
+package flv
+
+import (
+	"context"
+	"errors"
+	"io"
+	"pull2push/core/broker"
+	"pull2push/core/memory"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func packet(n byte) []byte {
+	return []byte{n}
+}
+
+func readAll(t *testing.T, c *RingCursor) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var out []byte
+	for {
+		batch, err := c.Next(ctx, nil)
+		for _, p := range batch {
+			out = append(out, p...)
+		}
+		if err != nil {
+			return out
+		}
+	}
+}
+
+func TestPacketRingStartsAtKeyFrame(t *testing.T) {
+	r := NewPacketRing(16, nil)
+	for i := byte(0); i < 10; i++ {
+		r.Write(packet(i), i == 3 || i == 7)
+	}
+	c := r.NewCursor([]byte("H"))
+	if got := string(readAll(t, c)); got != "H\x07\x08\x09" {
+		t.Fatalf("got % x", got)
+	}
+	r.Write(packet(10), false)
+	if got := readAll(t, c); len(got) != 1 || got[0] != 10 {
+		t.Fatalf("got % x", got)
+	}
+}
+
+func TestPacketRingOverrun(t *testing.T) {
+	r := NewPacketRing(8, nil)
+	r.Write(packet(0), true)
+	c := r.NewCursor(nil)
+
+	// 写满一圈多，游标的位置被覆盖，最近的关键帧 12 还在缓冲里
+	for i := byte(1); i < 16; i++ {
+		r.Write(packet(i), i == 12)
+	}
+	if got := string(readAll(t, c)); got != "\x0c\x0d\x0e\x0f" || c.Resyncs != 1 {
+		t.Fatalf("got % x, resyncs %d", got, c.Resyncs)
+	}
+
+	// 最近的关键帧也被覆盖时丢弃数据直到下一个关键帧
+	for i := byte(16); i < 30; i++ {
+		r.Write(packet(i), false)
+	}
+	if got := readAll(t, c); len(got) != 0 || c.Resyncs != 2 {
+		t.Fatalf("got % x, resyncs %d", got, c.Resyncs)
+	}
+	r.Write(packet(30), false)
+	r.Write(packet(31), true)
+	r.Write(packet(32), false)
+	if got := string(readAll(t, c)); got != "\x1f\x20" {
+		t.Fatalf("got % x", got)
+	}
+}
+
+func TestPacketRingClose(t *testing.T) {
+	r := NewPacketRing(8, nil)
+	r.Write(packet(0), true)
+	c := r.NewCursor(nil)
+
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for err == nil {
+			_, err = c.Next(context.Background(), nil)
+		}
+		done <- err
+	}()
+	r.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, io.EOF) {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("cursor not woken by Close")
+	}
+}
+
+func TestPacketRingMemoryBudget(t *testing.T) {
+	budget := memory.NewBudget(0)
+	account := budget.Open("test")
+	r := NewPacketRing(16, account)
+	base := budget.Used()
+
+	for i := byte(0); i < 8; i++ {
+		r.Write(make([]byte, 100), i%4 == 0)
+	}
+	if budget.Used()-base != 800 {
+		t.Fatalf("charged %d", budget.Used()-base)
+	}
+	c := r.NewCursor(nil)
+	caughtUp := r.NewCursor(nil)
+	readAll(t, caughtUp)
+
+	// 预算超出：写入时淘汰最近关键帧（8）之前的数据，只保留当前 GOP
+	budget.SetLimit(base + 800)
+	r.Write(make([]byte, 100), true)
+	if budget.Used()-base != 100 {
+		t.Fatalf("charged %d after trim", budget.Used()-base)
+	}
+	r.Write(packet(9), false)
+	// 还停在被淘汰区间里的游标跳到保留下来的关键帧
+	if got := readAll(t, c); len(got) != 101 || c.Resyncs != 1 {
+		t.Fatalf("got %d bytes, resyncs %d", len(got), c.Resyncs)
+	}
+	// 已经读到最新位置的游标不受淘汰影响
+	if got := readAll(t, caughtUp); len(got) != 101 || caughtUp.Resyncs != 0 {
+		t.Fatalf("caught-up cursor got %d bytes, resyncs %d", len(got), caughtUp.Resyncs)
+	}
+
+	account.Close()
+	if budget.Used() != 0 {
+		t.Fatalf("used %d after close", budget.Used())
+	}
+}
+
+// 重建 broker 时观众还没走，账户一直没有关闭；旧 broker 的缓冲记账要在 Close 时归还，不能累积到新 broker 上
+func TestBrokerReplaceFreesRing(t *testing.T) {
+	const key = "ring-replace"
+	viewer := memory.Default.Open(key)
+	defer viewer.Close()
+
+	blocked := func(ctx context.Context, _ string) (TagSource, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	for range 3 {
+		b := NewFLVStreamBrokerWithDialer(key, "test://", blocked)
+		b.setFLVHeader(BuildFLVHeader(false, true))
+		for i := range 10 {
+			b.writeTag(NewFlvTag(TagTypeVideo, uint32(i*40), []byte{0x17, 1, 0, 0, 0, byte(i)}))
+		}
+		if memory.Default.Usage(key) == 0 {
+			t.Fatal("缓冲没有记账")
+		}
+		b.Close()
+		if used := memory.Default.Usage(key); used != 0 {
+			t.Fatalf("Close 之后还记着 %d 字节", used)
+		}
+	}
+}
+
+// timedTag 带时间戳的 tag，数据的最后一个字节是 n，方便核对从哪里开始
+func timedTag(n byte, ts uint32) []byte {
+	return NewFlvTag(TagTypeVideo, ts, []byte{0x27, 1, 0, 0, 0, n}).ToBytes()
+}
+
+// firstPacket 游标读出的第一个 tag 的编号
+func firstPacket(t *testing.T, c *RingCursor) int {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	batch, _ := c.Next(ctx, nil)
+	if len(batch) == 0 {
+		return -1
+	}
+	return int(batch[0][len(batch[0])-PrevTagSizeLength-1])
+}
+
+func TestPacketRingStartModes(t *testing.T) {
+	// 每秒一个关键帧：0、25、50、75，每帧 40ms、tag 大小 21 字节
+	fill := func(policy broker.CachePolicy) *PacketRing {
+		r := NewPacketRing(RingSizeFor(policy), nil)
+		r.SetPolicy(policy)
+		for i := byte(0); i < 90; i++ {
+			r.Write(timedTag(i, uint32(i)*40), i%25 == 0)
+		}
+		return r
+	}
+	tests := []struct {
+		name   string
+		policy broker.CachePolicy
+		mode   broker.START_MODE
+		want   int
+	}{
+		{"默认最近一个 GOP", broker.CachePolicy{}, broker.StartDefault, 75},
+		{"live 等下一个关键帧", broker.CachePolicy{}, broker.StartLive, -1},
+		{"策略默认 live", broker.CachePolicy{Start: broker.StartLive}, broker.StartDefault, -1},
+		{"观众覆盖策略默认值", broker.CachePolicy{GOPs: 3, Start: broker.StartLive}, broker.StartBuffer, 25},
+		{"3 个 GOP", broker.CachePolicy{GOPs: 3}, broker.StartDefault, 25},
+		{"gop 不受 GOPs 影响", broker.CachePolicy{GOPs: 3}, broker.StartGOP, 75},
+		{"GOP 不够时全部给出", broker.CachePolicy{GOPs: 10}, broker.StartBuffer, 0},
+		{"最近 2.5 秒", broker.CachePolicy{Duration: 2500 * time.Millisecond}, broker.StartDefault, 50},
+		{"字节上限", broker.CachePolicy{GOPs: 3, MaxBytes: 40 * 21}, broker.StartDefault, 50},
+		{"字节上限也保留最近一个 GOP", broker.CachePolicy{GOPs: 3, MaxBytes: 1}, broker.StartDefault, 75},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := fill(tt.policy)
+			c := r.NewCursorAt(nil, tt.mode)
+			if got := firstPacket(t, c); got != tt.want {
+				t.Fatalf("从 %d 开始，期望 %d", got, tt.want)
+			}
+			if tt.want < 0 {
+				// live：下一个关键帧到来时开始
+				r.Write(timedTag(100, 4000), true)
+				if got := firstPacket(t, c); got != 100 {
+					t.Fatalf("live 从 %d 开始，期望 100", got)
+				}
+			}
+		})
+	}
+}
+
+func TestPacketRingAudioOnly(t *testing.T) {
+	// 纯音频流没有关键帧，每个音频 tag 都可以起播
+	audio := func(n byte) []byte { return NewFlvTag(TagTypeAudio, uint32(n)*23, []byte{0xAF, 1, n}).ToBytes() }
+	r := NewPacketRing(16, nil)
+	for i := byte(0); i < 5; i++ {
+		if !r.Write(audio(i), false) {
+			t.Fatalf("音频 tag %d 应该是起播点", i)
+		}
+	}
+	if got := firstPacket(t, r.NewCursor(nil)); got != 4 {
+		t.Fatalf("从 %d 开始，期望 4", got)
+	}
+	live := r.NewCursorAt(nil, broker.StartLive)
+	r.Write(audio(5), false)
+	if got := firstPacket(t, live); got != 5 {
+		t.Fatalf("live 从 %d 开始，期望 5", got)
+	}
+
+	// 出现视频之后只有视频关键帧可以起播
+	r.Write(timedTag(6, 6*23), false)
+	if r.Write(audio(7), false) {
+		t.Fatal("有视频之后音频 tag 不应该是起播点")
+	}
+	c := r.NewCursorAt(nil, broker.StartLive)
+	r.Write(audio(8), false)
+	r.Write(timedTag(9, 9*23), true)
+	if got := firstPacket(t, c); got != 9 {
+		t.Fatalf("从 %d 开始，期望 9", got)
+	}
+}
+
+// ====================== 基准测试 ======================
+
+/*
+每 1000 个观众的内存和 CPU 开销，对比原来每个观众一个 chan []byte（深度 4096）的方式：
+
+	go test ./core/broker/flv -run '^$' -bench Fanout -benchmem
+
+	B/viewer  建好 1000 个观众后每个观众占用的堆内存（环形缓冲本身也算在内）
+	ns/op     广播一个包并且 1000 个观众都读到的耗时
+	drop%     channel 方式写不进去被丢弃的比例
+*/
+
+const benchViewers = 1000
+
+var benchPacket = make([]byte, 1400)
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapInuse
+}
+
+func BenchmarkFanoutChannels1000(b *testing.B) {
+	before := heapInUse()
+	chans := make([]chan []byte, benchViewers)
+	for i := range chans {
+		chans[i] = make(chan []byte, 4096)
+	}
+	perViewer := float64(heapInUse()-before) / benchViewers
+
+	var wg sync.WaitGroup
+	for _, ch := range chans {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range ch {
+			}
+		}()
+	}
+
+	b.ResetTimer() // ResetTimer 会清掉已经上报的指标，内存在计时结束后再上报
+	dropped := 0
+	for i := 0; i < b.N; i++ {
+		for _, ch := range chans {
+			select {
+			case ch <- benchPacket:
+			default:
+				dropped++
+			}
+		}
+	}
+	for _, ch := range chans {
+		close(ch)
+	}
+	wg.Wait()
+	b.StopTimer()
+	b.ReportMetric(perViewer, "B/viewer")
+	b.ReportMetric(float64(dropped)*100/float64(b.N*benchViewers), "drop%")
+}
+
+func BenchmarkFanoutRing1000(b *testing.B) {
+	before := heapInUse()
+	ring := NewPacketRing(DefaultRingSize, nil)
+	cursors := make([]*RingCursor, benchViewers)
+	for i := range cursors {
+		cursors[i] = ring.NewCursor(nil)
+	}
+	perViewer := float64(heapInUse()-before) / benchViewers
+
+	var wg sync.WaitGroup
+	for _, c := range cursors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var batch [][]byte
+			var err error
+			for err == nil {
+				batch, err = c.Next(context.Background(), batch[:0])
+			}
+		}()
+	}
+
+	b.ResetTimer() // ResetTimer 会清掉已经上报的指标，内存在计时结束后再上报
+	for i := 0; i < b.N; i++ {
+		ring.Write(benchPacket, i%64 == 0)
+	}
+	ring.Close()
+	wg.Wait()
+	b.StopTimer()
+
+	resyncs := 0
+	for _, c := range cursors {
+		resyncs += c.Resyncs
+	}
+	b.ReportMetric(perViewer, "B/viewer")
+	b.ReportMetric(float64(resyncs)/benchViewers, "resyncs/viewer")
+}
+
+func TestPacketRingRange(t *testing.T) {
+	// 每秒一个关键帧：0、25、50、75，每帧 40ms，写入时间和时间戳一致
+	r := NewPacketRing(DefaultRingSize, nil)
+	base := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ms int) time.Time { return base.Add(time.Duration(ms) * time.Millisecond) }
+	for i := byte(0); i < 90; i++ {
+		r.Write(timedTag(i, uint32(i)*40), i%25 == 0)
+		r.slots[i].at = at(int(i) * 40).UnixNano()
+	}
+	number := func(data []byte) int { return int(data[len(data)-PrevTagSizeLength-1]) }
+	tests := []struct {
+		name        string
+		from, to    int // 毫秒
+		first, last int
+	}{
+		{"从开始时间之前的关键帧开始", 1500, 2500, 25, 62},
+		{"开始时间正好是关键帧", 2000, 2200, 50, 55},
+		{"开始时间早于缓存", -5000, 500, 0, 12},
+		{"结束时间晚于缓存", 3100, 9000, 75, 89},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, start, end, err := r.Range(at(tt.from), at(tt.to))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if number(data[0]) != tt.first || number(data[len(data)-1]) != tt.last {
+				t.Fatalf("导出 %d ~ %d，期望 %d ~ %d", number(data[0]), number(data[len(data)-1]), tt.first, tt.last)
+			}
+			if !start.Equal(at(tt.first*40)) || !end.Equal(at(tt.last*40)) {
+				t.Fatalf("时间 %v ~ %v", start, end)
+			}
+		})
+	}
+	if _, _, _, err := r.Range(at(-5000), at(-1000)); !errors.Is(err, broker.ErrClipRange) {
+		t.Errorf("缓存之前的时间段返回 %v", err)
+	}
+}
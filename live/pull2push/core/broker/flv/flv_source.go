@@ -0,0 +1,118 @@
+package flv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// TagSource 上游数据源，不管上游是什么协议，最终都转换成 FLV tag 交给 FLVStreamBroker 分发
+type TagSource interface {
+
+	// Header 返回 FLV 头（含 PreviousTagSize0，共 13 字节）
+	Header() []byte
+
+	// ReadTag 读取下一个 tag，上游结束或出错时返回 error
+	ReadTag() (*FlvTag, error)
+
+	// Close 关闭上游连接
+	Close() error
+}
+
+// SourceDialer 根据上游地址建立一个数据源
+type SourceDialer func(ctx context.Context, upstreamURL string) (TagSource, error)
+
+var (
+	dialerMutex   sync.RWMutex
+	sourceDialers = map[string]SourceDialer{
+		"http":  DialHTTPFLV,
+		"https": DialHTTPFLV,
+	}
+)
+
+// RegisterSourceDialer 注册一种上游协议（按 URL scheme 选择）
+func RegisterSourceDialer(scheme string, dialer SourceDialer) {
+	dialerMutex.Lock()
+	defer dialerMutex.Unlock()
+	sourceDialers[scheme] = dialer
+}
+
+// DialSource 根据 URL scheme 选择数据源（见 RegisterSourceDialer）
+func DialSource(ctx context.Context, upstreamURL string) (TagSource, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	dialerMutex.RLock()
+	dialer, ok := sourceDialers[u.Scheme]
+	dialerMutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("不支持的上游协议 %s", u.Scheme)
+	}
+	return dialer(ctx, upstreamURL)
+}
+
+// ====================== HTTP-FLV ======================
+
+// httpFLVSource HTTP-FLV 上游，也用来读内存里的 FLV 文件
+type httpFLVSource struct {
+	body   io.ReadCloser
+	header []byte
+}
+
+// DialHTTPFLV 以 GET 的方式拉取 HTTP-FLV 上游
+func DialHTTPFLV(ctx context.Context, upstreamURL string) (TagSource, error) {
+	return DialHTTPFLVWithHeader(ctx, upstreamURL, nil)
+}
+
+// DialHTTPFLVWithHeader 同 DialHTTPFLV，请求带上额外的 header，例如集群节点之间拉流的鉴权
+func DialHTTPFLVWithHeader(ctx context.Context, upstreamURL string, extra http.Header) (TagSource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// add headers typical for FLV
+	req.Header.Set("User-Agent", "Go-Relay-Flv/1.0")
+	req.Header.Set("Accept", "*/*")
+	for k, v := range extra {
+		req.Header[k] = v
+	}
+	client := &http.Client{
+		Timeout: 0, // streaming
+		Transport: &http.Transport{
+			// keep-alive
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream bad status: %s", resp.Status)
+	}
+	header, err := ReadFLVHeader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return &httpFLVSource{body: resp.Body, header: header}, nil
+}
+
+func (s *httpFLVSource) Header() []byte {
+	return s.header
+}
+
+func (s *httpFLVSource) ReadTag() (*FlvTag, error) {
+	return ReadFlvTag(s.body)
+}
+
+func (s *httpFLVSource) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,801 @@
+package flv
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+H.264 / H.265 SPS 与 AAC AudioSpecificConfig 解析
+
+	只解析出展示需要的字段：profile/level、裁剪后的分辨率、色度格式、位深、VUI 里的帧率。
+	SPS 在 NALU 里带有防竞争字节（00 00 03），解析前先去掉。
+*/
+
+var errSPSTruncated = errors.New("SPS 数据不完整")
+
+// bitReader 按位读取，支持指数哥伦布编码
+type bitReader struct {
+	data []byte
+	pos  int // 位偏移
+}
+
+func (r *bitReader) u(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, errSPSTruncated
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&0x01)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) flag() (bool, error) {
+	v, err := r.u(1)
+	return v == 1, err
+}
+
+func (r *bitReader) skip(n int) error {
+	if r.pos+n > len(r.data)*8 {
+		return errSPSTruncated
+	}
+	r.pos += n
+	return nil
+}
+
+// ue 无符号指数哥伦布
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.u(1)
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("指数哥伦布编码溢出")
+		}
+	}
+	v, err := r.u(zeros)
+	return (1<<zeros - 1) + v, err
+}
+
+// se 有符号指数哥伦布
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if v%2 == 1 {
+		return int32((v + 1) / 2), err
+	}
+	return -int32(v / 2), err
+}
+
+// SPSInfo SPS 解析结果
+type SPSInfo struct {
+	Profile      string  // 例如 High、Main 10
+	ProfileIdc   uint8   // profile_idc
+	Level        string  // 例如 4.1
+	LevelIdc     uint8   // level_idc
+	Width        int     // 裁剪后的宽
+	Height       int     // 裁剪后的高
+	ChromaFormat string  // 4:2:0 等
+	BitDepth     int     // 亮度位深
+	FrameRate    float64 // VUI timing_info 里的帧率，没有时为 0
+}
+
+var chromaFormatNames = []string{"4:0:0", "4:2:0", "4:2:2", "4:4:4"}
+
+// chromaSubsampling 返回 SubWidthC、SubHeightC
+func chromaSubsampling(chromaFormatIdc uint32) (int, int) {
+	switch chromaFormatIdc {
+	case 1:
+		return 2, 2
+	case 2:
+		return 2, 1
+	}
+	return 1, 1
+}
+
+// ====================== H.264 ======================
+
+func h264ProfileName(profileIdc uint8, constraintFlags uint8) string {
+	switch profileIdc {
+	case 66:
+		if constraintFlags&0x40 != 0 {
+			return "Constrained Baseline"
+		}
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
+	}
+	return fmt.Sprintf("Profile %d", profileIdc)
+}
+
+// ParseH264SPS 解析 H.264 SPS（含 1 字节 NALU 头）
+func ParseH264SPS(nalu []byte) (*SPSInfo, error) {
+	if len(nalu) < 4 || nalu[0]&0x1F != H264NALSPS {
+		return nil, errors.New("不是 H.264 SPS")
+	}
+	data := RemoveEmulationPrevention(nalu[1:])
+	if len(data) < 3 { // 去掉防竞争字节后可能不够 profile_idc + constraint_flags + level_idc
+		return nil, errSPSTruncated
+	}
+	info := &SPSInfo{
+		ProfileIdc: data[0],
+		LevelIdc:   data[2],
+		Profile:    h264ProfileName(data[0], data[1]),
+		BitDepth:   8,
+	}
+	info.Level = fmt.Sprintf("%g", float64(info.LevelIdc)/10)
+	if info.LevelIdc == 9 {
+		info.Level = "1b"
+	}
+	r := &bitReader{data: data, pos: 24}
+
+	if _, err := r.ue(); err != nil { // seq_parameter_set_id
+		return nil, err
+	}
+	chromaFormatIdc := uint32(1)
+	switch info.ProfileIdc {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		var err error
+		if chromaFormatIdc, err = r.ue(); err != nil {
+			return nil, err
+		}
+		if chromaFormatIdc == 3 {
+			if err := r.skip(1); err != nil { // separate_colour_plane_flag
+				return nil, err
+			}
+		}
+		bitDepthLuma, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		info.BitDepth = int(bitDepthLuma) + 8
+		if _, err := r.ue(); err != nil { // bit_depth_chroma_minus8
+			return nil, err
+		}
+		if err := r.skip(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return nil, err
+		}
+		scalingMatrixPresent, err := r.flag()
+		if err != nil {
+			return nil, err
+		}
+		if scalingMatrixPresent {
+			count := 8
+			if chromaFormatIdc == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				present, err := r.flag()
+				if err != nil {
+					return nil, err
+				}
+				if !present {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				if err := skipH264ScalingList(r, size); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if int(chromaFormatIdc) < len(chromaFormatNames) {
+		info.ChromaFormat = chromaFormatNames[chromaFormatIdc]
+	}
+
+	if _, err := r.ue(); err != nil { // log2_max_frame_num_minus4
+		return nil, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	switch pocType {
+	case 0:
+		if _, err := r.ue(); err != nil { // log2_max_pic_order_cnt_lsb_minus4
+			return nil, err
+		}
+	case 1:
+		if err := r.skip(1); err != nil { // delta_pic_order_always_zero_flag
+			return nil, err
+		}
+		if _, err := r.se(); err != nil { // offset_for_non_ref_pic
+			return nil, err
+		}
+		if _, err := r.se(); err != nil { // offset_for_top_to_bottom_field
+			return nil, err
+		}
+		n, err := r.ue()
+		if err != nil {
+			return nil, err
+		}
+		for i := uint32(0); i < n; i++ {
+			if _, err := r.se(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // max_num_ref_frames
+		return nil, err
+	}
+	if err := r.skip(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return nil, err
+	}
+	widthMbs, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	heightMapUnits, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	frameMbsOnly, err := r.u(1)
+	if err != nil {
+		return nil, err
+	}
+	if frameMbsOnly == 0 {
+		if err := r.skip(1); err != nil { // mb_adaptive_frame_field_flag
+			return nil, err
+		}
+	}
+	if err := r.skip(1); err != nil { // direct_8x8_inference_flag
+		return nil, err
+	}
+
+	info.Width = int(widthMbs+1) * 16
+	info.Height = int(2-frameMbsOnly) * int(heightMapUnits+1) * 16
+	cropping, err := r.flag()
+	if err != nil {
+		return nil, err
+	}
+	if cropping {
+		var crop [4]uint32 // left right top bottom
+		for i := range crop {
+			if crop[i], err = r.ue(); err != nil {
+				return nil, err
+			}
+		}
+		cropUnitX, cropUnitY := 1, int(2-frameMbsOnly)
+		if chromaFormatIdc != 0 {
+			subW, subH := chromaSubsampling(chromaFormatIdc)
+			cropUnitX, cropUnitY = subW, subH*int(2-frameMbsOnly)
+		}
+		info.Width -= cropUnitX * int(crop[0]+crop[1])
+		info.Height -= cropUnitY * int(crop[2]+crop[3])
+	}
+
+	vuiPresent, err := r.flag()
+	if err != nil || !vuiPresent {
+		return info, nil
+	}
+	// VUI 解析失败不影响前面的结果
+	if numUnits, timeScale, ok := parseVUITiming(r, false); ok && numUnits > 0 {
+		info.FrameRate = float64(timeScale) / float64(2*numUnits)
+	}
+	return info, nil
+}
+
+func skipH264ScalingList(r *bitReader, size int) error {
+	last, next := int32(8), int32(8)
+	for j := 0; j < size; j++ {
+		if next != 0 {
+			delta, err := r.se()
+			if err != nil {
+				return err
+			}
+			next = (last + delta + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+	return nil
+}
+
+// parseVUITiming 解析 VUI 开头到 timing_info 为止的部分，返回 num_units_in_tick 和 time_scale
+// H.264 与 H.265 的 VUI 在 timing_info 之前只差 neutral_chroma / field_seq / frame_field_info / default_display_window
+func parseVUITiming(r *bitReader, hevc bool) (uint32, uint32, bool) {
+	aspectRatioPresent, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if aspectRatioPresent {
+		idc, err := r.u(8)
+		if err != nil {
+			return 0, 0, false
+		}
+		if idc == 255 && r.skip(32) != nil { // sar_width + sar_height
+			return 0, 0, false
+		}
+	}
+	if overscan, err := r.flag(); err != nil || (overscan && r.skip(1) != nil) {
+		return 0, 0, false
+	}
+	videoSignal, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if videoSignal {
+		if r.skip(4) != nil { // video_format + video_full_range_flag
+			return 0, 0, false
+		}
+		colourDesc, err := r.flag()
+		if err != nil || (colourDesc && r.skip(24) != nil) {
+			return 0, 0, false
+		}
+	}
+	chromaLoc, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if chromaLoc {
+		if _, err := r.ue(); err != nil {
+			return 0, 0, false
+		}
+		if _, err := r.ue(); err != nil {
+			return 0, 0, false
+		}
+	}
+	if hevc {
+		if r.skip(3) != nil { // neutral_chroma_indication + field_seq + frame_field_info_present
+			return 0, 0, false
+		}
+		defaultDisplayWindow, err := r.flag()
+		if err != nil {
+			return 0, 0, false
+		}
+		if defaultDisplayWindow {
+			for i := 0; i < 4; i++ {
+				if _, err := r.ue(); err != nil {
+					return 0, 0, false
+				}
+			}
+		}
+	}
+	timingPresent, err := r.flag()
+	if err != nil || !timingPresent {
+		return 0, 0, false
+	}
+	numUnits, err := r.u(32)
+	if err != nil {
+		return 0, 0, false
+	}
+	timeScale, err := r.u(32)
+	if err != nil {
+		return 0, 0, false
+	}
+	return numUnits, timeScale, true
+}
+
+// ====================== H.265 ======================
+
+func h265ProfileName(profileIdc uint8) string {
+	switch profileIdc {
+	case 1:
+		return "Main"
+	case 2:
+		return "Main 10"
+	case 3:
+		return "Main Still Picture"
+	case 4:
+		return "Format Range Extensions"
+	}
+	return fmt.Sprintf("Profile %d", profileIdc)
+}
+
+// ParseH265SPS 解析 H.265 SPS（含 2 字节 NALU 头）
+func ParseH265SPS(nalu []byte) (*SPSInfo, error) {
+	if len(nalu) < 3 || H265NALType(nalu) != H265NALSPS {
+		return nil, errors.New("不是 H.265 SPS")
+	}
+	r := &bitReader{data: RemoveEmulationPrevention(nalu[2:])}
+
+	if err := r.skip(4); err != nil { // sps_video_parameter_set_id
+		return nil, err
+	}
+	maxSubLayersMinus1, err := r.u(3)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(1); err != nil { // sps_temporal_id_nesting_flag
+		return nil, err
+	}
+
+	// profile_tier_level
+	if err := r.skip(3); err != nil { // general_profile_space + general_tier_flag
+		return nil, err
+	}
+	profileIdc, err := r.u(5)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.skip(32 + 48); err != nil { // compatibility flags + constraint flags
+		return nil, err
+	}
+	levelIdc, err := r.u(8)
+	if err != nil {
+		return nil, err
+	}
+	info := &SPSInfo{
+		ProfileIdc: uint8(profileIdc),
+		Profile:    h265ProfileName(uint8(profileIdc)),
+		LevelIdc:   uint8(levelIdc),
+		Level:      fmt.Sprintf("%g", float64(levelIdc)/30),
+	}
+	subLayerProfile := make([]bool, maxSubLayersMinus1)
+	subLayerLevel := make([]bool, maxSubLayersMinus1)
+	for i := range subLayerProfile {
+		if subLayerProfile[i], err = r.flag(); err != nil {
+			return nil, err
+		}
+		if subLayerLevel[i], err = r.flag(); err != nil {
+			return nil, err
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		if err := r.skip(2 * int(8-maxSubLayersMinus1)); err != nil {
+			return nil, err
+		}
+	}
+	for i := range subLayerProfile {
+		if subLayerProfile[i] && r.skip(88) != nil {
+			return nil, errSPSTruncated
+		}
+		if subLayerLevel[i] && r.skip(8) != nil {
+			return nil, errSPSTruncated
+		}
+	}
+
+	if _, err := r.ue(); err != nil { // sps_seq_parameter_set_id
+		return nil, err
+	}
+	chromaFormatIdc, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	if chromaFormatIdc == 3 {
+		if err := r.skip(1); err != nil {
+			return nil, err
+		}
+	}
+	if int(chromaFormatIdc) < len(chromaFormatNames) {
+		info.ChromaFormat = chromaFormatNames[chromaFormatIdc]
+	}
+	width, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	height, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	info.Width, info.Height = int(width), int(height)
+	conformanceWindow, err := r.flag()
+	if err != nil {
+		return nil, err
+	}
+	if conformanceWindow {
+		var win [4]uint32
+		for i := range win {
+			if win[i], err = r.ue(); err != nil {
+				return nil, err
+			}
+		}
+		subW, subH := chromaSubsampling(chromaFormatIdc)
+		info.Width -= subW * int(win[0]+win[1])
+		info.Height -= subH * int(win[2]+win[3])
+	}
+	bitDepthLuma, err := r.ue()
+	if err != nil {
+		return nil, err
+	}
+	info.BitDepth = int(bitDepthLuma) + 8
+	if _, err := r.ue(); err != nil { // bit_depth_chroma_minus8
+		return nil, err
+	}
+
+	// 以下字段只为了走到 VUI，失败时返回已经拿到的分辨率
+	if numUnits, timeScale, ok := skipToH265VUITiming(r, maxSubLayersMinus1); ok && numUnits > 0 {
+		info.FrameRate = float64(timeScale) / float64(numUnits)
+	}
+	return info, nil
+}
+
+// skipToH265VUITiming 跳过 SPS 中 VUI 之前的字段并解析 timing_info
+func skipToH265VUITiming(r *bitReader, maxSubLayersMinus1 uint32) (uint32, uint32, bool) {
+	log2MaxPocLsbMinus4, err := r.ue()
+	if err != nil {
+		return 0, 0, false
+	}
+	orderingInfoPresent, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	start := maxSubLayersMinus1
+	if orderingInfoPresent {
+		start = 0
+	}
+	for i := start; i <= maxSubLayersMinus1; i++ {
+		for j := 0; j < 3; j++ {
+			if _, err := r.ue(); err != nil {
+				return 0, 0, false
+			}
+		}
+	}
+	for i := 0; i < 6; i++ { // coding block / transform block 大小和层级
+		if _, err := r.ue(); err != nil {
+			return 0, 0, false
+		}
+	}
+	scalingListEnabled, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if scalingListEnabled {
+		present, err := r.flag()
+		if err != nil || (present && skipH265ScalingListData(r) != nil) {
+			return 0, 0, false
+		}
+	}
+	if r.skip(2) != nil { // amp_enabled_flag + sample_adaptive_offset_enabled_flag
+		return 0, 0, false
+	}
+	pcmEnabled, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if pcmEnabled {
+		if r.skip(8) != nil {
+			return 0, 0, false
+		}
+		if _, err := r.ue(); err != nil {
+			return 0, 0, false
+		}
+		if _, err := r.ue(); err != nil {
+			return 0, 0, false
+		}
+		if r.skip(1) != nil {
+			return 0, 0, false
+		}
+	}
+	numShortTermRefPicSets, err := r.ue()
+	if err != nil || numShortTermRefPicSets > 64 {
+		return 0, 0, false
+	}
+	numDeltaPocs := make([]uint32, numShortTermRefPicSets)
+	for i := uint32(0); i < numShortTermRefPicSets; i++ {
+		if numDeltaPocs[i], err = skipH265ShortTermRefPicSet(r, i, numShortTermRefPicSets, numDeltaPocs); err != nil {
+			return 0, 0, false
+		}
+	}
+	longTermPresent, err := r.flag()
+	if err != nil {
+		return 0, 0, false
+	}
+	if longTermPresent {
+		n, err := r.ue()
+		if err != nil {
+			return 0, 0, false
+		}
+		for i := uint32(0); i < n; i++ {
+			if r.skip(int(log2MaxPocLsbMinus4)+4+1) != nil {
+				return 0, 0, false
+			}
+		}
+	}
+	if r.skip(2) != nil { // sps_temporal_mvp_enabled_flag + strong_intra_smoothing_enabled_flag
+		return 0, 0, false
+	}
+	vuiPresent, err := r.flag()
+	if err != nil || !vuiPresent {
+		return 0, 0, false
+	}
+	return parseVUITiming(r, true)
+}
+
+func skipH265ScalingListData(r *bitReader) error {
+	for sizeId := 0; sizeId < 4; sizeId++ {
+		step := 1
+		if sizeId == 3 {
+			step = 3
+		}
+		for matrixId := 0; matrixId < 6; matrixId += step {
+			predMode, err := r.flag()
+			if err != nil {
+				return err
+			}
+			if !predMode {
+				if _, err := r.ue(); err != nil {
+					return err
+				}
+				continue
+			}
+			coefNum := min(64, 1<<(4+(sizeId<<1)))
+			if sizeId > 1 {
+				if _, err := r.se(); err != nil {
+					return err
+				}
+			}
+			for i := 0; i < coefNum; i++ {
+				if _, err := r.se(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// skipH265ShortTermRefPicSet 跳过 st_ref_pic_set(idx)，返回它的 NumDeltaPocs
+func skipH265ShortTermRefPicSet(r *bitReader, idx, num uint32, numDeltaPocs []uint32) (uint32, error) {
+	interPrediction := false
+	if idx != 0 {
+		var err error
+		if interPrediction, err = r.flag(); err != nil {
+			return 0, err
+		}
+	}
+	if interPrediction {
+		deltaIdxMinus1 := uint32(0)
+		if idx == num {
+			var err error
+			if deltaIdxMinus1, err = r.ue(); err != nil {
+				return 0, err
+			}
+		}
+		if deltaIdxMinus1+1 > idx {
+			return 0, errors.New("st_ref_pic_set 引用越界")
+		}
+		if err := r.skip(1); err != nil { // delta_rps_sign
+			return 0, err
+		}
+		if _, err := r.ue(); err != nil { // abs_delta_rps_minus1
+			return 0, err
+		}
+		refDeltaPocs := numDeltaPocs[idx-(deltaIdxMinus1+1)]
+		count := uint32(0)
+		for j := uint32(0); j <= refDeltaPocs; j++ {
+			used, err := r.flag()
+			if err != nil {
+				return 0, err
+			}
+			useDelta := true
+			if !used {
+				if useDelta, err = r.flag(); err != nil {
+					return 0, err
+				}
+			}
+			if used || useDelta {
+				count++
+			}
+		}
+		return count, nil
+	}
+
+	numNegative, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	numPositive, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if numNegative+numPositive > 32 {
+		return 0, errors.New("st_ref_pic_set 数量异常")
+	}
+	for i := uint32(0); i < numNegative+numPositive; i++ {
+		if _, err := r.ue(); err != nil { // delta_poc_minus1
+			return 0, err
+		}
+		if err := r.skip(1); err != nil { // used_by_curr_pic_flag
+			return 0, err
+		}
+	}
+	return numNegative + numPositive, nil
+}
+
+// ====================== AAC ======================
+
+// AACInfo AudioSpecificConfig 解析结果
+type AACInfo struct {
+	ObjectType int    // audioObjectType
+	Profile    string // 例如 LC、HE-AAC
+	SampleRate int    // 输出采样率（HE-AAC 为 SBR 之后的采样率）
+	Channels   int
+}
+
+func aacProfileName(objectType int) string {
+	switch objectType {
+	case 1:
+		return "Main"
+	case 2:
+		return "LC"
+	case 3:
+		return "SSR"
+	case 4:
+		return "LTP"
+	case 5:
+		return "HE-AAC"
+	case 29:
+		return "HE-AACv2"
+	}
+	return fmt.Sprintf("AOT %d", objectType)
+}
+
+// ParseAudioSpecificConfig 解析 AAC AudioSpecificConfig
+func ParseAudioSpecificConfig(asc []byte) (*AACInfo, error) {
+	r := &bitReader{data: asc}
+	objectType, err := readAudioObjectType(r)
+	if err != nil {
+		return nil, err
+	}
+	sampleRate, err := readSamplingFrequency(r)
+	if err != nil {
+		return nil, err
+	}
+	channelConfig, err := r.u(4)
+	if err != nil {
+		return nil, err
+	}
+	info := &AACInfo{ObjectType: objectType, Profile: aacProfileName(objectType), SampleRate: sampleRate, Channels: int(channelConfig)}
+	if channelConfig == 7 {
+		info.Channels = 8
+	}
+	// 显式 SBR/PS：后面是扩展采样率
+	if objectType == 5 || objectType == 29 {
+		if extRate, err := readSamplingFrequency(r); err == nil {
+			info.SampleRate = extRate
+		}
+		if objectType == 29 && info.Channels == 1 {
+			info.Channels = 2 // PS 把单声道还原成立体声
+		}
+	}
+	return info, nil
+}
+
+func readAudioObjectType(r *bitReader) (int, error) {
+	v, err := r.u(5)
+	if err != nil {
+		return 0, err
+	}
+	if v == 31 {
+		ext, err := r.u(6)
+		return 32 + int(ext), err
+	}
+	return int(v), nil
+}
+
+func readSamplingFrequency(r *bitReader) (int, error) {
+	idx, err := r.u(4)
+	if err != nil {
+		return 0, err
+	}
+	if idx == 15 {
+		rate, err := r.u(24)
+		return int(rate), err
+	}
+	if int(idx) >= len(AACSampleRates) {
+		return 0, fmt.Errorf("无效的采样率索引 %d", idx)
+	}
+	return AACSampleRates[idx], nil
+}
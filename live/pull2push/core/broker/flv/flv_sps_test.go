@@ -0,0 +1,120 @@
+package flv
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// 1920x1088 编码、裁掉下面 8 行，VUI 里 time_scale 50 / num_units_in_tick 1，带防竞争字节
+const h264SPS1080p25 = "67 64 00 28 ac d9 40 78 02 27 e5 c0 44 00 00 03 00 04 00 00 03 00 ca 10"
+
+// Main level 4.1，1920x1088 + conformance window 裁成 1080，两个短期参考帧集（第二个用帧间预测），VUI 带色彩描述和 25fps timing
+const h265SPSMain41 = "42 01 01 01 60 00 00 03 00 90 00 00 03 00 00 03 00 7b a0 03 c0 80 11 07 cb 96 57 92 44 99 af f7 80 b5 01 01 01 04 00 00 03 00 04 00 00 03 00 64 20"
+
+func TestParseH264SPS(t *testing.T) {
+	info, err := ParseH264SPS(unhex(t, h264SPS1080p25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SPSInfo{Profile: "High", ProfileIdc: 100, Level: "4", LevelIdc: 40, Width: 1920, Height: 1080,
+		ChromaFormat: "4:2:0", BitDepth: 8, FrameRate: 25}
+	if *info != want {
+		t.Fatalf("得到 %+v\n期望 %+v", *info, want)
+	}
+}
+
+func TestParseH265SPS(t *testing.T) {
+	info, err := ParseH265SPS(unhex(t, h265SPSMain41))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SPSInfo{Profile: "Main", ProfileIdc: 1, Level: "4.1", LevelIdc: 123, Width: 1920, Height: 1080,
+		ChromaFormat: "4:2:0", BitDepth: 8, FrameRate: 25}
+	if *info != want {
+		t.Fatalf("得到 %+v\n期望 %+v", *info, want)
+	}
+}
+
+// 截断的 SPS 不能 panic；分辨率之前截断必须返回错误，VUI 里截断时返回已经解析出的结果
+func TestParseSPSTruncated(t *testing.T) {
+	tests := []struct {
+		name  string
+		sps   string
+		parse func([]byte) (*SPSInfo, error)
+		need  int // 至少这么多字节才能解析出分辨率
+	}{
+		{"h264", h264SPS1080p25, ParseH264SPS, 11},
+		{"h265", h265SPSMain41, ParseH265SPS, 23},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			full := unhex(t, tt.sps)
+			for n := 0; n < len(full); n++ {
+				info, err := tt.parse(full[:n])
+				if n < tt.need && err == nil {
+					t.Errorf("%d 字节应该返回错误，得到 %+v", n, *info)
+				}
+				if err == nil && (info.Width != 1920 || info.Height != 1080) {
+					t.Errorf("%d 字节: %dx%d", n, info.Width, info.Height)
+				}
+			}
+		})
+	}
+	// 去掉防竞争字节后不够 3 字节
+	if _, err := ParseH264SPS([]byte{0x67, 0, 0, 3}); err == nil {
+		t.Error("应该返回错误")
+	}
+}
+
+func TestParseAudioSpecificConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		asc  string
+		want AACInfo
+	}{
+		{"LC 44.1kHz 立体声", "12 10", AACInfo{2, "LC", 44100, 2}},
+		{"LC 48kHz 单声道", "11 88", AACInfo{2, "LC", 48000, 1}},
+		{"LC 7.1 声道", "11 b8", AACInfo{2, "LC", 48000, 8}},
+		{"LC 显式采样率", "17 80 56 22 10", AACInfo{2, "LC", 44100, 2}},
+		{"HE-AAC 24kHz 扩展到 48kHz", "2b 11 88", AACInfo{5, "HE-AAC", 48000, 2}},
+		{"HE-AAC 显式采样率", "2f 80 2b 11 17 80 56 22 08", AACInfo{5, "HE-AAC", 44100, 2}},
+		{"HE-AACv2 单声道还原成立体声", "eb 09 88", AACInfo{29, "HE-AACv2", 48000, 2}},
+		{"扩展 audioObjectType", "f9 48 40", AACInfo{42, "AOT 42", 44100, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := ParseAudioSpecificConfig(unhex(t, tt.asc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *info != tt.want {
+				t.Fatalf("得到 %+v\n期望 %+v", *info, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAudioSpecificConfigInvalid(t *testing.T) {
+	for _, asc := range []string{
+		"",
+		"12",          // 缺声道数
+		"16 90",       // 采样率索引 13 无效
+		"17 80 56",    // 显式采样率不完整
+		"f9",          // 扩展 audioObjectType 不完整
+		"2f 80 2b 11", // HE-AAC 缺声道数
+	} {
+		if info, err := ParseAudioSpecificConfig(unhex(t, asc)); err == nil {
+			t.Errorf("%q 应该返回错误，得到 %+v", asc, *info)
+		}
+	}
+}
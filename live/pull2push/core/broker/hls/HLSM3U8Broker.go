@@ -12,7 +12,11 @@ import (
 	"net/url"
 	"path"
 	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	tsBroker "pull2push/core/broker/ts"
 	"pull2push/core/client"
+	"pull2push/core/memory"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -40,15 +44,20 @@ import (
 // HLSM3U8Broker 每个 直播地址 用一个 Broker 管理，里面管理了多个当前直播链接的客户端
 type HLSM3U8Broker struct {
 	// 直播数据相关
-	BrokerKey    string       // 直播房间的唯一编号
-	upstreamURL  string       // 直播房间的上游拉流地址
-	Variant      string       // 可选：固定选择带宽 id/分辨率（留空自动选最优）
-	StreamState0 *StreamState // m3u8数据分片处理器
+	BrokerKey    string                // 直播房间的唯一编号
+	upstreamURL  string                // 直播房间的上游拉流地址
+	Variant      string                // 可选：固定选择带宽 id/分辨率（留空自动选最优）
+	StreamState0 *StreamState          // m3u8数据分片处理器
+	tsConverter  *tsBroker.Converter   // 分片 TS -> FLV tag，只用于统计媒体信息
+	stats        *flvBroker.MediaStats // 编码参数和码率/帧率/GOP 统计
+	health       *flvBroker.HealthAnalyzer
+	account      *memory.Account // 分片缓存的内存记账
 
 	// 状态控制相关
 	BrokerCloseSig chan struct{} // 控制当前这个直播是否被关闭
 	once           sync.Once
 	ctx            context.Context
+	cancel         context.CancelFunc
 
 	// 客户端相关
 	clientMutex    sync.Mutex                   // 客户端的异步操作控制器
@@ -61,19 +70,25 @@ func NewHLSM3U8Broker(ctx context.Context, brokerKey, upstreamURL, variant strin
 	if buffer == 0 {
 		buffer = 3
 	}
+	account := memory.Default.Open(brokerKey)
 	hmb := HLSM3U8Broker{
 		BrokerKey:      brokerKey,
 		upstreamURL:    upstreamURL,
 		Variant:        variant,
-		StreamState0:   NewStreamState(buffer),
+		StreamState0:   NewStreamState(buffer, account),
+		account:        account,
+		tsConverter:    tsBroker.NewConverter(),
+		stats:          flvBroker.NewMediaStats(),
+		health:         flvBroker.NewHealthAnalyzer(brokerKey, hlsHealthConfig()),
 		clientMap:      make(map[string]client.LiveClient),
-		ctx:            ctx,
 		BrokerCloseSig: make(chan struct{}),
 		ClientCloseSig: make(chan string),
 	}
 
+	hmb.ctx, hmb.cancel = context.WithCancel(ctx)
+
 	// 开始持续拉流
-	go hmb.PullLoop(broker.BrokerOptional{})
+	go hmb.PullLoop(hmb.ctx)
 
 	// 开启必要的状态监听
 	go hmb.ListenStatus()
@@ -140,41 +155,58 @@ func localSegName(absURI string, seq uint64) string {
 }
 
 // fetchOnce 拉取并解析一个 m3u8 文本
-func (hmb *HLSM3U8Broker) fetchOnce(ctx context.Context, client *http.Client, u string) (m m3u8.Playlist, body []byte, err error) {
+// 带上一次响应的 ETag/Last-Modified 做条件请求，上游返回 304 时 notModified 为 true
+func (hmb *HLSM3U8Broker) fetchOnce(ctx context.Context, client *http.Client, u string, validator *playlistValidator) (m m3u8.Playlist, notModified bool, err error) {
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	req.Header.Set("User-Agent", "hls-relay/1.0")
+	if validator != nil {
+		if validator.etag != "" {
+			req.Header.Set("If-None-Match", validator.etag)
+		}
+		if validator.lastModified != "" {
+			req.Header.Set("If-Modified-Since", validator.lastModified)
+		}
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && validator != nil {
+		return nil, true, nil
+	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("bad status %d", resp.StatusCode)
+		return nil, false, fmt.Errorf("bad status %d", resp.StatusCode)
 	}
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, err
 	}
-	p, listType, err := m3u8.Decode(*bytes.NewBuffer(b), true)
+	p, _, err := m3u8.Decode(*bytes.NewBuffer(b), true)
 	if err != nil {
-		return nil, nil, err
+		return nil, false, err
 	}
-	_ = listType
-	return p, b, nil
+	if validator != nil {
+		validator.etag = resp.Header.Get("ETag")
+		validator.lastModified = resp.Header.Get("Last-Modified")
+	}
+	return p, false, nil
 }
 
-// PullWorker 持续从上游拉取分片并写入 stream state
-
-// PullLoop 持续去直播原地址拉流/数据
-func (hmb *HLSM3U8Broker) PullLoop(bo broker.BrokerOptional) {
+// PullLoop 持续去直播原地址拉流/数据，ctx 结束时返回 ctx 的错误，上游播放列表结束时返回 nil
+func (hmb *HLSM3U8Broker) PullLoop(ctx context.Context) error {
 	/*
 		这是一个后台 goroutine，用来持续从某个 HLS 上游地址拉取数据。
-		它先请求 Master Playlist，如果是多码率流，选择合适变体变成 Media Playlist。
-		定时轮询 Media Playlist（默认 800ms），发现新分片后下载。
-		下载到分片后，调用 stream.PushSegment() 把它放入对应的 StreamState 环形缓存。
+		它先请求 Master Playlist，如果是多码率流，选择合适变体变成 Media Playlist；上游还没准备好时按退避重试，不会直接退出。
+		按 HLS 规范（RFC 8216 6.3.4）的刷新规则轮询 Media Playlist：
+			播放列表有变化时，距离上次开始加载至少等待一个 target duration 再刷新；
+			播放列表没有变化（304 或内容相同）时，等待半个 target duration 再刷新；
+			出现 EXT-X-ENDLIST 后停止轮询。
+		发现新分片后交给 prefetchSegments 并发下载，下载完成后按序号顺序调用 stream.PushSegment()。
 
 		核心点：
-			通过 seen 维护已下载分片，避免重复下载。
+			通过 ETag/If-Modified-Since 做条件请求，减少上游播放列表流量。
+			seen 只保留当前直播窗口里的分片，避免长时间运行时内存持续增长。
 			计算本地序列号 Seq，保证分片顺序。
 			下载的分片保持原样字节，不做解码重封装，性能好且稳定。
 	*/
@@ -183,110 +215,115 @@ func (hmb *HLSM3U8Broker) PullLoop(bo broker.BrokerOptional) {
 	client := &http.Client{Timeout: 10 * time.Second}
 
 	stream := hmb.StreamState0
-	seen := map[string]bool{}
-	var mediaURL string
+	// seen 记录已经处理过的分片 map[absURI]seq，每次刷新后裁剪到当前直播窗口
+	seen := map[string]uint64{}
 
-	// 初次处理 master/ media
-	p, _, err := hmb.fetchOnce(hmb.ctx, client, hmb.upstreamURL)
-	if err != nil {
-		log.Printf("[pull:%s] fetch master/media failed: %v", hmb.BrokerKey, err)
-		return
-	}
-	if mp, ok := p.(*m3u8.MasterPlaylist); ok {
-		v, err := pickVariant(mp, hmb.Variant)
-		if err != nil {
-			log.Printf("[pull:%s] no variant: %v", hmb.BrokerKey, err)
-			return
+	// 初次处理 master/ media，失败时等待时间按次数翻倍
+	var mediaURL string
+	for fails := 0; ; fails++ {
+		loadStart := time.Now()
+		var err error
+		if mediaURL, err = hmb.resolveMediaURL(ctx, client); err == nil {
+			break
 		}
-		mediaURL, err = resolveURL(hmb.upstreamURL, v.URI)
-		if err != nil {
-			log.Printf("[pull:%s] resolve media url: %v", hmb.BrokerKey, err)
-			return
+		log.Printf("[pull:%s] %v", hmb.BrokerKey, err)
+		select {
+		case <-ctx.Done():
+			log.Printf("[pull:%s] stop", hmb.BrokerKey)
+			return ctx.Err()
+		case <-time.After(reloadDelay(loadStart, startRetryDelay<<min(fails, 5), true)):
 		}
-		log.Printf("[pull:%s] choose variant bw=%d res=%s uri=%s", hmb.BrokerKey, v.Bandwidth, v.Resolution, mediaURL)
-	} else if _, ok := p.(*m3u8.MediaPlaylist); ok {
-		mediaURL = hmb.upstreamURL
-	} else {
-		log.Printf("[pull:%s] unknown playlist type", hmb.BrokerKey)
-		return
 	}
 
-	ticker := time.NewTicker(800 * time.Millisecond)
-	defer ticker.Stop()
+	validator := &playlistValidator{}
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
 	var lastSeq uint64
+	var lastFingerprint string
+	targetDur := time.Duration(stream.TargetDur * float64(time.Second))
 	for {
 		select {
-		case <-hmb.ctx.Done():
+		case <-ctx.Done():
 			log.Printf("[pull:%s] stop", hmb.BrokerKey)
-			return
-		case <-ticker.C:
-			p, _, err := hmb.fetchOnce(hmb.ctx, client, mediaURL)
-			if err != nil {
-				log.Printf("[pull:%s] fetch media: %v", hmb.BrokerKey, err)
-				continue
-			}
-			mp, ok := p.(*m3u8.MediaPlaylist)
-			if !ok {
-				log.Printf("[pull:%s] not media playlist", hmb.BrokerKey)
-				continue
-			}
+			return ctx.Err()
+		case <-timer.C:
+		}
 
-			// 更新 target duration
-			if mp.TargetDuration > 0 {
-				stream.Mu.Lock()
-				stream.TargetDur = float64(mp.TargetDuration)
-				stream.Mu.Unlock()
-			}
+		loadStart := time.Now()
+		p, notModified, err := hmb.fetchOnce(ctx, client, mediaURL, validator)
+		if err != nil {
+			log.Printf("[pull:%s] fetch media: %v", hmb.BrokerKey, err)
+			timer.Reset(reloadDelay(loadStart, targetDur, false))
+			continue
+		}
+		if notModified {
+			timer.Reset(reloadDelay(loadStart, targetDur, false))
+			continue
+		}
+		mp, ok := p.(*m3u8.MediaPlaylist)
+		if !ok {
+			log.Printf("[pull:%s] not media playlist", hmb.BrokerKey)
+			timer.Reset(reloadDelay(loadStart, targetDur, false))
+			continue
+		}
 
-			// 遍历新片段
-			for _, seg := range mp.Segments {
-				if seg == nil {
-					continue
-				}
-				absURI, err := resolveURL(mediaURL, seg.URI)
-				if err != nil {
-					continue
-				}
-				if seen[absURI] {
-					continue
-				}
-
-				// 估算 seq：用节目序列号 + 相对偏移（若提供）
-				var seq uint64
-				if mp.SeqNo != 0 {
-					seq = uint64(mp.SeqNo) + uint64(seg.SeqId)
-				} else {
-					// 回退：自增
-					lastSeq++
-					seq = lastSeq
-				}
-
-				data, err := hmb.download(hmb.ctx, client, absURI)
-				if err != nil {
-					log.Printf("[pull:%s] seg dl: %v", hmb.BrokerKey, err)
-					continue
-				}
-
-				localName := localSegName(absURI, seq)
-				fmt.Println("分片创建完成：.filename = ", localName)
-				stream.PushSegment(&Segment{
-					Seq:       seq,
-					URI:       absURI,
-					LocalName: localName,
-					Data:      data,
-					Dur:       seg.Duration,
-					Discont:   seg.Discontinuity,
-					AddedAt:   time.Now(),
-				})
-
-				seen[absURI] = true
-				lastSeq = seq
-			}
+		// 更新 target duration
+		if mp.TargetDuration > 0 {
+			stream.Mu.Lock()
+			stream.TargetDur = float64(mp.TargetDuration)
+			stream.Mu.Unlock()
+			targetDur = time.Duration(mp.TargetDuration * float64(time.Second))
+		}
+
+		// 找出新片段，seen 裁剪到当前直播窗口
+		pending := collectNewSegments(mediaURL, mp, seen, &lastSeq)
+
+		// 并发预取，按顺序入环形缓冲
+		for _, seg := range hmb.prefetchSegments(ctx, client, pending) {
+			stream.PushSegment(seg)
+			hmb.observeSegment(seg)
+			// 转推等需要连续字节流的客户端直接拿分片数据
+			hmb.Broadcast2LiveClient(seg.Data)
+		}
+
+		if mp.Closed {
+			log.Printf("[pull:%s] upstream playlist ended", hmb.BrokerKey)
+			return nil
+		}
+
+		fingerprint := playlistFingerprint(mp)
+		changed := fingerprint != lastFingerprint
+		lastFingerprint = fingerprint
+		timer.Reset(reloadDelay(loadStart, targetDur, changed))
+	}
+}
+
+// resolveMediaURL 请求上游地址，是 Master Playlist 时按 Variant 选出变体的 Media Playlist 地址
+func (hmb *HLSM3U8Broker) resolveMediaURL(ctx context.Context, client *http.Client) (string, error) {
+	p, _, err := hmb.fetchOnce(ctx, client, hmb.upstreamURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("fetch master/media failed: %w", err)
+	}
+	switch p := p.(type) {
+	case *m3u8.MasterPlaylist:
+		v, err := pickVariant(p, hmb.Variant)
+		if err != nil {
+			return "", fmt.Errorf("no variant: %w", err)
+		}
+		mediaURL, err := resolveURL(hmb.upstreamURL, v.URI)
+		if err != nil {
+			return "", fmt.Errorf("resolve media url: %w", err)
 		}
+		log.Printf("[pull:%s] choose variant bw=%d res=%s uri=%s", hmb.BrokerKey, v.Bandwidth, v.Resolution, mediaURL)
+		return mediaURL, nil
+	case *m3u8.MediaPlaylist:
+		return hmb.upstreamURL, nil
 	}
+	return "", errors.New("unknown playlist type")
 }
 
+// download 下载一个分片
 func (hmb *HLSM3U8Broker) download(ctx context.Context, client *http.Client, u string) ([]byte, error) {
 	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	req.Header.Set("User-Agent", "hls-relay/1.0")
@@ -298,7 +335,42 @@ func (hmb *HLSM3U8Broker) download(ctx context.Context, client *http.Client, u s
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("bad status %d for %s", resp.StatusCode, u)
 	}
-	return io.ReadAll(resp.Body)
+	// 分片一般有几百 KB 到几 MB，先读进池子里的缓冲，避免扩容产生的垃圾
+	return memory.ReadAll(resp.Body)
+}
+
+// observeSegment 解析分片里的音视频用于媒体信息统计，fMP4 分片找不到 PMT 时不产生任何 tag
+func (hmb *HLSM3U8Broker) observeSegment(seg *Segment) {
+	if seg.Discont {
+		// 时间戳和编码参数都可能变化，从头开始解析
+		hmb.tsConverter = tsBroker.NewConverter()
+		hmb.health.Reset()
+	}
+	tags, err := hmb.tsConverter.Feed(seg.Data)
+	if err != nil {
+		return
+	}
+	for _, tag := range tags {
+		hmb.stats.Observe(tag)
+		hmb.health.Observe(tag)
+	}
+}
+
+// hlsHealthConfig HLS 按分片到达，数据本来就是一阵一阵的，断流阈值放宽到几个分片的时长
+func hlsHealthConfig() flvBroker.HealthConfig {
+	cfg := flvBroker.DefaultHealthConfig()
+	cfg.StallTimeout = 30 * time.Second
+	return cfg
+}
+
+// HealthReport 当前的健康状态和最近的异常事件
+func (hmb *HLSM3U8Broker) HealthReport() *broker.HealthReport {
+	return hmb.health.Report()
+}
+
+// MediaInfo 当前流的编码参数和码率/帧率/GOP 统计
+func (hmb *HLSM3U8Broker) MediaInfo() *broker.MediaInfo {
+	return hmb.stats.Snapshot()
 }
 
 // AddLiveClient 添加客户端
@@ -327,6 +399,9 @@ func (hmb *HLSM3U8Broker) RemoveLiveClient(clientId string) {
 
 // FindLiveClient 查询 LiveClient
 func (hmb *HLSM3U8Broker) FindLiveClient(clientId string) (client.LiveClient, error) {
+	hmb.clientMutex.Lock()
+	defer hmb.clientMutex.Unlock()
+
 	if val, ok := hmb.clientMap[clientId]; ok {
 		return val, nil
 	}
@@ -334,6 +409,28 @@ func (hmb *HLSM3U8Broker) FindLiveClient(clientId string) (client.LiveClient, er
 
 }
 
+// ListLiveClients 当前所有客户端编号
+func (hmb *HLSM3U8Broker) ListLiveClients() []string {
+	hmb.clientMutex.Lock()
+	defer hmb.clientMutex.Unlock()
+
+	ids := make([]string, 0, len(hmb.clientMap))
+	for clientId := range hmb.clientMap {
+		ids = append(ids, clientId)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close 停止拉流，broker 从广播器移除后调用
+func (hmb *HLSM3U8Broker) Close() error {
+	hmb.once.Do(func() {
+		hmb.cancel()
+		hmb.account.Close()
+	})
+	return nil
+}
+
 // UpdateSourceURL 支持切换直播原地址
 func (hmb *HLSM3U8Broker) UpdateSourceURL(newSourceURL string) {
 
@@ -341,8 +438,15 @@ func (hmb *HLSM3U8Broker) UpdateSourceURL(newSourceURL string) {
 
 // ListenStatus 监听当前直播的必要状态
 func (hmb *HLSM3U8Broker) ListenStatus() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 	for {
 		select {
+		case <-hmb.ctx.Done():
+			return
+		case now := <-ticker.C:
+			// 定时检查是否断流
+			hmb.health.Check(now)
 		case clientId := <-hmb.ClientCloseSig:
 			// 监听客户端离开消息
 			hmb.RemoveLiveClient(clientId)
@@ -356,6 +460,16 @@ func (hmb *HLSM3U8Broker) ListenStatus() {
 }
 
 // Broadcast2LiveClient 原地址拉取到数据之后广播给客户端
+// HLS 观众通过播放列表自己取分片，这里的数据主要给转推这类需要连续 TS 字节流的客户端
 func (hmb *HLSM3U8Broker) Broadcast2LiveClient(data []byte) {
+	hmb.clientMutex.Lock()
+	clients := make([]client.LiveClient, 0, len(hmb.clientMap))
+	for _, c := range hmb.clientMap {
+		clients = append(clients, c)
+	}
+	hmb.clientMutex.Unlock()
 
+	for _, c := range clients {
+		c.Broadcast(data)
+	}
 }
@@ -0,0 +1,163 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	prefetchWorkers    = 4                      // 同时下载的分片数上限
+	segmentRetry       = 3                      // 单个分片最多尝试次数
+	segmentRetryDelay  = 300 * time.Millisecond // 分片重试的基础等待时间，按尝试次数递增
+	minReloadInterval  = 200 * time.Millisecond // 播放列表刷新的最小间隔，防止 target duration 异常时打爆上游
+	maxReloadInterval  = 10 * time.Second       // 播放列表刷新的最大间隔
+	defaultTargetDurMs = 6000                   // 上游未给出 target duration 时的默认值
+	startRetryDelay    = 500 * time.Millisecond // 第一次获取播放列表失败后的重试等待，按失败次数翻倍，最多到 maxReloadInterval
+)
+
+// playlistValidator 保存上一次播放列表响应的校验信息，用于条件请求
+type playlistValidator struct {
+	etag         string // 上一次响应的 ETag
+	lastModified string // 上一次响应的 Last-Modified
+}
+
+// reloadDelay 按 HLS 规范计算下一次刷新播放列表的等待时间
+// 播放列表有变化：从本次开始加载算起等待一个 target duration
+// 播放列表无变化或出错：等待半个 target duration
+func reloadDelay(loadStart time.Time, targetDur time.Duration, changed bool) time.Duration {
+	if targetDur <= 0 {
+		targetDur = defaultTargetDurMs * time.Millisecond
+	}
+	wait := targetDur
+	if !changed {
+		wait = targetDur / 2
+	}
+	wait -= time.Since(loadStart)
+	if wait < minReloadInterval {
+		wait = minReloadInterval
+	}
+	if wait > maxReloadInterval {
+		wait = maxReloadInterval
+	}
+	return wait
+}
+
+// playlistFingerprint 用媒体序列号和最后一个分片地址判断播放列表是否发生变化
+func playlistFingerprint(mp *m3u8.MediaPlaylist) string {
+	last := ""
+	for i := len(mp.Segments) - 1; i >= 0; i-- {
+		if mp.Segments[i] != nil {
+			last = mp.Segments[i].URI
+			break
+		}
+	}
+	return fmt.Sprintf("%d|%s", mp.SeqNo, last)
+}
+
+// collectNewSegments 找出播放列表里还没处理过的分片并分配本地序号，seen 记录处理过的分片 map[absURI]seq，
+// 处理完裁剪到当前直播窗口，避免长时间运行时内存持续增长
+func collectNewSegments(mediaURL string, mp *m3u8.MediaPlaylist, seen map[string]uint64, lastSeq *uint64) []*Segment {
+	window := make(map[string]bool, len(mp.Segments))
+	var pending []*Segment
+	for i, seg := range mp.Segments {
+		if seg == nil {
+			continue
+		}
+		absURI, err := resolveURL(mediaURL, seg.URI)
+		if err != nil {
+			continue
+		}
+		window[absURI] = true
+		if _, ok := seen[absURI]; ok {
+			continue
+		}
+
+		// seq：节目序列号 + 窗口内偏移
+		seq := mp.SeqNo + uint64(i)
+		if seq <= *lastSeq && *lastSeq != 0 {
+			// 上游序列号回退（重启/切流），沿用本地自增序号保证单调
+			seq = *lastSeq + 1
+		}
+		*lastSeq = seq
+		seen[absURI] = seq
+
+		pending = append(pending, &Segment{
+			Seq:       seq,
+			URI:       absURI,
+			LocalName: localSegName(absURI, seq),
+			Dur:       seg.Duration,
+			Discont:   seg.Discontinuity,
+		})
+	}
+
+	for uri := range seen {
+		if !window[uri] {
+			delete(seen, uri)
+		}
+	}
+	return pending
+}
+
+// prefetchSegments 并发下载一批新分片，每个分片独立重试
+// 返回下载成功的分片，顺序与传入顺序一致；重试后仍失败的分片会被丢弃
+func (hmb *HLSM3U8Broker) prefetchSegments(ctx context.Context, client *http.Client, pending []*Segment) []*Segment {
+	if len(pending) == 0 {
+		return nil
+	}
+
+	sem := make(chan struct{}, prefetchWorkers)
+	ok := make([]bool, len(pending))
+	var wg sync.WaitGroup
+	for i, seg := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, seg *Segment) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			data, err := hmb.downloadWithRetry(ctx, client, seg.URI)
+			if err != nil {
+				log.Printf("[pull:%s] seg dl: %v", hmb.BrokerKey, err)
+				return
+			}
+			seg.Data = data
+			seg.AddedAt = time.Now()
+			ok[i] = true
+		}(i, seg)
+	}
+	wg.Wait()
+
+	done := make([]*Segment, 0, len(pending))
+	for i, seg := range pending {
+		if ok[i] {
+			done = append(done, seg)
+		}
+	}
+	return done
+}
+
+// downloadWithRetry 下载分片，失败时按递增间隔重试
+func (hmb *HLSM3U8Broker) downloadWithRetry(ctx context.Context, client *http.Client, u string) ([]byte, error) {
+	var lastErr error
+	for attempt := 1; attempt <= segmentRetry; attempt++ {
+		data, err := hmb.download(ctx, client, u)
+		if err == nil {
+			return data, nil
+		}
+		lastErr = err
+		if attempt == segmentRetry {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(segmentRetryDelay * time.Duration(attempt)):
+		}
+	}
+	return nil, fmt.Errorf("download %s failed after %d attempts: %w", u, segmentRetry, lastErr)
+}
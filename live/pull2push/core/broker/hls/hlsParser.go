@@ -2,6 +2,7 @@ package hls
 
 import (
 	"container/ring"
+	"pull2push/core/memory"
 	"sync"
 	"time"
 )
@@ -19,6 +20,7 @@ type Segment struct {
 
 // StreamState 每一路拉流任务维护一个 StreamState，存放它的分片缓存和元数据。
 // 用 ring.Ring 实现固定容量的循环队列，保持缓存窗口。
+// 分片数据记在流的 memory.Account 上，进程内存预算超出时只保留最新的 minSegments 个分片。
 type StreamState struct {
 	Mu        sync.RWMutex
 	Segments  *ring.Ring // 环形缓冲，存放最近 N 个分片，元素为 *Segment 或 nil
@@ -28,16 +30,22 @@ type StreamState struct {
 	LastSeq   uint64     // 最新分片序列号（递增）
 	LastMod   time.Time  // 最后更新时间
 	Discont   bool       // 是否有断点续播
+
+	account *memory.Account
 }
 
-// NewStreamState 创建每一个直播的拉流缓冲区对象
-func NewStreamState(cap int) *StreamState {
+// minSegments 内存预算超出时至少保留的分片数，再少播放器就会频繁卡顿
+const minSegments = 2
+
+// NewStreamState 创建每一个直播的拉流缓冲区对象，account 为 nil 时不记账
+func NewStreamState(cap int, account *memory.Account) *StreamState {
 	return &StreamState{
 		Segments:  ring.New(cap),
 		Cap:       cap,
 		TargetDur: 6,
 		SeqStart:  0,
 		LastSeq:   0,
+		account:   account,
 	}
 }
 
@@ -54,7 +62,14 @@ func (s *StreamState) PushSegment(seg *Segment) {
 
 	// 移动指针到下一格并覆盖
 	s.Segments = s.Segments.Next()
+	if old, ok := s.Segments.Value.(*Segment); ok && old != nil {
+		s.account.Free(len(old.Data))
+	}
 	s.Segments.Value = seg
+	s.account.Charge(len(seg.Data))
+	if s.account.Over() {
+		s.trim()
+	}
 
 	if s.SeqStart == 0 {
 		// 第一次写入
@@ -71,13 +86,31 @@ func (s *StreamState) PushSegment(seg *Segment) {
 	}
 }
 
+// trim 从最旧的分片开始淘汰，只保留最新的 minSegments 个，调用方需持有写锁
+func (s *StreamState) trim() {
+	count := 0
+	s.Segments.Do(func(v any) {
+		if seg, ok := v.(*Segment); ok && seg != nil {
+			count++
+		}
+	})
+	// Segments 指向最新的分片，它的下一格是最旧的
+	for r := s.Segments.Next(); count > minSegments && r != s.Segments; r = r.Next() {
+		if seg, ok := r.Value.(*Segment); ok && seg != nil {
+			s.account.Free(len(seg.Data))
+			r.Value = nil
+			count--
+		}
+	}
+}
+
 // Snapshot 返回按序的窗口分片拷贝（只读）
 func (s *StreamState) Snapshot() (segs []*Segment, seqStart uint64, targetDur float64, discont bool) {
 	s.Mu.RLock()
 	defer s.Mu.RUnlock()
 	segs = make([]*Segment, 0, s.Cap)
-	// 从环形缓冲按时间顺序读出
-	tmp := s.Segments
+	// 从环形缓冲按时间顺序读出，Segments 指向最新的分片，它的下一格才是最旧的
+	tmp := s.Segments.Next()
 	tmp.Do(func(v any) {
 		if v == nil {
 			return
@@ -88,5 +121,10 @@ func (s *StreamState) Snapshot() (segs []*Segment, seqStart uint64, targetDur fl
 			segs = append(segs, seg)
 		}
 	})
-	return segs, s.SeqStart, s.TargetDur, s.Discont
+	seqStart = s.SeqStart
+	if len(segs) > 0 {
+		// 缓冲还没写满时窗口起点就是最旧的分片
+		seqStart = segs[0].Seq
+	}
+	return segs, seqStart, s.TargetDur, s.Discont
 }
@@ -0,0 +1,162 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"github.com/grafov/m3u8"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamStateSnapshot(t *testing.T) {
+	s := NewStreamState(3, nil)
+	push := func(seq uint64, data ...byte) {
+		s.PushSegment(&Segment{Seq: seq, Data: data, Dur: 2})
+	}
+	check := func(name string, wantStart uint64, want ...uint64) {
+		t.Helper()
+		segs, seqStart, _, _ := s.Snapshot()
+		var got []uint64
+		for _, seg := range segs {
+			got = append(got, seg.Seq)
+		}
+		if !slices.Equal(got, want) || seqStart != wantStart {
+			t.Errorf("%s: 分片 %v 起始序号 %d，期望 %v %d", name, got, seqStart, want, wantStart)
+		}
+	}
+
+	check("空缓冲", 0)
+	push(10, 1)
+	push(11, 1)
+	check("还没写满", 10, 10, 11)
+	push(12, 1)
+	check("刚好写满", 10, 10, 11, 12)
+	push(13, 1)
+	push(14, 1)
+	check("覆盖之后从最旧的开始", 12, 12, 13, 14)
+	push(15)
+	check("没有数据的分片不列出", 13, 13, 14)
+}
+
+func TestReloadDelay(t *testing.T) {
+	tests := []struct {
+		name      string
+		elapsed   time.Duration // 本次加载已经花掉的时间
+		targetDur time.Duration
+		changed   bool
+		want      time.Duration
+	}{
+		{"有变化等一个 target duration", 0, 4 * time.Second, true, 4 * time.Second},
+		{"没变化等半个 target duration", 0, 4 * time.Second, false, 2 * time.Second},
+		{"从开始加载算起", time.Second, 4 * time.Second, true, 3 * time.Second},
+		{"没有 target duration 用默认值", 0, 0, true, defaultTargetDurMs * time.Millisecond},
+		{"没有 target duration 没变化", 0, 0, false, defaultTargetDurMs * time.Millisecond / 2},
+		{"不小于最小间隔", 5 * time.Second, 4 * time.Second, true, minReloadInterval},
+		{"不超过最大间隔", 0, 30 * time.Second, true, maxReloadInterval},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := reloadDelay(time.Now().Add(-tt.elapsed), tt.targetDur, tt.changed)
+			if got > tt.want || got < tt.want-50*time.Millisecond {
+				t.Fatalf("reloadDelay = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// mediaPlaylist 媒体序列号为 seqNo 的直播播放列表
+func mediaPlaylist(t *testing.T, seqNo uint64, uris ...string) *m3u8.MediaPlaylist {
+	t.Helper()
+	mp, err := m3u8.NewMediaPlaylist(uint(len(uris)), uint(len(uris)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uri := range uris {
+		if err := mp.Append(uri, 2, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mp.SeqNo = seqNo
+	return mp
+}
+
+func TestCollectNewSegments(t *testing.T) {
+	const mediaURL = "http://h/live/index.m3u8"
+	seen := map[string]uint64{}
+	var lastSeq uint64
+	steps := []struct {
+		name    string
+		mp      *m3u8.MediaPlaylist
+		want    []string // 新分片的本地文件名
+		window  []string // 之后 seen 里的分片
+		lastSeq uint64
+	}{
+		{"第一次加载", mediaPlaylist(t, 100, "a.ts", "b.ts", "c.ts"),
+			[]string{"100.ts", "101.ts", "102.ts"}, []string{"a", "b", "c"}, 102},
+		{"没有变化", mediaPlaylist(t, 100, "a.ts", "b.ts", "c.ts"),
+			nil, []string{"a", "b", "c"}, 102},
+		{"窗口滑动，移出窗口的分片从 seen 删掉", mediaPlaylist(t, 101, "b.ts", "c.ts", "d.ts"),
+			[]string{"103.ts"}, []string{"b", "c", "d"}, 103},
+		{"上游重启序列号回退，本地序号继续递增", mediaPlaylist(t, 0, "x.ts", "y.ts"),
+			[]string{"104.ts", "105.ts"}, []string{"x", "y"}, 105},
+		{"绝对地址", mediaPlaylist(t, 2, "y.ts", "http://cdn/z.ts"),
+			[]string{"106.ts"}, []string{"y", "http://cdn/z.ts"}, 106},
+	}
+	for _, step := range steps {
+		var got []string
+		for _, seg := range collectNewSegments(mediaURL, step.mp, seen, &lastSeq) {
+			got = append(got, seg.LocalName)
+		}
+		var want []string
+		for _, uri := range step.window {
+			if !strings.HasPrefix(uri, "http") {
+				uri = "http://h/live/" + uri + ".ts"
+			}
+			want = append(want, uri)
+		}
+		slices.Sort(want)
+		if !slices.Equal(got, step.want) || !slices.Equal(slices.Sorted(maps.Keys(seen)), want) || lastSeq != step.lastSeq {
+			t.Errorf("%s: 新分片 %v，seen %v，lastSeq %d", step.name, got, slices.Sorted(maps.Keys(seen)), lastSeq)
+		}
+	}
+}
+
+// 上游第一次请求失败（还没开始推流、重启中）时拉流循环不能退出，恢复之后要拉到分片
+func TestPullLoopRetriesStart(t *testing.T) {
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/live.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:0\n#EXTINF:2.0,\nseg0.ts\n")
+	})
+	mux.HandleFunc("/seg0.ts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(make([]byte, 188))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	b := NewHLSM3U8Broker(context.Background(), "hls-retry", server.URL+"/live.m3u8", "", 3)
+	defer b.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if segs, _, _, _ := b.StreamState0.Snapshot(); len(segs) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("上游恢复后没有拉到分片，请求了 %d 次", requests.Load())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := requests.Load(); n < 2 {
+		t.Fatalf("播放列表只请求了 %d 次", n)
+	}
+}
@@ -0,0 +1,14 @@
+package ts
+
+import (
+	flvBroker "pull2push/core/broker/flv"
+)
+
+// ====================== TSStreamBroker ======================
+
+// NewTSStreamBroker TS 上游（udp://[@]ip:port 单播/组播、http(s):// HTTP-TS）的 Broker
+// TS 在入口处就解复用成 FLV tag，因此直接复用 FLVStreamBroker 的起播缓存和分发，
+// /live/flv、/live/ts、转推等所有输出都可以使用这个 Broker
+func NewTSStreamBroker(brokerKey, upstreamURL string) *flvBroker.FLVStreamBroker {
+	return flvBroker.NewFLVStreamBrokerWithDialer(brokerKey, upstreamURL, DialTS)
+}
@@ -0,0 +1,268 @@
+package ts
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+MPEG-TS 解复用
+
+	188 字节一个 TS 包，PID 0 是 PAT，PAT 里给出 PMT 的 PID，PMT 里给出每路音视频的 PID 和 stream_type。
+	音视频数据以 PES 的形式分散在多个 TS 包里，payload_unit_start_indicator 表示一个新 PES 的开始。
+	这里只处理单节目流（广播编码器 / ffmpeg 输出的常见情况），PSI 表默认一个包就能装下。
+*/
+
+const (
+	PacketSize = 188
+	SyncByte   = 0x47
+
+	PIDPAT = 0x0000
+
+	// stream_type
+	StreamTypeAAC  = 0x0F
+	StreamTypeH264 = 0x1B
+	StreamTypeH265 = 0x24
+)
+
+// pesFrame 一个完整的 PES 负载，时间戳为 90kHz
+type pesFrame struct {
+	StreamType uint8
+	PTS        uint64
+	DTS        uint64
+	Data       []byte
+}
+
+// pesStream 一路 PES 的重组状态
+type pesStream struct {
+	streamType uint8
+	buf        []byte
+	pts, dts   uint64
+	pesLength  int // PES_packet_length 不为 0 时，收满即可提前输出
+	started    bool
+}
+
+// tsDemuxer 增量 TS 解复用器，数据可以按任意字节边界喂进来
+type tsDemuxer struct {
+	buf     []byte
+	pmtPID  int // -1 表示还没有解析到 PAT
+	streams map[uint16]*pesStream
+
+	PMTParsed bool // 是否已经拿到 PMT
+	HasVideo  bool
+	HasAudio  bool
+
+	frames []*pesFrame // 本次 Feed 产生的帧
+}
+
+func newTSDemuxer() *tsDemuxer {
+	return &tsDemuxer{pmtPID: -1, streams: make(map[uint16]*pesStream)}
+}
+
+// Feed 追加数据，返回本次解析出的完整 PES 帧
+func (d *tsDemuxer) Feed(data []byte) ([]*pesFrame, error) {
+	d.frames = d.frames[:0]
+	d.buf = append(d.buf, data...)
+
+	pos := 0
+	for len(d.buf)-pos >= PacketSize {
+		if d.buf[pos] != SyncByte {
+			// 失去同步，逐字节寻找下一个同步字节
+			pos++
+			continue
+		}
+		if err := d.parsePacket(d.buf[pos : pos+PacketSize]); err != nil {
+			return nil, err
+		}
+		pos += PacketSize
+	}
+	d.buf = append(d.buf[:0], d.buf[pos:]...)
+
+	frames := make([]*pesFrame, len(d.frames))
+	copy(frames, d.frames)
+	return frames, nil
+}
+
+func (d *tsDemuxer) parsePacket(pkt []byte) error {
+	pusi := pkt[1]&0x40 != 0
+	pid := uint16(pkt[1]&0x1F)<<8 | uint16(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+
+	payload := pkt[4:]
+	if afc&0x02 != 0 {
+		afLen := int(payload[0])
+		if afLen+1 > len(payload) {
+			return nil
+		}
+		payload = payload[1+afLen:]
+	}
+	if afc&0x01 == 0 || len(payload) == 0 {
+		return nil
+	}
+
+	switch {
+	case pid == PIDPAT:
+		d.parsePAT(payload, pusi)
+	case int(pid) == d.pmtPID:
+		d.parsePMT(payload, pusi)
+	default:
+		if st, ok := d.streams[pid]; ok {
+			d.parsePES(st, payload, pusi)
+		}
+	}
+	return nil
+}
+
+// psiSection 跳过 pointer_field，返回 section 内容（不含 CRC）
+func psiSection(payload []byte, pusi bool) []byte {
+	if !pusi {
+		return nil
+	}
+	pointer := int(payload[0])
+	if 1+pointer >= len(payload) {
+		return nil
+	}
+	section := payload[1+pointer:]
+	if len(section) < 3 {
+		return nil
+	}
+	sectionLen := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+sectionLen > len(section) || sectionLen < 9 {
+		return nil
+	}
+	return section[:3+sectionLen-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte, pusi bool) {
+	section := psiSection(payload, pusi)
+	if section == nil || section[0] != 0x00 {
+		return
+	}
+	for pos := 8; pos+4 <= len(section); pos += 4 {
+		programNumber := uint16(section[pos])<<8 | uint16(section[pos+1])
+		pid := int(section[pos+2]&0x1F)<<8 | int(section[pos+3])
+		if programNumber != 0 {
+			d.pmtPID = pid
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte, pusi bool) {
+	section := psiSection(payload, pusi)
+	if section == nil || section[0] != 0x02 || len(section) < 12 {
+		return
+	}
+	programInfoLen := int(section[10]&0x0F)<<8 | int(section[11])
+	pos := 12 + programInfoLen
+	for pos+5 <= len(section) {
+		streamType := section[pos]
+		pid := uint16(section[pos+1]&0x1F)<<8 | uint16(section[pos+2])
+		esInfoLen := int(section[pos+3]&0x0F)<<8 | int(section[pos+4])
+		pos += 5 + esInfoLen
+
+		switch streamType {
+		case StreamTypeH264, StreamTypeH265:
+			d.HasVideo = true
+		case StreamTypeAAC:
+			d.HasAudio = true
+		default:
+			continue
+		}
+		if _, ok := d.streams[pid]; !ok {
+			d.streams[pid] = &pesStream{streamType: streamType}
+		}
+	}
+	d.PMTParsed = true
+}
+
+func (d *tsDemuxer) parsePES(st *pesStream, payload []byte, pusi bool) {
+	if pusi {
+		// 新 PES 开始，先输出上一个
+		d.flushPES(st)
+		if len(payload) < 9 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 {
+			return
+		}
+		pesLen := int(payload[4])<<8 | int(payload[5])
+		ptsDtsFlags := payload[7] >> 6
+		headerLen := int(payload[8])
+		if 9+headerLen > len(payload) {
+			return
+		}
+		if ptsDtsFlags&0x02 != 0 && headerLen >= 5 {
+			st.pts = readTimestamp(payload[9:14])
+			st.dts = st.pts
+		}
+		if ptsDtsFlags == 0x03 && headerLen >= 10 {
+			st.dts = readTimestamp(payload[14:19])
+		}
+		st.pesLength = 0
+		if pesLen > 0 {
+			st.pesLength = pesLen - 3 - headerLen
+		}
+		st.started = true
+		st.buf = append(st.buf[:0], payload[9+headerLen:]...)
+	} else if st.started {
+		st.buf = append(st.buf, payload...)
+	}
+
+	if st.started && st.pesLength > 0 && len(st.buf) >= st.pesLength {
+		d.flushPES(st)
+	}
+}
+
+func (d *tsDemuxer) flushPES(st *pesStream) {
+	if !st.started || len(st.buf) == 0 {
+		st.started = false
+		return
+	}
+	data := make([]byte, len(st.buf))
+	copy(data, st.buf)
+	d.frames = append(d.frames, &pesFrame{StreamType: st.streamType, PTS: st.pts, DTS: st.dts, Data: data})
+	st.buf = st.buf[:0]
+	st.started = false
+}
+
+// readTimestamp 解析 PES 头里 5 字节的 33bit 时间戳
+func readTimestamp(b []byte) uint64 {
+	return uint64(b[0]>>1&0x07)<<30 |
+		uint64(b[1])<<22 | uint64(b[2]>>1)<<15 |
+		uint64(b[3])<<7 | uint64(b[4]>>1)
+}
+
+// ====================== ADTS ======================
+
+// adtsFrame 一个 ADTS 帧
+type adtsFrame struct {
+	ObjectType      uint8
+	SampleRateIndex uint8
+	Channels        uint8
+	Raw             []byte
+}
+
+// splitADTS 把一个 PES 里的多个 ADTS 帧拆开
+func splitADTS(data []byte) ([]adtsFrame, error) {
+	var frames []adtsFrame
+	for len(data) >= 7 {
+		if data[0] != 0xFF || data[1]&0xF0 != 0xF0 {
+			return frames, errors.New("无效的ADTS同步字")
+		}
+		protectionAbsent := data[1] & 0x01
+		headerLen := 7
+		if protectionAbsent == 0 {
+			headerLen = 9
+		}
+		frameLen := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if frameLen < headerLen || frameLen > len(data) {
+			return frames, fmt.Errorf("ADTS帧长度异常: %d", frameLen)
+		}
+		frames = append(frames, adtsFrame{
+			ObjectType:      (data[2] >> 6) + 1,
+			SampleRateIndex: (data[2] >> 2) & 0x0F,
+			Channels:        (data[2]&0x01)<<2 | data[3]>>6,
+			Raw:             data[headerLen:frameLen],
+		})
+		data = data[frameLen:]
+	}
+	return frames, nil
+}
@@ -0,0 +1,329 @@
+package ts
+
+import (
+	"encoding/binary"
+	flvBroker "pull2push/core/broker/flv"
+)
+
+/*
+FLV tag -> MPEG-TS 复用
+
+	视频 PID 0x100，音频 PID 0x101，PMT PID 0x1000，PCR 放在视频 PID 上（纯音频时放在音频 PID 上）。
+	每个视频关键帧前重发 PAT/PMT 并在帧前带上 SPS/PPS（HEVC 还有 VPS），机顶盒从任意关键帧都能起播。
+*/
+
+const (
+	pidPMT   = 0x1000
+	pidVideo = 0x100
+	pidAudio = 0x101
+
+	streamIdVideo = 0xE0
+	streamIdAudio = 0xC0
+
+	// FLV 时间戳从 0 开始，TS 里整体后移，给 PCR 留出余量
+	ptsOffset = 90000 / 5
+)
+
+// TSMuxer 把 FLV tag 复用成 TS 包
+type TSMuxer struct {
+	videoStreamType uint8    // 0 表示还没有视频
+	audioStreamType uint8    // 0 表示还没有音频
+	paramSets       [][]byte // 视频参数集（Annex-B 前置到关键帧）
+	lengthSize      int      // AVCC NALU 长度字段大小
+	asc             []byte   // AAC AudioSpecificConfig
+
+	continuity map[uint16]uint8
+	pmtVersion uint8
+	tablesSent bool
+}
+
+func NewTSMuxer() *TSMuxer {
+	return &TSMuxer{continuity: make(map[uint16]uint8), lengthSize: 4}
+}
+
+// WriteTag 复用一个 FLV tag，返回对应的 TS 包（可能为空）
+func (m *TSMuxer) WriteTag(tag *flvBroker.FlvTag) []byte {
+	switch tag.TagType {
+	case flvBroker.TagTypeVideo:
+		return m.writeVideo(tag)
+	case flvBroker.TagTypeAudio:
+		return m.writeAudio(tag)
+	}
+	return nil
+}
+
+func (m *TSMuxer) writeVideo(tag *flvBroker.FlvTag) []byte {
+	// legacy 和 Enhanced FLV（hvc1）都支持，AV1/VP9 没有对应的 TS stream_type，直接丢弃
+	h := tag.VideoHeader()
+	if h == nil || (h.CodecID != flvBroker.CodecH264 && h.CodecID != flvBroker.CodecH265) {
+		return nil
+	}
+	codecID := h.CodecID
+	payload := tag.Data[h.HeaderSize:]
+
+	if h.IsSequenceStart() {
+		streamType := uint8(StreamTypeH264)
+		var err error
+		if codecID == flvBroker.CodecH265 {
+			streamType = StreamTypeH265
+			m.paramSets, m.lengthSize, err = flvBroker.ParseHEVCDecoderConfig(payload)
+		} else {
+			var spsList, ppsList [][]byte
+			spsList, ppsList, m.lengthSize, err = flvBroker.ParseAVCDecoderConfig(payload)
+			m.paramSets = append(spsList, ppsList...)
+		}
+		if err == nil && streamType != m.videoStreamType {
+			m.videoStreamType = streamType
+			m.tablesSent = false
+			m.pmtVersion++
+		}
+		return nil
+	}
+	if m.videoStreamType == 0 || !h.IsCodedFrame() {
+		return nil
+	}
+
+	nalus, err := flvBroker.SplitAVCC(payload, m.lengthSize)
+	if err != nil || len(nalus) == 0 {
+		return nil
+	}
+	keyFrame := h.IsKeyFrame()
+	cts := h.CompositionTime
+
+	var es []byte
+	if m.videoStreamType == StreamTypeH264 {
+		es = append(es, 0x00, 0x00, 0x00, 0x01, 0x09, 0xF0) // AUD
+	} else {
+		es = append(es, 0x00, 0x00, 0x00, 0x01, 0x46, 0x01, 0x50) // AUD
+	}
+	if keyFrame {
+		es = append(es, flvBroker.JoinAnnexB(m.paramSets...)...)
+	}
+	es = append(es, flvBroker.JoinAnnexB(nalus...)...)
+
+	var out []byte
+	if keyFrame || !m.tablesSent {
+		out = append(out, m.tables()...)
+	}
+	dts := uint64(tag.Timestamp)*90 + ptsOffset
+	pts := uint64(int64(tag.Timestamp)+int64(cts))*90 + ptsOffset
+	return append(out, m.packetizePES(pidVideo, streamIdVideo, pts, dts, es, true, keyFrame)...)
+}
+
+func (m *TSMuxer) writeAudio(tag *flvBroker.FlvTag) []byte {
+	if len(tag.Data) < 2 || (tag.Data[0]>>4)&0x0F != flvBroker.FormatAAC {
+		return nil
+	}
+	if tag.IsSequenceHeader() {
+		if len(tag.Data) >= 4 {
+			m.asc = append([]byte(nil), tag.Data[2:4]...)
+			if m.audioStreamType == 0 {
+				m.audioStreamType = StreamTypeAAC
+				m.tablesSent = false
+				m.pmtVersion++
+			}
+		}
+		return nil
+	}
+	if m.asc == nil {
+		return nil
+	}
+	raw := tag.Data[2:]
+	es := append(flvBroker.ADTSHeader(m.asc, len(raw)), raw...)
+
+	var out []byte
+	if !m.tablesSent {
+		out = append(out, m.tables()...)
+	}
+	pts := uint64(tag.Timestamp)*90 + ptsOffset
+	// 没有视频时 PCR 跟着音频走
+	withPCR := m.videoStreamType == 0
+	return append(out, m.packetizePES(pidAudio, streamIdAudio, pts, pts, es, withPCR, false)...)
+}
+
+// tables 生成 PAT + PMT
+func (m *TSMuxer) tables() []byte {
+	m.tablesSent = true
+
+	// PAT：program 1 -> PMT PID
+	pat := []byte{
+		0x00,       // table_id
+		0xB0, 0x0D, // section_syntax_indicator + section_length = 13
+		0x00, 0x01, // transport_stream_id
+		0xC1,       // version 0, current_next 1
+		0x00, 0x00, // section_number / last_section_number
+		0x00, 0x01, // program_number 1
+		0xE0 | byte(pidPMT>>8), byte(pidPMT & 0xFF),
+	}
+	pat = binary.BigEndian.AppendUint32(pat, crc32MPEG2(pat))
+
+	pcrPID := uint16(pidVideo)
+	if m.videoStreamType == 0 {
+		pcrPID = pidAudio
+	}
+	pmt := []byte{
+		0x02,       // table_id
+		0xB0, 0x00, // section_length 稍后填
+		0x00, 0x01, // program_number
+		0xC1 | (m.pmtVersion&0x1F)<<1,
+		0x00, 0x00,
+		0xE0 | byte(pcrPID>>8), byte(pcrPID & 0xFF),
+		0xF0, 0x00, // program_info_length = 0
+	}
+	if m.videoStreamType != 0 {
+		pmt = append(pmt, m.videoStreamType, 0xE0|byte(pidVideo>>8), byte(pidVideo&0xFF), 0xF0, 0x00)
+	}
+	if m.audioStreamType != 0 {
+		pmt = append(pmt, m.audioStreamType, 0xE0|byte(pidAudio>>8), byte(pidAudio&0xFF), 0xF0, 0x00)
+	}
+	sectionLen := len(pmt) - 3 + 4
+	pmt[1] = 0xB0 | byte(sectionLen>>8)
+	pmt[2] = byte(sectionLen)
+	pmt = binary.BigEndian.AppendUint32(pmt, crc32MPEG2(pmt))
+
+	out := m.psiPacket(PIDPAT, pat)
+	return append(out, m.psiPacket(pidPMT, pmt)...)
+}
+
+// psiPacket 把一个 PSI section 放进单个 TS 包，剩余部分用 0xFF 填充
+func (m *TSMuxer) psiPacket(pid uint16, section []byte) []byte {
+	pkt := make([]byte, PacketSize)
+	pkt[0] = SyncByte
+	pkt[1] = 0x40 | byte(pid>>8)
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.nextCC(pid)
+	pkt[4] = 0x00 // pointer_field
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < PacketSize; i++ {
+		pkt[i] = 0xFF
+	}
+	return pkt
+}
+
+func (m *TSMuxer) nextCC(pid uint16) uint8 {
+	cc := m.continuity[pid]
+	m.continuity[pid] = (cc + 1) & 0x0F
+	return cc
+}
+
+// packetizePES 生成 PES 并切分成 TS 包，第一个包可以带 PCR，关键帧带 random_access_indicator
+func (m *TSMuxer) packetizePES(pid uint16, streamId uint8, pts, dts uint64, es []byte, withPCR, randomAccess bool) []byte {
+	hasDTS := dts != pts
+	headerDataLen := 5
+	flags := byte(0x80)
+	if hasDTS {
+		headerDataLen = 10
+		flags = 0xC0
+	}
+	pes := make([]byte, 0, 9+headerDataLen+len(es))
+	pes = append(pes, 0x00, 0x00, 0x01, streamId)
+	pesLen := 3 + headerDataLen + len(es)
+	if streamId == streamIdVideo || pesLen > 0xFFFF {
+		pesLen = 0 // 视频 PES 长度允许为 0（不限长）
+	}
+	pes = binary.BigEndian.AppendUint16(pes, uint16(pesLen))
+	pes = append(pes, 0x80, flags, byte(headerDataLen))
+	if hasDTS {
+		pes = appendTimestamp(pes, 0x03, pts)
+		pes = appendTimestamp(pes, 0x01, dts)
+	} else {
+		pes = appendTimestamp(pes, 0x02, pts)
+	}
+	pes = append(pes, es...)
+
+	out := make([]byte, 0, (len(pes)/(PacketSize-4)+2)*PacketSize)
+	first := true
+	for len(pes) > 0 {
+		pkt := make([]byte, PacketSize)
+		pkt[0] = SyncByte
+		pkt[1] = byte(pid >> 8)
+		if first {
+			pkt[1] |= 0x40
+		}
+		pkt[2] = byte(pid)
+
+		// 自适应字段：PCR 和/或填充
+		var af []byte
+		if first && withPCR {
+			af = append(af, 0x10) // PCR flag
+			if randomAccess {
+				af[0] |= 0x40 // random_access_indicator
+			}
+			pcr := dts - ptsOffset/2
+			af = append(af, byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr&0x01)<<7|0x7E, 0x00)
+		}
+		space := PacketSize - 4
+		if af != nil {
+			space -= 1 + len(af)
+		}
+		if len(pes) < space {
+			// 最后一个包，用自适应字段填充到 188 字节
+			stuffing := space - len(pes)
+			if af == nil {
+				if stuffing == 1 {
+					af = []byte{}
+				} else {
+					af = []byte{0x00}
+					stuffing--
+				}
+				stuffing--
+			}
+			for i := 0; i < stuffing; i++ {
+				af = append(af, 0xFF)
+			}
+			space = len(pes)
+		}
+
+		pos := 4
+		if af != nil {
+			pkt[3] = 0x30 | m.nextCC(pid)
+			pkt[4] = byte(len(af))
+			copy(pkt[5:], af)
+			pos = 5 + len(af)
+		} else {
+			pkt[3] = 0x10 | m.nextCC(pid)
+		}
+		copy(pkt[pos:], pes[:space])
+		pes = pes[space:]
+		out = append(out, pkt...)
+		first = false
+	}
+	return out
+}
+
+// appendTimestamp 写入 PES 头里 5 字节的 33bit 时间戳
+func appendTimestamp(buf []byte, prefix byte, ts uint64) []byte {
+	ts &= 0x1FFFFFFFF
+	return append(buf,
+		prefix<<4|byte(ts>>29)&0x0E|0x01,
+		byte(ts>>22),
+		byte(ts>>14)|0x01,
+		byte(ts>>7),
+		byte(ts<<1)|0x01,
+	)
+}
+
+var crcTable = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04C11DB7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc32MPEG2 PSI 表使用的 CRC32/MPEG-2
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, b := range data {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^b]
+	}
+	return crc
+}
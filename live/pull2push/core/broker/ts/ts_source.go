@@ -0,0 +1,288 @@
+package ts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	flvBroker "pull2push/core/broker/flv"
+	"strings"
+	"time"
+)
+
+const (
+	udpReadTimeout = 10 * time.Second // UDP 超过该时间没有数据，认为上游中断
+	maxProbeBytes  = 4 << 20          // 等待 PMT 时最多读取的字节数
+	readBufferSize = 64 * 1024
+)
+
+// DialTS 根据 scheme 打开 TS 上游：udp://[@]ip:port（单播/组播监听）或 http(s):// 的 HTTP-TS 拉流
+func DialTS(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp":
+		return DialUDP(ctx, upstreamURL)
+	case "http", "https":
+		return DialHTTPTS(ctx, upstreamURL)
+	default:
+		return nil, fmt.Errorf("不支持的 TS 上游协议 %s", u.Scheme)
+	}
+}
+
+// DialUDP 监听 UDP 端口接收 TS，地址是组播地址时加入组播组，可以用 ?iface=eth0 指定网卡
+func DialUDP(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	// 兼容 ffmpeg 的 udp://@239.0.0.1:1234 写法
+	addr, err := net.ResolveUDPAddr("udp", strings.TrimPrefix(u.Host, "@"))
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	if addr.IP != nil && addr.IP.IsMulticast() {
+		var ifi *net.Interface
+		if name := u.Query().Get("iface"); name != "" {
+			if ifi, err = net.InterfaceByName(name); err != nil {
+				return nil, err
+			}
+		}
+		conn, err = net.ListenMulticastUDP("udp", ifi, addr)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetReadBuffer(4 << 20)
+
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	src, err := newTSTagSource(&udpReader{conn: conn}, conn)
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// udpReader 每次读取一个数据报，超时返回错误
+type udpReader struct {
+	conn *net.UDPConn
+}
+
+func (r *udpReader) Read(p []byte) (int, error) {
+	_ = r.conn.SetReadDeadline(time.Now().Add(udpReadTimeout))
+	n, _, err := r.conn.ReadFromUDP(p)
+	return n, err
+}
+
+// DialHTTPTS 以 GET 的方式拉取 HTTP-TS 上游
+func DialHTTPTS(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, upstreamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Go-Relay-TS/1.0")
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream bad status: %s", resp.Status)
+	}
+	src, err := newTSTagSource(resp.Body, resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return src, nil
+}
+
+// ====================== tsTagSource ======================
+
+// tsTagSource 把 TS 字节流转换成 FLV tag
+type tsTagSource struct {
+	r       io.Reader
+	closer  io.Closer
+	conv    *Converter
+	buf     []byte
+	pending []*flvBroker.FlvTag
+	header  []byte
+}
+
+// newTSTagSource 先读到 PMT，确定有哪些音视频流后才能构造 FLV 头
+func newTSTagSource(r io.Reader, closer io.Closer) (*tsTagSource, error) {
+	s := &tsTagSource{
+		r:      r,
+		closer: closer,
+		conv:   NewConverter(),
+		buf:    make([]byte, readBufferSize),
+	}
+	read := 0
+	for !s.conv.demuxer.PMTParsed {
+		n, err := s.fill()
+		if err != nil {
+			return nil, err
+		}
+		read += n
+		if read > maxProbeBytes {
+			return nil, errors.New("上游数据中没有找到 PMT")
+		}
+	}
+	s.header = flvBroker.BuildFLVHeader(s.conv.demuxer.HasAudio, s.conv.demuxer.HasVideo)
+	return s, nil
+}
+
+// fill 读取一次上游数据，解复用并转换成 tag 放入 pending
+func (s *tsTagSource) fill() (int, error) {
+	n, err := s.r.Read(s.buf)
+	if n > 0 {
+		tags, derr := s.conv.Feed(s.buf[:n])
+		if derr != nil {
+			return n, derr
+		}
+		s.pending = append(s.pending, tags...)
+	}
+	return n, err
+}
+
+func (s *tsTagSource) Header() []byte {
+	return s.header
+}
+
+func (s *tsTagSource) ReadTag() (*flvBroker.FlvTag, error) {
+	for len(s.pending) == 0 {
+		if _, err := s.fill(); err != nil && len(s.pending) == 0 {
+			return nil, err
+		}
+	}
+	tag := s.pending[0]
+	s.pending = s.pending[1:]
+	return tag, nil
+}
+
+func (s *tsTagSource) Close() error {
+	return s.closer.Close()
+}
+
+// ====================== TS -> FLV tag ======================
+
+// Converter 增量地把 TS 字节流转换成 FLV tag，数据可以按任意字节边界喂进来（HLS 分片、UDP 数据报都可以）
+type Converter struct {
+	demuxer   *tsDemuxer
+	converter *tsToFLV
+}
+
+func NewConverter() *Converter {
+	return &Converter{demuxer: newTSDemuxer(), converter: newTSToFLV()}
+}
+
+// Feed 追加 TS 数据，返回本次转换出的 tag
+func (c *Converter) Feed(data []byte) ([]*flvBroker.FlvTag, error) {
+	frames, err := c.demuxer.Feed(data)
+	if err != nil {
+		return nil, err
+	}
+	var tags []*flvBroker.FlvTag
+	for _, f := range frames {
+		tags = append(tags, c.converter.convert(f)...)
+	}
+	return tags, nil
+}
+
+// ====================== PES -> FLV tag ======================
+
+// tsToFLV 把 PES 帧转换成 FLV tag，时间戳换算成从 0 开始的毫秒
+type tsToFLV struct {
+	h264 *flvBroker.VideoPacker
+	h265 *flvBroker.VideoPacker
+	asc  []byte
+
+	baseTs int64 // 第一个时间戳（90kHz，已展开回绕）
+	lastTs int64 // 上一个展开后的时间戳
+	wraps  int64 // 33bit 回绕次数
+	inited bool  // 是否已经拿到第一个时间戳
+}
+
+func newTSToFLV() *tsToFLV {
+	return &tsToFLV{
+		h264: flvBroker.NewVideoPacker(flvBroker.CodecH264),
+		h265: flvBroker.NewVideoPacker(flvBroker.CodecH265),
+	}
+}
+
+// millis 33bit 90kHz 时间戳 -> 从 0 开始的毫秒
+func (c *tsToFLV) millis(ts uint64) uint32 {
+	const wrap = int64(1) << 33
+	v := int64(ts) + c.wraps*wrap
+	if !c.inited {
+		c.baseTs, c.lastTs, c.inited = v, v, true
+	}
+	if v < c.lastTs-wrap/2 {
+		c.wraps++
+		v += wrap
+	}
+	if v > c.lastTs {
+		c.lastTs = v
+	}
+	diff := (v - c.baseTs) / 90
+	if diff < 0 {
+		return 0
+	}
+	return uint32(diff)
+}
+
+func (c *tsToFLV) convert(f *pesFrame) []*flvBroker.FlvTag {
+	switch f.StreamType {
+	case StreamTypeH264, StreamTypeH265:
+		dts := c.millis(f.DTS)
+		// PTS 可能已经回绕而 DTS 还没有，差值按 33bit 取模；超过一半说明 PTS 早于 DTS，是异常数据
+		cts := int32(0)
+		if diff := (f.PTS - f.DTS) & 0x1FFFFFFFF; diff < 1<<32 {
+			cts = int32(diff / 90)
+		}
+		packer := c.h264
+		if f.StreamType == StreamTypeH265 {
+			packer = c.h265
+		}
+		return packer.Pack(flvBroker.SplitAnnexB(f.Data), dts, cts)
+	case StreamTypeAAC:
+		frames, _ := splitADTS(f.Data)
+		if len(frames) == 0 {
+			return nil
+		}
+		base := c.millis(f.PTS)
+		var tags []*flvBroker.FlvTag
+		first := frames[0]
+		asc := flvBroker.AACAudioSpecificConfig(first.ObjectType, first.SampleRateIndex, first.Channels)
+		if string(asc) != string(c.asc) {
+			c.asc = asc
+			tags = append(tags, flvBroker.NewAACSequenceTag(asc, base))
+		}
+		sampleRate := 44100
+		if int(first.SampleRateIndex) < len(flvBroker.AACSampleRates) {
+			sampleRate = flvBroker.AACSampleRates[first.SampleRateIndex]
+		}
+		for i, fr := range frames {
+			ts := base + uint32(i*1024*1000/sampleRate)
+			tags = append(tags, flvBroker.NewAACFrameTag(fr.Raw, ts))
+		}
+		return tags
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package ts
+
+import (
+	"bytes"
+	"fmt"
+	flvBroker "pull2push/core/broker/flv"
+	"slices"
+	"testing"
+)
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x02, 0x80, 0xBF, 0xE5}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+	testASC = flvBroker.AACAudioSpecificConfig(2, 4, 2) // AAC-LC 44.1kHz 双声道
+)
+
+// videoTag H.264 帧，关键帧是一个 IDR，其他是一个非 IDR slice；size 控制 NALU 大小，大帧会拆到很多个 TS 包里
+func videoTag(n byte, size int, keyFrame bool, dts uint32, cts int32) *flvBroker.FlvTag {
+	nalu := append([]byte{0x41}, bytes.Repeat([]byte{n}, size)...)
+	if keyFrame {
+		nalu[0] = 0x65
+	}
+	return flvBroker.NewVideoFrameTag(flvBroker.CodecH264, [][]byte{nalu}, keyFrame, dts, cts)
+}
+
+func audioTag(n byte, ts uint32) *flvBroker.FlvTag {
+	return flvBroker.NewAACFrameTag(bytes.Repeat([]byte{n}, 200), ts)
+}
+
+// roundTrip FLV tag -> TSMuxer -> Converter -> FLV tag，TS 数据按 chunk 字节一段段喂给 Converter
+func roundTrip(t *testing.T, tags []*flvBroker.FlvTag, chunk int) []*flvBroker.FlvTag {
+	t.Helper()
+	m := NewTSMuxer()
+	var ts []byte
+	for _, tag := range tags {
+		ts = append(ts, m.WriteTag(tag)...)
+	}
+	if len(ts)%PacketSize != 0 {
+		t.Fatalf("TS 长度 %d 不是 188 的整数倍", len(ts))
+	}
+	c := NewConverter()
+	var out []*flvBroker.FlvTag
+	for len(ts) > 0 {
+		n := min(chunk, len(ts))
+		got, err := c.Feed(ts[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, got...)
+		ts = ts[n:]
+	}
+	return out
+}
+
+// tagSummary 便于比较的 tag 内容：视频是时间戳、cts、关键帧和 NALU，音频是时间戳和负载。
+// 视频 PES 不带长度，要等下一个视频 PES 才输出，音视频之间的顺序会变，所以按轨道分别比较
+type tagSummary struct {
+	kind     string
+	ts       uint32
+	cts      int32
+	keyFrame bool
+	data     string
+}
+
+func summarize(t *testing.T, tags []*flvBroker.FlvTag, base uint32) (video, audio []tagSummary) {
+	t.Helper()
+	for _, tag := range tags {
+		s := tagSummary{ts: tag.Timestamp - base}
+		switch {
+		case tag.TagType == flvBroker.TagTypeAudio && tag.IsSequenceHeader():
+			s.kind, s.ts, s.data = "asc", 0, string(tag.Data[2:])
+		case tag.TagType == flvBroker.TagTypeAudio:
+			s.kind, s.data = "audio", string(tag.Data[2:])
+		default:
+			h := tag.VideoHeader()
+			if h.IsSequenceStart() {
+				s.kind, s.ts, s.data = "avc", 0, string(tag.Data[h.HeaderSize:])
+				break
+			}
+			nalus, err := flvBroker.SplitAVCC(tag.Data[h.HeaderSize:], 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.kind, s.cts, s.keyFrame, s.data = "video", h.CompositionTime, h.IsKeyFrame(), string(bytes.Join(nalus, []byte{0}))
+		}
+		if tag.TagType == flvBroker.TagTypeAudio {
+			audio = append(audio, s)
+		} else {
+			video = append(video, s)
+		}
+	}
+	return video, audio
+}
+
+// compareTracks 按轨道比较转换前后的 tag
+func compareTracks(t *testing.T, got, want []*flvBroker.FlvTag, wantBase uint32) {
+	t.Helper()
+	gotVideo, gotAudio := summarize(t, got, 0)
+	wantVideo, wantAudio := summarize(t, want, wantBase)
+	if !slices.Equal(gotVideo, wantVideo) {
+		t.Errorf("视频\n得到 %v\n期望 %v", brief(gotVideo), brief(wantVideo))
+	}
+	if !slices.Equal(gotAudio, wantAudio) {
+		t.Errorf("音频\n得到 %v\n期望 %v", brief(gotAudio), brief(wantAudio))
+	}
+}
+
+// streamTags 一段 H.264 + AAC 的 FLV 流，从 base 开始，最后一个视频帧只用来让前一个视频 PES 输出
+func streamTags(base uint32) []*flvBroker.FlvTag {
+	return []*flvBroker.FlvTag{
+		flvBroker.NewVideoSequenceTag(flvBroker.CodecH264, flvBroker.AVCDecoderConfig(testSPS, testPPS), base),
+		flvBroker.NewAACSequenceTag(testASC, base),
+		videoTag(1, 5000, true, base, 0),
+		audioTag(2, base),
+		audioTag(3, base+23),
+		videoTag(4, 300, false, base+40, 80), // B 帧之前的 P 帧，pts = dts + 80ms
+		audioTag(5, base+46),
+		videoTag(6, 300, false, base+80, 0),
+		audioTag(7, base+69),
+		videoTag(8, 10, true, base+120, 0),
+	}
+}
+
+func TestTSRoundTrip(t *testing.T) {
+	for _, chunk := range []int{1 << 20, PacketSize, 1, 97} {
+		t.Run(fmt.Sprint(chunk), func(t *testing.T) {
+			in := streamTags(0)
+			compareTracks(t, roundTrip(t, in, chunk), in[:len(in)-1], 0)
+		})
+	}
+}
+
+func TestTSTimestampWrap(t *testing.T) {
+	// 33bit 90kHz 的 PTS 大约 26.5 小时回绕一次，base 选在回绕前 300ms（TS 里整体后移了 ptsOffset），
+	// base+280 的帧 DTS 还没回绕、PTS 已经回绕
+	base := uint32((1<<33)/90) - ptsOffset/90 - 300
+	in := streamTags(base)
+	last := len(in) - 1
+	for i := range 6 {
+		cts := int32(0)
+		if i == 3 {
+			cts = 80
+		}
+		in = append(in[:last+i], videoTag(byte(10+i), 10, false, base+160+uint32(i)*40, cts), in[last])
+	}
+	compareTracks(t, roundTrip(t, in, 1<<20), in[:len(in)-1], base)
+}
+
+func TestTSDemuxPESSplit(t *testing.T) {
+	m := NewTSMuxer()
+	m.videoStreamType, m.audioStreamType = StreamTypeH264, StreamTypeAAC
+	big := bytes.Repeat([]byte{0xAB, 0xCD, 0xEF}, 1000) // 3000 字节，拆到十几个 TS 包里
+	ts := m.tables()
+	ts = append(ts, m.packetizePES(pidVideo, streamIdVideo, 9000, 3600, big, true, true)...)
+	// 音频 PES 带长度，收满就输出；视频 PES 长度为 0，要等下一个 PES 开始
+	ts = append(ts, m.packetizePES(pidAudio, streamIdAudio, 5000, 5000, []byte{1, 2, 3}, false, false)...)
+	ts = append(ts, m.packetizePES(pidVideo, streamIdVideo, 12600, 12600, []byte{9}, true, false)...)
+
+	for _, chunk := range []int{len(ts), 1, 100, 189} {
+		d := newTSDemuxer()
+		// 前面加一些垃圾数据，测试重新同步
+		data := append([]byte{0x00, 0x12, 0x34}, ts...)
+		var frames []*pesFrame
+		for len(data) > 0 {
+			n := min(chunk, len(data))
+			got, err := d.Feed(data[:n])
+			if err != nil {
+				t.Fatal(err)
+			}
+			frames = append(frames, got...)
+			data = data[n:]
+		}
+		if !d.PMTParsed || !d.HasVideo || !d.HasAudio {
+			t.Fatalf("chunk %d: PMT 没有解析出来", chunk)
+		}
+		if len(frames) != 2 {
+			t.Fatalf("chunk %d: 得到 %d 个 PES", chunk, len(frames))
+		}
+		audio, video := frames[0], frames[1]
+		if audio.StreamType != StreamTypeAAC || !bytes.Equal(audio.Data, []byte{1, 2, 3}) || audio.PTS != 5000 {
+			t.Errorf("chunk %d: 音频 %+v", chunk, audio)
+		}
+		if video.StreamType != StreamTypeH264 || !bytes.Equal(video.Data, big) || video.PTS != 9000 || video.DTS != 3600 {
+			t.Errorf("chunk %d: 视频 type=%x pts=%d dts=%d len=%d", chunk, video.StreamType, video.PTS, video.DTS, len(video.Data))
+		}
+	}
+}
+
+func TestReadTimestamp(t *testing.T) {
+	for _, ts := range []uint64{0, 1, 90000, 1<<32 + 5, 1<<33 - 1} {
+		if got := readTimestamp(appendTimestamp(nil, 0x02, ts)); got != ts {
+			t.Errorf("%d 读出 %d", ts, got)
+		}
+	}
+	// 超过 33bit 的部分丢掉
+	if got := readTimestamp(appendTimestamp(nil, 0x02, 1<<33+7)); got != 7 {
+		t.Errorf("回绕后读出 %d", got)
+	}
+}
+
+// brief 出错时打印的摘要，数据只打印长度
+func brief(tags []tagSummary) []string {
+	out := make([]string, len(tags))
+	for i, s := range tags {
+		out[i] = fmt.Sprintf("%s@%d cts=%d key=%v len=%d", s.kind, s.ts, s.cts, s.keyFrame, len(s.data))
+	}
+	return out
+}
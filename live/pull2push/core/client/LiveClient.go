@@ -1,5 +1,6 @@
 package client
 
+// LiveClient 一个观众，数据是没有分帧的 FLV 字节；新的观众请实现 stream.Client，用 adapter.PacketClientOf 挂到旧 broker 上
 type LiveClient interface {
 
 	// Broadcast 服务端给客户端推流
@@ -12,3 +13,14 @@ type LiveClient interface {
 	// GetDataChan 获取当前客户端的写通道
 	GetDataChan() chan []byte
 }
+
+// Kickable 可以被服务端主动断开的客户端，管理后台踢人时使用，reason 会尽量带给播放端
+type Kickable interface {
+	Kick(reason string)
+}
+
+// RingReader 自己从 broker 的共享环形缓冲按游标读数据的客户端（flv / ts / ws 观众），
+// broker 不会再逐个调用它的 Broadcast，也不会在 AddLiveClient 时给它发送起播数据
+type RingReader interface {
+	ReadsRing()
+}
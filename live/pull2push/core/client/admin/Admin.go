@@ -0,0 +1,151 @@
+package admin
+
+import (
+	"embed"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/fs"
+	"net/http"
+	"pull2push/config"
+	"pull2push/core/broker"
+	"pull2push/core/client"
+	"pull2push/core/client/push"
+	"pull2push/core/manager"
+	"pull2push/core/memory"
+)
+
+// console 目录是管理后台的静态页面，编译进二进制，不依赖部署目录
+//
+//go:embed console
+var consoleFS embed.FS
+
+// BrokerStatus 管理后台里一路直播的状态
+type BrokerStatus struct {
+	BrokerKey string               `json:"brokerKey"`
+	Type      string               `json:"type"`
+	URL       string               `json:"url"`
+	Viewers   []string             `json:"viewers"`
+	Push      []push.PushStatus    `json:"push"`
+	Media     *broker.MediaInfo    `json:"media"`
+	Health    *broker.HealthReport `json:"health"`
+	Memory    int64                `json:"memory"` // 缓存占用的字节数
+}
+
+// Console 管理后台页面  GET /console/*filepath
+func Console() gin.HandlerFunc {
+	sub, err := fs.Sub(consoleFS, "console")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix("/console", http.FileServer(http.FS(sub)))
+	return func(c *gin.Context) {
+		fileServer.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// ListBrokers 列出所有直播的配置、观众、转推目标和实时统计  GET /live/admin/brokers
+func ListBrokers(m *manager.StreamManager, pm *push.PushManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		streams := m.Streams()
+		list := make([]BrokerStatus, 0, len(streams))
+		for _, s := range streams {
+			status := BrokerStatus{
+				BrokerKey: s.Key,
+				Type:      s.Type,
+				URL:       s.URL,
+				Viewers:   []string{},
+				Push:      pm.ListTargets(s.Key),
+				Memory:    memory.Default.Usage(s.Key),
+			}
+			b, _, err := m.FindBroker(s.Key)
+			if err == nil {
+				if lister, ok := b.(broker.LiveClientLister); ok {
+					status.Viewers = lister.ListLiveClients()
+				}
+				if provider, ok := b.(broker.MediaInfoProvider); ok {
+					status.Media = provider.MediaInfo()
+				}
+				if reporter, ok := b.(broker.HealthReporter); ok {
+					status.Health = reporter.HealthReport()
+				}
+			}
+			list = append(list, status)
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": list})
+	}
+}
+
+// KickClient 踢出一个观众  DELETE /live/admin/brokers/:brokerKey/clients/:clientId
+func KickClient(m *manager.StreamManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey, clientId := c.Param("brokerKey"), c.Param("clientId")
+
+		b, _, err := m.FindBroker(brokerKey)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		liveClient, err := b.FindLiveClient(clientId)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		kickable, ok := liveClient.(client.Kickable)
+		if !ok {
+			// 短连接（hls）等无法主动断开的客户端，只从 broker 里移除
+			b.RemoveLiveClient(clientId)
+			c.JSON(http.StatusOK, gin.H{"code": 200, "msg": fmt.Sprintf("客户端 %s 不支持断开，已从 %s 移除", clientId, brokerKey)})
+			return
+		}
+		kickable.Kick(kickReason(c))
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
+
+// StopBroker 停止一路直播，断开所有观众和转推  POST /live/admin/brokers/:brokerKey/stop
+func StopBroker(m *manager.StreamManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey := c.Param("brokerKey")
+
+		// 先断开观众，broker 移除后它们就收不到任何数据了
+		if b, _, err := m.FindBroker(brokerKey); err == nil {
+			if lister, ok := b.(broker.LiveClientLister); ok {
+				for _, clientId := range lister.ListLiveClients() {
+					if liveClient, err := b.FindLiveClient(clientId); err == nil {
+						if kickable, ok := liveClient.(client.Kickable); ok {
+							kickable.Kick("直播已停止")
+						}
+					}
+				}
+			}
+		}
+		if err := m.Stop(brokerKey); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
+
+// SwitchBroker 切换上游地址  POST /live/admin/brokers/:brokerKey/switch  {"url": "rtmp://..."}
+// 新地址的协议和主机必须在 admin.switch_schemes / admin.switch_hosts 里（见 config.Config.CheckSwitchURL）
+func SwitchBroker(m *manager.StreamManager, store *config.Store) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.URL == "" {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": "url 不能为空"})
+			return
+		}
+		if err := store.Load().CheckSwitchURL(body.URL); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 403, "msg": err.Error()})
+			return
+		}
+		if err := m.SwitchURL(c.Param("brokerKey"), body.URL); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
@@ -0,0 +1,42 @@
+package admin
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/core/session"
+)
+
+// defaultKickReason 没有填写原因时发给观众的踢出原因
+const defaultKickReason = "被管理员移出直播间"
+
+// kickReason 踢人的原因，取 ?reason= 或者 JSON body 里的 reason
+func kickReason(c *gin.Context) string {
+	if reason := c.Query("reason"); reason != "" {
+		return reason
+	}
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 && c.ShouldBindJSON(&body) == nil && body.Reason != "" {
+		return body.Reason
+	}
+	return defaultKickReason
+}
+
+// ListSessions 列出观看会话，?broker= 只看一路直播  GET /live/sessions?broker=test1
+func ListSessions(r *session.Registry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": r.List(c.Query("broker"))})
+	}
+}
+
+// KickSession 按会话编号踢出一个观众，原因通过关闭信号带给客户端  DELETE /live/sessions/:id  {"reason": "..."}
+func KickSession(r *session.Registry) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := r.Kick(c.Param("id"), kickReason(c)); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
@@ -1,12 +1,18 @@
 package flv
 
 import (
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	cameraBroadcast "pull2push/core/broadcast/camera"
 	"pull2push/core/broker"
+	"pull2push/core/broker/adapter"
 	cameraBroker "pull2push/core/broker/camera"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/memory"
+	"pull2push/core/session"
+	"sync"
 )
 
 // ====================== CameraLiveClient ======================
@@ -14,8 +20,12 @@ import (
 // CameraLiveClient 每一个前端页面有持有一个客户端对象
 type CameraLiveClient struct {
 	BrokerKey string      // 这个客户端的直播房间的唯一编号
-	ClientId  string      // 这个客户端的id
-	dataCh    chan []byte // 这个客户端的一个只写通道
+	ClientId  string      // 这个客户端的id，即服务端分配的会话编号
+	dataCh    chan []byte // 这个客户端的一个只写通道，broker 通过 Broadcast 写入
+	session   *session.Session
+
+	mu       sync.Mutex
+	dropping bool // 通道满了丢过包，要丢到下一个视频关键帧
 
 	// http连接相关
 	httpCloseSig        <-chan struct{} // 当这个请求被客户端主动被关闭时触发
@@ -26,19 +36,20 @@ type CameraLiveClient struct {
 	brokerCloseSig <-chan broker.BROKER_CLOSE_TYPE // broker被关闭时，同时通知客户端关闭 【仅接收】
 }
 
-func NewCameraLiveClient(c *gin.Context, brokerKey, clientId string, clientCloseSig chan<- string, brokerCloseSig <-chan broker.BROKER_CLOSE_TYPE) (*CameraLiveClient, error) {
+func NewCameraLiveClient(c *gin.Context, sess *session.Session, clientCloseSig chan<- string, brokerCloseSig <-chan broker.BROKER_CLOSE_TYPE) (*CameraLiveClient, error) {
 
 	clc := CameraLiveClient{
-		BrokerKey:           brokerKey,
-		ClientId:            clientId,
+		BrokerKey:           sess.BrokerKey,
+		ClientId:            sess.ID,
 		dataCh:              make(chan []byte, 1024),
+		session:             sess,
 		httpCloseSig:        c.Done(),
 		httpRequestCloseSig: c.Request.Context().Done(),
 		clientCloseSig:      clientCloseSig,
 		brokerCloseSig:      brokerCloseSig,
 	}
 
-	fmt.Println("HLS 客户端连接成功 ClientId = ", clientId)
+	fmt.Println("camera 客户端连接成功 ClientId = ", sess.ID)
 
 	// 开启状态监听
 	go clc.Listen()
@@ -78,12 +89,42 @@ func (clc *CameraLiveClient) Listen() {
 
 }
 
+// Broadcast 非阻塞写入通道，慢客户端不会卡住推流；通道满了丢包之后一直丢到下一个视频关键帧，
+// 不把缺帧的 GOP 交给解码器
 func (clc *CameraLiveClient) Broadcast(data []byte) {
+	clc.mu.Lock()
+	defer clc.mu.Unlock()
+	if clc.dropping {
+		if !isKeyFrameTag(data) {
+			return
+		}
+		clc.dropping = false
+	}
+	select {
+	case clc.dataCh <- data:
+	default:
+		clc.dropping = true
+	}
+}
+
+// isKeyFrameTag data 是否以一个视频关键帧 tag 开头，legacy 和 Enhanced FLV 的帧类型都在第一个字节的 4-6 位
+func isKeyFrameTag(data []byte) bool {
+	return len(data) > flvBroker.FLVTagHeaderSize && data[0]&0x1F == flvBroker.TagTypeVideo &&
+		(data[flvBroker.FLVTagHeaderSize]>>4)&0x07 == 1
+}
+
+// Kick 服务端主动断开这个客户端，响应头已经发出，原因只能记在会话上
+func (clc *CameraLiveClient) Kick(reason string) {
+	clc.session.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+}
 
+// StartMode 请求参数 ?start= 指定的起播方式，见 broker.StartModer
+func (clc *CameraLiveClient) StartMode() broker.START_MODE {
+	return clc.session.Start
 }
 
 // ExecutePush ==================== HTTP ====================
-// ExecutePush 处理摄像头推上来的流数据
+// ExecutePush 处理摄像头推上来的流数据，推流断开后 broker 保留，观众等待重连
 func ExecutePush(cameraBroadcastPool *cameraBroadcast.CameraBroadcaster) func(c *gin.Context) {
 	return func(c *gin.Context) {
 		//if !strings.HasPrefix(c.GetHeader("Content-Type"), "video/x-flv") {
@@ -95,14 +136,23 @@ func ExecutePush(cameraBroadcastPool *cameraBroadcast.CameraBroadcaster) func(c
 		findBroker, err := cameraBroadcastPool.FindBroker(brokerKey)
 		if err != nil {
 			fmt.Printf("未找到对应的广播器 %s \n", brokerKey)
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		publisher, ok := findBroker.(adapter.Publisher)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": fmt.Sprintf("%s 不是 camera 推流", brokerKey)})
 			return
 		}
 
 		// 开始不断接收推流
-		findBroker.PullLoop(broker.BrokerOptional{GinContext: c})
-
-		cameraBroadcastPool.RemoveBroker(brokerKey)
-
+		if err := adapter.PublishRequest(c, publisher); err != nil {
+			status := http.StatusServiceUnavailable
+			if errors.Is(err, cameraBroker.ErrPublishing) {
+				status = http.StatusConflict
+			}
+			c.JSON(status, gin.H{"code": status, "msg": err.Error()})
+		}
 	}
 }
 
@@ -110,27 +160,47 @@ func ExecutePush(cameraBroadcastPool *cameraBroadcast.CameraBroadcaster) func(c
 func ExecutePull(cameraBroadcastPool *cameraBroadcast.CameraBroadcaster) func(c *gin.Context) {
 	return func(c *gin.Context) {
 
-		c.Header("Content-Type", "video/x-flv")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Status(http.StatusOK)
-
 		brokerKey := c.Param("brokerKey")
-		clientId := c.Param("clientId")
 		findBroker, err := cameraBroadcastPool.FindBroker(brokerKey)
 		if err != nil {
-			fmt.Printf("未找到对应的广播器 %s \n", brokerKey)
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": err.Error()})
 			return
 		}
+		cameraBrokerTemp, ok := findBroker.(*cameraBroker.CameraBroker)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"code": 500, "msg": fmt.Sprintf("brokerKey %s 不是 camera broker", brokerKey)})
+			return
+		}
+
+		// 准入检查在写响应头之前，加入 broker 之前
+		sess, err := session.Default.Open(c, c.Request.Context(), brokerKey, "camera")
+		if err != nil {
+			session.Default.Reject(c, brokerKey, err)
+			return
+		}
+		defer sess.End()
+		clientId := sess.ID
+
+		c.Header("Content-Type", "video/x-flv")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Status(http.StatusOK)
 
-		cameraBrokerTemp, _ := findBroker.(*cameraBroker.CameraBroker)
-		client, err := NewCameraLiveClient(c, brokerKey, clientId, cameraBrokerTemp.ClientCloseSig, cameraBrokerTemp.BrokerCloseSig)
+		client, err := NewCameraLiveClient(c, sess, cameraBrokerTemp.ClientCloseSig, cameraBrokerTemp.BrokerCloseSig)
 		if err != nil {
 			fmt.Println("NewCameraLiveClient 创建失败：", err)
 			return
 		}
 		fmt.Println("NewCameraLiveClient 创建成功：clientId = ", clientId)
+		// 通道缓冲区记在这路流的内存账户上
+		account := memory.Default.Open(brokerKey)
+		account.Charge(memory.ChanOverhead(cap(client.GetDataChan())))
+		defer func() {
+			account.Free(memory.ChanOverhead(cap(client.GetDataChan())))
+			account.Close()
+		}()
 		cameraBrokerTemp.AddLiveClient(clientId, client)
+		defer cameraBrokerTemp.RemoveLiveClient(clientId)
 
 		flusher, ok := c.Writer.(http.Flusher)
 		if !ok {
@@ -140,16 +210,17 @@ func ExecutePull(cameraBroadcastPool *cameraBroadcast.CameraBroadcaster) func(c
 
 		for {
 			select {
-			case pkt, ok := <-client.GetDataChan():
+			case pkt, ok := <-client.dataCh:
 				if !ok {
 					return
 				}
-				_, err := c.Writer.Write(pkt)
+				n, err := c.Writer.Write(pkt)
+				sess.AddBytes(n)
 				if err != nil {
 					return
 				}
 				flusher.Flush()
-			case <-c.Request.Context().Done():
+			case <-sess.Context().Done():
 				return
 			}
 		}
@@ -0,0 +1,33 @@
+package flv
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	cameraBroadcast "pull2push/core/broadcast/camera"
+	flvBroker "pull2push/core/broker/flv"
+	"testing"
+)
+
+// 找不到 broker 或者 broker 不是 camera 时返回 JSON 错误，不能发一个空的 200 或者解引用 nil
+func TestExecutePullNotCamera(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	pool := cameraBroadcast.NewCameraBroadcaster()
+	other := flvBroker.NewFLVStreamBrokerWithDialer("flv", "test://", func(ctx context.Context, _ string) (flvBroker.TagSource, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	defer other.Close()
+	pool.AddBroker("flv", other)
+
+	r := gin.New()
+	r.GET("/live/camera/:brokerKey/:clientId", ExecutePull(pool))
+	for key, want := range map[string]int{"missing": http.StatusNotFound, "flv": http.StatusInternalServerError} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("GET", "/live/camera/"+key+"/c1", nil))
+		if w.Code != want || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Errorf("%s: %d %s，期望 %d JSON", key, w.Code, w.Header().Get("Content-Type"), want)
+		}
+	}
+}
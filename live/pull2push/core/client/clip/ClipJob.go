@@ -0,0 +1,252 @@
+package clip
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/mp4"
+	"sync"
+	"time"
+)
+
+/*
+片段导出：编辑在直播过程中剪出精彩片段。
+
+	数据来自 broker 的内存缓存（FLVStreamBroker 的环形缓冲、CameraBroker 的 GOP 缓存，见 broker.Clipper），
+	能往前剪多久由流配置的 cache.clip_window 决定；结束时间在将来时任务先等到结束时间再导出，结束时间最多在 clips.max_duration 之后。
+	片段从不晚于开始时间的最近关键帧开始，时间戳从 0 开始，封装成 MP4 或者 FLV 写到 clips.dir，
+	写完之前文件名带 .part 后缀，下载地址只有任务完成后才能访问。
+*/
+
+// CLIP_FORMAT 片段的封装格式
+type CLIP_FORMAT string
+
+const (
+	FormatMP4 CLIP_FORMAT = "mp4"
+	FormatFLV CLIP_FORMAT = "flv"
+)
+
+// 任务状态
+const (
+	ClipStateWaiting = "waiting" // 结束时间还没到
+	ClipStateRunning = "running"
+	ClipStateDone    = "done"
+	ClipStateFailed  = "failed"
+)
+
+// ClipStatus 导出任务的状态快照
+type ClipStatus struct {
+	Id         string      `json:"id"`
+	BrokerKey  string      `json:"brokerKey"`
+	Format     CLIP_FORMAT `json:"format"`
+	State      string      `json:"state"`
+	Progress   float64     `json:"progress"` // 0 ~ 1
+	Error      string      `json:"error,omitempty"`
+	Start      time.Time   `json:"start"`                // 请求的开始时间
+	End        time.Time   `json:"end"`                  // 请求的结束时间
+	ClipStart  time.Time   `json:"clipStart,omitempty"`  // 实际的开始时间，对齐到关键帧
+	ClipEnd    time.Time   `json:"clipEnd,omitempty"`    // 实际的结束时间
+	Duration   float64     `json:"duration,omitempty"`   // 片段时长，秒
+	Size       int64       `json:"size,omitempty"`       // 文件字节数
+	URL        string      `json:"url,omitempty"`        // 下载地址，完成后才有
+	CreatedAt  time.Time   `json:"createdAt"`            // 创建时间
+	FinishedAt time.Time   `json:"finishedAt,omitempty"` // 完成或失败的时间
+}
+
+// ClipJob 一个导出任务
+type ClipJob struct {
+	path string                                         // 片段文件的路径
+	find func(brokerKey string) (broker.Clipper, error) // 导出时再按 brokerKey 查 broker，等待期间流可能被重建或者移除
+
+	mu     sync.Mutex
+	status ClipStatus
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Status 当前状态快照
+func (j *ClipJob) Status() ClipStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Stop 取消还没完成的任务并等待它退出
+func (j *ClipJob) Stop() {
+	j.cancel()
+	<-j.done
+}
+
+func (j *ClipJob) update(fn func(s *ClipStatus)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	fn(&j.status)
+}
+
+// run 等到结束时间，从 broker 缓存取出数据写成文件
+func (j *ClipJob) run(ctx context.Context) {
+	defer close(j.done)
+	status := j.Status()
+	if wait := time.Until(status.End); wait > 0 {
+		select {
+		case <-ctx.Done():
+			j.fail(ctx.Err())
+			return
+		case <-time.After(wait):
+		}
+	}
+	j.update(func(s *ClipStatus) { s.State = ClipStateRunning })
+
+	clipper, err := j.find(status.BrokerKey)
+	if err != nil {
+		j.fail(fmt.Errorf("导出时直播已经不在了: %w", err))
+		return
+	}
+	c, err := clipper.Clip(status.Start, status.End)
+	if err != nil {
+		j.fail(err)
+		return
+	}
+	j.update(func(s *ClipStatus) { s.ClipStart, s.ClipEnd = c.Start, c.End })
+	size, duration, err := j.write(ctx, c, status.Format)
+	if err != nil {
+		os.Remove(j.path + ".part")
+		j.fail(err)
+		return
+	}
+	j.update(func(s *ClipStatus) {
+		s.State, s.Progress, s.Size, s.Duration = ClipStateDone, 1, size, duration.Seconds()
+		s.URL = "/live/clips/" + s.Id + "/file"
+		s.FinishedAt = time.Now()
+	})
+}
+
+func (j *ClipJob) fail(err error) {
+	j.update(func(s *ClipStatus) {
+		s.State, s.Error, s.FinishedAt = ClipStateFailed, err.Error(), time.Now()
+	})
+}
+
+// write 把片段写到 path.part，完成后改名，返回文件大小和片段时长
+func (j *ClipJob) write(ctx context.Context, c *broker.Clip, format CLIP_FORMAT) (int64, time.Duration, error) {
+	header, tags, err := parseClip(c)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := os.Create(j.path + ".part")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var duration time.Duration
+	if format == FormatMP4 {
+		duration, err = j.writeMP4(ctx, f, header, tags)
+	} else {
+		duration, err = j.writeFLV(ctx, f, c.Header, tags)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, 0, err
+	}
+	return info.Size(), duration, os.Rename(j.path+".part", j.path)
+}
+
+// parseClip 把起播头和缓存里的字节解析成 tag，起播头只留元数据和序列头，数据的时间戳改成从 0 开始
+func parseClip(c *broker.Clip) ([]*flvBroker.FlvTag, []*flvBroker.FlvTag, error) {
+	d := flvBroker.NewFLVDemuxer()
+	header, err := d.Feed(c.Header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("解析起播头: %w", err)
+	}
+	tags := make([]*flvBroker.FlvTag, 0, len(c.Tags))
+	for _, data := range c.Tags {
+		parsed, err := d.Feed(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("解析缓存数据: %w", err)
+		}
+		tags = append(tags, parsed...)
+	}
+	if len(tags) == 0 {
+		return nil, nil, broker.ErrClipRange
+	}
+	base := tags[0].Timestamp
+	for _, tag := range tags {
+		tag.Timestamp -= min(base, tag.Timestamp)
+	}
+	return header, tags, nil
+}
+
+// progressEvery 每处理这么多个 tag 更新一次进度，同时检查任务有没有被取消
+const progressEvery = 256
+
+// convert 依次处理每个 tag，定时更新进度（写文件的时间算在最后 10% 里）
+func (j *ClipJob) convert(ctx context.Context, tags []*flvBroker.FlvTag, fn func(tag *flvBroker.FlvTag) error) error {
+	for i, tag := range tags {
+		if i%progressEvery == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			j.update(func(s *ClipStatus) { s.Progress = 0.9 * float64(i) / float64(len(tags)) })
+		}
+		if err := fn(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFLV 起播头 + 时间戳从 0 开始的 tag
+func (j *ClipJob) writeFLV(ctx context.Context, f *os.File, header []byte, tags []*flvBroker.FlvTag) (time.Duration, error) {
+	w := bufio.NewWriter(f)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	var last uint32
+	err := j.convert(ctx, tags, func(tag *flvBroker.FlvTag) error {
+		last = max(last, tag.Timestamp)
+		_, err := w.Write(tag.ToBytes())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(last) * time.Millisecond, w.Flush()
+}
+
+// writeMP4 序列头和数据一起交给 mp4.Muxer，不支持的编码直接失败，提示改用 flv
+func (j *ClipJob) writeMP4(ctx context.Context, f *os.File, header, tags []*flvBroker.FlvTag) (time.Duration, error) {
+	m := mp4.NewMuxer()
+	add := func(tag *flvBroker.FlvTag) error {
+		p, ok := flvBroker.PacketFromTag(tag)
+		if !ok {
+			return nil
+		}
+		if err := m.WritePacket(p); err != nil {
+			return fmt.Errorf("%w，可以改用 flv 格式", err)
+		}
+		return nil
+	}
+	for _, tag := range header {
+		if err := add(tag); err != nil {
+			return 0, err
+		}
+	}
+	if err := j.convert(ctx, tags, add); err != nil {
+		return 0, err
+	}
+	if _, err := m.WriteTo(f); err != nil {
+		return 0, err
+	}
+	return m.Duration(), nil
+}
@@ -0,0 +1,313 @@
+package clip
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pull2push/core/broadcast"
+	"pull2push/core/broker"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ====================== ClipManager ======================
+
+// ClipManager 管理所有导出任务 map[id]*ClipJob，任务和文件在 Retention 之后一起删除
+type ClipManager struct {
+	mutex sync.Mutex
+	jobs  map[string]*ClipJob
+
+	dir         string        // 片段文件的保存目录
+	retention   time.Duration // 片段保留多久
+	maxDuration time.Duration // 单个片段的最大时长
+
+	broadcastPools []broadcast.Broadcaster // 依次在这些广播器里查找 Broker
+}
+
+func NewClipManager(dir string, retention, maxDuration time.Duration, broadcastPools ...broadcast.Broadcaster) *ClipManager {
+	return &ClipManager{
+		jobs:           make(map[string]*ClipJob),
+		dir:            dir,
+		retention:      retention,
+		maxDuration:    maxDuration,
+		broadcastPools: broadcastPools,
+	}
+}
+
+// findClipper 找到 brokerKey 对应的 Broker，它的缓存要能导出片段
+func (cm *ClipManager) findClipper(brokerKey string) (broker.Clipper, error) {
+	for _, pool := range cm.broadcastPools {
+		b, err := pool.FindBroker(brokerKey)
+		if err != nil {
+			continue
+		}
+		clipper, ok := b.(broker.Clipper)
+		if !ok {
+			return nil, fmt.Errorf("%s 不支持导出片段", brokerKey)
+		}
+		return clipper, nil
+	}
+	return nil, fmt.Errorf("未找到 %s 对应的Broker", brokerKey)
+}
+
+// Export 创建导出任务，返回任务编号；结束时间在将来时任务等到结束时间再导出
+func (cm *ClipManager) Export(brokerKey string, start, end time.Time, format CLIP_FORMAT) (string, error) {
+	if format != FormatMP4 && format != FormatFLV {
+		return "", fmt.Errorf("format 只能是 %s / %s", FormatMP4, FormatFLV)
+	}
+	if !end.After(start) {
+		return "", errors.New("end 必须晚于 start")
+	}
+	if cm.maxDuration > 0 && end.Sub(start) > cm.maxDuration {
+		return "", fmt.Errorf("片段最长 %v", cm.maxDuration)
+	}
+	// 结束时间在将来时任务要等到那时候，等太久的任务一直占着 goroutine
+	if wait := cm.maxWait(); time.Until(end) > wait {
+		return "", fmt.Errorf("end 最多在 %v 之后", wait)
+	}
+	if _, err := cm.findClipper(brokerKey); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(cm.dir, 0o755); err != nil {
+		return "", err
+	}
+
+	id := newClipId()
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &ClipJob{
+		path: filepath.Join(cm.dir, id+"."+string(format)),
+		find: cm.findClipper,
+		status: ClipStatus{
+			Id:        id,
+			BrokerKey: brokerKey,
+			Format:    format,
+			State:     ClipStateWaiting,
+			Start:     start,
+			End:       end,
+			CreatedAt: time.Now(),
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	cm.mutex.Lock()
+	cm.jobs[id] = job
+	cm.mutex.Unlock()
+
+	go job.run(ctx)
+	return id, nil
+}
+
+// defaultMaxWait 没有限制片段时长时，结束时间最多在多久之后
+const defaultMaxWait = 10 * time.Minute
+
+// maxWait 结束时间最多在多久之后：片段不超过 maxDuration，再晚的结束时间意味着开始时间也还没到
+func (cm *ClipManager) maxWait() time.Duration {
+	if cm.maxDuration > 0 {
+		return cm.maxDuration
+	}
+	return defaultMaxWait
+}
+
+// newClipId 任务编号，16 位十六进制随机数，同时也是文件名
+func newClipId() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Find 查找任务
+func (cm *ClipManager) Find(id string) (*ClipJob, bool) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	job, ok := cm.jobs[id]
+	return job, ok
+}
+
+// List 列出任务状态，brokerKey 为空时列出全部，按创建时间排序
+func (cm *ClipManager) List(brokerKey string) []ClipStatus {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+	list := make([]ClipStatus, 0, len(cm.jobs))
+	for _, job := range cm.jobs {
+		if s := job.Status(); brokerKey == "" || s.BrokerKey == brokerKey {
+			list = append(list, s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list
+}
+
+// Remove 取消任务并删除文件
+func (cm *ClipManager) Remove(id string) error {
+	cm.mutex.Lock()
+	job, ok := cm.jobs[id]
+	delete(cm.jobs, id)
+	cm.mutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("未找到导出任务 %s", id)
+	}
+	job.Stop()
+	if err := os.Remove(job.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Run 定时删除超过保留时间的片段
+func (cm *ClipManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cm.expire(now)
+		}
+	}
+}
+
+// expire 删除完成后超过保留时间的任务；没有完成的任务（等待中、卡住的）从创建时间开始算
+func (cm *ClipManager) expire(now time.Time) {
+	if cm.retention <= 0 {
+		return
+	}
+	var expired []string
+	cm.mutex.Lock()
+	for id, job := range cm.jobs {
+		s := job.Status()
+		since := s.FinishedAt
+		if since.IsZero() {
+			since = s.CreatedAt
+		}
+		if now.Sub(since) > cm.retention {
+			expired = append(expired, id)
+		}
+	}
+	cm.mutex.Unlock()
+	for _, id := range expired {
+		cm.Remove(id)
+	}
+}
+
+// ---------- HTTP 服务 ----------
+
+// parseClipTime 片段的开始 / 结束时间：RFC3339 时间，或者相对现在的时长（-30s 表示 30 秒以前），now 表示现在
+func parseClipTime(s string, now time.Time) (time.Time, error) {
+	if s == "now" {
+		return now, nil
+	}
+	if strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("时间 %q 格式不对", s)
+		}
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("时间 %q 格式不对，应该是 RFC3339 或者 -30s 这样的相对时间", s)
+	}
+	return t, nil
+}
+
+// ExportClip 从直播缓存导出片段  POST /live/clips  {"brokerKey": "test1", "start": "-30s", "end": "now", "format": "mp4"}
+func ExportClip(cm *ClipManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			BrokerKey string      `json:"brokerKey"`
+			Start     string      `json:"start"`
+			End       string      `json:"end"`
+			Format    CLIP_FORMAT `json:"format"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.BrokerKey == "" || body.Start == "" {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": "brokerKey、start 不能为空"})
+			return
+		}
+		if body.End == "" {
+			body.End = "now"
+		}
+		if body.Format == "" {
+			body.Format = FormatMP4
+		}
+		now := time.Now()
+		start, err := parseClipTime(body.Start, now)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		end, err := parseClipTime(body.End, now)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		id, err := cm.Export(body.BrokerKey, start, end, body.Format)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": gin.H{"id": id, "status": "/live/clips/" + id}})
+	}
+}
+
+// ListClips 查询导出任务  GET /live/clips?broker=test1
+func ListClips(cm *ClipManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": cm.List(c.Query("broker"))})
+	}
+}
+
+// GetClip 查询导出进度  GET /live/clips/:id，完成后 data.url 是下载地址
+func GetClip(cm *ClipManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		job, ok := cm.Find(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": "未找到导出任务"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": job.Status()})
+	}
+}
+
+// errClipNotReady 任务还没完成，没有文件可以下载
+var errClipNotReady = errors.New("片段还没有导出完成")
+
+// DownloadClip 下载片段文件  GET /live/clips/:id/file
+func DownloadClip(cm *ClipManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		job, ok := cm.Find(c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "未找到导出任务"})
+			return
+		}
+		s := job.Status()
+		if s.State != ClipStateDone {
+			c.JSON(http.StatusConflict, gin.H{"code": 409, "msg": errClipNotReady.Error(), "data": s})
+			return
+		}
+		name := fmt.Sprintf("%s-%s.%s", s.BrokerKey, s.ClipStart.Format("20060102-150405"), s.Format)
+		c.FileAttachment(job.path, name)
+	}
+}
+
+// RemoveClip 取消任务并删除片段  DELETE /live/clips/:id
+func RemoveClip(cm *ClipManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := cm.Remove(c.Param("id")); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
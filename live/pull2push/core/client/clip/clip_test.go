@@ -0,0 +1,357 @@
+package clip
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	flvBroadcast "pull2push/core/broadcast/flv"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubPool 只支持 FindBroker 的广播器
+type stubPool map[string]broker.Broker
+
+func (p stubPool) AddBroker(string, broker.Broker) {}
+func (p stubPool) RemoveBroker(string)             {}
+func (p stubPool) FindBroker(brokerKey string) (broker.Broker, error) {
+	if b, ok := p[brokerKey]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("未找到 %s", brokerKey)
+}
+
+// stubClipper 返回固定片段的 broker，记录 Clip 的参数
+type stubClipper struct {
+	broker.Broker
+	clip *broker.Clip
+
+	mu    sync.Mutex
+	calls [][2]time.Time
+}
+
+func (s *stubClipper) Clip(from, to time.Time) (*broker.Clip, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, [2]time.Time{from, to})
+	if s.clip == nil {
+		return nil, broker.ErrClipRange
+	}
+	return s.clip, nil
+}
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x02, 0x80, 0xBF, 0xE5}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+)
+
+// h264Clip 直播里时间戳从 1000 开始的一段 H.264，一个关键帧 + 两个 P 帧
+func h264Clip() *broker.Clip {
+	header := append(flvBroker.BuildFLVHeader(false, true),
+		flvBroker.NewVideoSequenceTag(flvBroker.CodecH264, flvBroker.AVCDecoderConfig(testSPS, testPPS), 0).ToBytes()...)
+	c := &broker.Clip{Header: header, Start: time.Now().Add(-time.Second), End: time.Now()}
+	for i := range 3 {
+		nalu := []byte{0x41, byte(i)}
+		if i == 0 {
+			nalu[0] = 0x65
+		}
+		c.Tags = append(c.Tags, flvBroker.NewVideoFrameTag(flvBroker.CodecH264, [][]byte{nalu}, i == 0, 1000+uint32(i)*40, 0).ToBytes())
+	}
+	return c
+}
+
+// av1Clip mp4.Muxer 不支持的编码，写到一半失败
+func av1Clip() *broker.Clip {
+	frame := flvBroker.NewFlvTag(flvBroker.TagTypeVideo, 1000,
+		flvBroker.BuildVideoTagData(flvBroker.FourCCAV1, flvBroker.VideoFrameKey, flvBroker.VideoPacketCodedFrames, 0, []byte{0x12, 0}))
+	return &broker.Clip{Header: flvBroker.BuildFLVHeader(false, true), Tags: [][]byte{frame.ToBytes()}}
+}
+
+func newTestManager(t *testing.T, brokers stubPool) *ClipManager {
+	return NewClipManager(t.TempDir(), time.Hour, time.Minute, brokers)
+}
+
+// waitFinished 等任务完成或失败
+func waitFinished(t *testing.T, job *ClipJob) ClipStatus {
+	t.Helper()
+	select {
+	case <-job.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("任务没有结束: %+v", job.Status())
+	}
+	return job.Status()
+}
+
+func TestParseClipTime(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		s    string
+		want time.Time
+		ok   bool
+	}{
+		{"now", now, true},
+		{"-30s", now.Add(-30 * time.Second), true},
+		{"+1m", now.Add(time.Minute), true},
+		{"-1h2m", now.Add(-62 * time.Minute), true},
+		{"2024-05-01T11:59:00Z", now.Add(-time.Minute), true},
+		{"2024-05-01T19:59:00+08:00", now.Add(-time.Minute), true},
+		{"-30", time.Time{}, false},
+		{"30s", time.Time{}, false},
+		{"2024-05-01 11:59:00", time.Time{}, false},
+		{"", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := parseClipTime(tt.s, now)
+		if (err == nil) != tt.ok || !got.Equal(tt.want) {
+			t.Errorf("parseClipTime(%q) = %v, %v", tt.s, got, err)
+		}
+	}
+}
+
+func TestExportValidation(t *testing.T) {
+	cm := newTestManager(t, stubPool{"a": &stubClipper{}, "plain": nil})
+	now := time.Now()
+	tests := []struct {
+		name       string
+		brokerKey  string
+		start, end time.Time
+		format     CLIP_FORMAT
+		msg        string
+	}{
+		{"格式不对", "a", now.Add(-time.Second), now, "avi", "format"},
+		{"end 早于 start", "a", now, now.Add(-time.Second), FormatMP4, "晚于"},
+		{"超过最大时长", "a", now.Add(-2 * time.Minute), now, FormatMP4, "最长"},
+		{"end 太远", "a", now.Add(time.Hour), now.Add(time.Hour + time.Second), FormatFLV, "之后"},
+		{"没有这路流", "b", now.Add(-time.Second), now, FormatMP4, "未找到"},
+		{"不支持导出", "plain", now.Add(-time.Second), now, FormatMP4, "不支持"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := cm.Export(tt.brokerKey, tt.start, tt.end, tt.format)
+			if err == nil || !strings.Contains(err.Error(), tt.msg) {
+				t.Fatalf("Export = %v，期望包含 %q", err, tt.msg)
+			}
+		})
+	}
+	if n := len(cm.List("")); n != 0 {
+		t.Fatalf("不应该创建任务，得到 %d 个", n)
+	}
+}
+
+func TestClipJobWaitingToDone(t *testing.T) {
+	clipper := &stubClipper{clip: h264Clip()}
+	cm := newTestManager(t, stubPool{"a": clipper})
+	start, end := time.Now().Add(-time.Second), time.Now().Add(200*time.Millisecond)
+	id, err := cm.Export("a", start, end, FormatFLV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, ok := cm.Find(id)
+	if !ok {
+		t.Fatal("找不到任务")
+	}
+	if s := job.Status(); s.State != ClipStateWaiting || s.URL != "" {
+		t.Fatalf("结束时间没到应该在等待: %+v", s)
+	}
+
+	s := waitFinished(t, job)
+	if s.State != ClipStateDone || s.Progress != 1 || s.URL != "/live/clips/"+id+"/file" {
+		t.Fatalf("任务状态 %+v", s)
+	}
+	if time.Since(end) < 0 {
+		t.Fatal("没等到结束时间就导出了")
+	}
+	if len(clipper.calls) != 1 || !clipper.calls[0][0].Equal(start) || !clipper.calls[0][1].Equal(end) {
+		t.Fatalf("Clip 参数 %v", clipper.calls)
+	}
+
+	// 写完后 .part 改名成正式文件，时间戳从 0 开始
+	if _, err := os.Stat(job.path + ".part"); !os.IsNotExist(err) {
+		t.Fatalf(".part 文件还在: %v", err)
+	}
+	data, err := os.ReadFile(job.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(data)) != s.Size || s.Duration != 0.08 {
+		t.Fatalf("size=%d/%d duration=%v", len(data), s.Size, s.Duration)
+	}
+	tags, err := flvBroker.NewFLVDemuxer().Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []uint32
+	for _, tag := range tags {
+		got = append(got, tag.Timestamp)
+	}
+	if len(tags) != 4 || !tags[0].IsSequenceHeader() || fmt.Sprint(got) != "[0 0 40 80]" {
+		t.Fatalf("文件里的时间戳 %v", got)
+	}
+	if list := cm.List("a"); len(list) != 1 || list[0].Id != id {
+		t.Fatalf("List = %+v", list)
+	}
+	if list := cm.List("b"); len(list) != 0 {
+		t.Fatalf("List(b) = %+v", list)
+	}
+}
+
+func TestClipJobMP4(t *testing.T) {
+	cm := newTestManager(t, stubPool{"a": &stubClipper{clip: h264Clip()}})
+	id, err := cm.Export("a", time.Now().Add(-time.Second), time.Now(), FormatMP4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := cm.Find(id)
+	if s := waitFinished(t, job); s.State != ClipStateDone || filepath.Ext(job.path) != ".mp4" {
+		t.Fatalf("任务状态 %+v", s)
+	}
+	data, err := os.ReadFile(job.path)
+	if err != nil || len(data) < 8 || string(data[4:8]) != "ftyp" {
+		t.Fatalf("不是 MP4 文件: %v", err)
+	}
+}
+
+func TestClipJobFailed(t *testing.T) {
+	tests := []struct {
+		name string
+		clip *broker.Clip
+		msg  string
+	}{
+		{"不在缓存里", nil, broker.ErrClipRange.Error()},
+		{"写到一半失败", av1Clip(), "可以改用 flv 格式"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cm := newTestManager(t, stubPool{"a": &stubClipper{clip: tt.clip}})
+			id, err := cm.Export("a", time.Now().Add(-time.Second), time.Now(), FormatMP4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			job, _ := cm.Find(id)
+			s := waitFinished(t, job)
+			if s.State != ClipStateFailed || !strings.Contains(s.Error, tt.msg) || s.FinishedAt.IsZero() {
+				t.Fatalf("任务状态 %+v", s)
+			}
+			// 失败时不留下文件，.part 也删掉
+			if entries, _ := os.ReadDir(cm.dir); len(entries) != 0 {
+				t.Fatalf("留下了文件 %v", entries)
+			}
+		})
+	}
+}
+
+// 等待期间流被重建时从新的 broker 导出，被移除时任务失败，不能去读已经关闭的 broker
+func TestClipJobBrokerChanged(t *testing.T) {
+	pool := flvBroadcast.NewFLVBroadcaster()
+	old := &stubClipper{clip: h264Clip()}
+	pool.AddBroker("a", old)
+	cm := NewClipManager(t.TempDir(), time.Hour, time.Minute, pool)
+	export := func() *ClipJob {
+		id, err := cm.Export("a", time.Now().Add(-time.Second), time.Now().Add(100*time.Millisecond), FormatFLV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		job, _ := cm.Find(id)
+		return job
+	}
+
+	job := export()
+	replaced := &stubClipper{clip: h264Clip()}
+	pool.AddBroker("a", replaced)
+	if s := waitFinished(t, job); s.State != ClipStateDone {
+		t.Fatalf("重建后的任务状态 %+v", s)
+	}
+
+	job = export()
+	pool.RemoveBroker("a")
+	if s := waitFinished(t, job); s.State != ClipStateFailed || !strings.Contains(s.Error, "已经不在") {
+		t.Fatalf("移除后的任务状态 %+v", s)
+	}
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	if len(old.calls) != 0 {
+		t.Fatalf("从旧 broker 导出了 %d 次", len(old.calls))
+	}
+	replaced.mu.Lock()
+	defer replaced.mu.Unlock()
+	if len(replaced.calls) != 1 {
+		t.Fatalf("新 broker 导出了 %d 次", len(replaced.calls))
+	}
+}
+
+func TestClipRemove(t *testing.T) {
+	cm := newTestManager(t, stubPool{"a": &stubClipper{clip: h264Clip()}})
+
+	// 取消还在等待的任务
+	id, err := cm.Export("a", time.Now(), time.Now().Add(30*time.Second), FormatFLV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ := cm.Find(id)
+	if err := cm.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if s := job.Status(); s.State != ClipStateFailed || !strings.Contains(s.Error, "canceled") {
+		t.Fatalf("取消后的状态 %+v", s)
+	}
+	if _, ok := cm.Find(id); ok {
+		t.Fatal("取消后任务还在")
+	}
+
+	// 删除已经完成的任务同时删除文件
+	id, err = cm.Export("a", time.Now().Add(-time.Second), time.Now(), FormatFLV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, _ = cm.Find(id)
+	waitFinished(t, job)
+	if err := cm.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(job.path); !os.IsNotExist(err) {
+		t.Fatalf("文件没有删除: %v", err)
+	}
+	if err := cm.Remove(id); err == nil {
+		t.Fatal("重复删除应该返回错误")
+	}
+}
+
+func TestClipExpire(t *testing.T) {
+	cm := newTestManager(t, stubPool{"a": &stubClipper{clip: h264Clip()}})
+	now := time.Now()
+	waiting, err := cm.Export("a", now, now.Add(30*time.Second), FormatFLV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := cm.Export("a", now.Add(-time.Second), now, FormatFLV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doneJob, _ := cm.Find(done)
+	waitFinished(t, doneJob)
+	doneJob.update(func(s *ClipStatus) { s.FinishedAt = now.Add(90 * time.Minute) })
+
+	cm.expire(now.Add(30 * time.Minute))
+	if n := len(cm.List("")); n != 2 {
+		t.Fatalf("没到保留时间，剩下 %d 个任务", n)
+	}
+	// 等待中的任务按创建时间过期，完成的任务按完成时间
+	cm.expire(now.Add(2 * time.Hour))
+	if _, ok := cm.Find(waiting); ok {
+		t.Fatal("等待中的任务没有过期")
+	}
+	if _, ok := cm.Find(done); !ok {
+		t.Fatal("完成的任务提前过期了")
+	}
+	cm.expire(now.Add(3 * time.Hour))
+	if _, ok := cm.Find(done); ok {
+		t.Fatal("完成的任务没有过期")
+	}
+	if _, err := os.Stat(doneJob.path); !os.IsNotExist(err) {
+		t.Fatalf("过期的文件没有删除: %v", err)
+	}
+}
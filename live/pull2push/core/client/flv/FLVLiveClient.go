@@ -1,158 +1,149 @@
 package flv
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 	"log"
 	"net/http"
 	flvBroadcast "pull2push/core/broadcast/flv"
+	"pull2push/core/broker"
 	"pull2push/core/broker/flv"
-	flvBroker "pull2push/core/broker/flv"
-	"runtime/debug"
+	"pull2push/core/memory"
+	"pull2push/core/session"
 )
 
 // ====================== FLVLiveClient ======================
 
-// FLVLiveClient 每一个前端页面有持有一个客户端对象
+// FLVLiveClient 每一个前端页面有持有一个客户端对象，挂在 FLVStreamBroker 上时从共享环形缓冲按自己的游标读取，
+// 挂在其他 broker（adapter.LegacyBroker 等）上时从 DataCh 读取
 type FLVLiveClient struct {
-	BrokerKey string        // 这个客户端的直播房间的唯一编号
-	ClientId  string        // 这个客户端的id
-	DataCh    chan []byte   // 这个客户端的一个只写通道
-	CloseSig  chan struct{} // broker被关闭时，同时通知客户端关闭
+	BrokerKey string           // 这个客户端的直播房间的唯一编号
+	ClientId  string           // 这个客户端的id，即服务端分配的会话编号
+	CloseSig  chan struct{}    // Listen 退出时关闭
+	DataCh    chan []byte      // 这个客户端的一个只写通道，只有不提供环形缓冲的 broker 才会用到
+	session   *session.Session // 观看会话，被踢出时取消
 
 	// http连接相关
-	httpRequest         *http.Request
-	responseWriter      io.Writer
-	flusher             http.Flusher
-	httpCloseSig        <-chan struct{} // 当这个请求被客户端主动被关闭时触发
-	httpRequestCloseSig <-chan struct{} // 当这个请求被客户端主动被关闭时触发
-
-	flvStreamBroker *flv.FLVStreamBroker
+	ctx            context.Context // 请求结束或被踢出时取消
+	responseWriter io.Writer
+	flusher        http.Flusher
+
+	reader     flv.PacketReader // FLVStreamBroker 为环形缓冲游标，其他 broker 为 DataCh
+	cursor     *flv.RingCursor  // 在 broker 环形缓冲里的读取位置，不读环形缓冲时为 nil
+	account    *memory.Account  // DataCh 的内存记账，读环形缓冲时为 nil
+	liveBroker broker.Broker
 }
 
-func NewFLVLiveClient(c *gin.Context, brokerKey, clientId string, dataCh1 chan []byte, gOPCache *flv.GOPCache, flvStreamBroker *flv.FLVStreamBroker) (*FLVLiveClient, error) {
-	// 创建一个带缓冲的双向通道，缓冲大小根据需求调节
-	dataCh := make(chan []byte, 4096)
-
+func NewFLVLiveClient(c *gin.Context, sess *session.Session, b broker.Broker) (*FLVLiveClient, error) {
 	// gin.ResponseWriter 是接口，不能用指针
 	var writer io.Writer = c.Writer
 
 	// 断言出 http.Flusher 接口，方便主动刷新数据
 	flusher, ok := writer.(http.Flusher)
 	if !ok {
-		// 不支持刷新，可能无法做到流式推送
-		log.Println("ResponseWriter does not support Flusher interface")
+		// 不支持刷新，无法做到流式推送
+		return nil, fmt.Errorf("ResponseWriter does not support Flusher interface")
 	}
 
 	hc := FLVLiveClient{
-		BrokerKey:           brokerKey,
-		ClientId:            clientId,
-		DataCh:              dataCh,
-		CloseSig:            make(chan struct{}),
-		httpRequest:         c.Request,
-		responseWriter:      writer,
-		flusher:             flusher,
-		httpCloseSig:        c.Done(),
-		httpRequestCloseSig: c.Request.Context().Done(),
-		flvStreamBroker:     flvStreamBroker,
+		BrokerKey:      sess.BrokerKey,
+		ClientId:       sess.ID,
+		CloseSig:       make(chan struct{}),
+		session:        sess,
+		ctx:            sess.Context(),
+		responseWriter: writer,
+		flusher:        flusher,
+		liveBroker:     b,
+	}
+	if fb, ok := b.(*flv.FLVStreamBroker); ok {
+		hc.cursor = fb.SubscribeAt(sess.Start)
+		hc.reader = hc.cursor
+	} else {
+		hc.DataCh = make(chan []byte, 4096)
+		hc.reader = flv.ChanReader(hc.DataCh)
+		hc.account = memory.Default.Open(sess.BrokerKey)
+		hc.account.Charge(memory.ChanOverhead(cap(hc.DataCh)))
 	}
 
-	fmt.Println("客户端连接成功 ClientId = ", clientId)
-
-	//// 确保头部信息已解析
-	//flvStreamBroker.HeaderMutex.RLock()
-	//headerParsed := flvStreamBroker.HeaderParsed
-	//headerBytes := flvStreamBroker.HeaderBytes
-	//flvStreamBroker.HeaderMutex.RUnlock()
-	//
-	//if !headerParsed {
-	//	return nil, fmt.Errorf("FLV头部尚未解析完成，请先调用Start()")
-	//}
-	//
-	//// 一次性写入头部数据
-	//if _, err := writer.Write(headerBytes); err != nil {
-	//	return nil, fmt.Errorf("写入FLV头部失败: %v", err)
-	//}
-
-	// 持续监控是否一些控制通道的消息
-	go hc.Listen()
+	fmt.Println("客户端连接成功 ClientId = ", sess.ID)
 
 	return &hc, nil
 }
 
-// Listen 客户端监听器
+// Listen 客户端监听器：按游标读取数据写给前端，直到请求结束、被踢出、broker 关闭或写出错
+// 在 http 请求的 goroutine 里运行，返回之后才能把 responseWriter 交还给 gin
 func (hc *FLVLiveClient) Listen() {
+	defer close(hc.CloseSig)
+	defer hc.releaseAccount()
+	defer hc.liveBroker.RemoveLiveClient(hc.ClientId)
 
+	var batch [][]byte
+	resyncs := 0
 	for {
-		select {
-		case data, ok := <-hc.DataCh:
-			//fmt.Printf("接收到数据 len = %d \n", len(data))
-			if ok {
-
-				if hc.responseWriter == nil || hc.flusher == nil {
-					log.Println("responseWriter 或 flusher 已经无效，退出")
-					return
-				}
-
-				_, err := hc.responseWriter.Write(data)
-				if err != nil {
-					// 写出错，关闭连接
-					return
-				}
-				hc.flusher.Flush()
+		var err error
+		batch, err = hc.reader.Next(hc.ctx, batch[:0])
+		for _, data := range batch {
+			n, werr := hc.responseWriter.Write(data)
+			hc.session.AddBytes(n)
+			if werr != nil {
+				// 写出错，关闭连接
+				return
+			}
+		}
+		if len(batch) > 0 {
+			hc.flusher.Flush()
+		}
+		if err != nil {
+			switch {
+			case hc.session.Signal() != nil:
+				fmt.Println("客户端被踢出，退出循环 ", hc.ClientId, hc.session.Signal().Reason)
+			case errors.Is(err, io.EOF):
+				fmt.Println("broker 已关闭，退出循环 ", hc.ClientId)
+			default:
+				fmt.Println("收到客户端关闭信号，退出循环 ", hc.ClientId)
 			}
-		case <-hc.httpCloseSig:
-			hc.CloseSig <- struct{}{}
-			// 收到关闭信号，退出循环
-			fmt.Println("hc.httpCloseSig 收到客户端关闭信号，退出循环 ", hc.ClientId)
-
-			// when client closes, remove it
-			hc.flvStreamBroker.RemoveLiveClient(hc.ClientId)
-
-			close(hc.CloseSig)
-
 			return
-		case <-hc.httpRequestCloseSig:
-			hc.CloseSig <- struct{}{}
-			// 收到关闭信号，退出循环
-			fmt.Println("<-hc.httpRequestCloseSig 收到客户端关闭信号，退出循环 ", hc.ClientId)
+		}
+		if hc.cursor != nil && hc.cursor.Resyncs != resyncs {
+			resyncs = hc.cursor.Resyncs
+			log.Printf("[flv:%s] client %s 太慢被追上，已跳到最近的关键帧（第 %d 次）", hc.BrokerKey, hc.ClientId, resyncs)
+		}
+	}
+}
 
-			// when client closes, remove it
-			hc.flvStreamBroker.RemoveLiveClient(hc.ClientId)
+// Kick 服务端主动断开这个客户端，响应头已经发出，原因只能记在会话上
+func (hc *FLVLiveClient) Kick(reason string) {
+	hc.session.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+}
 
-			close(hc.CloseSig)
+// ReadsRing 挂在 FLVStreamBroker 上时由 Listen 从环形缓冲读取，见 client.RingReader
+func (hc *FLVLiveClient) ReadsRing() {}
 
-			return
-		}
-	}
+// StartMode 请求参数 ?start= 指定的起播方式，见 broker.StartModer
+func (hc *FLVLiveClient) StartMode() broker.START_MODE {
+	return hc.session.Start
 }
 
-// GetDataChan 获取当前客户端的写通道
+// GetDataChan 获取当前客户端的写通道，读环形缓冲时为 nil
 func (hc *FLVLiveClient) GetDataChan() chan []byte {
 	return hc.DataCh
 }
-func (hc *FLVLiveClient) Broadcast(data []byte) {
 
-	defer func() {
-		if err := recover(); err != nil {
-			// 这里写自定义日志处理  打印堆栈
-			log.Printf("panic recovered: %v: %v\n stack trace:\n%s", err, debug.Stack())
-		}
-	}()
-
-	if hc.responseWriter == nil || hc.flusher == nil {
-		log.Println("responseWriter 或 flusher 已经无效，退出")
-		return
-	}
-
-	_, err := hc.responseWriter.Write(data)
-	if err != nil {
-		// 写出错，关闭连接
-		return
+// Broadcast 非阻塞写入通道，客户端太慢时丢包，避免阻塞上游；读环形缓冲时不会被调用
+func (hc *FLVLiveClient) Broadcast(data []byte) {
+	select {
+	case hc.DataCh <- data:
+	default:
 	}
-	hc.flusher.Flush()
+}
 
+// releaseAccount 客户端结束时归还 DataCh 的内存记账
+func (hc *FLVLiveClient) releaseAccount() {
+	hc.account.Free(memory.ChanOverhead(cap(hc.DataCh)))
+	hc.account.Close()
 }
 
 // ---------- HTTP 服务 ----------
@@ -161,6 +152,24 @@ func (hc *FLVLiveClient) Broadcast(data []byte) {
 func LiveFlv(flvBroadcastPool *flvBroadcast.FLVBroadcaster) func(c *gin.Context) {
 	return func(c *gin.Context) {
 
+		brokerKey := c.Param("brokerKey")
+
+		// 找不到 broker 时在写响应头之前返回 404，集群里的 edge 据此切换到下一个候选节点
+		liveBroker, err := flvBroadcastPool.FindBroker(brokerKey)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+
+		// 准入检查在写响应头之前，超出限制时还能返回状态码或者重定向到其他节点；
+		// broker 里用服务端分配的会话编号登记，地址里的 clientId 重复也不会互相顶掉
+		sess, err := session.Default.Open(c, c.Request.Context(), brokerKey, "flv")
+		if err != nil {
+			session.Default.Reject(c, brokerKey, err)
+			return
+		}
+		defer sess.End()
+
 		c.Header("Content-Type", "video/x-flv")
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Transfer-Encoding", "chunked")
@@ -173,29 +182,22 @@ func LiveFlv(flvBroadcastPool *flvBroadcast.FLVBroadcaster) func(c *gin.Context)
 		// 确保响应缓冲区被刷新
 		c.Writer.Flush()
 
-		brokerKey := c.Param("brokerKey")
-		clientId := c.Param("clientId")
-
-		broker, _ := flvBroadcastPool.FindBroker(brokerKey)
-		flvStreamBroker, _ := broker.(*flvBroker.FLVStreamBroker)
-		flvStreamBroker.RemoveLiveClient(clientId)
-
 		// 阻塞客户端
 		//<-c.Request.Context().Done()
 
 		//// 或者使用以下逻辑
 		c.Stream(func(w io.Writer) bool {
 
-			liveFLVClient, err := NewFLVLiveClient(c, brokerKey, clientId, flvStreamBroker.DataCh, flvStreamBroker.GOPCache, flvStreamBroker)
+			liveFLVClient, err := NewFLVLiveClient(c, sess, liveBroker)
 			if err != nil {
 				c.JSON(500, err)
 				return false
 			}
 
-			flvStreamBroker.AddLiveClient(clientId, liveFLVClient)
+			liveBroker.AddLiveClient(sess.ID, liveFLVClient)
 
-			// 这里写数据推送逻辑，或者直接阻塞直到连接关闭
-			<-c.Request.Context().Done()
+			// 阻塞直到连接关闭或被踢出，gin 在 Stream 返回后还会 Flush，不能和 Listen 同时操作 responseWriter
+			liveFLVClient.Listen()
 			return false
 		})
 
@@ -0,0 +1,78 @@
+package flv
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	flvBroadcast "pull2push/core/broadcast/flv"
+	"pull2push/core/broker/adapter"
+	cameraBroker "pull2push/core/broker/camera"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/stream"
+	"testing"
+	"time"
+)
+
+// 广播器里的 broker 不是 FLVStreamBroker（adapter.LegacyBroker 包装的新 broker）时，观众从写通道读取
+func TestLiveFlvLegacyBroker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sb := cameraBroker.NewCameraBroker("legacy", 0)
+	lb, err := adapter.NewLegacyBroker(ctx, "legacy", sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Close()
+	for _, p := range []stream.Packet{
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, Config: true, Payload: []byte{1, 0x64, 0, 0x1F}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: 40 * time.Millisecond, PTS: 40 * time.Millisecond, KeyFrame: true, Payload: []byte{0, 0, 0, 1, 0x65}},
+	} {
+		if err := sb.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pool := flvBroadcast.NewFLVBroadcaster()
+	pool.AddBroker("legacy", lb)
+
+	r := gin.New()
+	r.GET("/live/flv/:brokerKey/:clientId", LiveFlv(pool))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/live/flv/legacy/viewer", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("状态码 %d", resp.StatusCode)
+	}
+
+	// 起播数据：FLV 头 + 序列头 + 关键帧
+	var got []byte
+	demuxer := flvBroker.NewFLVDemuxer()
+	buf := make([]byte, 4096)
+	for seq, key := false, false; !seq || !key; {
+		n, err := resp.Body.Read(buf)
+		if err != nil {
+			t.Fatalf("读取 flv: %v，已经收到 % x", err, got)
+		}
+		got = append(got, buf[:n]...)
+		tags, err := demuxer.Feed(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range tags {
+			seq = seq || tag.IsSequenceHeader()
+			key = key || (tag.IsKeyFrame() && !tag.IsSequenceHeader())
+		}
+	}
+	if !bytes.HasPrefix(got, []byte("FLV")) {
+		t.Fatalf("没有 FLV 头: % x", got[:9])
+	}
+}
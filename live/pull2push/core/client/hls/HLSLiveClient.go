@@ -5,39 +5,36 @@ import (
 	"github.com/gin-gonic/gin"
 	"net/http"
 	hlsBroadcast "pull2push/core/broadcast/hls"
+	"pull2push/core/broker"
 	hlsBroker "pull2push/core/broker/hls"
+	"pull2push/core/session"
 	"strings"
 )
 
 // ====================== HLSLiveClient ======================
 
-// HLSLiveClient 每一个前端页面有持有一个客户端对象
+// HLSLiveClient 每一个前端页面有持有一个客户端对象，hls 是短请求轮询，客户端跟着观看会话走，会话空闲超时后移除
 type HLSLiveClient struct {
 	BrokerKey string      // 这个客户端的直播房间的唯一编号
-	ClientId  string      // 这个客户端的id
+	ClientId  string      // 这个客户端的id，即服务端分配的会话编号，播放列表里的分片地址都带着它
 	DataCh    chan []byte // 这个客户端的一个只写通道
 
-	// http连接相关
-	httpCloseSig        <-chan struct{} // 当这个请求被客户端主动被关闭时触发
-	httpRequestCloseSig <-chan struct{} // 当这个请求被客户端主动被关闭时触发
+	session *session.Session // 观看会话
 
 	// 父级 Broker相关的内容
-	clientCloseSig chan<- string   // broker通过该信道监听客户端离线 【仅发送】
 	brokerCloseSig <-chan struct{} // broker被关闭时，同时通知客户端关闭 【仅接收】
 }
 
-func NewHLSLiveClient(c *gin.Context, brokerKey, clientId string, clientCloseSig chan<- string, brokerCloseSig <-chan struct{}) (*HLSLiveClient, error) {
+func NewHLSLiveClient(sess *session.Session, brokerCloseSig <-chan struct{}) (*HLSLiveClient, error) {
 
 	hlc := HLSLiveClient{
-		BrokerKey:           brokerKey,
-		ClientId:            clientId,
-		httpCloseSig:        c.Done(),
-		httpRequestCloseSig: c.Request.Context().Done(),
-		clientCloseSig:      clientCloseSig,
-		brokerCloseSig:      brokerCloseSig,
+		BrokerKey:      sess.BrokerKey,
+		ClientId:       sess.ID,
+		session:        sess,
+		brokerCloseSig: brokerCloseSig,
 	}
 
-	fmt.Println("HLS 客户端连接成功 ClientId = ", clientId)
+	fmt.Println("HLS 客户端连接成功 ClientId = ", sess.ID)
 
 	// 开启状态监听
 	go hlc.Listen()
@@ -45,30 +42,13 @@ func NewHLSLiveClient(c *gin.Context, brokerKey, clientId string, clientCloseSig
 	return &hlc, nil
 }
 
+// Listen broker 关闭时结束会话，会话被踢出或结束时退出
 func (hlc *HLSLiveClient) Listen() {
 
-	for {
-		select {
-		case <-hlc.httpCloseSig:
-			//// 收到关闭信号，退出循环
-			//fmt.Println("hlc.httpCloseSig 收到客户端关闭信号，退出循环 ", hlc.ClientId)
-			//
-			//// when client closes, remove it
-			//hlc.clientCloseSig <- hlc.ClientId
-
-			return
-		case <-hlc.httpRequestCloseSig:
-			//// 收到关闭信号，退出循环
-			//fmt.Println("<-hlc.httpRequestCloseSig 收到客户端关闭信号，退出循环 ", hlc.ClientId)
-			//
-			//// when client closes, remove it
-			//hlc.clientCloseSig <- hlc.ClientId
-
-			return
-
-		case <-hlc.brokerCloseSig:
-			return
-		}
+	select {
+	case <-hlc.session.Context().Done():
+	case <-hlc.brokerCloseSig:
+		hlc.session.End()
 	}
 
 }
@@ -82,6 +62,11 @@ func (hlc *HLSLiveClient) GetDataChan() chan []byte {
 	return hlc.DataCh
 }
 
+// Kick 服务端主动断开这个客户端，之后这个会话的请求都返回 403 和原因，直到会话空闲超时
+func (hlc *HLSLiveClient) Kick(reason string) {
+	hlc.session.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+}
+
 // ---------- HTTP 服务 ----------
 
 // LiveHLS 处理 hls 的拉流转推
@@ -89,9 +74,8 @@ func LiveHLS(hlsBroadcastPool *hlsBroadcast.HLSBroadcaster) func(c *gin.Context)
 	return func(c *gin.Context) {
 
 		brokerKey := c.Param("brokerKey")
-		clientId := c.Param("clientId")
 
-		broker, err := hlsBroadcastPool.FindBroker(brokerKey)
+		foundBroker, err := hlsBroadcastPool.FindBroker(brokerKey)
 		if err != nil {
 			c.JSON(http.StatusOK, gin.H{
 				"code": 404,
@@ -100,39 +84,86 @@ func LiveHLS(hlsBroadcastPool *hlsBroadcast.HLSBroadcaster) func(c *gin.Context)
 			return
 		}
 
-		hlsM3U8Broker, _ := broker.(*hlsBroker.HLSM3U8Broker)
+		hlsM3U8Broker, _ := foundBroker.(*hlsBroker.HLSM3U8Broker)
 
 		filepath := c.Param("filepath")
-		//  "xxx/index.m3u8" 结尾的就是第一次请求，这时通过 HandleIndex 接口第一次返回本地缓存的数据片给前端使用
-		if strings.HasSuffix(filepath, "/index.m3u8") {
-
-			hlsLiveClient, err := NewHLSLiveClient(c, brokerKey, clientId, hlsM3U8Broker.ClientCloseSig, hlsM3U8Broker.BrokerCloseSig)
+		sess, ok := session.Default.Get(c.Param("clientId"))
+		if !ok || sess.BrokerKey != brokerKey || sess.Protocol != "hls" {
+			// 地址里不是这路直播的会话编号：第一次请求 index.m3u8，分配会话，返回只有一个码率的 master playlist，
+			// 播放器之后刷新的都是带会话编号的播放列表，同一个 clientId 的多个观众也不会混在一起
+			if !strings.HasSuffix(filepath, "/index.m3u8") {
+				c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": "会话不存在或已过期，请重新请求 index.m3u8"})
+				return
+			}
+			// 只有新观众检查准入限制，已经在看的观众刷新播放列表、下载分片不受影响
+			sess, err = session.Default.OpenPoll(c, brokerKey, "hls", session.PollIdle)
 			if err != nil {
-				c.JSON(500, err)
+				session.Default.Reject(c, brokerKey, err)
 				return
 			}
-			hlsM3U8Broker.AddLiveClient(clientId, hlsLiveClient)
-
-			// 第一次链接，返回最新的直播数据分片
-			hlsLiveClient.HandleIndex(c.Writer, c.Request, hlsM3U8Broker)
-
+			sess.OnEnd(func() {
+				if b, err := hlsBroadcastPool.FindBroker(brokerKey); err == nil {
+					b.RemoveLiveClient(sess.ID)
+				}
+			})
+			writeMasterPlaylist(c, sess, hlsM3U8Broker)
 			return
 		}
-		// xxx/2689.ts 表示此时前端不是第一次掉接口了，是来获取缓存数据分片的，那么通过 HandleSegment 来下载数据分片
+		if sig := sess.Signal(); sig != nil {
+			c.JSON(http.StatusForbidden, gin.H{"code": 403, "msg": sig.Reason})
+			return
+		}
+		sess.Touch()
 
-		liveClient, err := hlsM3U8Broker.FindLiveClient(clientId)
+		liveClient, err := hlsM3U8Broker.FindLiveClient(sess.ID)
 		if err != nil {
-			c.JSON(500, err)
-			return
+			// 会话的第一次请求，或者 broker 重建过
+			liveClient, err = NewHLSLiveClient(sess, hlsM3U8Broker.BrokerCloseSig)
+			if err != nil {
+				c.JSON(500, err)
+				return
+			}
+			hlsM3U8Broker.AddLiveClient(sess.ID, liveClient)
 		}
 		hlsLiveClient, _ := liveClient.(*HLSLiveClient)
-		// 返回本地缓存的数据分片
+
+		//  "xxx/index.m3u8" 结尾的是播放列表请求，通过 HandleIndex 返回本地缓存的数据片给前端使用
+		if strings.HasSuffix(filepath, "/index.m3u8") {
+			hlsLiveClient.HandleIndex(c.Writer, c.Request, hlsM3U8Broker)
+			return
+		}
+		// xxx/2689.ts 表示是来获取缓存数据分片的，那么通过 HandleSegment 来下载数据分片
 		hlsLiveClient.HandleSegment(c.Writer, c.Request, hlsM3U8Broker)
 		// /live/hls/test-hls/c91b431e-ba21-47c9-8649-a05ce2490838/index.m3u8
 
 	}
 }
 
+// writeMasterPlaylist 返回指向会话播放列表的 master playlist，带上原请求的查询参数（鉴权 token 等）
+func writeMasterPlaylist(c *gin.Context, sess *session.Session, hlsM3U8Broker *hlsBroker.HLSM3U8Broker) {
+	uri := "/live/hls/" + sess.BrokerKey + "/" + sess.ID + "/index.m3u8"
+	if c.Request.URL.RawQuery != "" {
+		uri += "?" + c.Request.URL.RawQuery
+	}
+	// BANDWIDTH 是必填项，按缓存的分片估算，还没有分片时随便给一个
+	bandwidth := 1000000
+	if hlsM3U8Broker.StreamState0 != nil {
+		segs, _, _, _ := hlsM3U8Broker.StreamState0.Snapshot()
+		var size, dur float64
+		for _, seg := range segs {
+			size += float64(len(seg.Data))
+			dur += seg.Dur
+		}
+		if dur > 0 {
+			bandwidth = int(size * 8 / dur)
+		}
+	}
+	pl := fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-STREAM-INF:BANDWIDTH=%d\n%s\n", bandwidth, uri)
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/vnd.apple.mpegurl", []byte(pl))
+	sess.AddBytes(len(pl))
+}
+
 func (hlc *HLSLiveClient) HandleIndex(w http.ResponseWriter, r *http.Request, hlsM3U8Broker *hlsBroker.HLSM3U8Broker) {
 	// /live/hls/{brokerKey}/{clientID}/index.m3u8
 	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
@@ -153,7 +184,8 @@ func (hlc *HLSLiveClient) HandleIndex(w http.ResponseWriter, r *http.Request, hl
 	}
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.Header().Set("Cache-Control", "no-store")
-	_, _ = w.Write([]byte(pl))
+	n, _ := w.Write([]byte(pl))
+	hlc.session.AddBytes(n)
 }
 
 func (hlc *HLSLiveClient) HandleSegment(w http.ResponseWriter, r *http.Request, hlsM3U8Broker *hlsBroker.HLSM3U8Broker) {
@@ -198,7 +230,8 @@ func (hlc *HLSLiveClient) HandleSegment(w http.ResponseWriter, r *http.Request,
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 	w.Header().Set("Cache-Control", "public, max-age=60")
-	_, _ = w.Write(seg.Data)
+	n, _ := w.Write(seg.Data)
+	hlc.session.AddBytes(n)
 }
 
 // buildMediaPlaylist HTTP 播放列表生成与分片访问
@@ -225,6 +258,11 @@ func (hlc *HLSLiveClient) buildMediaPlaylist(segs []*hlsBroker.Segment, seqStart
 	}
 
 	base := fmt.Sprintf("/live/hls/" + hlc.BrokerKey + "/" + hlc.ClientId + "/")
+	// 分片地址带上播放列表的查询参数，开启鉴权时 token 才能传到分片请求上
+	query := ""
+	if r.URL.RawQuery != "" {
+		query = "?" + r.URL.RawQuery
+	}
 	for _, s := range segs {
 		if s == nil {
 			continue
@@ -233,7 +271,7 @@ func (hlc *HLSLiveClient) buildMediaPlaylist(segs []*hlsBroker.Segment, seqStart
 			b.WriteString("#EXT-X-DISCONTINUITY\n")
 		}
 		b.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n", s.Dur))
-		b.WriteString(base + s.LocalName + "\n")
+		b.WriteString(base + s.LocalName + query + "\n")
 	}
 	return b.String(), nil
 }
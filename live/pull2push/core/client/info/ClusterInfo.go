@@ -0,0 +1,31 @@
+package info
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/core/cluster"
+)
+
+// LiveCluster 查询 brokerKey 在集群中的 origin 和故障转移顺序，单机运行时 c 为 nil
+func LiveCluster(c *cluster.Cluster) func(ctx *gin.Context) {
+	return func(ctx *gin.Context) {
+		if c == nil {
+			ctx.JSON(http.StatusOK, gin.H{"code": 200, "msg": "未开启集群模式", "data": gin.H{"enabled": false}})
+			return
+		}
+		brokerKey := ctx.Param("brokerKey")
+		candidates := c.Candidates(brokerKey)
+		ctx.JSON(http.StatusOK, gin.H{
+			"code": 200,
+			"msg":  "ok",
+			"data": gin.H{
+				"enabled":    true,
+				"self":       c.Self,
+				"nodes":      c.Nodes(),
+				"origin":     candidates[0],
+				"isOrigin":   candidates[0] == c.Self,
+				"candidates": candidates,
+			},
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package info
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/core/broadcast"
+	"pull2push/core/broker"
+	"pull2push/core/memory"
+)
+
+// LiveInfo 查询 broker 当前的编码参数（codec / 分辨率 / fps）和实时统计（码率 / GOP 长度），
+// 运维不用打开播放器就能确认编码器配置
+func LiveInfo(broadcastPools ...broadcast.Broadcaster) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey := c.Param("brokerKey")
+
+		b := findBroker(brokerKey, broadcastPools)
+		if b == nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": fmt.Sprintf("brokerKey %s 不存在", brokerKey)})
+			return
+		}
+
+		provider, ok := b.(broker.MediaInfoProvider)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"code": 501, "msg": fmt.Sprintf("brokerKey %s 不支持查询媒体信息", brokerKey)})
+			return
+		}
+		mediaInfo := provider.MediaInfo()
+		if mediaInfo == nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"code": 503, "msg": fmt.Sprintf("brokerKey %s 还没有收到音视频数据", brokerKey)})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": mediaInfo})
+	}
+}
+
+// LiveStats 查询 broker 的运行统计：媒体信息 + 健康状态（断流、时间戳异常、关键帧间隔、音视频偏差等事件）+ 缓存占用的内存
+func LiveStats(broadcastPools ...broadcast.Broadcaster) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey := c.Param("brokerKey")
+
+		b := findBroker(brokerKey, broadcastPools)
+		if b == nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": fmt.Sprintf("brokerKey %s 不存在", brokerKey)})
+			return
+		}
+
+		data := gin.H{"brokerKey": brokerKey, "memoryBytes": memory.Default.Usage(brokerKey)}
+		if provider, ok := b.(broker.MediaInfoProvider); ok {
+			data["media"] = provider.MediaInfo()
+		}
+		if reporter, ok := b.(broker.HealthReporter); ok {
+			data["health"] = reporter.HealthReport()
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": data})
+	}
+}
+
+// LiveMemory 查询进程内存预算和各路流的缓存占用
+func LiveMemory() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": memory.Default.Stats()})
+	}
+}
+
+// findBroker 依次在各个广播池里查找 broker
+func findBroker(brokerKey string, broadcastPools []broadcast.Broadcaster) broker.Broker {
+	for _, pool := range broadcastPools {
+		if found, err := pool.FindBroker(brokerKey); err == nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+package push
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"pull2push/core/broadcast"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/memory"
+	"pull2push/core/rtmp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+转推（push out）：把某一个 Broker 的直播数据再推到其他服务器，用于一路摄像头同时分发到多个平台。
+
+	每一个推流目标都是挂在 Broker 上的一个 LiveClient，和前端观众一样从 Broker 收数据，
+	区别在于它把数据写到远端服务器，而不是写给 http 响应。
+
+支持的目标地址：
+	rtmp://host/app/stream        RTMP 推流（需要 FLV 数据源）
+	http(s)://host/path           HTTP POST 推流（HTTP-FLV POST、另一个 pull2push 的 /live/camera/ingest/:brokerKey）
+
+每个目标有独立的重连循环、退避和状态，可以在运行时添加/移除。
+*/
+
+const (
+	pushQueueSize   = 4096             // 推流目标的数据通道大小
+	pushMinBackoff  = time.Second      // 重连的最小退避
+	pushMaxBackoff  = 30 * time.Second // 重连的最大退避
+	pushIdleTimeout = 15 * time.Second // 超过该时间收不到 Broker 数据则认为源中断并重连
+)
+
+// 推流目标状态
+const (
+	PushStateConnecting = "connecting"
+	PushStatePushing    = "pushing"
+	PushStateBackoff    = "backoff"
+	PushStateStopped    = "stopped"
+)
+
+// PushStatus 推流目标的状态快照
+type PushStatus struct {
+	TargetId    string    `json:"targetId"`
+	BrokerKey   string    `json:"brokerKey"`
+	URL         string    `json:"url"`
+	State       string    `json:"state"`
+	LastError   string    `json:"lastError,omitempty"`
+	Retries     int       `json:"retries"`
+	BytesSent   int64     `json:"bytesSent"`
+	ConnectedAt time.Time `json:"connectedAt,omitempty"`
+}
+
+// ====================== PushLiveClient ======================
+
+// PushLiveClient 一个推流目标，对 Broker 来说它就是一个普通的客户端
+type PushLiveClient struct {
+	TargetId  string      // 推流目标编号
+	BrokerKey string      // 数据来源的直播房间编号
+	URL       string      // 推流目标地址
+	dataCh    chan []byte // 从 Broker 收到的数据
+
+	broadcastPool broadcast.Broadcaster // 用于查找 Broker
+
+	mu     sync.Mutex
+	status PushStatus
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func NewPushLiveClient(broadcastPool broadcast.Broadcaster, brokerKey, targetId, targetURL string) (*PushLiveClient, error) {
+	if !strings.HasPrefix(targetURL, "rtmp://") && !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
+		return nil, fmt.Errorf("不支持的推流地址 %s", targetURL)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	plc := PushLiveClient{
+		TargetId:      targetId,
+		BrokerKey:     brokerKey,
+		URL:           targetURL,
+		dataCh:        make(chan []byte, pushQueueSize),
+		broadcastPool: broadcastPool,
+		status: PushStatus{
+			TargetId:  targetId,
+			BrokerKey: brokerKey,
+			URL:       targetURL,
+			State:     PushStateConnecting,
+		},
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go plc.Listen()
+
+	return &plc, nil
+}
+
+// clientId 推流目标在 Broker 里的客户端编号
+func (plc *PushLiveClient) clientId() string {
+	return "push-" + plc.TargetId
+}
+
+// Broadcast 非阻塞写入，推流目标太慢时丢包，不影响其他客户端
+func (plc *PushLiveClient) Broadcast(data []byte) {
+	select {
+	case plc.dataCh <- data:
+	default:
+	}
+}
+
+// GetDataChan 获取当前客户端的写通道
+func (plc *PushLiveClient) GetDataChan() chan []byte {
+	return plc.dataCh
+}
+
+// Status 当前状态快照
+func (plc *PushLiveClient) Status() PushStatus {
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+	return plc.status
+}
+
+// Stop 停止推流并等待重连循环退出
+func (plc *PushLiveClient) Stop() {
+	plc.cancel()
+	<-plc.done
+}
+
+func (plc *PushLiveClient) setState(state string, err error) {
+	plc.mu.Lock()
+	defer plc.mu.Unlock()
+	plc.status.State = state
+	if err != nil {
+		plc.status.LastError = err.Error()
+	}
+	if state == PushStatePushing {
+		plc.status.ConnectedAt = time.Now()
+	}
+}
+
+// Listen 重连循环：连接目标 -> 挂到 Broker 上 -> 持续写数据，出错后退避重连
+func (plc *PushLiveClient) Listen() {
+	defer close(plc.done)
+
+	backoff := pushMinBackoff
+	for {
+		plc.setState(PushStateConnecting, nil)
+		started := time.Now()
+		err := plc.pushOnce()
+		if plc.ctx.Err() != nil {
+			plc.setState(PushStateStopped, nil)
+			log.Printf("[push:%s] target %s stopped", plc.BrokerKey, plc.URL)
+			return
+		}
+		log.Printf("[push:%s] target %s error: %v", plc.BrokerKey, plc.URL, err)
+
+		// 推流持续了一段时间才断开，说明目标是可用的，重置退避
+		if time.Since(started) > pushMaxBackoff {
+			backoff = pushMinBackoff
+		}
+		plc.mu.Lock()
+		plc.status.Retries++
+		plc.mu.Unlock()
+		plc.setState(PushStateBackoff, err)
+
+		select {
+		case <-plc.ctx.Done():
+			plc.setState(PushStateStopped, nil)
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > pushMaxBackoff {
+			backoff = pushMaxBackoff
+		}
+	}
+}
+
+// pushOnce 一次完整的推流过程，返回断开的原因
+func (plc *PushLiveClient) pushOnce() error {
+	b, err := plc.broadcastPool.FindBroker(plc.BrokerKey)
+	if err != nil {
+		return err
+	}
+
+	var writer pushWriter
+	if strings.HasPrefix(plc.URL, "rtmp://") {
+		writer, err = newRTMPPushWriter(plc.ctx, plc.URL)
+	} else {
+		writer, err = newHTTPPushWriter(plc.ctx, plc.URL), nil
+	}
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	// 清空上一次连接残留的数据，保证从起播头开始发送
+	for len(plc.dataCh) > 0 {
+		<-plc.dataCh
+	}
+	b.AddLiveClient(plc.clientId(), plc)
+	defer b.RemoveLiveClient(plc.clientId())
+
+	// 挂在 broker 上期间通道缓冲区记在这路流的内存账户上
+	account := memory.Default.Open(plc.BrokerKey)
+	account.Charge(memory.ChanOverhead(pushQueueSize))
+	defer func() {
+		account.Free(memory.ChanOverhead(pushQueueSize))
+		account.Close()
+	}()
+
+	plc.setState(PushStatePushing, nil)
+	idle := time.NewTimer(pushIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-plc.ctx.Done():
+			return plc.ctx.Err()
+		case <-idle.C:
+			return errors.New("broker 长时间没有数据")
+		case data := <-plc.dataCh:
+			if err := writer.Write(data); err != nil {
+				return err
+			}
+			plc.mu.Lock()
+			plc.status.BytesSent += int64(len(data))
+			plc.mu.Unlock()
+			if !idle.Stop() {
+				select {
+				case <-idle.C:
+				default:
+				}
+			}
+			idle.Reset(pushIdleTimeout)
+		}
+	}
+}
+
+// ====================== 推流写入器 ======================
+
+// pushWriter 把 Broker 的数据写到远端
+type pushWriter interface {
+	Write(data []byte) error
+	Close() error
+}
+
+// rtmpPushWriter 把 FLV 字节流拆成 tag，通过 RTMP publish 推出去
+type rtmpPushWriter struct {
+	conn    *rtmp.RTMPConn
+	demuxer *flvBroker.FLVDemuxer
+}
+
+func newRTMPPushWriter(ctx context.Context, targetURL string) (*rtmpPushWriter, error) {
+	conn, err := rtmp.Dial(ctx, targetURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Publish(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &rtmpPushWriter{conn: conn, demuxer: flvBroker.NewFLVDemuxer()}, nil
+}
+
+func (w *rtmpPushWriter) Write(data []byte) error {
+	tags, err := w.demuxer.Feed(data)
+	if err != nil {
+		if errors.Is(err, flvBroker.ErrInvalidFLVHeader) {
+			return errors.New("rtmp 推流需要 FLV 数据源")
+		}
+		return err
+	}
+	for _, tag := range tags {
+		if err := w.conn.WriteTag(tag.TagType, tag.Timestamp, tag.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *rtmpPushWriter) Close() error {
+	return w.conn.Close()
+}
+
+// httpPushWriter 以 chunked POST 的方式把数据原样推给远端
+// 请求在第一次写入时才发起，这样可以根据数据内容决定 Content-Type
+type httpPushWriter struct {
+	ctx       context.Context
+	targetURL string
+	pw        *io.PipeWriter
+	respErr   chan error
+}
+
+func newHTTPPushWriter(ctx context.Context, targetURL string) *httpPushWriter {
+	return &httpPushWriter{ctx: ctx, targetURL: targetURL, respErr: make(chan error, 1)}
+}
+
+func (w *httpPushWriter) start(first []byte) error {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, w.targetURL, pr)
+	if err != nil {
+		return err
+	}
+	contentType := "application/octet-stream"
+	if len(first) > 0 && first[0] == 'F' {
+		contentType = "video/x-flv"
+	} else if len(first) > 0 && first[0] == 0x47 {
+		contentType = "video/mp2t"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "pull2push-push/1.0")
+	w.pw = pw
+
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("推流目标结束请求: %s", resp.Status)
+		}
+		pr.CloseWithError(err)
+		w.respErr <- err
+	}()
+	return nil
+}
+
+func (w *httpPushWriter) Write(data []byte) error {
+	if w.pw == nil {
+		if err := w.start(data); err != nil {
+			return err
+		}
+	}
+	if _, err := w.pw.Write(data); err != nil {
+		select {
+		case respErr := <-w.respErr:
+			return respErr
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *httpPushWriter) Close() error {
+	if w.pw != nil {
+		return w.pw.Close()
+	}
+	return nil
+}
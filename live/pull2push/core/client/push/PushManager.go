@@ -0,0 +1,193 @@
+package push
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/config"
+	"pull2push/core/broadcast"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ====================== PushManager ======================
+
+// PushManager 管理所有 Broker 的推流目标 map[brokerKey]map[targetId]*PushLiveClient
+type PushManager struct {
+	mutex     sync.Mutex
+	targetMap map[string]map[string]*PushLiveClient
+
+	broadcastPools []broadcast.Broadcaster // 依次在这些广播器里查找 Broker
+	nextId         atomic.Uint64
+}
+
+func NewPushManager(broadcastPools ...broadcast.Broadcaster) *PushManager {
+	return &PushManager{
+		targetMap:      make(map[string]map[string]*PushLiveClient),
+		broadcastPools: broadcastPools,
+	}
+}
+
+// findPool 找到 brokerKey 所在的广播器
+func (pm *PushManager) findPool(brokerKey string) (broadcast.Broadcaster, error) {
+	for _, pool := range pm.broadcastPools {
+		if _, err := pool.FindBroker(brokerKey); err == nil {
+			return pool, nil
+		}
+	}
+	return nil, errors.New(fmt.Sprintf("未找到 %s 对应的Broker", brokerKey))
+}
+
+// AddTarget 给 Broker 添加一个推流目标，返回目标编号
+func (pm *PushManager) AddTarget(brokerKey, targetURL string) (string, error) {
+	pool, err := pm.findPool(brokerKey)
+	if err != nil {
+		return "", err
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	for _, t := range pm.targetMap[brokerKey] {
+		if t.URL == targetURL {
+			return "", errors.New(fmt.Sprintf("推流目标 %s 已存在", targetURL))
+		}
+	}
+
+	targetId := strconv.FormatUint(pm.nextId.Add(1), 10)
+	target, err := NewPushLiveClient(pool, brokerKey, targetId, targetURL)
+	if err != nil {
+		return "", err
+	}
+	if pm.targetMap[brokerKey] == nil {
+		pm.targetMap[brokerKey] = make(map[string]*PushLiveClient)
+	}
+	pm.targetMap[brokerKey][targetId] = target
+	return targetId, nil
+}
+
+// RemoveTarget 停止并移除一个推流目标
+func (pm *PushManager) RemoveTarget(brokerKey, targetId string) error {
+	pm.mutex.Lock()
+	target, ok := pm.targetMap[brokerKey][targetId]
+	if ok {
+		delete(pm.targetMap[brokerKey], targetId)
+		if len(pm.targetMap[brokerKey]) == 0 {
+			delete(pm.targetMap, brokerKey)
+		}
+	}
+	pm.mutex.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("未找到推流目标 %s", targetId))
+	}
+	target.Stop()
+	return nil
+}
+
+// RemoveBroker 停止某个 Broker 的全部推流目标
+func (pm *PushManager) RemoveBroker(brokerKey string) {
+	pm.mutex.Lock()
+	targets := pm.targetMap[brokerKey]
+	delete(pm.targetMap, brokerKey)
+	pm.mutex.Unlock()
+
+	for _, t := range targets {
+		t.Stop()
+	}
+}
+
+// ReplaceBroker Broker 重建之后调用：keep 返回 true 的推流目标挂到新的 Broker 上重新开始推，编号不变，其余的停止
+func (pm *PushManager) ReplaceBroker(brokerKey string, keep func(targetURL string) bool) {
+	pm.mutex.Lock()
+	old := pm.targetMap[brokerKey]
+	delete(pm.targetMap, brokerKey)
+	pm.mutex.Unlock()
+
+	for _, t := range old {
+		t.Stop()
+	}
+	pool, err := pm.findPool(brokerKey)
+	if err != nil {
+		return
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	for targetId, t := range old {
+		if !keep(t.URL) {
+			continue
+		}
+		target, err := NewPushLiveClient(pool, brokerKey, targetId, t.URL)
+		if err != nil {
+			continue
+		}
+		if pm.targetMap[brokerKey] == nil {
+			pm.targetMap[brokerKey] = make(map[string]*PushLiveClient)
+		}
+		pm.targetMap[brokerKey][targetId] = target
+	}
+}
+
+// ListTargets 列出某个 Broker 的推流目标状态
+func (pm *PushManager) ListTargets(brokerKey string) []PushStatus {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	list := make([]PushStatus, 0, len(pm.targetMap[brokerKey]))
+	for _, t := range pm.targetMap[brokerKey] {
+		list = append(list, t.Status())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].TargetId < list[j].TargetId })
+	return list
+}
+
+// ---------- HTTP 服务 ----------
+
+// ListPush 查询推流目标  GET /live/push/:brokerKey
+func ListPush(pm *PushManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"code": 200,
+			"msg":  "ok",
+			"data": pm.ListTargets(c.Param("brokerKey")),
+		})
+	}
+}
+
+// AddPush 添加推流目标  POST /live/push/:brokerKey  {"url": "rtmp://..."}，目标主机要在 admin.push_hosts 里
+func AddPush(pm *PushManager, store *config.Store) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var body struct {
+			URL string `json:"url"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil || body.URL == "" {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": "url 不能为空"})
+			return
+		}
+		if err := store.Load().CheckPushURL(body.URL); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 403, "msg": err.Error()})
+			return
+		}
+		targetId, err := pm.AddTarget(c.Param("brokerKey"), body.URL)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok", "data": gin.H{"targetId": targetId}})
+	}
+}
+
+// RemovePush 移除推流目标  DELETE /live/push/:brokerKey/:targetId
+func RemovePush(pm *PushManager) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := pm.RemoveTarget(c.Param("brokerKey"), c.Param("targetId")); err != nil {
+			c.JSON(http.StatusOK, gin.H{"code": 404, "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"code": 200, "msg": "ok"})
+	}
+}
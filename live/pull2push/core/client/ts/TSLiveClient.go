@@ -0,0 +1,191 @@
+package ts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net/http"
+	"pull2push/core/broadcast"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	tsBroker "pull2push/core/broker/ts"
+	"pull2push/core/memory"
+	"pull2push/core/session"
+)
+
+// ====================== TSLiveClient ======================
+
+// TSLiveClient HTTP-TS 客户端（机顶盒等），从 Broker 收 FLV 数据，实时复用成 TS 写给前端
+type TSLiveClient struct {
+	BrokerKey string      // 这个客户端的直播房间的唯一编号
+	ClientId  string      // 这个客户端的id，即服务端分配的会话编号
+	DataCh    chan []byte // 这个客户端的一个只写通道，只有不提供环形缓冲的 broker（camera）才会用到
+
+	ctx     context.Context        // 请求结束或被踢出时取消
+	session *session.Session       // 观看会话
+	reader  flvBroker.PacketReader // FLVStreamBroker 为环形缓冲游标，其他 broker 为 DataCh
+	account *memory.Account        // DataCh 的内存记账，读环形缓冲时为 nil
+
+	demuxer *flvBroker.FLVDemuxer
+	muxer   *tsBroker.TSMuxer
+}
+
+func NewTSLiveClient(sess *session.Session, b broker.Broker) *TSLiveClient {
+	tc := &TSLiveClient{
+		BrokerKey: sess.BrokerKey,
+		ClientId:  sess.ID,
+		ctx:       sess.Context(),
+		session:   sess,
+		demuxer:   flvBroker.NewFLVDemuxer(),
+		muxer:     tsBroker.NewTSMuxer(),
+	}
+	if fb, ok := b.(*flvBroker.FLVStreamBroker); ok {
+		tc.reader = fb.SubscribeAt(sess.Start)
+	} else {
+		tc.DataCh = make(chan []byte, 4096)
+		tc.reader = flvBroker.ChanReader(tc.DataCh)
+		tc.account = memory.Default.Open(sess.BrokerKey)
+		tc.account.Charge(memory.ChanOverhead(cap(tc.DataCh)))
+	}
+	return tc
+}
+
+// Broadcast 非阻塞写入通道，客户端太慢时丢包，避免阻塞上游拉流；读环形缓冲时不会被调用
+func (tc *TSLiveClient) Broadcast(data []byte) {
+	select {
+	case tc.DataCh <- data:
+	default:
+	}
+}
+
+// GetDataChan 获取当前客户端的写通道
+func (tc *TSLiveClient) GetDataChan() chan []byte {
+	return tc.DataCh
+}
+
+// Listen TS 客户端直接在 http 请求的 goroutine 里写数据，见 serve
+func (tc *TSLiveClient) Listen() {
+}
+
+// ReadsRing 挂在 FLVStreamBroker 上时从环形缓冲读取，见 client.RingReader
+func (tc *TSLiveClient) ReadsRing() {}
+
+// StartMode 请求参数 ?start= 指定的起播方式，见 broker.StartModer
+func (tc *TSLiveClient) StartMode() broker.START_MODE {
+	return tc.session.Start
+}
+
+// releaseAccount 客户端结束时归还 DataCh 的内存记账
+func (tc *TSLiveClient) releaseAccount() {
+	tc.account.Free(memory.ChanOverhead(cap(tc.DataCh)))
+	tc.account.Close()
+}
+
+// Kick 服务端主动断开这个客户端，响应头已经发出，原因只能记在会话上
+func (tc *TSLiveClient) Kick(reason string) {
+	tc.session.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+}
+
+// remux 把收到的 FLV 字节转换成 TS 包，追加到 out
+func (tc *TSLiveClient) remux(out *bytes.Buffer, data []byte) error {
+	tags, err := tc.demuxer.Feed(data)
+	if err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		out.Write(tc.muxer.WriteTag(tag))
+	}
+	return nil
+}
+
+// serve 持续把数据写给前端，直到请求结束或写出错
+func (tc *TSLiveClient) serve(c *gin.Context) error {
+	defer tc.releaseAccount()
+	var batch [][]byte
+	for {
+		var err error
+		batch, err = tc.reader.Next(tc.ctx, batch[:0])
+		if err != nil {
+			if sig := tc.session.Signal(); sig != nil {
+				return fmt.Errorf("kicked: %s", sig.Reason)
+			}
+			if errors.Is(err, io.EOF) {
+				return err
+			}
+			return nil
+		}
+		if err := tc.writeBatch(c, batch); err != nil {
+			return err
+		}
+	}
+}
+
+// writeBatch 把一批 FLV 数据复用成 TS 后一次写出，输出缓冲从池子里取，写完归还
+func (tc *TSLiveClient) writeBatch(c *gin.Context, batch [][]byte) error {
+	packets := memory.GetBuffer()
+	defer memory.PutBuffer(packets)
+	for _, data := range batch {
+		if err := tc.remux(packets, data); err != nil {
+			return err
+		}
+	}
+	if packets.Len() == 0 {
+		return nil
+	}
+	n, err := c.Writer.Write(packets.Bytes())
+	tc.session.AddBytes(n)
+	if err != nil {
+		return err
+	}
+	c.Writer.Flush()
+	return nil
+}
+
+// ---------- HTTP 服务 ----------
+
+// LiveTS 处理 HTTP-TS 拉流，数据源可以是任意输出 FLV 的 Broker（HTTP-FLV、TS、摄像头等）
+func LiveTS(broadcastPools ...broadcast.Broadcaster) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey := c.Param("brokerKey")
+
+		var b broker.Broker
+		for _, pool := range broadcastPools {
+			if found, err := pool.FindBroker(brokerKey); err == nil {
+				b = found
+				break
+			}
+		}
+		if b == nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": fmt.Sprintf("brokerKey %s 不存在", brokerKey)})
+			return
+		}
+
+		sess, err := session.Default.Open(c, c.Request.Context(), brokerKey, "ts")
+		if err != nil {
+			session.Default.Reject(c, brokerKey, err)
+			return
+		}
+		defer sess.End()
+
+		c.Header("Content-Type", "video/mp2t")
+		c.Header("Access-Control-Allow-Origin", "*")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Status(http.StatusOK)
+		c.Writer.Flush()
+
+		clientId := sess.ID
+		tsClient := NewTSLiveClient(sess, b)
+		b.AddLiveClient(clientId, tsClient)
+		defer b.RemoveLiveClient(clientId)
+
+		log.Printf("[ts:%s] client %s connected", brokerKey, clientId)
+		if err := tsClient.serve(c); err != nil {
+			log.Printf("[ts:%s] client %s closed: %v", brokerKey, clientId, err)
+		}
+	}
+}
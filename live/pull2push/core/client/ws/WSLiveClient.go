@@ -0,0 +1,363 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"pull2push/core/broadcast"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/memory"
+	"pull2push/core/session"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ====================== WSLiveClient ======================
+
+/*
+WSLiveClient WebSocket-FLV 客户端（flv.js 的 ws:// 地址），每个二进制帧里是一段 FLV 数据
+
+	只实现了直播需要的那部分 RFC 6455：握手、服务端发二进制帧、响应 ping / close，
+	不支持分片和扩展（permessage-deflate 对视频数据没有意义）
+*/
+type WSLiveClient struct {
+	BrokerKey string      // 这个客户端的直播房间的唯一编号
+	ClientId  string      // 这个客户端的id，即服务端分配的会话编号
+	DataCh    chan []byte // 这个客户端的一个只写通道，只有不提供环形缓冲的 broker（camera）才会用到
+
+	ctx     context.Context        // 连接断开或被踢出时取消
+	cancel  context.CancelFunc     // 连接断开时取消
+	session *session.Session       // 观看会话，被踢出时取消
+	reader  flvBroker.PacketReader // FLVStreamBroker 为环形缓冲游标，其他 broker 为 DataCh
+	account *memory.Account        // DataCh 的内存记账，读环形缓冲时为 nil
+
+	conn    net.Conn
+	rw      *bufio.ReadWriter
+	writeMu sync.Mutex // 数据帧和 pong / close 帧可能同时写
+}
+
+// websocket 帧类型
+const (
+	opBinary = 0x2
+	opClose  = 0x8
+	opPing   = 0x9
+	opPong   = 0xA
+)
+
+// closeKicked 被服务端踢出时 close 帧的状态码，4000-4999 留给应用自定义
+const closeKicked = 4000
+
+// wsGUID RFC 6455 里计算 Sec-WebSocket-Accept 用的固定字符串
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// writeTimeout 单个帧的写超时，客户端长时间不读时断开，不占着 goroutine
+const writeTimeout = 10 * time.Second
+
+func NewWSLiveClient(sess *session.Session, conn net.Conn, rw *bufio.ReadWriter, b broker.Broker) *WSLiveClient {
+	ctx, cancel := context.WithCancel(sess.Context())
+	wc := &WSLiveClient{
+		BrokerKey: sess.BrokerKey,
+		ClientId:  sess.ID,
+		ctx:       ctx,
+		cancel:    cancel,
+		session:   sess,
+		conn:      conn,
+		rw:        rw,
+	}
+	if fb, ok := b.(*flvBroker.FLVStreamBroker); ok {
+		wc.reader = fb.SubscribeAt(sess.Start)
+	} else {
+		wc.DataCh = make(chan []byte, 4096)
+		wc.reader = flvBroker.ChanReader(wc.DataCh)
+		wc.account = memory.Default.Open(sess.BrokerKey)
+		wc.account.Charge(memory.ChanOverhead(cap(wc.DataCh)))
+	}
+	return wc
+}
+
+// Broadcast 非阻塞写入通道，客户端太慢时丢包，避免阻塞上游拉流；读环形缓冲时不会被调用
+func (wc *WSLiveClient) Broadcast(data []byte) {
+	select {
+	case wc.DataCh <- data:
+	default:
+	}
+}
+
+// GetDataChan 获取当前客户端的写通道
+func (wc *WSLiveClient) GetDataChan() chan []byte {
+	return wc.DataCh
+}
+
+// Listen WS 客户端直接在 http 请求的 goroutine 里写数据，见 serve
+func (wc *WSLiveClient) Listen() {
+}
+
+// ReadsRing 挂在 FLVStreamBroker 上时从环形缓冲读取，见 client.RingReader
+func (wc *WSLiveClient) ReadsRing() {}
+
+// StartMode 请求参数 ?start= 指定的起播方式，见 broker.StartModer
+func (wc *WSLiveClient) StartMode() broker.START_MODE {
+	return wc.session.Start
+}
+
+// releaseAccount 客户端结束时归还 DataCh 的内存记账
+func (wc *WSLiveClient) releaseAccount() {
+	wc.account.Free(memory.ChanOverhead(cap(wc.DataCh)))
+	wc.account.Close()
+}
+
+// Kick 服务端主动断开这个客户端，原因放在 close 帧里发给播放端
+func (wc *WSLiveClient) Kick(reason string) {
+	wc.session.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+}
+
+// closePayload close 帧的内容：2 字节状态码加原因，控制帧最长 125 字节，原因超长时按 utf-8 字符截断
+func closePayload(code uint16, reason string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	for _, r := range reason {
+		if len(payload)+utf8.RuneLen(r) > 125 {
+			break
+		}
+		payload = utf8.AppendRune(payload, r)
+	}
+	return payload
+}
+
+// writeFrame 写一个不分片、不加掩码的帧（服务端发出的帧不能加掩码）
+func (wc *WSLiveClient) writeFrame(op byte, payload []byte) error {
+	return wc.writeFrames(op, [][]byte{payload})
+}
+
+// writeFrames 一次写出多个帧，只 Flush 一次
+func (wc *WSLiveClient) writeFrames(op byte, payloads [][]byte) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+
+	wc.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	for _, payload := range payloads {
+		var hdr [10]byte
+		hdr[0] = 0x80 | op // FIN
+		n := 2
+		switch {
+		case len(payload) < 126:
+			hdr[1] = byte(len(payload))
+		case len(payload) <= 0xFFFF:
+			hdr[1] = 126
+			binary.BigEndian.PutUint16(hdr[2:], uint16(len(payload)))
+			n = 4
+		default:
+			hdr[1] = 127
+			binary.BigEndian.PutUint64(hdr[2:], uint64(len(payload)))
+			n = 10
+		}
+		if _, err := wc.rw.Write(hdr[:n]); err != nil {
+			return err
+		}
+		if _, err := wc.rw.Write(payload); err != nil {
+			return err
+		}
+	}
+	return wc.rw.Flush()
+}
+
+// readLoop 读客户端发来的帧：回应 ping，收到 close 或连接出错时关闭 closed
+func (wc *WSLiveClient) readLoop(closed chan<- error) {
+	for {
+		op, payload, err := readFrame(wc.rw.Reader)
+		if err != nil {
+			closed <- err
+			return
+		}
+		switch op {
+		case opPing:
+			if err := wc.writeFrame(opPong, payload); err != nil {
+				closed <- err
+				return
+			}
+		case opClose:
+			wc.writeFrame(opClose, payload)
+			closed <- nil
+			return
+		}
+	}
+}
+
+// readFrame 读一个客户端帧并去掉掩码，控制帧以外的内容直接丢弃
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	op := hdr[0] & 0x0F
+	masked := hdr[1]&0x80 != 0
+	size := uint64(hdr[1] & 0x7F)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	if op < opClose {
+		// 播放端不会发数据帧，读掉即可
+		_, err := io.CopyN(io.Discard, r, int64(size))
+		return op, nil, err
+	}
+	if size > 125 {
+		return 0, nil, fmt.Errorf("控制帧长度 %d 超过 125", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// serve 持续把数据写给前端，直到客户端断开、被踢出或写出错
+func (wc *WSLiveClient) serve() error {
+	defer wc.cancel()
+	defer wc.releaseAccount()
+	closed := make(chan error, 1)
+	go func() {
+		// 客户端断开时让阻塞的读取返回
+		wc.readLoop(closed)
+		wc.cancel()
+	}()
+	var batch [][]byte
+	for {
+		var err error
+		batch, err = wc.reader.Next(wc.ctx, batch[:0])
+		if err != nil {
+			if sig := wc.session.Signal(); sig != nil {
+				wc.writeFrame(opClose, closePayload(closeKicked, sig.Reason))
+				return fmt.Errorf("kicked: %s", sig.Reason)
+			}
+			select {
+			case err := <-closed:
+				return err
+			default:
+			}
+			return err
+		}
+		if err := wc.writeFrames(opBinary, batch); err != nil {
+			return err
+		}
+		for _, data := range batch {
+			wc.session.AddBytes(len(data))
+		}
+	}
+}
+
+// acceptKey 根据 Sec-WebSocket-Key 计算 Sec-WebSocket-Accept
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// upgrade 完成握手并接管 tcp 连接
+func upgrade(c *gin.Context) (net.Conn, *bufio.ReadWriter, error) {
+	r := c.Request
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		return nil, nil, fmt.Errorf("不是 websocket 请求")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, nil, fmt.Errorf("不支持的 websocket 版本 %s", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, nil, fmt.Errorf("缺少 Sec-WebSocket-Key")
+	}
+
+	conn, rw, err := c.Writer.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	if _, err := rw.WriteString(resp); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// ---------- HTTP 服务 ----------
+
+// LiveWS 处理 WebSocket-FLV 拉流，数据源可以是任意输出 FLV 的 Broker（HTTP-FLV、TS、摄像头等）
+func LiveWS(broadcastPools ...broadcast.Broadcaster) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		brokerKey := c.Param("brokerKey")
+
+		var b broker.Broker
+		for _, pool := range broadcastPools {
+			if found, err := pool.FindBroker(brokerKey); err == nil {
+				b = found
+				break
+			}
+		}
+		if b == nil {
+			c.JSON(http.StatusNotFound, gin.H{"code": 404, "msg": fmt.Sprintf("brokerKey %s 不存在", brokerKey)})
+			return
+		}
+
+		// 连接会被接管，会话和 http 请求的 context 无关；准入检查在握手之前，超出限制时返回状态码
+		sess, err := session.Default.Open(c, context.Background(), brokerKey, "ws")
+		if err != nil {
+			session.Default.Reject(c, brokerKey, err)
+			return
+		}
+		defer sess.End()
+
+		conn, rw, err := upgrade(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": err.Error()})
+			return
+		}
+		defer conn.Close()
+
+		clientId := sess.ID
+		wsClient := NewWSLiveClient(sess, conn, rw, b)
+		b.AddLiveClient(clientId, wsClient)
+		defer b.RemoveLiveClient(clientId)
+
+		log.Printf("[ws:%s] client %s connected", brokerKey, clientId)
+		if err := wsClient.serve(); err != nil {
+			log.Printf("[ws:%s] client %s closed: %v", brokerKey, clientId, err)
+		}
+	}
+}
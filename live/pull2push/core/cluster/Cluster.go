@@ -0,0 +1,248 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	flvBroker "pull2push/core/broker/flv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+origin-edge 集群
+
+	所有节点配置同样的 broker（brokerKey -> 上游地址），每个 brokerKey 按一致性哈希得到一个有序的候选节点列表，
+	第一个是 origin，后面的依次作为备选。某个节点拉流时按顺序尝试候选节点：
+		候选节点是别的节点：拉它的 HTTP-FLV 输出 /live/flv/:brokerKey/:clientId
+		候选节点是自己：    直接拉真正的上游
+	这样正常情况下只有 origin 拉上游，edge 都从 origin 拉；origin 挂掉后，排在第二位的节点发现连不上 origin，
+	就会自己去拉上游，其余 edge 也会按同样的顺序切到它上面。节点只会从排在自己前面的候选节点拉流，不会形成环。
+
+	origin 恢复后，已经切走的节点在下一次重连时才会回到 origin。
+*/
+
+const (
+	originDialTimeout = 5 * time.Second  // 连接候选节点并收到 FLV 头的超时
+	originIdleTimeout = 10 * time.Second // 从其他节点拉流时，超过该时间没有 tag 认为节点已经不可用
+)
+
+// Registry 集群节点来源，节点用对外的 HTTP 地址表示，例如 http://10.0.0.1:8080
+type Registry interface {
+	Nodes(ctx context.Context) ([]string, error)
+}
+
+// StaticRegistry 配置文件里写死的节点列表
+type StaticRegistry []string
+
+func (r StaticRegistry) Nodes(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+// HTTPRegistry 从注册中心地址 GET 节点列表，返回 JSON 字符串数组
+type HTTPRegistry struct {
+	URL    string
+	Client *http.Client
+}
+
+func (r *HTTPRegistry) Nodes(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry bad status: %s", resp.Status)
+	}
+	var nodes []string
+	if err := json.NewDecoder(resp.Body).Decode(&nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Cluster 当前节点视角下的集群
+type Cluster struct {
+	Self     string // 当前节点对外的 HTTP 地址，必须和节点列表里的写法一致
+	Token    string // 从其他节点拉流时带的 cluster.token，对方开启 auth 时必须配置
+	registry Registry
+
+	mutex sync.RWMutex
+	ring  *HashRing
+}
+
+// NewCluster 创建集群并立即加载一次节点列表，refresh > 0 时定期从 registry 刷新
+func NewCluster(self string, registry Registry, refresh time.Duration) (*Cluster, error) {
+	c := &Cluster{Self: normalizeNode(self), registry: registry}
+	if err := c.Refresh(context.Background()); err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		go func() {
+			ticker := time.NewTicker(refresh)
+			defer ticker.Stop()
+			for range ticker.C {
+				if err := c.Refresh(context.Background()); err != nil {
+					log.Printf("[cluster] refresh nodes failed: %v", err)
+				}
+			}
+		}()
+	}
+	return c, nil
+}
+
+// Refresh 从 registry 重新加载节点列表
+func (c *Cluster) Refresh(ctx context.Context) error {
+	nodes, err := c.registry.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	normalized := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		normalized = append(normalized, normalizeNode(n))
+	}
+	if len(normalized) == 0 {
+		return errors.New("集群节点列表为空")
+	}
+	ring := NewHashRing(normalized, 0)
+	c.mutex.Lock()
+	c.ring = ring
+	c.mutex.Unlock()
+	return nil
+}
+
+// Nodes 当前的节点列表
+func (c *Cluster) Nodes() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.ring.Nodes()
+}
+
+// Candidates brokerKey 的候选 origin，按优先级排列；当前节点不在列表里时追加到最后，保证最终能自己拉上游
+func (c *Cluster) Candidates(brokerKey string) []string {
+	c.mutex.RLock()
+	ring := c.ring
+	c.mutex.RUnlock()
+
+	candidates := ring.GetN(brokerKey, len(ring.nodes))
+	for _, n := range candidates {
+		if n == c.Self {
+			return candidates
+		}
+	}
+	return append(candidates, c.Self)
+}
+
+// Overflow 当前节点观众满了时 brokerKey 的第 hop 个备选节点，按候选顺序跳过自己，没有更多节点时返回空串
+func (c *Cluster) Overflow(brokerKey string, hop int) string {
+	others := make([]string, 0)
+	for _, n := range c.Candidates(brokerKey) {
+		if n != c.Self {
+			others = append(others, n)
+		}
+	}
+	if hop < 0 || hop >= len(others) {
+		return ""
+	}
+	return others[hop]
+}
+
+// Origin brokerKey 归属的 origin 节点
+func (c *Cluster) Origin(brokerKey string) string {
+	return c.Candidates(brokerKey)[0]
+}
+
+// IsOrigin 当前节点是否是 brokerKey 的 origin
+func (c *Cluster) IsOrigin(brokerKey string) bool {
+	return c.Origin(brokerKey) == c.Self
+}
+
+// Dialer 把 brokerKey 的数据源包装成集群数据源：按候选顺序拉其他节点，轮到自己时用 upstream 拉真正的上游
+func (c *Cluster) Dialer(brokerKey string, upstream flvBroker.SourceDialer) flvBroker.SourceDialer {
+	return func(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+		var errs []error
+		for _, node := range c.Candidates(brokerKey) {
+			if node == c.Self {
+				log.Printf("[cluster:%s] pull upstream as origin", brokerKey)
+				return upstream(ctx, upstreamURL)
+			}
+			src, err := c.dialNode(ctx, node, brokerKey)
+			if err == nil {
+				log.Printf("[cluster:%s] pull from origin %s", brokerKey, node)
+				return src, nil
+			}
+			log.Printf("[cluster:%s] origin %s unavailable: %v", brokerKey, node, err)
+			errs = append(errs, fmt.Errorf("%s: %w", node, err))
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// OriginURL 从 node 拉 brokerKey 的 HTTP-FLV 地址，clientId 带上当前节点，重连时 origin 会替换掉旧连接
+func (c *Cluster) OriginURL(node, brokerKey string) string {
+	self := strings.NewReplacer("://", "-", ":", "-", "/", "-").Replace(c.Self)
+	return fmt.Sprintf("%s/live/flv/%s/edge-%s", node, url.PathEscape(brokerKey), url.PathEscape(self))
+}
+
+// dialNode 连接其他节点的 HTTP-FLV 输出，连接和读取都带超时，避免节点假死时一直挂着
+func (c *Cluster) dialNode(ctx context.Context, node, brokerKey string) (flvBroker.TagSource, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	dialTimer := time.AfterFunc(originDialTimeout, cancel)
+	var header http.Header
+	if c.Token != "" {
+		header = http.Header{"Authorization": {"Bearer " + c.Token}}
+	}
+	src, err := flvBroker.DialHTTPFLVWithHeader(ctx, c.OriginURL(node, brokerKey), header)
+	if !dialTimer.Stop() {
+		// 超时之后才返回，连接已经被取消
+		if src != nil {
+			src.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("连接超时 %s", originDialTimeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &edgeSource{TagSource: src, cancel: cancel, idle: time.AfterFunc(originIdleTimeout, cancel)}, nil
+}
+
+// edgeSource 从其他节点拉流的数据源，超过 originIdleTimeout 没有 tag 时断开，交给 broker 重连到下一个候选节点
+type edgeSource struct {
+	flvBroker.TagSource
+	cancel context.CancelFunc
+	idle   *time.Timer
+}
+
+func (s *edgeSource) ReadTag() (*flvBroker.FlvTag, error) {
+	tag, err := s.TagSource.ReadTag()
+	if err == nil {
+		s.idle.Reset(originIdleTimeout)
+	}
+	return tag, err
+}
+
+func (s *edgeSource) Close() error {
+	s.idle.Stop()
+	s.cancel()
+	return s.TagSource.Close()
+}
+
+// normalizeNode 去掉末尾的 /，保证同一个节点的不同写法哈希结果一致
+func normalizeNode(node string) string {
+	return strings.TrimRight(strings.TrimSpace(node), "/")
+}
@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// defaultReplicas 每个节点在环上的虚拟节点数，节点少时也能分布得比较均匀
+const defaultReplicas = 160
+
+// HashRing 一致性哈希环，节点增减时只有少部分 key 的归属会变化
+type HashRing struct {
+	replicas int
+	hashes   []uint32          // 排好序的虚拟节点哈希
+	owners   map[uint32]string // 虚拟节点哈希 -> 节点
+	nodes    []string
+}
+
+func NewHashRing(nodes []string, replicas int) *HashRing {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+	r := &HashRing{replicas: replicas, owners: make(map[uint32]string)}
+	seen := make(map[string]bool)
+	for _, node := range nodes {
+		if node == "" || seen[node] {
+			continue
+		}
+		seen[node] = true
+		r.nodes = append(r.nodes, node)
+		for i := 0; i < replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			if _, ok := r.owners[h]; ok {
+				continue // 极少数哈希冲突，保留先加入的节点
+			}
+			r.owners[h] = node
+			r.hashes = append(r.hashes, h)
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// Nodes 环上的所有节点
+func (r *HashRing) Nodes() []string {
+	return append([]string(nil), r.nodes...)
+}
+
+// Get 返回 key 归属的节点，环为空时返回空字符串
+func (r *HashRing) Get(key string) string {
+	if nodes := r.GetN(key, 1); len(nodes) > 0 {
+		return nodes[0]
+	}
+	return ""
+}
+
+// GetN 从 key 的位置顺时针找出 n 个不同的节点，第一个是主节点，后面的依次作为故障转移的备选
+func (r *HashRing) GetN(key string, n int) []string {
+	if len(r.hashes) == 0 || n <= 0 {
+		return nil
+	}
+	n = min(n, len(r.nodes))
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	result := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	for i := 0; i < len(r.hashes) && len(result) < n; i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !picked[node] {
+			picked[node] = true
+			result = append(result, node)
+		}
+	}
+	return result
+}
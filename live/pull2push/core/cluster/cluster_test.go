@@ -0,0 +1,310 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net"
+	"net/http/httptest"
+	"pull2push/config"
+	flvBroadcast "pull2push/core/broadcast/flv"
+	flvBroker "pull2push/core/broker/flv"
+	flvClient "pull2push/core/client/flv"
+	"pull2push/middleware"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testSPS = []byte{0x67, 0x64, 0x00, 0x1f, 0xac, 0xd9, 0x40, 0x50, 0x05, 0xbb, 0x01, 0x10, 0x00, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x03, 0x03, 0xc0, 0xf1, 0x83, 0x19, 0x60}
+var testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb, 0x22, 0xc0}
+
+// fakeSource 每 20ms 产生一帧 H.264 的上游
+type fakeSource struct {
+	n    int
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *fakeSource) Header() []byte { return flvBroker.BuildFLVHeader(false, true) }
+
+func (s *fakeSource) ReadTag() (*flvBroker.FlvTag, error) {
+	if s.n == 0 {
+		s.n++
+		return flvBroker.NewVideoSequenceTag(flvBroker.CodecH264, flvBroker.AVCDecoderConfig(testSPS, testPPS), 0), nil
+	}
+	select {
+	case <-s.done:
+		return nil, io.EOF
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.n++
+	frame := []byte{0x41, 0x9a, 0x00, 0x01}
+	if s.n%10 == 1 {
+		frame = []byte{0x65, 0x88, 0x84, 0x00}
+	}
+	return flvBroker.NewVideoFrameTag(flvBroker.CodecH264, [][]byte{frame}, frame[0] == 0x65, uint32(s.n*20), 0), nil
+}
+
+func (s *fakeSource) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+// collectClient 记录收到的字节数
+type collectClient struct {
+	bytes atomic.Int64
+}
+
+func (c *collectClient) Broadcast(data []byte)    { c.bytes.Add(int64(len(data))) }
+func (c *collectClient) Listen()                  {}
+func (c *collectClient) GetDataChan() chan []byte { return nil }
+
+// testNode 一个进程内的 pull2push 节点
+type testNode struct {
+	url       string
+	server    *httptest.Server
+	broker    *flvBroker.FLVStreamBroker
+	upstreams atomic.Int32 // 拉真正上游的次数
+	viewer    *collectClient
+}
+
+// startNodes 启动 n 个节点，先把所有端口都监听起来再创建 broker，避免启动顺序影响 origin 的选择
+func startNodes(t *testing.T, n int, brokerKey string) []*testNode {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	listeners := make([]net.Listener, n)
+	urls := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		urls[i] = "http://" + l.Addr().String()
+	}
+
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		node := &testNode{url: urls[i], viewer: &collectClient{}}
+		c, err := NewCluster(urls[i], StaticRegistry(urls), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		upstream := func(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+			node.upstreams.Add(1)
+			return &fakeSource{done: make(chan struct{})}, nil
+		}
+		node.broker = flvBroker.NewFLVStreamBrokerWithDialer(brokerKey, "fake://"+brokerKey, c.Dialer(brokerKey, upstream))
+		node.broker.Start(context.Background())
+		node.broker.AddLiveClient("viewer", node.viewer)
+
+		pool := flvBroadcast.NewFLVBroadcaster()
+		pool.AddBroker(brokerKey, node.broker)
+		r := gin.New()
+		r.GET("/live/flv/:brokerKey/:clientId", flvClient.LiveFlv(pool))
+		node.server = httptest.NewUnstartedServer(r)
+		node.server.Listener.Close()
+		node.server.Listener = listeners[i]
+		node.server.Start()
+		nodes[i] = node
+	}
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.server.CloseClientConnections()
+			node.server.Close()
+		}
+	})
+	return nodes
+}
+
+// byURL 按 url 找节点
+func byURL(nodes []*testNode, url string) *testNode {
+	for _, n := range nodes {
+		if n.url == url {
+			return n
+		}
+	}
+	return nil
+}
+
+// waitFor 轮询直到条件成立
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestHashRingStable(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	ring := NewHashRing(nodes, 0)
+	grown := NewHashRing(append(nodes, "http://d:8080"), 0)
+
+	counts := map[string]int{}
+	moved := 0
+	const keys = 3000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("stream-%d", i)
+		owner := ring.Get(key)
+		counts[owner]++
+		if got := grown.Get(key); got != owner && got != "http://d:8080" {
+			t.Fatalf("key %s moved from %s to %s, not to the new node", key, owner, got)
+		} else if got != owner {
+			moved++
+		}
+		if cands := ring.GetN(key, 3); len(cands) != 3 || cands[0] != owner {
+			t.Fatalf("GetN(%s) = %v, owner %s", key, cands, owner)
+		}
+	}
+	for node, n := range counts {
+		if n < keys/6 {
+			t.Errorf("node %s only owns %d of %d keys", node, n, keys)
+		}
+	}
+	// 新增一个节点，大约 1/4 的 key 迁移过去
+	if moved < keys/8 || moved > keys/2 {
+		t.Errorf("%d of %d keys moved after adding a node", moved, keys)
+	}
+}
+
+// TestOverflow 观众满了时按候选顺序换到其他节点，不会换回自己
+func TestOverflow(t *testing.T) {
+	nodes := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	c, err := NewCluster(nodes[1], StaticRegistry(nodes), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := c.Overflow("stream", 0), c.Overflow("stream", 1)
+	if first == "" || second == "" || first == second || first == c.Self || second == c.Self {
+		t.Fatalf("Overflow = %q, %q, self %s", first, second, c.Self)
+	}
+	if next := c.Overflow("stream", 2); next != "" {
+		t.Fatalf("Overflow(2) = %q, want no more nodes", next)
+	}
+}
+
+// TestOriginPullsOnce 三个节点都有观众时，只有 origin 拉上游，edge 都从 origin 拉
+func TestOriginPullsOnce(t *testing.T) {
+	const key = "room-1"
+	nodes := startNodes(t, 3, key)
+	c, _ := NewCluster(nodes[0].url, StaticRegistry([]string{nodes[0].url, nodes[1].url, nodes[2].url}), 0)
+	origin := byURL(nodes, c.Origin(key))
+
+	for _, n := range nodes {
+		waitFor(t, 5*time.Second, "viewer data on "+n.url, func() bool { return n.viewer.bytes.Load() > 1000 })
+	}
+	for _, n := range nodes {
+		want := int32(0)
+		if n == origin {
+			want = 1
+		}
+		if got := n.upstreams.Load(); got != want {
+			t.Errorf("node %s pulled upstream %d times, want %d", n.url, got, want)
+		}
+	}
+}
+
+// TestOriginFailover origin 挂掉之后，哈希环上的下一个节点接管上游，剩下的 edge 切到它上面继续播放
+func TestOriginFailover(t *testing.T) {
+	const key = "room-failover"
+	nodes := startNodes(t, 3, key)
+	c, _ := NewCluster(nodes[0].url, StaticRegistry([]string{nodes[0].url, nodes[1].url, nodes[2].url}), 0)
+	cands := c.Candidates(key)
+	origin, backup, edge := byURL(nodes, cands[0]), byURL(nodes, cands[1]), byURL(nodes, cands[2])
+
+	waitFor(t, 5*time.Second, "edge data", func() bool { return edge.viewer.bytes.Load() > 1000 })
+	if backup.upstreams.Load() != 0 || edge.upstreams.Load() != 0 {
+		t.Fatalf("only the origin should pull upstream before failover")
+	}
+
+	// origin 下线
+	origin.server.CloseClientConnections()
+	origin.server.Close()
+
+	waitFor(t, 10*time.Second, "backup takes over upstream", func() bool { return backup.upstreams.Load() == 1 })
+	before := edge.viewer.bytes.Load()
+	waitFor(t, 10*time.Second, "edge data after failover", func() bool { return edge.viewer.bytes.Load() > before+1000 })
+	if got := edge.upstreams.Load(); got != 0 {
+		t.Errorf("edge pulled upstream %d times after failover, want 0 (should pull from backup)", got)
+	}
+	if got := backup.upstreams.Load(); got != 1 {
+		t.Errorf("backup pulled upstream %d times, want 1", got)
+	}
+}
+
+// TestOriginMissingBroker 候选节点上没有这个 broker 时（返回 404）跳到下一个候选节点
+func TestOriginMissingBroker(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/live/flv/:brokerKey/:clientId", flvClient.LiveFlv(flvBroadcast.NewFLVBroadcaster()))
+	empty := httptest.NewServer(r)
+	defer empty.Close()
+
+	self := "http://127.0.0.1:1"
+	c, err := NewCluster(self, StaticRegistry([]string{empty.URL}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstreams atomic.Int32
+	dial := c.Dialer("missing", func(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+		upstreams.Add(1)
+		return &fakeSource{done: make(chan struct{})}, nil
+	})
+	src, err := dial(context.Background(), "fake://missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if upstreams.Load() != 1 {
+		t.Fatalf("expected fallback to own upstream, got %d upstream dials", upstreams.Load())
+	}
+}
+
+// TestOriginAuth origin 开启 auth 时，edge 带 cluster.token 才能拉流
+func TestOriginAuth(t *testing.T) {
+	const key = "room-auth"
+	gin.SetMode(gin.TestMode)
+	origin := flvBroker.NewFLVStreamBrokerWithDialer(key, "fake://"+key, func(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+		return &fakeSource{done: make(chan struct{})}, nil
+	})
+	origin.Start(context.Background())
+	defer origin.Close()
+	pool := flvBroadcast.NewFLVBroadcaster()
+	pool.AddBroker(key, origin)
+	store := config.NewStore(&config.Config{
+		Auth:    config.AuthConfig{Enabled: true, Tokens: []string{"viewer"}},
+		Cluster: config.ClusterConfig{Token: "cluster-secret"},
+	})
+	r := gin.New()
+	r.GET("/live/flv/:brokerKey/:clientId", middleware.AuthMiddleware(store), flvClient.LiveFlv(pool))
+	server := httptest.NewServer(r)
+	defer func() {
+		server.CloseClientConnections()
+		server.Close()
+	}()
+
+	edge, err := NewCluster("http://127.0.0.1:1", StaticRegistry([]string{server.URL}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := edge.dialNode(context.Background(), server.URL, key); err == nil {
+		t.Fatal("没有 cluster.token 也拉到了流")
+	}
+	edge.Token = "cluster-secret"
+	src, err := edge.dialNode(context.Background(), server.URL, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if _, err := src.ReadTag(); err != nil {
+		t.Fatal(err)
+	}
+}
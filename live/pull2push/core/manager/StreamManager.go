@@ -0,0 +1,427 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"pull2push/config"
+	"pull2push/core/broadcast"
+	"pull2push/core/broker"
+	cameraBroker "pull2push/core/broker/camera"
+	flvBroker "pull2push/core/broker/flv"
+	hlsBroker "pull2push/core/broker/hls"
+	tsBroker "pull2push/core/broker/ts"
+	pushClient "pull2push/core/client/push"
+	"pull2push/core/cluster"
+	"pull2push/core/memory"
+	"pull2push/core/playlist"
+	"pull2push/core/stream"
+	"pull2push/core/synthetic"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+/*
+StreamManager 按配置文件里的 streams 管理 broker
+
+	Apply 把新配置和当前生效的配置做 diff：
+		新增的流：创建 broker 并加入对应的广播器，内存预算剩余不足 memory.stream_reserve 时拒绝
+		删除的流：从广播器移除并停止拉流
+		只改了 url 的 flv/ts 流：UpdateSourceURL 切换上游，已连接的观众不断开
+		其他修改（类型、缓存大小、起播缓存策略、hls 码率等）：停止旧 broker，用新配置重建
+	转推目标只对比配置文件里声明的那部分，运行时通过接口添加的目标不受影响，broker 重建后挂到新 broker 上继续推；
+	删除流时所有转推目标一起停止。
+*/
+
+// ApplyResult 一次 Apply 的变化
+type ApplyResult struct {
+	Added    []string `json:"added"`
+	Removed  []string `json:"removed"`
+	Updated  []string `json:"updated"`  // 原地切换上游地址、断流垫片 / camera 推流策略
+	Replaced []string `json:"replaced"` // 重建 broker
+}
+
+// StreamManager 配置驱动的 broker 管理
+type StreamManager struct {
+	mutex sync.Mutex
+	ctx   context.Context
+
+	flvPool     broadcast.Broadcaster // flv / ts / synthetic / file
+	hlsPool     broadcast.Broadcaster
+	cameraPool  broadcast.Broadcaster
+	pushManager *pushClient.PushManager
+	cluster     *cluster.Cluster // 为 nil 时单机运行
+
+	reserve int64                          // 新增一路流时至少要剩余的内存预算
+	streams map[string]config.StreamConfig // 当前生效的流，Buffer 已经换算成实际值
+	pushes  map[string]map[string]string   // brokerKey -> 配置里的转推地址 -> targetId
+}
+
+func NewStreamManager(ctx context.Context, flvPool, hlsPool, cameraPool broadcast.Broadcaster, pushManager *pushClient.PushManager, c *cluster.Cluster) *StreamManager {
+	return &StreamManager{
+		ctx:         ctx,
+		flvPool:     flvPool,
+		hlsPool:     hlsPool,
+		cameraPool:  cameraPool,
+		pushManager: pushManager,
+		cluster:     c,
+		streams:     make(map[string]config.StreamConfig),
+		pushes:      make(map[string]map[string]string),
+	}
+}
+
+// Apply 按新配置增删改 broker
+func (m *StreamManager) Apply(cfg *config.Config) ApplyResult {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var result ApplyResult
+	m.reserve = int64(cfg.Memory.StreamReserve)
+	wanted := make(map[string]config.StreamConfig, len(cfg.Streams))
+	for _, s := range cfg.Streams {
+		s.Buffer = cfg.StreamBuffer(s)
+		s.Cache = cfg.StreamCache(s)
+		if s.Type == config.StreamTypeCamera {
+			s.Publish = cfg.StreamPublish(s)
+		}
+		wanted[s.Key] = s
+	}
+
+	for key := range m.streams {
+		if _, ok := wanted[key]; !ok {
+			m.removeStream(key)
+			result.Removed = append(result.Removed, key)
+		}
+	}
+
+	for _, key := range sortedKeys(wanted) {
+		s := wanted[key]
+		old, exists := m.streams[key]
+		switch {
+		case !exists:
+			if err := m.addStream(s); err != nil {
+				log.Printf("[manager] add stream %s failed: %v", key, err)
+				continue
+			}
+			result.Added = append(result.Added, key)
+		case sameExceptPush(old, s):
+			// 流本身没变，只可能改了转推目标
+		case onlySourceChanged(old, s):
+			m.updateSource(old, s)
+			m.streams[key] = s
+			result.Updated = append(result.Updated, key)
+		case onlyPublishChanged(old, s):
+			if b, err := m.cameraPool.FindBroker(key); err == nil {
+				if cb, ok := b.(*cameraBroker.CameraBroker); ok {
+					cb.SetPublishPolicy(publishPolicy(s.Publish))
+				}
+			}
+			m.streams[key] = s
+			result.Updated = append(result.Updated, key)
+		default:
+			if err := m.replaceStream(s); err != nil {
+				log.Printf("[manager] replace stream %s failed: %v", key, err)
+				continue
+			}
+			result.Replaced = append(result.Replaced, key)
+		}
+		m.syncPush(key, s.Push)
+	}
+
+	log.Printf("[manager] streams applied: added=%v removed=%v updated=%v replaced=%v",
+		result.Added, result.Removed, result.Updated, result.Replaced)
+	return result
+}
+
+// Streams 当前生效的流配置
+func (m *StreamManager) Streams() []config.StreamConfig {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	list := make([]config.StreamConfig, 0, len(m.streams))
+	for _, key := range sortedKeys(m.streams) {
+		list = append(list, m.streams[key])
+	}
+	return list
+}
+
+// FindBroker 查询流当前的 broker 和配置
+func (m *StreamManager) FindBroker(key string) (broker.Broker, config.StreamConfig, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.streams[key]
+	if !ok {
+		return nil, config.StreamConfig{}, fmt.Errorf("未找到 %s 对应的流", key)
+	}
+	b, err := m.poolOf(s.Type).FindBroker(key)
+	return b, s, err
+}
+
+// Stop 停止一路流，配置文件下次重新加载时会按配置恢复
+func (m *StreamManager) Stop(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.streams[key]; !ok {
+		return fmt.Errorf("未找到 %s 对应的流", key)
+	}
+	m.removeStream(key)
+	log.Printf("[manager] stream %s stopped", key)
+	return nil
+}
+
+// SwitchURL 临时切换上游地址，flv / ts 原地切换，hls 重建 broker；配置文件下次修改时以配置为准
+func (m *StreamManager) SwitchURL(key, url string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s, ok := m.streams[key]
+	if !ok {
+		return fmt.Errorf("未找到 %s 对应的流", key)
+	}
+	if s.Type == config.StreamTypeCamera {
+		return fmt.Errorf("%s 是推流的 camera，没有上游地址", key)
+	}
+
+	old := s
+	s.URL = url
+	if onlySourceChanged(old, s) {
+		m.updateSource(old, s)
+		m.streams[key] = s
+	} else {
+		if err := m.replaceStream(s); err != nil {
+			return err
+		}
+		m.syncPush(key, s.Push)
+	}
+	log.Printf("[manager] stream %s switched to %s", key, url)
+	return nil
+}
+
+// addStream 创建 broker 并加入广播器，内存预算不够时拒绝，配置下次重新加载时再尝试；调用方需持有 mutex
+func (m *StreamManager) addStream(s config.StreamConfig) error {
+	if err := memory.Default.Admit(m.reserve); err != nil {
+		return err
+	}
+	var b broker.Broker
+	switch s.Type {
+	case config.StreamTypeFLV:
+		b = m.newFLVBroker(s, flvBroker.DialSource)
+	case config.StreamTypeTS:
+		b = m.newFLVBroker(s, tsBroker.DialTS)
+	case config.StreamTypeSynthetic:
+		b = m.newFLVBroker(s, synthetic.DialSynthetic)
+	case config.StreamTypeFile:
+		b = m.newFLVBroker(s, playlist.NewDialer(playlistItems(s.Playlist)))
+	case config.StreamTypeHLS:
+		b = hlsBroker.NewHLSM3U8Broker(m.ctx, s.Key, s.URL, s.Variant, s.Buffer)
+	case config.StreamTypeCamera:
+		cb := cameraBroker.NewCameraBroker(s.Key, s.Buffer)
+		cb.SetPublishPolicy(publishPolicy(s.Publish))
+		cb.SetCachePolicy(cachePolicy(s.Cache))
+		b = cb
+	default:
+		return fmt.Errorf("不支持的流类型 %s", s.Type)
+	}
+	if fb, ok := b.(*flvBroker.FLVStreamBroker); ok && s.Fallback != "" {
+		setFallback(fb, s)
+	}
+	// flv / camera 实现了 stream.Broker，要 Start 之后才开始拉流和监听状态，m.ctx 结束时随之关闭
+	if sb, ok := b.(stream.Broker); ok {
+		if err := sb.Start(m.ctx); err != nil {
+			return err
+		}
+	}
+	m.poolOf(s.Type).AddBroker(s.Key, b)
+	m.streams[s.Key] = s
+	return nil
+}
+
+// updateSource 原地切换上游地址和断流垫片，调用方需持有 mutex
+func (m *StreamManager) updateSource(old, s config.StreamConfig) {
+	b, err := m.flvPool.FindBroker(s.Key)
+	if err != nil {
+		return
+	}
+	if old.URL != s.URL {
+		b.UpdateSourceURL(s.URL)
+	}
+	if fb, ok := b.(*flvBroker.FLVStreamBroker); ok && (old.Fallback != s.Fallback || old.FallbackAfter != s.FallbackAfter) {
+		setFallback(fb, s)
+	}
+}
+
+// setFallback 加载断流垫片，文件读取失败时不插播
+func setFallback(b *flvBroker.FLVStreamBroker, s config.StreamConfig) {
+	if s.Fallback == "" {
+		b.SetFallback(nil, 0)
+		return
+	}
+	slate, err := playlist.LoadSlate(s.Fallback)
+	if err != nil {
+		log.Printf("[manager] stream %s fallback: %v", s.Key, err)
+		b.SetFallback(nil, 0)
+		return
+	}
+	b.SetFallback(slate, s.FallbackAfter)
+}
+
+// newFLVBroker 按流的起播缓存策略创建 broker，集群模式下把数据源包装成按 origin 拉流
+func (m *StreamManager) newFLVBroker(s config.StreamConfig, dialer flvBroker.SourceDialer) *flvBroker.FLVStreamBroker {
+	if m.cluster != nil {
+		dialer = m.cluster.Dialer(s.Key, dialer)
+	}
+	return flvBroker.NewFLVStreamBrokerWithPolicy(s.Key, s.URL, dialer, cachePolicy(s.Cache))
+}
+
+// removeStream 停止转推、从广播器移除并停止拉流，调用方需持有 mutex
+func (m *StreamManager) removeStream(key string) {
+	m.pushManager.RemoveBroker(key)
+	delete(m.pushes, key)
+	m.closeBroker(key)
+}
+
+// replaceStream 停掉旧 broker 按新配置重建，运行时添加的转推目标挂到新 broker 上，
+// 配置里声明的由调用方随后 syncPush 重新添加；调用方需持有 mutex
+func (m *StreamManager) replaceStream(s config.StreamConfig) error {
+	configured := m.pushes[s.Key]
+	delete(m.pushes, s.Key)
+	m.closeBroker(s.Key)
+	if err := m.addStream(s); err != nil {
+		m.pushManager.RemoveBroker(s.Key)
+		return err
+	}
+	m.pushManager.ReplaceBroker(s.Key, func(targetURL string) bool {
+		_, ok := configured[targetURL]
+		return !ok
+	})
+	return nil
+}
+
+// closeBroker 从广播器移除并停止拉流，调用方需持有 mutex
+func (m *StreamManager) closeBroker(key string) {
+	s := m.streams[key]
+	pool := m.poolOf(s.Type)
+	if b, err := pool.FindBroker(key); err == nil {
+		pool.RemoveBroker(key)
+		if closer, ok := b.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	delete(m.streams, key)
+}
+
+// syncPush 让配置里声明的转推目标和 urls 一致，调用方需持有 mutex
+func (m *StreamManager) syncPush(key string, urls []string) {
+	current := m.pushes[key]
+	if current == nil {
+		current = make(map[string]string)
+		m.pushes[key] = current
+	}
+	wanted := make(map[string]bool, len(urls))
+	for _, u := range urls {
+		wanted[u] = true
+	}
+	for u, targetId := range current {
+		if !wanted[u] {
+			if err := m.pushManager.RemoveTarget(key, targetId); err != nil {
+				log.Printf("[manager] remove push %s -> %s: %v", key, u, err)
+			}
+			delete(current, u)
+		}
+	}
+	for _, u := range urls {
+		if _, ok := current[u]; ok {
+			continue
+		}
+		targetId, err := m.pushManager.AddTarget(key, u)
+		if err != nil {
+			log.Printf("[manager] add push %s -> %s failed: %v", key, u, err)
+			continue
+		}
+		current[u] = targetId
+	}
+}
+
+// poolOf 流类型对应的广播器，flv / ts / synthetic 共用 flv 的广播器
+func (m *StreamManager) poolOf(streamType string) broadcast.Broadcaster {
+	switch streamType {
+	case config.StreamTypeHLS:
+		return m.hlsPool
+	case config.StreamTypeCamera:
+		return m.cameraPool
+	}
+	return m.flvPool
+}
+
+func sameExceptPush(a, b config.StreamConfig) bool {
+	a.Push, b.Push = nil, nil
+	return reflect.DeepEqual(a, b)
+}
+
+// onlySourceChanged flv / ts / synthetic / file 只改了上游地址或者断流垫片时可以原地切换，
+// file 改了节目单要重新创建 broker
+func onlySourceChanged(a, b config.StreamConfig) bool {
+	if !a.PullsFLV() {
+		return false
+	}
+	a.URL, b.URL = "", ""
+	a.Fallback, b.Fallback = "", ""
+	a.FallbackAfter, b.FallbackAfter = 0, 0
+	return sameExceptPush(a, b)
+}
+
+// onlyPublishChanged camera 只改了推流策略时原地修改，不断开推流和观众
+func onlyPublishChanged(a, b config.StreamConfig) bool {
+	if a.Type != config.StreamTypeCamera {
+		return false
+	}
+	a.Publish, b.Publish = config.PublishConfig{}, config.PublishConfig{}
+	return sameExceptPush(a, b)
+}
+
+// playlistItems 配置里的节目单换成 playlist 包的，at 已经在加载配置时校验过
+func playlistItems(items []config.PlaylistItem) []playlist.Item {
+	out := make([]playlist.Item, 0, len(items))
+	for _, item := range items {
+		pi := playlist.Item{File: item.File, Loop: item.Loop}
+		if item.At != "" {
+			pi.At, _ = playlist.ParseAt(item.At)
+			pi.Scheduled = true
+		}
+		out = append(out, pi)
+	}
+	return out
+}
+
+// publishPolicy 配置里的推流策略换成 camera broker 的
+func publishPolicy(p config.PublishConfig) cameraBroker.PublishPolicy {
+	return cameraBroker.PublishPolicy{
+		Grace:       p.Grace,
+		HoldFrame:   p.HoldFrame,
+		OnDuplicate: cameraBroker.DUPLICATE_POLICY(p.OnDuplicate),
+	}
+}
+
+// cachePolicy 配置里的起播缓存策略换成 broker 的
+func cachePolicy(c config.StartCacheConfig) broker.CachePolicy {
+	return broker.CachePolicy{
+		GOPs:     c.GOPs,
+		Duration: c.Duration,
+		MaxBytes: int(c.MaxBytes),
+		Start:    broker.START_MODE(c.Start),
+		Retain:   c.ClipWindow,
+	}
+}
+
+func sortedKeys(m map[string]config.StreamConfig) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
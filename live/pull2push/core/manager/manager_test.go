@@ -0,0 +1,304 @@
+package manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"pull2push/config"
+	"pull2push/core/broadcast"
+	cameraBroadcast "pull2push/core/broadcast/camera"
+	flvBroadcast "pull2push/core/broadcast/flv"
+	hlsBroadcast "pull2push/core/broadcast/hls"
+	"pull2push/core/broker"
+	cameraBroker "pull2push/core/broker/camera"
+	pushClient "pull2push/core/client/push"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubPool 记录 AddBroker / RemoveBroker 的广播器，broker 包一层 recordBroker 记录 UpdateSourceURL
+type stubPool struct {
+	mu      sync.Mutex
+	brokers map[string]*recordBroker
+	events  []string
+}
+
+func newStubPool() *stubPool {
+	return &stubPool{brokers: make(map[string]*recordBroker)}
+}
+
+func (p *stubPool) AddBroker(brokerKey string, b broker.Broker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.brokers[brokerKey] = &recordBroker{Broker: b}
+	p.events = append(p.events, "add "+brokerKey)
+}
+
+func (p *stubPool) RemoveBroker(brokerKey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.brokers, brokerKey)
+	p.events = append(p.events, "remove "+brokerKey)
+}
+
+func (p *stubPool) FindBroker(brokerKey string) (broker.Broker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if b, ok := p.brokers[brokerKey]; ok {
+		return b, nil
+	}
+	return nil, fmt.Errorf("未找到 %s", brokerKey)
+}
+
+// takeEvents 取出并清空记录的操作
+func (p *stubPool) takeEvents() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	events := p.events
+	p.events = nil
+	return events
+}
+
+type recordBroker struct {
+	broker.Broker
+	urls []string
+}
+
+func (b *recordBroker) UpdateSourceURL(newSourceURL string) {
+	b.urls = append(b.urls, newSourceURL)
+	b.Broker.UpdateSourceURL(newSourceURL)
+}
+
+// Close 停止被包装的 broker，removeStream 通过 io.Closer 停止拉流
+func (b *recordBroker) Close() error {
+	if closer, ok := b.Broker.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func TestStreamManagerApply(t *testing.T) {
+	syn := func(url string) config.StreamConfig {
+		return config.StreamConfig{Key: "a", Type: config.StreamTypeSynthetic, URL: url}
+	}
+	cam := func(buffer int, push ...string) config.StreamConfig {
+		return config.StreamConfig{Key: "c", Type: config.StreamTypeCamera, Buffer: buffer, Push: push}
+	}
+	tests := []struct {
+		name   string
+		from   []config.StreamConfig
+		to     []config.StreamConfig
+		want   ApplyResult
+		flv    []string // 第二次 Apply 时 flv 广播器上的操作
+		camera []string // 第二次 Apply 时 camera 广播器上的操作
+		urls   []string // 第二次 Apply 时 a 收到的 UpdateSourceURL
+		pushes int      // 第二次 Apply 之后 c 的转推目标数
+	}{
+		{
+			name: "新增",
+			to:   []config.StreamConfig{syn("synthetic://a"), cam(10)},
+			want: ApplyResult{Added: []string{"a", "c"}},
+			flv:  []string{"add a"}, camera: []string{"add c"},
+		},
+		{
+			name: "删除",
+			from: []config.StreamConfig{syn("synthetic://a"), cam(10)},
+			to:   []config.StreamConfig{cam(10)},
+			want: ApplyResult{Removed: []string{"a"}},
+			flv:  []string{"remove a"},
+		},
+		{
+			name: "只改 url 原地切换",
+			from: []config.StreamConfig{syn("synthetic://a?fps=25")},
+			to:   []config.StreamConfig{syn("synthetic://a?fps=30")},
+			want: ApplyResult{Updated: []string{"a"}},
+			urls: []string{"synthetic://a?fps=30"},
+		},
+		{
+			name: "改类型重建",
+			from: []config.StreamConfig{syn("synthetic://a")},
+			to:   []config.StreamConfig{{Key: "a", Type: config.StreamTypeCamera}},
+			want: ApplyResult{Replaced: []string{"a"}},
+			flv:  []string{"remove a"}, camera: []string{"add a"},
+		},
+		{
+			name:   "改缓存大小重建",
+			from:   []config.StreamConfig{cam(10)},
+			to:     []config.StreamConfig{cam(20)},
+			want:   ApplyResult{Replaced: []string{"c"}},
+			camera: []string{"remove c", "add c"},
+		},
+		{
+			name:   "只改转推目标",
+			from:   []config.StreamConfig{cam(10)},
+			to:     []config.StreamConfig{cam(10, "rtmp://127.0.0.1:1/live/c")},
+			pushes: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			flvPool, hlsPool, cameraPool := newStubPool(), newStubPool(), newStubPool()
+			pm := pushClient.NewPushManager(flvPool, hlsPool, cameraPool)
+			m := NewStreamManager(ctx, flvPool, hlsPool, cameraPool, pm, nil)
+			defer m.Apply(&config.Config{}) // 停掉所有 broker 和转推
+
+			m.Apply(&config.Config{Streams: tt.from})
+			flvPool.takeEvents()
+			cameraPool.takeEvents()
+			var before *recordBroker
+			if b, err := flvPool.FindBroker("a"); err == nil {
+				before = b.(*recordBroker)
+			}
+
+			got := m.Apply(&config.Config{Streams: tt.to})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply = %+v，期望 %+v", got, tt.want)
+			}
+			if events := flvPool.takeEvents(); !reflect.DeepEqual(events, tt.flv) {
+				t.Errorf("flv 广播器 %v，期望 %v", events, tt.flv)
+			}
+			if events := cameraPool.takeEvents(); !reflect.DeepEqual(events, tt.camera) {
+				t.Errorf("camera 广播器 %v，期望 %v", events, tt.camera)
+			}
+			if before != nil && !reflect.DeepEqual(before.urls, tt.urls) {
+				t.Errorf("UpdateSourceURL %v，期望 %v", before.urls, tt.urls)
+			}
+			if n := len(pm.ListTargets("c")); n != tt.pushes {
+				t.Errorf("转推目标 %d 个，期望 %d", n, tt.pushes)
+			}
+		})
+	}
+}
+
+// 重建 broker 时运行时添加的转推目标保留原来的编号继续推，删除流时一起停止
+func TestReplaceKeepsRuntimePush(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flvPool, hlsPool, cameraPool := newStubPool(), newStubPool(), newStubPool()
+	pm := pushClient.NewPushManager(flvPool, hlsPool, cameraPool)
+	m := NewStreamManager(ctx, flvPool, hlsPool, cameraPool, pm, nil)
+	defer m.Apply(&config.Config{})
+
+	const cfgURL, runtimeURL = "rtmp://127.0.0.1:1/live/cfg", "rtmp://127.0.0.1:1/live/runtime"
+	cam := func(buffer int) *config.Config {
+		return &config.Config{Streams: []config.StreamConfig{{Key: "c", Type: config.StreamTypeCamera, Buffer: buffer, Push: []string{cfgURL}}}}
+	}
+	m.Apply(cam(10))
+	targetId, err := pm.AddTarget("c", runtimeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.Apply(cam(20)); !reflect.DeepEqual(got.Replaced, []string{"c"}) {
+		t.Fatalf("Apply = %+v，期望重建 c", got)
+	}
+	urls := make(map[string]string)
+	for _, st := range pm.ListTargets("c") {
+		urls[st.URL] = st.TargetId
+	}
+	if len(urls) != 2 || urls[runtimeURL] != targetId || urls[cfgURL] == "" {
+		t.Errorf("重建后的转推目标 %v，期望 %s=%s 和配置里的 %s", urls, runtimeURL, targetId, cfgURL)
+	}
+
+	m.Apply(&config.Config{})
+	if n := len(pm.ListTargets("c")); n != 0 {
+		t.Errorf("删除流之后还有 %d 个转推目标", n)
+	}
+}
+
+// 配置热更新增删 broker 的同时，HTTP 请求在广播器里查找 broker；用 -race 运行
+func TestApplyConcurrentFindBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flvPool, hlsPool, cameraPool := flvBroadcast.NewFLVBroadcaster(), hlsBroadcast.NewBroadcaster(), cameraBroadcast.NewCameraBroadcaster()
+	pm := pushClient.NewPushManager(flvPool, hlsPool, cameraPool)
+	m := NewStreamManager(ctx, flvPool, hlsPool, cameraPool, pm, nil)
+	defer m.Apply(&config.Config{})
+
+	stop := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for _, pool := range []broadcast.Broadcaster{flvPool, cameraPool} {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					pool.FindBroker("a")
+					pool.FindBroker("c")
+				}
+			}
+		}()
+	}
+	full := &config.Config{Streams: []config.StreamConfig{
+		{Key: "a", Type: config.StreamTypeSynthetic, URL: "synthetic://a"},
+		{Key: "c", Type: config.StreamTypeCamera},
+	}}
+	started.Wait()
+	for range 20 {
+		m.Apply(full)
+		m.Apply(&config.Config{})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// kickViewer 记录被踢出原因的观众
+type kickViewer struct {
+	kicked chan string
+}
+
+func (v *kickViewer) Broadcast(data []byte)    {}
+func (v *kickViewer) Listen()                  {}
+func (v *kickViewer) GetDataChan() chan []byte { return nil }
+func (v *kickViewer) Kick(reason string)       { v.kicked <- reason }
+
+// 配置里删掉或重建 camera 流时，已经在看的观众要被断开，不能一直挂着等数据
+func TestRemoveCameraStreamKicksViewers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	flvPool, hlsPool, cameraPool := flvBroadcast.NewFLVBroadcaster(), hlsBroadcast.NewBroadcaster(), cameraBroadcast.NewCameraBroadcaster()
+	m := NewStreamManager(ctx, flvPool, hlsPool, cameraPool, pushClient.NewPushManager(flvPool, hlsPool, cameraPool), nil)
+	defer m.Apply(&config.Config{})
+
+	cam := func(buffer int) *config.Config {
+		return &config.Config{Streams: []config.StreamConfig{{Key: "c", Type: config.StreamTypeCamera, Buffer: buffer}}}
+	}
+	m.Apply(cam(10))
+	for _, next := range []*config.Config{cam(20), {}} {
+		b, err := cameraPool.FindBroker("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb := b.(*cameraBroker.CameraBroker)
+		v := &kickViewer{kicked: make(chan string, 1)}
+		cb.AddLiveClient("v", v)
+
+		m.Apply(next)
+		select {
+		case reason := <-v.kicked:
+			if reason == "" {
+				t.Error("踢出原因为空")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("移除 camera 流之后观众没有被断开")
+		}
+
+		// 移除之后才加入的观众直接断开
+		late := &kickViewer{kicked: make(chan string, 1)}
+		cb.AddLiveClient("late", late)
+		select {
+		case <-late.kicked:
+		default:
+			t.Error("加入已关闭的 broker 没有被断开")
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Budget 进程内所有缓存共用的内存预算
+
+	各个 broker 的缓存（FLV 环形缓冲、HLS 分片、camera GOP）和客户端的通道都记在所属流的 Account 上，
+	写入时 Charge，被覆盖 / 淘汰 / 关闭时 Free，预算按所有流的总和判断：
+
+	准入：新增一路流前 Admit(reserve)，剩余预算不够时拒绝；新观众 Admit(0)，预算已经用完时拒绝
+	淘汰：总用量超过上限时（Over），缓存只保留最近一个 GOP / 最新的分片，不再多缓存历史数据
+
+	只统计缓存住的数据，不是进程的 RSS，上限要给 goroutine 栈、socket 缓冲等留出余量。
+	上限为 0 表示不限制，只统计用量。
+*/
+type Budget struct {
+	limit atomic.Int64
+	used  atomic.Int64
+
+	mu       sync.Mutex
+	accounts map[string]*Account // map[brokerKey]Account
+}
+
+// Default 进程共用的预算，main 按配置设置上限
+var Default = NewBudget(0)
+
+func NewBudget(limit int64) *Budget {
+	b := &Budget{accounts: make(map[string]*Account)}
+	b.limit.Store(limit)
+	return b
+}
+
+// SetLimit 修改上限，配置热更新时调用
+func (b *Budget) SetLimit(limit int64) {
+	b.limit.Store(limit)
+}
+
+// Limit 当前上限，0 表示不限制
+func (b *Budget) Limit() int64 {
+	return b.limit.Load()
+}
+
+// Used 所有流当前的用量
+func (b *Budget) Used() int64 {
+	return b.used.Load()
+}
+
+// Over 总用量是否超过上限，缓存据此淘汰历史数据
+func (b *Budget) Over() bool {
+	limit := b.limit.Load()
+	return limit > 0 && b.used.Load() > limit
+}
+
+// Admit 剩余预算是否还能放下 reserve 字节，不能时返回原因
+func (b *Budget) Admit(reserve int64) error {
+	limit := b.limit.Load()
+	if limit <= 0 {
+		return nil
+	}
+	used := b.used.Load()
+	if used+reserve > limit {
+		return fmt.Errorf("内存预算不足：已用 %s / %s，需要 %s", FormatBytes(used), FormatBytes(limit), FormatBytes(reserve))
+	}
+	return nil
+}
+
+// Open 打开一路流的账户，同一个 brokerKey 的 broker 和客户端共用一个账户，每次 Open 都要对应一次 Close
+func (b *Budget) Open(brokerKey string) *Account {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a := b.accounts[brokerKey]
+	if a == nil {
+		a = &Account{budget: b, key: brokerKey}
+		b.accounts[brokerKey] = a
+	}
+	a.refs++
+	return a
+}
+
+// Usage 一路流当前的用量
+func (b *Budget) Usage(brokerKey string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a := b.accounts[brokerKey]; a != nil {
+		return a.used.Load()
+	}
+	return 0
+}
+
+// BudgetStats 预算和各路流的用量
+type BudgetStats struct {
+	Limit   int64         `json:"limit"`
+	Used    int64         `json:"used"`
+	Over    bool          `json:"over"`
+	Streams []StreamUsage `json:"streams"` // 按用量从大到小
+}
+
+type StreamUsage struct {
+	BrokerKey string `json:"brokerKey"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// Stats 当前的预算快照
+func (b *Budget) Stats() BudgetStats {
+	b.mu.Lock()
+	streams := make([]StreamUsage, 0, len(b.accounts))
+	for key, a := range b.accounts {
+		streams = append(streams, StreamUsage{BrokerKey: key, Bytes: a.used.Load()})
+	}
+	b.mu.Unlock()
+	sort.Slice(streams, func(i, j int) bool {
+		if streams[i].Bytes != streams[j].Bytes {
+			return streams[i].Bytes > streams[j].Bytes
+		}
+		return streams[i].BrokerKey < streams[j].BrokerKey
+	})
+	return BudgetStats{Limit: b.Limit(), Used: b.Used(), Over: b.Over(), Streams: streams}
+}
+
+// ====================== Account ======================
+
+// Account 一路流的用量，nil 的 Account 可以直接使用（不记账），方便单独创建 broker 的测试
+type Account struct {
+	budget *Budget
+	key    string
+	used   atomic.Int64
+	closed atomic.Bool // 关闭之后的 Charge / Free 不再记账，拉流循环可能在 Close 之后还写入一次
+	refs   int         // 由 budget.mu 保护
+}
+
+// Charge 记入 n 字节
+func (a *Account) Charge(n int) {
+	if a == nil || n == 0 || a.closed.Load() {
+		return
+	}
+	a.used.Add(int64(n))
+	a.budget.used.Add(int64(n))
+}
+
+// Free 释放 n 字节
+func (a *Account) Free(n int) {
+	a.Charge(-n)
+}
+
+// Over 整个进程的预算是否已经超出
+func (a *Account) Over() bool {
+	return a != nil && a.budget.Over()
+}
+
+// Used 这路流当前的用量
+func (a *Account) Used() int64 {
+	if a == nil {
+		return 0
+	}
+	return a.used.Load()
+}
+
+// Close 释放一次 Open，最后一个使用者关闭时把剩余的用量全部归还，账户从预算里移除
+func (a *Account) Close() {
+	if a == nil {
+		return
+	}
+	b := a.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	a.refs--
+	if a.refs > 0 {
+		return
+	}
+	if b.accounts[a.key] == a {
+		delete(b.accounts, a.key)
+	}
+	a.closed.Store(true)
+	b.used.Add(-a.used.Swap(0))
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"testing"
+)
+
+func TestBudgetAccounts(t *testing.T) {
+	b := NewBudget(1000)
+	a1 := b.Open("a")
+	a2 := b.Open("a") // 同一路流的 broker 和客户端共用账户
+	c := b.Open("c")
+
+	a1.Charge(600)
+	a2.Charge(100)
+	c.Charge(200)
+	if b.Used() != 900 || b.Usage("a") != 700 || b.Over() {
+		t.Fatalf("used %d, a %d, over %v", b.Used(), b.Usage("a"), b.Over())
+	}
+	if err := b.Admit(50); err != nil {
+		t.Fatalf("admit 50: %v", err)
+	}
+	if err := b.Admit(200); err == nil {
+		t.Fatal("admit 200 should fail")
+	}
+
+	c.Charge(200)
+	if !a1.Over() {
+		t.Fatal("budget should be over")
+	}
+	if stats := b.Stats(); stats.Streams[0].BrokerKey != "a" || stats.Streams[1].Bytes != 400 {
+		t.Fatalf("stats %+v", stats)
+	}
+
+	// 最后一个使用者关闭时归还全部用量，之后的记账不再生效
+	c.Close()
+	c.Charge(100)
+	a1.Close()
+	if b.Used() != 700 || b.Usage("c") != 0 {
+		t.Fatalf("used %d after closing c", b.Used())
+	}
+	a2.Close()
+	if b.Used() != 0 || len(b.Stats().Streams) != 0 {
+		t.Fatalf("used %d after closing all", b.Used())
+	}
+
+	var nilAccount *Account
+	nilAccount.Charge(10)
+	nilAccount.Close()
+}
+
+func TestPool(t *testing.T) {
+	b := Get(1000)
+	if len(b) != 1000 || cap(b) != 4<<10 {
+		t.Fatalf("len %d cap %d", len(b), cap(b))
+	}
+	Put(b)
+	if big := Get(64 << 20); len(big) != 64<<20 {
+		t.Fatalf("len %d", len(big))
+	}
+
+	buf := GetBuffer()
+	buf.WriteString("abc")
+	PutBuffer(buf)
+	if GetBuffer().Len() != 0 {
+		t.Fatal("pooled buffer not reset")
+	}
+}
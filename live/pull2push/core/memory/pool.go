@@ -0,0 +1,105 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+/*
+临时缓冲池
+
+	只用于生命周期明确的临时缓冲：读上游的暂存区、HLS 分片下载、TS 复用的输出等，用完马上 Put 回来。
+	进了环形缓冲 / GOP 缓存的包会被多个观众同时引用，什么时候不再使用无法确定，不能放回池子，
+	这部分内存通过 Account 记账控制。
+*/
+
+// maxPooledSize 超过这个容量的缓冲用完直接丢掉，避免偶尔一个大分片让池子一直占着大块内存
+const maxPooledSize = 8 << 20
+
+// sizeClasses 按 2 的幂分级，Get(n) 从能放下 n 的最小一级取
+var sizeClasses = []int{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+var bytePools = func() []*sync.Pool {
+	pools := make([]*sync.Pool, len(sizeClasses))
+	for i, size := range sizeClasses {
+		size := size
+		pools[i] = &sync.Pool{New: func() any {
+			b := make([]byte, size)
+			return &b
+		}}
+	}
+	return pools
+}()
+
+var bufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Get 取一个长度为 n 的临时切片，内容不清零
+func Get(n int) []byte {
+	for i, size := range sizeClasses {
+		if n <= size {
+			b := *bytePools[i].Get().(*[]byte)
+			return b[:n]
+		}
+	}
+	return make([]byte, n)
+}
+
+// Put 归还 Get 得到的切片，之后不能再使用
+func Put(b []byte) {
+	c := cap(b)
+	for i, size := range sizeClasses {
+		if c == size {
+			b = b[:size]
+			bytePools[i].Put(&b)
+			return
+		}
+	}
+}
+
+// GetBuffer 取一个空的 bytes.Buffer
+func GetBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// PutBuffer 归还 GetBuffer 得到的 bytes.Buffer，之后不能再使用它和它返回过的 Bytes()
+func PutBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// ReadAll 和 io.ReadAll 一样，但是先读进池子里的缓冲再拷贝成刚好大小的切片，
+// 大文件（HLS 分片）不会在扩容过程中产生多份垃圾
+func ReadAll(r io.Reader) ([]byte, error) {
+	buf := GetBuffer()
+	defer PutBuffer(buf)
+	if _, err := buf.ReadFrom(r); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), buf.Bytes()...), nil
+}
+
+// chanSlotSize 通道里一个 []byte 元素占用的字节数（切片头）
+const chanSlotSize = 24
+
+// ChanOverhead 一个 chan []byte 缓冲区本身占用的内存，不含里面引用的数据
+func ChanOverhead(capacity int) int {
+	return capacity * chanSlotSize
+}
+
+// FormatBytes 人类可读的字节数
+func FormatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
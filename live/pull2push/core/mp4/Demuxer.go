@@ -0,0 +1,242 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	flvBroker "pull2push/core/broker/flv"
+	"time"
+)
+
+// ====================== Demuxer ======================
+
+/*
+Demuxer ISO-BMFF（MP4 / MOV）解复用，输出 FLV tag，可以直接作为 FLVStreamBroker 的上游或者本地文件源
+
+	支持 H.264 / H.265 视频，AAC / MP3 音频，其它轨道跳过；
+	moov 在文件头或者文件尾都可以，帧数据按 stco / co64 的偏移随机读取，不整个读进内存；
+	ctts 换算成 FLV 的 CompositionTime，编辑列表只处理开头的空编辑和第一段的 media_time；
+	输出顺序按解码时间交错，先发各轨道的序列头；时间戳从 0 开始（B 帧导致的负的解码时间整体后移）。
+	fragmented MP4（moof）不支持。
+*/
+type Demuxer struct {
+	r      io.ReaderAt
+	closer io.Closer
+	tracks []*track
+
+	header   []byte
+	pending  []*flvBroker.FlvTag // 还没有输出的序列头
+	duration time.Duration
+}
+
+// Open 打开一个本地 MP4 文件
+func Open(path string) (*Demuxer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	d, err := NewDemuxer(f, info.Size())
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	d.closer = f
+	return d, nil
+}
+
+// NewDemuxer 解析 moov，size 为整个文件的长度
+func NewDemuxer(r io.ReaderAt, size int64) (*Demuxer, error) {
+	top, err := readBoxes(r, 0, size)
+	if err != nil {
+		return nil, err
+	}
+	var moov box
+	found := false
+	for _, b := range top {
+		switch b.typ {
+		case "moov":
+			moov, found = b, true
+		case "moof":
+			return nil, errors.New("mp4: 不支持 fragmented MP4")
+		}
+	}
+	if !found {
+		return nil, errors.New("mp4: 缺少 moov")
+	}
+
+	d := &Demuxer{r: r}
+	movieTimescale, err := d.parseMovieHeader(moov)
+	if err != nil {
+		return nil, err
+	}
+	boxes, err := children(r, moov)
+	if err != nil {
+		return nil, err
+	}
+	var hasVideo, hasAudio bool
+	for _, b := range boxes {
+		if b.typ != "trak" {
+			continue
+		}
+		t, err := parseTrack(r, b, movieTimescale)
+		if errors.Is(err, errUnsupported) {
+			log.Printf("[mp4] 跳过不支持的轨道")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(t.samples) == 0 || (t.kind == "vide" && hasVideo) || (t.kind == "soun" && hasAudio) {
+			// FLV 只能有一路视频一路音频
+			continue
+		}
+		hasVideo = hasVideo || t.kind == "vide"
+		hasAudio = hasAudio || t.kind == "soun"
+		d.tracks = append(d.tracks, t)
+	}
+	if len(d.tracks) == 0 {
+		return nil, errors.New("mp4: 没有可以转成 FLV 的音视频轨道")
+	}
+
+	// 解码时间可能是负的（编辑列表去掉了 B 帧的延迟），整体后移让时间戳从 0 开始
+	minDts := int64(0)
+	for _, t := range d.tracks {
+		minDts = min(minDts, t.dts(0))
+	}
+	var flags byte
+	for _, t := range d.tracks {
+		t.shift -= minDts
+		if t.kind == "vide" {
+			flags |= 0x01
+		} else {
+			flags |= 0x04
+		}
+		if end := t.dts(len(t.samples) - 1); time.Duration(end)*time.Millisecond > d.duration {
+			d.duration = time.Duration(end) * time.Millisecond
+		}
+		if tag := t.sequenceTag(); tag != nil {
+			d.pending = append(d.pending, tag)
+		}
+	}
+	d.header = []byte{'F', 'L', 'V', 1, flags, 0, 0, 0, 9, 0, 0, 0, 0}
+	return d, nil
+}
+
+// parseMovieHeader mvhd 里的 timescale，编辑列表的时长用它
+func (d *Demuxer) parseMovieHeader(moov box) (uint32, error) {
+	mvhd, ok, err := find(d.r, moov, "mvhd")
+	if err != nil || !ok {
+		return 0, err
+	}
+	data, err := payload(d.r, mvhd)
+	if err != nil {
+		return 0, err
+	}
+	version, body, err := fullBox(data)
+	if err != nil {
+		return 0, err
+	}
+	tsOffset := 8
+	if version == 1 {
+		tsOffset = 16
+	}
+	if len(body) < tsOffset+4 {
+		return 0, errTruncated
+	}
+	return binary.BigEndian.Uint32(body[tsOffset:]), nil
+}
+
+// Header FLV 头，按实际的轨道设置音视频标志
+func (d *Demuxer) Header() []byte {
+	return d.header
+}
+
+// Duration 最后一帧的解码时间
+func (d *Demuxer) Duration() time.Duration {
+	return d.duration
+}
+
+// ReadTag 先输出序列头，然后按解码时间交错输出各轨道的帧，全部读完返回 io.EOF
+func (d *Demuxer) ReadTag() (*flvBroker.FlvTag, error) {
+	if len(d.pending) > 0 {
+		tag := d.pending[0]
+		d.pending = d.pending[1:]
+		return tag, nil
+	}
+	var next *track
+	for _, t := range d.tracks {
+		if t.next < len(t.samples) && (next == nil || t.dts(t.next) < next.dts(next.next)) {
+			next = t
+		}
+	}
+	if next == nil {
+		return nil, io.EOF
+	}
+	i := next.next
+	next.next++
+	return d.readFrame(next, i)
+}
+
+// Close 关闭文件
+func (d *Demuxer) Close() error {
+	if d.closer != nil {
+		return d.closer.Close()
+	}
+	return nil
+}
+
+// sequenceTag 轨道的序列头，MP3 没有
+func (t *track) sequenceTag() *flvBroker.FlvTag {
+	ts := uint32(t.dts(0))
+	switch {
+	case t.kind == "vide":
+		return flvBroker.NewVideoSequenceTag(t.codec, t.config, ts)
+	case t.codec == flvBroker.FormatAAC:
+		return flvBroker.NewAACSequenceTag(t.config, ts)
+	}
+	return nil
+}
+
+// readFrame 读出一帧打包成 FLV tag。MP4 和 FLV 的视频帧都是长度前缀的 NALU，长度字段的大小由同一份 avcC / hvcC 决定，
+// 帧数据可以原样放在 tag 头后面
+func (d *Demuxer) readFrame(t *track, i int) (*flvBroker.FlvTag, error) {
+	s := t.samples[i]
+	if s.size > maxPayload {
+		return nil, fmt.Errorf("mp4: trak %d 第 %d 帧有 %d 字节，太大", t.id, i, s.size)
+	}
+	dts := t.dts(i)
+	var body []byte
+	tagType := uint8(flvBroker.TagTypeAudio)
+	switch {
+	case t.kind == "vide":
+		cts := t.millis(s.dts+int64(s.cts)) + t.shift - dts
+		frameType := byte(0x20)
+		if s.key {
+			frameType = 0x10
+		}
+		body = make([]byte, 5+int(s.size))
+		body[0] = frameType | t.codec
+		body[1] = 0x01
+		body[2], body[3], body[4] = byte(cts>>16), byte(cts>>8), byte(cts)
+		tagType = flvBroker.TagTypeVideo
+	case t.codec == flvBroker.FormatAAC:
+		body = make([]byte, 2+int(s.size))
+		body[0], body[1] = 0xAF, 0x01
+	default:
+		// MP3：SoundFormat 2，44kHz，16bit，立体声（解码器以帧头为准）
+		body = make([]byte, 1+int(s.size))
+		body[0] = 0x2F
+	}
+	if _, err := d.r.ReadAt(body[len(body)-int(s.size):], s.offset); err != nil {
+		return nil, fmt.Errorf("mp4: 读取 trak %d 第 %d 帧: %w", t.id, i, err)
+	}
+	return flvBroker.NewFlvTag(tagType, uint32(dts), body), nil
+}
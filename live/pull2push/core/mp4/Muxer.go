@@ -0,0 +1,390 @@
+package mp4
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/stream"
+	"time"
+)
+
+// ====================== Muxer ======================
+
+/*
+Muxer 把 stream.Packet 封装成普通的（非 fragmented）MP4，导出直播片段时使用
+
+	支持 H.264 / H.265 视频，AAC / MP3 音频，各一个轨道；
+	帧数据先留在内存里（只引用，不复制），WriteTo 一次写出 ftyp + moov + mdat，moov 在前面，边下边播；
+	每个轨道一个 chunk，chunk 偏移用 co64，moov 的大小和偏移无关；
+	时间戳来自 FLV，精度是毫秒，两个轨道的 timescale 都是 1000，所有轨道第一帧的解码时间作为 0 点，
+	晚开始的轨道用编辑列表的空编辑对齐。中途更换的解码配置忽略，只用第一份。
+*/
+type Muxer struct {
+	video   *muxTrack
+	audio   *muxTrack
+	base    time.Duration // 第一帧的解码时间
+	hasBase bool
+}
+
+// muxTrack 一个输出轨道
+type muxTrack struct {
+	codec   string // stream.CodecAVC 等
+	config  []byte // avcC / hvcC / AudioSpecificConfig
+	samples []muxSample
+	size    int64 // 帧数据的总字节数
+}
+
+// muxSample 一帧，时间单位毫秒
+type muxSample struct {
+	data []byte
+	dts  int64
+	cts  int32 // 显示时间 - 解码时间
+	key  bool
+}
+
+// muxTimescale 输出轨道的 timescale，和 FLV 一样是毫秒
+const muxTimescale = 1000
+
+// NewMuxer 空的 Muxer，用 WritePacket 加入帧，最后 WriteTo 写出
+func NewMuxer() *Muxer {
+	return &Muxer{}
+}
+
+// WritePacket 加入一个包：解码配置保存下来写进 sample entry，元数据忽略；视频第一个关键帧之前的帧丢弃
+func (m *Muxer) WritePacket(p stream.Packet) error {
+	var t **muxTrack
+	switch {
+	case p.Kind == stream.PacketMetadata:
+		return nil
+	case p.Kind == stream.PacketVideo && (p.Codec == stream.CodecAVC || p.Codec == stream.CodecHEVC):
+		t = &m.video
+	case p.Kind == stream.PacketAudio && (p.Codec == stream.CodecAAC || p.Codec == stream.CodecMP3):
+		t = &m.audio
+	default:
+		return fmt.Errorf("mp4: 不支持 %s 编码 %q", p.Kind, p.Codec)
+	}
+	if *t == nil {
+		*t = &muxTrack{codec: p.Codec}
+	} else if (*t).codec != p.Codec {
+		return fmt.Errorf("mp4: %s 编码中途从 %s 换成了 %s", p.Kind, (*t).codec, p.Codec)
+	}
+	tr := *t
+	if p.Config {
+		if tr.config == nil {
+			tr.config = p.Payload
+		}
+		return nil
+	}
+	if len(p.Payload) == 0 || (p.Kind == stream.PacketVideo && len(tr.samples) == 0 && !p.KeyFrame) {
+		return nil
+	}
+	if !m.hasBase {
+		m.base, m.hasBase = p.DTS, true
+	}
+	tr.samples = append(tr.samples, muxSample{
+		data: p.Payload,
+		dts:  max(int64((p.DTS-m.base)/time.Millisecond), 0),
+		cts:  int32(p.CompositionTime() / time.Millisecond),
+		key:  p.KeyFrame || p.Kind == stream.PacketAudio,
+	})
+	tr.size += int64(len(p.Payload))
+	return nil
+}
+
+// Duration 最长的轨道的时长
+func (m *Muxer) Duration() time.Duration {
+	var d int64
+	for _, t := range m.tracks() {
+		d = max(d, t.end())
+	}
+	return time.Duration(d) * time.Millisecond
+}
+
+// WriteTo 写出完整的 MP4 文件
+func (m *Muxer) WriteTo(w io.Writer) (int64, error) {
+	tracks := m.tracks()
+	if len(tracks) == 0 {
+		return 0, errors.New("mp4: 没有可以写入的帧")
+	}
+	mdatSize := int64(8)
+	for _, t := range tracks {
+		mdatSize += t.size
+	}
+	if mdatSize > math.MaxUint32 {
+		return 0, fmt.Errorf("mp4: 帧数据 %d 字节，超过 4GB", mdatSize)
+	}
+	ftyp := boxBytes("ftyp", []byte("isom"), u32(512), []byte("isomiso2avc1mp41"))
+	moov, err := m.moov(tracks, 0)
+	if err != nil {
+		return 0, err
+	}
+	if moov, err = m.moov(tracks, int64(len(ftyp)+len(moov))+8); err != nil {
+		return 0, err
+	}
+
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, b := range [][]byte{ftyp, moov, binary.BigEndian.AppendUint32(nil, uint32(mdatSize)), []byte("mdat")} {
+		k, err := bw.Write(b)
+		n += int64(k)
+		if err != nil {
+			return n, err
+		}
+	}
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			k, err := bw.Write(s.data)
+			n += int64(k)
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, bw.Flush()
+}
+
+// tracks 有帧的轨道，视频在前；mdat 里的数据也按这个顺序
+func (m *Muxer) tracks() []*muxTrack {
+	var tracks []*muxTrack
+	for _, t := range []*muxTrack{m.video, m.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+// moov 所有轨道的 moov，dataOffset 是 mdat 里第一帧的文件偏移
+func (m *Muxer) moov(tracks []*muxTrack, dataOffset int64) ([]byte, error) {
+	duration := uint32(m.Duration() / time.Millisecond)
+	mvhd := fullBoxBytes("mvhd", 0, 0,
+		u32(0, 0, muxTimescale, duration, 0x00010000), u16(0x0100, 0), u32(0, 0), matrix, make([]byte, 24), u32(uint32(len(tracks)+1)))
+	boxes := [][]byte{mvhd}
+	for i, t := range tracks {
+		trak, err := t.trak(uint32(i+1), dataOffset)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, trak)
+		dataOffset += t.size
+	}
+	return boxBytes("moov", boxes...), nil
+}
+
+// matrix 单位矩阵
+var matrix = u32(0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000)
+
+// end 最后一帧结束的时间
+func (t *muxTrack) end() int64 {
+	deltas := t.deltas()
+	return t.samples[len(t.samples)-1].dts + int64(deltas[len(deltas)-1])
+}
+
+// deltas 每帧的时长，最后一帧按前一帧算
+func (t *muxTrack) deltas() []uint32 {
+	deltas := make([]uint32, len(t.samples))
+	for i := 0; i+1 < len(t.samples); i++ {
+		deltas[i] = uint32(max(t.samples[i+1].dts-t.samples[i].dts, 0))
+	}
+	if n := len(deltas); n > 1 {
+		deltas[n-1] = deltas[n-2]
+	}
+	return deltas
+}
+
+func (t *muxTrack) trak(id uint32, dataOffset int64) ([]byte, error) {
+	entry, width, height, err := t.sampleEntry()
+	if err != nil {
+		return nil, err
+	}
+	video := t.codec == stream.CodecAVC || t.codec == stream.CodecHEVC
+	first := t.samples[0].dts
+	duration := uint32(t.end() - first)
+	volume, handler, name := uint16(0), "vide", "VideoHandler"
+	mediaHeader := fullBoxBytes("vmhd", 0, 1, make([]byte, 8))
+	if !video {
+		volume, handler, name = 0x0100, "soun", "SoundHandler"
+		mediaHeader = fullBoxBytes("smhd", 0, 0, make([]byte, 4))
+	}
+
+	tkhd := fullBoxBytes("tkhd", 0, 3,
+		u32(0, 0, id, 0, uint32(t.end()), 0, 0), u16(0, 0, volume, 0), matrix, u32(uint32(width)<<16, uint32(height)<<16))
+	mdhd := fullBoxBytes("mdhd", 0, 0, u32(0, 0, muxTimescale, duration), u16(0x55C4, 0)) // und
+	hdlr := fullBoxBytes("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte(name+"\x00"))
+	dinf := boxBytes("dinf", fullBoxBytes("dref", 0, 0, u32(1), fullBoxBytes("url ", 0, 1)))
+	stbl := boxBytes("stbl", t.sampleTable(entry, dataOffset)...)
+	mdia := boxBytes("mdia", mdhd, hdlr, boxBytes("minf", mediaHeader, dinf, stbl))
+
+	trak := [][]byte{tkhd}
+	if first > 0 {
+		// 比其它轨道晚开始，前面放一段空编辑
+		elst := fullBoxBytes("elst", 0, 0, u32(2, uint32(first), math.MaxUint32, 0x00010000, duration, 0, 0x00010000))
+		trak = append(trak, boxBytes("edts", elst))
+	}
+	return boxBytes("trak", append(trak, mdia)...), nil
+}
+
+// sampleTable stbl 的子 box
+func (t *muxTrack) sampleTable(entry []byte, dataOffset int64) [][]byte {
+	n := uint32(len(t.samples))
+	deltas := t.deltas()
+	var stts, ctts, stss, sizes []byte
+	var sttsCount, cttsCount, keys uint32
+	negative, hasCTS := false, false
+	for i, s := range t.samples {
+		if i == 0 || deltas[i] != deltas[i-1] {
+			stts = append(stts, u32(1, deltas[i])...)
+			sttsCount++
+		} else {
+			last := len(stts) - 8
+			binary.BigEndian.PutUint32(stts[last:], binary.BigEndian.Uint32(stts[last:])+1)
+		}
+		ctts = append(ctts, u32(1, uint32(s.cts))...)
+		cttsCount++
+		negative = negative || s.cts < 0
+		hasCTS = hasCTS || s.cts != 0
+		if s.key {
+			stss = append(stss, u32(uint32(i+1))...)
+			keys++
+		}
+		sizes = append(sizes, u32(uint32(len(s.data)))...)
+	}
+	boxes := [][]byte{
+		fullBoxBytes("stsd", 0, 0, u32(1), entry),
+		fullBoxBytes("stts", 0, 0, u32(sttsCount), stts),
+	}
+	if hasCTS {
+		// version 1 的偏移是有符号的
+		version := uint8(0)
+		if negative {
+			version = 1
+		}
+		boxes = append(boxes, fullBoxBytes("ctts", version, 0, u32(cttsCount), ctts))
+	}
+	if keys < n {
+		boxes = append(boxes, fullBoxBytes("stss", 0, 0, u32(keys), stss))
+	}
+	return append(boxes,
+		fullBoxBytes("stsc", 0, 0, u32(1, 1, n, 1)),
+		fullBoxBytes("stsz", 0, 0, u32(0, n), sizes),
+		fullBoxBytes("co64", 0, 0, u32(1), binary.BigEndian.AppendUint64(nil, uint64(dataOffset))),
+	)
+}
+
+// sampleEntry stsd 里的条目，视频同时返回从 SPS 解析出的宽高（解析不了时为 0）
+func (t *muxTrack) sampleEntry() ([]byte, int, int, error) {
+	switch t.codec {
+	case stream.CodecAVC, stream.CodecHEVC:
+		if t.config == nil {
+			return nil, 0, 0, fmt.Errorf("mp4: %s 缺少解码配置", t.codec)
+		}
+		width, height := videoSize(t.codec, t.config)
+		configType := "avcC"
+		if t.codec == stream.CodecHEVC {
+			configType = "hvcC"
+		}
+		// VisualSampleEntry：reserved(6) data_reference_index pre_defined/reserved(16) width height
+		// horiz/vertresolution(72dpi) reserved frame_count compressorname(32) depth pre_defined(-1)
+		visual := [][]byte{make([]byte, 6), u16(1), make([]byte, 16), u16(uint16(width), uint16(height)),
+			u32(0x00480000, 0x00480000, 0), u16(1), make([]byte, 32), u16(0x0018, 0xFFFF), boxBytes(configType, t.config)}
+		return boxBytes(t.codec, visual...), width, height, nil
+
+	case stream.CodecAAC:
+		if t.config == nil {
+			return nil, 0, 0, errors.New("mp4: AAC 缺少 AudioSpecificConfig")
+		}
+		info, err := flvBroker.ParseAudioSpecificConfig(t.config)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("mp4: %w", err)
+		}
+		return audioSampleEntry(0x40, t.config, info.Channels, info.SampleRate), 0, 0, nil
+	}
+	// MP3 的采样率、声道以帧头为准，这里填常见值
+	return audioSampleEntry(0x6B, nil, 2, 44100), 0, 0, nil
+}
+
+// audioSampleEntry mp4a 条目：AudioSampleEntry + esds（ES_Descriptor > DecoderConfigDescriptor > DecoderSpecificInfo，SLConfigDescriptor）
+func audioSampleEntry(objectType uint8, asc []byte, channels, sampleRate int) []byte {
+	var dsi []byte
+	if asc != nil {
+		dsi = descriptorBytes(0x05, asc)
+	}
+	// objectTypeIndication streamType(音频) bufferSizeDB(3) maxBitrate avgBitrate
+	dcd := descriptorBytes(0x04, []byte{objectType, 0x15, 0, 0, 0}, u32(0, 0), dsi)
+	es := descriptorBytes(0x03, u16(0), []byte{0}, dcd, descriptorBytes(0x06, []byte{0x02}))
+	entry := [][]byte{make([]byte, 6), u16(1), make([]byte, 8), u16(uint16(channels), 16, 0, 0),
+		u32(uint32(min(sampleRate, math.MaxUint16)) << 16), fullBoxBytes("esds", 0, 0, es)}
+	return boxBytes("mp4a", entry...)
+}
+
+// videoSize 从 avcC / hvcC 里的 SPS 解析宽高
+func videoSize(codec string, config []byte) (int, int) {
+	var info *flvBroker.SPSInfo
+	if codec == stream.CodecAVC {
+		if sps, _, _, err := flvBroker.ParseAVCDecoderConfig(config); err == nil && len(sps) > 0 {
+			info, _ = flvBroker.ParseH264SPS(sps[0])
+		}
+	} else if sets, _, err := flvBroker.ParseHEVCDecoderConfig(config); err == nil {
+		for _, nalu := range sets {
+			if info, err = flvBroker.ParseH265SPS(nalu); err == nil {
+				break
+			}
+		}
+	}
+	if info == nil {
+		return 0, 0
+	}
+	return info.Width, info.Height
+}
+
+// ====================== box 编码 ======================
+
+func boxBytes(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(make([]byte, 0, size), uint32(size))
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBoxBytes(typ string, version uint8, flags uint32, payloads ...[]byte) []byte {
+	return boxBytes(typ, append([][]byte{u32(uint32(version)<<24 | flags&0xFFFFFF)}, payloads...)...)
+}
+
+// descriptorBytes MPEG-4 描述符，长度按 4 字节的可变长编码写，兼容性最好
+func descriptorBytes(tag uint8, payloads ...[]byte) []byte {
+	size := 0
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(size>>21), 0x80 | byte(size>>14), 0x80 | byte(size>>7), byte(size & 0x7F)}
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u32(vs ...uint32) []byte {
+	b := make([]byte, 0, 4*len(vs))
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func u16(vs ...uint16) []byte {
+	b := make([]byte, 0, 2*len(vs))
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
@@ -0,0 +1,112 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ====================== ISO-BMFF box ======================
+
+// box 一个 box 的位置，payload 不含 box 头
+type box struct {
+	typ    string
+	offset int64 // payload 在文件里的偏移
+	size   int64 // payload 长度
+}
+
+// errTruncated box 长度超出了父 box 或者文件
+var errTruncated = errors.New("mp4: box 长度越界")
+
+// readBoxes 列出 [start, end) 范围内的全部子 box
+func readBoxes(r io.ReaderAt, start, end int64) ([]box, error) {
+	var boxes []box
+	var hdr [16]byte
+	for pos := start; pos+8 <= end; {
+		if _, err := r.ReadAt(hdr[:8], pos); err != nil {
+			return nil, err
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[:4]))
+		typ := string(hdr[4:8])
+		headerLen := int64(8)
+		switch size {
+		case 0:
+			// 一直到文件（父 box）结尾
+			size = end - pos
+		case 1:
+			if _, err := r.ReadAt(hdr[8:16], pos+8); err != nil {
+				return nil, err
+			}
+			size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+			headerLen = 16
+		}
+		if size < headerLen || pos+size > end {
+			return nil, fmt.Errorf("%w: %s", errTruncated, typ)
+		}
+		boxes = append(boxes, box{typ: typ, offset: pos + headerLen, size: size - headerLen})
+		pos += size
+	}
+	return boxes, nil
+}
+
+// children 读取容器 box 的子 box
+func children(r io.ReaderAt, b box) ([]box, error) {
+	return readBoxes(r, b.offset, b.offset+b.size)
+}
+
+// find 按路径找到第一个子 box，比如 find(r, trak, "mdia", "minf", "stbl")
+func find(r io.ReaderAt, b box, path ...string) (box, bool, error) {
+	for _, typ := range path {
+		boxes, err := children(r, b)
+		if err != nil {
+			return box{}, false, err
+		}
+		found := false
+		for _, c := range boxes {
+			if c.typ == typ {
+				b, found = c, true
+				break
+			}
+		}
+		if !found {
+			return box{}, false, nil
+		}
+	}
+	return b, true, nil
+}
+
+// maxPayload 读进内存的单个 box 的上限，sample table 之外的 box 都很小
+const maxPayload = 256 << 20
+
+// payload 把 box 的内容读进内存
+func payload(r io.ReaderAt, b box) ([]byte, error) {
+	if b.size > maxPayload {
+		return nil, fmt.Errorf("mp4: %s 有 %d 字节，太大", b.typ, b.size)
+	}
+	data := make([]byte, b.size)
+	if _, err := r.ReadAt(data, b.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fullBox 读取 FullBox 的版本号，返回版本号之后的内容
+func fullBox(data []byte) (uint8, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errTruncated
+	}
+	return data[0], data[4:], nil
+}
+
+// table 检查 entry count 对应的表长度没有超出 box，返回表的内容
+func table(data []byte, entrySize int) (int, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errTruncated
+	}
+	count := int(binary.BigEndian.Uint32(data))
+	if count < 0 || count > (len(data)-4)/entrySize {
+		return 0, nil, errTruncated
+	}
+	return count, data[4:], nil
+}
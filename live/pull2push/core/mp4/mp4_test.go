@@ -0,0 +1,293 @@
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/stream"
+	"slices"
+	"testing"
+	"time"
+)
+
+func mkbox(typ string, payloads ...[]byte) []byte {
+	size := 8
+	for _, p := range payloads {
+		size += len(p)
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payloads {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func u32s(vs ...uint32) []byte {
+	var b []byte
+	for _, v := range vs {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+// testTrack 一个测试轨道：每帧的数据、解码时间间隔、显示时间偏移、关键帧
+type testTrack struct {
+	handler   string
+	entry     []byte // stsd 里的条目
+	timescale uint32
+	delta     uint32
+	samples   [][]byte
+	ctts      []uint32
+	keys      []uint32 // stss，从 1 开始
+	mediaTime int32    // 编辑列表的 media_time，-1 表示没有编辑列表
+}
+
+// buildMP4 ftyp + mdat + moov（moov 在文件尾），co64 为 true 时用 64 位 chunk 偏移，每个轨道一个 chunk
+func buildMP4(co64 bool, tracks ...testTrack) []byte {
+	ftyp := mkbox("ftyp", []byte("isom"), u32s(512), []byte("isomavc1"))
+	var mdat []byte
+	offsets := make([]int, len(tracks))
+	for i, tr := range tracks {
+		offsets[i] = len(ftyp) + 8 + len(mdat)
+		for _, s := range tr.samples {
+			mdat = append(mdat, s...)
+		}
+	}
+
+	moov := [][]byte{mkbox("mvhd", u32s(0, 0, 0, 1000, 0))}
+	for i, tr := range tracks {
+		n := uint32(len(tr.samples))
+		var sizes []uint32
+		for _, s := range tr.samples {
+			sizes = append(sizes, uint32(len(s)))
+		}
+		stbl := [][]byte{
+			mkbox("stsd", u32s(0, 1), tr.entry),
+			mkbox("stts", u32s(0, 1, n, tr.delta)),
+			mkbox("stsz", u32s(0, 0, n), u32s(sizes...)),
+			// 第一个 chunk 放全部的帧
+			mkbox("stsc", u32s(0, 1, 1, n, 1)),
+		}
+		if co64 {
+			stbl = append(stbl, mkbox("co64", u32s(0, 1), binary.BigEndian.AppendUint64(nil, uint64(offsets[i]))))
+		} else {
+			stbl = append(stbl, mkbox("stco", u32s(0, 1, uint32(offsets[i]))))
+		}
+		if tr.ctts != nil {
+			var entries []uint32
+			for _, c := range tr.ctts {
+				entries = append(entries, 1, c)
+			}
+			stbl = append(stbl, mkbox("ctts", u32s(0, uint32(len(tr.ctts))), u32s(entries...)))
+		}
+		if tr.keys != nil {
+			stbl = append(stbl, mkbox("stss", u32s(0, uint32(len(tr.keys))), u32s(tr.keys...)))
+		}
+		mdia := mkbox("mdia",
+			mkbox("mdhd", u32s(0, 0, 0, tr.timescale, 0, 0)),
+			mkbox("hdlr", u32s(0, 0), []byte(tr.handler), make([]byte, 13)),
+			mkbox("minf", mkbox("stbl", stbl...)),
+		)
+		trak := [][]byte{mkbox("tkhd", u32s(0, 0, 0, uint32(i+1), 0, 0))}
+		if tr.mediaTime >= 0 {
+			// 开头空编辑 0，然后从 media_time 开始播放
+			trak = append(trak, mkbox("edts", mkbox("elst", u32s(0, 1, 1000, uint32(tr.mediaTime), 1<<16))))
+		}
+		trak = append(trak, mdia)
+		moov = append(moov, mkbox("trak", trak...))
+	}
+	return append(append(ftyp, mkbox("mdat", mdat)...), mkbox("moov", moov...)...)
+}
+
+var avcC = []byte{1, 0x64, 0, 0x1F, 0xFF, 0xE1, 0, 4, 0x67, 0x64, 0, 0x1F, 1, 0, 2, 0x68, 0xEE}
+
+func videoEntry() []byte {
+	visual := make([]byte, 78)
+	binary.BigEndian.PutUint16(visual[24:], 320)
+	binary.BigEndian.PutUint16(visual[26:], 240)
+	return mkbox("avc1", visual, mkbox("avcC", avcC))
+}
+
+func audioEntry() []byte {
+	// ES_Descriptor(ES_ID, flags) > DecoderConfigDescriptor(AAC, 13 字节) > DecoderSpecificInfo(ASC)
+	dsi := []byte{0x05, 2, 0x12, 0x10}
+	dcd := append([]byte{0x04, byte(13 + len(dsi)), 0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, dsi...)
+	es := append([]byte{0x03, byte(3 + len(dcd)), 0, 1, 0}, dcd...)
+	entry := make([]byte, 28)
+	binary.BigEndian.PutUint16(entry[16:], 2)
+	return mkbox("mp4a", entry, mkbox("esds", u32s(0), es))
+}
+
+// sampleData 长度前缀的一个 NALU，最后一个字节是帧序号
+func sampleData(i byte) []byte {
+	return []byte{0, 0, 0, 2, 0x65, i}
+}
+
+func readAll(t *testing.T, d *Demuxer) []*flvBroker.FlvTag {
+	t.Helper()
+	var tags []*flvBroker.FlvTag
+	for {
+		tag, err := d.ReadTag()
+		if errors.Is(err, io.EOF) {
+			return tags
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags = append(tags, tag)
+	}
+}
+
+func TestDemuxer(t *testing.T) {
+	for _, co64 := range []bool{false, true} {
+		// 解码顺序 I P B B，B 帧延迟 2 帧，编辑列表去掉这 80ms
+		video := testTrack{
+			handler: "vide", entry: videoEntry(), timescale: 90000, delta: 3600,
+			samples: [][]byte{sampleData(0), sampleData(1), sampleData(2), sampleData(3)},
+			ctts:    []uint32{7200, 14400, 3600, 7200}, keys: []uint32{1}, mediaTime: 7200,
+		}
+		audio := testTrack{
+			handler: "soun", entry: audioEntry(), timescale: 44100, delta: 1024,
+			samples: [][]byte{{0xA0}, {0xA1}, {0xA2}}, mediaTime: -1,
+		}
+		data := buildMP4(co64, video, audio)
+		d, err := NewDemuxer(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := d.Header(); h[4] != 0x05 {
+			t.Fatalf("flv header flags = %#x", h[4])
+		}
+		tags := readAll(t, d)
+		if len(tags) != 9 {
+			t.Fatalf("co64=%v: %d tags, want 9", co64, len(tags))
+		}
+		if !tags[0].IsSequenceHeader() || !bytes.Equal(tags[0].Data[5:], avcC) {
+			t.Fatal("first tag is not the avcC sequence header")
+		}
+		if !tags[1].IsSequenceHeader() || !bytes.Equal(tags[1].Data[2:], []byte{0x12, 0x10}) {
+			t.Fatal("second tag is not the AAC sequence header")
+		}
+
+		var videoTs, audioTs []uint32
+		var cts []int32
+		var frames []byte
+		var last uint32
+		for _, tag := range tags[2:] {
+			if tag.Timestamp < last {
+				t.Fatalf("timestamp %d goes back from %d", tag.Timestamp, last)
+			}
+			last = tag.Timestamp
+			if tag.TagType == flvBroker.TagTypeVideo {
+				videoTs = append(videoTs, tag.Timestamp)
+				cts = append(cts, int32(tag.Data[2])<<16|int32(tag.Data[3])<<8|int32(tag.Data[4]))
+				frames = append(frames, tag.Data[len(tag.Data)-1])
+				if tag.IsKeyFrame() != (len(videoTs) == 1) {
+					t.Fatalf("video frame %d key = %v", len(videoTs)-1, tag.IsKeyFrame())
+				}
+			} else {
+				audioTs = append(audioTs, tag.Timestamp)
+			}
+		}
+		// 编辑列表让第一帧的显示时间为 0，解码时间 -80ms，整体后移 80ms
+		if want := []uint32{0, 40, 80, 120}; !slices.Equal(videoTs, want) {
+			t.Fatalf("video dts = %v, want %v", videoTs, want)
+		}
+		if want := []int32{80, 160, 40, 80}; !slices.Equal(cts, want) {
+			t.Fatalf("video cts = %v, want %v", cts, want)
+		}
+		if want := []uint32{80, 103, 126}; !slices.Equal(audioTs, want) {
+			t.Fatalf("audio dts = %v, want %v", audioTs, want)
+		}
+		if string(frames) != "\x00\x01\x02\x03" {
+			t.Fatalf("video frames out of order: %v", frames)
+		}
+	}
+}
+
+func TestDemuxerRejects(t *testing.T) {
+	frag := append(mkbox("ftyp", []byte("iso5")), mkbox("moof")...)
+	if _, err := NewDemuxer(bytes.NewReader(frag), int64(len(frag))); err == nil {
+		t.Fatal("fragmented mp4 accepted")
+	}
+	data := buildMP4(false, testTrack{handler: "vide", entry: videoEntry(), timescale: 1000, delta: 40, samples: [][]byte{sampleData(0)}, mediaTime: -1})
+	if _, err := NewDemuxer(bytes.NewReader(data[:len(data)-10]), int64(len(data)-10)); err == nil {
+		t.Fatal("truncated moov accepted")
+	}
+	// 只有不认识的编码
+	other := buildMP4(false, testTrack{handler: "vide", entry: mkbox("vp09", make([]byte, 78)), timescale: 1000, delta: 40, samples: [][]byte{{1}}, mediaTime: -1})
+	if _, err := NewDemuxer(bytes.NewReader(other), int64(len(other))); err == nil {
+		t.Fatal("mp4 without supported tracks accepted")
+	}
+}
+
+func TestMuxerRoundTrip(t *testing.T) {
+	ms := func(n int) time.Duration { return time.Duration(n) * time.Millisecond }
+	m := NewMuxer()
+	packets := []stream.Packet{
+		{Kind: stream.PacketMetadata, Payload: []byte{2}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, Config: true, Payload: avcC},
+		{Kind: stream.PacketAudio, Codec: stream.CodecAAC, Config: true, Payload: []byte{0x12, 0x10}},
+		// 关键帧之前的视频帧丢弃，直播里的时间戳从 1000 开始
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(960), PTS: ms(960), Payload: sampleData(9)},
+		{Kind: stream.PacketAudio, Codec: stream.CodecAAC, DTS: ms(1000), PTS: ms(1000), Payload: []byte{0xA0}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(1020), PTS: ms(1100), KeyFrame: true, Payload: sampleData(0)},
+		{Kind: stream.PacketAudio, Codec: stream.CodecAAC, DTS: ms(1023), PTS: ms(1023), Payload: []byte{0xA1}},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(1060), PTS: ms(1060), Payload: sampleData(1)},
+		{Kind: stream.PacketVideo, Codec: stream.CodecAVC, DTS: ms(1100), PTS: ms(1140), Payload: sampleData(2)},
+	}
+	for _, p := range packets {
+		if err := m.WritePacket(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	if err != nil || n != int64(buf.Len()) {
+		t.Fatalf("WriteTo = %d, %v; 实际 %d 字节", n, err, buf.Len())
+	}
+	if !bytes.Equal(buf.Bytes()[4:8], []byte("ftyp")) || bytes.Index(buf.Bytes(), []byte("moov")) > bytes.Index(buf.Bytes(), []byte("mdat")) {
+		t.Fatal("文件结构不对，应该是 ftyp + moov + mdat")
+	}
+
+	d, err := NewDemuxer(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := readAll(t, d)
+	if len(tags) != 7 || !tags[0].IsSequenceHeader() || !bytes.Equal(tags[0].Data[5:], avcC) || !tags[1].IsSequenceHeader() {
+		t.Fatalf("%d tags，前两个应该是序列头", len(tags))
+	}
+	type frame struct {
+		video bool
+		ts    uint32
+		cts   int32
+		last  byte
+	}
+	var got []frame
+	for _, tag := range tags[2:] {
+		f := frame{video: tag.TagType == flvBroker.TagTypeVideo, ts: tag.Timestamp, last: tag.Data[len(tag.Data)-1]}
+		if f.video {
+			f.cts = int32(tag.Data[2])<<16 | int32(tag.Data[3])<<8 | int32(tag.Data[4])
+			if tag.IsKeyFrame() != (f.last == 0) {
+				t.Fatalf("视频帧 %d key = %v", f.last, tag.IsKeyFrame())
+			}
+		}
+		got = append(got, f)
+	}
+	// 视频晚 20ms 开始，靠编辑列表对齐
+	want := []frame{{false, 0, 0, 0xA0}, {true, 20, 80, 0}, {false, 23, 0, 0xA1}, {true, 60, 0, 1}, {true, 100, 40, 2}}
+	if !slices.Equal(got, want) {
+		t.Fatalf("帧 %v\n期望 %v", got, want)
+	}
+
+	if err := NewMuxer().WritePacket(stream.Packet{Kind: stream.PacketVideo, Codec: stream.CodecAV1}); err == nil {
+		t.Error("不支持的编码应该返回错误")
+	}
+	if _, err := NewMuxer().WriteTo(io.Discard); err == nil {
+		t.Error("没有帧的时候应该返回错误")
+	}
+}
@@ -0,0 +1,523 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	flvBroker "pull2push/core/broker/flv"
+)
+
+// ====================== trak ======================
+
+// sample 一帧在文件里的位置和时间，时间单位是轨道的 timescale
+type sample struct {
+	offset int64
+	size   uint32
+	dts    int64
+	cts    int32 // 显示时间 - 解码时间
+	key    bool
+}
+
+// track 一个可以转成 FLV 的音视频轨道
+type track struct {
+	id        uint32
+	kind      string // "vide" / "soun"
+	timescale uint32
+	samples   []sample
+	next      int // 下一个要输出的 sample
+
+	// 编码：视频为 FLV CodecID（7 AVC / 12 HEVC），音频为 FLV SoundFormat（10 AAC / 2 MP3）
+	codec  uint8
+	config []byte // avcC / hvcC / AudioSpecificConfig，作为序列头发出
+	width  uint16
+	height uint16
+
+	shift int64 // 时间戳偏移（毫秒）：编辑列表的起始延迟减去 media_time，再加上全局的非负偏移
+}
+
+// maxSamples 单个轨道的帧数上限
+const maxSamples = 1 << 23
+
+// errUnsupported 轨道的编码没法放进 FLV，整个轨道跳过
+var errUnsupported = errors.New("mp4: 不支持的编码")
+
+// parseTrack 解析一个 trak，返回 errUnsupported 时跳过这个轨道
+func parseTrack(r io.ReaderAt, trak box, movieTimescale uint32) (*track, error) {
+	t := &track{}
+	if tkhd, ok, err := find(r, trak, "tkhd"); err != nil {
+		return nil, err
+	} else if ok {
+		data, err := payload(r, tkhd)
+		if err != nil {
+			return nil, err
+		}
+		version, body, err := fullBox(data)
+		if err != nil {
+			return nil, err
+		}
+		// version 1 的创建 / 修改时间是 64 位
+		idOffset := 8
+		if version == 1 {
+			idOffset = 16
+		}
+		if len(body) >= idOffset+4 {
+			t.id = binary.BigEndian.Uint32(body[idOffset:])
+		}
+	}
+
+	mdia, ok, err := find(r, trak, "mdia")
+	if err != nil || !ok {
+		return nil, fmt.Errorf("mp4: trak 缺少 mdia: %v", err)
+	}
+	if err := t.parseMediaHeader(r, mdia); err != nil {
+		return nil, err
+	}
+	if t.kind != "vide" && t.kind != "soun" {
+		return nil, errUnsupported
+	}
+	stbl, ok, err := find(r, mdia, "minf", "stbl")
+	if err != nil || !ok {
+		return nil, fmt.Errorf("mp4: trak %d 缺少 stbl: %v", t.id, err)
+	}
+	if err := t.parseSampleDescription(r, stbl); err != nil {
+		return nil, err
+	}
+	if err := t.parseSampleTable(r, stbl); err != nil {
+		return nil, fmt.Errorf("mp4: trak %d: %w", t.id, err)
+	}
+	if err := t.parseEditList(r, trak, movieTimescale); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseMediaHeader mdhd 里的 timescale，hdlr 里的轨道类型
+func (t *track) parseMediaHeader(r io.ReaderAt, mdia box) error {
+	mdhd, ok, err := find(r, mdia, "mdhd")
+	if err != nil || !ok {
+		return fmt.Errorf("mp4: mdia 缺少 mdhd: %v", err)
+	}
+	data, err := payload(r, mdhd)
+	if err != nil {
+		return err
+	}
+	version, body, err := fullBox(data)
+	if err != nil {
+		return err
+	}
+	tsOffset := 8
+	if version == 1 {
+		tsOffset = 16
+	}
+	if len(body) < tsOffset+4 {
+		return errTruncated
+	}
+	t.timescale = binary.BigEndian.Uint32(body[tsOffset:])
+	if t.timescale == 0 {
+		return errors.New("mp4: mdhd timescale 为 0")
+	}
+
+	hdlr, ok, err := find(r, mdia, "hdlr")
+	if err != nil || !ok {
+		return fmt.Errorf("mp4: mdia 缺少 hdlr: %v", err)
+	}
+	if data, err = payload(r, hdlr); err != nil {
+		return err
+	}
+	// version/flags(4) + pre_defined(4) + handler_type(4)
+	if len(data) < 12 {
+		return errTruncated
+	}
+	t.kind = string(data[8:12])
+	return nil
+}
+
+// parseSampleDescription stsd 的第一个条目：编码和解码配置
+func (t *track) parseSampleDescription(r io.ReaderAt, stbl box) error {
+	stsd, ok, err := find(r, stbl, "stsd")
+	if err != nil || !ok {
+		return fmt.Errorf("mp4: stbl 缺少 stsd: %v", err)
+	}
+	// version/flags(4) + entry_count(4) 之后是条目，每个条目本身是一个 box
+	entries, err := readBoxes(r, stsd.offset+8, stsd.offset+stsd.size)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return errors.New("mp4: stsd 没有条目")
+	}
+	entry := entries[0]
+	switch entry.typ {
+	case "avc1", "avc3":
+		t.codec = flvBroker.CodecH264
+		return t.parseVisualEntry(r, entry, "avcC")
+	case "hvc1", "hev1":
+		t.codec = flvBroker.CodecH265
+		return t.parseVisualEntry(r, entry, "hvcC")
+	case "mp4a":
+		return t.parseAudioEntry(r, entry)
+	}
+	return errUnsupported
+}
+
+// parseVisualEntry VisualSampleEntry 固定 78 字节，后面是 avcC / hvcC 等子 box
+func (t *track) parseVisualEntry(r io.ReaderAt, entry box, configType string) error {
+	const visualEntrySize = 78
+	if entry.size < visualEntrySize {
+		return errTruncated
+	}
+	var wh [4]byte
+	if _, err := r.ReadAt(wh[:], entry.offset+24); err != nil {
+		return err
+	}
+	t.width, t.height = binary.BigEndian.Uint16(wh[:2]), binary.BigEndian.Uint16(wh[2:])
+	boxes, err := readBoxes(r, entry.offset+visualEntrySize, entry.offset+entry.size)
+	if err != nil {
+		return err
+	}
+	for _, b := range boxes {
+		if b.typ == configType {
+			t.config, err = payload(r, b)
+			return err
+		}
+	}
+	return fmt.Errorf("mp4: %s 缺少 %s", entry.typ, configType)
+}
+
+// parseAudioEntry AudioSampleEntry 固定 28 字节，QuickTime 的 version 1 / 2 分别再多 16 / 36 字节；
+// esds 可能直接在条目下面，也可能包在 QuickTime 的 wave 里
+func (t *track) parseAudioEntry(r io.ReaderAt, entry box) error {
+	if entry.size < 28 {
+		return errTruncated
+	}
+	var ver [2]byte
+	if _, err := r.ReadAt(ver[:], entry.offset+8); err != nil {
+		return err
+	}
+	start := int64(28)
+	switch binary.BigEndian.Uint16(ver[:]) {
+	case 1:
+		start += 16
+	case 2:
+		start += 36
+	}
+	if start > entry.size {
+		return errTruncated
+	}
+	esds, err := findESDS(r, entry.offset+start, entry.offset+entry.size)
+	if err != nil {
+		return err
+	}
+	objectType, asc, err := parseESDS(esds)
+	if err != nil {
+		return err
+	}
+	switch objectType {
+	case 0x40, 0x66, 0x67, 0x68: // MPEG-4 AAC / MPEG-2 AAC
+		if len(asc) < 2 {
+			return errors.New("mp4: AAC 缺少 AudioSpecificConfig")
+		}
+		t.codec, t.config = flvBroker.FormatAAC, asc
+	case 0x69, 0x6B: // MP3，FLV 里不需要序列头
+		t.codec = flvBroker.FormatMP3
+	default:
+		return errUnsupported
+	}
+	return nil
+}
+
+func findESDS(r io.ReaderAt, start, end int64) ([]byte, error) {
+	boxes, err := readBoxes(r, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range boxes {
+		switch b.typ {
+		case "esds":
+			return payload(r, b)
+		case "wave":
+			return findESDS(r, b.offset, b.offset+b.size)
+		}
+	}
+	return nil, errors.New("mp4: mp4a 缺少 esds")
+}
+
+// parseESDS 从 ES_Descriptor 里取出 objectTypeIndication 和 DecoderSpecificInfo
+func parseESDS(data []byte) (uint8, []byte, error) {
+	_, body, err := fullBox(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	tag, desc, _, err := descriptor(body)
+	if err != nil || tag != 0x03 || len(desc) < 3 {
+		return 0, nil, errors.New("mp4: esds 缺少 ES_Descriptor")
+	}
+	flags := desc[2]
+	desc = desc[3:]
+	if flags&0x80 != 0 { // streamDependenceFlag
+		desc = desc[min(2, len(desc)):]
+	}
+	if flags&0x40 != 0 && len(desc) > 0 { // URL_Flag
+		desc = desc[min(1+int(desc[0]), len(desc)):]
+	}
+	if flags&0x20 != 0 { // OCRstreamFlag
+		desc = desc[min(2, len(desc)):]
+	}
+	tag, config, _, err := descriptor(desc)
+	if err != nil || tag != 0x04 || len(config) < 13 {
+		return 0, nil, errors.New("mp4: esds 缺少 DecoderConfigDescriptor")
+	}
+	objectType := config[0]
+	tag, info, _, err := descriptor(config[13:])
+	if err != nil || tag != 0x05 {
+		// MP3 没有 DecoderSpecificInfo
+		return objectType, nil, nil
+	}
+	return objectType, info, nil
+}
+
+// descriptor 读取一个 MPEG-4 描述符：tag + 变长长度（每字节 7 位，最高位表示后面还有）
+func descriptor(data []byte) (uint8, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, errTruncated
+	}
+	tag := data[0]
+	size, i := 0, 1
+	for ; i < len(data) && i <= 4; i++ {
+		size = size<<7 | int(data[i]&0x7F)
+		if data[i]&0x80 == 0 {
+			i++
+			break
+		}
+	}
+	if size > len(data)-i {
+		return 0, nil, nil, errTruncated
+	}
+	return tag, data[i : i+size], data[i+size:], nil
+}
+
+// parseSampleTable 由 stts / ctts / stss / stsz / stsc / stco(co64) 展开每一帧的位置和时间
+func (t *track) parseSampleTable(r io.ReaderAt, stbl box) error {
+	boxes, err := children(r, stbl)
+	if err != nil {
+		return err
+	}
+	tables := make(map[string][]byte)
+	for _, b := range boxes {
+		switch b.typ {
+		case "stts", "ctts", "stss", "stsz", "stsc", "stco", "co64":
+			data, err := payload(r, b)
+			if err != nil {
+				return err
+			}
+			_, tables[b.typ], err = fullBox(data)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, typ := range []string{"stts", "stsz", "stsc"} {
+		if tables[typ] == nil {
+			return fmt.Errorf("缺少 %s", typ)
+		}
+	}
+
+	// stsz：sample_size 不为 0 时每一帧一样大
+	stsz := tables["stsz"]
+	if len(stsz) < 8 {
+		return errTruncated
+	}
+	constSize := binary.BigEndian.Uint32(stsz)
+	count := int(binary.BigEndian.Uint32(stsz[4:]))
+	if constSize == 0 && count > (len(stsz)-8)/4 {
+		return errTruncated
+	}
+	// 损坏的文件可能写一个巨大的帧数，这里设个上限（24 小时 60fps 大约 520 万帧）
+	if count < 0 || count > maxSamples {
+		return fmt.Errorf("%d 帧，太多", count)
+	}
+	t.samples = make([]sample, count)
+	for i := range t.samples {
+		t.samples[i].size = constSize
+		if constSize == 0 {
+			t.samples[i].size = binary.BigEndian.Uint32(stsz[8+4*i:])
+		}
+	}
+
+	if err := t.fillTimes(tables["stts"], tables["ctts"]); err != nil {
+		return err
+	}
+	t.fillKeyFrames(tables["stss"])
+	return t.fillOffsets(tables["stsc"], tables["stco"], tables["co64"])
+}
+
+// fillTimes stts 展开解码时间，ctts 展开显示时间偏移（version 0 无符号，version 1 有符号，都按 int32 读）
+func (t *track) fillTimes(stts, ctts []byte) error {
+	n, entries, err := table(stts, 8)
+	if err != nil {
+		return err
+	}
+	var dts int64
+	i := 0
+	for e := 0; e < n && i < len(t.samples); e++ {
+		count := binary.BigEndian.Uint32(entries[8*e:])
+		delta := int64(binary.BigEndian.Uint32(entries[8*e+4:]))
+		for c := uint32(0); c < count && i < len(t.samples); c++ {
+			t.samples[i].dts = dts
+			dts += delta
+			i++
+		}
+	}
+	if i < len(t.samples) {
+		return errors.New("stts 的帧数少于 stsz")
+	}
+	if ctts == nil {
+		return nil
+	}
+	n, entries, err = table(ctts, 8)
+	if err != nil {
+		return err
+	}
+	i = 0
+	for e := 0; e < n && i < len(t.samples); e++ {
+		count := binary.BigEndian.Uint32(entries[8*e:])
+		offset := int32(binary.BigEndian.Uint32(entries[8*e+4:]))
+		for c := uint32(0); c < count && i < len(t.samples); c++ {
+			t.samples[i].cts = offset
+			i++
+		}
+	}
+	return nil
+}
+
+// fillKeyFrames stss 列出关键帧的序号（从 1 开始），没有 stss 时每一帧都是关键帧
+func (t *track) fillKeyFrames(stss []byte) {
+	if stss == nil {
+		for i := range t.samples {
+			t.samples[i].key = true
+		}
+		return
+	}
+	n, entries, err := table(stss, 4)
+	if err != nil {
+		return
+	}
+	for e := 0; e < n; e++ {
+		if i := int(binary.BigEndian.Uint32(entries[4*e:])) - 1; i >= 0 && i < len(t.samples) {
+			t.samples[i].key = true
+		}
+	}
+}
+
+// fillOffsets stsc 把帧分到 chunk 里，stco / co64 给出每个 chunk 的偏移，chunk 内的帧紧挨着
+func (t *track) fillOffsets(stsc, stco, co64 []byte) error {
+	var chunks []int64
+	switch {
+	case co64 != nil:
+		n, entries, err := table(co64, 8)
+		if err != nil {
+			return err
+		}
+		chunks = make([]int64, n)
+		for i := range chunks {
+			chunks[i] = int64(binary.BigEndian.Uint64(entries[8*i:]))
+		}
+	case stco != nil:
+		n, entries, err := table(stco, 4)
+		if err != nil {
+			return err
+		}
+		chunks = make([]int64, n)
+		for i := range chunks {
+			chunks[i] = int64(binary.BigEndian.Uint32(entries[4*i:]))
+		}
+	default:
+		return errors.New("缺少 stco / co64")
+	}
+
+	n, entries, err := table(stsc, 12)
+	if err != nil {
+		return err
+	}
+	i := 0
+	for e := 0; e < n && i < len(t.samples); e++ {
+		first := int(binary.BigEndian.Uint32(entries[12*e:])) - 1
+		perChunk := int(binary.BigEndian.Uint32(entries[12*e+4:]))
+		last := len(chunks)
+		if e+1 < n {
+			last = int(binary.BigEndian.Uint32(entries[12*(e+1):])) - 1
+		}
+		if first < 0 || last > len(chunks) || first > last {
+			return errors.New("stsc 的 chunk 序号越界")
+		}
+		for c := first; c < last && i < len(t.samples); c++ {
+			offset := chunks[c]
+			for s := 0; s < perChunk && i < len(t.samples); s++ {
+				t.samples[i].offset = offset
+				offset += int64(t.samples[i].size)
+				i++
+			}
+		}
+	}
+	if i < len(t.samples) {
+		return errors.New("stsc / stco 的帧数少于 stsz")
+	}
+	return nil
+}
+
+// parseEditList 只处理最常见的编辑列表：开头若干空编辑（延迟），然后一段从 media_time 开始的正常播放
+func (t *track) parseEditList(r io.ReaderAt, trak box, movieTimescale uint32) error {
+	elst, ok, err := find(r, trak, "edts", "elst")
+	if err != nil || !ok {
+		return err
+	}
+	data, err := payload(r, elst)
+	if err != nil {
+		return err
+	}
+	version, body, err := fullBox(data)
+	if err != nil {
+		return err
+	}
+	entrySize := 12
+	if version == 1 {
+		entrySize = 20
+	}
+	n, entries, err := table(body, entrySize)
+	if err != nil {
+		return err
+	}
+	var delay int64 // 电影 timescale
+	for e := 0; e < n; e++ {
+		entry := entries[entrySize*e:]
+		var duration, mediaTime int64
+		if version == 1 {
+			duration = int64(binary.BigEndian.Uint64(entry))
+			mediaTime = int64(binary.BigEndian.Uint64(entry[8:]))
+		} else {
+			duration = int64(binary.BigEndian.Uint32(entry))
+			mediaTime = int64(int32(binary.BigEndian.Uint32(entry[4:])))
+		}
+		if mediaTime == -1 {
+			delay += duration
+			continue
+		}
+		if movieTimescale > 0 {
+			t.shift = delay * 1000 / int64(movieTimescale)
+		}
+		t.shift -= mediaTime * 1000 / int64(t.timescale)
+		return nil
+	}
+	return nil
+}
+
+// millis 轨道时间换算成毫秒
+func (t *track) millis(v int64) int64 {
+	return v * 1000 / int64(t.timescale)
+}
+
+// dts 第 i 帧输出时的解码时间（毫秒）
+func (t *track) dts(i int) int64 {
+	return t.millis(t.samples[i].dts) + t.shift
+}
@@ -0,0 +1,229 @@
+package playlist
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	flvBroker "pull2push/core/broker/flv"
+	"sync"
+	"time"
+)
+
+// ====================== FileSource ======================
+
+// defaultHeader 只有定时条目、还没有打开任何文件时用的 FLV 头（音频 + 视频）
+var defaultHeader = []byte{'F', 'L', 'V', 1, 5, 0, 0, 0, 9, 0, 0, 0, 0}
+
+// spliceGap 换文件或者循环时，没有统计到视频帧间隔就按 25fps 接上
+const spliceGap = 40
+
+// fileSource 按 tag 的时间戳真实时间播放本地文件，可以作为任意 FLVStreamBroker 的上游。
+// 文件内部的时间戳原样保留（用来复现上游抓下来的问题），换文件和循环时整体平移，观众看到的时间戳一直往前走
+type fileSource struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	sched   *schedule
+	mu      sync.Mutex          // 保护 cur，Close 可能和 ReadTag 在不同的 goroutine
+	cur     flvBroker.TagSource // 正在播放的文件，播完为 nil
+	header  []byte
+	start   time.Time // 输出时间戳 0 对应的墙上时间
+	checked time.Time // 上一次检查定时插播的时间
+	empty   int       // 连续几个文件一帧都没有读出来
+
+	first     int64 // 当前文件第一个音视频 tag 的时间戳，-1 表示还没有
+	base      int64 // 当前文件在输出时间线上的起点（毫秒）
+	lastOut   int64 // 已经输出的最大时间戳
+	lastVideo int64 // 当前文件上一个视频帧的时间戳，-1 表示还没有
+	frame     int64 // 最近的视频帧间隔，接缝处按这个间隔接上
+	played    bool  // 已经输出过音视频 tag
+}
+
+// DialFile 作为 SourceDialer 使用：file:///path/to/a.flv，单个文件循环播放
+func DialFile(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	u, err := url.Parse(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Path
+	if u.Host != "" {
+		// file://data/a.flv 当作相对路径
+		path = u.Host + u.Path
+	}
+	if path == "" {
+		return nil, fmt.Errorf("%s 缺少文件路径", upstreamURL)
+	}
+	return newFileSource(ctx, []Item{{File: path}})
+}
+
+// NewDialer 按节目单播放的 SourceDialer，items 为空时按上游地址播放单个文件（见 DialFile）
+func NewDialer(items []Item) flvBroker.SourceDialer {
+	if len(items) == 0 {
+		return DialFile
+	}
+	return func(ctx context.Context, _ string) (flvBroker.TagSource, error) {
+		return newFileSource(ctx, items)
+	}
+}
+
+func newFileSource(ctx context.Context, items []Item) (*fileSource, error) {
+	for _, item := range items {
+		if _, err := os.Stat(item.File); err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	s := &fileSource{
+		sched:     newSchedule(items),
+		header:    defaultHeader,
+		start:     now,
+		checked:   now,
+		first:     -1,
+		lastVideo: -1,
+		frame:     spliceGap,
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if item, ok := s.sched.advance(); ok {
+		if err := s.open(item); err != nil {
+			return nil, err
+		}
+		s.header = s.cur.Header()
+	}
+	return s, nil
+}
+
+func (s *fileSource) Header() []byte {
+	return s.header
+}
+
+// ReadTag 下一个 tag 的时间没到时等待；文件播完换下一个，定时条目到点时打断当前文件
+func (s *fileSource) ReadTag() (*flvBroker.FlvTag, error) {
+	for {
+		now := time.Now()
+		if item, ok := s.sched.due(s.checked, now); ok {
+			log.Printf("[playlist] 定时插播 %s", item.File)
+			if err := s.open(item); err != nil {
+				return nil, err
+			}
+		}
+		s.checked = now
+
+		if s.cur == nil {
+			item, ok := s.sched.advance()
+			if !ok {
+				// 只有定时条目，等下一次插播
+				if err := s.sleepUntil(s.sched.upcoming(now)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if err := s.open(item); err != nil {
+				return nil, err
+			}
+		}
+
+		tag, err := s.cur.ReadTag()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// 录下来的文件最后一个 tag 经常不完整，丢掉换下一个
+			s.closeCurrent()
+			if s.first < 0 {
+				s.empty++
+				if s.empty > len(s.sched.rotation)+len(s.sched.scheduled) {
+					return nil, errors.New("节目单里的文件都没有可以播放的音视频数据")
+				}
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		ts := s.rewrite(tag)
+		if err := s.sleepUntil(s.start.Add(time.Duration(ts) * time.Millisecond)); err != nil {
+			return nil, err
+		}
+		return tag, nil
+	}
+}
+
+// open 开始播放一个文件，时间线接在已经输出的最后一个 tag 之后
+func (s *fileSource) open(item Item) error {
+	s.closeCurrent()
+	if err := s.ctx.Err(); err != nil {
+		// 已经被 Close，不再打开文件
+		return err
+	}
+	src, err := OpenMedia(item.File)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cur = src
+	s.mu.Unlock()
+	s.first, s.lastVideo = -1, -1
+	s.base = 0
+	if s.played {
+		s.base = s.lastOut + s.frame
+	}
+	return nil
+}
+
+func (s *fileSource) closeCurrent() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cur != nil {
+		s.cur.Close()
+		s.cur = nil
+	}
+}
+
+// rewrite 把文件里的时间戳换算到输出时间线上，返回换算后的时间戳
+func (s *fileSource) rewrite(tag *flvBroker.FlvTag) int64 {
+	ts := int64(tag.Timestamp)
+	if s.first < 0 {
+		if tag.TagType == flvBroker.TagTypeScript || tag.IsSequenceHeader() {
+			// 文件开头的元数据和序列头放在起点
+			tag.Timestamp = uint32(s.base)
+			return s.base
+		}
+		s.first = ts
+		s.empty = 0
+	}
+	if tag.TagType == flvBroker.TagTypeVideo && !tag.IsSequenceHeader() {
+		if d := ts - s.lastVideo; s.lastVideo >= 0 && d > 0 && d < 1000 {
+			s.frame = d
+		}
+		s.lastVideo = ts
+	}
+	out := max(s.base+ts-s.first, 0)
+	tag.Timestamp = uint32(out)
+	if out > s.lastOut {
+		s.lastOut = out
+	}
+	s.played = true
+	return out
+}
+
+func (s *fileSource) sleepUntil(t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return s.ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *fileSource) Close() error {
+	s.cancel()
+	s.closeCurrent()
+	return nil
+}
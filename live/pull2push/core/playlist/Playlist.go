@@ -0,0 +1,105 @@
+package playlist
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Playlist 本地文件轮播的节目单
+
+	没有 At 的条目按顺序轮播，每个条目连续播放 Loop 遍，播完最后一个回到第一个；
+	有 At 的条目每天到点插播：打断当前节目，播完之后接着轮播被打断的下一个条目。
+	只有定时条目时，两次插播之间没有数据，broker 按断流处理（配置了 fallback 时插播垫片）。
+*/
+
+// Item 节目单里的一个文件
+type Item struct {
+	File string        // 本地文件路径，.flv / .mp4
+	Loop int           // 连续播放几遍，0 和 1 都是一遍
+	At   time.Duration // 每天定时播放的时刻（距离当天 0 点），只对 Scheduled 的条目有效
+	// Scheduled 是否是定时插播的条目
+	Scheduled bool
+}
+
+// ParseAt 解析每天定时播放的时刻，格式为 HH:MM 或者 HH:MM:SS
+func ParseAt(s string) (time.Duration, error) {
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+		}
+	}
+	return 0, fmt.Errorf("定时 %q 格式不对，应为 HH:MM 或 HH:MM:SS", s)
+}
+
+// nextAt now 之后（含）最近的一次 at，按本地时间
+func nextAt(now time.Time, at time.Duration) time.Time {
+	y, m, d := now.Date()
+	t := time.Date(y, m, d, 0, 0, 0, 0, now.Location()).Add(at)
+	if t.Before(now) {
+		t = time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Add(at)
+	}
+	return t
+}
+
+// schedule 节目单的播放顺序
+type schedule struct {
+	rotation  []Item // 轮播的条目
+	scheduled []Item // 定时插播的条目
+	next      int    // 下一个轮播的条目
+	played    int    // 当前轮播条目已经播了几遍
+}
+
+func newSchedule(items []Item) *schedule {
+	s := &schedule{}
+	for _, item := range items {
+		if item.Scheduled {
+			s.scheduled = append(s.scheduled, item)
+		} else {
+			s.rotation = append(s.rotation, item)
+		}
+	}
+	return s
+}
+
+// due 在 (after, now] 之间到点的定时条目，有多个时取最晚的一个
+func (s *schedule) due(after, now time.Time) (Item, bool) {
+	var found Item
+	var foundAt time.Time
+	for _, item := range s.scheduled {
+		at := nextAt(after, item.At)
+		if at.After(now) || !at.After(after) {
+			continue
+		}
+		if foundAt.IsZero() || at.After(foundAt) {
+			found, foundAt = item, at
+		}
+	}
+	return found, !foundAt.IsZero()
+}
+
+// upcoming now 之后最近一次定时插播的时间，没有定时条目时为零值
+func (s *schedule) upcoming(now time.Time) time.Time {
+	var earliest time.Time
+	for _, item := range s.scheduled {
+		at := nextAt(now, item.At)
+		if earliest.IsZero() || at.Before(earliest) {
+			earliest = at
+		}
+	}
+	return earliest
+}
+
+// advance 当前轮播条目播完一遍，返回下一个要播的条目；没有轮播条目时返回 false
+func (s *schedule) advance() (Item, bool) {
+	if len(s.rotation) == 0 {
+		return Item{}, false
+	}
+	item := s.rotation[s.next]
+	s.played++
+	if s.played >= max(item.Loop, 1) {
+		s.played = 0
+		s.next = (s.next + 1) % len(s.rotation)
+	}
+	return item, true
+}
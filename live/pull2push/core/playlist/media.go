@@ -0,0 +1,73 @@
+package playlist
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	flvBroker "pull2push/core/broker/flv"
+	"pull2push/core/mp4"
+	"strings"
+)
+
+// flvFile 从头到尾顺序读一个本地 FLV 文件，不整个读进内存
+type flvFile struct {
+	f      *os.File
+	r      *bufio.Reader
+	header []byte
+}
+
+// OpenMedia 按扩展名打开一个本地媒体文件（FLV / MP4），读出来都是 FLV tag，读完返回 io.EOF
+func OpenMedia(path string) (flvBroker.TagSource, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".flv":
+		f, err := openFLV(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	case ".mp4", ".m4v", ".mov":
+		d, err := mp4.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("%s: 不支持的文件格式，目前只支持 .flv / .mp4", path)
+}
+
+// LoadSlate 读取断流垫片，格式同 OpenMedia
+func LoadSlate(path string) (*flvBroker.Slate, error) {
+	src, err := OpenMedia(path)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	return flvBroker.NewSlate(path, src)
+}
+
+func openFLV(path string) (*flvFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(f, 64<<10)
+	header, err := flvBroker.ReadFLVHeader(r)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &flvFile{f: f, r: r, header: header}, nil
+}
+
+func (m *flvFile) Header() []byte {
+	return m.header
+}
+
+func (m *flvFile) ReadTag() (*flvBroker.FlvTag, error) {
+	return flvBroker.ReadFlvTag(m.r)
+}
+
+func (m *flvFile) Close() error {
+	return m.f.Close()
+}
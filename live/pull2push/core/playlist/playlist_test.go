@@ -0,0 +1,122 @@
+package playlist
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	flvBroker "pull2push/core/broker/flv"
+	"testing"
+	"time"
+)
+
+func testTag(ts uint32, data ...byte) *flvBroker.FlvTag {
+	return &flvBroker.FlvTag{TagType: flvBroker.TagTypeVideo, DataSize: uint32(len(data)), Timestamp: ts, Data: data}
+}
+
+// writeFLV 写一个序列头 + 关键帧 + 两个普通帧的文件，最后一个字节区分文件
+func writeFLV(t *testing.T, name string, first uint32, mark byte) string {
+	t.Helper()
+	buf := []byte{'F', 'L', 'V', 1, 1, 0, 0, 0, 9, 0, 0, 0, 0}
+	for _, tag := range []*flvBroker.FlvTag{
+		testTag(first, 0x17, 0, 0, 0, 0, mark),
+		testTag(first, 0x17, 1, 0, 0, 0, mark),
+		testTag(first+40, 0x27, 1, 0, 0, 0, mark),
+		testTag(first+80, 0x27, 1, 0, 0, 0, mark),
+	} {
+		buf = append(buf, tag.ToBytes()...)
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParseAt(t *testing.T) {
+	if at, err := ParseAt("09:30"); err != nil || at != 9*time.Hour+30*time.Minute {
+		t.Fatalf("09:30 = %v, %v", at, err)
+	}
+	if at, err := ParseAt("23:59:59"); err != nil || at != 24*time.Hour-time.Second {
+		t.Fatalf("23:59:59 = %v, %v", at, err)
+	}
+	if _, err := ParseAt("25:00"); err == nil {
+		t.Fatal("25:00 accepted")
+	}
+}
+
+func TestScheduleOrder(t *testing.T) {
+	s := newSchedule([]Item{{File: "a", Loop: 2}, {File: "news", At: 9 * time.Hour, Scheduled: true}, {File: "b"}})
+	var got string
+	for range 5 {
+		item, _ := s.advance()
+		got += item.File
+	}
+	if got != "aabaa" {
+		t.Fatalf("rotation = %q", got)
+	}
+
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local)
+	if _, ok := s.due(day.Add(8*time.Hour), day.Add(8*time.Hour+59*time.Minute)); ok {
+		t.Fatal("due before 09:00")
+	}
+	if item, ok := s.due(day.Add(8*time.Hour+59*time.Minute), day.Add(9*time.Hour)); !ok || item.File != "news" {
+		t.Fatal("not due at 09:00")
+	}
+	if up := s.upcoming(day.Add(10 * time.Hour)); !up.Equal(day.Add(33 * time.Hour)) {
+		t.Fatalf("upcoming = %v", up)
+	}
+}
+
+func TestFileSourceLoop(t *testing.T) {
+	// 第二个文件的时间戳从 5000 开始，输出时还是要接在第一个文件之后
+	a := writeFLV(t, "a.flv", 0, 'a')
+	b := writeFLV(t, "b.flv", 5000, 'b')
+	src, err := NewDialer([]Item{{File: a}, {File: b}})(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	start := time.Now()
+	var marks []byte
+	var last uint32
+	for i := range 12 {
+		tag, err := src.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag.Timestamp < last {
+			t.Fatalf("tag %d timestamp %d goes back from %d", i, tag.Timestamp, last)
+		}
+		last = tag.Timestamp
+		marks = append(marks, tag.Data[len(tag.Data)-1])
+	}
+	if string(marks) != "aaaabbbbaaaa" {
+		t.Fatalf("play order = %q", marks)
+	}
+	// 三个文件各 80ms，接缝处各 40ms
+	if last != 320 {
+		t.Fatalf("last timestamp = %d, want 320", last)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Fatalf("played %v of media in %v, not real time", time.Duration(last)*time.Millisecond, elapsed)
+	}
+}
+
+func TestDialFile(t *testing.T) {
+	if _, err := DialFile(context.Background(), "file:///no/such/file.flv"); err == nil {
+		t.Fatal("missing file accepted")
+	}
+	path := writeFLV(t, "a.flv", 0, 'a')
+	src, err := DialFile(context.Background(), "file://"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := src.Header(); len(h) != 13 || string(h[:3]) != "FLV" {
+		t.Fatalf("header = %v", h)
+	}
+	src.Close()
+	if _, err := src.ReadTag(); err == nil {
+		t.Fatal("read after close")
+	}
+}
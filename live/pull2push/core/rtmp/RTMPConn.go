@@ -0,0 +1,529 @@
+package rtmp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+/*
+RTMP 客户端（简单握手 + AMF0 命令）
+
+	推流：Dial -> Publish -> WriteTag ...
+	拉流：Dial -> Play -> ReadTag ...
+
+只实现了简单握手（不带 digest），主流服务器（SRS/nginx-rtmp/各大 CDN）均支持。
+*/
+
+const (
+	handshakeSize  = 1536
+	defaultPort    = "1935"
+	dialTimeout    = 5 * time.Second
+	commandTimeout = 10 * time.Second
+
+	playBufferMs    = 3000             // 拉流时告诉服务器的缓冲时长
+	playReadTimeout = 10 * time.Second // 拉流超过该时间没有数据，认为上游中断
+)
+
+// RTMPConn 一个 RTMP 客户端连接
+type RTMPConn struct {
+	netConn net.Conn
+	reader  *chunkReader
+	writer  *chunkWriter
+
+	App        string // 应用名，例如 live
+	StreamName string // 流名（可带 query），例如 livestream?token=xx
+	TcURL      string // rtmp://host:port/app
+
+	streamId      uint32     // createStream 返回的消息流 id
+	transactionId float64    // 命令事务号
+	pending       []*message // 等待 onStatus 期间收到的音视频消息，拉流时由 ReadTag 先返回
+
+	// 确认窗口相关
+	counter       *countingReader
+	windowAckSize uint32
+	lastAck       uint64
+}
+
+// countingReader 统计读取的字节数，用于发送 Acknowledgement
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// ParseURL 解析 rtmp://host[:port]/app/stream 形式的地址
+// 第一段路径作为 app，剩余部分（含 query）作为流名
+func ParseURL(rawURL string) (host, app, streamName, tcURL string, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", "", err
+	}
+	if u.Scheme != "rtmp" {
+		return "", "", "", "", fmt.Errorf("rtmp: unsupported scheme %q", u.Scheme)
+	}
+	host = u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	idx := strings.Index(p, "/")
+	if idx <= 0 || idx == len(p)-1 {
+		return "", "", "", "", fmt.Errorf("rtmp: url %q must be rtmp://host/app/stream", rawURL)
+	}
+	app = p[:idx]
+	streamName = p[idx+1:]
+	if u.RawQuery != "" {
+		streamName += "?" + u.RawQuery
+	}
+	tcURL = fmt.Sprintf("rtmp://%s/%s", u.Host, app)
+	return host, app, streamName, tcURL, nil
+}
+
+// Dial 建立 TCP 连接，完成握手并发送 connect 命令
+func Dial(ctx context.Context, rawURL string) (*RTMPConn, error) {
+	host, app, streamName, tcURL, err := ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	counter := &countingReader{r: nc}
+	rc := &RTMPConn{
+		netConn:       nc,
+		reader:        newChunkReader(bufio.NewReaderSize(counter, 64*1024)),
+		writer:        &chunkWriter{w: bufio.NewWriterSize(nc, 64*1024), chunkSize: defaultChunkSize},
+		App:           app,
+		StreamName:    streamName,
+		TcURL:         tcURL,
+		counter:       counter,
+		windowAckSize: 2500000,
+	}
+
+	// ctx 取消时关闭连接，打断阻塞中的读写
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	defer stop()
+
+	nc.SetDeadline(time.Now().Add(commandTimeout))
+	if err := rc.handshake(); err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("rtmp handshake: %w", err)
+	}
+	if err := rc.connect(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return rc, nil
+}
+
+// handshake 简单握手：C0C1 -> S0S1S2 -> C2
+func (rc *RTMPConn) handshake() error {
+	c0c1 := make([]byte, 1+handshakeSize)
+	c0c1[0] = 3
+	binary.BigEndian.PutUint32(c0c1[1:5], uint32(time.Now().UnixMilli()))
+	if _, err := rand.Read(c0c1[9:]); err != nil {
+		return err
+	}
+	if _, err := rc.netConn.Write(c0c1); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*handshakeSize)
+	if _, err := io.ReadFull(rc.reader.r, s0s1s2); err != nil {
+		return err
+	}
+	if s0s1s2[0] != 3 {
+		return fmt.Errorf("unsupported rtmp version %d", s0s1s2[0])
+	}
+	// C2 原样回显 S1
+	_, err := rc.netConn.Write(s0s1s2[1 : 1+handshakeSize])
+	return err
+}
+
+// connect 设置输出 chunk 大小并发送 connect 命令
+func (rc *RTMPConn) connect() error {
+	chunkSize := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkSize, outChunkSize)
+	if err := rc.writeMessage(csidControl, &message{typeId: msgSetChunkSize, payload: chunkSize}); err != nil {
+		return err
+	}
+	rc.writer.chunkSize = outChunkSize
+
+	_, err := rc.call("connect", map[string]interface{}{
+		"app":           rc.App,
+		"type":          "nonprivate",
+		"flashVer":      "FMLE/3.0 (compatible; pull2push)",
+		"tcUrl":         rc.TcURL,
+		"fpad":          false,
+		"capabilities":  15.0,
+		"audioCodecs":   3191.0,
+		"videoCodecs":   252.0,
+		"videoFunction": 1.0,
+		// Enhanced RTMP：声明支持的 FourCC，服务器才会下发 HEVC/AV1/VP9
+		"fourCcList": []interface{}{"av01", "vp09", "hvc1"},
+	})
+	if err != nil {
+		return fmt.Errorf("rtmp connect: %w", err)
+	}
+	return nil
+}
+
+// call 发送一个命令并等待对应事务号的 _result/_error
+func (rc *RTMPConn) call(name string, args ...interface{}) ([]interface{}, error) {
+	rc.transactionId++
+	txid := rc.transactionId
+	if err := rc.sendCommand(0, name, txid, args...); err != nil {
+		return nil, err
+	}
+	for {
+		msg, err := rc.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if msg.typeId != msgCommandAMF0 {
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) < 2 {
+			continue
+		}
+		cmd, _ := values[0].(string)
+		id, _ := values[1].(float64)
+		if id != txid {
+			continue
+		}
+		switch cmd {
+		case "_result":
+			return values, nil
+		case "_error":
+			return nil, fmt.Errorf("%s rejected: %s", name, describeStatus(values))
+		}
+	}
+}
+
+// sendCommand 发送 AMF0 命令消息
+func (rc *RTMPConn) sendCommand(streamId uint32, name string, txid float64, args ...interface{}) error {
+	payload, err := amf0Encode(append([]interface{}{name, txid}, args...)...)
+	if err != nil {
+		return err
+	}
+	return rc.writeMessage(csidCommand, &message{typeId: msgCommandAMF0, streamId: streamId, payload: payload})
+}
+
+// createStream 创建消息流，返回流 id
+func (rc *RTMPConn) createStream() error {
+	values, err := rc.call("createStream", nil)
+	if err != nil {
+		return err
+	}
+	if len(values) < 4 {
+		return errors.New("createStream: missing stream id")
+	}
+	id, ok := values[3].(float64)
+	if !ok {
+		return errors.New("createStream: invalid stream id")
+	}
+	rc.streamId = uint32(id)
+	return nil
+}
+
+// waitStatus 等待 onStatus，code 命中 okCode 返回 nil，其余 error/failed 级别返回错误
+func (rc *RTMPConn) waitStatus(okCode string) error {
+	rc.netConn.SetReadDeadline(time.Now().Add(commandTimeout))
+	defer rc.netConn.SetReadDeadline(time.Time{})
+	for {
+		msg, err := rc.readMessage()
+		if err != nil {
+			return err
+		}
+		if msg.typeId != msgCommandAMF0 {
+			// Play.Start 和第一批音视频数据可能交错到达，先缓存起来
+			if isMediaMessage(msg.typeId) {
+				rc.pending = append(rc.pending, msg)
+			}
+			continue
+		}
+		values, err := amf0Decode(msg.payload)
+		if err != nil || len(values) == 0 {
+			continue
+		}
+		if cmd, _ := values[0].(string); cmd != "onStatus" {
+			if cmd == "_error" {
+				return fmt.Errorf("rtmp error: %s", describeStatus(values))
+			}
+			continue
+		}
+		code, level := statusInfo(values)
+		if code == okCode {
+			return nil
+		}
+		if level == "error" || strings.Contains(code, "Failed") || strings.Contains(code, "BadName") {
+			return fmt.Errorf("rtmp status %s: %s", code, describeStatus(values))
+		}
+	}
+}
+
+// Publish 以 live 模式推流
+func (rc *RTMPConn) Publish() error {
+	// releaseStream/FCPublish 是 FMLE 习惯的命令，部分 CDN 依赖它们，不等待结果
+	rc.transactionId++
+	rc.sendCommand(0, "releaseStream", rc.transactionId, nil, rc.StreamName)
+	rc.transactionId++
+	rc.sendCommand(0, "FCPublish", rc.transactionId, nil, rc.StreamName)
+
+	if err := rc.createStream(); err != nil {
+		return fmt.Errorf("rtmp publish: %w", err)
+	}
+	if err := rc.sendCommand(rc.streamId, "publish", 0, nil, rc.StreamName, "live"); err != nil {
+		return err
+	}
+	if err := rc.waitStatus("NetStream.Publish.Start"); err != nil {
+		return fmt.Errorf("rtmp publish: %w", err)
+	}
+	return nil
+}
+
+// Play 以 live 模式拉流，成功后用 ReadTag 读取音视频数据
+func (rc *RTMPConn) Play() error {
+	if err := rc.createStream(); err != nil {
+		return fmt.Errorf("rtmp play: %w", err)
+	}
+	// start=-2：有直播就播直播，没有就播点播
+	if err := rc.sendCommand(rc.streamId, "play", 0, nil, rc.StreamName, -2.0); err != nil {
+		return err
+	}
+	if err := rc.setBufferLength(playBufferMs); err != nil {
+		return err
+	}
+	if err := rc.waitStatus("NetStream.Play.Start"); err != nil {
+		return fmt.Errorf("rtmp play: %w", err)
+	}
+	return nil
+}
+
+// setBufferLength 用户控制消息 SetBufferLength(3)，部分服务器在收到它之前不发数据
+func (rc *RTMPConn) setBufferLength(ms uint32) error {
+	payload := make([]byte, 10)
+	binary.BigEndian.PutUint16(payload, 3)
+	binary.BigEndian.PutUint32(payload[2:], rc.streamId)
+	binary.BigEndian.PutUint32(payload[6:], ms)
+	return rc.writeMessage(csidControl, &message{typeId: msgUserControl, payload: payload})
+}
+
+// ReadTag 读取下一个音视频/元数据消息，返回 FLV tag 的类型、时间戳和数据
+// 聚合消息会被拆开逐个返回；服务器通知流结束时返回 io.EOF
+func (rc *RTMPConn) ReadTag() (tagType uint8, timestamp uint32, data []byte, err error) {
+	for {
+		var msg *message
+		if len(rc.pending) > 0 {
+			msg, rc.pending = rc.pending[0], rc.pending[1:]
+		} else {
+			rc.netConn.SetReadDeadline(time.Now().Add(playReadTimeout))
+			if msg, err = rc.readMessage(); err != nil {
+				return 0, 0, nil, err
+			}
+		}
+
+		switch msg.typeId {
+		case msgAudio, msgVideo:
+			if len(msg.payload) == 0 {
+				continue
+			}
+			return msg.typeId, msg.timestamp, msg.payload, nil
+		case msgDataAMF0:
+			if payload := metaDataPayload(msg.payload); payload != nil {
+				return msgDataAMF0, msg.timestamp, payload, nil
+			}
+		case msgAggregate:
+			rc.pending = append(splitAggregate(msg), rc.pending...)
+		case msgCommandAMF0:
+			values, derr := amf0Decode(msg.payload)
+			if derr != nil || len(values) == 0 {
+				continue
+			}
+			if cmd, _ := values[0].(string); cmd != "onStatus" {
+				continue
+			}
+			code, _ := statusInfo(values)
+			if code == "NetStream.Play.Stop" || code == "NetStream.Play.UnpublishNotify" || code == "NetStream.Play.Complete" {
+				return 0, 0, nil, io.EOF
+			}
+		}
+	}
+}
+
+// isMediaMessage 拉流时需要交给上层的消息
+func isMediaMessage(typeId uint8) bool {
+	return typeId == msgAudio || typeId == msgVideo || typeId == msgDataAMF0 || typeId == msgAggregate
+}
+
+// metaDataPayload 只保留 onMetaData，去掉可能存在的 @setDataFrame 前缀；其它数据消息（如 |RtmpSampleAccess）返回 nil
+func metaDataPayload(payload []byte) []byte {
+	values, err := amf0Decode(payload)
+	if err != nil || len(values) == 0 {
+		return nil
+	}
+	if name, _ := values[0].(string); name == "@setDataFrame" {
+		prefix, _ := amf0Encode("@setDataFrame")
+		payload = payload[len(prefix):]
+		values = values[1:]
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if name, _ := values[0].(string); name != "onMetaData" {
+		return nil
+	}
+	return payload
+}
+
+// splitAggregate 把聚合消息拆成单个消息，负载是连续的 FLV tag（11 字节头 + 数据 + 4 字节 PreviousTagSize）
+// 子消息的时间戳以第一个子消息为基准，按聚合消息自身的时间戳整体平移
+func splitAggregate(msg *message) []*message {
+	var out []*message
+	data := msg.payload
+	var base uint32
+	for first := true; len(data) >= 11; first = false {
+		size := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		ts := uint32(data[4])<<16 | uint32(data[5])<<8 | uint32(data[6]) | uint32(data[7])<<24
+		if len(data) < 11+size {
+			break
+		}
+		if first {
+			base = ts
+		}
+		if isMediaMessage(data[0]) && data[0] != msgAggregate {
+			out = append(out, &message{
+				typeId:    data[0],
+				streamId:  msg.streamId,
+				timestamp: msg.timestamp + ts - base,
+				payload:   data[11 : 11+size],
+			})
+		}
+		data = data[11+size:]
+		if len(data) >= 4 {
+			data = data[4:]
+		}
+	}
+	return out
+}
+
+// WriteTag 把一个 FLV tag 作为 RTMP 消息发送
+func (rc *RTMPConn) WriteTag(tagType uint8, timestamp uint32, data []byte) error {
+	msg := &message{typeId: tagType, streamId: rc.streamId, timestamp: timestamp, payload: data}
+	csid := uint32(csidData)
+	switch tagType {
+	case msgAudio:
+		csid = csidAudio
+	case msgVideo:
+		csid = csidVideo
+	case msgDataAMF0:
+		// 推流时元数据需要以 @setDataFrame 开头
+		prefix, _ := amf0Encode("@setDataFrame")
+		msg.payload = append(prefix, data...)
+	}
+	return rc.writeMessage(csid, msg)
+}
+
+// Close 关闭连接
+func (rc *RTMPConn) Close() error {
+	return rc.netConn.Close()
+}
+
+func (rc *RTMPConn) writeMessage(csid uint32, msg *message) error {
+	return rc.writer.writeMessage(csid, msg)
+}
+
+// readMessage 读取下一条消息，协议控制消息在这里处理掉
+func (rc *RTMPConn) readMessage() (*message, error) {
+	for {
+		msg, err := rc.reader.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if err := rc.sendAckIfNeeded(); err != nil {
+			return nil, err
+		}
+		switch msg.typeId {
+		case msgSetChunkSize:
+			if len(msg.payload) >= 4 {
+				rc.reader.chunkSize = binary.BigEndian.Uint32(msg.payload) & 0x7FFFFFFF
+			}
+		case msgWindowAckSize:
+			if len(msg.payload) >= 4 {
+				rc.windowAckSize = binary.BigEndian.Uint32(msg.payload)
+			}
+		case msgUserControl:
+			// PingRequest(6) 需要回复 PingResponse(7)
+			if len(msg.payload) >= 6 && binary.BigEndian.Uint16(msg.payload) == 6 {
+				resp := make([]byte, 6)
+				binary.BigEndian.PutUint16(resp, 7)
+				copy(resp[2:], msg.payload[2:6])
+				if err := rc.writeMessage(csidControl, &message{typeId: msgUserControl, payload: resp}); err != nil {
+					return nil, err
+				}
+			}
+		case msgAck, msgSetPeerBandwidth, msgAbort:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// sendAckIfNeeded 读取的字节数超过确认窗口时发送 Acknowledgement，否则服务器会停止发送数据
+func (rc *RTMPConn) sendAckIfNeeded() error {
+	if rc.windowAckSize == 0 || rc.counter.n-rc.lastAck < uint64(rc.windowAckSize) {
+		return nil
+	}
+	rc.lastAck = rc.counter.n
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(rc.counter.n))
+	return rc.writeMessage(csidControl, &message{typeId: msgAck, payload: payload})
+}
+
+// statusInfo 取出 onStatus 信息对象里的 code/level
+func statusInfo(values []interface{}) (code, level string) {
+	for _, v := range values {
+		if obj, ok := v.(map[string]interface{}); ok {
+			c, _ := obj["code"].(string)
+			l, _ := obj["level"].(string)
+			if c != "" {
+				return c, l
+			}
+		}
+	}
+	return "", ""
+}
+
+func describeStatus(values []interface{}) string {
+	for _, v := range values {
+		if obj, ok := v.(map[string]interface{}); ok {
+			if d, ok := obj["description"].(string); ok && d != "" {
+				return d
+			}
+			if c, ok := obj["code"].(string); ok {
+				return c
+			}
+		}
+	}
+	return fmt.Sprintf("%v", values)
+}
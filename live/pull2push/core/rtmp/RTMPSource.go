@@ -0,0 +1,47 @@
+package rtmp
+
+import (
+	"context"
+	flvBroker "pull2push/core/broker/flv"
+)
+
+// ====================== RTMP -> FLV tag ======================
+
+// rtmpSource RTMP 拉流数据源，RTMP 消息和 FLV tag 一一对应，不需要转码
+type rtmpSource struct {
+	conn   *RTMPConn
+	header []byte
+}
+
+// DialRTMP FLVStreamBroker 的 RTMP 数据源：rtmp://host[:port]/app/stream
+func DialRTMP(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	conn, err := Dial(ctx, upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	err = conn.Play()
+	stop()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// RTMP 没有 FLV 头，音视频标志位按都有处理，播放器会以实际收到的 tag 为准
+	return &rtmpSource{conn: conn, header: flvBroker.BuildFLVHeader(true, true)}, nil
+}
+
+func (s *rtmpSource) Header() []byte {
+	return s.header
+}
+
+func (s *rtmpSource) ReadTag() (*flvBroker.FlvTag, error) {
+	tagType, timestamp, data, err := s.conn.ReadTag()
+	if err != nil {
+		return nil, err
+	}
+	return flvBroker.NewFlvTag(tagType, timestamp, data), nil
+}
+
+func (s *rtmpSource) Close() error {
+	return s.conn.Close()
+}
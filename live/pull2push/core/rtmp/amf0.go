@@ -0,0 +1,223 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// AMF0 数据类型标记
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0EcmaArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0A
+	amf0Date        = 0x0B
+	amf0LongString  = 0x0C
+)
+
+// amf0Encode 把一组值按 AMF0 顺序编码
+// 支持 float64/int/uint32/bool/string/nil/map[string]interface{}/[]interface{}
+func amf0Encode(values ...interface{}) ([]byte, error) {
+	buf := make([]byte, 0, 128)
+	var err error
+	for _, v := range values {
+		buf, err = amf0AppendValue(buf, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func amf0AppendValue(buf []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(buf, amf0Null), nil
+	case float64:
+		buf = append(buf, amf0Number)
+		return binary.BigEndian.AppendUint64(buf, math.Float64bits(val)), nil
+	case int:
+		return amf0AppendValue(buf, float64(val))
+	case uint32:
+		return amf0AppendValue(buf, float64(val))
+	case bool:
+		if val {
+			return append(buf, amf0Boolean, 1), nil
+		}
+		return append(buf, amf0Boolean, 0), nil
+	case string:
+		if len(val) > math.MaxUint16 {
+			buf = append(buf, amf0LongString)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(val)))
+			return append(buf, val...), nil
+		}
+		buf = append(buf, amf0String)
+		return amf0AppendKey(buf, val), nil
+	case map[string]interface{}:
+		buf = append(buf, amf0Object)
+		// 按 key 排序，保证编码结果稳定
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var err error
+		for _, k := range keys {
+			buf = amf0AppendKey(buf, k)
+			if buf, err = amf0AppendValue(buf, val[k]); err != nil {
+				return nil, err
+			}
+		}
+		return append(buf, 0x00, 0x00, amf0ObjectEnd), nil
+	case []interface{}:
+		buf = append(buf, amf0StrictArray)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(val)))
+		var err error
+		for _, item := range val {
+			if buf, err = amf0AppendValue(buf, item); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	default:
+		return nil, fmt.Errorf("amf0: unsupported type %T", v)
+	}
+}
+
+// amf0AppendKey 写入不带类型标记的 UTF-8 字符串（对象属性名）
+func amf0AppendKey(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+// amf0Decode 解码 data 中的全部 AMF0 值
+func amf0Decode(data []byte) ([]interface{}, error) {
+	var values []interface{}
+	for len(data) > 0 {
+		v, n, err := amf0DecodeValue(data)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		data = data[n:]
+	}
+	return values, nil
+}
+
+var errAMF0Short = errors.New("amf0: data too short")
+
+// amf0MaxDepth 对象 / 数组的最大嵌套层数，防止恶意数据把栈耗尽
+const amf0MaxDepth = 32
+
+func amf0DecodeValue(data []byte) (interface{}, int, error) {
+	return amf0DecodeDepth(data, 0)
+}
+
+func amf0DecodeDepth(data []byte, depth int) (interface{}, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errAMF0Short
+	}
+	if depth > amf0MaxDepth {
+		return nil, 0, errors.New("amf0: nesting too deep")
+	}
+	switch data[0] {
+	case amf0Number:
+		if len(data) < 9 {
+			return nil, 0, errAMF0Short
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 9, nil
+	case amf0Boolean:
+		if len(data) < 2 {
+			return nil, 0, errAMF0Short
+		}
+		return data[1] != 0, 2, nil
+	case amf0String:
+		s, n, err := amf0DecodeKey(data[1:])
+		return s, n + 1, err
+	case amf0LongString:
+		if len(data) < 5 {
+			return nil, 0, errAMF0Short
+		}
+		l := int(binary.BigEndian.Uint32(data[1:5]))
+		if len(data) < 5+l {
+			return nil, 0, errAMF0Short
+		}
+		return string(data[5 : 5+l]), 5 + l, nil
+	case amf0Null, amf0Undefined:
+		return nil, 1, nil
+	case amf0Object:
+		obj, n, err := amf0DecodeProps(data[1:], depth+1)
+		return obj, n + 1, err
+	case amf0EcmaArray:
+		if len(data) < 5 {
+			return nil, 0, errAMF0Short
+		}
+		obj, n, err := amf0DecodeProps(data[5:], depth+1)
+		return obj, n + 5, err
+	case amf0StrictArray:
+		if len(data) < 5 {
+			return nil, 0, errAMF0Short
+		}
+		count := int(binary.BigEndian.Uint32(data[1:5]))
+		pos := 5
+		// count 来自对端，每个元素至少 1 字节，预分配不能超过剩余数据能放下的个数
+		arr := make([]interface{}, 0, min(count, len(data)-pos))
+		for i := 0; i < count; i++ {
+			v, n, err := amf0DecodeDepth(data[pos:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			arr = append(arr, v)
+			pos += n
+		}
+		return arr, pos, nil
+	case amf0Date:
+		if len(data) < 11 {
+			return nil, 0, errAMF0Short
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), 11, nil
+	default:
+		return nil, 0, fmt.Errorf("amf0: unsupported marker 0x%02X", data[0])
+	}
+}
+
+func amf0DecodeKey(data []byte) (string, int, error) {
+	if len(data) < 2 {
+		return "", 0, errAMF0Short
+	}
+	l := int(binary.BigEndian.Uint16(data[0:2]))
+	if len(data) < 2+l {
+		return "", 0, errAMF0Short
+	}
+	return string(data[2 : 2+l]), 2 + l, nil
+}
+
+// amf0DecodeProps 解码对象属性，直到遇到 0x00 0x00 0x09 结束标记
+func amf0DecodeProps(data []byte, depth int) (map[string]interface{}, int, error) {
+	obj := make(map[string]interface{})
+	pos := 0
+	for {
+		if len(data)-pos >= 3 && data[pos] == 0 && data[pos+1] == 0 && data[pos+2] == amf0ObjectEnd {
+			return obj, pos + 3, nil
+		}
+		key, n, err := amf0DecodeKey(data[pos:])
+		if err != nil {
+			return obj, pos, err
+		}
+		pos += n
+		v, n, err := amf0DecodeDepth(data[pos:], depth)
+		if err != nil {
+			return obj, pos, err
+		}
+		obj[key] = v
+		pos += n
+	}
+}
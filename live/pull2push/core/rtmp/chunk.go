@@ -0,0 +1,250 @@
+package rtmp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// RTMP 消息类型
+const (
+	msgSetChunkSize     = 1
+	msgAbort            = 2
+	msgAck              = 3
+	msgUserControl      = 4
+	msgWindowAckSize    = 5
+	msgSetPeerBandwidth = 6
+	msgAudio            = 8
+	msgVideo            = 9
+	msgDataAMF3         = 15
+	msgCommandAMF3      = 17
+	msgDataAMF0         = 18
+	msgCommandAMF0      = 20
+	msgAggregate        = 22
+)
+
+// 常用的 chunk stream id
+const (
+	csidControl = 2
+	csidCommand = 3
+	csidAudio   = 4
+	csidData    = 5
+	csidVideo   = 6
+)
+
+const (
+	defaultChunkSize = 128
+	outChunkSize     = 4096
+	maxMessageSize   = 16 << 20 // 单个消息的上限，防止异常数据撑爆内存
+)
+
+// message 一个完整的 RTMP 消息（由一个或多个 chunk 组成）
+type message struct {
+	typeId    uint8
+	streamId  uint32
+	timestamp uint32
+	payload   []byte
+}
+
+// chunkStreamState 每个 chunk stream 的解析状态，fmt1~3 的头部需要引用上一个 chunk 的值
+type chunkStreamState struct {
+	timestamp  uint32
+	delta      uint32
+	length     uint32
+	typeId     uint8
+	streamId   uint32
+	extendedTs bool
+	buf        []byte
+}
+
+// chunkReader 负责把 chunk 重新组装成消息
+type chunkReader struct {
+	r         *bufio.Reader
+	chunkSize uint32
+	streams   map[uint32]*chunkStreamState
+}
+
+func newChunkReader(r *bufio.Reader) *chunkReader {
+	return &chunkReader{
+		r:         r,
+		chunkSize: defaultChunkSize,
+		streams:   make(map[uint32]*chunkStreamState),
+	}
+}
+
+// readMessage 读取 chunk 直到组装出一个完整的消息
+func (cr *chunkReader) readMessage() (*message, error) {
+	for {
+		b0, err := cr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		format := b0 >> 6
+		csid := uint32(b0 & 0x3F)
+		switch csid {
+		case 0:
+			b, err := cr.r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b)
+		case 1:
+			var b [2]byte
+			if _, err := io.ReadFull(cr.r, b[:]); err != nil {
+				return nil, err
+			}
+			csid = 64 + uint32(b[0]) + uint32(b[1])*256
+		}
+
+		st := cr.streams[csid]
+		if st == nil {
+			if format != 0 {
+				return nil, fmt.Errorf("rtmp: chunk stream %d starts with fmt %d", csid, format)
+			}
+			st = &chunkStreamState{}
+			cr.streams[csid] = st
+		}
+
+		var hdr [11]byte
+		var tsField uint32
+		switch format {
+		case 0:
+			if _, err := io.ReadFull(cr.r, hdr[:11]); err != nil {
+				return nil, err
+			}
+			tsField = uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+			st.length = uint32(hdr[3])<<16 | uint32(hdr[4])<<8 | uint32(hdr[5])
+			st.typeId = hdr[6]
+			st.streamId = binary.LittleEndian.Uint32(hdr[7:11])
+		case 1:
+			if _, err := io.ReadFull(cr.r, hdr[:7]); err != nil {
+				return nil, err
+			}
+			tsField = uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+			st.length = uint32(hdr[3])<<16 | uint32(hdr[4])<<8 | uint32(hdr[5])
+			st.typeId = hdr[6]
+		case 2:
+			if _, err := io.ReadFull(cr.r, hdr[:3]); err != nil {
+				return nil, err
+			}
+			tsField = uint32(hdr[0])<<16 | uint32(hdr[1])<<8 | uint32(hdr[2])
+		}
+
+		if format != 3 {
+			st.extendedTs = tsField == 0xFFFFFF
+		}
+		if st.extendedTs {
+			var ext [4]byte
+			if _, err := io.ReadFull(cr.r, ext[:]); err != nil {
+				return nil, err
+			}
+			if format != 3 {
+				tsField = binary.BigEndian.Uint32(ext[:])
+			}
+		}
+
+		// 只有在新消息的第一个 chunk 上才更新时间戳
+		if len(st.buf) == 0 {
+			switch format {
+			case 0:
+				st.timestamp = tsField
+				st.delta = 0
+			case 1, 2:
+				st.delta = tsField
+				st.timestamp += tsField
+			case 3:
+				st.timestamp += st.delta
+			}
+		}
+
+		if st.length > maxMessageSize {
+			return nil, fmt.Errorf("rtmp: message too large (%d bytes)", st.length)
+		}
+		if len(st.buf) > 0 && uint32(len(st.buf)) >= st.length {
+			// 消息中途的 fmt0 / fmt1 把长度改得比已经收到的还短
+			return nil, fmt.Errorf("rtmp: chunk stream %d length changed to %d mid-message (%d bytes received)", csid, st.length, len(st.buf))
+		}
+		remain := st.length - uint32(len(st.buf))
+		n := remain
+		if n > cr.chunkSize {
+			n = cr.chunkSize
+		}
+		start := len(st.buf)
+		st.buf = append(st.buf, make([]byte, n)...)
+		if _, err := io.ReadFull(cr.r, st.buf[start:]); err != nil {
+			return nil, err
+		}
+		if uint32(len(st.buf)) == st.length {
+			msg := &message{
+				typeId:    st.typeId,
+				streamId:  st.streamId,
+				timestamp: st.timestamp,
+				payload:   st.buf,
+			}
+			st.buf = nil
+			return msg, nil
+		}
+	}
+}
+
+// chunkWriter 负责把消息拆分成 chunk 写出
+type chunkWriter struct {
+	w         *bufio.Writer
+	chunkSize uint32
+}
+
+// writeMessage 第一个 chunk 使用 fmt0 完整头，后续 chunk 使用 fmt3
+func (cw *chunkWriter) writeMessage(csid uint32, msg *message) error {
+	extended := msg.timestamp >= 0xFFFFFF
+	tsField := msg.timestamp
+	if extended {
+		tsField = 0xFFFFFF
+	}
+
+	payload := msg.payload
+	first := true
+	for first || len(payload) > 0 {
+		if first {
+			cw.writeBasicHeader(0, csid)
+			var hdr [11]byte
+			hdr[0], hdr[1], hdr[2] = byte(tsField>>16), byte(tsField>>8), byte(tsField)
+			l := uint32(len(msg.payload))
+			hdr[3], hdr[4], hdr[5] = byte(l>>16), byte(l>>8), byte(l)
+			hdr[6] = msg.typeId
+			binary.LittleEndian.PutUint32(hdr[7:], msg.streamId)
+			cw.w.Write(hdr[:])
+		} else {
+			cw.writeBasicHeader(3, csid)
+		}
+		if extended {
+			var ext [4]byte
+			binary.BigEndian.PutUint32(ext[:], msg.timestamp)
+			cw.w.Write(ext[:])
+		}
+		n := uint32(len(payload))
+		if n > cw.chunkSize {
+			n = cw.chunkSize
+		}
+		if _, err := cw.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		first = false
+	}
+	return cw.w.Flush()
+}
+
+func (cw *chunkWriter) writeBasicHeader(format uint8, csid uint32) {
+	switch {
+	case csid < 64:
+		cw.w.WriteByte(format<<6 | byte(csid))
+	case csid < 320:
+		cw.w.WriteByte(format << 6)
+		cw.w.WriteByte(byte(csid - 64))
+	default:
+		cw.w.WriteByte(format<<6 | 1)
+		cw.w.WriteByte(byte((csid - 64) & 0xFF))
+		cw.w.WriteByte(byte((csid - 64) >> 8))
+	}
+}
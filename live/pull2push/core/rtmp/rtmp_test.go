@@ -0,0 +1,509 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	flvBroker "pull2push/core/broker/flv"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ====================== AMF0 ======================
+
+func TestAMF0RoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   interface{}
+		want interface{} // 解码后的值，int / uint32 都会变成 float64
+	}{
+		{"number", 1.5, 1.5},
+		{"int", 3, 3.0},
+		{"uint32", uint32(7), 7.0},
+		{"bool", true, true},
+		{"string", "live", "live"},
+		{"long string", strings.Repeat("x", 70000), strings.Repeat("x", 70000)},
+		{"null", nil, nil},
+		{"object", map[string]interface{}{"app": "live", "tcUrl": "rtmp://h/live", "fpad": false},
+			map[string]interface{}{"app": "live", "tcUrl": "rtmp://h/live", "fpad": false}},
+		{"nested", map[string]interface{}{"a": map[string]interface{}{"b": 1}}, map[string]interface{}{"a": map[string]interface{}{"b": 1.0}}},
+		{"strict array", []interface{}{1, "a", nil}, []interface{}{1.0, "a", nil}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := amf0Encode("cmd", tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values, err := amf0Decode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(values) != 2 || values[0] != "cmd" || !reflect.DeepEqual(values[1], tt.want) {
+				t.Fatalf("解码得到 %#v", values)
+			}
+		})
+	}
+	if _, err := amf0Encode(struct{}{}); err == nil {
+		t.Error("不支持的类型应该返回错误")
+	}
+}
+
+func TestAMF0DecodeEcmaArrayAndDate(t *testing.T) {
+	// onMetaData 常用的 ECMA array：count + 属性 + 结束标记；Date：8 字节毫秒 + 2 字节时区
+	data := []byte{amf0EcmaArray, 0, 0, 0, 1, 0, 1, 'w', amf0Number, 0x40, 0x94, 0, 0, 0, 0, 0, 0, 0, 0, amf0ObjectEnd}
+	data = append(data, amf0Date, 0x42, 0x77, 0, 0, 0, 0, 0, 0, 0, 0)
+	values, err := amf0Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || !reflect.DeepEqual(values[0], map[string]interface{}{"w": 1280.0}) {
+		t.Fatalf("解码得到 %#v", values)
+	}
+}
+
+func TestAMF0DecodeMalformed(t *testing.T) {
+	deep := bytes.Repeat([]byte{amf0StrictArray, 0, 0, 0, 1}, amf0MaxDepth+2)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"number 太短", []byte{amf0Number, 0, 0}},
+		{"bool 没有值", []byte{amf0Boolean}},
+		{"string 长度越界", []byte{amf0String, 0, 10, 'a'}},
+		{"long string 长度越界", []byte{amf0LongString, 0xFF, 0xFF, 0xFF, 0xFF, 'a'}},
+		{"对象没有结束标记", []byte{amf0Object, 0, 1, 'a', amf0Null}},
+		{"ecma array 太短", []byte{amf0EcmaArray, 0, 0}},
+		// 对端声明 2^31 个元素，不能按这个数预分配
+		{"strict array 数量巨大", []byte{amf0StrictArray, 0x7F, 0xFF, 0xFF, 0xFF}},
+		{"strict array 元素不够", []byte{amf0StrictArray, 0, 0, 0, 3, amf0Null}},
+		{"date 太短", []byte{amf0Date, 0}},
+		{"嵌套太深", deep},
+		{"不认识的标记", []byte{0x11}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := amf0Decode(tt.data); err == nil {
+				t.Fatal("应该返回错误")
+			}
+		})
+	}
+}
+
+// ====================== chunk ======================
+
+// chunkBytes 用 chunkWriter 把消息拆成 chunk
+func chunkBytes(t *testing.T, chunkSize uint32, csid uint32, msgs ...*message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw := &chunkWriter{w: bufio.NewWriter(&buf), chunkSize: chunkSize}
+	for _, m := range msgs {
+		if err := cw.writeMessage(csid, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readAllMessages(data []byte, chunkSize uint32) ([]*message, error) {
+	cr := newChunkReader(bufio.NewReader(bytes.NewReader(data)))
+	cr.chunkSize = chunkSize
+	var msgs []*message
+	for {
+		m, err := cr.readMessage()
+		if err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+}
+
+func TestChunkReassembly(t *testing.T) {
+	big := bytes.Repeat([]byte{0xAB}, 1000)
+	tests := []struct {
+		name      string
+		chunkSize uint32
+		csid      uint32
+		msgs      []*message
+	}{
+		{"单个 chunk", 128, csidVideo, []*message{{typeId: msgVideo, streamId: 1, timestamp: 40, payload: []byte{1, 2, 3}}}},
+		{"拆成多个 chunk", 128, csidVideo, []*message{{typeId: msgVideo, streamId: 1, timestamp: 40, payload: big}}},
+		{"扩展时间戳", 100, csidAudio, []*message{{typeId: msgAudio, streamId: 1, timestamp: 0x1234567, payload: big}}},
+		{"两字节 csid", 128, 200, []*message{{typeId: msgDataAMF0, timestamp: 1, payload: []byte{5}}}},
+		{"三字节 csid", 128, 1000, []*message{{typeId: msgDataAMF0, timestamp: 2, payload: big}}},
+		{"连续多个消息", 4096, csidVideo, []*message{
+			{typeId: msgVideo, streamId: 1, timestamp: 0, payload: big},
+			{typeId: msgVideo, streamId: 1, timestamp: 40, payload: []byte{9}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := readAllMessages(chunkBytes(t, tt.chunkSize, tt.csid, tt.msgs...), tt.chunkSize)
+			if len(got) != len(tt.msgs) {
+				t.Fatalf("组装出 %d 个消息，期望 %d", len(got), len(tt.msgs))
+			}
+			for i, want := range tt.msgs {
+				if !reflect.DeepEqual(got[i], want) {
+					t.Errorf("第 %d 个消息 %+v", i, got[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChunkDeltaHeaders(t *testing.T) {
+	// fmt0 开始，后面的消息用 fmt1（改长度）、fmt2（只有时间增量）、fmt3（沿用增量）
+	data := []byte{
+		0x06, 0, 0, 10, 0, 0, 1, msgVideo, 1, 0, 0, 0, 0xA0,
+		0x46, 0, 0, 40, 0, 0, 2, msgVideo, 0xA1, 0xA2,
+		0x86, 0, 0, 20, 0xA3, 0xA4,
+		0xC6, 0xA5, 0xA6,
+	}
+	msgs, _ := readAllMessages(data, defaultChunkSize)
+	if len(msgs) != 4 {
+		t.Fatalf("组装出 %d 个消息", len(msgs))
+	}
+	for i, ts := range []uint32{10, 50, 70, 90} {
+		if msgs[i].timestamp != ts || msgs[i].streamId != 1 {
+			t.Errorf("第 %d 个消息 ts=%d stream=%d，期望 ts=%d", i, msgs[i].timestamp, msgs[i].streamId, ts)
+		}
+	}
+}
+
+func TestChunkMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"新的 chunk stream 不是 fmt0", []byte{0x46, 0, 0, 0, 0, 0, 1, msgVideo, 0}},
+		// 声明 200 字节，收到 128 字节后 fmt1 把长度改成 10，不能回绕成 40 亿字节继续收
+		{"消息中途缩短长度", append(append([]byte{0x06, 0, 0, 0, 0, 0, 200, msgVideo, 1, 0, 0, 0}, make([]byte, 128)...),
+			0x46, 0, 0, 0, 0, 0, 10, msgVideo)},
+		{"chunk 数据不完整", []byte{0x06, 0, 0, 0, 0, 0, 5, msgVideo, 1, 0, 0, 0, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 读到结尾的 io.EOF 不算，必须是解析出错
+			msgs, err := readAllMessages(tt.data, defaultChunkSize)
+			if len(msgs) != 0 || err == nil || err == io.EOF {
+				t.Fatalf("应该返回错误，得到 %d 个消息 %v", len(msgs), err)
+			}
+		})
+	}
+}
+
+// ====================== 进程内 RTMP 服务器 ======================
+
+// testServer 最小化的 RTMP 服务器：简单握手、connect / createStream / play，play 之后按固定脚本下发消息
+type testServer struct {
+	t          *testing.T
+	ln         net.Listener
+	playStatus string // play 之后回复的 onStatus code
+
+	mu         sync.Mutex
+	c2Echoed   bool   // C2 原样回显了 S1
+	app        string // connect 里的 app
+	tcURL      string // connect 里的 tcUrl
+	streamName string // play 的流名
+	bufferMs   uint32 // 客户端 SetBufferLength 的值
+	pong       chan uint32
+}
+
+func newTestServer(t *testing.T, playStatus string) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, ln: ln, playStatus: playStatus, pong: make(chan uint32, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) url(path string) string {
+	return "rtmp://" + s.ln.Addr().String() + path
+}
+
+var (
+	testVideoSeq = []byte{0x17, 0, 0, 0, 0, 1, 0x42, 0xC0, 0x1E, 0xFF}
+	testAudio    = []byte{0xAF, 1, 0x21, 0x10}
+	testBigVideo = bytes.Repeat([]byte{0x27, 1, 0, 0, 0, 0xDD}, 50) // 300 字节，按服务器的 chunk 大小 100 拆成 3 个 chunk
+	testMetaData = map[string]interface{}{"width": 320.0, "height": 240.0}
+)
+
+func (s *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+
+	// 简单握手：C0C1 -> S0S1S2（S2 回显 C1）-> C2
+	c0c1 := make([]byte, 1+handshakeSize)
+	if _, err := io.ReadFull(br, c0c1); err != nil || c0c1[0] != 3 {
+		return
+	}
+	s1 := make([]byte, handshakeSize)
+	for i := range s1 {
+		s1[i] = byte(i * 7)
+	}
+	s0s1s2 := append(append([]byte{3}, s1...), c0c1[1:]...)
+	if _, err := conn.Write(s0s1s2); err != nil {
+		return
+	}
+	c2 := make([]byte, handshakeSize)
+	if _, err := io.ReadFull(br, c2); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.c2Echoed = bytes.Equal(c2, s1)
+	s.mu.Unlock()
+
+	cr := newChunkReader(br)
+	cw := &chunkWriter{w: bufio.NewWriter(conn), chunkSize: defaultChunkSize}
+	send := func(csid uint32, typeId uint8, ts uint32, payload []byte) {
+		if err := cw.writeMessage(csid, &message{typeId: typeId, streamId: 1, timestamp: ts, payload: payload}); err != nil {
+			s.t.Error(err)
+		}
+	}
+	command := func(values ...interface{}) {
+		payload, err := amf0Encode(values...)
+		if err != nil {
+			s.t.Error(err)
+		}
+		send(csidCommand, msgCommandAMF0, 0, payload)
+	}
+	status := func(code, level string) {
+		command("onStatus", 0.0, nil, map[string]interface{}{"level": level, "code": code, "description": code})
+	}
+	u32 := func(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+	for {
+		msg, err := cr.readMessage()
+		if err != nil {
+			return
+		}
+		switch msg.typeId {
+		case msgSetChunkSize:
+			cr.chunkSize = binary.BigEndian.Uint32(msg.payload)
+		case msgUserControl:
+			switch binary.BigEndian.Uint16(msg.payload) {
+			case 3: // SetBufferLength
+				s.mu.Lock()
+				s.bufferMs = binary.BigEndian.Uint32(msg.payload[6:])
+				s.mu.Unlock()
+			case 7: // PingResponse
+				s.pong <- binary.BigEndian.Uint32(msg.payload[2:])
+			}
+		case msgCommandAMF0:
+			values, err := amf0Decode(msg.payload)
+			if err != nil || len(values) < 2 {
+				s.t.Errorf("命令解析失败: %v", err)
+				return
+			}
+			txid, _ := values[1].(float64)
+			switch values[0] {
+			case "connect":
+				obj, _ := values[2].(map[string]interface{})
+				s.mu.Lock()
+				s.app, _ = obj["app"].(string)
+				s.tcURL, _ = obj["tcUrl"].(string)
+				s.mu.Unlock()
+				send(csidControl, msgWindowAckSize, 0, u32(5000000))
+				send(csidControl, msgSetChunkSize, 0, u32(100))
+				cw.chunkSize = 100
+				command("_result", txid, map[string]interface{}{"fmsVer": "FMS/3,0,1,123"},
+					map[string]interface{}{"level": "status", "code": "NetConnection.Connect.Success"})
+			case "createStream":
+				command("_result", txid, nil, 1.0)
+			case "play":
+				s.mu.Lock()
+				s.streamName, _ = values[3].(string)
+				s.mu.Unlock()
+				// 第一批数据比 Play.Start 先到
+				send(csidVideo, msgVideo, 0, testVideoSeq)
+				status("NetStream.Play.Reset", "status")
+				if s.playStatus != "NetStream.Play.Start" {
+					status(s.playStatus, "error")
+					continue
+				}
+				status("NetStream.Play.Start", "status")
+				s.play(send)
+				status("NetStream.Play.Stop", "status")
+			}
+		}
+	}
+}
+
+// play 下发元数据、音视频、聚合消息、扩展时间戳和 Ping
+func (s *testServer) play(send func(csid uint32, typeId uint8, ts uint32, payload []byte)) {
+	meta, _ := amf0Encode("@setDataFrame", "onMetaData", testMetaData)
+	send(csidData, msgDataAMF0, 0, meta)
+	access, _ := amf0Encode("|RtmpSampleAccess", false, false)
+	send(csidData, msgDataAMF0, 0, access)
+	send(csidAudio, msgAudio, 10, testAudio)
+	send(csidControl, msgUserControl, 0, []byte{0, 6, 0, 0, 0, 42}) // PingRequest
+
+	// 聚合消息：子消息时间戳 500 / 520，以第一个为基准平移到聚合消息自身的 1000
+	aggregate := append(flvBroker.NewFlvTag(msgVideo, 500, []byte{0x27, 1, 0, 0, 0, 0xBB}).ToBytes(),
+		flvBroker.NewFlvTag(msgAudio, 520, []byte{0xAF, 1, 0xCC}).ToBytes()...)
+	send(csidVideo, msgAggregate, 1000, aggregate)
+
+	send(csidVideo, msgVideo, 0x1234567, testBigVideo) // 扩展时间戳，后续 fmt3 chunk 也带 4 字节扩展时间戳
+	send(csidVideo, msgVideo, 0x1234568, nil)          // 空消息跳过
+}
+
+type readTagResult struct {
+	tagType   uint8
+	timestamp uint32
+	data      []byte
+}
+
+func TestRTMPPlay(t *testing.T) {
+	s := newTestServer(t, "NetStream.Play.Start")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rc, err := Dial(ctx, s.url("/live/stream1?token=abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := rc.Play(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []readTagResult
+	for {
+		tagType, ts, data, err := rc.ReadTag()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, readTagResult{tagType, ts, data})
+	}
+
+	meta, _ := amf0Encode("onMetaData", testMetaData)
+	want := []readTagResult{
+		{msgVideo, 0, testVideoSeq},
+		{msgDataAMF0, 0, meta}, // 去掉 @setDataFrame 前缀，|RtmpSampleAccess 被跳过
+		{msgAudio, 10, testAudio},
+		{msgVideo, 1000, []byte{0x27, 1, 0, 0, 0, 0xBB}},
+		{msgAudio, 1020, []byte{0xAF, 1, 0xCC}},
+		{msgVideo, 0x1234567, testBigVideo},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("读到 %+v", got)
+	}
+
+	select {
+	case id := <-s.pong:
+		if id != 42 {
+			t.Errorf("PingResponse 时间戳 %d", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("没有回复 PingResponse")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.c2Echoed {
+		t.Error("C2 没有回显 S1")
+	}
+	if s.app != "live" || s.tcURL != "rtmp://"+s.ln.Addr().String()+"/live" || s.streamName != "stream1?token=abc" {
+		t.Errorf("app=%q tcUrl=%q stream=%q", s.app, s.tcURL, s.streamName)
+	}
+	if s.bufferMs != playBufferMs {
+		t.Errorf("SetBufferLength %d", s.bufferMs)
+	}
+}
+
+func TestDialRTMPSource(t *testing.T) {
+	s := newTestServer(t, "NetStream.Play.Start")
+	src, err := DialRTMP(context.Background(), s.url("/live/stream1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	if !bytes.Equal(src.Header(), flvBroker.BuildFLVHeader(true, true)) {
+		t.Errorf("FLV 头 % x", src.Header())
+	}
+	tag, err := src.ReadTag()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.TagType != flvBroker.TagTypeVideo || !tag.IsSequenceHeader() {
+		t.Errorf("第一个 tag 应该是视频序列头: %+v", tag)
+	}
+}
+
+func TestRTMPPlayRejected(t *testing.T) {
+	s := newTestServer(t, "NetStream.Play.StreamNotFound")
+	_, err := DialRTMP(context.Background(), s.url("/live/missing"))
+	if err == nil || !strings.Contains(err.Error(), "StreamNotFound") {
+		t.Fatalf("应该返回 StreamNotFound，得到 %v", err)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url                          string
+		host, app, streamName, tcURL string
+		ok                           bool
+	}{
+		{"rtmp://h/live/s", "h:1935", "live", "s", "rtmp://h/live", true},
+		{"rtmp://h:1936/live/a/b?token=1", "h:1936", "live", "a/b?token=1", "rtmp://h:1936/live", true},
+		{"rtmp://h/live", "", "", "", "", false},
+		{"rtmp://h/live/", "", "", "", "", false},
+		{"http://h/live/s", "", "", "", "", false},
+	}
+	for _, tt := range tests {
+		host, app, streamName, tcURL, err := ParseURL(tt.url)
+		if (err == nil) != tt.ok || host != tt.host || app != tt.app || streamName != tt.streamName || tcURL != tt.tcURL {
+			t.Errorf("ParseURL(%q) = %q %q %q %q %v", tt.url, host, app, streamName, tcURL, err)
+		}
+	}
+}
+
+func TestSplitAggregate(t *testing.T) {
+	video := flvBroker.NewFlvTag(msgVideo, 100, []byte{1, 2}).ToBytes()
+	audio := flvBroker.NewFlvTag(msgAudio, 140, []byte{3}).ToBytes()
+	script := flvBroker.NewFlvTag(msgCommandAMF0, 120, []byte{4}).ToBytes()
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []uint32 // 拆出来的子消息时间戳
+	}{
+		{"两个子消息", append(append([]byte{}, video...), audio...), []uint32{5000, 5040}},
+		{"跳过不是音视频的子消息", append(append(append([]byte{}, video...), script...), audio...), []uint32{5000, 5040}},
+		{"最后一个子消息不完整", append(append([]byte{}, video...), audio[:11]...), []uint32{5000}},
+		{"没有 PreviousTagSize", append(append([]byte{}, video...), audio[:len(audio)-4]...), []uint32{5000, 5040}},
+		{"太短", []byte{9, 0, 0}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []uint32
+			for _, m := range splitAggregate(&message{typeId: msgAggregate, streamId: 1, timestamp: 5000, payload: tt.payload}) {
+				if m.streamId != 1 {
+					t.Errorf("streamId %d", m.streamId)
+				}
+				got = append(got, m.timestamp)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("时间戳 %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package rtsp
+
+import (
+	"encoding/binary"
+	"errors"
+	flvBroker "pull2push/core/broker/flv"
+)
+
+/*
+RTP 解包
+
+	H.264：RFC 6184，单 NALU / STAP-A(24) / FU-A(28)
+	H.265：RFC 7798，单 NALU / AP(48) / FU(49)
+	AAC：  RFC 3640 mpeg4-generic，AU-headers（AAC-hbr / AAC-lbr）
+
+视频按 RTP 时间戳组装访问单元，marker 位或时间戳变化时输出；丢包时丢弃正在组装的分片。
+*/
+
+var errShortPacket = errors.New("RTP 包长度不足")
+
+// rtpPacket 一个 RTP 包
+type rtpPacket struct {
+	PayloadType    uint8
+	Marker         bool
+	SequenceNumber uint16
+	Timestamp      uint32
+	SSRC           uint32
+	Payload        []byte
+}
+
+// parseRTP 解析 RTP 头，跳过 CSRC、扩展头和填充
+func parseRTP(b []byte) (*rtpPacket, error) {
+	if len(b) < 12 {
+		return nil, errShortPacket
+	}
+	if b[0]>>6 != 2 {
+		return nil, errors.New("RTP 版本错误")
+	}
+	p := &rtpPacket{
+		Marker:         b[1]&0x80 != 0,
+		PayloadType:    b[1] & 0x7F,
+		SequenceNumber: binary.BigEndian.Uint16(b[2:4]),
+		Timestamp:      binary.BigEndian.Uint32(b[4:8]),
+		SSRC:           binary.BigEndian.Uint32(b[8:12]),
+	}
+	pos := 12 + 4*int(b[0]&0x0F)
+	if b[0]&0x10 != 0 {
+		if len(b) < pos+4 {
+			return nil, errShortPacket
+		}
+		pos += 4 + 4*int(binary.BigEndian.Uint16(b[pos+2:pos+4]))
+	}
+	end := len(b)
+	if b[0]&0x20 != 0 && end > 0 {
+		end -= int(b[end-1])
+	}
+	if pos > end {
+		return nil, errShortPacket
+	}
+	p.Payload = b[pos:end]
+	return p, nil
+}
+
+// accessUnit 一个视频访问单元
+type accessUnit struct {
+	Timestamp uint32
+	NALUs     [][]byte
+}
+
+// videoDepacketizer H.264 / H.265 解包器
+type videoDepacketizer struct {
+	codecID uint8 // CodecH264 / CodecH265
+
+	lastSeq uint16
+	seqInit bool
+
+	fu       []byte // 正在组装的分片 NALU
+	fuActive bool
+
+	au       [][]byte
+	auTs     uint32
+	auActive bool
+}
+
+func newVideoDepacketizer(codecID uint8) *videoDepacketizer {
+	return &videoDepacketizer{codecID: codecID}
+}
+
+// Push 输入一个 RTP 包，返回组装完成的访问单元
+func (d *videoDepacketizer) Push(p *rtpPacket) []accessUnit {
+	var out []accessUnit
+	if d.seqInit && p.SequenceNumber != d.lastSeq+1 {
+		// 丢包，正在组装的分片已经不完整
+		d.fu, d.fuActive = nil, false
+	}
+	d.lastSeq, d.seqInit = p.SequenceNumber, true
+
+	if d.auActive && p.Timestamp != d.auTs {
+		out = d.flush(out)
+	}
+	d.auTs, d.auActive = p.Timestamp, true
+
+	if d.codecID == flvBroker.CodecH265 {
+		d.pushH265(p.Payload)
+	} else {
+		d.pushH264(p.Payload)
+	}
+	if p.Marker {
+		out = d.flush(out)
+	}
+	return out
+}
+
+func (d *videoDepacketizer) flush(out []accessUnit) []accessUnit {
+	if len(d.au) > 0 {
+		out = append(out, accessUnit{Timestamp: d.auTs, NALUs: d.au})
+	}
+	d.au, d.auActive = nil, false
+	return out
+}
+
+func (d *videoDepacketizer) pushH264(payload []byte) {
+	if len(payload) < 1 {
+		return
+	}
+	switch typ := payload[0] & 0x1F; typ {
+	case 24: // STAP-A
+		d.pushAggregated(payload[1:])
+	case 28: // FU-A
+		if len(payload) < 2 {
+			return
+		}
+		fuHeader := payload[1]
+		if fuHeader&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0xE0 | fuHeader&0x1F}, payload[2:]...)
+			d.fuActive = true
+		} else if d.fuActive {
+			d.fu = append(d.fu, payload[2:]...)
+		}
+		if fuHeader&0x40 != 0 && d.fuActive {
+			d.au = append(d.au, d.fu)
+			d.fu, d.fuActive = nil, false
+		}
+	default:
+		if typ >= 1 && typ <= 23 {
+			d.au = append(d.au, append([]byte(nil), payload...))
+		}
+	}
+}
+
+func (d *videoDepacketizer) pushH265(payload []byte) {
+	if len(payload) < 2 {
+		return
+	}
+	switch typ := (payload[0] >> 1) & 0x3F; typ {
+	case 48: // AP
+		d.pushAggregated(payload[2:])
+	case 49: // FU
+		if len(payload) < 3 {
+			return
+		}
+		fuHeader := payload[2]
+		if fuHeader&0x80 != 0 {
+			d.fu = append([]byte{payload[0]&0x81 | (fuHeader&0x3F)<<1, payload[1]}, payload[3:]...)
+			d.fuActive = true
+		} else if d.fuActive {
+			d.fu = append(d.fu, payload[3:]...)
+		}
+		if fuHeader&0x40 != 0 && d.fuActive {
+			d.au = append(d.au, d.fu)
+			d.fu, d.fuActive = nil, false
+		}
+	default:
+		if typ < 48 {
+			d.au = append(d.au, append([]byte(nil), payload...))
+		}
+	}
+}
+
+// pushAggregated STAP-A / AP：16 位长度 + NALU，重复
+func (d *videoDepacketizer) pushAggregated(data []byte) {
+	for len(data) >= 2 {
+		size := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if size == 0 || size > len(data) {
+			return
+		}
+		d.au = append(d.au, append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+}
+
+// aacFrame 一个 AAC 裸帧
+type aacFrame struct {
+	Timestamp uint32
+	Raw       []byte
+}
+
+// aacDepacketizer RFC 3640 AAC 解包器
+type aacDepacketizer struct {
+	sizeLength  int // AU-size 的位数，AAC-hbr 为 13
+	indexLength int // AU-Index 的位数，AAC-hbr 为 3
+
+	frag     []byte // 跨包的 AU
+	fragSize int
+	fragTs   uint32
+}
+
+func newAACDepacketizer(sizeLength, indexLength int) *aacDepacketizer {
+	return &aacDepacketizer{sizeLength: sizeLength, indexLength: indexLength}
+}
+
+// Push 输入一个 RTP 包，返回其中完整的 AAC 帧
+func (d *aacDepacketizer) Push(p *rtpPacket) []aacFrame {
+	payload := p.Payload
+	if len(payload) < 2 {
+		return nil
+	}
+	headersBits := int(binary.BigEndian.Uint16(payload))
+	headersBytes := (headersBits + 7) / 8
+	if len(payload) < 2+headersBytes || d.sizeLength == 0 {
+		return nil
+	}
+	headers := payload[2 : 2+headersBytes]
+	data := payload[2+headersBytes:]
+
+	headerBits := d.sizeLength + d.indexLength
+	var sizes []int
+	for bit := 0; bit+headerBits <= headersBits; bit += headerBits {
+		sizes = append(sizes, readBits(headers, bit, d.sizeLength))
+	}
+
+	// 一个 AU 太大被拆成多个包，只会有一个 AU 头
+	if len(sizes) == 1 && (sizes[0] > len(data) || d.frag != nil) {
+		if d.frag == nil || d.fragTs != p.Timestamp {
+			d.frag, d.fragSize, d.fragTs = nil, sizes[0], p.Timestamp
+		}
+		d.frag = append(d.frag, data...)
+		if len(d.frag) < d.fragSize {
+			return nil
+		}
+		frame := aacFrame{Timestamp: p.Timestamp, Raw: d.frag[:d.fragSize]}
+		d.frag = nil
+		return []aacFrame{frame}
+	}
+
+	var frames []aacFrame
+	for i, size := range sizes {
+		if size > len(data) {
+			break
+		}
+		frames = append(frames, aacFrame{
+			Timestamp: p.Timestamp + uint32(i*1024),
+			Raw:       append([]byte(nil), data[:size]...),
+		})
+		data = data[size:]
+	}
+	return frames
+}
+
+// readBits 从 bit 偏移开始读取 n 位
+func readBits(b []byte, offset, n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		pos := offset + i
+		if pos/8 >= len(b) {
+			return v
+		}
+		v = v<<1 | int(b[pos/8]>>(7-pos%8)&0x01)
+	}
+	return v
+}
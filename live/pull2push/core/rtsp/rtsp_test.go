@@ -0,0 +1,460 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	flvBroker "pull2push/core/broker/flv"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ====================== 进程内 RTSP 服务器 ======================
+
+var (
+	testSPS = []byte{0x67, 0x42, 0xC0, 0x1E, 0xDA, 0x02, 0x80, 0xBF, 0xE5, 0x84}
+	testPPS = []byte{0x68, 0xCE, 0x3C, 0x80}
+	testASC = []byte{0x12, 0x10} // AAC-LC 44100Hz 双声道
+)
+
+// testIDR 一个大于 MTU 的 IDR，必须走 FU-A
+func testIDR() []byte {
+	idr := make([]byte, 3000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i)
+	}
+	return idr
+}
+
+// testServer 最小化的 RTSP 服务器：Digest 认证、TCP interleaved / UDP、H.264 + AAC
+type testServer struct {
+	t         *testing.T
+	ln        net.Listener
+	user      string
+	pass      string
+	frames    int // 每个会话发送的帧数，发完后断开连接
+	sessions  atomic.Int32
+	frameTime time.Duration
+}
+
+func newTestServer(t *testing.T, frames int) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{t: t, ln: ln, user: "admin", pass: "secret", frames: frames, frameTime: time.Millisecond}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) url(path string) string {
+	return fmt.Sprintf("rtsp://%s:%s@%s%s", s.user, s.pass, s.ln.Addr(), path)
+}
+
+func (s *testServer) sdp() string {
+	sprop := base64.StdEncoding.EncodeToString(testSPS) + "," + base64.StdEncoding.EncodeToString(testPPS)
+	return "v=0\r\no=- 0 0 IN IP4 127.0.0.1\r\ns=test\r\nt=0 0\r\na=control:*\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1; sprop-parameter-sets=" + sprop + "\r\na=control:trackID=0\r\n" +
+		"m=audio 0 RTP/AVP 97\r\na=rtpmap:97 MPEG4-GENERIC/44100/2\r\n" +
+		"a=fmtp:97 streamtype=5; profile-level-id=15; mode=AAC-hbr; config=1210; sizelength=13; indexlength=3; indexdeltalength=3\r\n" +
+		"a=control:trackID=1\r\n"
+}
+
+// checkAuth 校验 Digest 认证
+func (s *testServer) checkAuth(method string, header textproto.MIMEHeader) bool {
+	scheme, rest, _ := strings.Cut(header.Get("Authorization"), " ")
+	if scheme != "Digest" {
+		return false
+	}
+	p := parseAuthParams(rest)
+	ha1 := md5Hex(p["username"] + ":test:" + s.pass)
+	ha2 := md5Hex(method + ":" + p["uri"])
+	expected := md5Hex(ha1 + ":" + p["nonce"] + ":" + p["nc"] + ":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+	return p["username"] == s.user && p["response"] == expected
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	tp := textproto.NewReader(br)
+	var writeMu sync.Mutex
+	write := func(b []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := conn.Write(b)
+		return err
+	}
+
+	var udpTargets []*net.UDPAddr
+	interleaved := false
+	done := make(chan struct{})
+	defer close(done)
+
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		method, uri, _ := strings.Cut(line, " ")
+		uri, _, _ = strings.Cut(uri, " ")
+		cseq := header.Get("CSeq")
+
+		reply := func(status string, extra string, body string) {
+			msg := "RTSP/1.0 " + status + "\r\nCSeq: " + cseq + "\r\n" + extra
+			if body != "" {
+				msg += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n"
+			}
+			_ = write([]byte(msg + "\r\n" + body))
+		}
+
+		if method != "OPTIONS" && !s.checkAuth(method, header) {
+			reply("401 Unauthorized", "WWW-Authenticate: Digest realm=\"test\", nonce=\"abc123\", qop=\"auth\"\r\n", "")
+			continue
+		}
+		switch method {
+		case "OPTIONS":
+			reply("200 OK", "Public: OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER\r\n", "")
+		case "DESCRIBE":
+			base := "rtsp://" + s.ln.Addr().String() + "/live/"
+			reply("200 OK", "Content-Base: "+base+"\r\nContent-Type: application/sdp\r\n", s.sdp())
+		case "SETUP":
+			transport := header.Get("Transport")
+			if _, ports, ok := strings.Cut(transport, "client_port="); ok {
+				first, _, _ := strings.Cut(ports, "-")
+				port, _ := strconv.Atoi(first)
+				udpTargets = append(udpTargets, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+				reply("200 OK", "Transport: "+transport+";server_port=6970-6971\r\nSession: 12345678;timeout=60\r\n", "")
+			} else {
+				interleaved = true
+				reply("200 OK", "Transport: "+transport+"\r\nSession: 12345678;timeout=60\r\n", "")
+			}
+		case "PLAY":
+			reply("200 OK", "Session: 12345678\r\n", "")
+			s.sessions.Add(1)
+			go func() {
+				s.stream(interleaved, write, udpTargets, done)
+				conn.Close()
+			}()
+		case "TEARDOWN":
+			reply("200 OK", "", "")
+			return
+		default:
+			reply("200 OK", "", "")
+		}
+	}
+}
+
+// stream 发送 s.frames 帧：第 0 帧是 IDR（FU-A），其余是单 NALU 的 P 帧，每帧一个 AAC
+func (s *testServer) stream(interleaved bool, write func([]byte) error, udpTargets []*net.UDPAddr, done chan struct{}) {
+	var udpConn *net.UDPConn
+	if !interleaved {
+		var err error
+		if udpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			return
+		}
+		defer udpConn.Close()
+	}
+	send := func(track int, pkt []byte) error {
+		if interleaved {
+			frame := []byte{'$', byte(2 * track), byte(len(pkt) >> 8), byte(len(pkt))}
+			return write(append(frame, pkt...))
+		}
+		_, err := udpConn.WriteToUDP(pkt, udpTargets[track])
+		return err
+	}
+
+	var videoSeq, audioSeq uint16
+	for i := 0; i < s.frames; i++ {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		ts := uint32(i * 3600)
+		nalu := []byte{0x41, byte(i), 0xAA, 0xBB}
+		if i%10 == 0 {
+			nalu = testIDR()
+		}
+		for _, payload := range packetizeH264(nalu, 1200) {
+			videoSeq++
+			last := payload[0]&0x1F != 28 || payload[1]&0x40 != 0
+			if send(0, rtpBytes(96, videoSeq, ts, last, payload)) != nil {
+				return
+			}
+		}
+		audioSeq++
+		au := bytes.Repeat([]byte{byte(i)}, 200)
+		payload := []byte{0x00, 0x10, byte(len(au) >> 5), byte(len(au)<<3) & 0xF8}
+		if send(1, rtpBytes(97, audioSeq, uint32(i*1024), true, append(payload, au...))) != nil {
+			return
+		}
+		time.Sleep(s.frameTime)
+	}
+}
+
+// packetizeH264 单 NALU 或 FU-A
+func packetizeH264(nalu []byte, mtu int) [][]byte {
+	if len(nalu) <= mtu {
+		return [][]byte{nalu}
+	}
+	var out [][]byte
+	indicator := nalu[0]&0xE0 | 28
+	data := nalu[1:]
+	for start := true; len(data) > 0; start = false {
+		n := min(mtu, len(data))
+		header := nalu[0] & 0x1F
+		if start {
+			header |= 0x80
+		}
+		if n == len(data) {
+			header |= 0x40
+		}
+		out = append(out, append([]byte{indicator, header}, data[:n]...))
+		data = data[n:]
+	}
+	return out
+}
+
+func rtpBytes(pt uint8, seq uint16, ts uint32, marker bool, payload []byte) []byte {
+	b := make([]byte, 12, 12+len(payload))
+	b[0] = 0x80
+	b[1] = pt
+	if marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], seq)
+	binary.BigEndian.PutUint32(b[4:], ts)
+	binary.BigEndian.PutUint32(b[8:], 0x12345678)
+	return append(b, payload...)
+}
+
+// ====================== 测试 ======================
+
+// readTags 从数据源读取 tag，直到读满 n 个或出错
+func readTags(t *testing.T, src flvBroker.TagSource, n int) []*flvBroker.FlvTag {
+	var tags []*flvBroker.FlvTag
+	for len(tags) < n {
+		tag, err := src.ReadTag()
+		if err != nil {
+			t.Fatalf("ReadTag after %d tags: %v", len(tags), err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// checkTags 校验序列头、IDR 的 FU-A 重组结果和 AAC 帧
+func checkTags(t *testing.T, tags []*flvBroker.FlvTag) {
+	var videoSeq, audioSeq, keyFrame bool
+	audioFrames, videoFrames := 0, 0
+	for _, tag := range tags {
+		switch {
+		case tag.TagType == flvBroker.TagTypeVideo && tag.IsSequenceHeader():
+			spsList, ppsList, _, err := flvBroker.ParseAVCDecoderConfig(tag.Data[5:])
+			if err != nil || !bytes.Equal(spsList[0], testSPS) || !bytes.Equal(ppsList[0], testPPS) {
+				t.Fatalf("bad AVC config: %v", err)
+			}
+			videoSeq = true
+		case tag.TagType == flvBroker.TagTypeAudio && tag.IsSequenceHeader():
+			if !bytes.Equal(tag.Data[2:], testASC) {
+				t.Fatalf("bad ASC %x", tag.Data[2:])
+			}
+			audioSeq = true
+		case tag.TagType == flvBroker.TagTypeVideo:
+			videoFrames++
+			if tag.IsKeyFrame() {
+				nalus, err := flvBroker.SplitAVCC(tag.Data[5:], 4)
+				if err != nil || len(nalus) != 1 || !bytes.Equal(nalus[0], testIDR()) {
+					t.Fatalf("IDR not reassembled: %v", err)
+				}
+				keyFrame = true
+			}
+		case tag.TagType == flvBroker.TagTypeAudio:
+			audioFrames++
+			if len(tag.Data) != 2+200 {
+				t.Fatalf("bad AAC frame size %d", len(tag.Data))
+			}
+		}
+	}
+	if !videoSeq || !audioSeq || !keyFrame || videoFrames == 0 || audioFrames == 0 {
+		t.Fatalf("missing tags: videoSeq=%v audioSeq=%v keyFrame=%v video=%d audio=%d", videoSeq, audioSeq, keyFrame, videoFrames, audioFrames)
+	}
+}
+
+func TestDialRTSPInterleavedDigest(t *testing.T) {
+	s := newTestServer(t, 20)
+	src, err := DialRTSP(context.Background(), s.url("/live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	if !bytes.Equal(src.Header(), flvBroker.BuildFLVHeader(true, true)) {
+		t.Fatalf("unexpected FLV header %x", src.Header())
+	}
+	checkTags(t, readTags(t, src, 20))
+}
+
+func TestDialRTSPUDP(t *testing.T) {
+	s := newTestServer(t, 20)
+	src, err := DialRTSP(context.Background(), s.url("/live?transport=udp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	checkTags(t, readTags(t, src, 20))
+}
+
+func TestDialRTSPWrongPassword(t *testing.T) {
+	s := newTestServer(t, 20)
+	s.pass = "other"
+	_, err := DialRTSP(context.Background(), fmt.Sprintf("rtsp://admin:secret@%s/live", s.ln.Addr()))
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected 401, got %v", err)
+	}
+}
+
+func TestDialRTSPEndOfStream(t *testing.T) {
+	s := newTestServer(t, 3)
+	src, err := DialRTSP(context.Background(), s.url("/live"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	// 服务器发完 3 帧就断开，ReadTag 应该返回 EOF 交给 Broker 重连，而不是一直阻塞
+	n := 0
+	for {
+		_, err := src.ReadTag()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				t.Fatalf("expected EOF, got %v", err)
+			}
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("no tags before EOF")
+	}
+}
+
+// collectClient 记录收到的字节数
+type collectClient struct {
+	bytes atomic.Int64
+	ch    chan []byte
+}
+
+func (c *collectClient) Broadcast(data []byte) { c.bytes.Add(int64(len(data))) }
+func (c *collectClient) Listen()               {}
+func (c *collectClient) GetDataChan() chan []byte {
+	return c.ch
+}
+
+// TestBrokerReconnect 服务器每个会话只发几帧就断开，Broker 应该自动重连并持续给客户端发数据
+func TestBrokerReconnect(t *testing.T) {
+	s := newTestServer(t, 5)
+	b := flvBroker.NewFLVStreamBrokerWithDialer("camera", s.url("/live"), DialRTSP)
+	b.Start(context.Background())
+	c := &collectClient{}
+	b.AddLiveClient("c1", c)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for s.sessions.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d sessions before deadline", s.sessions.Load())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if c.bytes.Load() == 0 {
+		t.Fatal("client received no data")
+	}
+}
+
+func TestVideoDepacketizerH265(t *testing.T) {
+	vps := []byte{0x40, 0x01, 0x0C}
+	sps := []byte{0x42, 0x01, 0x01}
+	idr := append([]byte{0x26, 0x01}, bytes.Repeat([]byte{0x55}, 100)...)
+
+	// AP：VPS + SPS
+	ap := []byte{48 << 1, 0x01}
+	for _, n := range [][]byte{vps, sps} {
+		ap = binary.BigEndian.AppendUint16(ap, uint16(len(n)))
+		ap = append(ap, n...)
+	}
+	// FU：IDR 分两片
+	fuType := (idr[0] >> 1) & 0x3F
+	fu1 := append([]byte{49 << 1, 0x01, 0x80 | fuType}, idr[2:50]...)
+	fu2 := append([]byte{49 << 1, 0x01, 0x40 | fuType}, idr[50:]...)
+
+	d := newVideoDepacketizer(flvBroker.CodecH265)
+	var aus []accessUnit
+	for i, payload := range [][]byte{ap, fu1, fu2} {
+		pkt, err := parseRTP(rtpBytes(96, uint16(i), 9000, i == 2, payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aus = append(aus, d.Push(pkt)...)
+	}
+	if len(aus) != 1 || len(aus[0].NALUs) != 3 {
+		t.Fatalf("unexpected access units %+v", aus)
+	}
+	for i, want := range [][]byte{vps, sps, idr} {
+		if !bytes.Equal(aus[0].NALUs[i], want) {
+			t.Fatalf("nalu %d mismatch", i)
+		}
+	}
+
+	// 中间丢包时丢弃不完整的分片
+	d = newVideoDepacketizer(flvBroker.CodecH265)
+	p1, _ := parseRTP(rtpBytes(96, 1, 0, false, fu1))
+	p2, _ := parseRTP(rtpBytes(96, 3, 0, true, fu2))
+	if aus := append(d.Push(p1), d.Push(p2)...); len(aus) != 0 {
+		t.Fatalf("expected fragment to be dropped, got %+v", aus)
+	}
+}
+
+func TestParseSDPAndControl(t *testing.T) {
+	sd, err := parseSDP([]byte((&testServer{}).sdp()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sd.Medias) != 2 || sd.Medias[0].Encoding != "H264" || sd.Medias[1].ClockRate != 44100 || sd.Medias[1].Channels != 2 {
+		t.Fatalf("unexpected SDP %+v", sd.Medias)
+	}
+	if sd.Medias[1].Fmtp["sizelength"] != "13" {
+		t.Fatalf("fmtp not parsed: %v", sd.Medias[1].Fmtp)
+	}
+	base := "rtsp://h/live/"
+	if got := resolveControl(base, sd.Medias[0].Control); got != "rtsp://h/live/trackID=0" {
+		t.Fatalf("resolveControl = %s", got)
+	}
+	if got := resolveControl(base, sd.Control); got != base {
+		t.Fatalf("resolveControl(*) = %s", got)
+	}
+}
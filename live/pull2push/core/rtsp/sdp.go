@@ -0,0 +1,110 @@
+package rtsp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// mediaDescription SDP 里的一路媒体（m= 段）
+type mediaDescription struct {
+	Type        string            // video / audio
+	PayloadType uint8             // RTP payload type
+	Encoding    string            // 大写的编码名：H264 / H265 / MPEG4-GENERIC
+	ClockRate   int               // RTP 时钟频率
+	Channels    int               // 音频声道数
+	Control     string            // a=control
+	Fmtp        map[string]string // a=fmtp 参数，key 为小写
+}
+
+// sessionDescription DESCRIBE 返回的 SDP
+type sessionDescription struct {
+	Control string // 会话级 a=control，PLAY 使用
+	Medias  []*mediaDescription
+}
+
+// parseSDP 只解析拉流需要的字段
+func parseSDP(body []byte) (*sessionDescription, error) {
+	sd := &sessionDescription{}
+	var cur *mediaDescription
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) < 2 || line[1] != '=' {
+			continue
+		}
+		value := line[2:]
+		switch line[0] {
+		case 'm':
+			fields := strings.Fields(value)
+			if len(fields) < 4 {
+				cur = nil
+				continue
+			}
+			pt, err := strconv.Atoi(fields[3])
+			if err != nil {
+				cur = nil
+				continue
+			}
+			cur = &mediaDescription{Type: fields[0], PayloadType: uint8(pt), Fmtp: make(map[string]string)}
+			sd.Medias = append(sd.Medias, cur)
+		case 'a':
+			key, attr, _ := strings.Cut(value, ":")
+			switch key {
+			case "control":
+				if cur == nil {
+					sd.Control = attr
+				} else {
+					cur.Control = attr
+				}
+			case "rtpmap":
+				if cur == nil {
+					continue
+				}
+				pt, rest, _ := strings.Cut(attr, " ")
+				if n, err := strconv.Atoi(pt); err != nil || uint8(n) != cur.PayloadType {
+					continue
+				}
+				parts := strings.Split(strings.TrimSpace(rest), "/")
+				cur.Encoding = strings.ToUpper(parts[0])
+				if len(parts) > 1 {
+					cur.ClockRate, _ = strconv.Atoi(parts[1])
+				}
+				if len(parts) > 2 {
+					cur.Channels, _ = strconv.Atoi(parts[2])
+				}
+			case "fmtp":
+				if cur == nil {
+					continue
+				}
+				_, params, _ := strings.Cut(attr, " ")
+				for _, p := range strings.Split(params, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+					if ok {
+						cur.Fmtp[strings.ToLower(k)] = strings.TrimSpace(v)
+					}
+				}
+			}
+		}
+	}
+	if len(sd.Medias) == 0 {
+		return nil, errors.New("SDP 中没有媒体描述")
+	}
+	return sd, nil
+}
+
+// resolveControl 把 a=control 解析成完整地址
+func resolveControl(base, control string) string {
+	if control == "" || control == "*" {
+		return base
+	}
+	if strings.HasPrefix(control, "rtsp://") || strings.HasPrefix(control, "rtsps://") {
+		return control
+	}
+	if strings.HasSuffix(base, "/") {
+		return base + control
+	}
+	return base + "/" + control
+}
@@ -0,0 +1,172 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"pull2push/core/broker"
+	"strconv"
+	"time"
+)
+
+/*
+Limits 观众准入限制，0 表示不限制
+
+	新建会话（Open / OpenPoll）时检查，在客户端加入 broker 之前，已经在看的观众不受影响。
+	节点、单路直播、带宽是本节点的限制，换一个节点就能看，开启 Redirect 时 302 到集群里的其他节点；
+	token 的限制和节点无关，只能拒绝。
+*/
+type Limits struct {
+	MaxViewers          int   // 本节点同时在看的会话数
+	MaxViewersPerBroker int   // 单路直播同时在看的会话数
+	MaxBandwidth        int64 // 本节点的出口带宽，bit/s
+	MaxSessionsPerToken int   // 同一个 token 同时在看的会话数
+	Redirect            bool  // 超出本节点的限制时重定向到其他节点
+}
+
+type LIMIT_TYPE string
+
+const (
+	// LimitViewers 本节点观众数已满
+	LimitViewers LIMIT_TYPE = "max_viewers"
+
+	// LimitBrokerViewers 这路直播的观众数已满
+	LimitBrokerViewers LIMIT_TYPE = "max_viewers_per_stream"
+
+	// LimitBandwidth 本节点出口带宽已满
+	LimitBandwidth LIMIT_TYPE = "max_bandwidth"
+
+	// LimitToken 这个 token 同时观看的会话数已满
+	LimitToken LIMIT_TYPE = "max_sessions_per_token"
+)
+
+// LimitError 超出准入限制
+type LimitError struct {
+	Type LIMIT_TYPE
+	Msg  string
+}
+
+func (e *LimitError) Error() string {
+	return e.Msg
+}
+
+// Redirectable 换一个节点能不能看
+func (e *LimitError) Redirectable() bool {
+	return e.Type != LimitToken
+}
+
+// Redirector 超出本节点的限制时挑选第 hop 个备选节点，返回节点地址（http://host:port），没有更多节点时返回空串
+type Redirector func(brokerKey string, hop int) string
+
+// hopParam 重定向时记录已经跳过几个节点，避免在都满了的节点之间来回跳
+const hopParam = "edge_hop"
+
+// retryAfter 拒绝时建议播放器多久以后重试
+const retryAfter = 10 * time.Second
+
+// SetLimits 修改准入限制，配置热更新时调用
+func (r *Registry) SetLimits(limits Limits) {
+	r.limits.Store(&limits)
+}
+
+// SetRedirector 设置超出限制时挑选其他节点的方法，集群模式下 main 设置
+func (r *Registry) SetRedirector(redirector Redirector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redirector = redirector
+}
+
+// admit 检查能否再加入一个会话，调用方需持有 r.mu
+func (r *Registry) admit(brokerKey, token string) error {
+	limits := r.limits.Load()
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxSessionsPerToken > 0 && token != "" && r.tokenCount[token] >= limits.MaxSessionsPerToken {
+		return &LimitError{Type: LimitToken, Msg: fmt.Sprintf("同一个 token 最多同时观看 %d 路", limits.MaxSessionsPerToken)}
+	}
+	if limits.MaxViewers > 0 && len(r.sessions) >= limits.MaxViewers {
+		return &LimitError{Type: LimitViewers, Msg: fmt.Sprintf("本节点观众数已满（%d）", limits.MaxViewers)}
+	}
+	if limits.MaxViewersPerBroker > 0 && r.brokerCount[brokerKey] >= limits.MaxViewersPerBroker {
+		return &LimitError{Type: LimitBrokerViewers, Msg: fmt.Sprintf("直播 %s 观众数已满（%d）", brokerKey, limits.MaxViewersPerBroker)}
+	}
+	if limits.MaxBandwidth > 0 {
+		// 按现在每个观众的平均码率估算再加一个观众之后的带宽
+		rate := r.rate.Load()
+		if n := int64(len(r.sessions)); n > 0 {
+			rate += rate / n
+		}
+		if rate > limits.MaxBandwidth {
+			return &LimitError{Type: LimitBandwidth, Msg: fmt.Sprintf("本节点出口带宽已满（%d Mbps）", limits.MaxBandwidth/1e6)}
+		}
+	}
+	return nil
+}
+
+// Reject 拒绝一个新观众：本节点的限制在开启重定向时 302 到其他节点，否则 503；token 的限制返回 429
+func (r *Registry) Reject(c *gin.Context, brokerKey string, err error) {
+	if errors.Is(err, broker.ErrInvalidStartMode) {
+		c.JSON(http.StatusBadRequest, gin.H{"code": 400, "msg": err.Error()})
+		return
+	}
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"code": 503, "msg": err.Error()})
+		return
+	}
+	if !limitErr.Redirectable() {
+		c.JSON(http.StatusTooManyRequests, gin.H{"code": 429, "msg": limitErr.Msg, "data": gin.H{"limit": limitErr.Type}})
+		return
+	}
+	if location := r.redirectURL(c, brokerKey); location != "" {
+		c.Redirect(http.StatusFound, location)
+		return
+	}
+	c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	c.JSON(http.StatusServiceUnavailable, gin.H{"code": 503, "msg": limitErr.Msg, "data": gin.H{"limit": limitErr.Type}})
+}
+
+// redirectURL 同一个请求换到下一个备选节点的地址，不能重定向时返回空串
+func (r *Registry) redirectURL(c *gin.Context, brokerKey string) string {
+	r.mu.Lock()
+	redirector := r.redirector
+	r.mu.Unlock()
+	if limits := r.limits.Load(); limits == nil || !limits.Redirect || redirector == nil {
+		return ""
+	}
+	query := c.Request.URL.Query()
+	hop, _ := strconv.Atoi(query.Get(hopParam))
+	node := redirector(brokerKey, hop)
+	if node == "" {
+		return ""
+	}
+	query.Set(hopParam, strconv.Itoa(hop+1))
+	target, err := url.Parse(node)
+	if err != nil {
+		return ""
+	}
+	target.Path = c.Request.URL.Path
+	target.RawQuery = query.Encode()
+	return target.String()
+}
+
+// sample 按两次采样之间发出的字节数计算出口带宽，由 Run 定时调用
+func (r *Registry) sample(now time.Time) {
+	sent := r.sent.Load()
+	r.mu.Lock()
+	elapsed := now.Sub(r.sampledAt)
+	delta := sent - r.sampledBytes
+	r.sampledAt, r.sampledBytes = now, sent
+	r.mu.Unlock()
+	if elapsed > 0 {
+		r.rate.Store(int64(float64(delta*8) / elapsed.Seconds()))
+	}
+}
+
+// Bandwidth 最近一次采样的出口带宽，bit/s
+func (r *Registry) Bandwidth() int64 {
+	return r.rate.Load()
+}
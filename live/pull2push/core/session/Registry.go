@@ -0,0 +1,196 @@
+package session
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"pull2push/core/broker"
+	"pull2push/middleware"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Registry 进程内所有观看会话，会话列表、踢人接口和准入限制都从这里查
+type Registry struct {
+	mu          sync.Mutex
+	sessions    map[string]*Session // map[sessionId]Session
+	brokerCount map[string]int      // map[brokerKey]会话数
+	tokenCount  map[string]int      // map[token]会话数
+
+	limits     atomic.Pointer[Limits]
+	redirector Redirector
+
+	// 出口带宽：sent 为所有会话累计发出的字节数，Run 定时采样算出 rate
+	sent         atomic.Int64
+	rate         atomic.Int64 // bit/s
+	sampledAt    time.Time
+	sampledBytes int64
+}
+
+// Default 进程共用的会话注册表
+var Default = NewRegistry()
+
+// PollIdle hls 观众多久没有请求算离开，要比播放器刷新播放列表的间隔（一个分片时长）长得多
+const PollIdle = 30 * time.Second
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sessions:    make(map[string]*Session),
+		brokerCount: make(map[string]int),
+		tokenCount:  make(map[string]int),
+		sampledAt:   time.Now(),
+	}
+}
+
+// newSessionId 生成会话编号，16 位十六进制随机数
+func newSessionId() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%016x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+func (r *Registry) newSession(c *gin.Context, parent context.Context, brokerKey, protocol string) *Session {
+	ctx, cancel := context.WithCancel(parent)
+	return &Session{
+		ID:        newSessionId(),
+		BrokerKey: brokerKey,
+		ClientId:  c.Param("clientId"),
+		Protocol:  protocol,
+		RemoteIP:  c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		StartedAt: time.Now(),
+		token:     middleware.RequestToken(c),
+		peer:      middleware.IsClusterPeer(c),
+		ctx:       ctx,
+		cancel:    cancel,
+		registry:  r,
+	}
+}
+
+// Open 为一个长连接观众创建会话，超出准入限制时返回 *LimitError，?start= 不合法时返回 broker.ErrInvalidStartMode；
+// parent 结束时会话的 Context 也结束，处理函数返回前必须 End
+func (r *Registry) Open(c *gin.Context, parent context.Context, brokerKey, protocol string) (*Session, error) {
+	start, err := broker.ParseStartMode(c.Query("start"))
+	if err != nil {
+		return nil, err
+	}
+	s := r.newSession(c, parent, brokerKey, protocol)
+	s.Start = start
+	return r.add(s)
+}
+
+// OpenPoll 为一个轮询观众（hls）创建会话，之后的请求地址要带上会话编号，空闲超过 idle 后由 Run 结束
+func (r *Registry) OpenPoll(c *gin.Context, brokerKey, protocol string, idle time.Duration) (*Session, error) {
+	s := r.newSession(c, context.Background(), brokerKey, protocol)
+	s.idle = idle
+	s.Touch()
+	return r.add(s)
+}
+
+// add 检查准入限制并登记会话，集群节点的拉流不检查
+func (r *Registry) add(s *Session) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !s.peer {
+		// 限制是给观众的，拒绝 edge 会让它那边的观众全部断流
+		if err := r.admit(s.BrokerKey, s.token); err != nil {
+			s.cancel()
+			return nil, err
+		}
+	}
+	r.sessions[s.ID] = s
+	r.brokerCount[s.BrokerKey]++
+	if s.token != "" {
+		r.tokenCount[s.token]++
+	}
+	return s, nil
+}
+
+func (r *Registry) remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.ID] != s {
+		return
+	}
+	delete(r.sessions, s.ID)
+	if r.brokerCount[s.BrokerKey]--; r.brokerCount[s.BrokerKey] <= 0 {
+		delete(r.brokerCount, s.BrokerKey)
+	}
+	if s.token != "" {
+		if r.tokenCount[s.token]--; r.tokenCount[s.token] <= 0 {
+			delete(r.tokenCount, s.token)
+		}
+	}
+}
+
+// Get 按会话编号查询
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// List 列出会话，按开始时间排序；brokerKey 为空时列出所有直播的
+func (r *Registry) List(brokerKey string) []Info {
+	r.mu.Lock()
+	list := make([]Info, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		if brokerKey == "" || s.BrokerKey == brokerKey {
+			list = append(list, s.Info())
+		}
+	}
+	r.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].StartedAt.Equal(list[j].StartedAt) {
+			return list[i].StartedAt.Before(list[j].StartedAt)
+		}
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Kick 踢出一个观众，原因通过 CloseSignal 带给客户端
+func (r *Registry) Kick(id, reason string) error {
+	s, ok := r.Get(id)
+	if !ok {
+		return fmt.Errorf("会话 %s 不存在", id)
+	}
+	s.Close(broker.CloseSignal{Type: broker.KickedOutClient, Reason: reason})
+	return nil
+}
+
+// Run 定时结束空闲超时的轮询会话、采样出口带宽，直到 ctx 结束
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.reapOnce(now)
+			r.sample(now)
+		}
+	}
+}
+
+func (r *Registry) reapOnce(now time.Time) {
+	var expired []*Session
+	r.mu.Lock()
+	for _, s := range r.sessions {
+		if s.expired(now) {
+			expired = append(expired, s)
+		}
+	}
+	r.mu.Unlock()
+	for _, s := range expired {
+		s.End()
+	}
+}
@@ -0,0 +1,137 @@
+package session
+
+import (
+	"context"
+	"pull2push/core/broker"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Session 一个观众的一次观看，会话编号由服务端分配
+
+	地址里的 clientId 由前端随意填写，两个观众可能用同一个，broker 里统一用会话编号登记客户端，
+	clientId 只作为展示用的标签保留下来。
+
+	长连接（flv / ws / ts / camera）：请求开始时 Open，处理函数返回时 End
+	轮询（hls）：第一次请求时 OpenPoll，之后的地址都带着会话编号，空闲超过 idle 后由 Registry.Run 结束
+*/
+type Session struct {
+	ID        string            // 服务端分配的会话编号，broker 里客户端的 clientId
+	BrokerKey string            // 观看的直播
+	ClientId  string            // 地址里的 clientId，只用于展示
+	Protocol  string            // flv / ws / ts / hls / camera
+	RemoteIP  string            // 观众地址
+	UserAgent string            // 播放器
+	StartedAt time.Time         // 开始观看的时间
+	Start     broker.START_MODE // 请求参数 ?start= 指定的起播方式，为空时按流的默认策略
+
+	token     string // 请求携带的 token，按 token 限制并发会话数
+	peer      bool   // 集群里其他节点的拉流，不受准入限制
+	bytesSent atomic.Int64
+	lastSeen  atomic.Int64  // 最后一次请求的时间（UnixNano），只有轮询的会话使用
+	idle      time.Duration // 轮询的会话空闲多久算离开，长连接为 0
+
+	ctx    context.Context    // 被踢出或会话结束时取消
+	cancel context.CancelFunc // 服务端主动断开
+	signal atomic.Pointer[broker.CloseSignal]
+
+	registry *Registry
+	endOnce  sync.Once
+	mu       sync.Mutex
+	ended    bool
+	onEnd    []func()
+}
+
+// Info 会话的快照，会话列表接口返回
+type Info struct {
+	ID        string              `json:"id"`
+	BrokerKey string              `json:"brokerKey"`
+	ClientId  string              `json:"clientId"`
+	Protocol  string              `json:"protocol"`
+	RemoteIP  string              `json:"remoteIp"`
+	UserAgent string              `json:"userAgent"`
+	StartedAt time.Time           `json:"startedAt"`
+	BytesSent int64               `json:"bytesSent"`
+	Closed    *broker.CloseSignal `json:"closed,omitempty"` // 被服务端断开时的信号，还没结束的轮询会话会出现
+}
+
+// Context 被踢出或会话结束时取消，客户端的读写循环据此退出
+func (s *Session) Context() context.Context {
+	return s.ctx
+}
+
+// AddBytes 累计发给观众的字节数
+func (s *Session) AddBytes(n int) {
+	s.bytesSent.Add(int64(n))
+	s.registry.sent.Add(int64(n))
+}
+
+// BytesSent 已经发给观众的字节数
+func (s *Session) BytesSent() int64 {
+	return s.bytesSent.Load()
+}
+
+// Touch 轮询的会话收到一次请求，刷新空闲时间
+func (s *Session) Touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Close 服务端主动断开会话，只有第一次的信号生效；会话还留在列表里，直到处理函数 End 或者空闲被回收
+func (s *Session) Close(sig broker.CloseSignal) {
+	s.signal.CompareAndSwap(nil, &sig)
+	s.cancel()
+}
+
+// Signal 服务端断开会话时的信号，没有被断开时为 nil
+func (s *Session) Signal() *broker.CloseSignal {
+	return s.signal.Load()
+}
+
+// OnEnd 注册会话结束时的回调，比如把客户端从 broker 移除；会话已经结束时马上执行
+func (s *Session) OnEnd(f func()) {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		f()
+		return
+	}
+	s.onEnd = append(s.onEnd, f)
+	s.mu.Unlock()
+}
+
+// End 结束会话：从注册表移除，取消 Context，执行 OnEnd 回调，可以重复调用
+func (s *Session) End() {
+	s.endOnce.Do(func() {
+		s.registry.remove(s)
+		s.cancel()
+		s.mu.Lock()
+		callbacks := s.onEnd
+		s.ended, s.onEnd = true, nil
+		s.mu.Unlock()
+		for _, f := range callbacks {
+			f()
+		}
+	})
+}
+
+// expired 轮询的会话是否空闲超时
+func (s *Session) expired(now time.Time) bool {
+	return s.idle > 0 && now.Sub(time.Unix(0, s.lastSeen.Load())) > s.idle
+}
+
+// Info 会话当前的快照
+func (s *Session) Info() Info {
+	return Info{
+		ID:        s.ID,
+		BrokerKey: s.BrokerKey,
+		ClientId:  s.ClientId,
+		Protocol:  s.Protocol,
+		RemoteIP:  s.RemoteIP,
+		UserAgent: s.UserAgent,
+		StartedAt: s.StartedAt,
+		BytesSent: s.bytesSent.Load(),
+		Closed:    s.signal.Load(),
+	}
+}
@@ -0,0 +1,225 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"pull2push/config"
+	"pull2push/core/broker"
+	"pull2push/middleware"
+	"testing"
+	"time"
+)
+
+func newTestContext(clientId, remoteAddr string) *gin.Context {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest("GET", "/live/hls/test/"+clientId+"/index.m3u8", nil)
+	c.Request.RemoteAddr = remoteAddr
+	c.Request.Header.Set("User-Agent", "test-player")
+	c.Params = gin.Params{{Key: "clientId", Value: clientId}}
+	return c
+}
+
+func mustOpen(t *testing.T, r *Registry, c *gin.Context, brokerKey string) *Session {
+	t.Helper()
+	s, err := r.Open(c, context.Background(), brokerKey, "flv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRegistryOpenKick(t *testing.T) {
+	r := NewRegistry()
+	// 两个观众用同一个 clientId 也会拿到不同的会话
+	a := mustOpen(t, r, newTestContext("same", "10.0.0.1:1000"), "test")
+	b := mustOpen(t, r, newTestContext("same", "10.0.0.2:1000"), "test")
+	mustOpen(t, r, newTestContext("other", "10.0.0.3:1000"), "other")
+	if a.ID == b.ID {
+		t.Fatalf("session ids collide: %s", a.ID)
+	}
+	if list := r.List("test"); len(list) != 2 || list[0].ClientId != "same" || list[0].RemoteIP != "10.0.0.1" {
+		t.Fatalf("List(test) = %+v", list)
+	}
+	if len(r.List("")) != 3 {
+		t.Fatalf("List() = %d sessions, want 3", len(r.List("")))
+	}
+
+	if err := r.Kick(a.ID, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-a.Context().Done():
+	default:
+		t.Fatal("kicked session context not cancelled")
+	}
+	if sig := a.Signal(); sig == nil || sig.Type != broker.KickedOutClient || sig.Reason != "spam" {
+		t.Fatalf("signal = %+v", sig)
+	}
+	if b.Signal() != nil {
+		t.Fatal("other session was kicked")
+	}
+
+	ended := 0
+	a.OnEnd(func() { ended++ })
+	a.End()
+	a.End()
+	a.OnEnd(func() { ended++ })
+	if ended != 2 {
+		t.Fatalf("OnEnd callbacks ran %d times, want 2", ended)
+	}
+	if _, ok := r.Get(a.ID); ok {
+		t.Fatal("ended session still registered")
+	}
+	if err := r.Kick(a.ID, "again"); err == nil {
+		t.Fatal("kicking an ended session should fail")
+	}
+}
+
+func TestRegistryReap(t *testing.T) {
+	r := NewRegistry()
+	// 长连接的会话不会因为空闲被回收
+	long := mustOpen(t, r, newTestContext("flv", "10.0.0.1:1000"), "test")
+	poll, err := r.OpenPoll(newTestContext("hls", "10.0.0.1:1000"), "test", "hls", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := false
+	poll.OnEnd(func() { removed = true })
+
+	r.reapOnce(time.Now().Add(30 * time.Second))
+	if _, ok := r.Get(poll.ID); !ok {
+		t.Fatal("active session reaped")
+	}
+	r.reapOnce(time.Now().Add(2 * time.Minute))
+	if _, ok := r.Get(poll.ID); ok || !removed {
+		t.Fatal("idle poll session not reaped")
+	}
+	if _, ok := r.Get(long.ID); !ok {
+		t.Fatal("long-lived session reaped")
+	}
+}
+
+func TestRegistryLimits(t *testing.T) {
+	r := NewRegistry()
+	r.SetLimits(Limits{MaxViewers: 3, MaxViewersPerBroker: 2, MaxSessionsPerToken: 1})
+	limitType := func(err error) LIMIT_TYPE {
+		var limitErr *LimitError
+		if !errors.As(err, &limitErr) {
+			t.Fatalf("err = %v, want *LimitError", err)
+		}
+		return limitErr.Type
+	}
+
+	a := mustOpen(t, r, newTestContext("a", "10.0.0.1:1000"), "test")
+	mustOpen(t, r, newTestContext("b", "10.0.0.2:1000"), "test")
+	if _, err := r.Open(newTestContext("c", "10.0.0.3:1000"), context.Background(), "test", "flv"); limitType(err) != LimitBrokerViewers {
+		t.Fatalf("third viewer of test: %v", err)
+	}
+	mustOpen(t, r, newTestContext("c", "10.0.0.3:1000"), "other")
+	if _, err := r.Open(newTestContext("d", "10.0.0.4:1000"), context.Background(), "another", "flv"); limitType(err) != LimitViewers {
+		t.Fatalf("fourth viewer on the node: %v", err)
+	}
+	// 有人离开后空出名额
+	a.End()
+	mustOpen(t, r, newTestContext("d", "10.0.0.4:1000"), "test")
+
+	r.SetLimits(Limits{MaxSessionsPerToken: 1})
+	withToken := func() *gin.Context {
+		c := newTestContext("t", "10.0.0.5:1000")
+		c.Request.Header.Set("Authorization", "Bearer user-1")
+		return c
+	}
+	s := mustOpen(t, r, withToken(), "test")
+	if _, err := r.Open(withToken(), context.Background(), "other", "flv"); limitType(err) != LimitToken {
+		t.Fatalf("second session of the token: %v", err)
+	}
+	s.End()
+	mustOpen(t, r, withToken(), "other")
+}
+
+// 带 cluster.token 的 edge 拉流不受观众限制，auth 开启时也能通过
+func TestRegistryClusterPeer(t *testing.T) {
+	r := NewRegistry()
+	r.SetLimits(Limits{MaxViewers: 1, MaxSessionsPerToken: 1})
+	auth := middleware.AuthMiddleware(config.NewStore(&config.Config{
+		Auth:    config.AuthConfig{Enabled: true, Tokens: []string{"user-1"}},
+		Cluster: config.ClusterConfig{Token: "cluster-1"},
+	}))
+	open := func(token string) (*Session, error) {
+		c := newTestContext("edge", "10.0.0.9:1000")
+		c.Request.Header.Set("Authorization", "Bearer "+token)
+		auth(c)
+		if c.IsAborted() {
+			return nil, errors.New("鉴权失败")
+		}
+		return r.Open(c, context.Background(), "test", "flv")
+	}
+
+	if _, err := open("user-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open("user-1"); err == nil {
+		t.Fatal("观众超出限制也被放行了")
+	}
+	for range 2 {
+		if _, err := open("cluster-1"); err != nil {
+			t.Fatalf("edge 拉流被拒绝: %v", err)
+		}
+	}
+	if _, err := open("cluster-2"); err == nil {
+		t.Fatal("错误的 cluster token 通过了鉴权")
+	}
+}
+
+func TestRegistryBandwidthLimit(t *testing.T) {
+	r := NewRegistry()
+	r.SetLimits(Limits{MaxBandwidth: 10e6})
+	start := r.sampledAt
+	s := mustOpen(t, r, newTestContext("a", "10.0.0.1:1000"), "test")
+	// 1 秒发出 1MB = 8Mbps，再来一个同样码率的观众就超过 10Mbps
+	s.AddBytes(1e6)
+	r.sample(start.Add(time.Second))
+	if got := r.Bandwidth(); got != 8e6 {
+		t.Fatalf("Bandwidth() = %d, want 8e6", got)
+	}
+	_, err := r.Open(newTestContext("b", "10.0.0.2:1000"), context.Background(), "test", "flv")
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Type != LimitBandwidth || !limitErr.Redirectable() {
+		t.Fatalf("err = %v, want bandwidth limit", err)
+	}
+	r.sample(start.Add(2 * time.Second))
+	mustOpen(t, r, newTestContext("b", "10.0.0.2:1000"), "test")
+}
+
+func TestRejectRedirect(t *testing.T) {
+	r := NewRegistry()
+	r.SetLimits(Limits{MaxViewers: 1, Redirect: true})
+	r.SetRedirector(func(brokerKey string, hop int) string {
+		if hop > 0 {
+			return ""
+		}
+		return "http://edge2:8080"
+	})
+	mustOpen(t, r, newTestContext("a", "10.0.0.1:1000"), "test")
+
+	reject := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest("GET", target, nil)
+		c.Params = gin.Params{{Key: "clientId", Value: "b"}}
+		_, err := r.Open(c, context.Background(), "test", "flv")
+		r.Reject(c, "test", err)
+		return w
+	}
+	w := reject("/live/flv/test/b?token=x")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://edge2:8080/live/flv/test/b?edge_hop=1&token=x" {
+		t.Fatalf("redirect = %d %s", w.Code, w.Header().Get("Location"))
+	}
+	// 已经跳过一次、没有更多节点时直接拒绝
+	if w := reject("/live/flv/test/b?edge_hop=1"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("second hop = %d", w.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package stream
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// maxGOPPackets GOP 缓存最多保存的包数，关键帧间隔异常大时放弃缓存，等下一个关键帧
+const maxGOPPackets = 4096
+
+// Hub 观众列表 + 起播缓存，新 broker 嵌入它实现 WritePacket / AddClient / RemoveClient
+//
+//	起播：缓存最近的元数据、音视频解码配置和从最近关键帧开始的 GOP，新观众先收到这些再收实时数据
+//	分发：WritePacket 在调用方的 goroutine 里依次写给每个观众，Write 出错的观众直接移除
+type Hub struct {
+	mu       sync.Mutex
+	clients  map[string]Client
+	metadata *Packet
+	configs  map[PACKET_KIND]Packet
+	gop      []Packet
+	closed   bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[string]Client),
+		configs: make(map[PACKET_KIND]Packet),
+	}
+}
+
+// WritePacket 更新起播缓存并分发给全部观众
+func (h *Hub) WritePacket(p Packet) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	h.cache(p)
+	for id, c := range h.clients {
+		if err := c.Write(p); err != nil {
+			log.Printf("[stream] 观众 %s 写入失败，移除: %v", id, err)
+			delete(h.clients, id)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) cache(p Packet) {
+	switch {
+	case p.Kind == PacketMetadata:
+		h.metadata = &p
+	case p.Config:
+		h.configs[p.Kind] = p
+		if p.Kind == PacketVideo {
+			// 解码配置变了，旧 GOP 用新配置解不了
+			h.gop = h.gop[:0]
+		}
+	case p.Kind == PacketVideo && p.KeyFrame:
+		clear(h.gop)
+		h.gop = append(h.gop[:0], p)
+	case len(h.gop) > 0:
+		if len(h.gop) >= maxGOPPackets {
+			clear(h.gop)
+			h.gop = h.gop[:0]
+			return
+		}
+		h.gop = append(h.gop, p)
+	}
+}
+
+// AddClient 先把起播缓存写给新观众，再加入分发列表；同一个 id 已经存在时替换
+func (h *Hub) AddClient(id string, c Client) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	for _, p := range h.startup() {
+		if err := c.Write(p); err != nil {
+			return err
+		}
+	}
+	h.clients[id] = c
+	return nil
+}
+
+// startup 新观众需要先收到的包：元数据、视频配置、音频配置、GOP
+func (h *Hub) startup() []Packet {
+	packets := make([]Packet, 0, 3+len(h.gop))
+	if h.metadata != nil {
+		packets = append(packets, *h.metadata)
+	}
+	for _, kind := range []PACKET_KIND{PacketVideo, PacketAudio} {
+		if p, ok := h.configs[kind]; ok {
+			packets = append(packets, p)
+		}
+	}
+	return append(packets, h.gop...)
+}
+
+func (h *Hub) RemoveClient(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, id)
+}
+
+// FindClient 查询观众
+func (h *Hub) FindClient(id string) (Client, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c, ok := h.clients[id]
+	return c, ok
+}
+
+// ClientIDs 当前全部观众的 id，按字典序
+func (h *Hub) ClientIDs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids := make([]string, 0, len(h.clients))
+	for id := range h.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close 移除全部观众、清空缓存，之后的 WritePacket / AddClient 返回 ErrClosed
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.clients = make(map[string]Client)
+	h.metadata, h.gop = nil, nil
+	clear(h.configs)
+	return nil
+}
@@ -0,0 +1,72 @@
+package stream
+
+import (
+	"fmt"
+	"time"
+)
+
+// PACKET_KIND 包的类型
+type PACKET_KIND uint8
+
+const (
+	// PacketVideo 视频
+	PacketVideo PACKET_KIND = 1
+
+	// PacketAudio 音频
+	PacketAudio PACKET_KIND = 2
+
+	// PacketMetadata 元数据（onMetaData 等），Payload 为 AMF0 编码
+	PacketMetadata PACKET_KIND = 3
+)
+
+func (k PACKET_KIND) String() string {
+	switch k {
+	case PacketVideo:
+		return "video"
+	case PacketAudio:
+		return "audio"
+	case PacketMetadata:
+		return "metadata"
+	}
+	return fmt.Sprintf("kind(%d)", uint8(k))
+}
+
+// 编码，沿用 ISO-BMFF 的 sample entry / FourCC 名字
+const (
+	CodecAVC  = "avc1" // H.264
+	CodecHEVC = "hvc1" // H.265
+	CodecAV1  = "av01"
+	CodecVP9  = "vp09"
+	CodecAAC  = "mp4a"
+	CodecMP3  = ".mp3"
+)
+
+// Packet 一帧音视频或者一条元数据，broker 和观众之间传递的最小单位，不带任何封装格式的帧头
+type Packet struct {
+	Kind     PACKET_KIND
+	Codec    string        // CodecAVC 等，元数据为空
+	DTS      time.Duration // 解码时间
+	PTS      time.Duration // 显示时间，音频和元数据等于 DTS
+	KeyFrame bool          // 视频关键帧，新观众从这里开始解码
+	Config   bool          // 解码配置（avcC / hvcC / av1C / AudioSpecificConfig），不属于任何 GOP
+
+	// Payload 编码数据：视频为长度前缀的 NALU（av01 为 OBU），音频为裸帧，Config 为解码配置记录。
+	// 可能被多个观众共享，只读
+	Payload []byte
+}
+
+// CompositionTime 显示时间和解码时间的差，有 B 帧时大于 0
+func (p Packet) CompositionTime() time.Duration {
+	return p.PTS - p.DTS
+}
+
+func (p Packet) String() string {
+	flags := ""
+	if p.KeyFrame {
+		flags += " key"
+	}
+	if p.Config {
+		flags += " config"
+	}
+	return fmt.Sprintf("%s %s dts=%v pts=%v %dB%s", p.Kind, p.Codec, p.DTS, p.PTS, len(p.Payload), flags)
+}
@@ -0,0 +1,56 @@
+package stream
+
+import (
+	"context"
+	"errors"
+)
+
+/*
+stream 新的 broker / 观众接口
+
+	和 broker.Broker / client.LiveClient 相比：
+		数据按 Packet 一帧一帧传递，带类型、时间戳、关键帧标志和编码，不再是没有分帧的 []byte；
+		生命周期明确：Start 启动，Close 结束，PullLoop 带 context 并返回 error；
+		不依赖 gin，推流这类 broker 从 io.Reader 读取，HTTP 请求由 adapter.PublishRequest 转换。
+	FLVStreamBroker 和 CameraBroker 同时实现了两套接口，可以直接放进广播器。
+	其他新 broker 通过 core/broker/adapter 转换：包装成 LegacyBroker 放进现有的广播器给 flv / ts / ws 观众使用，
+	旧观众也可以挂到新 broker 上。
+*/
+
+// ErrClosed broker 已经 Close
+var ErrClosed = errors.New("stream: broker 已经关闭")
+
+// Client 一个观众
+type Client interface {
+
+	// Write 写出一个包，返回 error 表示观众已经断开或者跟不上，broker 会把它移除。
+	// 在 broker 的分发 goroutine 里调用，不能阻塞
+	Write(p Packet) error
+}
+
+// Broker 一路直播
+type Broker interface {
+
+	// Start 启动拉流和状态监听等后台任务，不阻塞；ctx 结束等同于 Close
+	Start(ctx context.Context) error
+
+	// PullLoop 拉流主循环，阻塞到 ctx 结束、Close 或者上游出错；Start 会在后台调用它并负责重连
+	PullLoop(ctx context.Context) error
+
+	// WritePacket 把一个包分发给全部观众
+	WritePacket(p Packet) error
+
+	// AddClient 新增观众，新观众先收到解码配置和最近的 GOP
+	AddClient(id string, c Client) error
+
+	// RemoveClient 移除观众
+	RemoveClient(id string)
+
+	// Close 结束直播，断开上游和全部观众
+	Close() error
+}
+
+// SourceUpdater 支持原地切换上游地址的 broker
+type SourceUpdater interface {
+	UpdateSourceURL(url string)
+}
@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	packets []Packet
+	fail    error
+}
+
+func (r *recorder) Write(p Packet) error {
+	if r.fail != nil {
+		return r.fail
+	}
+	r.packets = append(r.packets, p)
+	return nil
+}
+
+func video(ms int, key bool) Packet {
+	ts := time.Duration(ms) * time.Millisecond
+	return Packet{Kind: PacketVideo, Codec: CodecAVC, DTS: ts, PTS: ts, KeyFrame: key, Payload: []byte{byte(ms)}}
+}
+
+func audio(ms int) Packet {
+	ts := time.Duration(ms) * time.Millisecond
+	return Packet{Kind: PacketAudio, Codec: CodecAAC, DTS: ts, PTS: ts, Payload: []byte{byte(ms)}}
+}
+
+func TestHubStartupCache(t *testing.T) {
+	h := NewHub()
+	h.WritePacket(Packet{Kind: PacketMetadata, Payload: []byte{2}})
+	h.WritePacket(Packet{Kind: PacketAudio, Codec: CodecAAC, Config: true, Payload: []byte{0x12, 0x10}})
+	h.WritePacket(Packet{Kind: PacketVideo, Codec: CodecAVC, Config: true, Payload: []byte{1}})
+	h.WritePacket(audio(0)) // 第一个关键帧之前的包不进 GOP
+	h.WritePacket(video(0, true))
+	h.WritePacket(audio(20))
+	h.WritePacket(video(40, false))
+	h.WritePacket(video(80, true))
+	h.WritePacket(video(120, false))
+
+	r := &recorder{}
+	if err := h.AddClient("a", r); err != nil {
+		t.Fatal(err)
+	}
+	// 元数据、视频配置、音频配置、从最近关键帧开始的 GOP
+	want := []struct {
+		kind   PACKET_KIND
+		config bool
+		dts    time.Duration
+	}{
+		{PacketMetadata, false, 0},
+		{PacketVideo, true, 0},
+		{PacketAudio, true, 0},
+		{PacketVideo, false, 80 * time.Millisecond},
+		{PacketVideo, false, 120 * time.Millisecond},
+	}
+	if len(r.packets) != len(want) {
+		t.Fatalf("起播包数 %d，期望 %d: %v", len(r.packets), len(want), r.packets)
+	}
+	for i, w := range want {
+		p := r.packets[i]
+		if p.Kind != w.kind || p.Config != w.config || p.DTS != w.dts {
+			t.Errorf("第 %d 个包 %v，期望 %v config=%v dts=%v", i, p, w.kind, w.config, w.dts)
+		}
+	}
+
+	h.WritePacket(audio(140))
+	if last := r.packets[len(r.packets)-1]; last.DTS != 140*time.Millisecond {
+		t.Errorf("没有收到实时数据: %v", last)
+	}
+}
+
+func TestHubRemovesFailedClient(t *testing.T) {
+	h := NewHub()
+	good, bad := &recorder{}, &recorder{}
+	h.AddClient("good", good)
+	h.AddClient("bad", bad)
+	bad.fail = errors.New("断开")
+
+	h.WritePacket(video(0, true))
+	if ids := h.ClientIDs(); len(ids) != 1 || ids[0] != "good" {
+		t.Fatalf("写入失败的观众没有被移除: %v", ids)
+	}
+	if len(good.packets) != 1 {
+		t.Errorf("正常观众收到 %d 个包", len(good.packets))
+	}
+
+	h.Close()
+	if err := h.WritePacket(video(40, false)); !errors.Is(err, ErrClosed) {
+		t.Errorf("Close 之后 WritePacket 返回 %v", err)
+	}
+	if err := h.AddClient("late", &recorder{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Close 之后 AddClient 返回 %v", err)
+	}
+}
@@ -0,0 +1,301 @@
+package synthetic
+
+import (
+	"fmt"
+	"net/url"
+	flvBroker "pull2push/core/broker/flv"
+	"strconv"
+	"time"
+)
+
+/*
+Generator 合成直播流，不需要任何真实上游
+
+	视频：H.264 Baseline 测试画面（彩条 + 时钟），帧率、GOP、分辨率、码率可配置
+	音频：AAC-LC 静音，可以关闭
+	故障注入：定时时间戳跳变（jump 为负数时是时间戳回退），定时断流见 SyntheticSource
+
+	同样的参数和起始时间生成的内容完全一样，HLS 分片可以按编号随时重新生成。
+*/
+
+// Options 合成流参数，可以从 synthetic:// 地址的 query 解析，例如
+//
+//	synthetic://test?width=320&height=240&fps=25&gop=50&bitrate=800&audio=none&stall_every=30s&stall_for=6s&jump_every=20s&jump=5000
+type Options struct {
+	Width       int    // 宽，向上取整到偶数
+	Height      int    // 高，向上取整到偶数
+	FPS         int    // 帧率
+	GOP         int    // 关键帧间隔（帧数）
+	BitrateKbps int    // 目标码率，画面本身不够时用 filler data 补齐，0 表示不补
+	Audio       string // silence / none
+	SampleRate  int    // 音频采样率
+	Channels    int    // 音频声道数（1 / 2）
+
+	StallEvery time.Duration // 每隔多久断流一次，0 表示不断流
+	StallFor   time.Duration // 每次断流多久
+	JumpEvery  time.Duration // 每隔多久（媒体时间）时间戳跳变一次，0 表示不跳变
+	JumpMs     int           // 每次跳变的毫秒数，负数为回退
+}
+
+const (
+	AudioSilence = "silence"
+	AudioNone    = "none"
+)
+
+// DefaultOptions 默认参数：320x240 25fps，2 秒一个 GOP，双声道 44.1kHz 静音
+func DefaultOptions() Options {
+	return Options{
+		Width:      320,
+		Height:     240,
+		FPS:        25,
+		GOP:        50,
+		Audio:      AudioSilence,
+		SampleRate: 44100,
+		Channels:   2,
+	}
+}
+
+// ParseOptions 解析 synthetic:// 地址，没有给出的参数使用默认值
+func ParseOptions(rawURL string) (Options, error) {
+	opts := DefaultOptions()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return opts, err
+	}
+	q := u.Query()
+
+	ints := map[string]*int{
+		"width":       &opts.Width,
+		"height":      &opts.Height,
+		"fps":         &opts.FPS,
+		"gop":         &opts.GOP,
+		"bitrate":     &opts.BitrateKbps,
+		"sample_rate": &opts.SampleRate,
+		"channels":    &opts.Channels,
+		"jump":        &opts.JumpMs,
+	}
+	for key, dst := range ints {
+		if v := q.Get(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return opts, fmt.Errorf("synthetic 参数 %s=%s 不是整数", key, v)
+			}
+			*dst = n
+		}
+	}
+	durations := map[string]*time.Duration{
+		"stall_every": &opts.StallEvery,
+		"stall_for":   &opts.StallFor,
+		"jump_every":  &opts.JumpEvery,
+	}
+	for key, dst := range durations {
+		if v := q.Get(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return opts, fmt.Errorf("synthetic 参数 %s=%s 不是时长", key, v)
+			}
+			*dst = d
+		}
+	}
+	if v := q.Get("audio"); v != "" {
+		opts.Audio = v
+	}
+	return opts, opts.normalize()
+}
+
+// normalize 检查参数，宽高向上取整到偶数（4:2:0 色度采样）
+func (o *Options) normalize() error {
+	if o.Width <= 0 || o.Height <= 0 || o.Width > 4096 || o.Height > 2304 {
+		return fmt.Errorf("synthetic 分辨率 %dx%d 无效", o.Width, o.Height)
+	}
+	o.Width = (o.Width + 1) / 2 * 2
+	o.Height = (o.Height + 1) / 2 * 2
+	if o.FPS <= 0 || o.FPS > 120 {
+		return fmt.Errorf("synthetic 帧率 %d 无效", o.FPS)
+	}
+	if o.GOP <= 0 {
+		o.GOP = o.FPS
+	}
+	switch o.Audio {
+	case AudioSilence:
+		if o.Channels != 1 && o.Channels != 2 {
+			return fmt.Errorf("synthetic 声道数 %d 无效，只支持 1 / 2", o.Channels)
+		}
+		if sampleRateIndex(o.SampleRate) < 0 {
+			return fmt.Errorf("synthetic 采样率 %d 无效", o.SampleRate)
+		}
+	case AudioNone:
+	default:
+		return fmt.Errorf("synthetic audio=%s 无效，只支持 silence / none", o.Audio)
+	}
+	return nil
+}
+
+// GOPDuration 一个 GOP 的时长
+func (o Options) GOPDuration() time.Duration {
+	return time.Duration(o.GOP) * time.Second / time.Duration(o.FPS)
+}
+
+func sampleRateIndex(rate int) int {
+	for i, r := range flvBroker.AACSampleRates {
+		if r == rate {
+			return i
+		}
+	}
+	return -1
+}
+
+// ====================== Generator ======================
+
+// Generator 按帧生成 FLV tag，不做任何等待，实时节奏由调用方控制
+type Generator struct {
+	opts  Options
+	start time.Time // 画面上时钟的起点，对应媒体时间 0
+
+	encoder *h264Encoder
+	picture *picture
+	asc     []byte
+	silence []byte
+
+	frame      int   // 下一个视频帧序号
+	audioFrame int   // 下一个音频帧序号
+	padDeficit int64 // 距离目标码率还差多少字节
+}
+
+// NewGenerator 从第 0 帧开始生成
+func NewGenerator(opts Options, start time.Time) (*Generator, error) {
+	return newGeneratorAt(opts, start, 0)
+}
+
+// newGeneratorAt 从第 firstFrame 帧开始生成，firstFrame 必须是 GOP 的起点
+func newGeneratorAt(opts Options, start time.Time, firstFrame int) (*Generator, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	encoder := newH264Encoder(opts.Width, opts.Height, opts.FPS)
+	g := &Generator{
+		opts:    opts,
+		start:   start,
+		encoder: encoder,
+		picture: newPicture(encoder.mbW*16, encoder.mbH*16),
+		frame:   firstFrame,
+	}
+	drawBackground(g.picture)
+	if opts.Audio == AudioSilence {
+		g.asc = flvBroker.AACAudioSpecificConfig(2, uint8(sampleRateIndex(opts.SampleRate)), uint8(opts.Channels))
+		g.silence = silentAACFrame(opts.Channels)
+		// 从上一帧之后的第一个音频帧开始，和前一个 GOP 生成的音频正好衔接
+		if firstFrame > 0 {
+			prevMs := g.mediaMillis(firstFrame - 1)
+			g.audioFrame = int(prevMs * int64(opts.SampleRate) / (aacSamplesPerFrame * 1000))
+			for g.audioFrame > 0 && g.audioMillis(g.audioFrame-1) > prevMs {
+				g.audioFrame--
+			}
+			for g.audioMillis(g.audioFrame) <= prevMs {
+				g.audioFrame++
+			}
+		}
+	}
+	return g, nil
+}
+
+// Options 生成参数
+func (g *Generator) Options() Options {
+	return g.opts
+}
+
+// Header FLV 头
+func (g *Generator) Header() []byte {
+	return flvBroker.BuildFLVHeader(g.opts.Audio != AudioNone, true)
+}
+
+// SequenceTags 序列头（视频 AVCDecoderConfigurationRecord、音频 AudioSpecificConfig），时间戳为当前位置
+func (g *Generator) SequenceTags() []*flvBroker.FlvTag {
+	ts := g.timestamp(g.mediaMillis(g.frame))
+	tags := []*flvBroker.FlvTag{
+		flvBroker.NewVideoSequenceTag(flvBroker.CodecH264, flvBroker.AVCDecoderConfig(g.encoder.sps, g.encoder.pps), ts),
+	}
+	if g.asc != nil {
+		tags = append(tags, flvBroker.NewAACSequenceTag(g.asc, ts))
+	}
+	return tags
+}
+
+// Next 生成下一个视频帧，以及时间戳不晚于它的音频帧，按时间戳先后排列
+func (g *Generator) Next() []*flvBroker.FlvTag {
+	frameMs := g.mediaMillis(g.frame)
+
+	var tags []*flvBroker.FlvTag
+	if g.asc != nil {
+		for {
+			audioMs := g.audioMillis(g.audioFrame)
+			if audioMs > frameMs {
+				break
+			}
+			tags = append(tags, flvBroker.NewAACFrameTag(g.silence, g.timestamp(audioMs)))
+			g.audioFrame++
+		}
+	}
+
+	keyFrame := g.frame%g.opts.GOP == 0
+	drawClock(g.picture, g.start.Add(time.Duration(frameMs)*time.Millisecond).Format("15:04:05.000"))
+	nalus := [][]byte{g.encoder.encode(g.picture, keyFrame)}
+	if keyFrame {
+		// 关键帧前带上参数集，直接拿 NALU 的播放器（TS 复用等）从任意关键帧都能解码
+		nalus = append([][]byte{g.encoder.sps, g.encoder.pps}, nalus...)
+	}
+	if pad := g.padding(nalus); pad > 0 {
+		nalus = append(nalus, fillerNAL(pad))
+	}
+	tags = append(tags, flvBroker.NewVideoFrameTag(flvBroker.CodecH264, nalus, keyFrame, g.timestamp(frameMs), 0))
+	g.frame++
+	return tags
+}
+
+// padding 按目标码率计算这一帧需要补多少字节
+func (g *Generator) padding(nalus [][]byte) int {
+	if g.opts.BitrateKbps <= 0 {
+		return 0
+	}
+	size := 0
+	for _, n := range nalus {
+		size += len(n) + 4
+	}
+	g.padDeficit += int64(g.opts.BitrateKbps)*1000/8/int64(g.opts.FPS) - int64(size)
+	if g.padDeficit <= 4+2 {
+		return 0
+	}
+	pad := int(g.padDeficit) - 4
+	g.padDeficit = 0
+	return pad
+}
+
+// FrameTime 第 frame 帧的媒体时间
+func (g *Generator) FrameTime(frame int) time.Duration {
+	return time.Duration(g.mediaMillis(frame)) * time.Millisecond
+}
+
+// Frame 下一个视频帧序号
+func (g *Generator) Frame() int {
+	return g.frame
+}
+
+func (g *Generator) mediaMillis(frame int) int64 {
+	return int64(frame) * 1000 / int64(g.opts.FPS)
+}
+
+func (g *Generator) audioMillis(audioFrame int) int64 {
+	return int64(audioFrame) * aacSamplesPerFrame * 1000 / int64(g.opts.SampleRate)
+}
+
+// timestamp 媒体时间加上注入的时间戳跳变
+func (g *Generator) timestamp(mediaMs int64) uint32 {
+	if g.opts.JumpEvery > 0 && g.opts.JumpMs != 0 {
+		jumps := mediaMs / g.opts.JumpEvery.Milliseconds()
+		mediaMs += jumps * int64(g.opts.JumpMs)
+		if mediaMs < 0 {
+			mediaMs = 0
+		}
+	}
+	return uint32(mediaMs)
+}
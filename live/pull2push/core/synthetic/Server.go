@@ -0,0 +1,140 @@
+package synthetic
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	tsBroker "pull2push/core/broker/ts"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ====================== Server ======================
+
+// hlsWindow 直播列表里保留的分片数
+const hlsWindow = 5
+
+/*
+Server 合成流的 HTTP 上游，可以直接挂到 httptest.NewServer 上做端到端测试，也可以单独部署演示
+
+	GET /live.flv      实时 HTTP-FLV，每个连接从第 0 帧开始（带故障注入）
+	GET /live.m3u8     HLS 直播列表，每个 GOP 一个分片
+	GET /seg/<n>.ts    HLS 分片，由 Generator 按编号重新生成后复用成 TS
+*/
+type Server struct {
+	opts     Options
+	hlsStart time.Time // HLS 时间轴的起点，往前推了一个窗口，启动后马上就有完整的分片
+}
+
+func NewServer(opts Options) (*Server, error) {
+	if err := opts.normalize(); err != nil {
+		return nil, err
+	}
+	return &Server{
+		opts:     opts,
+		hlsStart: time.Now().Add(-hlsWindow * opts.GOPDuration()),
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/live.flv":
+		s.serveFLV(w, r)
+	case r.URL.Path == "/live.m3u8":
+		s.servePlaylist(w)
+	case strings.HasPrefix(r.URL.Path, "/seg/") && strings.HasSuffix(r.URL.Path, ".ts"):
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/seg/"), ".ts"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveSegment(w, r, n)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveFLV(w http.ResponseWriter, r *http.Request) {
+	src, err := newSyntheticSource(r.Context(), s.opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer src.Close()
+
+	w.Header().Set("Content-Type", "video/x-flv")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	if _, err := w.Write(src.Header()); err != nil {
+		return
+	}
+	for {
+		tag, err := src.ReadTag()
+		if err != nil {
+			return
+		}
+		if _, err := w.Write(tag.ToBytes()); err != nil {
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// completeSegments 到现在为止已经完整生成的分片数
+func (s *Server) completeSegments() int {
+	return int(time.Since(s.hlsStart) / s.opts.GOPDuration())
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter) {
+	complete := s.completeSegments()
+	first := max(0, complete-hlsWindow)
+	segDur := s.opts.GOPDuration().Seconds()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(segDur)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first)
+	for n := first; n < complete; n++ {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg/%d.ts\n", segDur, n)
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(b.String()))
+}
+
+func (s *Server) serveSegment(w http.ResponseWriter, r *http.Request, n int) {
+	if n < 0 || n >= s.completeSegments() {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := s.segment(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(data)
+}
+
+// segment 生成第 n 个 GOP 的 TS 分片
+func (s *Server) segment(n int) ([]byte, error) {
+	gen, err := newGeneratorAt(s.opts, s.hlsStart, n*s.opts.GOP)
+	if err != nil {
+		return nil, err
+	}
+	muxer := tsBroker.NewTSMuxer()
+	var out []byte
+	for _, tag := range gen.SequenceTags() {
+		out = append(out, muxer.WriteTag(tag)...)
+	}
+	for i := 0; i < s.opts.GOP; i++ {
+		for _, tag := range gen.Next() {
+			out = append(out, muxer.WriteTag(tag)...)
+		}
+	}
+	return out, nil
+}
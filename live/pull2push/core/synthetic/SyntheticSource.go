@@ -0,0 +1,92 @@
+package synthetic
+
+import (
+	"context"
+	flvBroker "pull2push/core/broker/flv"
+	"time"
+)
+
+// ====================== SyntheticSource ======================
+
+// syntheticSource 按真实时间节奏输出合成流，可以作为任意 FLVStreamBroker 的上游
+type syntheticSource struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	gen     *Generator
+	pending []*flvBroker.FlvTag
+
+	base      time.Time // 媒体时间 0 对应的墙上时间，每次断流后整体后移
+	nextStall time.Time // 下一次断流的时间
+}
+
+// DialSynthetic 作为 SourceDialer 使用：synthetic://name?fps=25&gop=50...，参数见 Options
+func DialSynthetic(ctx context.Context, upstreamURL string) (flvBroker.TagSource, error) {
+	opts, err := ParseOptions(upstreamURL)
+	if err != nil {
+		return nil, err
+	}
+	return newSyntheticSource(ctx, opts)
+}
+
+func newSyntheticSource(ctx context.Context, opts Options) (*syntheticSource, error) {
+	now := time.Now()
+	gen, err := NewGenerator(opts, now)
+	if err != nil {
+		return nil, err
+	}
+	s := &syntheticSource{
+		gen:     gen,
+		pending: gen.SequenceTags(),
+		base:    now,
+	}
+	if opts.StallEvery > 0 {
+		s.nextStall = now.Add(opts.StallEvery)
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	return s, nil
+}
+
+func (s *syntheticSource) Header() []byte {
+	return s.gen.Header()
+}
+
+// ReadTag 下一帧的时间没到时等待，断流期间不输出任何数据，恢复后时间戳继续连续
+func (s *syntheticSource) ReadTag() (*flvBroker.FlvTag, error) {
+	for len(s.pending) == 0 {
+		due := s.base.Add(s.gen.FrameTime(s.gen.Frame()))
+		opts := s.gen.Options()
+		if opts.StallEvery > 0 && !due.Before(s.nextStall) {
+			s.base = s.base.Add(opts.StallFor)
+			due = due.Add(opts.StallFor)
+			s.nextStall = s.nextStall.Add(opts.StallEvery + opts.StallFor)
+		}
+		if err := s.sleepUntil(due); err != nil {
+			return nil, err
+		}
+		s.pending = s.gen.Next()
+	}
+	tag := s.pending[0]
+	s.pending = s.pending[1:]
+	return tag, nil
+}
+
+func (s *syntheticSource) sleepUntil(t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return s.ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (s *syntheticSource) Close() error {
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,50 @@
+package synthetic
+
+/*
+AAC-LC 静音帧
+
+	raw_data_block 里每个声道只写 ics_info，max_sfb = 0 表示没有任何频谱数据，解码结果就是静音：
+		单声道：SCE(id=0)；双声道：CPE(id=1, common_window=0) 里两个 individual_channel_stream
+	最后写 END(id=7) 并字节对齐。单声道结果为 01 40 20 07，和常见编码器输出的静音帧一致。
+*/
+
+const (
+	aacSamplesPerFrame = 1024
+	aacGlobalGain      = 160
+
+	aacElementSCE = 0
+	aacElementCPE = 1
+	aacElementEND = 7
+)
+
+// silentAACFrame 生成 1 或 2 声道的 AAC-LC 静音裸帧
+func silentAACFrame(channels int) []byte {
+	w := &bitWriter{}
+	if channels == 1 {
+		w.u(3, aacElementSCE)
+		w.u(4, 0) // element_instance_tag
+		writeSilentICS(w)
+	} else {
+		w.u(3, aacElementCPE)
+		w.u(4, 0)     // element_instance_tag
+		w.flag(false) // common_window
+		writeSilentICS(w)
+		writeSilentICS(w)
+	}
+	w.u(3, aacElementEND)
+	w.alignZero()
+	return w.buf
+}
+
+// writeSilentICS 没有频谱数据的 individual_channel_stream
+func writeSilentICS(w *bitWriter) {
+	w.u(8, aacGlobalGain)
+	w.flag(false) // ics_reserved_bit
+	w.u(2, 0)     // window_sequence：ONLY_LONG_SEQUENCE
+	w.flag(true)  // window_shape：KBD
+	w.u(6, 0)     // max_sfb
+	w.flag(false) // predictor_data_present
+	w.flag(false) // pulse_data_present
+	w.flag(false) // tns_data_present
+	w.flag(false) // gain_control_data_present
+}
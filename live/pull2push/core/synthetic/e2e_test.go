@@ -0,0 +1,225 @@
+package synthetic_test
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	flvBroadcast "pull2push/core/broadcast/flv"
+	hlsBroadcast "pull2push/core/broadcast/hls"
+	"pull2push/core/broker"
+	flvBroker "pull2push/core/broker/flv"
+	hlsBroker "pull2push/core/broker/hls"
+	tsBroker "pull2push/core/broker/ts"
+	flvClient "pull2push/core/client/flv"
+	hlsClient "pull2push/core/client/hls"
+	tsClient "pull2push/core/client/ts"
+	"pull2push/core/synthetic"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 端到端：synthetic 上游 -> broker -> 各协议客户端，全部在进程内完成，不依赖任何真实直播源
+
+func newUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	opts := synthetic.DefaultOptions()
+	opts.GOP = opts.FPS // 1 秒一个 GOP / HLS 分片，测试更快
+	s, err := synthetic.NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// waitFor 轮询直到 cond 成立
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func checkMediaInfo(t *testing.T, info *broker.MediaInfo) {
+	t.Helper()
+	if info.Video == nil || info.Video.Width != 320 || info.Video.Height != 240 || info.Video.FPS != 25 {
+		t.Fatalf("video info = %+v", info.Video)
+	}
+	if info.Audio == nil || info.Audio.Codec != "AAC" || info.Audio.SampleRate != 44100 || info.Audio.Channels != 2 {
+		t.Fatalf("audio info = %+v", info.Audio)
+	}
+}
+
+func TestFLVEndToEnd(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	upstream := newUpstream(t)
+
+	b := flvBroker.NewFLVStreamBroker("e2e", upstream.URL+"/live.flv")
+	b.Start(context.Background())
+	defer b.Close()
+	pool := flvBroadcast.NewFLVBroadcaster()
+	pool.AddBroker("e2e", b)
+
+	r := gin.New()
+	r.GET("/live/flv/:brokerKey/:clientId", flvClient.LiveFlv(pool))
+	r.GET("/live/ts/:brokerKey", tsClient.LiveTS(pool))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	waitFor(t, 5*time.Second, "broker media info", func() bool { return b.MediaInfo() != nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// HTTP-FLV 观众：起播头 + GOP 缓存，然后持续收到实时数据
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/live/flv/e2e/viewer1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	demuxer := flvBroker.NewFLVDemuxer()
+	var videoSeq, audioSeq, keyFrames, videoFrames int
+	var lastVideoTs uint32
+	buf := make([]byte, 32*1024)
+	for videoFrames < 40 {
+		n, err := resp.Body.Read(buf)
+		if err != nil {
+			t.Fatalf("read flv: %v (video frames %d)", err, videoFrames)
+		}
+		tags, err := demuxer.Feed(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tag := range tags {
+			switch {
+			case tag.IsSequenceHeader() && tag.TagType == flvBroker.TagTypeVideo:
+				videoSeq++
+			case tag.IsSequenceHeader():
+				audioSeq++
+			case tag.TagType == flvBroker.TagTypeVideo:
+				if videoFrames == 0 && !tag.IsKeyFrame() {
+					t.Fatal("first video frame is not a keyframe")
+				}
+				if videoFrames > 0 && tag.Timestamp <= lastVideoTs {
+					t.Fatalf("video timestamp %d after %d", tag.Timestamp, lastVideoTs)
+				}
+				if tag.IsKeyFrame() {
+					keyFrames++
+				}
+				lastVideoTs = tag.Timestamp
+				videoFrames++
+			}
+		}
+	}
+	if videoSeq != 1 || audioSeq != 1 || keyFrames < 1 {
+		t.Fatalf("videoSeq=%d audioSeq=%d keyFrames=%d", videoSeq, audioSeq, keyFrames)
+	}
+	checkMediaInfo(t, b.MediaInfo())
+
+	// HTTP-TS 观众：同一个 broker 复用成 TS
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/live/ts/e2e", nil)
+	tsResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tsResp.Body.Close()
+	packets := make([]byte, 188*50)
+	if _, err := io.ReadFull(tsResp.Body, packets); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(packets); i += 188 {
+		if packets[i] != 0x47 {
+			t.Fatalf("ts packet %d sync byte = %#x", i/188, packets[i])
+		}
+	}
+}
+
+func TestHLSEndToEnd(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	upstream := newUpstream(t)
+
+	b := hlsBroker.NewHLSM3U8Broker(context.Background(), "e2e-hls", upstream.URL+"/live.m3u8", "", 3)
+	defer b.Close()
+	pool := hlsBroadcast.NewBroadcaster()
+	pool.AddBroker("e2e-hls", b)
+
+	r := gin.New()
+	r.GET("/live/hls/:brokerKey/:clientId/*filepath", hlsClient.LiveHLS(pool))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(path string) []byte {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %s", path, resp.Status)
+		}
+		return body
+	}
+
+	// 第一次请求返回 master playlist，指向带会话编号的播放列表
+	var media string
+	for _, line := range strings.Split(string(get("/live/hls/e2e-hls/viewer1/index.m3u8")), "\n") {
+		if strings.HasSuffix(line, "/index.m3u8") {
+			media = line
+		}
+	}
+	if media == "" || strings.Contains(media, "/viewer1/") {
+		t.Fatalf("master playlist variant = %q", media)
+	}
+
+	var segment string
+	waitFor(t, 10*time.Second, "hls segments", func() bool {
+		for _, line := range strings.Split(string(get(media)), "\n") {
+			if strings.HasSuffix(line, ".ts") {
+				segment = line
+			}
+		}
+		return segment != ""
+	})
+
+	data := get(segment)
+	if len(data) == 0 || len(data)%188 != 0 || data[0] != 0x47 {
+		t.Fatalf("segment %s: %d bytes", segment, len(data))
+	}
+	tags, err := tsBroker.NewConverter().Feed(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFrames := 0
+	for _, tag := range tags {
+		if tag.IsKeyFrame() {
+			keyFrames++
+		}
+	}
+	if keyFrames != 1 {
+		t.Fatalf("segment keyframes = %d, want 1", keyFrames)
+	}
+
+	waitFor(t, 5*time.Second, "hls media info", func() bool { return b.MediaInfo() != nil && b.MediaInfo().Audio != nil })
+	checkMediaInfo(t, b.MediaInfo())
+}
+
+func TestTimestampJumpHealthEvent(t *testing.T) {
+	b := flvBroker.NewFLVStreamBrokerWithDialer("e2e-jump", "synthetic://jump?gop=25&jump_every=1s&jump=5000", synthetic.DialSynthetic)
+	b.Start(context.Background())
+	defer b.Close()
+
+	waitFor(t, 5*time.Second, "timestamp_jump event", func() bool {
+		return b.HealthReport().EventCounts["timestamp_jump"] > 0
+	})
+}
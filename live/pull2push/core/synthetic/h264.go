@@ -0,0 +1,356 @@
+package synthetic
+
+import (
+	"math/bits"
+)
+
+/*
+不依赖编码器的 H.264 Baseline 码流
+
+	所有宏块都用 I_PCM 编码（直接写像素），P 帧只重新编码和上一帧不同的宏块，其余宏块 P_Skip。
+	这样不需要 DCT / 运动估计也能生成任意画面，时钟每一帧都是准确的，解码器不会有任何误差。
+	码率由画面变化的宏块数决定，需要更高码率时在帧后面追加 filler data（NALU 12）。
+*/
+
+const (
+	nalSlice  = 1
+	nalIDR    = 5
+	nalSPS    = 7
+	nalPPS    = 8
+	nalFiller = 12
+
+	mbTypeIPCM      = 25 // I slice 里的 I_PCM
+	mbTypeIPCMInP   = 30 // P slice 里的 I_PCM（intra 类型偏移 5）
+	sliceTypeP      = 5  // 整帧都是 P slice
+	sliceTypeI      = 7  // 整帧都是 I slice
+	log2MaxFrameNum = 4
+)
+
+// ====================== bitWriter ======================
+
+// bitWriter 按位写 RBSP
+type bitWriter struct {
+	buf []byte
+	cur byte
+	n   uint8 // cur 里已经写了几位
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		w.cur = w.cur<<1 | byte(v>>uint(i)&1)
+		w.n++
+		if w.n == 8 {
+			w.buf = append(w.buf, w.cur)
+			w.cur, w.n = 0, 0
+		}
+	}
+}
+
+func (w *bitWriter) flag(b bool) {
+	if b {
+		w.u(1, 1)
+	} else {
+		w.u(1, 0)
+	}
+}
+
+// ue 无符号指数哥伦布
+func (w *bitWriter) ue(v uint32) {
+	x := v + 1
+	n := bits.Len32(x)
+	w.u(n-1, 0)
+	w.u(n, x)
+}
+
+// se 有符号指数哥伦布
+func (w *bitWriter) se(v int32) {
+	if v > 0 {
+		w.ue(uint32(2*v - 1))
+	} else {
+		w.ue(uint32(-2 * v))
+	}
+}
+
+func (w *bitWriter) alignZero() {
+	for w.n != 0 {
+		w.u(1, 0)
+	}
+}
+
+// writeBytes 按字节写入，调用前必须已经字节对齐
+func (w *bitWriter) writeBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// trailing rbsp_trailing_bits
+func (w *bitWriter) trailing() []byte {
+	w.u(1, 1)
+	w.alignZero()
+	return w.buf
+}
+
+// nalUnit 加上 NALU 头和防竞争字节
+func nalUnit(refIdc, nalType byte, rbsp []byte) []byte {
+	out := make([]byte, 0, len(rbsp)+len(rbsp)/64+1)
+	out = append(out, refIdc<<5|nalType)
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros >= 2 && b <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
+
+// fillerNAL 指定总长度的 filler data NALU
+func fillerNAL(size int) []byte {
+	if size < 2 {
+		size = 2
+	}
+	nalu := make([]byte, size)
+	nalu[0] = nalFiller
+	for i := 1; i < size-1; i++ {
+		nalu[i] = 0xFF
+	}
+	nalu[size-1] = 0x80
+	return nalu
+}
+
+// ====================== picture ======================
+
+// picture 4:2:0 8bit 画面，宽高都是 16 的整数倍
+type picture struct {
+	width, height int
+	y, cb, cr     []byte
+}
+
+func newPicture(width, height int) *picture {
+	return &picture{
+		width:  width,
+		height: height,
+		y:      make([]byte, width*height),
+		cb:     make([]byte, width*height/4),
+		cr:     make([]byte, width*height/4),
+	}
+}
+
+func (p *picture) clone() *picture {
+	c := &picture{width: p.width, height: p.height}
+	c.y = append([]byte(nil), p.y...)
+	c.cb = append([]byte(nil), p.cb...)
+	c.cr = append([]byte(nil), p.cr...)
+	return c
+}
+
+// sameMB 两个画面在宏块 (mbX, mbY) 上是否完全相同
+func (p *picture) sameMB(o *picture, mbX, mbY int) bool {
+	for row := 0; row < 16; row++ {
+		off := (mbY*16+row)*p.width + mbX*16
+		if string(p.y[off:off+16]) != string(o.y[off:off+16]) {
+			return false
+		}
+	}
+	cw := p.width / 2
+	for row := 0; row < 8; row++ {
+		off := (mbY*8+row)*cw + mbX*8
+		if string(p.cb[off:off+8]) != string(o.cb[off:off+8]) || string(p.cr[off:off+8]) != string(o.cr[off:off+8]) {
+			return false
+		}
+	}
+	return true
+}
+
+// writePCM 写宏块的 PCM 采样：256 个亮度，然后 64 个 Cb、64 个 Cr
+func (p *picture) writePCM(w *bitWriter, mbX, mbY int) {
+	for row := 0; row < 16; row++ {
+		off := (mbY*16+row)*p.width + mbX*16
+		w.writeBytes(p.y[off : off+16])
+	}
+	cw := p.width / 2
+	for _, plane := range [][]byte{p.cb, p.cr} {
+		for row := 0; row < 8; row++ {
+			off := (mbY*8+row)*cw + mbX*8
+			w.writeBytes(plane[off : off+8])
+		}
+	}
+}
+
+// ====================== h264Encoder ======================
+
+type h264Encoder struct {
+	width, height int // 显示尺寸，编码尺寸是宏块的整数倍，多出来的部分用 frame_cropping 裁掉
+	mbW, mbH      int
+	fps           int
+
+	sps, pps []byte
+	prev     *picture // 解码端当前的参考帧
+	frameNum uint32
+	idrId    uint32
+}
+
+func newH264Encoder(width, height, fps int) *h264Encoder {
+	e := &h264Encoder{
+		width:  width,
+		height: height,
+		mbW:    (width + 15) / 16,
+		mbH:    (height + 15) / 16,
+		fps:    fps,
+	}
+	e.sps = e.buildSPS()
+	e.pps = e.buildPPS()
+	return e
+}
+
+// level 按每秒宏块数选择，I_PCM 码率很高，按 Level 表里的宏块处理能力选就够了
+func (e *h264Encoder) level() uint32 {
+	mbps := e.mbW * e.mbH * e.fps
+	switch {
+	case mbps <= 40500:
+		return 30
+	case mbps <= 108000:
+		return 31
+	case mbps <= 245760:
+		return 40
+	}
+	return 51
+}
+
+func (e *h264Encoder) buildSPS() []byte {
+	w := &bitWriter{}
+	w.u(8, 66)   // profile_idc：Baseline
+	w.u(8, 0xC0) // constraint_set0/1：Constrained Baseline
+	w.u(8, e.level())
+	w.ue(0)                   // seq_parameter_set_id
+	w.ue(log2MaxFrameNum - 4) // log2_max_frame_num_minus4
+	w.ue(2)                   // pic_order_cnt_type：POC 由 frame_num 推导，没有 B 帧
+	w.ue(1)                   // max_num_ref_frames
+	w.flag(false)             // gaps_in_frame_num_value_allowed_flag
+	w.ue(uint32(e.mbW - 1))   // pic_width_in_mbs_minus1
+	w.ue(uint32(e.mbH - 1))   // pic_height_in_map_units_minus1
+	w.flag(true)              // frame_mbs_only_flag
+	w.flag(true)              // direct_8x8_inference_flag
+	cropRight, cropBottom := uint32(e.mbW*16-e.width)/2, uint32(e.mbH*16-e.height)/2
+	if cropRight > 0 || cropBottom > 0 {
+		w.flag(true) // frame_cropping_flag，4:2:0 下单位是 2 像素
+		w.ue(0)
+		w.ue(cropRight)
+		w.ue(0)
+		w.ue(cropBottom)
+	} else {
+		w.flag(false) // frame_cropping_flag
+	}
+	w.flag(true) // vui_parameters_present_flag
+
+	// VUI：只写帧率和 bitstream_restriction（没有重排序，解码器可以零延迟输出）
+	w.flag(false) // aspect_ratio_info_present_flag
+	w.flag(false) // overscan_info_present_flag
+	w.flag(false) // video_signal_type_present_flag
+	w.flag(false) // chroma_loc_info_present_flag
+	w.flag(true)  // timing_info_present_flag
+	w.u(32, 1)    // num_units_in_tick
+	w.u(32, uint32(2*e.fps))
+	w.flag(true)  // fixed_frame_rate_flag
+	w.flag(false) // nal_hrd_parameters_present_flag
+	w.flag(false) // vcl_hrd_parameters_present_flag
+	w.flag(false) // pic_struct_present_flag
+	w.flag(true)  // bitstream_restriction_flag
+	w.flag(true)  // motion_vectors_over_pic_boundaries_flag
+	w.ue(0)       // max_bytes_per_pic_denom
+	w.ue(0)       // max_bits_per_mb_denom
+	w.ue(16)      // log2_max_mv_length_horizontal
+	w.ue(16)      // log2_max_mv_length_vertical
+	w.ue(0)       // max_num_reorder_frames
+	w.ue(1)       // max_dec_frame_buffering
+	return nalUnit(3, nalSPS, w.trailing())
+}
+
+func (e *h264Encoder) buildPPS() []byte {
+	w := &bitWriter{}
+	w.ue(0)       // pic_parameter_set_id
+	w.ue(0)       // seq_parameter_set_id
+	w.flag(false) // entropy_coding_mode_flag：CAVLC
+	w.flag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.ue(0)       // num_slice_groups_minus1
+	w.ue(0)       // num_ref_idx_l0_default_active_minus1
+	w.ue(0)       // num_ref_idx_l1_default_active_minus1
+	w.flag(false) // weighted_pred_flag
+	w.u(2, 0)     // weighted_bipred_idc
+	w.se(0)       // pic_init_qp_minus26
+	w.se(0)       // pic_init_qs_minus26
+	w.se(0)       // chroma_qp_index_offset
+	w.flag(true)  // deblocking_filter_control_present_flag
+	w.flag(false) // constrained_intra_pred_flag
+	w.flag(false) // redundant_pic_cnt_present_flag
+	return nalUnit(3, nalPPS, w.trailing())
+}
+
+// encode 编码一帧，idr 为 true 时整帧 I_PCM，否则只编码变化的宏块；返回 slice NALU
+func (e *h264Encoder) encode(pic *picture, idr bool) []byte {
+	if e.prev == nil {
+		idr = true
+	}
+	w := &bitWriter{}
+	w.ue(0) // first_mb_in_slice
+	if idr {
+		e.frameNum = 0
+		w.ue(sliceTypeI)
+	} else {
+		e.frameNum = (e.frameNum + 1) % (1 << log2MaxFrameNum)
+		w.ue(sliceTypeP)
+	}
+	w.ue(0) // pic_parameter_set_id
+	w.u(log2MaxFrameNum, e.frameNum)
+	if idr {
+		w.ue(e.idrId) // idr_pic_id，相邻 IDR 不能相同
+		e.idrId = (e.idrId + 1) % 2
+		w.flag(false) // no_output_of_prior_pics_flag
+		w.flag(false) // long_term_reference_flag
+	} else {
+		w.flag(false) // num_ref_idx_active_override_flag
+		w.flag(false) // ref_pic_list_modification_flag_l0
+		w.flag(false) // adaptive_ref_pic_marking_mode_flag
+	}
+	w.se(0) // slice_qp_delta
+	w.ue(1) // disable_deblocking_filter_idc：关闭去块滤波，P_Skip 的宏块和参考帧完全一致
+
+	if idr {
+		for mbY := 0; mbY < e.mbH; mbY++ {
+			for mbX := 0; mbX < e.mbW; mbX++ {
+				w.ue(mbTypeIPCM)
+				w.alignZero() // pcm_alignment_zero_bit
+				pic.writePCM(w, mbX, mbY)
+			}
+		}
+	} else {
+		skipRun := uint32(0)
+		for mbY := 0; mbY < e.mbH; mbY++ {
+			for mbX := 0; mbX < e.mbW; mbX++ {
+				if pic.sameMB(e.prev, mbX, mbY) {
+					skipRun++
+					continue
+				}
+				w.ue(skipRun) // mb_skip_run
+				skipRun = 0
+				w.ue(mbTypeIPCMInP)
+				w.alignZero()
+				pic.writePCM(w, mbX, mbY)
+			}
+		}
+		if skipRun > 0 {
+			w.ue(skipRun)
+		}
+	}
+
+	e.prev = pic.clone()
+	if idr {
+		return nalUnit(3, nalIDR, w.trailing())
+	}
+	return nalUnit(2, nalSlice, w.trailing())
+}
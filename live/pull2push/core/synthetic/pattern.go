@@ -0,0 +1,101 @@
+package synthetic
+
+/*
+测试画面：75% 彩条 + 底部灰阶，左上角黑底白字的时钟（HH:MM:SS.mmm）
+
+	时钟放在单独的宏块里，每一帧只有数字变化的几个宏块需要重新编码。
+*/
+
+// 75% 彩条的 YCbCr（BT.601）：白、黄、青、绿、品红、红、蓝
+var colorBars = [][3]byte{
+	{180, 128, 128},
+	{162, 44, 142},
+	{131, 156, 44},
+	{112, 72, 58},
+	{84, 184, 198},
+	{65, 100, 212},
+	{35, 212, 114},
+}
+
+// 5x7 点阵字体，每行低 5 位有效
+var glyphs = map[byte][7]byte{
+	'0': {0x0E, 0x11, 0x13, 0x15, 0x19, 0x11, 0x0E},
+	'1': {0x04, 0x0C, 0x04, 0x04, 0x04, 0x04, 0x0E},
+	'2': {0x0E, 0x11, 0x01, 0x02, 0x04, 0x08, 0x1F},
+	'3': {0x1F, 0x02, 0x04, 0x02, 0x01, 0x11, 0x0E},
+	'4': {0x02, 0x06, 0x0A, 0x12, 0x1F, 0x02, 0x02},
+	'5': {0x1F, 0x10, 0x1E, 0x01, 0x01, 0x11, 0x0E},
+	'6': {0x06, 0x08, 0x10, 0x1E, 0x11, 0x11, 0x0E},
+	'7': {0x1F, 0x01, 0x02, 0x04, 0x08, 0x08, 0x08},
+	'8': {0x0E, 0x11, 0x11, 0x0E, 0x11, 0x11, 0x0E},
+	'9': {0x0E, 0x11, 0x11, 0x0F, 0x01, 0x02, 0x0C},
+	':': {0x00, 0x0C, 0x0C, 0x00, 0x0C, 0x0C, 0x00},
+	'.': {0x00, 0x00, 0x00, 0x00, 0x00, 0x0C, 0x0C},
+}
+
+const (
+	glyphScale   = 2
+	glyphAdvance = 6 * glyphScale // 5 列字形 + 1 列间距
+	clockX       = 8
+	clockY       = 9
+	clockBoxH    = 32 // 两行宏块
+	clockBoxW    = 160
+	lumaBlack    = 16
+	lumaWhite    = 235
+)
+
+// drawBackground 画彩条和灰阶，只需要画一次
+func drawBackground(p *picture) {
+	barsH := p.height * 3 / 4
+	for y := 0; y < p.height; y++ {
+		for x := 0; x < p.width; x++ {
+			var c [3]byte
+			if y < barsH {
+				c = colorBars[x*len(colorBars)/p.width]
+			} else {
+				c = [3]byte{byte(lumaBlack + (lumaWhite-lumaBlack)*x/p.width), 128, 128}
+			}
+			p.y[y*p.width+x] = c[0]
+			if x%2 == 0 && y%2 == 0 {
+				p.cb[(y/2)*(p.width/2)+x/2] = c[1]
+				p.cr[(y/2)*(p.width/2)+x/2] = c[2]
+			}
+		}
+	}
+}
+
+// drawClock 在左上角画时钟，超出画面的部分裁掉
+func drawClock(p *picture, text string) {
+	boxW, boxH := min(clockBoxW, p.width), min(clockBoxH, p.height)
+	for y := 0; y < boxH; y++ {
+		for x := 0; x < boxW; x++ {
+			p.y[y*p.width+x] = lumaBlack
+			if x%2 == 0 && y%2 == 0 {
+				p.cb[(y/2)*(p.width/2)+x/2] = 128
+				p.cr[(y/2)*(p.width/2)+x/2] = 128
+			}
+		}
+	}
+	for i := 0; i < len(text); i++ {
+		glyph, ok := glyphs[text[i]]
+		if !ok {
+			continue
+		}
+		for row := 0; row < 7; row++ {
+			for col := 0; col < 5; col++ {
+				if glyph[row]>>(4-col)&1 == 0 {
+					continue
+				}
+				for dy := 0; dy < glyphScale; dy++ {
+					for dx := 0; dx < glyphScale; dx++ {
+						x := clockX + i*glyphAdvance + col*glyphScale + dx
+						y := clockY + row*glyphScale + dy
+						if x < boxW && y < boxH {
+							p.y[y*p.width+x] = lumaWhite
+						}
+					}
+				}
+			}
+		}
+	}
+}
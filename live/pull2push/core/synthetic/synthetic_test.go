@@ -0,0 +1,259 @@
+package synthetic
+
+import (
+	"bytes"
+	"context"
+	flvBroker "pull2push/core/broker/flv"
+	"testing"
+	"time"
+)
+
+// testBits 测试里用来反解 slice 的位读取器
+type testBits struct {
+	b   []byte
+	pos int
+}
+
+func (r *testBits) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | uint32(r.b[r.pos/8]>>(7-uint(r.pos%8))&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *testBits) ue() uint32 {
+	zeros := 0
+	for r.u(1) == 0 {
+		zeros++
+	}
+	return 1<<uint(zeros) - 1 + r.u(zeros)
+}
+
+func (r *testBits) align() {
+	for r.pos%8 != 0 {
+		r.pos++
+	}
+}
+
+func (r *testBits) readPCM(p *picture, mbX, mbY int) {
+	r.align()
+	for row := 0; row < 16; row++ {
+		off := (mbY*16+row)*p.width + mbX*16
+		copy(p.y[off:off+16], r.b[r.pos/8:])
+		r.pos += 16 * 8
+	}
+	cw := p.width / 2
+	for _, plane := range [][]byte{p.cb, p.cr} {
+		for row := 0; row < 8; row++ {
+			off := (mbY*8+row)*cw + mbX*8
+			copy(plane[off:off+8], r.b[r.pos/8:])
+			r.pos += 8 * 8
+		}
+	}
+}
+
+// decodeSlice 按 I_PCM / P_Skip 重建画面，ref 为上一帧
+func decodeSlice(t *testing.T, nalu []byte, ref *picture, width, height int) *picture {
+	t.Helper()
+	r := &testBits{b: flvBroker.RemoveEmulationPrevention(nalu[1:])}
+	idr := nalu[0]&0x1F == nalIDR
+
+	if r.ue() != 0 {
+		t.Fatal("first_mb_in_slice != 0")
+	}
+	sliceType := r.ue()
+	r.ue()               // pic_parameter_set_id
+	r.u(log2MaxFrameNum) // frame_num
+	if idr {
+		r.ue()
+		r.u(2)
+	} else {
+		r.u(3)
+	}
+	r.ue() // slice_qp_delta
+	if r.ue() != 1 {
+		t.Fatal("deblocking filter should be disabled")
+	}
+
+	var pic *picture
+	if ref != nil {
+		pic = ref.clone()
+	} else {
+		pic = newPicture(width, height)
+	}
+	mbW, total := width/16, width/16*height/16
+	if sliceType == sliceTypeI {
+		for mb := 0; mb < total; mb++ {
+			if mbType := r.ue(); mbType != mbTypeIPCM {
+				t.Fatalf("I slice mb_type = %d", mbType)
+			}
+			r.readPCM(pic, mb%mbW, mb/mbW)
+		}
+	} else {
+		for mb := 0; mb < total; {
+			mb += int(r.ue())
+			if mb >= total {
+				break
+			}
+			if mbType := r.ue(); mbType != mbTypeIPCMInP {
+				t.Fatalf("P slice mb_type = %d", mbType)
+			}
+			r.readPCM(pic, mb%mbW, mb/mbW)
+			mb++
+		}
+	}
+	// rbsp_slice_trailing_bits
+	if r.u(1) != 1 {
+		t.Fatal("missing rbsp_stop_one_bit")
+	}
+	if r.pos+7 < len(r.b)*8 && r.pos/8 != len(r.b)-1 {
+		t.Fatalf("trailing data: pos %d of %d bits", r.pos, len(r.b)*8)
+	}
+	return pic
+}
+
+func TestSilentAACFrame(t *testing.T) {
+	if got := silentAACFrame(1); !bytes.Equal(got, []byte{0x01, 0x40, 0x20, 0x07}) {
+		t.Fatalf("mono silence = % x", got)
+	}
+	if got := silentAACFrame(2); got[0]>>5 != aacElementCPE {
+		t.Fatalf("stereo silence = % x", got)
+	}
+}
+
+func TestGeneratorSPS(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Width, opts.Height, opts.FPS = 199, 120, 30
+	gen, err := NewGenerator(opts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := flvBroker.ParseH264SPS(gen.encoder.sps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 200 || info.Height != 120 || info.FrameRate != 30 || info.ProfileIdc != 66 {
+		t.Fatalf("sps = %+v", info)
+	}
+}
+
+func TestGeneratorDecode(t *testing.T) {
+	opts := DefaultOptions()
+	opts.GOP = 10
+	gen, err := NewGenerator(opts, time.Date(2024, 1, 1, 12, 0, 59, 900e6, time.Local))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ref *picture
+	var lastTs uint32
+	audio := 0
+	for i := 0; i < 25; i++ {
+		for _, tag := range gen.Next() {
+			if tag.Timestamp < lastTs {
+				t.Fatalf("timestamp regression %d -> %d", lastTs, tag.Timestamp)
+			}
+			lastTs = tag.Timestamp
+			if tag.TagType == flvBroker.TagTypeAudio {
+				audio++
+				continue
+			}
+			if tag.IsKeyFrame() != (i%opts.GOP == 0) {
+				t.Fatalf("frame %d keyframe = %v", i, tag.IsKeyFrame())
+			}
+			nalus, err := flvBroker.SplitAVCC(tag.Data[5:], 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			slice := nalus[0]
+			if tag.IsKeyFrame() {
+				slice = nalus[2] // SPS, PPS, IDR
+			}
+			ref = decodeSlice(t, slice, ref, opts.Width, opts.Height)
+			if !bytes.Equal(ref.y, gen.picture.y) || !bytes.Equal(ref.cb, gen.picture.cb) || !bytes.Equal(ref.cr, gen.picture.cr) {
+				t.Fatalf("frame %d decoded picture differs", i)
+			}
+		}
+	}
+	// 1 秒 44.1kHz，每帧 1024 个采样
+	if audio < 40 || audio > 45 {
+		t.Fatalf("audio frames = %d", audio)
+	}
+}
+
+func TestGeneratorBitrate(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BitrateKbps = 2000
+	gen, err := NewGenerator(opts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := 0
+	for i := 0; i < opts.FPS*4; i++ {
+		for _, tag := range gen.Next() {
+			if tag.TagType == flvBroker.TagTypeVideo {
+				size += len(tag.Data)
+			}
+		}
+	}
+	kbps := size * 8 / 4 / 1000
+	if kbps < 1900 || kbps > 2100 {
+		t.Fatalf("bitrate = %d kbps", kbps)
+	}
+}
+
+func TestTimestampJump(t *testing.T) {
+	opts, err := ParseOptions("synthetic://test?fps=10&audio=none&jump_every=1s&jump=-500")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen, err := NewGenerator(opts, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prev uint32
+	regressions := 0
+	for i := 0; i < 25; i++ {
+		tag := gen.Next()[0]
+		if i > 0 && tag.Timestamp < prev {
+			regressions++
+		}
+		prev = tag.Timestamp
+	}
+	if regressions != 2 {
+		t.Fatalf("regressions = %d, want 2", regressions)
+	}
+}
+
+func TestSourceStall(t *testing.T) {
+	src, err := DialSynthetic(context.Background(), "synthetic://stall?fps=25&audio=none&stall_every=400ms&stall_for=600ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	var maxGap time.Duration
+	var prevTs uint32
+	last := time.Now()
+	for start := time.Now(); time.Since(start) < 1200*time.Millisecond; {
+		tag, err := src.ReadTag()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gap := time.Since(last); gap > maxGap {
+			maxGap = gap
+		}
+		last = time.Now()
+		if tag.TagType == flvBroker.TagTypeVideo && !tag.IsSequenceHeader() {
+			if prevTs != 0 && tag.Timestamp-prevTs != 40 {
+				t.Fatalf("timestamp %d after %d, should stay continuous across stalls", tag.Timestamp, prevTs)
+			}
+			prevTs = tag.Timestamp
+		}
+	}
+	if maxGap < 550*time.Millisecond {
+		t.Fatalf("max gap between tags = %v, want a stall", maxGap)
+	}
+}
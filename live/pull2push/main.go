@@ -2,19 +2,37 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"log"
+	"net/http"
+	"pull2push/config"
 	cameraBroadcast "pull2push/core/broadcast/camera"
 	flvBroadcast "pull2push/core/broadcast/flv"
 	hlsBroadcast "pull2push/core/broadcast/hls"
-	cameraBroker "pull2push/core/broker/camera"
 	flvBroker "pull2push/core/broker/flv"
-	hlsBroker "pull2push/core/broker/hls"
+	tsBroker "pull2push/core/broker/ts"
+	adminClient "pull2push/core/client/admin"
 	cameraClient "pull2push/core/client/camera"
+	clipClient "pull2push/core/client/clip"
 	flvClient "pull2push/core/client/flv"
 	hlsClient "pull2push/core/client/hls"
+	infoClient "pull2push/core/client/info"
+	pushClient "pull2push/core/client/push"
+	tsClient "pull2push/core/client/ts"
+	wsClient "pull2push/core/client/ws"
+	"pull2push/core/cluster"
+	"pull2push/core/manager"
+	"pull2push/core/memory"
+	"pull2push/core/playlist"
+	"pull2push/core/rtmp"
+	"pull2push/core/rtsp"
+	"pull2push/core/session"
+	"pull2push/core/synthetic"
 	"pull2push/middleware"
+	"reflect"
 	"time"
 )
 
@@ -37,9 +55,22 @@ var (
 	flvBroadcastPool    *flvBroadcast.FLVBroadcaster
 	hlsBroadcastPool    *hlsBroadcast.HLSBroadcaster
 	cameraBroadcastPool *cameraBroadcast.CameraBroadcaster
+	pushManager         *pushClient.PushManager
+	clipManager         *clipClient.ClipManager
+	streamManager       *manager.StreamManager
 )
 
 func main() {
+	configPath := flag.String("config", "config/config.yaml", "配置文件路径")
+	flag.Parse()
+
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	store := config.NewStore(cfg)
+	memory.Default.SetLimit(int64(cfg.Memory.Limit))
+	session.Default.SetLimits(sessionLimits(cfg.Limits))
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.Default()
@@ -47,12 +78,12 @@ func main() {
 
 	// 添加 CORS 中间件
 	r.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "android-device-id", "Content-Type", "Accept", "Authorization", "X-Token", "request-time", "X-Requested-With"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
+		AllowOrigins:     cfg.HTTP.CORS.AllowOrigins,
+		AllowMethods:     cfg.HTTP.CORS.AllowMethods,
+		AllowHeaders:     cfg.HTTP.CORS.AllowHeaders,
+		ExposeHeaders:    cfg.HTTP.CORS.ExposeHeaders,
+		AllowCredentials: cfg.HTTP.CORS.AllowCredentials,
+		MaxAge:           cfg.HTTP.CORS.MaxAge,
 	}))
 
 	// health
@@ -61,51 +92,159 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// ============== flv ==============
-	flvBrokerKey := "test1"
-	flvUpstreamURL := "http://192.168.203.182:8080/live/livestream.flv"
-
-	flvBroadcastPool = flvBroadcast.NewFLVBroadcaster()
-	var flvStreamBroker *flvBroker.FLVStreamBroker = flvBroker.NewFLVStreamBroker(flvBrokerKey, flvUpstreamURL)
-	flvBroadcastPool.AddBroker(flvBrokerKey, flvStreamBroker)
+	// ============== cluster ==============, origin-edge 模式：每个 brokerKey 按一致性哈希选出 origin，只有 origin 拉真正的上游，
+	// 其他节点从 origin 的 /live/flv 输出拉流，origin 不可用时按哈希环顺序切到下一个节点。nodes 和 registry 都为空时单机运行
+	var flvCluster *cluster.Cluster
+	if cfg.Cluster.Registry != "" {
+		flvCluster, err = cluster.NewCluster(cfg.Cluster.Self, &cluster.HTTPRegistry{URL: cfg.Cluster.Registry}, cfg.Cluster.Refresh)
+	} else if len(cfg.Cluster.Nodes) > 0 {
+		flvCluster, err = cluster.NewCluster(cfg.Cluster.Self, cluster.StaticRegistry(cfg.Cluster.Nodes), 0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if flvCluster != nil {
+		flvCluster.Token = cfg.Cluster.Token
+	}
 
-	// http://localhost:8080/live/flv
-	r.GET("/live/flv/:brokerKey/:clientId", flvClient.LiveFlv(flvBroadcastPool))
+	// 上游按 scheme 选择数据源：http(s):// 为 HTTP-FLV，rtmp:// 为 RTMP 拉流，udp:// 为 MPEG-TS，rtsp:// 为 IP 摄像头，synthetic:// 为本地合成的测试流，file:// 为本地文件
+	flvBroker.RegisterSourceDialer("rtmp", rtmp.DialRTMP)
+	flvBroker.RegisterSourceDialer("udp", tsBroker.DialTS)
+	flvBroker.RegisterSourceDialer("rtsp", rtsp.DialRTSP)
+	flvBroker.RegisterSourceDialer("synthetic", synthetic.DialSynthetic)
+	flvBroker.RegisterSourceDialer("file", playlist.DialFile)
 
-	// ============== hls ==============
+	// flv / ts / rtsp 共用 flv 的 broadcaster
+	flvBroadcastPool = flvBroadcast.NewFLVBroadcaster()
+	hlsBroadcastPool = hlsBroadcast.NewBroadcaster()
+	cameraBroadcastPool = cameraBroadcast.NewCameraBroadcaster()
+	pushManager = pushClient.NewPushManager(flvBroadcastPool, hlsBroadcastPool, cameraBroadcastPool)
+	clipManager = clipClient.NewClipManager(cfg.Clips.Dir, cfg.Clips.Retention, cfg.Clips.MaxDuration, flvBroadcastPool, hlsBroadcastPool, cameraBroadcastPool)
+
+	// ============== streams ==============, 按配置文件创建 broker，配置热更新时增删改
+	streamManager = manager.NewStreamManager(ctx, flvBroadcastPool, hlsBroadcastPool, cameraBroadcastPool, pushManager, flvCluster)
+	streamManager.Apply(cfg)
+
+	go config.Watch(ctx, *configPath, 2*time.Second, func(newCfg *config.Config) {
+		oldCfg := store.Swap(newCfg)
+		if !reflect.DeepEqual(oldCfg.HTTP, newCfg.HTTP) || !reflect.DeepEqual(oldCfg.Cluster, newCfg.Cluster) || oldCfg.Clips != newCfg.Clips {
+			log.Println("[config] http / cluster / clips 的修改需要重启后生效")
+		}
+		memory.Default.SetLimit(int64(newCfg.Memory.Limit))
+		session.Default.SetLimits(sessionLimits(newCfg.Limits))
+		streamManager.Apply(newCfg)
+	})
+
+	// 回收空闲的 hls 观看会话、采样出口带宽；集群模式下超出本节点的观众限制时重定向到其他节点
+	go session.Default.Run(ctx, 5*time.Second)
+	if flvCluster != nil {
+		session.Default.SetRedirector(flvCluster.Overflow)
+	}
+	// 删除超过保留时间的导出片段
+	go clipManager.Run(ctx, time.Minute)
 
-	hlsBrokerKey := "test-hls"
-	hlsUpstreamURL := "http://192.168.203.182:8080/live/livestream.m3u8"
+	auth := middleware.AuthMiddleware(store)
+	// 停止直播、踢人、切换上游只认管理 token
+	admin := middleware.AdminMiddleware(store)
+	playHook := middleware.PlayHookMiddleware(store)
+	// 内存预算用完时拒绝新的长连接观众
+	budget := middleware.MemoryBudgetMiddleware()
 
-	hlsBroadcastPool = hlsBroadcast.NewBroadcaster()
-	var hlsM3U8Broker *hlsBroker.HLSM3U8Broker = hlsBroker.NewHLSM3U8Broker(ctx, hlsBrokerKey, hlsUpstreamURL, "", 3)
-	hlsBroadcastPool.AddBroker(hlsBrokerKey, hlsM3U8Broker)
+	// http://localhost:8080/live/flv
+	r.GET("/live/flv/:brokerKey/:clientId", auth, playHook, budget, flvClient.LiveFlv(flvBroadcastPool))
 
 	// hls要提供两个接口，一个是 index.m3u8用于客户端第一次调用的时候获取最新数据分片消息的，有助于第二个接口来获取最新的分片数据
 	// 一个是 类似 2689.ts 的接口，用于给客户端请求具体的流数据
 	// http://localhost:8080/live/hls/:brokerKey/:clientId/index.m3u8
 	// http://localhost:8080/live/hls/:brokerKey/:clientId/2689.ts
-	r.GET("/live/hls/:brokerKey/:clientId/*filepath", hlsClient.LiveHLS(hlsBroadcastPool))
+	r.GET("/live/hls/:brokerKey/:clientId/*filepath", auth, hlsClient.LiveHLS(hlsBroadcastPool))
 
 	// ============== camera ==============,  先启动go服务器，再打开前端页面，最后使用ffmpeng推流
-	cameraBroadcastPool = cameraBroadcast.NewCameraBroadcaster()
-	brokerKey := "test-camera"
-	var cameraM3U8Broker *cameraBroker.CameraBroker = cameraBroker.NewCameraBroker(brokerKey, 150)
-
-	cameraBroadcastPool.AddBroker(brokerKey, cameraM3U8Broker)
 
 	// ffmpeg -f avfoundation -framerate 30 -video_size 640x480 -i "0:0" -vcodec libx264 -preset veryfast -tune zerolatency -g 30 -acodec aac -ar 44100 -ac 2 -f flv "http://127.0.0.1:8080/live/camera/ingest/test-camera"
 	// http://127.0.0.1:8080/live/camera/ingest/test-camera
 	// camera ffmpeg 推流接口
-	r.POST("/live/camera/ingest/:brokerKey", cameraClient.ExecutePush(cameraBroadcastPool))
+	r.POST("/live/camera/ingest/:brokerKey", auth, middleware.PublishHookMiddleware(store), cameraClient.ExecutePush(cameraBroadcastPool))
 
 	// http://127.0.0.1:8080/live/camera/test.flv
 	// camera HTTP-FLV 拉流接口
 	//r.GET("/live/:stream.flv", func(c *gin.Context) {
-	r.GET("/live/camera/:brokerKey/:clientId", cameraClient.ExecutePull(cameraBroadcastPool))
+	r.GET("/live/camera/:brokerKey/:clientId", auth, playHook, budget, cameraClient.ExecutePull(cameraBroadcastPool))
+
+	// http://127.0.0.1:8080/live/ts/test-ts
+	// HTTP-TS 拉流接口（机顶盒），flv / ts / camera 的 Broker 都可以输出 TS
+	r.GET("/live/ts/:brokerKey", auth, playHook, budget, tsClient.LiveTS(flvBroadcastPool, cameraBroadcastPool))
+
+	// ws://127.0.0.1:8080/live/ws/test1/client1
+	// WebSocket-FLV 拉流接口（flv.js 直接使用 ws:// 地址），flv / ts / camera 的 Broker 都可以输出
+	r.GET("/live/ws/:brokerKey/:clientId", auth, playHook, budget, wsClient.LiveWS(flvBroadcastPool, cameraBroadcastPool))
+
+	// http://127.0.0.1:8080/live/info/test-ts
+	// 查询直播的编码参数、分辨率、帧率、码率和 GOP 长度
+	r.GET("/live/info/:brokerKey", auth, infoClient.LiveInfo(flvBroadcastPool, hlsBroadcastPool, cameraBroadcastPool))
+
+	// http://127.0.0.1:8080/live/stats/test-ts
+	// 查询直播的运行统计和健康事件（断流、时间戳跳变、关键帧间隔异常、音视频不同步、缺少序列头）
+	r.GET("/live/stats/:brokerKey", auth, infoClient.LiveStats(flvBroadcastPool, hlsBroadcastPool, cameraBroadcastPool))
+
+	// http://127.0.0.1:8080/live/memory
+	// 查询内存预算和各路流缓存占用的内存
+	r.GET("/live/memory", auth, infoClient.LiveMemory())
+
+	// http://127.0.0.1:8080/live/cluster/test1
+	// 查询 brokerKey 的 origin 和故障转移顺序
+	r.GET("/live/cluster/:brokerKey", auth, infoClient.LiveCluster(flvCluster))
+
+	// ============== push ==============, 把任意一个 broker 再转推到其他服务器（RTMP / HTTP-FLV POST / 另一个 pull2push 的 ingest）
+	// 配置文件里 streams[].push 声明的目标随配置热更新，这里运行时增删的目标不受影响；增删目标只认管理 token
+	r.GET("/live/push/:brokerKey", auth, pushClient.ListPush(pushManager))
+	r.POST("/live/push/:brokerKey", admin, pushClient.AddPush(pushManager, store))
+	r.DELETE("/live/push/:brokerKey/:targetId", admin, pushClient.RemovePush(pushManager))
+
+	// ============== clips ==============, 直播过程中从缓存里剪出片段，导出成 MP4 / FLV 文件，能往前剪多久由流配置的 cache.clip_window 决定
+	// curl -X POST http://127.0.0.1:8080/live/clips -d '{"brokerKey": "test1", "start": "-30s", "end": "now", "format": "mp4"}'
+	// 返回任务编号，GET /live/clips/:id 查询进度，完成后 data.url 是下载地址
+	r.POST("/live/clips", auth, clipClient.ExportClip(clipManager))
+	r.GET("/live/clips", auth, clipClient.ListClips(clipManager))
+	r.GET("/live/clips/:id", auth, clipClient.GetClip(clipManager))
+	r.GET("/live/clips/:id/file", auth, clipClient.DownloadClip(clipManager))
+	r.DELETE("/live/clips/:id", auth, clipClient.RemoveClip(clipManager))
+
+	// ============== sessions ==============, 服务端分配的观看会话：观众地址、UA、协议、开始时间、已发送字节数
+	// http://127.0.0.1:8080/live/sessions?broker=test1
+	r.GET("/live/sessions", admin, adminClient.ListSessions(session.Default))
+	// 踢出观众，原因取 ?reason= 或 {"reason": "..."}，通过关闭信号带给客户端（ws 的 close 帧、hls 的 403）
+	r.DELETE("/live/sessions/:id", admin, adminClient.KickSession(session.Default))
+
+	// ============== admin ==============, 内置管理后台：直播列表、实时统计、观众、踢人 / 停止 / 切换上游、flv.js / hls.js 预览
+	// http://127.0.0.1:8080/console/
+	r.GET("/console/*filepath", adminClient.Console())
+	r.GET("/live/admin/brokers", admin, adminClient.ListBrokers(streamManager, pushManager))
+	r.DELETE("/live/admin/brokers/:brokerKey/clients/:clientId", admin, adminClient.KickClient(streamManager))
+	r.POST("/live/admin/brokers/:brokerKey/stop", admin, adminClient.StopBroker(streamManager))
+	r.POST("/live/admin/brokers/:brokerKey/switch", admin, adminClient.SwitchBroker(streamManager, store))
+
+	// 同时监听配置里的所有地址，任意一个失败就退出
+	errCh := make(chan error, len(cfg.HTTP.Listen))
+	for _, addr := range cfg.HTTP.Listen {
+		server := &http.Server{Addr: addr, Handler: r}
+		go func() {
+			log.Println("listening on", addr)
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}()
+	}
+	log.Fatal(<-errCh)
+}
 
-	log.Println("listening on :8080")
-	if err := r.Run(":8080"); err != nil {
-		log.Fatal(err)
+// sessionLimits 配置里的观众准入限制
+func sessionLimits(l config.LimitsConfig) session.Limits {
+	return session.Limits{
+		MaxViewers:          l.MaxViewers,
+		MaxViewersPerBroker: l.MaxViewersPerStream,
+		MaxBandwidth:        int64(l.MaxBandwidth),
+		MaxSessionsPerToken: l.MaxSessionsPerToken,
+		Redirect:            l.Redirect,
 	}
 }
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/config"
+	"slices"
+	"strings"
+)
+
+// clusterPeerKey 带 cluster.token 的请求在 gin.Context 里的标记，见 IsClusterPeer
+const clusterPeerKey = "clusterPeer"
+
+// AuthMiddleware 拉流/推流鉴权，每次请求都读取当前生效的配置，热更新 tokens 后立即生效
+// token 通过 ?token=xxx 或者 Authorization: Bearer xxx 传递；集群里其他节点拉流时带的是 cluster.token
+func AuthMiddleware(store *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := store.Load()
+		token := RequestToken(c)
+		if token != "" && token == cfg.Cluster.Token {
+			c.Set(clusterPeerKey, true)
+			c.Next()
+			return
+		}
+
+		auth := cfg.Auth
+		if !auth.Enabled {
+			c.Next()
+			return
+		}
+
+		if token != "" && slices.Contains(auth.Tokens, token) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "token 无效",
+		})
+	}
+}
+
+// AdminMiddleware 管理接口鉴权，只认 admin.tokens，拉流的 token 不能停止直播、踢人、切换上游
+// 没有配置 admin.tokens 时：auth 关闭则不鉴权（本机调试），auth 开启则拒绝所有管理请求
+func AdminMiddleware(store *config.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := store.Load()
+		if len(cfg.Admin.Tokens) == 0 {
+			if !cfg.Auth.Enabled {
+				c.Next()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"code": 403,
+				"msg":  "没有配置 admin.tokens，管理接口已关闭",
+			})
+			return
+		}
+
+		if token := RequestToken(c); token != "" && slices.Contains(cfg.Admin.Tokens, token) {
+			c.Next()
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"code": 401,
+			"msg":  "管理 token 无效",
+		})
+	}
+}
+
+// IsClusterPeer 请求是否来自集群里的其他节点，edge 从 origin 拉流不算观众，不受准入限制
+func IsClusterPeer(c *gin.Context) bool {
+	return c.GetBool(clusterPeerKey)
+}
+
+// RequestToken 请求携带的 token，没有时返回空串
+func RequestToken(c *gin.Context) string {
+	if token := c.Query("token"); token != "" {
+		return token
+	}
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	return ""
+}
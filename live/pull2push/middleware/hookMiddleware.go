@@ -0,0 +1,120 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"pull2push/config"
+	"time"
+)
+
+// 回调事件
+const (
+	HookEventPlay      = "on_play"
+	HookEventStop      = "on_stop"
+	HookEventPublish   = "on_publish"
+	HookEventUnpublish = "on_unpublish"
+)
+
+// HookPayload 回调时 POST 的 JSON
+type HookPayload struct {
+	Event     string `json:"event"`
+	BrokerKey string `json:"brokerKey"`
+	ClientId  string `json:"clientId,omitempty"`
+	ClientIP  string `json:"clientIP"`
+	Path      string `json:"path"`
+	Time      int64  `json:"time"`
+}
+
+// PlayHookMiddleware 拉流前回调 on_play，返回非 2xx 时拒绝；处理函数返回（观众断开）后异步回调 on_stop
+// 只用于长连接的拉流接口，hls 每个分片都是一次请求，不适合挂这个中间件
+func PlayHookMiddleware(store *config.Store) gin.HandlerFunc {
+	return hookMiddleware(store, HookEventPlay, HookEventStop)
+}
+
+// PublishHookMiddleware 推流前回调 on_publish，返回非 2xx 时拒绝；推流结束后异步回调 on_unpublish
+func PublishHookMiddleware(store *config.Store) gin.HandlerFunc {
+	return hookMiddleware(store, HookEventPublish, HookEventUnpublish)
+}
+
+func hookMiddleware(store *config.Store, startEvent, endEvent string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hooks := store.Load().Hooks
+		payload := HookPayload{
+			BrokerKey: c.Param("brokerKey"),
+			ClientId:  c.Param("clientId"),
+			ClientIP:  c.ClientIP(),
+			Path:      c.Request.URL.Path,
+		}
+
+		if url := hookURL(hooks, startEvent); url != "" {
+			payload.Event = startEvent
+			if err := callHook(c.Request.Context(), url, hooks.Timeout, payload); err != nil {
+				log.Printf("[hook] %s %s rejected: %v", startEvent, payload.BrokerKey, err)
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+					"code": 403,
+					"msg":  fmt.Sprintf("%s 回调拒绝: %v", startEvent, err),
+				})
+				return
+			}
+		}
+
+		c.Next()
+
+		// 结束事件读取处理结束时的配置，期间可能已经热更新
+		hooks = store.Load().Hooks
+		if url := hookURL(hooks, endEvent); url != "" {
+			payload.Event = endEvent
+			go func() {
+				if err := callHook(context.Background(), url, hooks.Timeout, payload); err != nil {
+					log.Printf("[hook] %s %s failed: %v", endEvent, payload.BrokerKey, err)
+				}
+			}()
+		}
+	}
+}
+
+func hookURL(hooks config.HooksConfig, event string) string {
+	switch event {
+	case HookEventPlay:
+		return hooks.OnPlay
+	case HookEventStop:
+		return hooks.OnStop
+	case HookEventPublish:
+		return hooks.OnPublish
+	case HookEventUnpublish:
+		return hooks.OnUnpublish
+	}
+	return ""
+}
+
+// callHook POST 回调，非 2xx 返回 error
+func callHook(ctx context.Context, url string, timeout time.Duration, payload HookPayload) error {
+	payload.Time = time.Now().UnixMilli()
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
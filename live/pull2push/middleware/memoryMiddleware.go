@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"pull2push/core/memory"
+)
+
+// MemoryBudgetMiddleware 进程内存预算已经用完时拒绝新观众，已经在看的观众不受影响
+// 只用于长连接的拉流接口，hls 每个分片都是一次请求，拒绝分片会让已经在看的观众卡住
+func MemoryBudgetMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := memory.Default.Admit(0); err != nil {
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{
+				"code": 503,
+				"msg":  err.Error(),
+			})
+			return
+		}
+		c.Next()
+	}
+}